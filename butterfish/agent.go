@@ -0,0 +1,697 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/bakks/tiktoken-go"
+	"github.com/sashabaranov/go-openai/jsonschema"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// An Agent pursues a goal by asking the LLM for one step at a time and
+// carrying it out: running a command, asking the user a question, calling a
+// custom tool, or finishing. This is the loop behind goal mode without the
+// shell, so that other programs can run it headlessly with their own executor
+// and tools. Goal mode in the shell shares the function definitions and
+// parsing below but drives the steps from the PTY.
+//
+// Example:
+//
+//	agent := bf.NewAgent(llm, &bf.LocalExecutor{Out: os.Stdout}, "gpt-4o")
+//	agent.Confirm = func(ctx context.Context, cmd string) (string, bool, error) {
+//		return cmd, cmd != "rm -rf /", nil
+//	}
+//	result, err := agent.Run(ctx, "Find the largest file in this directory")
+
+const (
+	agentTemperature    = 0.6
+	agentResponseTokens = 1024
+)
+
+// Runs the commands an Agent chooses
+type AgentExecutor interface {
+	// Run a command and return its output and exit status, a non-zero status
+	// is not an error
+	Execute(ctx context.Context, cmd string) (string, int, error)
+}
+
+// Runs commands locally with /bin/sh, streaming their output to Out if set
+type LocalExecutor struct {
+	Out io.Writer
+}
+
+func (this *LocalExecutor) Execute(ctx context.Context, cmd string) (string, int, error) {
+	out := this.Out
+	if out == nil {
+		out = io.Discard
+	}
+
+	result, err := executeCommand(ctx, cmd, out)
+	if err != nil {
+		return "", 0, err
+	}
+	return string(result.LastOutput), result.Status, nil
+}
+
+// A function the agent can call in addition to the built in ones
+type AgentTool struct {
+	Definition util.FunctionDefinition
+	// Called with the model's JSON arguments, the result is sent back to the
+	// model. An error is also sent back rather than stopping the agent.
+	Run func(ctx context.Context, params string) (string, error)
+}
+
+type AgentResult struct {
+	// The agent called finish
+	Finished bool `json:"finished"`
+	// Whether the agent says it accomplished the goal
+	Success bool `json:"success"`
+	// Set if the agent stopped to ask a question because there's no AskUser,
+	// answer it with Continue
+	Question string `json:"question,omitempty"`
+	// Number of LLM requests made
+	Steps int `json:"steps"`
+	// Set if the agent stopped because it reached one of its Limits
+	Limit string `json:"limit,omitempty"`
+	// What a sub-agent reported when it finished
+	Summary string `json:"summary,omitempty"`
+}
+
+const (
+	// The model's text output, if it wrote any
+	AgentEventOutput = "output"
+	// The model called a function
+	AgentEventFunctionCall = "function_call"
+	// A command was approved or declined
+	AgentEventCommand = "command"
+	// A command finished, with its output and exit status
+	AgentEventExit = "exit"
+)
+
+// A step taken by the agent, passed to OnEvent as it happens
+type AgentEvent struct {
+	Type string `json:"type"`
+	// The LLM request the event belongs to, starting at 1
+	Step       int    `json:"step"`
+	Output     string `json:"output,omitempty"`
+	Function   string `json:"function,omitempty"`
+	Parameters string `json:"parameters,omitempty"`
+	Command    string `json:"command,omitempty"`
+	Declined   bool   `json:"declined,omitempty"`
+	Status     *int   `json:"status,omitempty"`
+	// Set for events from a sub-agent, numbered from 1
+	Task int `json:"task,omitempty"`
+}
+
+type Agent struct {
+	LLM      LLM
+	Executor AgentExecutor
+	Model    string
+	// Template for the system message, must contain {goal} and {sysinfo}
+	SystemMessage string
+	Temperature   float32
+	// Tokens reserved for each response
+	MaxResponseTokens int
+	// Limit for each request, 0 means the model's context window
+	MaxPromptTokens int
+	// Limit for each block of history, e.g. a long command output
+	MaxHistoryBlockTokens int
+	// Stop after this many LLM requests, 0 means no limit
+	MaxSteps int
+	// After reaching one of these the agent can only ask the user or finish
+	Limits GoalLimits
+	// Stop after this many failed commands in a row, 0 means no limit
+	MaxFailedCommands int
+	RequestLimits     RequestLimits
+
+	// Commands run without confirmation only if Unsafe is set, otherwise
+	// Confirm is called with each command and can edit or reject it
+	Unsafe  bool
+	Confirm func(ctx context.Context, cmd string) (string, bool, error)
+	// Answers the agent's questions, if nil Run returns the question instead
+	AskUser func(ctx context.Context, question string) (string, error)
+
+	// Custom functions, offered alongside command, user_input, and finish
+	Tools []*AgentTool
+	// Runs sub-agents for spawn_task, which is only offered if this is set
+	Manager *AgentManager
+	// Providers for {sysinfo} about the current directory, if nil only the OS
+	// is included
+	SystemInfo *SystemInfo
+	// Env var name patterns env_info reports on top of DefaultSessionEnvVars
+	EnvVars []string
+
+	// The conversation so far, kept between calls so that Continue works
+	History *ShellHistory
+	// Counts tokens for the history, if nil they're estimated from bytes
+	Encoder *tiktoken.Tiktoken
+	// Receives the model's streamed output, may be nil
+	Out     io.Writer
+	Verbose bool
+	// Called with each step as it happens, e.g. to write a transcript
+	OnEvent func(event *AgentEvent)
+	// pre_command hooks can block commands after they're approved, may be nil
+	Hooks *Hooks
+
+	goal  string
+	step  int
+	usage *GoalUsage
+	// set for sub-agents, which report back with finish
+	subtask bool
+	// set to the profile name if the profile disables unsafe mode
+	unsafeDisabledBy string
+	// confirms commands and counts failures, shared with exec
+	repair CommandRepair
+}
+
+// Create an agent with the default goal mode system message and limits
+func NewAgent(llm LLM, executor AgentExecutor, model string) *Agent {
+	sysMsg := ""
+	for _, p := range prompt.DefaultPrompts {
+		if p.Name == prompt.GoalModeSystemMessage {
+			sysMsg = p.Prompt
+		}
+	}
+
+	return &Agent{
+		LLM:                   llm,
+		Executor:              executor,
+		Model:                 model,
+		SystemMessage:         sysMsg,
+		Temperature:           agentTemperature,
+		MaxResponseTokens:     agentResponseTokens,
+		MaxHistoryBlockTokens: 1024,
+		MaxFailedCommands:     DefaultMaxFixAttempts,
+		RequestLimits:         DefaultRequestLimits()[FeatureAgent],
+		History:               NewShellHistory(),
+	}
+}
+
+// Create an agent using this context's LLM client, models, prompt library,
+// request limits, and profile policy
+func (this *ButterfishCtx) NewAgent(executor AgentExecutor) (*Agent, error) {
+	sysMsg, err := this.PromptLibrary.GetUninterpolatedPromptForModel(
+		prompt.GoalModeSystemMessage, this.Config.ShellPromptModel)
+	if err != nil {
+		return nil, err
+	}
+
+	agent := NewAgent(this.LLMClient, executor, this.Config.ShellPromptModel)
+	agent.SystemMessage = sysMsg
+	agent.MaxPromptTokens = this.Config.ShellMaxPromptTokens
+	if this.Config.ShellMaxHistoryBlockTokens > 0 {
+		agent.MaxHistoryBlockTokens = this.Config.ShellMaxHistoryBlockTokens
+	}
+	agent.RequestLimits = this.Config.RequestLimits[FeatureAgent]
+	agent.MaxFailedCommands = this.Config.MaxFixAttempts
+	agent.Limits = this.Config.GoalLimits
+	if this.Config.MaxSubagents > 0 {
+		agent.Manager = NewAgentManager(this.Config.MaxSubagents)
+	}
+	agent.SystemInfo = NewSystemInfo(this.Config.SystemInfo)
+	agent.EnvVars = this.Config.ShellSessionEnvVars
+	agent.Verbose = this.Config.Verbose > 0
+	agent.Hooks = this.Hooks
+	if profile := this.Config.Profile; profile != nil && profile.DisableUnsafeGoalMode {
+		agent.unsafeDisabledBy = profile.Name
+	}
+	return agent, nil
+}
+
+// Work towards the goal until the agent finishes, asks a question nobody can
+// answer, or the context is cancelled
+func (this *Agent) Run(ctx context.Context, goal string) (*AgentResult, error) {
+	this.goal = goal
+	// sub-agents already share their parent's usage
+	if !this.subtask || this.usage == nil {
+		this.usage = NewGoalUsage(this.Limits)
+	}
+	return this.loop(ctx, "Start now.")
+}
+
+// Continue after Run returned a question, or with further instructions after
+// the agent finished. Limits still count from the start of Run.
+func (this *Agent) Continue(ctx context.Context, message string) (*AgentResult, error) {
+	if this.goal == "" {
+		return nil, errors.New("The agent has no goal, call Run first")
+	}
+	return this.loop(ctx, message)
+}
+
+func (this *Agent) validate() error {
+	if this.LLM == nil {
+		return errors.New("The agent has no LLM")
+	}
+	if this.Executor == nil {
+		return errors.New("The agent has no executor")
+	}
+	if this.Unsafe && this.unsafeDisabledBy != "" {
+		return fmt.Errorf("Unsafe goal mode is disabled by profile %s", this.unsafeDisabledBy)
+	}
+	if !this.Unsafe && this.Confirm == nil {
+		return errors.New("The agent needs a Confirm function unless Unsafe is set")
+	}
+
+	for _, tool := range this.Tools {
+		for _, function := range this.builtinFunctions() {
+			if tool.Definition.Name == function.Name {
+				return fmt.Errorf("Tool %s has the same name as a built in function", function.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (this *Agent) builtinFunctions() []util.FunctionDefinition {
+	functions := []util.FunctionDefinition{}
+	for _, function := range goalModeFunctions {
+		if this.subtask && function.Name == subtaskFinishFunction.Name {
+			function = subtaskFinishFunction
+		}
+		functions = append(functions, function)
+	}
+	if this.Manager != nil {
+		functions = append(functions, spawnTaskFunction)
+	}
+	return functions
+}
+
+// The functions offered to the model, only those that stop the goal once a
+// limit has been reached
+func (this *Agent) functions(stopping bool) []util.FunctionDefinition {
+	functions := []util.FunctionDefinition{}
+	for _, function := range this.builtinFunctions() {
+		if !stopping || isGoalStopFunction(function.Name) {
+			functions = append(functions, function)
+		}
+	}
+	if !stopping {
+		for _, tool := range this.Tools {
+			functions = append(functions, tool.Definition)
+		}
+	}
+	return functions
+}
+
+func (this *Agent) tool(name string) *AgentTool {
+	for _, tool := range this.Tools {
+		if tool.Definition.Name == name {
+			return tool
+		}
+	}
+	return nil
+}
+
+func (this *Agent) loop(ctx context.Context, message string) (*AgentResult, error) {
+	err := this.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	// templated prompts can check {{if .functions}} for tool guidance
+	functionNames := []string{}
+	for _, function := range this.functions(false) {
+		functionNames = append(functionNames, function.Name)
+	}
+	sysInfo := GetSystemInfo()
+	if this.SystemInfo != nil {
+		dir, _ := os.Getwd()
+		sysInfo = this.SystemInfo.Get(ctx, dir)
+	}
+	sysMsg, err := prompt.Interpolate(this.SystemMessage,
+		"goal", this.goal,
+		"sysinfo", sysInfo,
+		"functions", strings.Join(functionNames, ", "))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &AgentResult{}
+	for {
+		if this.MaxSteps > 0 && result.Steps >= this.MaxSteps {
+			return result, fmt.Errorf("The agent didn't finish within %d steps", this.MaxSteps)
+		}
+		result.Steps++
+		this.step = result.Steps
+
+		limit := this.usage.Reach()
+		if limit != "" {
+			message = goalLimitMessage(message, limit)
+		}
+		output, err := this.request(ctx, sysMsg, message, limit != "")
+		if err != nil {
+			return result, err
+		}
+		message = ""
+
+		if output.Refusal != "" {
+			this.History.RemoveLastPrompt()
+			return result, fmt.Errorf("The model refused: %s", output.Refusal)
+		}
+		this.History.Append(historyTypeLLMOutput, output.Completion)
+		if output.Completion != "" {
+			this.emit(&AgentEvent{Type: AgentEventOutput, Output: output.Completion})
+		}
+		if output.FunctionName != "" {
+			this.History.AddFunctionCall(output.FunctionName, output.FunctionParameters)
+			this.emit(&AgentEvent{
+				Type:       AgentEventFunctionCall,
+				Function:   output.FunctionName,
+				Parameters: output.FunctionParameters,
+			})
+		}
+
+		if limit != "" && !isGoalStopFunction(output.FunctionName) {
+			return result, fmt.Errorf("The agent didn't stop after reaching %s", limit)
+		}
+		result.Limit = limit
+
+		if output.FunctionName == spawnTaskFunction.Name && this.Manager != nil {
+			response := this.spawnTasks(ctx, output.FunctionParameters)
+			this.History.AppendFunctionOutput(output.FunctionName, response)
+			continue
+		}
+
+		if tool := this.tool(output.FunctionName); tool != nil {
+			response, err := tool.Run(ctx, output.FunctionParameters)
+			if err != nil {
+				response = fmt.Sprintf("Error: %s", err)
+			}
+			this.History.AppendFunctionOutput(output.FunctionName, response)
+			continue
+		}
+
+		action := parseAgentAction(output)
+		switch action.Kind {
+		case agentActionCommand:
+			err = this.runCommand(ctx, action.Command)
+			if err != nil {
+				return result, err
+			}
+
+		case agentActionUserInput:
+			if this.AskUser == nil {
+				result.Question = action.Question
+				return result, nil
+			}
+			answer, err := this.AskUser(ctx, action.Question)
+			if err != nil {
+				return result, err
+			}
+			message = answer
+
+		case agentActionFinish:
+			result.Finished = true
+			result.Success = action.Success
+			result.Summary = action.Summary
+			return result, nil
+
+		case agentActionEnvInfo:
+			dir, _ := os.Getwd()
+			this.History.AppendFunctionOutput(output.FunctionName,
+				envInfoOutput(ctx, dir, this.EnvVars))
+
+		case agentActionNone:
+			this.History.Append(historyTypePrompt, action.Error)
+
+		default:
+			this.History.AppendFunctionOutput(output.FunctionName, action.Error)
+		}
+	}
+}
+
+func (this *Agent) runCommand(ctx context.Context, cmd string) error {
+	this.repair.Policy = PolicyConfirm
+	if this.Unsafe {
+		this.repair.Policy = PolicyAuto
+	}
+	this.repair.Confirm = this.Confirm
+	this.repair.MaxAttempts = this.MaxFailedCommands
+
+	cmd, ok, err := this.repair.Approve(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	var veto error
+	if ok {
+		veto = this.Hooks.PreCommand(ctx, cmd, "")
+	}
+	this.emit(&AgentEvent{Type: AgentEventCommand, Command: cmd, Declined: !ok || veto != nil})
+	if !ok {
+		this.History.AppendFunctionOutput("command", "The user declined to run this command.")
+		return nil
+	}
+	if veto != nil {
+		this.History.AppendFunctionOutput("command", veto.Error())
+		return nil
+	}
+
+	if !this.usage.StartCommand() {
+		this.History.AppendFunctionOutput("command",
+			goalLimitMessage("The command wasn't run.", fmt.Sprintf("the limit of %d commands", this.Limits.MaxCommands)))
+		return nil
+	}
+
+	log.Printf("Agent command: %s", cmd)
+	output, status, err := this.Executor.Execute(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	this.emit(&AgentEvent{Type: AgentEventExit, Command: cmd, Output: output, Status: &status})
+
+	this.History.AppendFunctionOutput("command", output)
+	this.History.AppendFunctionOutput("command", fmt.Sprintf("Exit Code: %d\n", status))
+	return this.repair.Record(status)
+}
+
+func (this *Agent) emit(event *AgentEvent) {
+	if this.OnEvent == nil {
+		return
+	}
+	event.Step = this.step
+	this.OnEvent(event)
+}
+
+func (this *Agent) request(ctx context.Context, sysMsg, message string, stopping bool) (*util.CompletionResponse, error) {
+	functions := this.functions(stopping)
+	functionsBytes, err := json.Marshal(functions)
+	if err != nil {
+		return nil, err
+	}
+
+	contextWindow := NumTokensForModel(this.Model)
+	maxTokens := contextWindow
+	if this.MaxPromptTokens > 0 {
+		maxTokens = min(maxTokens, this.MaxPromptTokens)
+	}
+	maxTokens -= this.MaxResponseTokens
+
+	var historyBlocks []util.HistoryBlock
+	if this.Encoder != nil {
+		message, historyBlocks, err = assembleChat(message, sysMsg,
+			string(functionsBytes), this.History, this.Model, this.Encoder, 512,
+			this.MaxHistoryBlockTokens, maxTokens, isSmallContext(contextWindow))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// roughly 4 bytes per token
+		used := len(message) + len(sysMsg) + len(functionsBytes)
+		historyBlocks = historyBlocksByBytes(this.History,
+			this.MaxHistoryBlockTokens*4, maxTokens*4-used)
+	}
+
+	if message != "" {
+		this.History.Append(historyTypePrompt, message)
+	}
+
+	request := &util.CompletionRequest{
+		Ctx:           ctx,
+		Prompt:        message,
+		Model:         this.Model,
+		MaxTokens:     this.MaxResponseTokens,
+		Temperature:   this.Temperature,
+		HistoryBlocks: historyBlocks,
+		SystemMessage: sysMsg,
+		Functions:     functions,
+		Verbose:       this.Verbose,
+		Timeout:       this.RequestLimits.Timeout,
+		Retries:       this.RequestLimits.Retries,
+	}
+
+	out := this.Out
+	if out == nil {
+		out = io.Discard
+	}
+	response, err := this.LLM.CompletionStream(request, out)
+	if response != nil {
+		this.usage.AddTokens(estimateRequestTokens(request) + estimateResponseTokens(response))
+	}
+	return response, err
+}
+
+// The most recent history blocks that fit in maxBytes, each truncated to
+// maxBlockBytes, for when we don't have an encoder to count tokens
+func historyBlocksByBytes(history *ShellHistory, maxBlockBytes, maxBytes int) []util.HistoryBlock {
+	blocks := []util.HistoryBlock{}
+	history.IterateBlocks(func(block *HistoryBuffer) bool {
+		content := sanitizeTTYString(block.Content.String())
+		if len(content) > maxBlockBytes {
+			content = content[:maxBlockBytes]
+		}
+
+		size := len(content) + len(block.FunctionName) + len(block.FunctionParams)
+		if size > maxBytes {
+			return false
+		}
+		maxBytes -= size
+
+		blocks = append([]util.HistoryBlock{{
+			Type:           block.Type,
+			Content:        content,
+			FunctionName:   block.FunctionName,
+			FunctionParams: block.FunctionParams,
+		}}, blocks...)
+		return true
+	})
+	return blocks
+}
+
+const (
+	agentActionNone = iota
+	agentActionCommand
+	agentActionUserInput
+	agentActionFinish
+	agentActionEnvInfo
+	agentActionInvalid
+)
+
+// A step chosen by the model through one of the goal mode functions
+type agentAction struct {
+	Kind     int
+	Command  string
+	Question string
+	Success  bool
+	Summary  string
+	// For agentActionNone and agentActionInvalid, what to tell the model
+	Error string
+}
+
+// Interpret a goal mode response, errors are returned as an action with a
+// message for the model so that it can try again
+func parseAgentAction(output *util.CompletionResponse) *agentAction {
+	var err error
+	action := &agentAction{}
+
+	switch output.FunctionName {
+	case "command":
+		action.Kind = agentActionCommand
+		action.Command, err = parseCommandParams(output.FunctionParameters)
+	case "user_input":
+		action.Kind = agentActionUserInput
+		action.Question, err = parseUserInputParams(output.FunctionParameters)
+	case "finish":
+		action.Kind = agentActionFinish
+		var params *FinishParams
+		params, err = parseFinishParams(output.FunctionParameters)
+		if err == nil {
+			action.Success = params.Success
+			action.Summary = params.Summary
+		}
+	case envInfoFunction.Name:
+		action.Kind = agentActionEnvInfo
+		return action
+	case "":
+		action.Kind = agentActionNone
+		action.Error = "You must call a function in goal mode responses."
+		return action
+	default:
+		log.Printf("Invalid function name called in goal mode: %s", output.FunctionName)
+		action.Kind = agentActionInvalid
+		action.Error = fmt.Sprintf("Invalid function name: %s", output.FunctionName)
+		return action
+	}
+
+	if err != nil {
+		// we failed to parse the json, send the error back to the model
+		log.Printf("Error parsing function arguments: %s", err)
+		return &agentAction{
+			Kind:  agentActionInvalid,
+			Error: fmt.Sprintf("Error parsing your json, try again: %s", err),
+		}
+	}
+	return action
+}
+
+var goalModeFunctions = []util.FunctionDefinition{
+	{
+		Name:        "command",
+		Description: "Run a command in the shell to help achieve your goal",
+		Parameters: jsonschema.Definition{
+			Type: jsonschema.Object,
+			Properties: map[string]jsonschema.Definition{
+				"cmd": {
+					Type:        jsonschema.String,
+					Description: "The string command including any arguments, for example 'ls ~'",
+				},
+			},
+			Required: []string{"cmd"},
+		},
+	},
+
+	{
+		Name:        "user_input",
+		Description: "Resolve an ambiguity in the goal or provide additional information or hand off a goal that can't be accomplished to the user.",
+		Parameters: jsonschema.Definition{
+			Type: jsonschema.Object,
+			Properties: map[string]jsonschema.Definition{
+				"question": {
+					Type:        jsonschema.String,
+					Description: "The question to ask the user",
+				},
+			},
+			Required: []string{"question"},
+		},
+	},
+
+	{
+		Name:        "finish",
+		Description: "Finish the goal and exit goal mode, call only if the goal is accomplished or multiple strategies have been attempted and the goal is impossible.",
+		Parameters: jsonschema.Definition{
+			Type: jsonschema.Object,
+			Properties: map[string]jsonschema.Definition{
+				"success": {
+					Type:        jsonschema.Boolean,
+					Description: "Whether the goal was accomplished",
+				},
+			},
+			Required: []string{"success"},
+		},
+	},
+
+	envInfoFunction,
+}
+
+var goalModeFunctionsString string
+
+// serialize goalModeFunctions to json and cache in goalModeFunctionsString
+func getGoalModeFunctionsString() string {
+	if goalModeFunctionsString == "" {
+		bytes, err := json.Marshal(goalModeFunctions)
+		if err != nil {
+			log.Fatal(err)
+		}
+		goalModeFunctionsString = string(bytes)
+		log.Printf("goalModeFunctionsString: %s", goalModeFunctionsString)
+	}
+	return goalModeFunctionsString
+}
@@ -0,0 +1,179 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Returns each of its responses in turn, then finishes
+type functionCallLLM struct {
+	responses []*util.CompletionResponse
+	requests  []*util.CompletionRequest
+}
+
+func (this *functionCallLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	return this.Completion(request)
+}
+
+func (this *functionCallLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	this.requests = append(this.requests, request)
+	if len(this.requests) > len(this.responses) {
+		return callFunction("finish", `{"success": false}`), nil
+	}
+	return this.responses[len(this.requests)-1], nil
+}
+
+func (this *functionCallLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	return nil, nil
+}
+
+func callFunction(name, params string) *util.CompletionResponse {
+	return &util.CompletionResponse{FunctionName: name, FunctionParameters: params}
+}
+
+type fakeExecutor struct {
+	commands []string
+}
+
+func (this *fakeExecutor) Execute(ctx context.Context, cmd string) (string, int, error) {
+	this.commands = append(this.commands, cmd)
+	if strings.HasPrefix(cmd, "false") {
+		return "", 1, nil
+	}
+	return "output of " + cmd, 0, nil
+}
+
+func lastHistoryBlock(request *util.CompletionRequest) util.HistoryBlock {
+	return request.HistoryBlocks[len(request.HistoryBlocks)-1]
+}
+
+func TestAgentUnsafe(t *testing.T) {
+	llm := &functionCallLLM{responses: []*util.CompletionResponse{
+		callFunction("command", `{"cmd": "ls"}`),
+		callFunction("command", `{"cmd": "false"}`),
+		callFunction("finish", `{"success": true}`),
+	}}
+	executor := &fakeExecutor{}
+
+	agent := NewAgent(llm, executor, "gpt-4o")
+	agent.Unsafe = true
+	result, err := agent.Run(context.Background(), "list files")
+	assert.NoError(t, err)
+	assert.Equal(t, &AgentResult{Finished: true, Success: true, Steps: 3}, result)
+	assert.Equal(t, []string{"ls", "false"}, executor.commands)
+
+	assert.Equal(t, "Start now.", llm.requests[0].Prompt)
+	assert.Contains(t, llm.requests[0].SystemMessage, "list files")
+	assert.Equal(t, "output of lsExit Code: 0\n", lastHistoryBlock(llm.requests[1]).Content)
+	assert.Equal(t, "Exit Code: 1\n", lastHistoryBlock(llm.requests[2]).Content)
+	assert.Equal(t, agent.RequestLimits.Timeout, llm.requests[0].Timeout)
+}
+
+func TestAgentConfirmAndQuestions(t *testing.T) {
+	llm := &functionCallLLM{responses: []*util.CompletionResponse{
+		callFunction("command", `{"cmd": "rm -rf build"}`),
+		callFunction("command", `{"cmd": "make"}`),
+		callFunction("user_input", `{"question": "Which target?"}`),
+		callFunction("command", `{"cmd": "make test"}`),
+		callFunction("command", `not json`),
+		{Completion: "I forgot to call a function"},
+		callFunction("finish", `{"success": true}`),
+	}}
+	executor := &fakeExecutor{}
+
+	agent := NewAgent(llm, executor, "gpt-4o")
+	_, err := agent.Run(context.Background(), "build it")
+	assert.Error(t, err)
+
+	confirmed := []string{}
+	agent.Confirm = func(ctx context.Context, cmd string) (string, bool, error) {
+		confirmed = append(confirmed, cmd)
+		return cmd + " -j4", !strings.HasPrefix(cmd, "rm"), nil
+	}
+
+	// no AskUser, so the agent stops with the question
+	result, err := agent.Run(context.Background(), "build it")
+	assert.NoError(t, err)
+	assert.Equal(t, "Which target?", result.Question)
+	assert.False(t, result.Finished)
+	assert.Equal(t, []string{"make -j4"}, executor.commands)
+	assert.Equal(t, "The user declined to run this command.", lastHistoryBlock(llm.requests[1]).Content)
+
+	result, err = agent.Continue(context.Background(), "the test target")
+	assert.NoError(t, err)
+	assert.True(t, result.Success)
+	assert.Equal(t, []string{"rm -rf build", "make", "make test"}, confirmed)
+	assert.Equal(t, "the test target", llm.requests[3].Prompt)
+	assert.Contains(t, lastHistoryBlock(llm.requests[5]).Content, "Error parsing your json")
+	assert.Equal(t, "You must call a function in goal mode responses.", lastHistoryBlock(llm.requests[6]).Content)
+}
+
+func TestAgentTools(t *testing.T) {
+	llm := &functionCallLLM{responses: []*util.CompletionResponse{
+		callFunction("lookup", `{"key": "a"}`),
+		callFunction("lookup", `{"key": "b"}`),
+		callFunction("unknown", `{}`),
+	}}
+
+	agent := NewAgent(llm, &fakeExecutor{}, "gpt-4o")
+	agent.Unsafe = true
+	agent.MaxSteps = 3
+	agent.Tools = []*AgentTool{{
+		Definition: util.FunctionDefinition{Name: "lookup"},
+		Run: func(ctx context.Context, params string) (string, error) {
+			if strings.Contains(params, "b") {
+				return "", errors.New("not found")
+			}
+			return "found a", nil
+		},
+	}}
+
+	result, err := agent.Run(context.Background(), "look things up")
+	assert.Error(t, err)
+	assert.Equal(t, 3, result.Steps)
+	assert.Equal(t, 5, len(llm.requests[0].Functions))
+	assert.Equal(t, "found a", lastHistoryBlock(llm.requests[1]).Content)
+	assert.Equal(t, "Error: not found", lastHistoryBlock(llm.requests[2]).Content)
+
+	agent.Tools[0].Definition.Name = "finish"
+	_, err = agent.Run(context.Background(), "look things up")
+	assert.Error(t, err)
+}
+
+func TestAgentLimits(t *testing.T) {
+	llm := &functionCallLLM{responses: []*util.CompletionResponse{
+		callFunction("command", `{"cmd": "ls"}`),
+		callFunction("finish", `{"success": false}`),
+	}}
+
+	agent := NewAgent(llm, &fakeExecutor{}, "gpt-4o")
+	agent.Unsafe = true
+	agent.Limits = GoalLimits{MaxCommands: 1}
+	result, err := agent.Run(context.Background(), "list files")
+	assert.NoError(t, err)
+	assert.Equal(t, &AgentResult{Finished: true, Steps: 2, Limit: "the limit of 1 commands"}, result)
+
+	assert.Len(t, llm.requests[0].Functions, 4)
+	assert.Equal(t, goalModeStopFunctions, llm.requests[1].Functions)
+	assert.Contains(t, llm.requests[1].Prompt, "You've reached the limit of 1 commands")
+
+	// carrying on after the limit stops the agent
+	llm = &functionCallLLM{responses: []*util.CompletionResponse{
+		callFunction("command", `{"cmd": "ls"}`),
+		callFunction("command", `{"cmd": "ls -la"}`),
+	}}
+	executor := &fakeExecutor{}
+	agent = NewAgent(llm, executor, "gpt-4o")
+	agent.Unsafe = true
+	agent.Limits = GoalLimits{MaxCommands: 1}
+	_, err = agent.Run(context.Background(), "list files")
+	assert.ErrorContains(t, err, "didn't stop after reaching the limit of 1 commands")
+	assert.Equal(t, []string{"ls"}, executor.commands)
+}
@@ -0,0 +1,197 @@
+package butterfish
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// butterfish agent runs goal mode from the command line, without the shell.
+// With --json each step is written to stdout as one JSON object per line,
+// ending with a result object, so that CI jobs can run the agent and check
+// what it did. Nobody is there to confirm commands or answer questions, so
+// commands either all run, as with --unsafe, or are checked against a policy
+// file like:
+//
+//	allow:
+//	  - ^go (build|test|vet)\b
+//	  - ^git (status|diff|log)\b
+//	deny:
+//	  - \brm\b
+//
+// A command runs if it matches an allow pattern and no deny pattern, other
+// commands are declined and the agent is told so.
+
+// Regular expressions deciding which commands the agent may run unattended
+type AgentPolicy struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+func LoadAgentPolicy(path string) (*AgentPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &AgentPolicy{}
+	err = yaml.UnmarshalStrict(data, policy)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse agent policy %s: %s", path, err)
+	}
+
+	compile := func(patterns []string) ([]*regexp.Regexp, error) {
+		compiled := []*regexp.Regexp{}
+		for _, pattern := range patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid pattern in agent policy %s: %s", path, err)
+			}
+			compiled = append(compiled, re)
+		}
+		return compiled, nil
+	}
+	if policy.allow, err = compile(policy.Allow); err != nil {
+		return nil, err
+	}
+	if policy.deny, err = compile(policy.Deny); err != nil {
+		return nil, err
+	}
+	if len(policy.allow) == 0 {
+		return nil, fmt.Errorf("Agent policy %s doesn't allow any commands", path)
+	}
+	return policy, nil
+}
+
+// Whether a command matches an allow pattern and no deny pattern
+func (this *AgentPolicy) Allows(cmd string) bool {
+	for _, re := range this.deny {
+		if re.MatchString(cmd) {
+			return false
+		}
+	}
+	for _, re := range this.allow {
+		if re.MatchString(cmd) {
+			return true
+		}
+	}
+	return false
+}
+
+// An Agent Confirm function that applies the policy
+func (this *AgentPolicy) Confirm(ctx context.Context, cmd string) (string, bool, error) {
+	return cmd, this.Allows(cmd), nil
+}
+
+// The last line of a --json transcript
+type agentResultEvent struct {
+	Type string `json:"type"`
+	*AgentResult
+	Error string `json:"error,omitempty"`
+}
+
+func (this *ButterfishCtx) agentCommand(options *CliCommandConfig) error {
+	opts := options.Agent
+	goal := strings.TrimSpace(strings.Join(opts.Goal, " "))
+	if goal == "" {
+		return errors.New("Please provide a goal for the agent")
+	}
+	if opts.Unsafe && opts.Policy != "" {
+		return errors.New("--unsafe and --policy can't be used together")
+	}
+
+	executor := &LocalExecutor{}
+	if !opts.Json {
+		executor.Out = this.Out
+	}
+	agent, err := this.NewAgent(executor)
+	if err != nil {
+		return err
+	}
+	agent.Unsafe = opts.Unsafe
+
+	if opts.Policy != "" {
+		policy, err := LoadAgentPolicy(opts.Policy)
+		if err != nil {
+			return err
+		}
+		agent.Confirm = policy.Confirm
+	}
+
+	var encoder *json.Encoder
+	if opts.Json {
+		// without a policy nothing would confirm commands
+		agent.Unsafe = agent.Unsafe || opts.Policy == ""
+		encoder = json.NewEncoder(this.Out)
+		agent.OnEvent = func(event *AgentEvent) {
+			encoder.Encode(event)
+		}
+	} else {
+		this.interactiveAgent(agent)
+	}
+
+	result, err := agent.Run(this.Ctx, goal)
+	if result == nil {
+		result = &AgentResult{}
+	}
+	if err == nil && !result.Success {
+		if result.Question != "" {
+			err = fmt.Errorf("The agent stopped to ask: %s", result.Question)
+		} else if result.Limit != "" {
+			err = fmt.Errorf("The agent stopped after reaching %s", result.Limit)
+		} else {
+			err = errors.New("The agent didn't accomplish the goal")
+		}
+	}
+
+	if encoder != nil {
+		event := &agentResultEvent{Type: "result", AgentResult: result}
+		if err != nil {
+			event.Error = err.Error()
+		}
+		encoder.Encode(event)
+	} else if err == nil {
+		this.StylePrintf(this.Config.Styles.Answer, "Goal accomplished in %d steps\n", result.Steps)
+	}
+	return err
+}
+
+// Print commands as they run and ask on the terminal before running them and
+// for answers to the agent's questions
+func (this *ButterfishCtx) interactiveAgent(agent *Agent) {
+	stdin := bufio.NewReader(os.Stdin)
+	readLine := func() (string, error) {
+		line, err := stdin.ReadString('\n')
+		return strings.TrimSpace(line), err
+	}
+
+	agent.OnEvent = func(event *AgentEvent) {
+		if event.Type == AgentEventCommand && !event.Declined {
+			this.StylePrintf(this.Config.Styles.Highlight, "> %s\n", event.Command)
+		}
+	}
+	if agent.Confirm == nil {
+		agent.Confirm = func(ctx context.Context, cmd string) (string, bool, error) {
+			this.StylePrintf(this.Config.Styles.Question, "Run %s? [y/N]: ", cmd)
+			input, err := readLine()
+			if err != nil {
+				return "", false, err
+			}
+			return cmd, strings.ToLower(input) == "y", nil
+		}
+	}
+	agent.AskUser = func(ctx context.Context, question string) (string, error) {
+		this.StylePrintf(this.Config.Styles.Question, "%s\n> ", question)
+		return readLine()
+	}
+}
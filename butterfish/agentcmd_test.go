@@ -0,0 +1,103 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func TestAgentPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	os.WriteFile(path, []byte("allow:\n  - ^echo\\b\n  - ^ls\ndeny:\n  - secret\n"), 0644)
+
+	policy, err := LoadAgentPolicy(path)
+	assert.NoError(t, err)
+	assert.True(t, policy.Allows("echo hi"))
+	assert.True(t, policy.Allows("ls -la"))
+	assert.False(t, policy.Allows("echo secret"))
+	assert.False(t, policy.Allows("rm -rf /"))
+	assert.False(t, policy.Allows("echoes"))
+
+	os.WriteFile(path, []byte("deny:\n  - rm\n"), 0644)
+	_, err = LoadAgentPolicy(path)
+	assert.ErrorContains(t, err, "doesn't allow any commands")
+
+	os.WriteFile(path, []byte("allow:\n  - (\n"), 0644)
+	_, err = LoadAgentPolicy(path)
+	assert.ErrorContains(t, err, "Invalid pattern")
+
+	os.WriteFile(path, []byte("allowed:\n  - ls\n"), 0644)
+	_, err = LoadAgentPolicy(path)
+	assert.ErrorContains(t, err, "Unable to parse agent policy")
+}
+
+func runAgentCommand(t *testing.T, llm LLM, args ...string) ([]map[string]any, error) {
+	out := &bytes.Buffer{}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+		Out:           out,
+	}
+
+	parsed, options, err := butterfish.ParseCommand(strings.Join(append([]string{"agent"}, args...), " "))
+	assert.NoError(t, err)
+	err = butterfish.ExecCommand(parsed, options)
+
+	lines := []map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		event := map[string]any{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &event), line)
+		lines = append(lines, event)
+	}
+	return lines, err
+}
+
+func TestAgentCommandJson(t *testing.T) {
+	llm := &functionCallLLM{responses: []*util.CompletionResponse{
+		{Completion: "Saying hi", FunctionName: "command", FunctionParameters: `{"cmd": "echo hi"}`},
+		callFunction("finish", `{"success": true}`),
+	}}
+
+	events, err := runAgentCommand(t, llm, "--json", "say", "hi")
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]any{
+		{"type": "output", "step": 1.0, "output": "Saying hi"},
+		{"type": "function_call", "step": 1.0, "function": "command", "parameters": `{"cmd": "echo hi"}`},
+		{"type": "command", "step": 1.0, "command": "echo hi"},
+		{"type": "exit", "step": 1.0, "command": "echo hi", "output": "hi\n", "status": 0.0},
+		{"type": "function_call", "step": 2.0, "function": "finish", "parameters": `{"success": true}`},
+		{"type": "result", "finished": true, "success": true, "steps": 2.0},
+	}, events)
+}
+
+func TestAgentCommandJsonPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	os.WriteFile(path, []byte("allow:\n  - ^echo\\b\n"), 0644)
+
+	llm := &functionCallLLM{responses: []*util.CompletionResponse{
+		callFunction("command", `{"cmd": "rm -rf build"}`),
+		callFunction("user_input", `{"question": "May I delete build?"}`),
+	}}
+
+	events, err := runAgentCommand(t, llm, "--json", "--policy", path, "clean up")
+	assert.ErrorContains(t, err, "May I delete build?")
+	assert.Equal(t, map[string]any{"type": "command", "step": 1.0, "command": "rm -rf build", "declined": true}, events[1])
+	assert.Equal(t, map[string]any{
+		"type":     "result",
+		"finished": false,
+		"success":  false,
+		"question": "May I delete build?",
+		"steps":    2.0,
+		"error":    "The agent stopped to ask: May I delete build?",
+	}, events[len(events)-1])
+}
@@ -0,0 +1,158 @@
+package butterfish
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// Answers often end with a command in a code block. "Run" types the command
+// from the last code block of the most recent answer that has one into the
+// shell, without running it, so the user can read it and press enter or edit
+// it first, like the gencmd command. "Copy" puts the code block on the
+// clipboard with an OSC 52 escape sequence, which works over ssh but has to
+// be allowed in some terminals and in tmux (set-clipboard on).
+
+// Code block languages we take to be shell commands, console blocks show
+// commands after a $ followed by their output
+var shellBlockLanguages = map[string]bool{
+	"": true, "sh": true, "bash": true, "zsh": true, "fish": true, "shell": true,
+	"console": true, "shell-session": true,
+}
+
+// Parse "Run" or "Run last", other prompts starting with Run, like "Run the
+// tests for me", are normal prompts. The same goes for Copy.
+func answerCommand(prompt, command string) bool {
+	arg, ok := localCommandText(prompt, command)
+	return ok && (arg == "" || strings.EqualFold(arg, "last"))
+}
+
+// The last fenced code block of shell commands in text
+func lastShellBlock(text string) (string, bool) {
+	block, found := "", false
+	var lines []string
+	var language string
+	inBlock := false
+
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, "```") {
+			if inBlock {
+				lines = append(lines, line)
+			}
+			continue
+		}
+
+		if !inBlock {
+			inBlock = true
+			language = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(trimmed, "```")))
+			lines = nil
+			continue
+		}
+		inBlock = false
+		if shellBlockLanguages[language] {
+			block, found = shellBlockText(lines, language), true
+		}
+	}
+
+	return block, found && block != ""
+}
+
+// The commands in a code block, without prompts, comments, or the output in
+// console blocks
+func shellBlockText(lines []string, language string) string {
+	console := language == "console" || language == "shell-session"
+	commands := []string{}
+	for _, line := range lines {
+		// keep indentation, e.g. in loops, unless there's a prompt
+		command := strings.TrimRight(line, " \t\r")
+		trimmed, prompted := strings.CutPrefix(strings.TrimSpace(line), "$ ")
+		if console && !prompted {
+			continue
+		}
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if prompted {
+			command = trimmed
+		}
+		commands = append(commands, command)
+	}
+	return strings.Join(commands, "\n")
+}
+
+// Join lines continued with a backslash, the result has a command per line
+func joinContinuations(block string) []string {
+	commands := []string{}
+	current := ""
+	for _, line := range strings.Split(block, "\n") {
+		if before, ok := strings.CutSuffix(line, "\\"); ok {
+			current += strings.TrimSpace(before) + " "
+			continue
+		}
+		commands = append(commands, current+strings.TrimSpace(line))
+		current = ""
+	}
+	if current != "" {
+		commands = append(commands, strings.TrimSpace(current))
+	}
+	return commands
+}
+
+// The last shell code block in the most recent answer that has one
+func (this *ShellState) lastAnswerBlock() (string, bool) {
+	block, found := "", false
+	this.History.IterateBlocks(func(history *HistoryBuffer) bool {
+		if history.Type == historyTypeLLMOutput {
+			block, found = lastShellBlock(history.Content.String())
+		}
+		return !found
+	})
+	return block, found
+}
+
+// Type the command from the last answer into the shell once the local
+// response is done, it isn't run until the user presses enter
+func (this *ShellState) RunAnswerCommand() {
+	block, ok := this.lastAnswerBlock()
+	if !ok {
+		this.printLocalResponse("There's no command in a code block in the recent answers\n")
+		return
+	}
+
+	commands := joinContinuations(block)
+	if len(commands) > 1 {
+		this.printLocalResponse(fmt.Sprintf(
+			"The last code block has %d commands, type Copy to copy them to the clipboard instead\n", len(commands)))
+		return
+	}
+
+	this.AnswerCommand = commands[0]
+	this.printLocalResponse("Press enter to run this command, or edit it first\n")
+}
+
+// Copy the last code block from an answer to the clipboard
+func (this *ShellState) CopyAnswerCommand() {
+	block, ok := this.lastAnswerBlock()
+	if !ok {
+		this.printLocalResponse("There's no command in a code block in the recent answers\n")
+		return
+	}
+
+	fmt.Fprintf(this.ParentOut, "\x1b]52;c;%s\a", base64.StdEncoding.EncodeToString([]byte(block)))
+	this.printLocalResponse(fmt.Sprintf("Copied to the clipboard:\n%s\n", block))
+}
+
+// Type the command from Run after the new prompt, the shell shows it on the
+// line ready to run
+func (this *ShellState) typeAnswerCommand() {
+	command := this.AnswerCommand
+	this.AnswerCommand = ""
+	this.ChildIn.Write([]byte(command))
+	this.Command = NewShellBuffer()
+	this.Command.Write(command)
+	if this.Vi != nil {
+		this.Vi.Reset(0)
+	}
+	this.setState(stateShell)
+}
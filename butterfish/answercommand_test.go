@@ -0,0 +1,68 @@
+package butterfish
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/bakks/butterfish/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLastShellBlock(t *testing.T) {
+	answer := "Find them with:\n```bash\n# recursive\nfind . -name '*.py'\n```\nor in Python:\n```python\nprint(1)\n```\n"
+	block, ok := lastShellBlock(answer)
+	assert.True(t, ok)
+	assert.Equal(t, "find . -name '*.py'", block)
+
+	block, ok = lastShellBlock("```console\n$ ls\nfoo bar\n$ echo hi\nhi\n```")
+	assert.True(t, ok)
+	assert.Equal(t, "ls\necho hi", block)
+
+	_, ok = lastShellBlock("Use `ls -l` for that")
+	assert.False(t, ok)
+	// an unclosed block is still being written
+	_, ok = lastShellBlock("```\nls")
+	assert.False(t, ok)
+}
+
+func TestJoinContinuations(t *testing.T) {
+	assert.Equal(t, []string{"docker run -it ubuntu"}, joinContinuations("docker run \\\n  -it \\\n  ubuntu"))
+	assert.Equal(t, []string{"cd src", "make"}, joinContinuations("cd src\nmake"))
+}
+
+func TestRunAnswerCommand(t *testing.T) {
+	parentOut := new(bytes.Buffer)
+	state := &ShellState{
+		Butterfish:         &ButterfishCtx{Config: MakeButterfishConfig()},
+		ParentOut:          parentOut,
+		ChildIn:            new(bytes.Buffer),
+		Color:              DarkShellColorScheme,
+		Prompt:             NewShellBuffer(),
+		History:            NewShellHistory(),
+		PromptAnswerWriter: new(bytes.Buffer),
+		PromptOutputChan:   make(chan *util.CompletionResponse, 4),
+	}
+	state.History.Append(historyTypeLLMOutput, "Try:\n```\ngit log --oneline \\\n  -n 5\n```")
+	state.History.Append(historyTypeLLMOutput, "Prompt temperature is 0.7")
+
+	state.Prompt.Write("Run the tests")
+	assert.False(t, state.HandleLocalPrompt())
+
+	state.Prompt.Clear()
+	state.Prompt.Write("run last")
+	assert.True(t, state.HandleLocalPrompt())
+	assert.Equal(t, "git log --oneline -n 5", state.AnswerCommand)
+
+	state.typeAnswerCommand()
+	assert.Equal(t, "git log --oneline -n 5", state.ChildIn.(*bytes.Buffer).String())
+	assert.Equal(t, "git log --oneline -n 5", state.Command.String())
+	assert.Equal(t, stateShell, state.State)
+	assert.Equal(t, "", state.AnswerCommand)
+
+	state.Prompt.Clear()
+	state.Prompt.Write("Copy")
+	assert.True(t, state.HandleLocalPrompt())
+	copied := base64.StdEncoding.EncodeToString([]byte("git log --oneline \\\n  -n 5"))
+	assert.Equal(t, "\x1b]52;c;"+copied+"\a", parentOut.String())
+}
@@ -0,0 +1,210 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// The API answers 401 when the key is wrong or revoked, and 403 when the key
+// isn't allowed to do what we asked. Rather than showing the raw HTTP error
+// we say where the key came from and how to replace it. The command line
+// offers to save a new key to the token store like the first run does, and
+// shell mode stops autosuggesting, which would fail on every keystroke, until
+// a request works again or a new key is given with "Key <key>".
+
+const APIKeysURL = "https://platform.openai.com/api-keys"
+
+// The API rejected our key
+type AuthError struct {
+	Err    error
+	Status int
+	// Where the key came from, see ButterfishConfig.KeySource
+	KeySource string
+}
+
+func (this *AuthError) Error() string {
+	message := this.Err.Error()
+	var apiErr *openai.APIError
+	if errors.As(this.Err, &apiErr) && apiErr.Message != "" {
+		message = apiErr.Message
+	}
+
+	text := "The API rejected your API key"
+	if this.Status == 403 {
+		text = "Your API key isn't allowed to make this request"
+	}
+	text = fmt.Sprintf("%s: %s", text, strings.TrimSpace(message))
+	if this.KeySource != "" {
+		text += fmt.Sprintf("\nThe key is %s.", this.KeySource)
+	}
+	return text + fmt.Sprintf(" You can create a new key at %s", APIKeysURL)
+}
+
+func (this *AuthError) Unwrap() error {
+	return this.Err
+}
+
+// Whether an error means the API rejected the key, errors from other
+// clients may only say so in the message
+func isAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch errorStatus(err) {
+	case 401, 403:
+		return true
+	case 0:
+		message := strings.ToLower(err.Error())
+		return strings.Contains(message, "invalid_api_key") || strings.Contains(message, "incorrect api key")
+	}
+	return false
+}
+
+func IsAuthError(err error) bool {
+	var authErr *AuthError
+	return errors.As(err, &authErr)
+}
+
+// Wraps the API client, turning errors for a rejected key into AuthErrors
+// and remembering that the key was rejected until a request works
+type AuthCheckingLLM struct {
+	LLM       LLM
+	KeySource string
+
+	rejected atomic.Bool
+}
+
+func NewAuthCheckingLLM(llm LLM, keySource string) *AuthCheckingLLM {
+	return &AuthCheckingLLM{
+		LLM:       llm,
+		KeySource: keySource,
+	}
+}
+
+func (this *AuthCheckingLLM) Unwrap() LLM {
+	return this.LLM
+}
+
+// Whether the last request failed because the key was rejected
+func (this *AuthCheckingLLM) Rejected() bool {
+	return this.rejected.Load()
+}
+
+func (this *AuthCheckingLLM) check(err error) error {
+	if !isAuthError(err) {
+		if err == nil {
+			this.rejected.Store(false)
+		}
+		return err
+	}
+	this.rejected.Store(true)
+	return &AuthError{Err: err, Status: errorStatus(err), KeySource: this.KeySource}
+}
+
+func (this *AuthCheckingLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	response, err := this.LLM.CompletionStream(request, writer)
+	return response, this.check(err)
+}
+
+func (this *AuthCheckingLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	response, err := this.LLM.Completion(request)
+	return response, this.check(err)
+}
+
+func (this *AuthCheckingLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	embeddings, err := this.LLM.Embeddings(ctx, input, verbose)
+	return embeddings, this.check(err)
+}
+
+// Whether the key was rejected by the last request, false if the chain has
+// no AuthCheckingLLM, e.g. for a client passed in by a library user
+func keyRejected(llm LLM) bool {
+	for llm != nil {
+		if checking, ok := llm.(*AuthCheckingLLM); ok {
+			return checking.Rejected()
+		}
+		wrapping, ok := llm.(wrappingLLM)
+		if !ok {
+			return false
+		}
+		llm = wrapping.Unwrap()
+	}
+	return false
+}
+
+// Where the API key came from, for telling the user what to change
+func (this *ButterfishConfig) KeySource() string {
+	if profile := this.Profile; profile != nil && profile.Token() != "" {
+		if profile.OpenAIToken != "" {
+			return fmt.Sprintf("openai_token in profile %s", profile.Name)
+		}
+		return fmt.Sprintf("the %s env var from profile %s", profile.OpenAITokenEnv, profile.Name)
+	}
+	return this.OpenAITokenSource
+}
+
+// Where a fallback's key came from, the primary's key when it uses the same
+// provider without its own
+func (this *ButterfishConfig) fallbackKeySource(fallback *Fallback) string {
+	profile := ""
+	if this.Profile != nil {
+		profile = " in profile " + this.Profile.Name
+	}
+	switch {
+	case fallback.OpenAIToken != "":
+		return fmt.Sprintf("openai_token for fallback %s%s", fallback.Model, profile)
+	case fallback.OpenAITokenEnv != "":
+		return fmt.Sprintf("the %s env var from fallback %s%s", fallback.OpenAITokenEnv, fallback.Model, profile)
+	case fallback.BaseURL == "":
+		return this.KeySource()
+	}
+	return ""
+}
+
+// Whether a new key can be saved to the token store, which only helps if
+// that's where the key came from rather than an env var or a profile
+func (this *ButterfishConfig) CanSaveKey() bool {
+	return this.TokenStore != nil &&
+		this.KeySource() == this.TokenStore.Describe(DefaultTokenProvider)
+}
+
+// Use a new key from now on, saving it to the token store if that's where the
+// key came from, returns a description of where the key went
+func (this *ButterfishCtx) SetKey(key string) (string, error) {
+	config := this.Config
+	saved := ""
+	if config.CanSaveKey() {
+		if err := config.TokenStore.Set(DefaultTokenProvider, key); err != nil {
+			return "", err
+		}
+		saved = config.TokenStore.Describe(DefaultTokenProvider)
+		// so that switching profiles keeps it
+		if config.profileBase != nil {
+			config.profileBase.OpenAIToken = key
+		}
+	}
+
+	source := config.KeySource()
+	config.OpenAIToken = key
+	if saved == "" {
+		config.OpenAITokenSource = "the key given with Key"
+	}
+	llmClient, err := initLLM(config)
+	if err != nil {
+		return "", err
+	}
+	this.LLMClient = llmClient
+
+	if saved != "" {
+		return fmt.Sprintf("Saved the new key to %s", saved), nil
+	}
+	return fmt.Sprintf("Using the new key for this session, update %s to keep using it", source), nil
+}
@@ -0,0 +1,114 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func TestAuthCheckingLLM(t *testing.T) {
+	backend := &failoverTestLLM{err: &openai.APIError{HTTPStatusCode: 401, Message: "Incorrect API key provided"}}
+	llm := NewAuthCheckingLLM(backend, "OPENAI_TOKEN in /home/me/.config/butterfish/butterfish.env")
+	wrapped := NewRetryingLLM(llm, DefaultRetryPolicy())
+
+	_, err := llm.Completion(&util.CompletionRequest{Model: "gpt-4o"})
+	assert.True(t, IsAuthError(err))
+	assert.EqualError(t, err, "The API rejected your API key: Incorrect API key provided\n"+
+		"The key is OPENAI_TOKEN in /home/me/.config/butterfish/butterfish.env. You can create a new key at "+APIKeysURL)
+	assert.True(t, keyRejected(wrapped))
+
+	// other errors pass through, a working request clears the rejection
+	backend.err = &openai.APIError{HTTPStatusCode: 403, Message: "Project does not have access"}
+	_, err = llm.Completion(&util.CompletionRequest{Model: "gpt-4o"})
+	assert.ErrorContains(t, err, "Your API key isn't allowed to make this request")
+
+	backend.err = errors.New("connection reset")
+	_, err = llm.Completion(&util.CompletionRequest{Model: "gpt-4o"})
+	assert.False(t, IsAuthError(err))
+	assert.True(t, keyRejected(wrapped))
+
+	backend.err = nil
+	_, err = llm.Completion(&util.CompletionRequest{Model: "gpt-4o"})
+	assert.Nil(t, err)
+	assert.False(t, keyRejected(wrapped))
+	assert.False(t, keyRejected(&echoLLM{}))
+}
+
+func TestKeySource(t *testing.T) {
+	config := MakeButterfishConfig()
+	config.OpenAITokenSource = "the OPENAI_API_KEY env var"
+	assert.False(t, config.CanSaveKey())
+
+	config.TokenStore = &EnvFileTokenStore{Path: "/home/me/.config/butterfish/butterfish.env"}
+	assert.False(t, config.CanSaveKey())
+	config.OpenAITokenSource = config.TokenStore.Describe(DefaultTokenProvider)
+	assert.True(t, config.CanSaveKey())
+
+	// a profile's own token wins
+	config.Profile = &Profile{Name: "work", OpenAIToken: "sk-work"}
+	assert.Equal(t, "openai_token in profile work", config.KeySource())
+	assert.False(t, config.CanSaveKey())
+}
+
+func TestFallbackAuthChecking(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(401)
+		w.Write([]byte(`{"error": {"message": "Incorrect API key provided"}}`))
+	}))
+	defer server.Close()
+
+	config := MakeButterfishConfig()
+	config.OpenAIToken = "sk-primary"
+	config.BaseURL = server.URL
+	config.Middleware = []string{MiddlewareFailover}
+	config.Profile = &Profile{Name: "work", Fallbacks: []*Fallback{
+		{Model: "gpt-4o-mini", BaseURL: server.URL, OpenAIToken: "sk-fallback"},
+	}}
+	assert.Equal(t, "openai_token for fallback gpt-4o-mini in profile work",
+		config.fallbackKeySource(config.Profile.Fallbacks[0]))
+	assert.Equal(t, config.KeySource(), config.fallbackKeySource(&Fallback{Model: "gpt-4o-mini"}))
+
+	llm, err := initLLM(config)
+	assert.Nil(t, err)
+	_, err = llm.Completion(&util.CompletionRequest{
+		Ctx: context.Background(), Model: "gpt-4o", SystemMessage: "hi", Prompt: "hi"})
+	assert.True(t, IsAuthError(err))
+	assert.ErrorContains(t, err, "The key is openai_token for fallback gpt-4o-mini in profile work.")
+}
+
+func TestShellKeyCommand(t *testing.T) {
+	shell := pluginShell()
+	config := shell.Butterfish.Config
+	path := filepath.Join(t.TempDir(), "butterfish.env")
+	config.TokenStore = &EnvFileTokenStore{Path: path}
+	config.OpenAITokenSource = config.TokenStore.Describe(DefaultTokenProvider)
+	config.Middleware = []string{}
+
+	_, ok := keyCommand("Key takeaways?")
+	assert.False(t, ok)
+
+	key := "sk-" + strings.Repeat("a", 40)
+	shell.Prompt.Write("Key " + key)
+	assert.True(t, shell.HandleLocalPrompt())
+	output := <-shell.PromptOutputChan
+	assert.Equal(t, "Saved the new key to OPENAI_TOKEN in "+path+"\n", output.Completion)
+	assert.NotContains(t, shell.PromptAnswerWriter.(*bytes.Buffer).String(), key)
+	assert.Equal(t, key, config.OpenAIToken)
+	assert.IsType(t, &AuthCheckingLLM{}, shell.Butterfish.LLMClient)
+
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "OPENAI_TOKEN="+key+"\n", string(data))
+}
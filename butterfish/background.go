@@ -0,0 +1,103 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// With --background-answers a prompt doesn't take over the terminal while
+// it's answered. We give the shell a new prompt right away and the answer
+// streams into a buffer, so the user can keep typing and running commands.
+// When the answer is finished it's printed if the shell is sitting at an
+// empty prompt, otherwise it waits for the next prompt, i.e. until the
+// command that's running or being typed is done. This way the answer never
+// lands in the middle of a command's output or the line being edited.
+//
+// One answer runs in the background at a time, and goal mode always runs in
+// the foreground.
+
+var errBackgroundAnswerRunning = errors.New("Still answering the last prompt, you'll see the answer at the next prompt.\n")
+
+type backgroundAnswer struct {
+	cancel context.CancelFunc
+	// the answer as it streams in, only read once it's finished
+	buffer bytes.Buffer
+	// set when the answer is finished and waiting to be printed
+	output *util.CompletionResponse
+}
+
+// Whether the next prompt's answer should go to the background
+func (this *ShellState) answerInBackground() bool {
+	return this.Butterfish.Config.ShellBackgroundAnswers && !this.GoalMode
+}
+
+// Start answering a request in the background and give the shell a new
+// prompt
+func (this *ShellState) startBackgroundAnswer(request *util.CompletionRequest, cancel context.CancelFunc, prepare func()) {
+	answer := &backgroundAnswer{cancel: cancel}
+	this.Background = answer
+	this.setState(stateNormal)
+	this.ChildIn.Write([]byte("\n"))
+
+	go func() {
+		prepare()
+		CompletionRoutine(request, this.Butterfish.LLMClient, &answer.buffer,
+			this.BackgroundOutputChan, this.Color.Answer, this.Color.Error, nil)
+	}()
+}
+
+// Called from the mux when the background answer is finished
+func (this *ShellState) backgroundAnswerDone(output *util.CompletionResponse) {
+	answer := this.Background
+	if answer == nil {
+		return
+	}
+	answer.cancel()
+
+	if output.Refusal != "" {
+		this.History.RemoveLastPrompt()
+	} else if output.Interrupted {
+		this.History.AddInterruptedAnswer(output.Completion)
+	} else if output.Completion != "" {
+		this.History.Append(historyTypeLLMOutput, output.Completion)
+	}
+	if !output.Interrupted {
+		this.Notifier.Done(NotifyEventAnswer, "Butterfish answered your prompt")
+	}
+
+	answer.output = output
+	if this.atIdlePrompt() {
+		this.printBackgroundAnswer()
+	}
+}
+
+// Whether the shell is showing a prompt with nothing typed and nothing
+// running
+func (this *ShellState) atIdlePrompt() bool {
+	return this.State == stateNormal && !this.GoalMode && !HasRunningChildren()
+}
+
+// Print a finished background answer over the current prompt line and get a
+// new prompt
+func (this *ShellState) printBackgroundAnswer() {
+	answer := this.Background
+	if answer == nil || answer.output == nil {
+		return
+	}
+	this.Background = nil
+
+	fmt.Fprintf(this.ParentOut, "\r%s", ESC_CLEAR)
+	this.PromptAnswerWriter.Write(answer.buffer.Bytes())
+	if this.StyleWriter != nil {
+		this.StyleWriter.Reset()
+	}
+	fmt.Fprintf(this.PromptAnswerWriter, "%s", this.Color.Command)
+	this.pageLongAnswer(answer.output.Completion)
+	if !this.openPager() {
+		this.ChildIn.Write([]byte("\n"))
+	}
+}
@@ -0,0 +1,50 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func TestBackgroundAnswer(t *testing.T) {
+	shell := pluginShell()
+	shell.Butterfish.Config.ShellBackgroundAnswers = true
+	shell.BackgroundOutputChan = make(chan *util.CompletionResponse, 1)
+	parentOut := new(bytes.Buffer)
+	childIn := new(bytes.Buffer)
+	shell.ParentOut = parentOut
+	shell.ChildIn = childIn
+	assert.True(t, shell.answerInBackground())
+
+	// the shell gets a new prompt right away
+	shell.History.Append(historyTypePrompt, "What's up?")
+	_, cancel := context.WithCancel(context.Background())
+	shell.startBackgroundAnswer(&util.CompletionRequest{Prompt: "What's up?"}, cancel, func() {})
+	assert.Equal(t, stateNormal, shell.State)
+	assert.Equal(t, "\n", childIn.String())
+	output := <-shell.BackgroundOutputChan
+
+	// a command is being typed, so the answer waits for the next prompt
+	shell.State = stateShell
+	shell.backgroundAnswerDone(output)
+	assert.NotNil(t, shell.Background)
+	assert.Equal(t, "", shell.PromptAnswerWriter.(*bytes.Buffer).String())
+	history := shell.History.Blocks
+	assert.Equal(t, historyTypeLLMOutput, history[len(history)-1].Type)
+
+	shell.State = stateNormal
+	shell.printBackgroundAnswer()
+	assert.Nil(t, shell.Background)
+	assert.Equal(t, "\r"+ESC_CLEAR, parentOut.String())
+	assert.Equal(t, DarkShellColorScheme.Answer+"echo: What's up?"+DarkShellColorScheme.Command,
+		shell.PromptAnswerWriter.(*bytes.Buffer).String())
+	assert.Equal(t, "\n\n", childIn.String())
+
+	// goal mode stays in the foreground
+	shell.GoalMode = true
+	assert.False(t, shell.answerInBackground())
+}
@@ -0,0 +1,362 @@
+package butterfish
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// Batch mode, started with `butterfish batch manifest.yaml`, runs a list of
+// prompt, summarize, and indexquestion jobs and writes each result to a file.
+// File globs and output paths are relative to the manifest's directory. A job
+// with `each: true` is expanded into one job per matched file, and its output
+// path should contain {file}, which is replaced with the file's path.
+//
+//	concurrency: 4
+//	model: gpt-4o
+//	jobs:
+//	  - name: package-docs
+//	    type: prompt
+//	    prompt: Write reference documentation for this Go file.
+//	    files: ["butterfish/*.go"]
+//	    each: true
+//	    output: docs/{file}.md
+//
+// Jobs whose output already exists are skipped unless forced, so a failed
+// batch can be re-run to pick up where it stopped. The temperature defaults to
+// 0 to keep results as reproducible as the model allows, and summarize jobs
+// use the job's model and settings like any other job.
+
+const (
+	BatchJobPrompt        = "prompt"
+	BatchJobSummarize     = "summarize"
+	BatchJobIndexQuestion = "indexquestion"
+)
+
+type BatchJob struct {
+	Name          string   `yaml:"name"`
+	Type          string   `yaml:"type"`
+	Prompt        string   `yaml:"prompt"`
+	SystemMessage string   `yaml:"system_message"`
+	Files         []string `yaml:"files"`
+	Each          bool     `yaml:"each"`
+	Output        string   `yaml:"output"`
+	Model         string   `yaml:"model"`
+	MaxTokens     int      `yaml:"max_tokens"`
+	Temperature   *float32 `yaml:"temperature"`
+	// Bytes summarized at a time by summarize jobs
+	ChunkSize int `yaml:"chunk_size"`
+}
+
+type BatchManifest struct {
+	Concurrency int         `yaml:"concurrency"`
+	Model       string      `yaml:"model"`
+	MaxTokens   int         `yaml:"max_tokens"`
+	Temperature float32     `yaml:"temperature"`
+	ChunkSize   int         `yaml:"chunk_size"`
+	Jobs        []*BatchJob `yaml:"jobs"`
+
+	// Directory of the manifest file, files and outputs are relative to this
+	dir string
+}
+
+// Load a manifest, expanding file globs and `each` jobs, and filling in
+// defaults so every job is ready to run.
+func LoadBatchManifest(path string) (*BatchManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &BatchManifest{}
+	err = yaml.UnmarshalStrict(data, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse batch manifest %s: %s", path, err)
+	}
+
+	manifest.dir = filepath.Dir(path)
+	if manifest.Concurrency <= 0 {
+		manifest.Concurrency = 1
+	}
+	if manifest.Model == "" {
+		manifest.Model = "gpt-4-turbo"
+	}
+	if manifest.MaxTokens <= 0 {
+		manifest.MaxTokens = 1024
+	}
+	if manifest.ChunkSize <= 0 {
+		manifest.ChunkSize = DefaultSummarizeChunkSize
+	}
+
+	jobs := []*BatchJob{}
+	for i, job := range manifest.Jobs {
+		if job.Name == "" {
+			job.Name = fmt.Sprintf("job%d", i+1)
+		}
+		expanded, err := manifest.expandJob(job)
+		if err != nil {
+			return nil, fmt.Errorf("Batch job %s: %s", job.Name, err)
+		}
+		jobs = append(jobs, expanded...)
+	}
+	manifest.Jobs = jobs
+
+	if len(manifest.Jobs) == 0 {
+		return nil, errors.New("Batch manifest has no jobs")
+	}
+
+	return manifest, nil
+}
+
+func (this *BatchManifest) expandJob(job *BatchJob) ([]*BatchJob, error) {
+	switch job.Type {
+	case BatchJobPrompt, BatchJobIndexQuestion:
+		if job.Prompt == "" {
+			return nil, errors.New("Missing prompt")
+		}
+	case BatchJobSummarize:
+		if len(job.Files) == 0 {
+			return nil, errors.New("Summarize jobs need files")
+		}
+	default:
+		return nil, fmt.Errorf("Unknown job type %q, expected prompt, summarize, or indexquestion", job.Type)
+	}
+	if job.Output == "" {
+		return nil, errors.New("Missing output")
+	}
+
+	if job.Model == "" {
+		job.Model = this.Model
+	}
+	if job.MaxTokens <= 0 {
+		job.MaxTokens = this.MaxTokens
+	}
+	if job.Temperature == nil {
+		temperature := this.Temperature
+		job.Temperature = &temperature
+	}
+	if job.ChunkSize <= 0 {
+		job.ChunkSize = this.ChunkSize
+	}
+
+	files := []string{}
+	for _, pattern := range job.Files {
+		matches, err := filepath.Glob(filepath.Join(this.dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("No files match %s", pattern)
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	job.Files = files
+	job.Output = filepath.Join(this.dir, job.Output)
+
+	if !job.Each {
+		return []*BatchJob{job}, nil
+	}
+
+	if !strings.Contains(job.Output, "{file}") {
+		return nil, errors.New("Output must contain {file} when each is set")
+	}
+
+	jobs := []*BatchJob{}
+	for _, file := range files {
+		relPath, err := filepath.Rel(this.dir, file)
+		if err != nil {
+			return nil, err
+		}
+
+		fileJob := *job
+		fileJob.Name = fmt.Sprintf("%s:%s", job.Name, relPath)
+		fileJob.Files = []string{file}
+		fileJob.Each = false
+		fileJob.Output = strings.ReplaceAll(job.Output, "{file}", relPath)
+		jobs = append(jobs, &fileJob)
+	}
+
+	return jobs, nil
+}
+
+// Run the manifest's jobs, up to Concurrency at a time. A failed job doesn't
+// stop the others, we report failures at the end.
+func (this *ButterfishCtx) RunBatch(manifest *BatchManifest, force bool) error {
+	for _, job := range manifest.Jobs {
+		if job.Type == BatchJobIndexQuestion {
+			err := this.initVectorIndex(nil)
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	var outputMutex sync.Mutex
+	var indexMutex sync.Mutex
+	var waitGroup sync.WaitGroup
+	semaphore := make(chan struct{}, manifest.Concurrency)
+	failed := []string{}
+	total := len(manifest.Jobs)
+
+	report := func(i int, job *BatchJob, err error, skipped bool) {
+		outputMutex.Lock()
+		defer outputMutex.Unlock()
+
+		prefix := fmt.Sprintf("[%d/%d] %s", i+1, total, job.Name)
+		switch {
+		case err != nil:
+			failed = append(failed, job.Name)
+			this.StylePrintf(this.Config.Styles.Error, "%s failed: %s\n", prefix, err)
+		case skipped:
+			this.StylePrintf(this.Config.Styles.Grey, "%s skipped, %s exists\n", prefix, job.Output)
+		default:
+			this.StylePrintf(this.Config.Styles.Foreground, "%s -> %s\n", prefix, job.Output)
+		}
+	}
+
+	for i, job := range manifest.Jobs {
+		if this.Ctx.Err() != nil {
+			break
+		}
+
+		if !force {
+			if _, err := os.Stat(job.Output); err == nil {
+				report(i, job, nil, true)
+				continue
+			}
+		}
+
+		semaphore <- struct{}{}
+		waitGroup.Add(1)
+		go func(i int, job *BatchJob) {
+			defer waitGroup.Done()
+			defer func() { <-semaphore }()
+
+			output, err := this.runBatchJob(job, &indexMutex)
+			if err == nil {
+				err = writeBatchOutput(job.Output, output)
+			}
+			report(i, job, err, false)
+		}(i, job)
+	}
+
+	waitGroup.Wait()
+
+	if this.Ctx.Err() != nil {
+		return this.Ctx.Err()
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d batch jobs failed: %s", len(failed), total, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (this *ButterfishCtx) runBatchJob(job *BatchJob, indexMutex *sync.Mutex) (string, error) {
+	req := &util.CompletionRequest{
+		Ctx:           this.Ctx,
+		Model:         job.Model,
+		MaxTokens:     job.MaxTokens,
+		Temperature:   *job.Temperature,
+		SystemMessage: job.SystemMessage,
+		Verbose:       this.Config.Verbose > 0,
+		TokenTimeout:  this.Config.TokenTimeout,
+	}
+	this.Config.LimitRequest(FeaturePrompt, req)
+	var snippets []*questionSnippet
+
+	switch job.Type {
+	case BatchJobSummarize:
+		// the job's model and settings, not the summarize defaults
+		summaryReq := *req
+		summaryReq.SystemMessage = "N/A"
+		this.Config.LimitRequest(FeatureSummarize, &summaryReq)
+		output := new(bytes.Buffer)
+		fs := afero.NewOsFs()
+		for _, file := range job.Files {
+			chunks, err := util.GetFileChunks(this.Ctx, fs, file, job.ChunkSize, -1)
+			if err != nil {
+				return "", err
+			}
+			if len(job.Files) > 1 {
+				fmt.Fprintf(output, "# %s\n\n", file)
+			}
+			fileReq := summaryReq
+			err = this.summarizeChunksConcurrently(&fileReq, chunks, output,
+				this.Config.SummarizeConcurrency, nil, nil)
+			if err != nil {
+				return "", err
+			}
+			output.WriteString("\n")
+		}
+		return output.String(), nil
+
+	case BatchJobIndexQuestion:
+		indexMutex.Lock()
+		results, err := this.VectorIndex.Search(this.Ctx, job.Prompt, 3)
+		indexMutex.Unlock()
+		if err != nil {
+			return "", err
+		}
+
+		req.Prompt, snippets, err = this.questionPrompt(job.Prompt, results)
+		if err != nil {
+			return "", err
+		}
+		if req.SystemMessage == "" {
+			req.SystemMessage = "N/A"
+		}
+
+	default:
+		input := strings.Builder{}
+		input.WriteString(job.Prompt)
+		for _, file := range job.Files {
+			content, err := os.ReadFile(file)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&input, "\n\n--- %s ---\n%s", file, content)
+		}
+		req.Prompt = input.String()
+
+		if req.SystemMessage == "" {
+			var err error
+			req.SystemMessage, err = this.PromptLibrary.GetPrompt(prompt.PromptSystemMessage)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	resp, err := this.LLMClient.Completion(req)
+	if err != nil {
+		return "", err
+	}
+	if resp.Refusal != "" {
+		return "", errors.New(resp.RefusalMessage())
+	}
+	if snippets != nil {
+		return resp.Completion + "\n\n" + formatSources(resp.Completion, snippets), nil
+	}
+	return resp.Completion, nil
+}
+
+func writeBatchOutput(path, output string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(output), 0644)
+}
@@ -0,0 +1,126 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatch(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "pkg"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "pkg", "a.go"), []byte("package a"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "pkg", "b.go"), []byte("package b"), 0644))
+
+	manifestPath := filepath.Join(dir, "batch.yaml")
+	manifest := `
+concurrency: 2
+model: gpt-4o
+jobs:
+  - name: docs
+    type: prompt
+    prompt: Document this
+    files: ["pkg/*.go"]
+    each: true
+    output: docs/{file}.md
+  - type: prompt
+    prompt: Overview
+    output: overview.md
+    temperature: 0.5
+`
+	assert.Nil(t, os.WriteFile(manifestPath, []byte(manifest), 0644))
+
+	loaded, err := LoadBatchManifest(manifestPath)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(loaded.Jobs))
+	assert.Equal(t, "docs:pkg/a.go", loaded.Jobs[0].Name)
+	assert.Equal(t, filepath.Join(dir, "docs", "pkg", "b.go.md"), loaded.Jobs[1].Output)
+	assert.Equal(t, "job2", loaded.Jobs[2].Name)
+	assert.Equal(t, float32(0), *loaded.Jobs[0].Temperature)
+	assert.Equal(t, float32(0.5), *loaded.Jobs[2].Temperature)
+
+	llm := &echoLLM{}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+		Out:           new(bytes.Buffer),
+	}
+
+	assert.Nil(t, butterfish.RunBatch(loaded, false))
+	assert.Equal(t, 3, len(llm.requests))
+
+	output, err := os.ReadFile(filepath.Join(dir, "docs", "pkg", "a.go.md"))
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(output), "echo: Document this"))
+	assert.Contains(t, string(output), "package a")
+
+	// outputs exist, so a second run skips everything
+	assert.Nil(t, butterfish.RunBatch(loaded, false))
+	assert.Equal(t, 3, len(llm.requests))
+}
+
+func TestBatchSummarizeSettings(t *testing.T) {
+	dir := t.TempDir()
+	content := strings.Repeat("a line of the notes file\n", 10)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte(content), 0644))
+
+	manifestPath := filepath.Join(dir, "batch.yaml")
+	manifest := `
+model: gpt-4o
+chunk_size: 100
+jobs:
+  - type: summarize
+    files: ["notes.txt"]
+    output: summary.md
+    model: gpt-4o-mini
+    max_tokens: 300
+    temperature: 0.3
+`
+	assert.Nil(t, os.WriteFile(manifestPath, []byte(manifest), 0644))
+	loaded, err := LoadBatchManifest(manifestPath)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, loaded.Jobs[0].ChunkSize)
+
+	llm := &echoLLM{}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+		Out:           new(bytes.Buffer),
+	}
+	assert.Nil(t, butterfish.RunBatch(loaded, false))
+
+	// 250 bytes in chunks of 100 are summarized as facts, then the facts
+	assert.Greater(t, len(llm.requests), 2)
+	for _, request := range llm.requests {
+		assert.Equal(t, "gpt-4o-mini", request.Model)
+		assert.Equal(t, 300, request.MaxTokens)
+		assert.Equal(t, float32(0.3), request.Temperature)
+	}
+}
+
+func TestBatchManifestErrors(t *testing.T) {
+	dir := t.TempDir()
+	manifestPath := filepath.Join(dir, "batch.yaml")
+
+	for _, manifest := range []string{
+		"jobs: []",
+		"jobs:\n  - type: translate\n    prompt: hi\n    output: out.md",
+		"jobs:\n  - type: prompt\n    prompt: hi",
+		"jobs:\n  - type: prompt\n    prompt: hi\n    files: [nothing/*]\n    output: out.md",
+		"jobs:\n  - type: prompt\n    prompt: hi\n    files: [batch.yaml]\n    each: true\n    output: out.md",
+		"unknown_key: 1",
+	} {
+		assert.Nil(t, os.WriteFile(manifestPath, []byte(manifest), 0644))
+		_, err := LoadBatchManifest(manifestPath)
+		assert.NotNil(t, err, manifest)
+	}
+}
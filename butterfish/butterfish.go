@@ -10,8 +10,11 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"reflect"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 	"unicode"
@@ -39,6 +42,9 @@ type ButterfishConfig struct {
 	// 1 = verbose output
 	// 2 = very verbose output
 	Verbose int
+	// LogFormatBoxes or LogFormatJSONL, the latter logs a JSON record for
+	// every LLM request
+	LogFormat string
 
 	// build variables
 	BuildInfo string
@@ -48,9 +54,18 @@ type ButterfishConfig struct {
 	OpenAIToken  string
 	BaseURL      string
 	TokenTimeout time.Duration // how long to wait for a token before timing out
+	// Where OpenAIToken came from unless it's from the profile, e.g. the
+	// OPENAI_API_KEY env var, see KeySource
+	OpenAITokenSource string
+	// The store OpenAIToken was read from, new keys are saved there, nil if
+	// it came from somewhere else. See tokenstore.go
+	TokenStore TokenStore
 
 	// LLM API communication client that implements the LLM interface
 	LLMClient LLM
+	// Set for commands that never call the API, like paths and tokens, so
+	// NewButterfish doesn't require a token or build a client
+	NoLLM bool
 
 	// Color scheme to use for the shell, see GruvboxDark below
 	ColorScheme *ColorScheme
@@ -59,6 +74,22 @@ type ButterfishConfig struct {
 	// These are what should actually be used during rendering
 	Styles    *styles
 	ColorDark bool
+	// Chroma style for code blocks, see CodeTheme
+	Theme string
+	// No color or styling anywhere, set with NO_COLOR, see DisableColor
+	NoColor bool
+
+	// Parsed config file (may be empty) and the active profile from it
+	ConfigFile  *ConfigFile
+	Profile     *Profile
+	profileBase *Profile
+	// The persona from --persona, nil for none
+	Persona *Persona
+
+	// Directory under which per-profile state lives, and the resolved
+	// directory for the active profile, e.g. ~/.local/state/butterfish/profiles/work
+	StateBaseDir string
+	StateDir     string
 
 	// Path of yaml file from which to load LLM prompts
 	// Defaults to ~/.config/butterfish/prompts.yaml
@@ -74,6 +105,7 @@ type ButterfishConfig struct {
 	ShellBinary             string // path to the shell binary to use, e.g. /bin/zsh
 	ShellPromptModel        string // used when the user enters an explicit prompt
 	ShellLeavePromptAlone   bool   // don't try to edit the shell prompt
+	ShellPromptPrefix       string // prompts start with this rather than a capital letter
 	ShellAutosuggestEnabled bool   // whether to use autosuggest
 	ShellAutosuggestModel   string // used when we're autocompleting a command
 	// how long to wait between when the user stos typing and we ask for an
@@ -83,10 +115,52 @@ type ButterfishConfig struct {
 	ShellNewlineAutosuggestTimeout time.Duration
 	// Maximum tokens in a prompt regardless of model capacity
 	ShellMaxPromptTokens int
-	// Maximum tokens that a single history line-item can consume
+	// Maximum tokens that a single history line-item can consume, 0 to size it
+	// from the model's context window
 	ShellMaxHistoryBlockTokens int
-	// Maximum tokens for the response, reserved when calculating history and passed as max_tokens during inference
+	// Maximum tokens for the response, reserved when calculating history and passed as max_tokens during inference,
+	// 0 to size it from the model's context window
 	ShellMaxResponseTokens int
+	// Automatically ask for a diagnosis when a command exits non-zero, at most
+	// once per interval
+	ShellAutoDebug         bool
+	ShellAutoDebugInterval time.Duration
+	// Answer prompts in the background and print the answer at the next
+	// prompt, so the shell can be used meanwhile
+	ShellBackgroundAnswers bool
+	// Open answers taller than the terminal in $PAGER once they're finished
+	ShellPager bool
+	// A previously exported session to start the history with
+	ShellResume *HistoryExport
+	// Search the index for the shell's directory when prompting with a
+	// question and add the results to the system message, up to this many
+	// tokens
+	ShellIndexContext       bool
+	ShellIndexContextTokens int
+	// Add the tmux pane's scrollback to the history when the shell starts
+	ShellTmuxContext bool
+	// Extra env var name patterns to record in the session transcript, on top
+	// of DefaultSessionEnvVars
+	ShellSessionEnvVars []string
+	// Extra command patterns to keep out of the history, on top of
+	// DefaultShellExcludeCommands
+	ShellExcludeCommands []string
+	// Commands starting with a capital letter that aren't on the PATH, like
+	// aliases, on top of the ones that are
+	ShellCapitalizedCommands []string
+	// Bytes of the key sequence that starts an inline edit of the command
+	// being typed, nil disables it, see ParseKeySequence
+	ShellInlineEditKey []byte
+	// Follow vi mode line editing, see ViEditor
+	ShellViMode bool
+	// Run when a long answer or goal finishes while the terminal isn't
+	// focused, see Notifier
+	ShellNotifyCommand string
+	ShellNotifyAfter   time.Duration
+	// Directory of Starlark plugins for the shell, none are loaded if empty
+	ShellPluginDir string
+	// Turn system info providers on or off by name, see SystemInfoProviders
+	SystemInfo map[string]bool
 
 	// Model, temp, and max tokens to use when executing the `gencmd` command
 	GencmdModel       string
@@ -97,11 +171,57 @@ type ButterfishConfig struct {
 	ExeccheckModel       string
 	ExeccheckTemperature float32
 	ExeccheckMaxTokens   int
+	// Give up fixing commands in exec and goal mode after this many failures
+	// in a row, 0 means no limit
+	MaxFixAttempts int
+	// Commands, time, and tokens a goal can use before the agent has to hand
+	// back to the user or finish
+	GoalLimits GoalLimits
+	// Sub-agents an agent can run at once with spawn_task, 0 turns it off
+	MaxSubagents int
+	// Ask before index, summarize, and goal mode send more than this many
+	// dollars of input, 0 means never ask
+	CostThreshold float64
 
 	// Model, temp, and max tokens to use when executing the `summarize` command
 	SummarizeModel       string
 	SummarizeTemperature float32
 	SummarizeMaxTokens   int
+	// How many chunk summaries to request at once
+	SummarizeConcurrency int
+
+	// Embeddings backend used by the index commands: openai (through the LLM
+	// client), ollama, or command (an external program), see embedding.go.
+	// Empty is openai unless the profile sets one.
+	EmbeddingBackend string
+	EmbeddingModel   string
+	EmbeddingURL     string
+	EmbeddingCommand string
+
+	// Format for writing index dotfiles, one of embedding.IndexFormats
+	IndexFormat string
+	// Disable approximate search for large indexes
+	ExactSearch bool
+	// Keep index files here rather than in the directories they index, empty
+	// for dotfiles, see embedding/store.go
+	IndexStoreDir string
+
+	// Timeout and retries per feature, see DefaultRequestLimits
+	RequestLimits map[string]RequestLimits
+	// Which errors are retried and how long to wait between retries
+	RetryPolicy *RetryPolicy
+	// Directory for cached responses to requests with temperature 0, empty
+	// turns the cache off, see cache.go
+	ResponseCacheDir string
+	// How long a cached response is good for, 0 means forever
+	ResponseCacheTTL time.Duration
+	// LLMModeLive, LLMModeRecord to record requests and responses to the
+	// fixtures file, or LLMModeReplay to answer from it, see replay.go
+	LLMMode     string
+	LLMFixtures string
+	// Middlewares around the LLM backend from the outermost, see
+	// DefaultMiddleware
+	Middleware []string
 }
 
 func (this *ButterfishConfig) ParseShell() string {
@@ -119,8 +239,12 @@ type PromptLibrary interface {
 	// returned. If a variable is not found, or an argument is passed that doesn't
 	// have a corresponding variable, an error is returned.
 	GetPrompt(name string, args ...string) (string, error)
+	// Like GetPrompt, but uses the prompt's variant for the model if it has
+	// one, falling back to the default prompt
+	GetPromptForModel(name, model string, args ...string) (string, error)
 
 	GetUninterpolatedPrompt(name string) (string, error)
+	GetUninterpolatedPromptForModel(name, model string) (string, error)
 	InterpolatePrompt(prompt string, args ...string) (string, error)
 }
 
@@ -152,6 +276,10 @@ type ButterfishCtx struct {
 	CommandRegister string
 	// embedding index for searching local files
 	VectorIndex embedding.FileEmbeddingIndex
+	// terminals connected with butterfish wrap, only set in console mode
+	Console *ConsoleServer
+	// hooks from the config file, nil if there aren't any
+	Hooks *Hooks
 }
 
 type ColorScheme struct {
@@ -210,9 +338,21 @@ func MakeButterfishConfig() *ButterfishConfig {
 		ExeccheckModel:       BestCompletionModel,
 		ExeccheckTemperature: 0.6,
 		ExeccheckMaxTokens:   512,
+		MaxFixAttempts:       DefaultMaxFixAttempts,
+		GoalLimits:           DefaultGoalLimits,
+		MaxSubagents:         DefaultMaxSubagents,
+		CostThreshold:        DefaultCostThreshold,
 		SummarizeModel:       BestCompletionModel,
 		SummarizeTemperature: 0.7,
 		SummarizeMaxTokens:   1024,
+		SummarizeConcurrency: DefaultSummarizeConcurrency,
+		IndexFormat:          embedding.IndexFormatFloat16,
+		RequestLimits:        DefaultRequestLimits(),
+		RetryPolicy:          DefaultRetryPolicy(),
+		ResponseCacheTTL:     DefaultResponseCacheTTL,
+		LLMMode:              LLMModeLive,
+		LLMFixtures:          DefaultFixturesPath,
+		Middleware:           DefaultMiddleware,
 	}
 }
 
@@ -343,8 +483,10 @@ func (this *ButterfishCtx) initVectorIndex(pathsToLoad []string) error {
 	}
 
 	out := util.NewStyledWriter(this.Out, this.Config.Styles.Foreground)
-	index := embedding.NewDiskCachedEmbeddingIndex(this, out)
-
+	index, err := this.NewEmbeddingIndex(out)
+	if err != nil {
+		return err
+	}
 	if this.Config.Verbose > 0 {
 		index.SetOutput(this.Out)
 	}
@@ -367,6 +509,23 @@ func (this *ButterfishCtx) initVectorIndex(pathsToLoad []string) error {
 	return nil
 }
 
+// An embedding index using the configured embeddings backend and index
+// format, with nothing loaded, progress is written to out
+func (this *ButterfishCtx) NewEmbeddingIndex(out io.Writer) (*embedding.DiskCachedEmbeddingIndex, error) {
+	embedder, err := this.newEmbedder()
+	if err != nil {
+		return nil, err
+	}
+
+	index := embedding.NewDiskCachedEmbeddingIndex(embedder, out)
+	if this.Config.IndexFormat != "" {
+		index.Format = this.Config.IndexFormat
+	}
+	index.ExactSearch = this.Config.ExactSearch
+	index.StoreDir = this.Config.IndexStoreDir
+	return index, nil
+}
+
 func (this *ButterfishCtx) printError(err error, prefix ...string) {
 	if len(prefix) > 0 {
 		fmt.Fprintf(this.Out, "%s error: %s\n", prefix[0], err.Error())
@@ -399,6 +558,43 @@ func (this *styles) PrintTestColors() {
 	fmt.Println(this.Grey.Render("Grey"))
 }
 
+// Styles that render text as is
+func NoColorStyles() *styles {
+	plain := lipgloss.NewStyle()
+	return &styles{
+		Question:   plain,
+		Answer:     plain,
+		Go:         plain,
+		Highlight:  plain,
+		Summarize:  plain,
+		Prompt:     plain,
+		Error:      plain,
+		Foreground: plain,
+		Grey:       plain,
+	}
+}
+
+// Turn off colors in styles, the shell, code blocks, and logging boxes
+func (this *ButterfishConfig) DisableColor() {
+	this.NoColor = true
+	this.Styles = NoColorStyles()
+	loggingBoxColors = false
+}
+
+// The chroma style for code blocks, monokai or monokailight unless a theme
+// was set
+func (this *ButterfishConfig) CodeTheme() string {
+	switch {
+	case this.NoColor:
+		return util.NoHighlightTheme
+	case this.Theme != "":
+		return this.Theme
+	case this.ColorDark:
+		return "monokai"
+	}
+	return "monokailight"
+}
+
 func ColorSchemeToStyles(colorScheme *ColorScheme) *styles {
 	return &styles{
 		Question:   lipgloss.NewStyle().Foreground(lipgloss.Color(colorScheme.Color5)),
@@ -416,7 +612,7 @@ func ColorSchemeToStyles(colorScheme *ColorScheme) *styles {
 // Let's initialize our prompts. If we have a prompt library file, we'll load it.
 // Either way, we'll then add the default prompts to the library, replacing
 // loaded prompts only if OkToReplace is set on them. Then we save the library
-// at the same path.
+// at the same path if anything changed.
 func NewDiskPromptLibrary(path string, verbose bool, writer io.Writer) (*prompt.DiskPromptLibrary, error) {
 	promptLibrary := prompt.NewPromptLibrary(path, verbose, writer)
 	loaded := false
@@ -428,8 +624,12 @@ func NewDiskPromptLibrary(path string, verbose bool, writer io.Writer) (*prompt.
 		}
 		loaded = true
 	}
+	before := make([]prompt.Prompt, len(promptLibrary.Prompts))
+	copy(before, promptLibrary.Prompts)
 	promptLibrary.ReplacePrompts(prompt.DefaultPrompts)
-	promptLibrary.Save()
+	if !loaded || !reflect.DeepEqual(before, promptLibrary.Prompts) {
+		promptLibrary.Save()
+	}
 
 	if !loaded {
 		fmt.Fprintf(writer, "Wrote prompt library at %s\n", path)
@@ -438,17 +638,135 @@ func NewDiskPromptLibrary(path string, verbose bool, writer io.Writer) (*prompt.
 	return promptLibrary, nil
 }
 
+// A PromptLibrary that defers loading until a prompt is first requested, so
+// that commands which never prompt don't pay for reading and writing the
+// prompt library file.
+type LazyPromptLibrary struct {
+	init    func() (PromptLibrary, error)
+	once    sync.Once
+	library PromptLibrary
+	err     error
+}
+
+func NewLazyPromptLibrary(init func() (PromptLibrary, error)) *LazyPromptLibrary {
+	return &LazyPromptLibrary{init: init}
+}
+
+func (this *LazyPromptLibrary) get() (PromptLibrary, error) {
+	this.once.Do(func() {
+		this.library, this.err = this.init()
+	})
+	return this.library, this.err
+}
+
+func (this *LazyPromptLibrary) GetPrompt(name string, args ...string) (string, error) {
+	library, err := this.get()
+	if err != nil {
+		return "", err
+	}
+	return library.GetPrompt(name, args...)
+}
+
+func (this *LazyPromptLibrary) GetPromptForModel(name, model string, args ...string) (string, error) {
+	library, err := this.get()
+	if err != nil {
+		return "", err
+	}
+	return library.GetPromptForModel(name, model, args...)
+}
+
+func (this *LazyPromptLibrary) GetUninterpolatedPrompt(name string) (string, error) {
+	library, err := this.get()
+	if err != nil {
+		return "", err
+	}
+	return library.GetUninterpolatedPrompt(name)
+}
+
+func (this *LazyPromptLibrary) GetUninterpolatedPromptForModel(name, model string) (string, error) {
+	library, err := this.get()
+	if err != nil {
+		return "", err
+	}
+	return library.GetUninterpolatedPromptForModel(name, model)
+}
+
+func (this *LazyPromptLibrary) InterpolatePrompt(prompt string, args ...string) (string, error) {
+	library, err := this.get()
+	if err != nil {
+		return "", err
+	}
+	return library.InterpolatePrompt(prompt, args...)
+}
+
+func (this *LazyPromptLibrary) Names() []string {
+	library, err := this.get()
+	if err != nil {
+		return nil
+	}
+	return promptNames(library)
+}
+
+// Build the LLM client, a backend wrapped in the middleware chain, see
+// middleware.go
 func initLLM(config *ButterfishConfig) (LLM, error) {
-	if config.OpenAIToken == "" && config.LLMClient != nil {
+	if config.NoLLM {
+		return nil, nil
+	}
+
+	replaying := config.LLMMode == LLMModeReplay
+	if config.OpenAIToken == "" && config.LLMClient == nil && !replaying {
+		// index commands with a local embeddings backend run without an LLM
+		if !config.EmbeddingNeedsToken() {
+			return nil, nil
+		}
 		return nil, errors.New("Must provide either an OpenAI Token or an LLM client.")
 	} else if config.OpenAIToken != "" && config.LLMClient != nil {
 		return nil, errors.New("Must provide either an OpenAI Token or an LLM client, not both.")
-	} else if config.OpenAIToken != "" {
-		gpt := NewGPT(config.OpenAIToken, config.BaseURL)
-		return gpt, nil
-	} else {
-		return config.LLMClient, nil
 	}
+
+	var redactConfig *RedactConfig
+	if config.ConfigFile != nil {
+		redactConfig = config.ConfigFile.Redact
+	}
+	redactor, err := NewRedactor(redactConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	names := config.Middleware
+	if names == nil {
+		names = DefaultMiddleware
+	}
+	chain := &middlewareChain{
+		config:   config,
+		names:    names,
+		redactor: redactor,
+		hooks:    configHooks(config),
+	}
+
+	record := slices.Index(names, MiddlewareRecord)
+	if (replaying || config.LLMMode == LLMModeRecord) && record < 0 {
+		return nil, fmt.Errorf("--llm=%s needs %s in the middleware list of the config file", config.LLMMode, MiddlewareRecord)
+	}
+	if replaying {
+		replay, err := LoadReplayLLM(config.LLMFixtures)
+		if err != nil {
+			return nil, err
+		}
+		chain.names = names[:record]
+		return chain.wrap(replay, 0), nil
+	}
+
+	if config.LLMClient != nil {
+		return chain.wrap(config.LLMClient, 0), nil
+	}
+
+	if config.StateDir != "" {
+		chain.tracker = NewUsageTracker(config.StateDir)
+	}
+	backend := NewAuthCheckingLLM(NewGPT(config.OpenAIToken, config.BaseURL), config.KeySource())
+	return chain.wrap(backend, 0), nil
 }
 
 func initPromptLibrary(config *ButterfishConfig) (PromptLibrary, error) {
@@ -463,7 +781,15 @@ func initPromptLibrary(config *ButterfishConfig) (PromptLibrary, error) {
 		return nil, err
 	}
 
-	return NewDiskPromptLibrary(promptPath, config.Verbose > 0, verboseWriter)
+	// The shell will need prompts right away, and we don't want a first-run
+	// message printed in the middle of the session
+	if config.ShellMode {
+		return NewDiskPromptLibrary(promptPath, config.Verbose > 0, verboseWriter)
+	}
+
+	return NewLazyPromptLibrary(func() (PromptLibrary, error) {
+		return NewDiskPromptLibrary(promptPath, config.Verbose > 0, verboseWriter)
+	}), nil
 }
 
 func NewButterfish(ctx context.Context, config *ButterfishConfig) (*ButterfishCtx, error) {
@@ -487,7 +813,17 @@ func NewButterfish(ctx context.Context, config *ButterfishConfig) (*ButterfishCt
 		Config:        config,
 		LLMClient:     llmClient,
 		Out:           os.Stdout,
+		Hooks:         configHooks(config),
 	}
 
 	return butterfishCtx, nil
 }
+
+// A copy that makes requests with ctx and writes any output to out, for a
+// single call from a program that embeds Butterfish, see the client package
+func (this *ButterfishCtx) WithContext(ctx context.Context, out io.Writer) *ButterfishCtx {
+	clone := *this
+	clone.Ctx = ctx
+	clone.Out = out
+	return &clone
+}
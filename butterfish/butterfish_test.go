@@ -1,9 +1,23 @@
 package butterfish
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	openai "github.com/sashabaranov/go-openai"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
 )
 
 func TestFixCommandParse(t *testing.T) {
@@ -93,6 +107,139 @@ func TestShellHistory(t *testing.T) {
 	assert.Equal(t, "llm2more llm ᐅ", output)
 }
 
+func TestShellHistoryLastCommand(t *testing.T) {
+	history := NewShellHistory()
+
+	command, _ := history.LastCommand()
+	assert.Nil(t, command)
+
+	history.Append(historyTypeShellInput, "make")
+	history.Append(historyTypeShellOutput, "error: ")
+	history.Append(historyTypeShellOutput, "missing target")
+
+	command, output := history.LastCommand()
+	assert.Equal(t, "make", command.Content.String())
+	assert.Equal(t, "error: missing target", output)
+
+	// a prompt after the command means there's nothing to diagnose
+	history.Append(historyTypePrompt, "why did that fail?")
+	command, _ = history.LastCommand()
+	assert.Nil(t, command)
+}
+
+func TestShellHistoryFinishCommand(t *testing.T) {
+	history := NewShellHistory()
+	start := time.Now()
+
+	history.AddCommand("", start)
+	assert.Empty(t, history.Blocks)
+
+	history.AddCommand("ls /nope", start)
+	history.Append(historyTypeShellOutput, "ls: /nope: No such file or directory")
+	history.FinishCommand(127, start.Add(200*time.Millisecond))
+	command := history.Blocks[0]
+	assert.True(t, command.Finished)
+	assert.Equal(t, "command failed with exit 127 after 0.2s", command.CommandStatus())
+
+	// a later prompt doesn't change a finished command
+	history.FinishCommand(0, start.Add(time.Second))
+	assert.Equal(t, 127, command.ExitCode)
+
+	history.AddCommand("sleep 90", start)
+	history.FinishCommand(0, start.Add(90*time.Second))
+	assert.Equal(t, "command succeeded after 1m30s", history.Blocks[2].CommandStatus())
+
+	// a prompt isn't a command
+	history.Append(historyTypePrompt, "hello")
+	history.FinishCommand(1, start)
+	assert.Equal(t, "", history.Blocks[3].CommandStatus())
+}
+
+func TestShellHistoryRendersOutput(t *testing.T) {
+	history := NewShellHistory()
+	history.SetTerminalSize(20, 5)
+
+	history.AddCommand("make", time.Now())
+	history.Append(historyTypeShellOutput, "building\r\n\x1b[32m[###   ] 50%\x1b[0m")
+	history.Append(historyTypeShellOutput, "\r[######] 100%\r\n")
+	command, output := history.LastCommand()
+	assert.Equal(t, "make", command.Content.String())
+	assert.Equal(t, "building\n[######] 100%", output)
+
+	history.AddCommand("vim", time.Now())
+	history.Append(historyTypeShellOutput, "\x1b[?1049h\x1b[H~\r\n~\x1b[?1049l")
+	_, output = history.LastCommand()
+	assert.Equal(t, "", output)
+}
+
+func TestShellHistoryRemoveLastPrompt(t *testing.T) {
+	history := NewShellHistory()
+
+	history.Append(historyTypeShellInput, "ls")
+	history.Append(historyTypePrompt, "something the model refuses")
+	history.RemoveLastPrompt()
+	assert.Equal(t, "ls", HistoryBlocksToString(history.GetLastNBytes(256, 512)))
+
+	// only a trailing prompt is removed
+	history.RemoveLastPrompt()
+	assert.Equal(t, "ls", HistoryBlocksToString(history.GetLastNBytes(256, 512)))
+}
+
+func TestRefusalReason(t *testing.T) {
+	assert.Equal(t, "", refusalReason("stop", ""))
+	assert.Equal(t, "I can't help with that", refusalReason("stop", "I can't help with that"))
+	assert.NotEqual(t, "", refusalReason("content_filter", ""))
+
+	err := &openai.APIError{Code: "content_filter", Message: "filtered"}
+	assert.Equal(t, "filtered", contentFilterRefusal(fmt.Errorf("request failed: %w", err)).Refusal)
+	assert.Nil(t, contentFilterRefusal(&openai.APIError{Code: "rate_limit_exceeded"}))
+}
+
+func TestLocalCommandArg(t *testing.T) {
+	arg, ok := localCommandArg("Model gpt-4o", "model")
+	assert.True(t, ok)
+	assert.Equal(t, "gpt-4o", arg)
+
+	arg, ok = localCommandArg("  model  ", "model")
+	assert.True(t, ok)
+	assert.Equal(t, "", arg)
+
+	_, ok = localCommandArg("Model the data as a graph", "model")
+	assert.False(t, ok)
+
+	_, ok = localCommandArg("Models are fun", "model")
+	assert.False(t, ok)
+
+	text, ok := localCommandText("system Be terse.  Answer in English", "system")
+	assert.True(t, ok)
+	assert.Equal(t, "Be terse.  Answer in English", text)
+
+	_, ok = localCommandText("Systemd is failing", "system")
+	assert.False(t, ok)
+
+	text, ok = localCommandColonText("system: Be terse.  Answer in English", "system")
+	assert.True(t, ok)
+	assert.Equal(t, "Be terse.  Answer in English", text)
+
+	text, ok = localCommandColonText("System", "system")
+	assert.True(t, ok)
+	assert.Equal(t, "", text)
+}
+
+func TestSystemLocalCommand(t *testing.T) {
+	shell := pluginShell()
+
+	// a prompt that starts with the word goes to the LLM
+	shell.Prompt.Write("System load is high, what's using the CPU?")
+	assert.False(t, shell.HandleLocalPrompt())
+	assert.Equal(t, "", shell.SystemMessage)
+
+	shell.Prompt.Clear()
+	shell.Prompt.Write("System: Answer like a pirate")
+	assert.True(t, shell.HandleLocalPrompt())
+	assert.Equal(t, "Answer like a pirate", shell.SystemMessage)
+}
+
 // A test case for incompleteAnsiSequence()
 func TestIncompleteAnsiSequence(t *testing.T) {
 	// incomplete sequence
@@ -102,3 +249,128 @@ func TestIncompleteAnsiSequence(t *testing.T) {
 	assert.False(t, incompleteAnsiSequence([]byte{0x1b, 0x5b, 0x30, 0x3b, 0x31, 0x3b, 0x32, 0x6d, 0x1b, 0x5b, 0x30, 0x6d}))
 	assert.False(t, incompleteAnsiSequence([]byte{0x20, 0x20, 0x1b, 0x5b, 0x30, 0x3b, 0x31, 0x3b, 0x32, 0x6d, 0x1b, 0x5b, 0x30, 0x6d}))
 }
+
+// Commands that don't prompt shouldn't touch the prompt library file, this
+// guards the lazy initialization that keeps CLI startup fast.
+func TestNewButterfishIsLazy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prompts.yaml")
+	config := MakeButterfishConfig()
+	config.LLMClient = &echoLLM{}
+	config.PromptLibraryPath = path
+
+	butterfish, err := NewButterfish(context.Background(), config)
+	assert.Nil(t, err)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = butterfish.PromptLibrary.GetPrompt(prompt.PromptSystemMessage)
+	assert.Nil(t, err)
+	_, err = os.Stat(path)
+	assert.Nil(t, err)
+}
+
+func BenchmarkNewButterfish(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "prompts.yaml")
+	for i := 0; i < b.N; i++ {
+		config := MakeButterfishConfig()
+		config.LLMClient = &echoLLM{}
+		config.PromptLibraryPath = path
+		_, err := NewButterfish(context.Background(), config)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDiskPromptLibrary(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "prompts.yaml")
+	for i := 0; i < b.N; i++ {
+		_, err := NewDiskPromptLibrary(path, false, io.Discard)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Cancels the request on the first write, like Ctrl-C while an answer streams
+type cancelingWriter struct {
+	cancel context.CancelFunc
+	out    bytes.Buffer
+}
+
+func (this *cancelingWriter) Write(p []byte) (int, error) {
+	this.cancel()
+	return this.out.Write(p)
+}
+
+func TestInterruptedStreamKeepsPartialAnswer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, `data: {"id": "1", "object": "chat.completion.chunk", "choices": [{"index": 0, "delta": {"content": "Step one, "}}]}`+"\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := &cancelingWriter{cancel: cancel}
+	request := &util.CompletionRequest{Ctx: ctx, Model: "gpt-4o", Prompt: "How do I deploy?", SystemMessage: "Be brief"}
+	response, err := NewGPT("token", server.URL).CompletionStream(request, writer)
+	assert.ErrorContains(t, err, "context canceled")
+	assert.Equal(t, "Step one, ", response.Completion)
+	assert.True(t, response.Interrupted)
+}
+
+func TestShellHistoryInterruptedAnswer(t *testing.T) {
+	history := NewShellHistory()
+	history.Append(historyTypePrompt, "How do I deploy?")
+	assert.False(t, history.LastAnswerInterrupted())
+
+	history.AddInterruptedAnswer("Step one, ")
+	history.Append(historyTypeShellOutput, "$ ")
+	assert.True(t, history.LastAnswerInterrupted())
+
+	history.Append(historyTypePrompt, continuePrompt)
+	history.Append(historyTypeLLMOutput, "step two.")
+	assert.False(t, history.LastAnswerInterrupted())
+}
+
+// Streams part of an answer and then fails with err
+type interruptedLLM struct {
+	failoverTestLLM
+	partial string
+}
+
+func (this *interruptedLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	writer.Write([]byte(this.partial))
+	return interruptedResponse(this.partial, nil), this.err
+}
+
+func TestCompletionRoutineInterrupted(t *testing.T) {
+	shell := pluginShell()
+
+	// Continue is an ordinary prompt unless an answer was cut off
+	shell.Prompt.Write("Continue")
+	assert.False(t, shell.HandleLocalPrompt())
+
+	// Ctrl-C before anything arrived leaves nothing for the history, rather
+	// than the error
+	client := &interruptedLLM{failoverTestLLM: failoverTestLLM{err: context.Canceled}}
+	out := new(bytes.Buffer)
+	CompletionRoutine(&util.CompletionRequest{}, client, out, shell.PromptOutputChan, "", "", nil)
+	assert.Equal(t, &util.CompletionResponse{}, <-shell.PromptOutputChan)
+	assert.Equal(t, "", out.String())
+
+	client.partial = "Step one, "
+	CompletionRoutine(&util.CompletionRequest{}, client, out, shell.PromptOutputChan, "", "", nil)
+	output := <-shell.PromptOutputChan
+	assert.Equal(t, "Step one, ", output.Completion)
+	assert.True(t, output.Interrupted)
+
+	// a timeout suggests continuing
+	out.Reset()
+	client.err = errors.New("Timed out waiting for streaming response")
+	CompletionRoutine(&util.CompletionRequest{}, client, out, shell.PromptOutputChan, "", "", nil)
+	<-shell.PromptOutputChan
+	assert.Contains(t, out.String(), `Type "Continue" to pick up the answer where it stopped`)
+}
@@ -0,0 +1,200 @@
+package butterfish
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Requests with a temperature of 0 are close enough to deterministic that we
+// cache their responses on disk, so a script that calls `butterfish prompt`
+// with the same input again gets the answer instantly without an API call.
+// Entries are keyed by a hash of everything that affects the answer and
+// expire after a TTL, --no-cache turns the cache off.
+
+const DefaultResponseCacheTTL = 24 * time.Hour
+
+// Everything in a request that affects the response, and where it's sent, so
+// that the same model name on another server or profile isn't answered from
+// this one's entries
+type responseCacheKey struct {
+	BaseURL       string `json:",omitempty"`
+	Profile       string `json:",omitempty"`
+	Model         string
+	SystemMessage string
+	Prompt        string
+	HistoryBlocks []util.HistoryBlock
+	Functions     []util.FunctionDefinition
+	Tools         []util.ToolDefinition
+	MaxTokens     int
+	JSONSchema    json.RawMessage
+	Images        []util.CompletionImage
+}
+
+type responseCacheEntry struct {
+	Created  time.Time
+	Response *util.CompletionResponse
+}
+
+// An LLM wrapper that answers repeated deterministic requests from disk
+type CachingLLM struct {
+	LLM LLM
+	Dir string
+	// How long an entry is good for, 0 means forever
+	TTL time.Duration
+	// Part of every key, see responseCacheKey
+	BaseURL string
+	Profile string
+}
+
+func NewCachingLLM(llm LLM, dir string, ttl time.Duration) *CachingLLM {
+	return &CachingLLM{
+		LLM: llm,
+		Dir: dir,
+		TTL: ttl,
+	}
+}
+
+func (this *CachingLLM) Unwrap() LLM {
+	return this.LLM
+}
+
+// A hash of everything in a request that affects the response
+func requestHash(request *util.CompletionRequest) (string, error) {
+	return scopedRequestHash("", "", request)
+}
+
+// Like requestHash, also keyed by where the request is sent
+func scopedRequestHash(baseURL, profile string, request *util.CompletionRequest) (string, error) {
+	data, err := json.Marshal(&responseCacheKey{
+		BaseURL:       baseURL,
+		Profile:       profile,
+		Model:         request.Model,
+		SystemMessage: request.SystemMessage,
+		Prompt:        request.Prompt,
+		HistoryBlocks: request.HistoryBlocks,
+		Functions:     request.Functions,
+		Tools:         request.Tools,
+		MaxTokens:     request.MaxTokens,
+		JSONSchema:    request.JSONSchema,
+		Images:        request.Images,
+	})
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// The path of a request's cache entry, empty if the request can't be cached
+func (this *CachingLLM) path(request *util.CompletionRequest) string {
+	if request.Temperature != 0 {
+		return ""
+	}
+	hash, err := scopedRequestHash(this.BaseURL, this.Profile, request)
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(this.Dir, hash+".json")
+}
+
+func (this *CachingLLM) get(path string) *util.CompletionResponse {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	entry := &responseCacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil || entry.Response == nil {
+		return nil
+	}
+	if this.TTL > 0 && time.Since(entry.Created) > this.TTL {
+		os.Remove(path)
+		return nil
+	}
+	log.Printf("Answering from the response cache, %s", path)
+	return entry.Response
+}
+
+func (this *CachingLLM) put(path string, response *util.CompletionResponse) {
+	// an answer from a fallback model doesn't belong to the requested one
+	if response == nil || response.Model != "" {
+		return
+	}
+	// a refusal may not happen again, e.g. after a content filter change
+	if response.Refusal != "" {
+		return
+	}
+
+	cached := *response
+	cached.Metrics = nil
+	data, err := json.Marshal(&responseCacheEntry{Created: time.Now(), Response: &cached})
+	if err != nil {
+		return
+	}
+
+	// write and rename so that a concurrent call never reads half an entry
+	err = os.MkdirAll(this.Dir, 0700)
+	if err == nil {
+		var file *os.File
+		file, err = os.CreateTemp(this.Dir, ".tmp-*")
+		if err == nil {
+			_, err = file.Write(data)
+			file.Close()
+			if err == nil {
+				err = os.Rename(file.Name(), path)
+			}
+			if err != nil {
+				os.Remove(file.Name())
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Unable to write to the response cache: %s", err)
+	}
+}
+
+func (this *CachingLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	path := this.path(request)
+	if path == "" {
+		return this.LLM.CompletionStream(request, writer)
+	}
+	if response := this.get(path); response != nil {
+		_, err := writer.Write([]byte(response.Completion))
+		return response, err
+	}
+
+	response, err := this.LLM.CompletionStream(request, writer)
+	if err == nil {
+		this.put(path, response)
+	}
+	return response, err
+}
+
+func (this *CachingLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	path := this.path(request)
+	if path == "" {
+		return this.LLM.Completion(request)
+	}
+	if response := this.get(path); response != nil {
+		return response, nil
+	}
+
+	response, err := this.LLM.Completion(request)
+	if err == nil {
+		this.put(path, response)
+	}
+	return response, err
+}
+
+func (this *CachingLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	return this.LLM.Embeddings(ctx, input, verbose)
+}
@@ -0,0 +1,92 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func TestCachingLLM(t *testing.T) {
+	backend := &failoverTestLLM{}
+	llm := NewCachingLLM(backend, t.TempDir(), time.Hour)
+
+	request := &util.CompletionRequest{Ctx: context.Background(), Model: "gpt-4o", Prompt: "what is 2+2?"}
+	for i := 0; i < 2; i++ {
+		out := new(bytes.Buffer)
+		response, err := llm.CompletionStream(request, out)
+		assert.Nil(t, err)
+		assert.Equal(t, "from gpt-4o", response.Completion)
+		assert.Equal(t, "from gpt-4o", out.String())
+	}
+	assert.Equal(t, 1, len(backend.requests))
+
+	response, err := llm.Completion(request)
+	assert.Nil(t, err)
+	assert.Equal(t, "from gpt-4o", response.Completion)
+	assert.Equal(t, 1, len(backend.requests))
+
+	// anything that changes the answer is a different entry
+	other := *request
+	other.SystemMessage = "be brief"
+	llm.Completion(&other)
+	assert.Equal(t, 2, len(backend.requests))
+
+	// so is sampling
+	random := *request
+	random.Temperature = 0.7
+	llm.Completion(&random)
+	llm.Completion(&random)
+	assert.Equal(t, 4, len(backend.requests))
+
+	// another server or profile has its own entries
+	otherServer := NewCachingLLM(backend, llm.Dir, time.Hour)
+	otherServer.BaseURL = "http://localhost:11434/v1"
+	otherServer.Completion(request)
+	assert.Equal(t, 5, len(backend.requests))
+	otherProfile := NewCachingLLM(backend, llm.Dir, time.Hour)
+	otherProfile.Profile = "work"
+	otherProfile.Completion(request)
+	assert.Equal(t, 6, len(backend.requests))
+
+	// expired entries are fetched again
+	llm.TTL = time.Nanosecond
+	llm.Completion(request)
+	assert.Equal(t, 7, len(backend.requests))
+}
+
+func TestCachingLLMSkipsFallbacks(t *testing.T) {
+	primary := &failoverTestLLM{err: context.DeadlineExceeded}
+	fallback := &failoverTestLLM{}
+	failover := NewFailoverLLM(primary)
+	failover.Add("llama3.2", fallback)
+	llm := NewCachingLLM(failover, t.TempDir(), 0)
+
+	request := &util.CompletionRequest{Ctx: context.Background(), Model: "gpt-4o", Prompt: "hi"}
+	llm.Completion(request)
+	primary.err = nil
+	response, err := llm.Completion(request)
+	assert.Nil(t, err)
+	assert.Equal(t, "from gpt-4o", response.Completion)
+	assert.Equal(t, 2, len(primary.requests))
+}
+
+func TestCachingLLMSkipsRefusals(t *testing.T) {
+	backend := &failoverTestLLM{refusal: "I can't help with that"}
+	llm := NewCachingLLM(backend, t.TempDir(), 0)
+
+	request := &util.CompletionRequest{Ctx: context.Background(), Model: "gpt-4o", Prompt: "hi"}
+	response, err := llm.Completion(request)
+	assert.Nil(t, err)
+	assert.Equal(t, "I can't help with that", response.Refusal)
+
+	backend.refusal = ""
+	response, err = llm.Completion(request)
+	assert.Nil(t, err)
+	assert.Equal(t, "from gpt-4o", response.Completion)
+	assert.Equal(t, 2, len(backend.requests))
+}
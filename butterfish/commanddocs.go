@@ -0,0 +1,214 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The explain command adds extracts from the installed documentation of each
+// command to its prompt, so that flags are explained for the version on this
+// machine. We read the man page, or the --help output if there's no man page,
+// and keep the start of it plus the paragraphs describing the flags used.
+
+const (
+	commandDocsTimeout = 3 * time.Second
+	// Lines kept from the start of the docs, i.e. the name and synopsis
+	commandDocsIntroLines = 12
+	// Lines kept for each flag's description
+	commandDocsFlagLines = 8
+	maxCommandDocsLength = 3000
+)
+
+// Returns the documentation for a command, or "" if there isn't any
+type CommandDocsFunc func(ctx context.Context, name string) string
+
+// Commands that run another command, we document the command they run
+var wrapperCommands = map[string]bool{
+	"sudo":    true,
+	"env":     true,
+	"time":    true,
+	"nice":    true,
+	"nohup":   true,
+	"command": true,
+	"exec":    true,
+}
+
+// Man pages rendered without a terminal use backspaces for bold and underline
+var overstrikeRegex = regexp.MustCompile(".\x08")
+
+var envAssignmentRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// Read the man page for a command, falling back to its --help output
+func LocalCommandDocs(ctx context.Context, name string) string {
+	// only document things on the PATH, never run a path from the command line
+	if strings.ContainsRune(name, '/') {
+		return ""
+	}
+	if _, err := exec.LookPath(name); err != nil {
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, commandDocsTimeout)
+	defer cancel()
+
+	if _, err := exec.LookPath("man"); err == nil {
+		cmd := exec.CommandContext(ctx, "man", name)
+		cmd.Env = append(os.Environ(), "MANPAGER=cat", "PAGER=cat", "MANWIDTH=100", "GROFF_NO_SGR=1")
+		output, err := cmd.Output()
+		if err == nil && len(bytes.TrimSpace(output)) > 0 {
+			return stripANSI(overstrikeRegex.ReplaceAllString(string(output), ""))
+		}
+	}
+
+	// many tools print --help to stderr, or exit non-zero after printing it
+	cmd := exec.CommandContext(ctx, name, "--help")
+	output, _ := cmd.CombinedOutput()
+	return stripANSI(string(output))
+}
+
+// The command a stage runs, skipping env assignments and wrappers like sudo,
+// and the flags it's given
+func stageCommandAndFlags(stage *CommandStage) (string, []string) {
+	words := stage.Words
+	for len(words) > 0 &&
+		(envAssignmentRegex.MatchString(words[0]) || wrapperCommands[words[0]]) {
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		return "", nil
+	}
+
+	flags := []string{}
+	for _, word := range words[1:] {
+		if word == "--" {
+			break
+		}
+		if len(word) < 2 || word[0] != '-' {
+			continue
+		}
+		if i := strings.IndexByte(word, '='); i > 0 {
+			word = word[:i]
+		}
+		flags = append(flags, word)
+	}
+	return words[0], flags
+}
+
+// Whether a line of docs starts describing a flag, e.g. "-a, --all  do not
+// ignore entries starting with ."
+func describesFlag(line, flag string) bool {
+	line = strings.TrimSpace(line)
+	for _, part := range strings.Split(line, ", ") {
+		if !strings.HasPrefix(part, flag) {
+			continue
+		}
+		rest := part[len(flag):]
+		if rest == "" || strings.IndexByte(" =[\t,", rest[0]) != -1 {
+			return true
+		}
+	}
+	return false
+}
+
+func leadingSpaces(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " \t"))
+}
+
+// Keep the start of the docs and the description of each flag, truncated
+func CommandDocsExtract(docs string, flags []string) string {
+	lines := strings.Split(strings.ReplaceAll(docs, "\r", ""), "\n")
+	keep := make([]bool, len(lines))
+
+	intro := 0
+	for i := 0; i < len(lines) && intro < commandDocsIntroLines; i++ {
+		if strings.TrimSpace(lines[i]) != "" {
+			keep[i] = true
+			intro++
+		}
+	}
+
+	// mark a flag's description, returns false if it isn't documented
+	keepFlag := func(flag string) bool {
+		for i, line := range lines {
+			if !describesFlag(line, flag) {
+				continue
+			}
+			indent := leadingSpaces(line)
+			keep[i] = true
+			for j := i + 1; j < len(lines) && j <= i+commandDocsFlagLines; j++ {
+				next := lines[j]
+				if strings.TrimSpace(next) == "" ||
+					(leadingSpaces(next) <= indent && strings.HasPrefix(strings.TrimSpace(next), "-")) {
+					break
+				}
+				keep[j] = true
+			}
+			return true
+		}
+		return false
+	}
+
+	for _, flag := range flags {
+		if keepFlag(flag) || flag[1] == '-' {
+			continue
+		}
+		// combined short flags like -xzf
+		for _, c := range flag[1:] {
+			keepFlag("-" + string(c))
+		}
+	}
+
+	builder := strings.Builder{}
+	skipped := false
+	for i, line := range lines {
+		if !keep[i] {
+			skipped = true
+			continue
+		}
+		if skipped && builder.Len() > 0 {
+			builder.WriteString("...\n")
+		}
+		skipped = false
+		builder.WriteString(strings.TrimRight(line, " \t"))
+		builder.WriteString("\n")
+	}
+
+	extract := builder.String()
+	if len(extract) > maxCommandDocsLength {
+		extract = extract[:maxCommandDocsLength] + "...\n"
+	}
+	return extract
+}
+
+// Documentation extracts for each command in the stages, looked up once per
+// command
+func stagesCommandDocs(ctx context.Context, stages []*CommandStage, lookup CommandDocsFunc) string {
+	names := []string{}
+	flagsByName := map[string][]string{}
+	for _, stage := range stages {
+		name, flags := stageCommandAndFlags(stage)
+		if name == "" {
+			continue
+		}
+		if _, ok := flagsByName[name]; !ok {
+			names = append(names, name)
+		}
+		flagsByName[name] = append(flagsByName[name], flags...)
+	}
+
+	builder := strings.Builder{}
+	for _, name := range names {
+		docs := lookup(ctx, name)
+		if strings.TrimSpace(docs) == "" {
+			continue
+		}
+		fmt.Fprintf(&builder, "Documentation for %s:\n'''\n%s'''\n", name, CommandDocsExtract(docs, flagsByName[name]))
+	}
+	return builder.String()
+}
@@ -1,16 +1,21 @@
 package butterfish
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math/rand"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/charmbracelet/lipgloss"
@@ -27,7 +32,7 @@ import (
 // Parse and execute a command in a butterfish context
 func (this *ButterfishCtx) Command(cmd string) error {
 	parsed, options, err := this.ParseCommand(cmd)
-	if err != nil {
+	if err != nil || parsed == nil {
 		return err
 	}
 
@@ -39,16 +44,46 @@ func (this *ButterfishCtx) Command(cmd string) error {
 	return nil
 }
 
+// Commands that only make sense inside the console
+type consoleCommandConfig struct {
+	Exit struct {
+	} `cmd:"" help:"Exit the console."`
+	Quit struct {
+	} `cmd:"" hidden:""`
+	Help struct {
+	} `cmd:"" help:"Print this help."`
+
+	CliCommandConfig
+}
+
+// Parse a console command, returns a nil context if it was only a request for
+// --help, which has been printed
 func (this *ButterfishCtx) ParseCommand(cmd string) (*kong.Context, *CliCommandConfig, error) {
-	options := &CliCommandConfig{}
-	parser, err := kong.New(options)
+	options := &consoleCommandConfig{}
+	printedHelp := false
+	parser, err := kong.New(options,
+		kong.Name(""),
+		kong.Writers(this.Out, this.Out),
+		// kong exits after printing --help, we want to keep the console open
+		kong.Exit(func(int) { printedHelp = true }))
 	if err != nil {
 		return nil, nil, err
 	}
 
 	fields := strings.Fields(cmd)
 	kongCtx, err := parser.Parse(fields)
-	return kongCtx, options, err
+	if printedHelp {
+		return nil, nil, nil
+	}
+	return kongCtx, &options.CliCommandConfig, err
+}
+
+// Rerank flags shared by the index search commands
+type RerankOptions struct {
+	Rerank           bool   `help:"Rerank search results with an LLM or a cross-encoder endpoint before using them, this is slower but picks more relevant snippets."`
+	RerankCandidates int    `default:"20" help:"Number of candidates to fetch by cosine similarity and pass to the reranker."`
+	RerankModel      string `help:"Model used for reranking, defaults to gpt-4o-mini for LLM reranking. With --rerank-url this is passed to the endpoint."`
+	RerankURL        string `name:"rerank-url" help:"Rerank with a cross-encoder endpoint (Cohere/Jina style /rerank API, e.g. a local Infinity or llama.cpp server) instead of an LLM."`
 }
 
 // Kong CLI parser option configuration
@@ -62,10 +97,17 @@ type CliCommandConfig struct {
 		Functions     string   `short:"f" default:"" help:"Path to json file with functions to use for prompt."`
 		NoColor       bool     `default:"false" help:"Disable color output."`
 		NoBackticks   bool     `default:"false" help:"Strip out backticks around codeblocks."`
-	} `cmd:"" help:"Run an LLM prompt without wrapping, stream results back. This is a straight-through call to the LLM from the command line with a given prompt. This accepts piped input, if there is both piped input and a prompt then they will be concatenated together (prompt first). It is recommended that you wrap the prompt with quotes. The default GPT model is gpt-4-turbo."`
+		JsonSchema    string   `default:"" help:"Path to a JSON schema file. The model is asked for JSON matching the schema, the output is validated, and only the JSON is printed."`
+		SchemaRetries int      `default:"2" help:"With --json-schema, how many times to retry if the model returns invalid output."`
+		Output        string   `short:"o" default:"" help:"Write the raw completion to this file instead of stdout. The file is only written if the completion succeeds."`
+		Quiet         bool     `short:"q" default:"false" help:"Print only the raw completion to stdout, without color, styling, or verbose logging."`
+		Continue      bool     `short:"c" default:"false" help:"Continue the conversation from previous prompt calls, sending earlier prompts and responses as history."`
+		New           bool     `default:"false" help:"Clear the saved conversation. Without a prompt this only clears it."`
+		Pager         bool     `default:"false" help:"If the answer is taller than the terminal, open it in $PAGER, or less -R, once it's finished."`
+	} `cmd:"" help:"Run an LLM prompt without wrapping, stream results back. This is a straight-through call to the LLM from the command line with a given prompt. This accepts piped input, if there is both piped input and a prompt then they will be concatenated together (prompt first). It is recommended that you wrap the prompt with quotes. The default GPT model is gpt-4-turbo. Errors are printed to stderr and exit with a non-zero status."`
 
 	Promptedit struct {
-		File        string  `short:"f" default:"~/.config/butterfish/prompt.txt" help:"Cached prompt file to use." optional:""`
+		File        string  `short:"f" default:"" help:"Cached prompt file to use, defaults to prompt.txt in the state directory." optional:""`
 		Editor      string  `short:"e" default:"" help:"Editor to use for the prompt."`
 		Model       string  `short:"m" default:"gpt-4-turbo" help:"GPT model to use for the prompt."`
 		NumTokens   int     `short:"n" default:"1024" help:"Maximum number of tokens to generate."`
@@ -73,36 +115,155 @@ type CliCommandConfig struct {
 	} `cmd:"" help:"Like the prompt command, but this opens a local file with your default editor (set with the EDITOR env var) that will then be passed as a prompt in the LLM call."`
 
 	Edit struct {
-		Filepath    string  `arg:"" help:"Path to file, will be edited in-place."`
+		Filepath    string  `arg:"" help:"Path to a file, or a directory to edit any of the files in it."`
 		Prompt      string  `arg:"" help:"LLM model prompt, e.g. 'Plan an edit'"`
 		Model       string  `short:"m" default:"gpt-4-turbo" help:"LLM to use for the prompt."`
 		NumTokens   int     `short:"n" default:"1024" help:"Maximum number of tokens to generate."`
 		Temperature float32 `short:"T" default:"0.7" help:"Temperature to use for the prompt, higher temperature indicates more freedom/randomness when generating each token."`
-		InPlace     bool    `short:"i" default:"false" help:"Edit the file in-place, otherwise we write to stdout."`
+		InPlace     bool    `short:"i" default:"false" help:"Write the changes without showing a diff, otherwise the edited file (or a diff when editing a directory) is printed to stdout."`
+		Diff        bool    `short:"d" default:"false" help:"Show a diff of the changes and ask before applying them, or pick which hunks to apply. This is the default when stdout is a terminal."`
+		NoDiff      bool    `default:"false" help:"Don't show a diff even if stdout is a terminal."`
+		Yes         bool    `short:"y" default:"false" help:"Apply the changes after showing the diff without asking for confirmation."`
 		NoColor     bool    `default:"false" help:"Disable color output."`
 		NoBackticks bool    `default:"false" help:"Strip out backticks around codeblocks."`
-	} `cmd:"" help:"Edit a file by using a line range editing tool."`
+	} `cmd:"" help:"Edit a file, or files in a directory, by using a line range editing tool."`
+
+	Gentest struct {
+		File        string  `arg:"" help:"Source file to write tests for."`
+		Output      string  `short:"o" default:"" help:"Path of the test file, defaults to the convention for the language, e.g. foo_test.go next to foo.go. If the file exists the tests are added to it."`
+		Framework   string  `default:"" help:"Test framework to use, e.g. pytest or vitest, defaults to a guess based on the project."`
+		Model       string  `short:"m" default:"gpt-4-turbo" help:"LLM to use for the tests."`
+		NumTokens   int     `short:"n" default:"4096" help:"Maximum number of tokens to generate for each edit."`
+		Temperature float32 `short:"T" default:"0.2" help:"Temperature to use for the prompt."`
+		Yes         bool    `short:"y" default:"false" help:"Write the test file without asking for confirmation."`
+		Print       bool    `short:"p" default:"false" help:"Print the test file rather than writing it."`
+		NoColor     bool    `default:"false" help:"Disable color output."`
+	} `cmd:"" help:"Generate tests for a source file. The language and test framework are guessed from the file and project, e.g. go test, pytest, or jest, and the tests are written with the edit tool to a file alongside the source, e.g. foo_test.go, after confirmation."`
+
+	Undo struct {
+		List  bool `default:"false" help:"List the changes that can be undone, most recent first."`
+		Count int  `short:"n" default:"1" help:"Number of changes to undo, most recent first."`
+		Force bool `short:"f" default:"false" help:"Restore files even if they've changed since Butterfish wrote them."`
+	} `cmd:"" help:"Undo file changes made by edit and gentest. Before writing files, Butterfish saves a copy of what they replace, this restores the most recent changes and removes them from the list."`
+
+	Tokens struct {
+		Files  []string `arg:"" help:"Files to count, reads stdin if there are none." optional:""`
+		Models []string `short:"m" default:"gpt-4-turbo" help:"Models to count tokens for, repeat for more than one, e.g. -m gpt-4o -m gpt-3.5-turbo."`
+	} `cmd:"" help:"Count the tokens in files or piped input for one or more models, with the share of each model's context window and the estimated cost of sending it as input. Useful before pasting a big file into a prompt."`
 
 	Summarize struct {
-		Files     []string `arg:"" help:"File paths to summarize." optional:""`
-		ChunkSize int      `short:"c" default:"3600" help:"Number of bytes to summarize at a time if the file must be split up."`
-		MaxChunks int      `short:"C" default:"8" help:"Maximum number of chunks to summarize from a specific file."`
-	} `cmd:"" help:"Semantically summarize a list of files (or piped input). We read in the file, if it is short then we hand it directly to the LLM and ask for a summary. If it is longer then we break it into chunks and ask for a list of facts from each chunk (max 8 chunks), then concatenate facts and ask GPT for an overall summary."`
+		Files       []string `arg:"" help:"File or directory paths to summarize." optional:""`
+		ChunkSize   int      `short:"c" default:"3600" help:"Number of bytes to summarize at a time if the file must be split up."`
+		MaxChunks   int      `short:"C" default:"0" help:"Maximum number of chunks to summarize from a specific file, 0 means no limit."`
+		Concurrency int      `short:"j" default:"4" help:"Number of chunks to summarize at once."`
+		MaxDepth    int      `default:"3" help:"How many directory levels to descend when summarizing a directory, 0 means no limit."`
+		Output      string   `short:"o" help:"Write the markdown report for directories to this file rather than printing it."`
+		Yes         bool     `short:"y" default:"false" help:"Don't ask for confirmation when the estimated cost is over --cost-threshold."`
+	} `cmd:"" help:"Semantically summarize a list of files (or piped input). We read in the file, if it is short then we hand it directly to the LLM and ask for a summary. If it is longer then we break it into chunks and ask for a list of facts from each chunk, merge the facts in groups until they fit in one request, then ask GPT for an overall summary. Directories are walked, skipping hidden files and anything in .gitignore, each file is summarized, then each directory, then the whole project, as a markdown report."`
+
+	Image struct {
+		Path        string   `arg:"" help:"Path to the image, or - to read it from stdin. Defaults to stdin if an image is piped in." optional:""`
+		Prompt      []string `arg:"" help:"What to ask about the image, defaults to asking for a description." optional:""`
+		Model       string   `short:"m" default:"gpt-4o" env:"BUTTERFISH_IMAGE_MODEL" help:"Vision-capable LLM to use."`
+		NumTokens   int      `short:"n" default:"1024" help:"Maximum number of tokens to generate."`
+		Temperature float32  `short:"T" default:"0.7" help:"Temperature to use for the prompt."`
+		NoColor     bool     `default:"false" help:"Disable color output."`
+	} `cmd:"" help:"Ask a vision model about an image, e.g. 'butterfish image screenshot.png what is this error?'. PNG, JPEG, GIF, and WebP images are supported, up to 20 MB. Pipe an image in to read it from stdin, e.g. 'pbpaste | butterfish image - what is this?'."`
+
+	Snap struct {
+		Prompt      []string `arg:"" help:"What to ask about the screen, e.g. 'why does my TUI look broken?'." optional:""`
+		Session     string   `short:"s" help:"Session ID of the shell to read, or a unique prefix of one. Defaults to the most recently started shell."`
+		Print       bool     `short:"p" default:"false" help:"Print the screen contents rather than asking the LLM about them."`
+		Model       string   `short:"m" default:"gpt-4o" help:"LLM to use."`
+		NumTokens   int      `short:"n" default:"1024" help:"Maximum number of tokens to generate."`
+		Temperature float32  `short:"T" default:"0.7" help:"Temperature to use for the prompt."`
+		NoColor     bool     `default:"false" help:"Disable color output."`
+	} `cmd:"" help:"Ask the LLM about what's on the screen of a running Butterfish shell, e.g. 'butterfish snap why does my TUI look broken?'. The shell keeps a text model of its terminal, so this works over SSH and inside TUIs. Run it from another terminal or tmux pane."`
 
 	Gencmd struct {
-		Prompt []string `arg:"" help:"Prompt describing the desired shell command."`
-		Force  bool     `short:"f" default:"false" help:"Execute the command without prompting."`
-	} `cmd:"" help:"Generate a shell command from a prompt, i.e. pass in what you want, a shell command will be generated. Accepts piped input. You can use the -f command to execute it sight-unseen."`
+		Prompt  []string `arg:"" help:"Prompt describing the desired shell command."`
+		Force   bool     `short:"f" default:"false" help:"Execute the command without prompting."`
+		Json    bool     `default:"false" help:"Print {\"command\": \"...\", \"explanation\": \"...\"} as JSON, for scripts and editor plugins."`
+		Explain bool     `short:"e" default:"false" help:"Print a one line explanation of how the command works under it."`
+		Print   bool     `short:"p" default:"false" help:"Print the command without asking whether to run, edit, or regenerate it."`
+	} `cmd:"" help:"Generate a shell command from a prompt, i.e. pass in what you want, a shell command will be generated. Accepts piped input. On a terminal you're asked whether to run the command, edit it, or generate it again with feedback, commands that are run are added to your shell history. You can use the -f command to execute it sight-unseen."`
+
+	Explain struct {
+		Command   []string `arg:"" help:"Command line to explain, wrap it in quotes so your shell doesn't interpret it." optional:""`
+		Json      bool     `default:"false" help:"Print the explanation as JSON."`
+		Model     string   `short:"m" default:"gpt-4-turbo" help:"LLM to use for the explanation."`
+		NumTokens int      `short:"n" default:"2048" help:"Maximum number of tokens to generate."`
+		NoDocs    bool     `default:"false" help:"Don't add extracts from local man pages or --help output to the prompt."`
+	} `cmd:"" help:"Explain a shell command like a man page. The command line is split into pipeline stages and each stage and its flags and arguments are explained, along with warnings about dangerous operations. Extracts from the local man page or --help output of each command are included so that the explanation matches the installed version. Accepts piped input, e.g. a script."`
+
+	Commit struct {
+		Model     string `short:"m" default:"gpt-4-turbo" help:"LLM to use for the commit message."`
+		NumTokens int    `short:"n" default:"512" help:"Maximum number of tokens to generate."`
+		ChunkSize int    `short:"c" default:"12000" help:"Diffs larger than this many bytes are split into chunks on file boundaries and each chunk is summarized first."`
+		MaxChunks int    `short:"C" default:"8" help:"Maximum number of diff chunks to summarize."`
+		Editor    string `short:"e" default:"" help:"Editor to use when editing the message, defaults to the EDITOR env var."`
+		Yes       bool   `short:"y" default:"false" help:"Commit without asking for confirmation."`
+		Print     bool   `short:"p" default:"false" help:"Print the message and exit without committing, e.g. butterfish commit -p | git commit -F -"`
+		Amend     bool   `default:"false" help:"Amend the previous commit, the message then covers its changes as well as the staged ones. Passed through to git commit."`
+		NoVerify  bool   `default:"false" help:"Skip the pre-commit and commit-msg hooks. Passed through to git commit."`
+	} `cmd:"" help:"Write a conventional commit message for the staged changes (git diff --staged), show it for confirmation or editing, then run git commit. Large diffs are split into chunks which are summarized first."`
+
+	Review struct {
+		Range       string `arg:"" optional:"" help:"Git ref range to review, e.g. main..HEAD, or a single ref to diff the working tree against. If not given, a unified diff is read from stdin."`
+		Model       string `short:"m" default:"gpt-4-turbo" help:"LLM to use for the review."`
+		NumTokens   int    `short:"n" default:"2048" help:"Maximum number of tokens to generate for each chunk."`
+		ChunkTokens int    `short:"c" default:"4000" help:"Approximate token budget for each chunk of the diff. Diffs are split per file, and large files per hunk, to fit."`
+		Json        bool   `default:"false" help:"Print the comments as JSON once the review is done."`
+		FailOn      string `enum:"none,info,warning,error" default:"none" help:"Exit with an error if there are comments at this severity or above, e.g. to fail a CI job."`
+	} `cmd:"" help:"Review a diff and print comments with a file, line, severity, and explanation. Pass a git ref range or pipe in a unified diff, e.g. 'gh pr diff | butterfish review'. Large diffs are reviewed in chunks."`
 
 	Exec struct {
 		Command []string `arg:"" help:"Command to execute." optional:""`
+		Yes     bool     `short:"y" default:"false" help:"Run fixed commands without asking."`
 	} `cmd:"" help:"Execute a command and try to debug problems. The command can either passed in or in the command register (if you have run gencmd in Console Mode)."`
 
+	Execremote struct {
+		Command  []string `arg:"" help:"Command to execute." optional:""`
+		Terminal string   `short:"t" default:"" help:"ID of the wrapped terminal to run the command in, defaults to the most recently connected one."`
+	} `cmd:"" help:"Execute a command in a terminal wrapped with butterfish wrap and try to debug problems, like exec. The command can either be passed in or come from the command register. Console Mode only."`
+
+	Terminals struct {
+		Output bool `short:"o" default:"false" help:"Print recent output of each terminal, not just the last line."`
+	} `cmd:"" help:"List terminals connected with butterfish wrap, with the last line of output of each. Console Mode only."`
+
+	Agent struct {
+		Goal   []string `arg:"" help:"Goal for the agent, e.g. 'make the tests pass'."`
+		Json   bool     `default:"false" help:"Write each step as a JSON object per line to stdout, ending with the result, for CI. Commands run without confirmation unless --policy is set."`
+		Unsafe bool     `default:"false" help:"Run commands without asking for confirmation."`
+		Policy string   `default:"" help:"Path to a YAML file with allow and deny lists of regular expressions, commands are run only if they match an allow pattern and no deny pattern."`
+	} `cmd:"" help:"Work towards a goal by running commands, like goal mode in the shell. With --json the agent runs unattended and writes a machine-readable transcript, exiting with an error if the goal wasn't accomplished."`
+
+	Tail struct {
+		File      string        `arg:"" help:"Log file to follow."`
+		Question  []string      `arg:"" help:"A question about the log or something to be told about, e.g. 'tell me when payments start failing'. Without one the facts from each update are printed." optional:""`
+		Lines     int           `short:"n" default:"50" help:"Start with this many lines from the end of the file."`
+		Interval  time.Duration `short:"i" default:"30s" help:"Summarize new lines at most this often."`
+		ChunkSize int           `short:"c" default:"3600" help:"Summarize as soon as this many bytes of new lines arrive, bursts are split into chunks of this size."`
+		Window    int           `short:"w" default:"20" help:"How many lists of facts the running summary of the log keeps."`
+	} `cmd:"" help:"Follow a log file like tail -f, summarizing new lines as they arrive. Only new lines are sent, the facts from recent updates are kept as a running summary. With a question, the new lines and the summary are sent with it and the answer is printed when there's something to report."`
+
+	Watch struct {
+		Command    []string      `arg:"" passthrough:"" help:"Command to run, e.g. -- npm run dev."`
+		Model      string        `short:"m" default:"gpt-4o-mini" help:"LLM to use for annotations."`
+		Budget     int           `short:"b" default:"20000" help:"Stop annotating once about this many tokens have been used."`
+		Interval   time.Duration `default:"1m" help:"Minimum time between annotations."`
+		Stall      time.Duration `default:"5m" help:"Annotate when the command hasn't printed anything for this long, 0 to turn off."`
+		ErrorSpike int           `default:"5" help:"Annotate when this many error lines are printed within a minute, 0 to turn off."`
+	} `cmd:"" help:"Run a long-running command, like a dev server, passing its output through, and print notes from the LLM inline when the output looks wrong: a stack trace, a burst of errors, or no output for a while."`
+
 	Index struct {
-		Paths     []string `arg:"" help:"Paths to index." optional:""`
-		Force     bool     `short:"f" default:"false" help:"Force re-indexing of files rather than skipping cached embeddings."`
-		ChunkSize int      `short:"c" default:"512" help:"Number of bytes to embed at a time when the file is split up."`
-		MaxChunks int      `short:"C" default:"256" help:"Maximum number of chunks to embed from a specific file."`
+		Paths     []string      `arg:"" help:"Paths to index." optional:""`
+		Force     bool          `short:"f" default:"false" help:"Force re-indexing of files rather than skipping cached embeddings."`
+		ChunkSize int           `short:"c" default:"512" help:"Number of bytes to embed at a time when the file is split up."`
+		MaxChunks int           `short:"C" default:"256" help:"Maximum number of chunks to embed from a specific file."`
+		Watch     bool          `short:"w" help:"After indexing, keep watching the paths and re-embed files as they change."`
+		Debounce  time.Duration `default:"2s" help:"With --watch, wait until files have stopped changing for this long before re-indexing."`
+		Yes       bool          `short:"y" default:"false" help:"Don't ask for confirmation when the estimated cost is over --cost-threshold."`
 	} `cmd:"" help:"Recursively index the current directory using embeddings. This will read each file, split it into chunks, embed the chunks, and write a .butterfish_index file to each directory caching the embeddings. If you re-run this it will skip over previously embedded files unless you force a re-index. This implements an exponential backoff if you hit OpenAI API rate limits."`
 
 	Clearindex struct {
@@ -117,17 +278,122 @@ type CliCommandConfig struct {
 		Paths []string `arg:"" help:"Paths to show from the index." optional:""`
 	} `cmd:"" help:"Show which files are present in the loaded index. You can pass in a path but it defaults to the current directory."`
 
+	Indexstats struct {
+		Paths     []string `arg:"" help:"Paths to report on." optional:""`
+		ChunkSize int      `short:"c" default:"512" help:"Chunk size index would use, for estimating the cost of a refresh."`
+		MaxChunks int      `short:"C" default:"256" help:"Maximum chunks per file index would use, for estimating the cost of a refresh."`
+		Json      bool     `default:"false" help:"Print the stats as JSON."`
+	} `cmd:"" help:"Show stats for the index under each path: files, chunks, size on disk, when files were embedded, stale files modified since they were embedded, and the estimated cost of refreshing with index. Defaults to the current directory."`
+
+	Migrateindex struct {
+		Paths []string `arg:"" help:"Paths to migrate." optional:""`
+	} `cmd:"" help:"Rewrite .butterfish_index files in the format set by --index-format without re-embedding, e.g. to convert indexes from the protobuf format to the smaller f16 or int8 formats. Defaults to the current directory."`
+
 	Indexsearch struct {
 		Query   string `arg:"" help:"Query to search for."`
 		Results int    `short:"r" default:"5" help:"Number of results to return."`
+
+		RerankOptions `embed:""`
 	} `cmd:"" help:"Search embedding index and return relevant file snippets. This uses the embedding API to embed the search string, then does a brute-force cosine similarity against every indexed chunk of text, returning those chunks and their scores."`
 
 	Indexquestion struct {
-		Question    string  `arg:"" help:"Question to ask."`
-		Model       string  `short:"m" default:"gpt-4-turbo" help:"GPT model to use for the prompt."`
-		NumTokens   int     `short:"n" default:"1024" help:"Maximum number of tokens to generate."`
-		Temperature float32 `short:"T" default:"0.7" help:"Temperature to use for the prompt."`
-	} `cmd:"" help:"Ask a question using the embeddings index. This fetches text snippets from the index and passes them to the LLM to generate an answer, thus you need to run the index command first."`
+		Question     string  `arg:"" help:"Question to ask."`
+		Model        string  `short:"m" default:"gpt-4-turbo" help:"GPT model to use for the prompt."`
+		NumTokens    int     `short:"n" default:"1024" help:"Maximum number of tokens to generate."`
+		Temperature  float32 `short:"T" default:"0.7" help:"Temperature to use for the prompt."`
+		Results      int     `short:"r" default:"3" help:"Number of snippets to pass to the LLM."`
+		ShowSnippets bool    `help:"Print the retrieved snippets before the answer."`
+
+		RerankOptions `embed:""`
+	} `cmd:"" help:"Ask a question using the embeddings index. This fetches text snippets from the index and passes them to the LLM to generate an answer, thus you need to run the index command first. The answer is followed by a list of sources, the files and line ranges of the snippets it cites."`
+
+	Rpc struct {
+		Model       string  `short:"m" default:"gpt-4-turbo" help:"LLM to use for complete requests that don't specify a model."`
+		NumTokens   int     `short:"n" default:"1024" help:"Maximum number of tokens to generate for complete requests that don't specify max_tokens."`
+		Temperature float32 `short:"T" default:"0.7" help:"Temperature for complete requests that don't specify one."`
+	} `cmd:"" help:"Serve JSON-RPC 2.0 over stdio, one JSON object per line, so that other programs can embed Butterfish as a subprocess. Methods are complete, summarize, gencmd, and index.search, see the README for the protocol. Stdout only carries responses, other output goes to stderr."`
+
+	Serve struct {
+		Addr        string  `default:"127.0.0.1:7641" help:"Address to listen on."`
+		Token       string  `env:"BUTTERFISH_SERVE_TOKEN" help:"Bearer token every request must send in the Authorization header. Without one a token is generated and written to serve-token in the state directory."`
+		Model       string  `short:"m" default:"gpt-4-turbo" help:"LLM to use for prompt requests that don't specify a model."`
+		NumTokens   int     `short:"n" default:"1024" help:"Maximum number of tokens to generate for prompt requests that don't specify max_tokens."`
+		Temperature float32 `short:"T" default:"0.7" help:"Temperature for prompt requests that don't specify one."`
+	} `cmd:"" help:"Serve a local HTTP API for prompt, summarize, gencmd, index search, and session history, so that editor plugins and scripts can share one running Butterfish and its loaded index. See the README for the endpoints."`
+
+	Batch struct {
+		Manifest    string `arg:"" help:"Path to the batch manifest YAML file."`
+		Force       bool   `short:"f" default:"false" help:"Re-run jobs even if their output file already exists."`
+		Concurrency int    `short:"j" default:"0" help:"Number of jobs to run at once, overrides the manifest's concurrency."`
+	} `cmd:"" help:"Run a manifest of prompt, summarize, and indexquestion jobs, writing each result to its own output file. Jobs can be expanded over file globs, e.g. to generate docs for every file in a package. Jobs with existing output are skipped, so a failed batch can be re-run. See the README for the manifest format."`
+
+	Sessions struct {
+		List struct {
+		} `cmd:"" help:"List recorded shell sessions, oldest first."`
+		Env struct {
+			ID   string `arg:"" help:"Session ID, a unique prefix of one, or 'last'."`
+			Json bool   `default:"false" help:"Print the environment as JSON."`
+		} `cmd:"" help:"Show the environment a shell session started in: OS, shell, tool versions, and whitelisted env vars."`
+	} `cmd:"" help:"Inspect recorded shell sessions. Each Butterfish shell session records a transcript in the state directory, starting with the environment it ran in."`
+
+	History struct {
+		Export struct {
+			Session string `short:"s" help:"Session ID of the shell to export, or a unique prefix of one. Defaults to the most recently started shell."`
+			Format  string `short:"f" help:"markdown or json, defaults to json for a .json output file and markdown otherwise."`
+			Output  string `short:"o" help:"File to write, defaults to stdout."`
+		} `cmd:"" help:"Export the prompts, answers, commands, and output of a running shell as a markdown transcript or JSON, with secrets redacted."`
+	} `cmd:"" help:"Work with the history of a running Butterfish shell."`
+
+	Prompts struct {
+		List struct {
+		} `cmd:"" help:"List the prompts in the library, with the models their variants are for."`
+		Show struct {
+			Name  string `arg:"" help:"Prompt name, see prompts list."`
+			Model string `short:"m" help:"Show the version of the prompt used for this model."`
+		} `cmd:"" help:"Print a prompt and its per-model variants."`
+		Edit struct {
+			Name   string `arg:"" optional:"" help:"Prompt to jump to in the editor."`
+			Editor string `short:"e" default:"" help:"Editor to use, defaults to the EDITOR env var."`
+		} `cmd:"" help:"Open the prompt library in your editor. Prompts you change are marked so that upgrades don't replace them."`
+	} `cmd:"" help:"Manage the prompt library at ~/.config/butterfish/prompts.yaml. A prompt can have variants for specific models or model families, e.g. a terser autosuggest prompt for small local models, which are used instead of the default when that model is active."`
+
+	Auth struct {
+		Set struct {
+			Provider string `arg:"" help:"Provider name, butterfish uses the openai token."`
+		} `cmd:"" help:"Save a token, read from stdin or typed without echo. Saving to the keychain removes a plain text copy from butterfish.env."`
+		Get struct {
+			Provider string `arg:"" help:"Provider name, butterfish uses the openai token."`
+		} `cmd:"" help:"Print a saved token, e.g. to pass it to another tool."`
+		Delete struct {
+			Provider string `arg:"" help:"Provider name, butterfish uses the openai token."`
+		} `cmd:"" help:"Delete a token from the keychain and butterfish.env."`
+	} `cmd:"" help:"Manage API tokens. Tokens are kept in the OS keychain if there is one, the macOS Keychain, the Secret Service through secret-tool on Linux or the Windows Credential Manager, and otherwise in ~/.config/butterfish/butterfish.env. Set token_store in config.yaml to keychain or env to choose."`
+
+	Paths struct {
+	} `cmd:"" help:"Print where Butterfish keeps its config, state, logs, and caches. These follow XDG_CONFIG_HOME, XDG_STATE_HOME, and XDG_CACHE_HOME if set."`
+}
+
+const defaultEditor = "vi"
+
+// Use the given editor, or $EDITOR, or vi
+func resolveEditor(editor string) string {
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = defaultEditor
+	}
+	return editor
+}
+
+// Run an editor attached to the terminal and wait for it to exit
+func runEditor(editor string, args ...string) error {
+	cmd := exec.Command(editor, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	return cmd.Run()
 }
 
 func (this *ButterfishCtx) getPipedStdin() string {
@@ -239,7 +505,7 @@ func ApplyEditToolToLineBuffer(toolCall *util.ToolCall, lineBuffer *LineBuffer)
 
 	paramJson := toolCall.Function.Parameters
 	var params EditToolParameters
-	err := json.Unmarshal([]byte(paramJson), &params)
+	err := unmarshalToolArguments(paramJson, &params)
 	if err != nil {
 		return err
 	}
@@ -265,12 +531,20 @@ func (this *ButterfishCtx) ExecCommand(
 
 	case "help":
 		parsed.Kong.Stdout = this.Out
-		parsed.PrintUsage(false)
+		root, err := kong.Trace(parsed.Kong, nil)
+		if err != nil {
+			return err
+		}
+		root.PrintUsage(false)
 
 	case "prompt", "prompt <prompt>":
 		// The prompt command accepts both stdin and a prompt string, but needs at
 		// least one of them. If we have both then we concatenate them with prompt
 		// first.
+		if this.Config.Persona != nil {
+			this.Config.Persona.applyPromptOptions(parsed, options)
+		}
+
 		promptArr := options.Prompt.Prompt
 		prompt := ""
 		if promptArr != nil && len(promptArr) > 0 {
@@ -278,6 +552,31 @@ func (this *ButterfishCtx) ExecCommand(
 		}
 		piped := this.getPipedStdin()
 
+		// The conversation is only saved and loaded if we have a state dir
+		var conversation *Conversation
+		if this.Config.StateDir != "" {
+			var err error
+			conversation, err = LoadConversation(this.Config.StateDir)
+			if err != nil {
+				return err
+			}
+		}
+
+		if options.Prompt.New {
+			if conversation != nil {
+				err := conversation.Clear()
+				if err != nil {
+					return err
+				}
+			}
+			if piped == "" && prompt == "" {
+				return nil
+			}
+		}
+		if options.Prompt.Continue && options.Prompt.JsonSchema != "" {
+			return errors.New("--continue can't be combined with --json-schema")
+		}
+
 		var input string
 
 		if piped == "" && prompt == "" {
@@ -290,52 +589,104 @@ func (this *ButterfishCtx) ExecCommand(
 			input = fmt.Sprintf("%s\n%s", prompt, piped)
 		}
 
-		commandConfig := &promptCommand{
-			Prompt:      input,
-			SysMsg:      options.Prompt.SystemMessage,
-			Model:       options.Prompt.Model,
-			NumTokens:   options.Prompt.NumTokens,
-			Temperature: options.Prompt.Temperature,
-			Functions:   options.Prompt.Functions,
-			NoColor:     options.Prompt.NoColor,
-			NoBackticks: options.Prompt.NoBackticks,
-			Verbose:     this.Config.Verbose,
+		verbose := this.Config.Verbose
+		if options.Prompt.Quiet {
+			verbose = 0
 		}
 
-		_, err := this.Prompt(commandConfig)
-		return err
+		run := func(out io.Writer) error {
+			if options.Prompt.JsonSchema != "" {
+				output, err := this.StructuredPrompt(
+					input,
+					options.Prompt.SystemMessage,
+					options.Prompt.Model,
+					options.Prompt.NumTokens,
+					options.Prompt.Temperature,
+					options.Prompt.JsonSchema,
+					options.Prompt.SchemaRetries)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "%s\n", output)
+				return nil
+			}
+
+			commandConfig := &promptCommand{
+				Prompt:      input,
+				SysMsg:      options.Prompt.SystemMessage,
+				Model:       options.Prompt.Model,
+				NumTokens:   options.Prompt.NumTokens,
+				Temperature: options.Prompt.Temperature,
+				Functions:   options.Prompt.Functions,
+				NoColor:     options.Prompt.NoColor || options.Prompt.Quiet || options.Prompt.Output != "",
+				NoBackticks: options.Prompt.NoBackticks,
+				Verbose:     verbose,
+				Out:         out,
+			}
+			if conversation != nil && options.Prompt.Continue && len(conversation.Turns) > 0 {
+				// leave room for the prompt, system message and answer
+				maxTokens := NumTokensForModel(options.Prompt.Model) - options.Prompt.NumTokens -
+					estimateTokens(input) - estimateTokens(options.Prompt.SystemMessage)
+				commandConfig.History = conversation.HistoryBlocks(maxTokens)
+			}
+
+			response, err := this.Prompt(commandConfig)
+			if err != nil {
+				return err
+			}
+			if response.Refusal != "" {
+				return errors.New(response.RefusalMessage())
+			}
+			if options.Prompt.Pager && out == this.Out {
+				this.pageAnswer(response.Completion)
+			}
+			// stderr so that piped output stays clean
+			if note := failoverNote(&util.CompletionRequest{Model: options.Prompt.Model}, response); note != "" && !options.Prompt.Quiet {
+				fmt.Fprintln(os.Stderr, note)
+			}
+			if conversation == nil {
+				return nil
+			}
+
+			if !options.Prompt.Continue {
+				conversation.Turns = nil
+			}
+			conversation.Append(input, response.Completion)
+			return conversation.Save()
+		}
+
+		if options.Prompt.Output != "" {
+			return writeFileOnSuccess(options.Prompt.Output, run)
+		}
+		return run(this.Out)
 
 	case "promptedit":
 		targetFile := options.Promptedit.File
 		editor := options.Promptedit.Editor
 
+		if targetFile == "" {
+			paths, err := util.GetPaths()
+			if err != nil {
+				return err
+			}
+			targetFile = paths.PromptEditFile()
+		}
+
 		targetFile, err := homedir.Expand(targetFile)
 		if err != nil {
 			return err
 		}
 
-		// get EDITOR env var if not specified
-		if editor == "" {
-			editor = os.Getenv("EDITOR")
-		}
-		if editor == "" {
-			editor = "vi"
-			if this.Config.Verbose > 0 {
-				this.StylePrintf(this.Config.Styles.Grey, "Defaulting to %s for editor, you can set this with --editor or the EDITOR env var\n", editor)
-			}
+		if editor == "" && os.Getenv("EDITOR") == "" && this.Config.Verbose > 0 {
+			this.StylePrintf(this.Config.Styles.Grey, "Defaulting to %s for editor, you can set this with --editor or the EDITOR env var\n", defaultEditor)
 		}
+		editor = resolveEditor(editor)
 
 		if this.Config.Verbose > 0 {
 			this.StylePrintf(this.Config.Styles.Grey, "%s %s\n", editor, targetFile)
 		}
 
-		cmd := exec.Command(editor, targetFile)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Env = os.Environ()
-
-		err = cmd.Run()
+		err = runEditor(editor, targetFile)
 		if err != nil {
 			return err
 		}
@@ -361,44 +712,28 @@ func (this *ButterfishCtx) ExecCommand(
 		return err
 
 	case "edit <filepath> <prompt>":
-		prompt := options.Edit.Prompt
+		return this.editCommand(options)
 
-		filepath := options.Edit.Filepath
-		if filepath == "" {
-			return errors.New("Please provide a filepath")
-		}
-
-		filepath, err := homedir.Expand(filepath)
-		if err != nil {
-			return err
-		}
+	case "undo":
+		return this.undoCommand(options)
 
-		lineBuffer, err := NewLineBuffer(filepath)
-		if err != nil {
-			return err
-		}
+	case "tokens", "tokens <files>":
+		return this.tokensCommand(options)
 
-		err = this.EditLineBuffer(lineBuffer, prompt, options)
-		if err != nil {
-			return err
-		}
+	case "gentest <file>":
+		return this.gentestCommand(options)
 
-		if options.Edit.InPlace {
-			err = os.WriteFile(filepath, []byte(lineBuffer.String()), 0644)
-			if err != nil {
-				return err
-			}
-		} else {
-			fmt.Fprintf(this.Out, "%s\n", lineBuffer.String())
-		}
+	case "image", "image <path>", "image <path> <prompt>":
+		return this.imageCommand(options)
 
-		return nil
+	case "snap", "snap <prompt>":
+		return this.snapCommand(options)
 
 	case "summarize":
 		chunks, err := util.GetChunks(
 			os.Stdin,
 			options.Summarize.ChunkSize,
-			options.Summarize.MaxChunks)
+			UnlimitedChunks(options.Summarize.MaxChunks))
 
 		if err != nil {
 			return err
@@ -408,7 +743,7 @@ func (this *ButterfishCtx) ExecCommand(
 			return errors.New("No input to summarize")
 		}
 
-		return this.SummarizeChunks(chunks)
+		return this.SummarizeChunks(chunks, options.Summarize.Yes)
 
 	case "summarize <files>":
 		files := options.Summarize.Files
@@ -418,7 +753,10 @@ func (this *ButterfishCtx) ExecCommand(
 
 		err := this.SummarizePaths(files,
 			options.Summarize.ChunkSize,
-			options.Summarize.MaxChunks)
+			UnlimitedChunks(options.Summarize.MaxChunks),
+			options.Summarize.MaxDepth,
+			options.Summarize.Output,
+			options.Summarize.Yes)
 		return err
 
 	case "gencmd <prompt>":
@@ -427,24 +765,91 @@ func (this *ButterfishCtx) ExecCommand(
 			return errors.New("Please provide a description to generate a command")
 		}
 
-		cmd, err := this.gencmdCommand(input)
+		if options.Gencmd.Json && options.Gencmd.Force {
+			return errors.New("--json can't be combined with --force")
+		}
+
+		generate := func(description string) (*GeneratedCommand, error) {
+			if options.Gencmd.Json || options.Gencmd.Explain {
+				return this.GenerateExplainedCommand(description)
+			}
+			cmd, err := this.GenerateCommand(description)
+			if err != nil {
+				return nil, err
+			}
+			return &GeneratedCommand{Command: strings.TrimSpace(cmd)}, nil
+		}
+
+		generated, err := generate(input)
 		if err != nil {
 			return err
 		}
 
-		// trim whitespace
-		cmd = strings.TrimSpace(cmd)
-
-		if !options.Gencmd.Force {
-			this.StylePrintf(this.Config.Styles.Highlight, "%s\n", cmd)
-		} else {
-			_, err := this.execCommand(cmd)
+		if options.Gencmd.Json {
+			output, err := json.MarshalIndent(generated, "", "  ")
 			if err != nil {
 				return err
 			}
+			fmt.Fprintf(this.Out, "%s\n", output)
+			return nil
+		}
+
+		if options.Gencmd.Force {
+			if generated.Explanation != "" {
+				this.StylePrintf(this.Config.Styles.Grey, "%s\n", generated.Explanation)
+			}
+			_, err := this.execCommand(generated.Command)
+			return err
+		}
+
+		// ask what to do with the command if there's someone to ask, e.g. not
+		// when the output is captured with $(butterfish gencmd ...)
+		if !options.Gencmd.Print && !this.InConsoleMode &&
+			term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd())) {
+			return this.gencmdMenu(os.Stdin, input, generated, generate)
+		}
+
+		this.StylePrintf(this.Config.Styles.Highlight, "%s\n", generated.Command)
+		if generated.Explanation != "" {
+			this.StylePrintf(this.Config.Styles.Grey, "%s\n", generated.Explanation)
 		}
 		return nil
 
+	case "explain", "explain <command>":
+		cmdline := strings.Join(options.Explain.Command, " ")
+		if cmdline == "" {
+			cmdline = this.getPipedStdin()
+		}
+		if strings.TrimSpace(cmdline) == "" {
+			return errors.New("Please provide a command to explain")
+		}
+
+		var docs CommandDocsFunc = LocalCommandDocs
+		if options.Explain.NoDocs {
+			docs = nil
+		}
+
+		explanation, err := this.ExplainCommand(cmdline, options.Explain.Model, options.Explain.NumTokens, docs)
+		if err != nil {
+			return err
+		}
+
+		if options.Explain.Json {
+			output, err := json.MarshalIndent(explanation, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(this.Out, "%s\n", output)
+			return nil
+		}
+		this.PrintExplanation(explanation)
+
+	case "commit":
+		return this.commitCommand(options)
+
+	case "review", "review <range>":
+		return this.reviewCommand(options)
+
 	case "exec", "exec <command>":
 		input := this.cleanInput(options.Exec.Command)
 		if input == "" {
@@ -455,7 +860,62 @@ func (this *ButterfishCtx) ExecCommand(
 			return errors.New("No command to execute")
 		}
 
-		return this.execAndCheck(this.Ctx, input)
+		policy := PolicyConfirm
+		if options.Exec.Yes {
+			policy = PolicyAuto
+		}
+		return this.execAndCheck(this.Ctx, input, policy, this.execCommand)
+
+	case "execremote", "execremote <command>":
+		if this.Console == nil {
+			return errors.New("execremote only works in Console Mode, start it with butterfish console")
+		}
+		input := strings.Join(options.Execremote.Command, " ")
+		if input == "" {
+			input = this.CommandRegister
+		}
+		if input == "" {
+			return errors.New("No command to execute")
+		}
+
+		terminal, err := this.Console.Terminal(options.Execremote.Terminal)
+		if err != nil {
+			return err
+		}
+		return this.execAndCheck(this.Ctx, input, PolicyConfirm, func(cmd string) (*executeResult, error) {
+			this.StylePrintf(this.Config.Styles.Question, "%d> %s\n", terminal.ID, cmd)
+			return terminal.Exec(this.Ctx, cmd, this.Out)
+		})
+
+	case "terminals":
+		if this.Console == nil {
+			return errors.New("terminals only works in Console Mode, start it with butterfish console")
+		}
+		this.Console.PrintTerminals(this.Out, options.Terminals.Output)
+
+	case "agent <goal>":
+		return this.agentCommand(options)
+
+	case "tail <file>", "tail <file> <question>":
+		opts := options.Tail
+		return this.TailFile(&TailOptions{
+			Path:      opts.File,
+			Question:  strings.Join(opts.Question, " "),
+			Lines:     opts.Lines,
+			Interval:  opts.Interval,
+			ChunkSize: opts.ChunkSize,
+			Window:    opts.Window,
+		})
+
+	case "watch <command>":
+		opts := options.Watch
+		return this.WatchCommand(opts.Command, &WatchOptions{
+			Model:      opts.Model,
+			Budget:     opts.Budget,
+			Interval:   opts.Interval,
+			Stall:      opts.Stall,
+			ErrorSpike: opts.ErrorSpike,
+		})
 
 	case "clearindex", "clearindex <paths>":
 		this.initVectorIndex(nil)
@@ -479,6 +939,21 @@ func (this *ButterfishCtx) ExecCommand(
 
 		return nil
 
+	case "indexstats", "indexstats <paths>":
+		return this.indexStatsCommand(options)
+
+	case "migrateindex", "migrateindex <paths>":
+		paths := options.Migrateindex.Paths
+		if len(paths) == 0 {
+			paths = []string{"."}
+		}
+
+		err := this.initVectorIndex(paths)
+		if err != nil {
+			return err
+		}
+		return this.VectorIndex.MigratePaths(this.Ctx, paths)
+
 	case "loadindex", "loadindex <paths>":
 		paths := options.Loadindex.Paths
 		if len(paths) == 0 {
@@ -509,6 +984,25 @@ func (this *ButterfishCtx) ExecCommand(
 		}
 		force := options.Index.Force
 
+		// only the OpenAI backend costs anything
+		if this.Config.EmbeddingNeedsToken() {
+			found, err := this.VectorIndex.EstimatePaths(this.Ctx, paths, force,
+				options.Index.ChunkSize, options.Index.MaxChunks)
+			if err != nil {
+				return err
+			}
+			estimate := &CostEstimate{
+				Model:    string(GPTEmbeddingsModel),
+				Tokens:   int(found.Bytes / 4),
+				Requests: found.Calls,
+			}
+			this.StylePrintf(this.Config.Styles.Grey, "Embedding %d files, %s\n", found.Files, estimate)
+			err = this.ConfirmCost(estimate, options.Index.Yes)
+			if err != nil {
+				return err
+			}
+		}
+
 		err = this.VectorIndex.IndexPaths(
 			this.Ctx,
 			paths,
@@ -520,6 +1014,15 @@ func (this *ButterfishCtx) ExecCommand(
 		}
 
 		this.Printf("Done, %d files now loaded in the index\n", len(this.VectorIndex.IndexedFiles()))
+
+		if options.Index.Watch {
+			return this.VectorIndex.WatchPaths(
+				this.Ctx,
+				paths,
+				options.Index.ChunkSize,
+				options.Index.MaxChunks,
+				options.Index.Debounce)
+		}
 		return nil
 
 	case "indexsearch <query>":
@@ -531,7 +1034,7 @@ func (this *ButterfishCtx) ExecCommand(
 		}
 		numResults := options.Indexsearch.Results
 
-		results, err := this.VectorIndex.Search(this.Ctx, input, numResults)
+		results, err := this.SearchIndex(input, numResults, &options.Indexsearch.RerankOptions)
 		if err != nil {
 			return err
 		}
@@ -552,25 +1055,24 @@ func (this *ButterfishCtx) ExecCommand(
 			return errors.New("No vector index loaded")
 		}
 
-		results, err := this.VectorIndex.Search(this.Ctx, input, 3)
+		results, err := this.SearchIndex(input, options.Indexquestion.Results,
+			&options.Indexquestion.RerankOptions)
 		if err != nil {
 			return err
 		}
-		samples := []string{}
-
-		for _, result := range results {
-			samples = append(samples, result.Content)
-		}
-
-		exerpts := strings.Join(samples, "\n---\n")
-
-		prompt, err := this.PromptLibrary.GetPrompt(prompt.PromptQuestion,
-			"snippets", exerpts,
-			"question", input)
+		prompt, snippets, err := this.questionPrompt(input, results)
 		if err != nil {
 			return err
 		}
 
+		if options.Indexquestion.ShowSnippets {
+			for _, snippet := range snippets {
+				this.StylePrintf(this.Config.Styles.Highlight, "[%d] %s\n", snippet.Number, snippet.Location())
+				this.Printf("%s\n", snippet.Content)
+			}
+			this.Printf("\n")
+		}
+
 		req := &util.CompletionRequest{
 			Ctx:           this.Ctx,
 			Prompt:        prompt,
@@ -579,9 +1081,74 @@ func (this *ButterfishCtx) ExecCommand(
 			Temperature:   options.Indexquestion.Temperature,
 			SystemMessage: "N/A",
 		}
+		this.Config.LimitRequest(FeaturePrompt, req)
 
-		_, err = this.LLMClient.CompletionStream(req, this.Out)
-		return err
+		resp, err := this.LLMClient.CompletionStream(req, this.Out)
+		if err != nil {
+			return err
+		}
+
+		this.StylePrintf(this.Config.Styles.Highlight, "\n\n%s", formatSources(resp.Completion, snippets))
+		return nil
+
+	case "rpc":
+		// stdout belongs to the protocol, send anything else to stderr
+		out := this.Out
+		this.Out = os.Stderr
+		server := NewRPCServer(this, &RPCOptions{
+			Model:       options.Rpc.Model,
+			NumTokens:   options.Rpc.NumTokens,
+			Temperature: options.Rpc.Temperature,
+		}, out)
+		return server.Serve(os.Stdin)
+
+	case "serve":
+		token := options.Serve.Token
+		if token == "" {
+			var path string
+			var err error
+			token, path, err = writeServeToken(this.Config.StateBaseDir)
+			if err != nil {
+				return fmt.Errorf("Unable to write a token for the server: %s", err)
+			}
+			this.Printf("Requests need the token in %s, e.g. -H \"Authorization: Bearer $(cat %s)\"\n", path, path)
+		}
+		server := NewHTTPServer(this, &RPCOptions{
+			Model:       options.Serve.Model,
+			NumTokens:   options.Serve.NumTokens,
+			Temperature: options.Serve.Temperature,
+		}, token)
+		return server.ListenAndServe(this.Ctx, options.Serve.Addr, this.Out)
+
+	case "batch <manifest>":
+		manifest, err := LoadBatchManifest(options.Batch.Manifest)
+		if err != nil {
+			return err
+		}
+		if options.Batch.Concurrency > 0 {
+			manifest.Concurrency = options.Batch.Concurrency
+		}
+		return this.RunBatch(manifest, options.Batch.Force)
+
+	case "sessions list", "sessions env <id>":
+		return RunSessionsCommand(this.Out, this.Config.StateBaseDir, parsed.Command(), options)
+
+	case "history export":
+		return RunHistoryCommand(this.Ctx, this.Out, this.Config.StateBaseDir, parsed.Command(), options)
+
+	case "prompts list", "prompts show <name>", "prompts edit", "prompts edit <name>":
+		promptPath, err := homedir.Expand(this.Config.PromptLibraryPath)
+		if err != nil {
+			return err
+		}
+		return RunPromptsCommand(this.Out, promptPath, parsed.Command(), options)
+
+	case "paths":
+		paths, err := util.GetPaths()
+		if err != nil {
+			return err
+		}
+		PrintPaths(this.Out, paths)
 
 	default:
 		return errors.New("Unrecognized command: " + parsed.Command())
@@ -591,6 +1158,38 @@ func (this *ButterfishCtx) ExecCommand(
 	return nil
 }
 
+// Print the locations of Butterfish's files, marking those that don't exist yet
+func PrintPaths(out io.Writer, paths *util.Paths) {
+	entries := []struct {
+		name string
+		path string
+	}{
+		{"Config dir", paths.ConfigDir},
+		{"Config file", paths.ConfigFile()},
+		{"Env file", paths.EnvFile()},
+		{"Prompt library", paths.PromptFile()},
+		{"Plugins dir", paths.PluginDir()},
+		{"State dir", paths.StateDir},
+		{"Log file", paths.LogFile()},
+		{"Promptedit file", paths.PromptEditFile()},
+		{"Sessions dir", SessionsDir(ProfileStateDir(paths.StateDir, "<profile>"))},
+		{"Screens dir", ScreensDir(paths.StateDir)},
+		{"Undo dir", UndoDir(paths.StateDir)},
+		{"Cache dir", paths.CacheDir},
+		{"Embedding index", "<indexed dir>/.butterfish_index"},
+	}
+
+	for _, entry := range entries {
+		missing := ""
+		if !strings.Contains(entry.path, "<") {
+			if _, err := os.Stat(entry.path); err != nil {
+				missing = " (not created yet)"
+			}
+		}
+		fmt.Fprintf(out, "%-16s %s%s\n", entry.name+":", entry.path, missing)
+	}
+}
+
 func styleToEscape(color lipgloss.TerminalColor) string {
 	r, g, b, _ := color.RGBA()
 	color256 := 16 + (36 * (r / 257 / 51)) + (6 * (g / 257 / 51)) + (b / 257 / 51)
@@ -609,36 +1208,38 @@ type promptCommand struct {
 	Verbose     int
 	History     []util.HistoryBlock
 	Tools       []util.ToolDefinition
+	Images      []util.CompletionImage
+	Out         io.Writer // defaults to this.Out
 }
 
 func (this *ButterfishCtx) Prompt(cmd *promptCommand) (*util.CompletionResponse, error) {
-	writer := this.Out
+	out := cmd.Out
+	if out == nil {
+		out = this.Out
+	}
+	writer := out
 
-	if !cmd.NoColor {
+	if !cmd.NoColor && !this.Config.NoColor {
 		color := styleToEscape(this.Config.Styles.Answer.GetForeground())
 		highlight := styleToEscape(this.Config.Styles.Highlight.GetForeground())
-		this.Out.Write([]byte(color))
+		out.Write([]byte(color))
 
 		termWidth, _, _ := term.GetSize(int(os.Stdout.Fd()))
 
 		if termWidth > 0 {
-			colorScheme := "monokai"
-			if !this.Config.ColorDark {
-				colorScheme = "monokailight"
-			}
-			writer = util.NewStyleCodeblocksWriter(this.Out, termWidth, color, highlight, colorScheme)
+			writer = util.NewStyleCodeblocksWriter(out, termWidth, color, highlight, this.Config.CodeTheme())
 		}
 	} else if cmd.NoBackticks {
 		// this is an else because the code blocks writer will strip out backticks
 		// on its own, so this is only used if we don't have color AND we don't
 		// want backticks
-		writer = util.NewStripbackticksWriter(this.Out)
+		writer = util.NewStripbackticksWriter(out)
 	}
 
 	sysMsg := cmd.SysMsg
 	if sysMsg == "" {
 		var err error
-		sysMsg, err = this.PromptLibrary.GetPrompt(prompt.PromptSystemMessage)
+		sysMsg, err = this.PromptLibrary.GetPromptForModel(prompt.PromptSystemMessage, cmd.Model)
 		if err != nil {
 			return nil, err
 		}
@@ -673,11 +1274,167 @@ func (this *ButterfishCtx) Prompt(cmd *promptCommand) (*util.CompletionResponse,
 		Tools:         cmd.Tools,
 		HistoryBlocks: cmd.History,
 		TokenTimeout:  this.Config.TokenTimeout,
+		Images:        cmd.Images,
 	}
+	this.Config.LimitRequest(FeaturePrompt, req)
 
 	return this.LLMClient.CompletionStream(req, writer)
 }
 
+// Create a temp file next to path. Unlike os.CreateTemp's 0600, it's created
+// with mode, less the umask, like a file the shell's > would create.
+func createTempNextTo(path string, mode os.FileMode) (*os.File, error) {
+	for i := 0; ; i++ {
+		name := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.%d", filepath.Base(path), rand.Uint32()))
+		file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, mode)
+		if os.IsExist(err) && i < 100 {
+			continue
+		}
+		return file, err
+	}
+}
+
+// Write to a temp file next to path and move it into place only if write
+// succeeds, so a failed command never leaves a partial file behind, e.g. for
+// make targets. A file that's replaced keeps its mode.
+func writeFileOnSuccess(path string, write func(io.Writer) error) error {
+	file, err := createTempNextTo(path, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if info, err := os.Stat(path); err == nil {
+		err = file.Chmod(info.Mode().Perm())
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	err = write(file)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// Prompt for JSON output matching the schema at schemaPath. The output is
+// validated against the schema and we retry with the validation error if it
+// doesn't match. Returns the compacted JSON.
+func (this *ButterfishCtx) StructuredPrompt(
+	input, sysMsg, model string,
+	numTokens int,
+	temperature float32,
+	schemaPath string,
+	retries int,
+) (string, error) {
+	schemaPath, err := homedir.Expand(schemaPath)
+	if err != nil {
+		return "", err
+	}
+	schemaJson, err := os.ReadFile(schemaPath)
+	if err != nil {
+		return "", err
+	}
+
+	// The schema is passed to the API as-is, we parse it into a Definition to
+	// validate output, which covers types, properties, required, and items
+	var schema jsonschema.Definition
+	err = json.Unmarshal(schemaJson, &schema)
+	if err != nil {
+		return "", fmt.Errorf("Unable to parse JSON schema %s: %s", schemaPath, err)
+	}
+
+	if sysMsg == "" {
+		sysMsg, err = this.PromptLibrary.GetPromptForModel(prompt.PromptSystemMessage, model)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	req := &util.CompletionRequest{
+		Ctx:           this.Ctx,
+		Prompt:        input,
+		Model:         model,
+		MaxTokens:     numTokens,
+		Temperature:   temperature,
+		SystemMessage: sysMsg,
+		Verbose:       this.Config.Verbose > 0,
+		TokenTimeout:  this.Config.TokenTimeout,
+		JSONSchema:    json.RawMessage(schemaJson),
+	}
+	this.Config.LimitRequest(FeaturePrompt, req)
+
+	return this.structuredCompletion(req, schema, retries)
+}
+
+// Run a completion request that has JSONSchema set, validating the output
+// against schema and retrying with the validation error if it doesn't match.
+func (this *ButterfishCtx) structuredCompletion(
+	req *util.CompletionRequest,
+	schema jsonschema.Definition,
+	retries int,
+) (string, error) {
+	var validationErr error
+	for attempt := 0; attempt <= retries; attempt++ {
+		attemptReq := *req
+		if validationErr != nil {
+			attemptReq.Prompt = fmt.Sprintf("%s\n\nYour previous response was invalid: %s. Respond only with JSON that matches the schema.",
+				req.Prompt, validationErr)
+		}
+
+		resp, err := this.LLMClient.Completion(&attemptReq)
+		if err != nil {
+			return "", err
+		}
+		if resp.Refusal != "" {
+			return "", errors.New(resp.RefusalMessage())
+		}
+
+		var output string
+		output, validationErr = validateStructuredOutput(resp.Completion, schema)
+		if validationErr == nil {
+			return output, nil
+		}
+		log.Printf("Structured output attempt %d was invalid: %s", attempt+1, validationErr)
+	}
+
+	return "", fmt.Errorf("Model output did not match the JSON schema after %d attempts: %s",
+		retries+1, validationErr)
+}
+
+// Check that the output is JSON matching the schema, tolerating a markdown
+// code fence around it. Returns the compacted JSON.
+func validateStructuredOutput(output string, schema jsonschema.Definition) (string, error) {
+	output = strings.TrimSpace(output)
+	output = strings.TrimPrefix(output, "```json")
+	output = strings.TrimPrefix(output, "```")
+	output = strings.TrimSuffix(output, "```")
+
+	var data any
+	err := json.Unmarshal([]byte(output), &data)
+	if err != nil {
+		return "", fmt.Errorf("Not valid JSON: %s", err)
+	}
+
+	if schema.Type != "" && !jsonschema.Validate(schema, data) {
+		return "", errors.New("JSON does not match the schema")
+	}
+
+	compacted := new(bytes.Buffer)
+	err = json.Compact(compacted, []byte(output))
+	if err != nil {
+		return "", err
+	}
+	return compacted.String(), nil
+}
+
 var EditSysMsg = `You're helping an expert programmer edit a file of code. You can either respond with questions and clarifications, or you can use the edit() tool, which replaces a range from the file with new code. In some cases you may want to call edit() multiple times, I will apply the edits and give you the updated file after every call. Use the most recent file for your edits. If there are no more edits, just say "DONE!"`
 
 var EditTools = []util.ToolDefinition{
@@ -689,6 +1446,10 @@ var EditTools = []util.ToolDefinition{
 			Parameters: jsonschema.Definition{
 				Type: jsonschema.Object,
 				Properties: map[string]jsonschema.Definition{
+					"path": {
+						Type:        jsonschema.String,
+						Description: "Path of the file to edit, relative to the directory being edited. Leave it out when editing a single file.",
+					},
 					"range_start": {
 						Type:        jsonschema.Number,
 						Description: "The start of the line range, inclusive",
@@ -708,35 +1469,35 @@ var EditTools = []util.ToolDefinition{
 	},
 }
 
-func (this *ButterfishCtx) EditLineBuffer(lineBuffer *LineBuffer, prompt string, options *CliCommandConfig) error {
+// Prompt the model with the request and, when editing a single file, its
+// numbered lines, then apply its tool calls until it stops calling them. cmd
+// sets the model, system message, tools, etc. for every request, the history
+// is filled in here. Tools default to EditTools.
+func (this *ButterfishCtx) editLoop(session *EditSession, prompt string, cmd *promptCommand) error {
 	// add prompt to history, this is what the user is asking for
 	history := []util.HistoryBlock{
 		{
 			Type:    historyTypePrompt,
 			Content: prompt,
 		},
-		{
+	}
+	if session.DefaultPath != "" {
+		history = append(history, util.HistoryBlock{
 			Type:    historyTypePrompt,
-			Content: lineBuffer.PrefixLineNumbers(),
-		},
+			Content: session.Files[session.DefaultPath].PrefixLineNumbers(),
+		})
 	}
 
 	for {
 		// prep prompting arguments
-		commandConfig := &promptCommand{
-			SysMsg:      EditSysMsg,
-			Model:       options.Edit.Model,
-			NumTokens:   options.Edit.NumTokens,
-			Temperature: options.Edit.Temperature,
-			Tools:       EditTools,
-			NoColor:     options.Edit.NoColor,
-			NoBackticks: options.Edit.NoBackticks,
-			Verbose:     this.Config.Verbose,
-			History:     history,
+		commandConfig := *cmd
+		if commandConfig.Tools == nil {
+			commandConfig.Tools = EditTools
 		}
+		commandConfig.History = history
 
 		// send prompt
-		resp, err := this.Prompt(commandConfig)
+		resp, err := this.Prompt(&commandConfig)
 		if err != nil {
 			return err
 		}
@@ -755,25 +1516,23 @@ func (this *ButterfishCtx) EditLineBuffer(lineBuffer *LineBuffer, prompt string,
 
 		// execute tool calls and add to history
 		for _, toolCall := range resp.ToolCalls {
-			if toolCall.Function.Name == "edit" {
-				err := ApplyEditToolToLineBuffer(toolCall, lineBuffer)
-				if err != nil {
-					return err
-				}
-
-				history = append(history, util.HistoryBlock{
-					Type:       historyTypeToolOutput,
-					Content:    lineBuffer.PrefixLineNumbers(),
-					ToolCallId: toolCall.Id,
-				})
-			} else {
-				return errors.New("Unknown tool call: " + toolCall.Function.Name)
+			output, err := session.ApplyToolCall(toolCall)
+			if err != nil {
+				return err
 			}
+
+			history = append(history, util.HistoryBlock{
+				Type:       historyTypeToolOutput,
+				Content:    output,
+				ToolCallId: toolCall.Id,
+			})
 		}
 	}
 
 	if this.Config.Verbose > 1 {
-		fmt.Fprintf(this.Out, "Final file:\n%s\n", lineBuffer.PrefixLineNumbers())
+		for _, path := range session.Changed() {
+			fmt.Fprintf(this.Out, "Final %s:\n%s\n", path, session.Files[path].PrefixLineNumbers())
+		}
 	}
 	return nil
 }
@@ -799,13 +1558,14 @@ func (this *ButterfishCtx) diffStrings(a, b string) string {
 
 // Given a description of functionality, we call GPT to generate a shell
 // command
-func (this *ButterfishCtx) gencmdCommand(description string) (string, error) {
-	promptStr, err := this.PromptLibrary.GetPrompt("generate_command", "content", description)
+func (this *ButterfishCtx) GenerateCommand(description string) (string, error) {
+	promptStr, err := this.PromptLibrary.GetPromptForModel(prompt.PromptGenerateCommand,
+		this.Config.GencmdModel, "content", description)
 	if err != nil {
 		return "", err
 	}
 
-	sysMsg, err := this.PromptLibrary.GetPrompt(prompt.PromptSystemMessage)
+	sysMsg, err := this.PromptLibrary.GetPromptForModel(prompt.PromptSystemMessage, this.Config.GencmdModel)
 	if err != nil {
 		return "", err
 	}
@@ -818,6 +1578,7 @@ func (this *ButterfishCtx) gencmdCommand(description string) (string, error) {
 		SystemMessage: sysMsg,
 		TokenTimeout:  this.Config.TokenTimeout,
 	}
+	this.Config.LimitRequest(FeatureGencmd, req)
 
 	resp, err := this.LLMClient.Completion(req)
 	if err != nil {
@@ -856,62 +1617,22 @@ func fixCommandParse(s string) (string, error) {
 }
 
 // Execute a command in a loop, if the exit status is non-zero then we call
-// GPT to give us a fixed command and ask the user if they want to run it
-func (this *ButterfishCtx) execAndCheck(ctx context.Context, cmd string) error {
-	for {
-		result, err := this.execCommand(cmd)
-		if err != nil {
-			return err
-		}
-		// If the command succeeded, we're done
-		if result.Status == 0 {
-			return nil
-		}
-
-		this.ErrorPrintf("Command failed with status %d, requesting fix...\n", result.Status)
-
-		prompt, err := this.PromptLibrary.GetPrompt("fix_command",
-			"command", cmd,
-			"status", fmt.Sprintf("%d", result.Status),
-			"output", string(result.LastOutput))
-		if err != nil {
-			return err
-		}
-
-		styleWriter := util.NewStyledWriter(this.Out, this.Config.Styles.Highlight)
-
-		req := &util.CompletionRequest{
-			Ctx:           this.Ctx,
-			Prompt:        prompt,
-			Model:         this.Config.ExeccheckModel,
-			MaxTokens:     this.Config.ExeccheckMaxTokens,
-			Temperature:   this.Config.ExeccheckTemperature,
-			SystemMessage: "N/A",
-			TokenTimeout:  this.Config.TokenTimeout,
-		}
-
-		response, err := this.LLMClient.CompletionStream(req, styleWriter)
-		if err != nil {
-			return err
-		}
-
-		cmd, err = fixCommandParse(response.Completion)
-		if err != nil {
-			return err
-		}
-
+// GPT to give us a fixed command and ask the user if they want to run it.
+// run executes the command, locally or in a wrapped terminal.
+func (this *ButterfishCtx) execAndCheck(ctx context.Context, cmd string, policy CommandPolicy, run func(string) (*executeResult, error)) error {
+	repair := this.NewCommandRepair(policy)
+	repair.Out = util.NewStyledWriter(this.Out, this.Config.Styles.Highlight)
+	repair.Confirm = func(ctx context.Context, cmd string) (string, bool, error) {
 		this.StylePrintf(this.Config.Styles.Question, "Run this command? [y/N]: ")
 
 		var input string
-		_, err = fmt.Scanln(&input)
+		_, err := fmt.Scanln(&input)
 		if err != nil {
-			return err
-		}
-
-		if strings.ToLower(input) != "y" {
-			return nil
+			return "", false, err
 		}
+		return cmd, strings.ToLower(input) == "y", nil
 	}
+	return repair.Run(ctx, cmd, run)
 }
 
 type executeResult struct {
@@ -924,7 +1645,13 @@ type executeResult struct {
 // process is killed.
 // Returns an executeResult with status and last output
 func executeCommand(ctx context.Context, cmd string, out io.Writer) (*executeResult, error) {
+	return executeCommandIn(ctx, "", cmd, out)
+}
+
+// Like executeCommand but runs in dir, or our own directory if it's empty
+func executeCommandIn(ctx context.Context, dir, cmd string, out io.Writer) (*executeResult, error) {
 	c := exec.CommandContext(ctx, "/bin/sh", "-c", cmd)
+	c.Dir = dir
 	cacheWriter := util.NewCacheWriter(out)
 	c.Stdout = cacheWriter
 	c.Stderr = cacheWriter
@@ -963,15 +1690,54 @@ func (this *ButterfishCtx) execCommand(cmd string) (*executeResult, error) {
 	return executeCommand(this.Ctx, cmd, this.Out)
 }
 
-// Iterate through a list of file paths and summarize each
-func (this *ButterfishCtx) SummarizePaths(paths []string, chunkSize, maxChunks int) error {
+// A --max-chunks of 0 means no limit, which the chunking functions take as -1
+func UnlimitedChunks(maxChunks int) int {
+	if maxChunks <= 0 {
+		return -1
+	}
+	return maxChunks
+}
+
+// Iterate through a list of file paths and summarize each, directories get a
+// report of their tree that's written to output if it's set
+func (this *ButterfishCtx) SummarizePaths(paths []string, chunkSize, maxChunks, maxDepth int, output string, yes bool) error {
+	reports := []string{}
 	for _, path := range paths {
-		err := this.SummarizePath(path, chunkSize, maxChunks)
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			report, err := this.SummarizeDirectory(path, chunkSize, maxChunks, maxDepth, yes)
+			if err != nil {
+				return err
+			}
+			reports = append(reports, report)
+			continue
+		}
+
+		err = this.SummarizePath(path, chunkSize, maxChunks, yes)
 		if err != nil {
 			return err
 		}
 	}
 
+	if len(reports) == 0 {
+		return nil
+	}
+	report := strings.Join(reports, "\n")
+	if output == "" {
+		fmt.Fprintf(this.Out, "%s", report)
+		return nil
+	}
+	err := writeFileOnSuccess(output, func(out io.Writer) error {
+		_, err := io.WriteString(out, report)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	this.StylePrintf(this.Config.Styles.Grey, "Wrote %s\n", output)
 	return nil
 }
 
@@ -987,7 +1753,7 @@ func (this *ButterfishCtx) SummarizePaths(paths []string, chunkSize, maxChunks i
 // The number of tokens processed in a given API request depends on the length
 // of both your inputs and outputs. As a rough rule of thumb, 1 token is
 // approximately 4 characters or 0.75 words for English text.
-func (this *ButterfishCtx) SummarizePath(path string, chunkSize, maxChunks int) error {
+func (this *ButterfishCtx) SummarizePath(path string, chunkSize, maxChunks int, yes bool) error {
 	this.StylePrintf(this.Config.Styles.Question, "Summarizing %s\n", path)
 
 	fs := afero.NewOsFs()
@@ -996,7 +1762,7 @@ func (this *ButterfishCtx) SummarizePath(path string, chunkSize, maxChunks int)
 		return err
 	}
 
-	return this.SummarizeChunks(chunks)
+	return this.SummarizeChunks(chunks, yes)
 }
 
 func (this *ButterfishCtx) updateCommandRegister(cmd string) {
@@ -1012,8 +1778,34 @@ func (this *ButterfishCtx) updateCommandRegister(cmd string) {
 	this.Printf("Run exec or execremote to execute\n")
 }
 
-func (this *ButterfishCtx) SummarizeChunks(chunks [][]byte) error {
+// Summarize chunks from the command line, showing the estimated cost first
+// and asking if it's over the threshold
+func (this *ButterfishCtx) SummarizeChunks(chunks [][]byte, yes bool) error {
+	if len(chunks) > 1 {
+		estimate := this.summarizeCostEstimate(chunks, tokenCounter(this.Config.SummarizeModel))
+		this.StylePrintf(this.Config.Styles.Grey, "Summarizing %d chunks, %s, plus more requests to merge the facts if they don't fit in one\n",
+			len(chunks), estimate)
+		err := this.ConfirmCost(estimate, yes)
+		if err != nil {
+			return err
+		}
+	}
+
 	writer := util.NewStyledWriter(this.Out, this.Config.Styles.Foreground)
+	progress := util.NewStyledWriter(this.Out, this.Config.Styles.Grey)
+	return this.summarizeChunksConcurrently(this.summarizeRequest(), chunks, writer,
+		this.Config.SummarizeConcurrency, progress, nil)
+}
+
+// Summarize the chunks of a document and write the summary to writer, without
+// asking about the cost
+func (this *ButterfishCtx) WriteSummary(chunks [][]byte, writer io.Writer) error {
+	return this.summarizeChunksConcurrently(this.summarizeRequest(), chunks, writer,
+		this.Config.SummarizeConcurrency, nil, nil)
+}
+
+// The request summaries are made with, from the summarize settings
+func (this *ButterfishCtx) summarizeRequest() *util.CompletionRequest {
 	req := &util.CompletionRequest{
 		Ctx:           this.Ctx,
 		Model:         this.Config.SummarizeModel,
@@ -1021,50 +1813,108 @@ func (this *ButterfishCtx) SummarizeChunks(chunks [][]byte) error {
 		Temperature:   this.Config.SummarizeTemperature,
 		SystemMessage: "N/A",
 	}
+	this.Config.LimitRequest(FeatureSummarize, req)
+	return req
+}
+
+// Summarize chunks with up to concurrency requests at a time, each request
+// is a copy of req with its prompt filled in. If progress isn't nil we print
+// the merge requests to it. If backoff is set every request waits on it and
+// is retried through it, so that a rate limit here also pauses the caller's
+// other workers, e.g. those summarizing other files.
+func (this *ButterfishCtx) summarizeChunksConcurrently(
+	req *util.CompletionRequest,
+	chunks [][]byte,
+	writer io.Writer,
+	concurrency int,
+	progress io.Writer,
+	backoff *sharedBackoff,
+) error {
+
+	// with a shared backoff the summary is buffered, so that a retried
+	// request doesn't repeat output
+	shared := backoff != nil
+	if !shared {
+		backoff = newSharedBackoff(this.Config.RetryPolicy)
+	}
+	stream := func(req *util.CompletionRequest) error {
+		if !shared {
+			_, err := this.LLMClient.CompletionStream(req, writer)
+			return err
+		}
+		streamReq := *req
+		streamReq.Retries = 0
+		output, err := backoff.do(this.Ctx, req.Retries, func() (string, error) {
+			buffer := new(bytes.Buffer)
+			_, err := this.LLMClient.CompletionStream(&streamReq, buffer)
+			return buffer.String(), err
+		})
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(writer, output)
+		return err
+	}
 
 	if len(chunks) == 1 {
 		// the entire document fits within the token limit, summarize directly
-		prompt, err := this.PromptLibrary.GetPrompt(prompt.PromptSummarize,
+		prompt, err := this.PromptLibrary.GetPromptForModel(prompt.PromptSummarize, req.Model,
 			"content", string(chunks[0]))
 		if err != nil {
 			return err
 		}
 		req.Prompt = prompt
-
-		_, err = this.LLMClient.CompletionStream(req, writer)
+		return stream(req)
 	}
 
-	// the document doesn't fit within the token limit, we'll iterate over it
-	// and summarize each chunk as facts, then ask for a summary of facts
-	facts := strings.Builder{}
-
-	for _, chunk := range chunks {
-		if len(chunk) < 16 { // if we have a tiny chunk, skip it
+	// the document doesn't fit within the token limit, we'll summarize each
+	// chunk as facts on a pool of workers, merge the facts in groups until
+	// they fit in one request, then ask for a summary of facts
+	for i, chunk := range chunks {
+		if len(chunk) < 16 { // if we have a tiny chunk, skip it and the rest
+			chunks = chunks[:i]
 			break
 		}
+	}
 
-		prompt, err := this.PromptLibrary.GetPrompt(prompt.PromptSummarizeFacts,
-			"content", string(chunk))
-		if err != nil {
-			return err
-		}
-		req.Prompt = prompt
-		resp, err := this.LLMClient.Completion(req)
-		if err != nil {
-			return err
-		}
-		facts.WriteString(resp.Completion)
-		facts.WriteString("\n")
+	countTokens := tokenCounter(req.Model)
+
+	// the pool does the retrying so that rate limits pause every worker
+	factsReq := *req
+	factsReq.Retries = 0
+	facts, err := runOrderedWithBackoff(this.Ctx, backoff, len(chunks), concurrency, req.Retries,
+		func(ctx context.Context, i int) (string, error) {
+			prompt, err := this.PromptLibrary.GetPromptForModel(prompt.PromptSummarizeFacts, req.Model,
+				"content", string(chunks[i]))
+			if err != nil {
+				return "", err
+			}
+			chunkReq := factsReq
+			chunkReq.Ctx = ctx
+			chunkReq.Prompt = prompt
+			resp, err := this.LLMClient.Completion(&chunkReq)
+			if err != nil {
+				return "", err
+			}
+			return resp.Completion + "\n", nil
+		})
+	if err != nil {
+		return err
+	}
+
+	budget := summarizeMergeBudget(req.Model, req.MaxTokens)
+	facts, err = this.reduceFacts(facts, &factsReq, budget, concurrency, req.Retries, backoff, countTokens, progress)
+	if err != nil {
+		return err
 	}
 
-	mergedFacts := facts.String()
-	prompt, err := this.PromptLibrary.GetPrompt(prompt.PromptSummarizeListOfFacts,
+	mergedFacts := strings.Join(facts, "")
+	prompt, err := this.PromptLibrary.GetPromptForModel(prompt.PromptSummarizeListOfFacts, req.Model,
 		"content", mergedFacts)
 	if err != nil {
 		return err
 	}
 
 	req.Prompt = prompt
-	_, err = this.LLMClient.CompletionStream(req, writer)
-	return err
+	return stream(req)
 }
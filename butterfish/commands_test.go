@@ -0,0 +1,183 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Returns each of its responses in turn
+type scriptedLLM struct {
+	responses []string
+	requests  []*util.CompletionRequest
+}
+
+func (this *scriptedLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	response, err := this.Completion(request)
+	writer.Write([]byte(response.Completion))
+	return response, err
+}
+
+func (this *scriptedLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	response := this.responses[len(this.requests)%len(this.responses)]
+	this.requests = append(this.requests, request)
+	return &util.CompletionResponse{Completion: response}, nil
+}
+
+func (this *scriptedLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	return nil, nil
+}
+
+func TestStructuredPrompt(t *testing.T) {
+	schemaPath := filepath.Join(t.TempDir(), "schema.json")
+	schema := `{"type": "object", "properties": {"name": {"type": "string"}}, "required": ["name"]}`
+	assert.Nil(t, os.WriteFile(schemaPath, []byte(schema), 0644))
+
+	llm := &scriptedLLM{responses: []string{
+		"not json",
+		`{"other": 1}`,
+		"```json\n{\"name\": \"fish\"}\n```",
+	}}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+	}
+
+	output, err := butterfish.StructuredPrompt("hi", "", "gpt-4o", 100, 0.7, schemaPath, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"name":"fish"}`, output)
+	assert.Equal(t, 3, len(llm.requests))
+	assert.JSONEq(t, schema, string(llm.requests[0].JSONSchema))
+	assert.Equal(t, "hi", llm.requests[0].Prompt)
+	assert.Contains(t, llm.requests[2].Prompt, "does not match the schema")
+
+	llm.requests = nil
+	_, err = butterfish.StructuredPrompt("hi", "", "gpt-4o", 100, 0.7, schemaPath, 1)
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, len(llm.requests))
+}
+
+func TestGenerateExplainedCommand(t *testing.T) {
+	llm := &scriptedLLM{responses: []string{
+		`{"command": "ls -lS"}`,
+		`{"command": " ls -lS\n", "explanation": "-S sorts by size, largest first. "}`,
+	}}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+	}
+
+	generated, err := butterfish.GenerateExplainedCommand("list files by size")
+	assert.Nil(t, err)
+	assert.Equal(t, &GeneratedCommand{Command: "ls -lS", Explanation: "-S sorts by size, largest first."}, generated)
+	assert.Equal(t, 2, len(llm.requests))
+	assert.NotNil(t, llm.requests[0].JSONSchema)
+	assert.Contains(t, llm.requests[1].Prompt, "does not match the schema")
+}
+
+func TestGencmdMenu(t *testing.T) {
+	llm := &scriptedLLM{responses: []string{" du -sh * | sort -h\n"}}
+	out := new(bytes.Buffer)
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+		Out:           out,
+	}
+	butterfish.Config.DisableColor()
+	generate := func(description string) (*GeneratedCommand, error) {
+		cmd, err := butterfish.GenerateCommand(description)
+		return &GeneratedCommand{Command: strings.TrimSpace(cmd)}, err
+	}
+
+	// generate again with feedback, then don't run it
+	in := strings.NewReader("g\nuse du instead\nn\n")
+	err := butterfish.gencmdMenu(in, "list files by size", &GeneratedCommand{Command: "ls -lS"}, generate)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(llm.requests))
+	assert.Contains(t, llm.requests[0].Prompt, "A previous attempt was `ls -lS`, change it as follows: use du instead")
+	assert.Contains(t, out.String(), "ls -lS\n")
+	assert.Contains(t, out.String(), "du -sh * | sort -h\n")
+
+	// running it adds it to the shell history
+	history := filepath.Join(t.TempDir(), "history")
+	t.Setenv("HISTFILE", history)
+	in = strings.NewReader("r\n")
+	err = butterfish.gencmdMenu(in, "say hi", &GeneratedCommand{Command: "echo hi"}, generate)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(out.String(), "hi\n"))
+	content, _ := os.ReadFile(history)
+	assert.Equal(t, "echo hi\n", string(content))
+}
+
+func TestFormatHistoryEntry(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	assert.Equal(t, "ls\n", formatHistoryEntry(nil, "ls", now))
+	assert.Equal(t, "ls\n", formatHistoryEntry([]byte("cd /tmp\n"), "ls", now))
+	assert.Equal(t, "#1700000000\nls\n", formatHistoryEntry([]byte("#1699999999\ncd /tmp\n"), "ls", now))
+	assert.Equal(t, ": 1700000000:0;for f in *; do\\\necho $f\\\ndone\n",
+		formatHistoryEntry([]byte(": 1699999999:0;cd /tmp\n"), "for f in *; do\necho $f\ndone", now))
+}
+
+func TestWriteFileOnSuccess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.txt")
+
+	err := writeFileOnSuccess(path, func(out io.Writer) error {
+		out.Write([]byte("partial"))
+		return errors.New("API error")
+	})
+	assert.NotNil(t, err)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     &echoLLM{},
+	}
+	err = writeFileOnSuccess(path, func(out io.Writer) error {
+		_, err := butterfish.Prompt(&promptCommand{Prompt: "hi", NoColor: true, Out: out})
+		return err
+	})
+	assert.Nil(t, err)
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "echo: hi", string(data))
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+
+	// a new file is readable like one from >, an existing one keeps its mode
+	umask := syscall.Umask(0)
+	syscall.Umask(umask)
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0644&^umask), info.Mode().Perm())
+
+	assert.Nil(t, os.Chmod(path, 0755))
+	assert.Nil(t, writeFileOnSuccess(path, func(out io.Writer) error {
+		_, err := out.Write([]byte("#!/bin/sh\n"))
+		return err
+	}))
+	info, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+}
@@ -0,0 +1,273 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// The commit command writes a commit message for the staged changes. Small
+// diffs are sent to the model whole, large diffs are split on file boundaries
+// and each chunk is summarized first, then the message is written from the
+// summaries. The message is shown for confirmation or editing before we run
+// git commit.
+
+// git's empty tree, used as the base when amending the root commit
+const emptyTreeHash = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+// Run git in the current directory and return its stdout
+func runGit(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return "", fmt.Errorf("git %s failed: %s", args[0], msg)
+	}
+	return string(output), nil
+}
+
+// The staged diff, or with amend the diff the amended commit will have
+func stagedDiff(ctx context.Context, amend bool) (string, error) {
+	if !amend {
+		return runGit(ctx, "diff", "--staged")
+	}
+
+	base := "HEAD^"
+	if _, err := runGit(ctx, "rev-parse", "--verify", "--quiet", base); err != nil {
+		base = emptyTreeHash
+	}
+	return runGit(ctx, "diff", "--staged", base)
+}
+
+// Split a diff into the part for each file
+func splitDiffFiles(diff string) []string {
+	files := []string{}
+	rest := diff
+	for {
+		i := strings.Index(rest, "\ndiff --git ")
+		if i < 0 {
+			files = append(files, rest)
+			break
+		}
+		files = append(files, rest[:i+1])
+		rest = rest[i+1:]
+	}
+	return files
+}
+
+// Split a diff into chunks of at most chunkSize bytes on file boundaries,
+// files larger than chunkSize are split on lines
+func splitDiff(diff string, chunkSize int) []string {
+	files := splitDiffFiles(diff)
+	chunks := []string{}
+	current := strings.Builder{}
+	flush := func() {
+		if current.Len() > 0 {
+			chunks = append(chunks, current.String())
+			current.Reset()
+		}
+	}
+
+	for _, file := range files {
+		if current.Len()+len(file) > chunkSize {
+			flush()
+		}
+		if len(file) <= chunkSize {
+			current.WriteString(file)
+			continue
+		}
+
+		for _, line := range strings.SplitAfter(file, "\n") {
+			if current.Len()+len(line) > chunkSize {
+				flush()
+			}
+			if len(line) > chunkSize {
+				line = line[:chunkSize]
+			}
+			current.WriteString(line)
+		}
+	}
+	flush()
+
+	return chunks
+}
+
+// Strip code fences and whitespace that models sometimes wrap messages in
+func cleanCommitMessage(message string) string {
+	message = strings.TrimSpace(message)
+	if strings.HasPrefix(message, "```") {
+		lines := strings.Split(message, "\n")
+		lines = lines[1:]
+		if len(lines) > 0 && strings.HasPrefix(strings.TrimSpace(lines[len(lines)-1]), "```") {
+			lines = lines[:len(lines)-1]
+		}
+		message = strings.TrimSpace(strings.Join(lines, "\n"))
+	}
+	return message
+}
+
+// Write a commit message for a diff, summarizing chunks first if the diff is
+// larger than chunkSize
+func (this *ButterfishCtx) CommitMessage(diff, model string, numTokens, chunkSize, maxChunks int) (string, error) {
+	if strings.TrimSpace(diff) == "" {
+		return "", errors.New("No staged changes, stage them with git add first")
+	}
+
+	req := &util.CompletionRequest{
+		Ctx:           this.Ctx,
+		Model:         model,
+		MaxTokens:     numTokens,
+		Temperature:   0.2,
+		SystemMessage: "N/A",
+		Verbose:       this.Config.Verbose > 0,
+		TokenTimeout:  this.Config.TokenTimeout,
+	}
+	this.Config.LimitRequest(FeaturePrompt, req)
+
+	changes := diff
+	chunks := splitDiff(diff, chunkSize)
+	if len(chunks) > 1 {
+		if len(chunks) > maxChunks {
+			chunks = chunks[:maxChunks]
+		}
+
+		summaries := strings.Builder{}
+		for _, chunk := range chunks {
+			summaryPrompt, err := this.PromptLibrary.GetPromptForModel(prompt.PromptSummarizeDiff, model,
+				"diff", chunk)
+			if err != nil {
+				return "", err
+			}
+			chunkReq := *req
+			chunkReq.Prompt = summaryPrompt
+
+			response, err := this.LLMClient.Completion(&chunkReq)
+			if err != nil {
+				return "", err
+			}
+			if response.Refusal != "" {
+				return "", errors.New(response.RefusalMessage())
+			}
+			summaries.WriteString(strings.TrimSpace(response.Completion))
+			summaries.WriteString("\n")
+		}
+		changes = summaries.String()
+	}
+
+	messagePrompt, err := this.PromptLibrary.GetPromptForModel(prompt.PromptCommitMessage, model,
+		"diff", changes)
+	if err != nil {
+		return "", err
+	}
+	req.Prompt = messagePrompt
+
+	response, err := this.LLMClient.Completion(req)
+	if err != nil {
+		return "", err
+	}
+	if response.Refusal != "" {
+		return "", errors.New(response.RefusalMessage())
+	}
+
+	message := cleanCommitMessage(response.Completion)
+	if message == "" {
+		return "", errors.New("The model returned an empty commit message")
+	}
+	return message, nil
+}
+
+// Open text in an editor, in a temp file named like pattern, and return the
+// edited version
+func editInEditor(editor, pattern, text string) (string, error) {
+	file, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString(text + "\n")
+	file.Close()
+	if err != nil {
+		return "", err
+	}
+
+	err = runEditor(resolveEditor(editor), file.Name())
+	if err != nil {
+		return "", err
+	}
+
+	edited, err := os.ReadFile(file.Name())
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(edited)), nil
+}
+
+func (this *ButterfishCtx) commitCommand(options *CliCommandConfig) error {
+	opts := options.Commit
+
+	diff, err := stagedDiff(this.Ctx, opts.Amend)
+	if err != nil {
+		return err
+	}
+
+	message, err := this.CommitMessage(diff, opts.Model, opts.NumTokens, opts.ChunkSize, opts.MaxChunks)
+	if err != nil {
+		return err
+	}
+
+	if opts.Print {
+		fmt.Fprintf(this.Out, "%s\n", message)
+		return nil
+	}
+
+	for !opts.Yes {
+		this.StylePrintf(this.Config.Styles.Answer, "%s\n\n", message)
+		this.StylePrintf(this.Config.Styles.Question, "Commit with this message? [y/N/e(dit)]: ")
+
+		var input string
+		fmt.Scanln(&input)
+		input = strings.ToLower(strings.TrimSpace(input))
+
+		if input == "y" {
+			break
+		}
+		if input != "e" {
+			return nil
+		}
+
+		message, err = editInEditor(opts.Editor, "butterfish-commit-*.txt", message)
+		if err != nil {
+			return err
+		}
+		if message == "" {
+			return errors.New("Aborting commit due to empty commit message")
+		}
+	}
+
+	args := []string{"commit", "-m", message}
+	if opts.Amend {
+		args = append(args, "--amend")
+	}
+	if opts.NoVerify {
+		args = append(args, "--no-verify")
+	}
+
+	cmd := exec.CommandContext(this.Ctx, "git", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = this.Out
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
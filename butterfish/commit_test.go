@@ -0,0 +1,82 @@
+package butterfish
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testDiff = `diff --git a/a.go b/a.go
+index 1..2 100644
+--- a/a.go
++++ b/a.go
+@@ -1 +1 @@
+-foo
++bar
+diff --git a/b.go b/b.go
+index 1..2 100644
+--- a/b.go
++++ b/b.go
+@@ -1 +1 @@
+-baz
++qux
+`
+
+func TestSplitDiff(t *testing.T) {
+	chunks := splitDiff(testDiff, 1000)
+	assert.Equal(t, []string{testDiff}, chunks)
+
+	// each file gets its own chunk
+	chunks = splitDiff(testDiff, 100)
+	assert.Equal(t, 2, len(chunks))
+	assert.True(t, strings.HasPrefix(chunks[0], "diff --git a/a.go"))
+	assert.True(t, strings.HasPrefix(chunks[1], "diff --git a/b.go"))
+	assert.Equal(t, testDiff, strings.Join(chunks, ""))
+
+	// files larger than a chunk are split on lines
+	chunks = splitDiff(testDiff, 40)
+	assert.Greater(t, len(chunks), 2)
+	for _, chunk := range chunks {
+		assert.LessOrEqual(t, len(chunk), 40)
+	}
+	assert.Equal(t, testDiff, strings.Join(chunks, ""))
+}
+
+func TestCleanCommitMessage(t *testing.T) {
+	assert.Equal(t, "fix: x\n\nbody", cleanCommitMessage("\n```\nfix: x\n\nbody\n```\n"))
+	assert.Equal(t, "fix: x", cleanCommitMessage("```text\nfix: x\n```"))
+	assert.Equal(t, "feat: y", cleanCommitMessage("  feat: y \n"))
+}
+
+func TestCommitMessage(t *testing.T) {
+	llm := &scriptedLLM{responses: []string{"```\nfix(a): change foo to bar\n\nBody\n```"}}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+	}
+
+	message, err := butterfish.CommitMessage(testDiff, "gpt-4o", 100, 1000, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, "fix(a): change foo to bar\n\nBody", message)
+	assert.Equal(t, 1, len(llm.requests))
+	assert.Contains(t, llm.requests[0].Prompt, "commit_message")
+	assert.Contains(t, llm.requests[0].Prompt, "+bar")
+
+	// large diffs are summarized per chunk, then the summaries are used
+	llm = &scriptedLLM{responses: []string{"a.go changed", "b.go changed", "chore: update"}}
+	butterfish.LLMClient = llm
+	message, err = butterfish.CommitMessage(testDiff, "gpt-4o", 100, 100, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, "chore: update", message)
+	assert.Equal(t, 3, len(llm.requests))
+	assert.Contains(t, llm.requests[0].Prompt, "summarize_diff")
+	assert.Contains(t, llm.requests[2].Prompt, "a.go changed\nb.go changed")
+	assert.NotContains(t, llm.requests[2].Prompt, "+bar")
+
+	_, err = butterfish.CommitMessage(" \n", "gpt-4o", 100, 100, 8)
+	assert.NotNil(t, err)
+}
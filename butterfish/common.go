@@ -13,65 +13,6 @@ import (
 	"github.com/mattn/go-runewidth"
 )
 
-// See https://platform.openai.com/docs/models/overview
-var MODEL_TO_NUM_TOKENS = map[string]int{
-	"gpt-4o":                      128000,
-	"gpt-4o-2024-05-13":           128000,
-	"gpt-4":                       8192,
-	"gpt-4-1106":                  128000,
-	"gpt-4-0125-preview":          128000,
-	"gpt-4-vision":                128000,
-	"gpt-4-0314":                  8192,
-	"gpt-4-0613":                  8192,
-	"gpt-4-32k":                   32768,
-	"gpt-4-32k-0314":              32768,
-	"gpt-4-32k-0613":              32768,
-	"gpt-4-turbo":                 128000,
-	"gpt-4-turbo-preview":         128000,
-	"gpt-4-turbo-2024-04-09":      128000,
-	"gpt-3.5-turbo":               16384,
-	"gpt-3.5-turbo-0301":          4096,
-	"gpt-3.5-turbo-0613":          4096,
-	"gpt-3.5-turbo-1106":          16384,
-	"gpt-3.5-turbo-0125":          16384,
-	"gpt-3.5-turbo-16k":           16384,
-	"gpt-3.5-turbo-16k-0613":      16384,
-	"gpt-3.5-turbo-instruct":      4096,
-	"gpt-3.5-turbo-instruct-0913": 4096,
-	"text-davinci-003":            2047,
-	"text-davinci-002":            2047,
-	"code-davinci-002":            8001,
-	"code-davinci-001":            8001,
-	"text-curie-001":              2049,
-	"text-babbage-001":            2049,
-	"text-ada-001":                2049,
-	"davinci":                     2049,
-	"curie":                       2049,
-	"babbage":                     2049,
-	"ada":                         2049,
-	"code-cushman-002":            2048,
-	"code-cushman-001":            2048,
-}
-
-// these token numbers come from
-// https://github.com/pkoukk/tiktoken-go#counting-tokens-for-chat-api-calls
-var MODEL_TO_TOKENS_PER_MESSAGE = map[string]int{
-	"gpt-4o":                 3,
-	"gpt-4o-2024-05-13":      3,
-	"gpt-4":                  3,
-	"gpt-4-0314":             3,
-	"gpt-4-0613":             3,
-	"gpt-4-32k":              3,
-	"gpt-4-32k-0314":         3,
-	"gpt-4-32k-0613":         3,
-	"gpt-3.5-turbo":          4,
-	"gpt-3.5-turbo-0301":     4,
-	"gpt-3.5-turbo-1613":     4,
-	"gpt-3.5-turbo-1106":     4,
-	"gpt-3.5-turbo-16k":      4,
-	"gpt-3.5-turbo-16k-0613": 4,
-}
-
 // Given a model name (e.g. gpt-4-32k-0613), search the kv map for the
 // value associated with the model name. If the model name is not found,
 // attempt to find a simpler model name by removing the last segment
@@ -101,38 +42,6 @@ func findModelValue(model string, kv map[string]int) (string, int) {
 	return "", -1
 }
 
-func NumTokensForModel(model string) int {
-	foundModel, numTokens := findModelValue(model, MODEL_TO_NUM_TOKENS)
-
-	// couldn't find model
-	if foundModel == "" {
-		log.Printf("WARNING: Unknown model %s, using default context window size of 8192 tokens", model)
-		return 8192
-	}
-
-	// found simpler model
-	if foundModel != model {
-		log.Printf("WARNING: Unknown model %s, using model %s settings instead with context window size of %d tokens", model, foundModel, numTokens)
-		return numTokens
-	}
-
-	log.Printf("Found model %s context window size of %d tokens", model, numTokens)
-
-	// normal
-	return numTokens
-}
-
-func NumTokensPerMessageForModel(model string) int {
-	foundModel, numTokens := findModelValue(model, MODEL_TO_TOKENS_PER_MESSAGE)
-
-	if foundModel == "" {
-		log.Printf("WARNING: Unknown model %s, using default num tokens per message 5", model)
-		return 5
-	}
-
-	return numTokens
-}
-
 // Data type for passing byte chunks from a wrapped command around
 type byteMsg struct {
 	Data []byte
@@ -282,6 +191,17 @@ var BOX_COLORS = []string{
 	"\033[38;2;255;177;209m",
 }
 
+// Turned off by ButterfishConfig.DisableColor
+var loggingBoxColors = true
+
+// The escape codes for a box color and for resetting it, empty without color
+func boxColorEscapes(color int) (string, string) {
+	if !loggingBoxColors {
+		return "", ""
+	}
+	return BOX_COLORS[color], "\033[0m"
+}
+
 // Given a loggingbox and a writer, write boxes with lines and width 80.
 // The boxes can be nested, and the title will be placed in the top line of
 // the box.
@@ -290,7 +210,8 @@ func PrintLoggingBox(box LoggingBox) {
 	buf := new(bytes.Buffer)
 	buf.WriteString("\n")
 	printLoggingBox(box, buf, 0, []string{})
-	buf.WriteString("\033[0m")
+	_, reset := boxColorEscapes(box.Color)
+	buf.WriteString(reset)
 	log.Println(buf.String())
 }
 
@@ -323,10 +244,10 @@ func printLoggingBox(box LoggingBox, writer io.Writer, depth int, colors []strin
 	for i := 0; i < depth; i++ {
 		indent += colors[i] + V_LINE
 	}
-	boxColor := BOX_COLORS[box.Color]
+	boxColor, reset := boxColorEscapes(box.Color)
 	indentFull := indent + boxColor + V_LINE
-	indent += "\033[0m"
-	indentFull += "\033[0m"
+	indent += reset
+	indentFull += reset
 
 	indentRight := ""
 	for i := depth - 1; i >= 0; i-- {
@@ -0,0 +1,532 @@
+package butterfish
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/bakks/butterfish/embedding"
+	"github.com/bakks/butterfish/util"
+)
+
+// This file handles the optional user config file, by default found at
+// ~/.config/butterfish/config.yaml. The config file holds named profiles,
+// which bundle an API key, base URL, models, a token budget, and some policy
+// switches. A profile is selected with `butterfish --profile work ...`, with
+// the BUTTERFISH_PROFILE env var, or with default_profile in the file.
+//
+// Example:
+//
+//	default_profile: personal
+//	profiles:
+//	  work:
+//	    openai_token_env: WORK_OPENAI_KEY
+//	    base_url: https://llm.internal.example.com/v1
+//	    shell_prompt_model: gpt-4o
+//	    token_budget: 2000000
+//	    disable_unsafe_goal_mode: true
+//	    fallbacks:
+//	      - model: gpt-4o-mini
+//	      - model: llama3.2
+//	        base_url: http://localhost:11434/v1
+//	  personal:
+//	    shell_prompt_model: gpt-4o-mini
+//	    embedding_backend: ollama
+//	request_limits:
+//	  autosuggest:
+//	    timeout: 2s
+//	  agent:
+//	    timeout: 2m
+//	    retries: 3
+//	retry_policy:
+//	  max_delay: 30s
+//	  statuses: [429, 503]
+//	middleware: [budget, redact, hooks, record, failover, tools, log, retry]
+//	theme: dracula
+//	prompt_prefix: ":"
+//	capitalized_commands: [Deploy]
+//	notify_command: notify-send Butterfish {message}
+//	hooks:
+//	  - event: pre_command
+//	    command: ~/bin/check-command
+//	token_store: keychain
+//	index_store: central
+//	context_windows:
+//	  llama3.2:3b: 4096
+//	models:
+//	  llava:
+//	    context_window: 4096
+//	    vision: true
+//	personas:
+//	  terse:
+//	    system_message: Answer in as few words as possible.
+//	    temperature: 0.2
+//	  teacher:
+//	    system_message: Explain your answers step by step for a beginner.
+//	    model: gpt-4o
+
+const DefaultProfileName = "default"
+
+// Features with their own request timeout and retry count
+const (
+	FeatureAutosuggest = "autosuggest"
+	FeaturePrompt      = "prompt"
+	FeatureGencmd      = "gencmd"
+	FeatureSummarize   = "summarize"
+	FeatureAgent       = "agent"
+)
+
+var Features = []string{FeatureAutosuggest, FeaturePrompt, FeatureGencmd, FeatureSummarize, FeatureAgent}
+
+// A hard timeout for a whole request and how many times to retry rate limits
+// and server errors
+type RequestLimits struct {
+	Timeout time.Duration
+	Retries int
+}
+
+// Autosuggest is useless once the user has typed on, so it gives up quickly
+// and never retries, while a goal mode step or a long summary is worth
+// waiting for
+func DefaultRequestLimits() map[string]RequestLimits {
+	return map[string]RequestLimits{
+		FeatureAutosuggest: {Timeout: 3 * time.Second, Retries: 0},
+		FeaturePrompt:      {Timeout: 2 * time.Minute, Retries: 2},
+		FeatureGencmd:      {Timeout: 30 * time.Second, Retries: 2},
+		FeatureSummarize:   {Timeout: 5 * time.Minute, Retries: 4},
+		FeatureAgent:       {Timeout: 90 * time.Second, Retries: 3},
+	}
+}
+
+// Request limits in the config file, unset fields keep the defaults
+type RequestLimitsOverride struct {
+	Timeout *time.Duration `yaml:"timeout,omitempty"`
+	Retries *int           `yaml:"retries,omitempty"`
+}
+
+type Profile struct {
+	Name string `yaml:"-"`
+
+	// API access, the token can be given directly or read from an env var
+	OpenAIToken    string `yaml:"openai_token,omitempty"`
+	OpenAITokenEnv string `yaml:"openai_token_env,omitempty"`
+	BaseURL        string `yaml:"base_url,omitempty"`
+
+	// Models, empty values leave the command line settings alone
+	ShellPromptModel string `yaml:"shell_prompt_model,omitempty"`
+	AutosuggestModel string `yaml:"autosuggest_model,omitempty"`
+	GencmdModel      string `yaml:"gencmd_model,omitempty"`
+	SummarizeModel   string `yaml:"summarize_model,omitempty"`
+
+	// Maximum number of (estimated) tokens to send and receive per calendar
+	// month under this profile, 0 means unlimited
+	TokenBudget int `yaml:"token_budget,omitempty"`
+
+	// Embeddings backend for the index commands, see EmbeddingBackends
+	EmbeddingBackend string `yaml:"embedding_backend,omitempty"`
+	EmbeddingModel   string `yaml:"embedding_model,omitempty"`
+	EmbeddingURL     string `yaml:"embedding_url,omitempty"`
+	EmbeddingCommand string `yaml:"embedding_command,omitempty"`
+
+	// Models to fail over to in order when a request to the primary fails,
+	// see failover.go
+	Fallbacks []*Fallback `yaml:"fallbacks,omitempty"`
+
+	// Policies
+	DisableAutosuggest    bool `yaml:"disable_autosuggest,omitempty"`
+	DisableUnsafeGoalMode bool `yaml:"disable_unsafe_goal_mode,omitempty"`
+}
+
+// A named system message with the model and temperature to use it with,
+// selected with --persona or "Persona <name>" in the shell, see persona.go
+type Persona struct {
+	Name string `yaml:"-"`
+
+	SystemMessage string `yaml:"system_message"`
+	// Empty values leave the current model and temperature alone
+	Model       string   `yaml:"model,omitempty"`
+	Temperature *float32 `yaml:"temperature,omitempty"`
+}
+
+type ConfigFile struct {
+	DefaultProfile string                            `yaml:"default_profile,omitempty"`
+	Profiles       map[string]*Profile               `yaml:"profiles,omitempty"`
+	RequestLimits  map[string]*RequestLimitsOverride `yaml:"request_limits,omitempty"`
+	RetryPolicy    *RetryPolicyOverride              `yaml:"retry_policy,omitempty"`
+	// Middlewares around the LLM from the outermost, see DefaultMiddleware
+	Middleware []string `yaml:"middleware,omitempty"`
+	// Context window sizes in tokens for models butterfish doesn't know, e.g.
+	// local models
+	ContextWindows map[string]int `yaml:"context_windows,omitempty"`
+	// Models to add to the model registry or fields to override, see
+	// models.go
+	Models map[string]*ModelEntry `yaml:"models,omitempty"`
+	// Patterns for secrets to redact before sending anything to the API, on
+	// top of the built-in ones
+	Redact *RedactConfig `yaml:"redact,omitempty"`
+	// Commands to keep out of the shell history, see
+	// DefaultShellExcludeCommands
+	ExcludeCommands []string `yaml:"exclude_commands,omitempty"`
+	// Turn system info providers on or off by name, see SystemInfoProviders
+	SystemInfo map[string]bool `yaml:"system_info,omitempty"`
+	// Chroma style for code blocks, overridden by --theme
+	Theme string `yaml:"theme,omitempty"`
+	// Same as setting NO_COLOR
+	NoColor bool `yaml:"no_color,omitempty"`
+	// Shell prompts start with this rather than a capital letter
+	PromptPrefix string `yaml:"prompt_prefix,omitempty"`
+	// Commands starting with a capital letter that aren't prompts, on top of
+	// the executables found on the PATH
+	CapitalizedCommands []string `yaml:"capitalized_commands,omitempty"`
+	// Command to run when a long answer or goal finishes in the shell, see
+	// Notifier
+	NotifyCommand string `yaml:"notify_command,omitempty"`
+	// Programs to run on events like sending a prompt, see hooks.go
+	Hooks []*Hook `yaml:"hooks,omitempty"`
+	// Where API tokens are saved, keychain or env, see tokenstore.go
+	TokenStore string `yaml:"token_store,omitempty"`
+	// Named system messages, see Persona
+	Personas map[string]*Persona `yaml:"personas,omitempty"`
+	// Where embedding indexes are kept, directory for .butterfish_index
+	// dotfiles or central for one store, see embedding/store.go
+	IndexStore string `yaml:"index_store,omitempty"`
+}
+
+// Load the config file at the given path, a missing file is not an error and
+// results in an empty config.
+func LoadConfigFile(path string) (*ConfigFile, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ConfigFile{}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = yaml.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse config file %s: %s", path, err)
+	}
+
+	for name, profile := range config.Profiles {
+		if profile == nil {
+			profile = &Profile{}
+			config.Profiles[name] = profile
+		}
+		profile.Name = name
+
+		for _, fallback := range profile.Fallbacks {
+			if fallback == nil || fallback.Model == "" {
+				return nil, fmt.Errorf("Fallback without a model in profile %s in %s", name, path)
+			}
+		}
+	}
+
+	for name, persona := range config.Personas {
+		if persona == nil || persona.SystemMessage == "" {
+			return nil, fmt.Errorf("Persona %s has no system_message in %s", name, path)
+		}
+		if strings.EqualFold(name, DefaultPersonaName) {
+			return nil, fmt.Errorf("Persona %s in %s, %s is reserved for going back to no persona", name, path, DefaultPersonaName)
+		}
+		if persona.Temperature != nil && (*persona.Temperature < 0 || *persona.Temperature > 2) {
+			return nil, fmt.Errorf("Persona %s has temperature %g in %s, expected a number between 0 and 2", name, *persona.Temperature, path)
+		}
+		persona.Name = name
+	}
+
+	for feature := range config.RequestLimits {
+		if _, ok := DefaultRequestLimits()[feature]; !ok {
+			return nil, fmt.Errorf("Unknown feature %s in request_limits in %s, expected one of %v", feature, path, Features)
+		}
+	}
+
+	if config.RetryPolicy != nil {
+		if err := config.RetryPolicy.Validate(); err != nil {
+			return nil, fmt.Errorf("Invalid retry_policy in %s: %s", path, err)
+		}
+	}
+
+	if err := ValidatePromptPrefix(config.PromptPrefix); err != nil {
+		return nil, fmt.Errorf("%s in %s", err, path)
+	}
+
+	if err := util.ValidateTheme(config.Theme); err != nil {
+		return nil, fmt.Errorf("%s in %s", err, path)
+	}
+
+	if config.Middleware != nil {
+		if err := ValidateMiddleware(config.Middleware); err != nil {
+			return nil, fmt.Errorf("%s in %s", err, path)
+		}
+	}
+
+	if err := ValidateTokenStore(config.TokenStore); err != nil {
+		return nil, fmt.Errorf("%s in %s", err, path)
+	}
+
+	if config.IndexStore != "" && config.IndexStore != embedding.IndexStoreDirectory &&
+		config.IndexStore != embedding.IndexStoreCentral {
+		return nil, fmt.Errorf("Unknown index_store %s in %s, expected one of %v", config.IndexStore, path, embedding.IndexStores)
+	}
+
+	for _, hook := range config.Hooks {
+		if hook == nil {
+			return nil, fmt.Errorf("Empty hook in %s", path)
+		}
+		if err := hook.Validate(); err != nil {
+			return nil, fmt.Errorf("%s in %s", err, path)
+		}
+	}
+
+	for model, entry := range config.Models {
+		if entry == nil {
+			return nil, fmt.Errorf("Empty entry for model %s in %s", model, path)
+		}
+		if err := entry.Validate(); err != nil {
+			return nil, fmt.Errorf("%s for model %s in %s", err, model, path)
+		}
+	}
+
+	for model, tokens := range config.ContextWindows {
+		if tokens <= 0 {
+			return nil, fmt.Errorf("Context window for %s in %s must be a positive number of tokens", model, path)
+		}
+	}
+
+	if config.Redact != nil {
+		for _, pattern := range config.Redact.Patterns {
+			if pattern == nil {
+				return nil, fmt.Errorf("Empty redact pattern in %s", path)
+			}
+			if err := pattern.compile(); err != nil {
+				return nil, fmt.Errorf("%s in %s", err, path)
+			}
+		}
+	}
+
+	for name := range config.SystemInfo {
+		if findSystemInfoProvider(name) == nil {
+			return nil, fmt.Errorf("Unknown provider %s in system_info in %s, expected one of %v", name, path, SystemInfoProviderNames())
+		}
+	}
+
+	return config, nil
+}
+
+// Find a profile by name. An empty name falls back to default_profile, and
+// if that isn't set either we return an empty default profile.
+func (this *ConfigFile) GetProfile(name string) (*Profile, error) {
+	if name == "" {
+		name = this.DefaultProfile
+	}
+	if name == "" || (name == DefaultProfileName && this.Profiles[name] == nil) {
+		return &Profile{Name: DefaultProfileName}, nil
+	}
+
+	profile, ok := this.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown profile %s, available profiles: %v", name, this.ProfileNames())
+	}
+	return profile, nil
+}
+
+// The persona with the given name, an empty name is no persona
+func (this *ConfigFile) GetPersona(name string) (*Persona, error) {
+	if name == "" {
+		return nil, nil
+	}
+	persona, ok := this.Personas[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown persona %s, available personas: %v", name, this.PersonaNames())
+	}
+	return persona, nil
+}
+
+func (this *ConfigFile) PersonaNames() []string {
+	names := []string{}
+	for name := range this.Personas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (this *ConfigFile) ProfileNames() []string {
+	names := []string{}
+	for name := range this.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Resolve the API token for this profile, returns an empty string if the
+// profile doesn't specify one.
+func (this *Profile) Token() string {
+	if this.OpenAIToken != "" {
+		return this.OpenAIToken
+	}
+	if this.OpenAITokenEnv != "" {
+		return os.Getenv(this.OpenAITokenEnv)
+	}
+	return ""
+}
+
+// The directory where we keep state for a profile (usage tracking, session
+// files), profiles never share a directory.
+func ProfileStateDir(baseDir, profileName string) string {
+	if profileName == "" {
+		profileName = DefaultProfileName
+	}
+	return filepath.Join(baseDir, "profiles", profileName)
+}
+
+// Overlay profile settings onto a config, empty profile fields are ignored so
+// that command line settings still apply. The first call records the
+// pre-profile settings so that switching profiles later starts from a clean
+// slate rather than inheriting the previous profile's keys and models.
+func (this *ButterfishConfig) ApplyProfile(profile *Profile) {
+	if this.profileBase == nil {
+		this.profileBase = &Profile{
+			OpenAIToken:        this.OpenAIToken,
+			BaseURL:            this.BaseURL,
+			ShellPromptModel:   this.ShellPromptModel,
+			AutosuggestModel:   this.ShellAutosuggestModel,
+			GencmdModel:        this.GencmdModel,
+			SummarizeModel:     this.SummarizeModel,
+			EmbeddingBackend:   this.EmbeddingBackend,
+			EmbeddingModel:     this.EmbeddingModel,
+			EmbeddingURL:       this.EmbeddingURL,
+			EmbeddingCommand:   this.EmbeddingCommand,
+			DisableAutosuggest: !this.ShellAutosuggestEnabled,
+		}
+	}
+
+	base := this.profileBase
+	this.OpenAIToken = base.OpenAIToken
+	this.BaseURL = base.BaseURL
+	this.ShellPromptModel = base.ShellPromptModel
+	this.ShellAutosuggestModel = base.AutosuggestModel
+	this.GencmdModel = base.GencmdModel
+	this.SummarizeModel = base.SummarizeModel
+	this.EmbeddingBackend = base.EmbeddingBackend
+	this.EmbeddingModel = base.EmbeddingModel
+	this.EmbeddingURL = base.EmbeddingURL
+	this.EmbeddingCommand = base.EmbeddingCommand
+	this.ShellAutosuggestEnabled = !base.DisableAutosuggest
+
+	this.Profile = profile
+
+	if token := profile.Token(); token != "" {
+		this.OpenAIToken = token
+	}
+	if profile.BaseURL != "" {
+		this.BaseURL = profile.BaseURL
+	}
+	if profile.ShellPromptModel != "" {
+		this.ShellPromptModel = profile.ShellPromptModel
+	}
+	if profile.AutosuggestModel != "" {
+		this.ShellAutosuggestModel = profile.AutosuggestModel
+	}
+	if profile.GencmdModel != "" {
+		this.GencmdModel = profile.GencmdModel
+	}
+	if profile.SummarizeModel != "" {
+		this.SummarizeModel = profile.SummarizeModel
+	}
+	// unlike the other settings, --embedding-backend wins over the profile
+	if profile.EmbeddingBackend != "" && base.EmbeddingBackend == "" {
+		this.EmbeddingBackend = profile.EmbeddingBackend
+	}
+	if profile.EmbeddingModel != "" {
+		this.EmbeddingModel = profile.EmbeddingModel
+	}
+	if profile.EmbeddingURL != "" {
+		this.EmbeddingURL = profile.EmbeddingURL
+	}
+	if profile.EmbeddingCommand != "" {
+		this.EmbeddingCommand = profile.EmbeddingCommand
+	}
+	if profile.DisableAutosuggest {
+		this.ShellAutosuggestEnabled = false
+	}
+
+	if this.StateBaseDir != "" {
+		this.StateDir = ProfileStateDir(this.StateBaseDir, profile.Name)
+	}
+}
+
+func (this *ButterfishConfig) ProfileName() string {
+	if this.Profile == nil {
+		return DefaultProfileName
+	}
+	return this.Profile.Name
+}
+
+// Switch the running context to a different profile from the config file,
+// this rebuilds the LLM client so that keys and base URLs take effect, and
+// points usage tracking at the new profile's state directory.
+func (this *ButterfishCtx) SwitchProfile(name string) error {
+	if this.Config.ConfigFile == nil {
+		return errors.New("No config file loaded, profiles are defined in config.yaml")
+	}
+
+	profile, err := this.Config.ConfigFile.GetProfile(name)
+	if err != nil {
+		return err
+	}
+
+	this.Config.ApplyProfile(profile)
+	if this.Config.OpenAIToken == "" {
+		return fmt.Errorf("Profile %s has no API token", profile.Name)
+	}
+
+	llmClient, err := initLLM(this.Config)
+	if err != nil {
+		return err
+	}
+	this.LLMClient = llmClient
+	this.LoadModelMetadata()
+	return nil
+}
+
+// Apply request limits from the config file over the defaults
+func (this *ButterfishConfig) ApplyRequestLimits(overrides map[string]*RequestLimitsOverride) {
+	for feature, override := range overrides {
+		if override == nil {
+			continue
+		}
+		limits := this.RequestLimits[feature]
+		if override.Timeout != nil {
+			limits.Timeout = *override.Timeout
+		}
+		if override.Retries != nil {
+			limits.Retries = *override.Retries
+		}
+		this.RequestLimits[feature] = limits
+	}
+}
+
+// Set a feature's timeout and retries on a request
+func (this *ButterfishConfig) LimitRequest(feature string, request *util.CompletionRequest) *util.CompletionRequest {
+	limits := this.RequestLimits[feature]
+	request.Timeout = limits.Timeout
+	request.Retries = limits.Retries
+	return request
+}
@@ -0,0 +1,240 @@
+package butterfish
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func TestLoadConfigFileProfiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	content := `default_profile: personal
+profiles:
+  work:
+    openai_token: sk-work
+    shell_prompt_model: gpt-4o
+    token_budget: 1000
+  personal:
+    shell_prompt_model: gpt-4o-mini
+`
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+
+	config, err := LoadConfigFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"personal", "work"}, config.ProfileNames())
+
+	profile, err := config.GetProfile("")
+	assert.Nil(t, err)
+	assert.Equal(t, "personal", profile.Name)
+
+	profile, err = config.GetProfile("work")
+	assert.Nil(t, err)
+	assert.Equal(t, "sk-work", profile.Token())
+	assert.Equal(t, 1000, profile.TokenBudget)
+
+	_, err = config.GetProfile("nope")
+	assert.NotNil(t, err)
+
+	// missing file is an empty config
+	config, err = LoadConfigFile(filepath.Join(dir, "missing.yaml"))
+	assert.Nil(t, err)
+	profile, err = config.GetProfile("")
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultProfileName, profile.Name)
+}
+
+func TestRequestLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := `request_limits:
+  autosuggest:
+    timeout: 1500ms
+  agent:
+    retries: 5
+`
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+
+	configFile, err := LoadConfigFile(path)
+	assert.Nil(t, err)
+
+	config := MakeButterfishConfig()
+	config.ApplyRequestLimits(configFile.RequestLimits)
+
+	request := config.LimitRequest(FeatureAutosuggest, &util.CompletionRequest{})
+	assert.Equal(t, 1500*time.Millisecond, request.Timeout)
+	assert.Equal(t, 0, request.Retries)
+
+	// unset fields keep their defaults
+	request = config.LimitRequest(FeatureAgent, &util.CompletionRequest{})
+	assert.Equal(t, DefaultRequestLimits()[FeatureAgent].Timeout, request.Timeout)
+	assert.Equal(t, 5, request.Retries)
+
+	assert.Nil(t, os.WriteFile(path, []byte("request_limits:\n  autosugest:\n    retries: 1\n"), 0644))
+	_, err = LoadConfigFile(path)
+	assert.NotNil(t, err)
+}
+
+func TestThemeAndNoColor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte("theme: dracula\nno_color: true\n"), 0644))
+	configFile, err := LoadConfigFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "dracula", configFile.Theme)
+	assert.True(t, configFile.NoColor)
+
+	assert.Nil(t, os.WriteFile(path, []byte("theme: dracul\n"), 0644))
+	_, err = LoadConfigFile(path)
+	assert.ErrorContains(t, err, "Unknown theme dracul")
+
+	config := MakeButterfishConfig()
+	assert.Equal(t, "monokailight", config.CodeTheme())
+	config.ColorDark = true
+	assert.Equal(t, "monokai", config.CodeTheme())
+	config.Theme = "dracula"
+	assert.Equal(t, "dracula", config.CodeTheme())
+
+	defer func() { loggingBoxColors = true }()
+	config.DisableColor()
+	assert.Equal(t, util.NoHighlightTheme, config.CodeTheme())
+	assert.Equal(t, "Error", config.Styles.Error.Render("Error"))
+
+	out := new(bytes.Buffer)
+	printLoggingBox(LoggingBox{Title: "Prompt", Content: "hi", Color: 1}, out, 0, []string{})
+	assert.NotContains(t, out.String(), "\033[")
+}
+
+func TestApplyProfileResets(t *testing.T) {
+	config := MakeButterfishConfig()
+	config.OpenAIToken = "sk-base"
+	config.ShellPromptModel = "gpt-4o"
+	config.ShellAutosuggestEnabled = true
+	config.StateBaseDir = "/tmp/bf"
+
+	config.ApplyProfile(&Profile{
+		Name:               "work",
+		OpenAIToken:        "sk-work",
+		ShellPromptModel:   "gpt-4-turbo",
+		DisableAutosuggest: true,
+	})
+	assert.Equal(t, "sk-work", config.OpenAIToken)
+	assert.Equal(t, "gpt-4-turbo", config.ShellPromptModel)
+	assert.False(t, config.ShellAutosuggestEnabled)
+	assert.Equal(t, "/tmp/bf/profiles/work", config.StateDir)
+
+	config.ApplyProfile(&Profile{Name: "personal"})
+	assert.Equal(t, "sk-base", config.OpenAIToken)
+	assert.Equal(t, "gpt-4o", config.ShellPromptModel)
+	assert.True(t, config.ShellAutosuggestEnabled)
+	assert.Equal(t, "personal", config.ProfileName())
+}
+
+func TestEmbeddingBackendPrecedence(t *testing.T) {
+	profile := &Profile{Name: "local", EmbeddingBackend: EmbeddingBackendOllama}
+
+	config := MakeButterfishConfig()
+	assert.True(t, config.EmbeddingNeedsToken())
+	config.ApplyProfile(profile)
+	assert.Equal(t, EmbeddingBackendOllama, config.EmbeddingBackend)
+	config.ApplyProfile(&Profile{Name: "work"})
+	assert.Equal(t, "", config.EmbeddingBackend)
+
+	// --embedding-backend wins over the profile
+	config = MakeButterfishConfig()
+	config.EmbeddingBackend = EmbeddingBackendOpenAI
+	config.ApplyProfile(profile)
+	assert.Equal(t, EmbeddingBackendOpenAI, config.EmbeddingBackend)
+}
+
+func TestSwitchProfileWithoutToken(t *testing.T) {
+	// the starting profile carries its own token and there's no default one
+	config := MakeButterfishConfig()
+	config.ConfigFile = &ConfigFile{
+		Profiles: map[string]*Profile{
+			"work":     {Name: "work", OpenAIToken: "sk-work"},
+			"personal": {Name: "personal"},
+		},
+	}
+	config.ApplyProfile(config.ConfigFile.Profiles["work"])
+	assert.Equal(t, "sk-work", config.OpenAIToken)
+
+	butterfish := &ButterfishCtx{Config: config}
+	err := butterfish.SwitchProfile("personal")
+	assert.ErrorContains(t, err, "Profile personal has no API token")
+	assert.Equal(t, "", config.OpenAIToken)
+}
+
+func TestUsageTrackingBudget(t *testing.T) {
+	tracker := NewUsageTracker(t.TempDir())
+	tracker.Record("gpt-4o", 600, 500, nil)
+
+	usage := tracker.CurrentMonth()
+	assert.Equal(t, 1, usage.Requests)
+	assert.Equal(t, 1100, usage.Total())
+
+	// reload from disk
+	reloaded := NewUsageTracker(filepath.Dir(tracker.Path))
+	usage = reloaded.CurrentMonth()
+	assert.Equal(t, 1100, usage.Total())
+
+	llm := NewUsageTrackingLLM(nil, tracker, "work", 1000)
+	assert.NotNil(t, llm.checkBudget())
+	llm.Budget = 0
+	assert.Nil(t, llm.checkBudget())
+}
+
+func TestUsageTrackingLatency(t *testing.T) {
+	tracker := NewUsageTracker(t.TempDir())
+	tracker.Record("gpt-4o", 10, 10, &util.CompletionMetrics{
+		TimeToFirstToken: 200 * time.Millisecond,
+		Duration:         1200 * time.Millisecond,
+		Tokens:           50,
+	})
+	tracker.Record("gpt-4o", 10, 10, &util.CompletionMetrics{
+		Duration: 600 * time.Millisecond,
+		Tokens:   10,
+	})
+
+	latency := tracker.CurrentMonthModels()["gpt-4o"].Latency
+	assert.Equal(t, 2, latency.Requests)
+	assert.Equal(t, 1, latency.Streamed)
+	assert.Equal(t, "avg 900ms, 200ms to first token, 37.5 tokens/s", latency.String())
+	assert.Equal(t, int64(200), latency.MaxFirstTokenMs)
+}
+
+func TestUsageTrackingSession(t *testing.T) {
+	dir := t.TempDir()
+	NewUsageTracker(dir).Record("gpt-4o", 10, 10, nil)
+
+	// only requests from this process count towards the session
+	tracker := NewUsageTracker(dir)
+	assert.Equal(t, "No requests yet this session\n", sessionStatsText(tracker.SessionModels(), time.Second))
+
+	tracker.Record("gpt-4o", 100, 20, &util.CompletionMetrics{
+		TimeToFirstToken: 300 * time.Millisecond,
+		Duration:         1300 * time.Millisecond,
+		Tokens:           20,
+		Retries:          1,
+	})
+	tracker.Record("gpt-4o", 100, 20, &util.CompletionMetrics{
+		TimeToFirstToken: 900 * time.Millisecond,
+		Duration:         1900 * time.Millisecond,
+		Tokens:           20,
+	})
+	assert.Equal(t, 3, tracker.CurrentMonth().Requests)
+
+	assert.Equal(t, `Requests this session:
+
+gpt-4o
+  Requests:            2
+  Tokens:              ~200 prompt, ~40 completion
+  Latency:             avg 1.6s, 600ms to first token, 20.0 tokens/s
+  Slowest first token: 900ms, token timeout is 10s
+  Retries:             1
+`, sessionStatsText(tracker.SessionModels(), 10*time.Second))
+}
@@ -0,0 +1,409 @@
+package butterfish
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	"github.com/bakks/butterfish/proto"
+)
+
+// Console mode, started with `butterfish console`, reads Butterfish commands
+// from stdin and also runs a gRPC server that terminals started with
+// `butterfish wrap <command>` connect to. A wrapped terminal streams its
+// output to the console, so that you can see what's happening in it, and runs
+// commands the console sends with execremote, so that e.g. a command from
+// gencmd can be run and debugged on another machine.
+//
+// This uses the Ibodai service from proto/ibodai.proto:
+//
+//   - The client opens a stream and sends HELLO with a description of the
+//     terminal in data, and "<nonce>:<proof>" in client_token, where the
+//     proof is consoleTokenProof(token, "wrap", nonce). The token itself is
+//     never sent.
+//   - The console checks the proof and answers with a Command without an ID
+//     whose command is consoleTokenProof(token, "console", nonce). The client
+//     doesn't run anything until it has checked this, so that whatever is
+//     listening on the port has to know the token to run commands.
+//   - The client sends the wrapped terminal's output as OUTPUT messages
+//     without a command_id.
+//   - The console sends a Command, the client runs it and sends its output as
+//     OUTPUT messages with that command_id, then DONE with the exit code.
+
+// How much recent output we keep for each terminal
+const consoleOutputBufferSize = 64 * 1024
+
+type ConsoleOptions struct {
+	Addr string
+	// Token wrapped terminals must know, a random one is generated and
+	// printed if it's empty
+	Token string
+	// Serve TLS with this certificate and key, needed to listen on anything
+	// other than a loopback address
+	TLSCert string
+	TLSKey  string
+}
+
+// Shows that one side of a console connection knows the token without
+// sending it, role is "wrap" or "console" so that neither proof can be
+// replayed as the other
+func consoleTokenProof(token, role, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(role + ":" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newConsoleNonce() (string, error) {
+	return randomHex(16)
+}
+
+// A token for a console started without one
+func newConsoleToken() (string, error) {
+	return randomHex(32)
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Whether addr, e.g. 127.0.0.1:7642, only reaches this machine. An empty host
+// listens on every interface, so it doesn't count.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+type WrappedTerminal struct {
+	ID          int
+	Description string
+	Connected   time.Time
+
+	stream    proto.Ibodai_StreamServer
+	sendMutex sync.Mutex
+	// closed when the terminal disconnects
+	closed chan struct{}
+
+	mutex         sync.Mutex
+	output        []byte
+	commands      map[string]*remoteCommand
+	nextCommandID atomic.Int64
+}
+
+type remoteCommand struct {
+	messages chan *proto.ClientMessage
+	// closed when nobody is waiting for messages anymore
+	done chan struct{}
+}
+
+type ConsoleServer struct {
+	proto.UnimplementedIbodaiServer
+
+	// Token wrapped terminals must prove they know, terminals are refused
+	// if it's empty
+	Token string
+	// Where to announce terminals connecting and disconnecting
+	Out io.Writer
+
+	mutex     sync.Mutex
+	terminals []*WrappedTerminal
+	nextID    int
+}
+
+func NewConsoleServer(token string, out io.Writer) *ConsoleServer {
+	return &ConsoleServer{
+		Token:  token,
+		Out:    out,
+		nextID: 1,
+	}
+}
+
+func (this *ConsoleServer) Stream(stream proto.Ibodai_StreamServer) error {
+	hello, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if hello.GetType() != proto.ClientMessageType_HELLO {
+		return status.Error(codes.InvalidArgument, "Expected HELLO as the first message")
+	}
+	nonce, proof, _ := strings.Cut(hello.GetClientToken(), ":")
+	if nonce == "" {
+		return status.Error(codes.InvalidArgument, "Expected a nonce in HELLO")
+	}
+	if this.Token == "" {
+		return status.Error(codes.Unauthenticated, "The console has no token")
+	}
+	if !hmac.Equal([]byte(proof), []byte(consoleTokenProof(this.Token, "wrap", nonce))) {
+		return status.Error(codes.Unauthenticated, "Invalid console token")
+	}
+	err = stream.Send(&proto.Command{Command: consoleTokenProof(this.Token, "console", nonce)})
+	if err != nil {
+		return err
+	}
+
+	terminal := this.addTerminal(string(hello.GetData()), stream)
+	fmt.Fprintf(this.Out, "Terminal %d connected: %s\n", terminal.ID, terminal.Description)
+	defer func() {
+		this.removeTerminal(terminal)
+		fmt.Fprintf(this.Out, "Terminal %d disconnected\n", terminal.ID)
+	}()
+
+	for {
+		message, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		terminal.receive(message)
+	}
+}
+
+func (this *ConsoleServer) addTerminal(description string, stream proto.Ibodai_StreamServer) *WrappedTerminal {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	terminal := &WrappedTerminal{
+		ID:          this.nextID,
+		Description: description,
+		Connected:   time.Now(),
+		stream:      stream,
+		closed:      make(chan struct{}),
+		commands:    map[string]*remoteCommand{},
+	}
+	this.nextID++
+	this.terminals = append(this.terminals, terminal)
+	return terminal
+}
+
+func (this *ConsoleServer) removeTerminal(terminal *WrappedTerminal) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for i, t := range this.terminals {
+		if t == terminal {
+			this.terminals = append(this.terminals[:i], this.terminals[i+1:]...)
+			break
+		}
+	}
+	close(terminal.closed)
+}
+
+// Connected terminals, oldest first
+func (this *ConsoleServer) Terminals() []*WrappedTerminal {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return append([]*WrappedTerminal{}, this.terminals...)
+}
+
+// Find a terminal by ID, or the most recently connected one if id is empty
+func (this *ConsoleServer) Terminal(id string) (*WrappedTerminal, error) {
+	terminals := this.Terminals()
+	if len(terminals) == 0 {
+		return nil, errors.New("No terminals are connected, start one with butterfish wrap <command>")
+	}
+	if id == "" {
+		return terminals[len(terminals)-1], nil
+	}
+
+	for _, terminal := range terminals {
+		if strconv.Itoa(terminal.ID) == id {
+			return terminal, nil
+		}
+	}
+	return nil, fmt.Errorf("No terminal with ID %s", id)
+}
+
+func (this *WrappedTerminal) receive(message *proto.ClientMessage) {
+	this.mutex.Lock()
+	if message.GetCommandId() == "" {
+		if message.GetType() == proto.ClientMessageType_OUTPUT {
+			this.output = append(this.output, message.GetData()...)
+			if len(this.output) > consoleOutputBufferSize {
+				this.output = this.output[len(this.output)-consoleOutputBufferSize:]
+			}
+		}
+		this.mutex.Unlock()
+		return
+	}
+	command := this.commands[message.GetCommandId()]
+	this.mutex.Unlock()
+
+	if command == nil {
+		return
+	}
+	select {
+	case command.messages <- message:
+	case <-command.done:
+	}
+}
+
+// Recent output of the wrapped terminal with escape sequences removed
+func (this *WrappedTerminal) RecentOutput() string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return sanitizeTTYString(string(this.output))
+}
+
+// Run a command in the wrapped terminal's directory, streaming its output to
+// out
+func (this *WrappedTerminal) Exec(ctx context.Context, cmd string, out io.Writer) (*executeResult, error) {
+	id := strconv.FormatInt(this.nextCommandID.Add(1), 10)
+	command := &remoteCommand{
+		messages: make(chan *proto.ClientMessage, 16),
+		done:     make(chan struct{}),
+	}
+	this.mutex.Lock()
+	this.commands[id] = command
+	this.mutex.Unlock()
+
+	defer func() {
+		this.mutex.Lock()
+		delete(this.commands, id)
+		this.mutex.Unlock()
+		close(command.done)
+	}()
+
+	this.sendMutex.Lock()
+	err := this.stream.Send(&proto.Command{Id: id, Command: cmd})
+	this.sendMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	output := []byte{}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+
+		case <-this.closed:
+			return nil, fmt.Errorf("Terminal %d disconnected", this.ID)
+
+		case message := <-command.messages:
+			switch message.GetType() {
+			case proto.ClientMessageType_OUTPUT:
+				output = append(output, message.GetData()...)
+				out.Write(message.GetData())
+			case proto.ClientMessageType_DONE:
+				return &executeResult{LastOutput: output, Status: int(message.GetExitCode())}, nil
+			}
+		}
+	}
+}
+
+// Print the connected terminals, with the last line of output of each, or
+// all recent output if full is set
+func (this *ConsoleServer) PrintTerminals(out io.Writer, full bool) {
+	terminals := this.Terminals()
+	if len(terminals) == 0 {
+		fmt.Fprintf(out, "No terminals are connected, start one with butterfish wrap <command>\n")
+		return
+	}
+
+	for _, terminal := range terminals {
+		fmt.Fprintf(out, "%d  %s  (connected %s)\n", terminal.ID, terminal.Description,
+			terminal.Connected.Format(time.Kitchen))
+		output := strings.TrimRight(terminal.RecentOutput(), "\n ")
+		if output == "" {
+			continue
+		}
+		if !full {
+			output = output[strings.LastIndex(output, "\n")+1:]
+		}
+		for _, line := range strings.Split(output, "\n") {
+			fmt.Fprintf(out, "   | %s\n", line)
+		}
+	}
+}
+
+// Run the console, serving wrapped terminals on options.Addr and executing
+// commands read from in until exit, EOF, or the context is cancelled
+func (this *ButterfishCtx) RunConsole(options *ConsoleOptions, in io.Reader) error {
+	serverOptions := []grpc.ServerOption{}
+	if options.TLSCert != "" || options.TLSKey != "" {
+		creds, err := credentials.NewServerTLSFromFile(options.TLSCert, options.TLSKey)
+		if err != nil {
+			return fmt.Errorf("Unable to load TLS certificate: %s", err)
+		}
+		serverOptions = append(serverOptions, grpc.Creds(creds))
+	} else if !isLoopbackAddr(options.Addr) {
+		return fmt.Errorf("Listening on %s needs TLS, set --tls-cert and --tls-key, or listen on localhost and use an SSH tunnel", options.Addr)
+	}
+
+	token := options.Token
+	if token == "" {
+		var err error
+		token, err = newConsoleToken()
+		if err != nil {
+			return err
+		}
+	}
+
+	listener, err := net.Listen("tcp", options.Addr)
+	if err != nil {
+		return err
+	}
+
+	this.Console = NewConsoleServer(token, this.Out)
+	this.InConsoleMode = true
+	server := grpc.NewServer(serverOptions...)
+	proto.RegisterIbodaiServer(server, this.Console)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	this.Printf("Butterfish console, listening for wrapped terminals on %s\n", listener.Addr())
+	if options.Token == "" {
+		this.Printf("Wrapped terminals need this token, e.g. BUTTERFISH_CONSOLE_TOKEN=%s butterfish wrap bash\n", token)
+	}
+	this.Printf("Run butterfish wrap <command> in another terminal, then terminals and execremote here. Type help for commands.\n")
+
+	scanner := bufio.NewScanner(in)
+	for this.Ctx.Err() == nil {
+		this.StylePrintf(this.Config.Styles.Question, "> ")
+		if !scanner.Scan() {
+			break
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		err := this.Command(line)
+		if err != nil {
+			this.printError(err)
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,207 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/bakks/butterfish/proto"
+)
+
+func startTestConsole(t *testing.T, token string) (*ConsoleServer, func() proto.IbodaiClient) {
+	listener := bufconn.Listen(1024 * 1024)
+	console := NewConsoleServer(token, new(bytes.Buffer))
+	server := grpc.NewServer()
+	proto.RegisterIbodaiServer(server, console)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	dial := func() proto.IbodaiClient {
+		conn, err := grpc.NewClient("passthrough:///bufconn",
+			grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+				return listener.Dial()
+			}),
+			grpc.WithTransportCredentials(insecure.NewCredentials()))
+		assert.Nil(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return proto.NewIbodaiClient(conn)
+	}
+	return console, dial
+}
+
+func waitForTerminals(console *ConsoleServer, n int) bool {
+	for i := 0; i < 100; i++ {
+		if len(console.Terminals()) == n {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestConsoleExecRemote(t *testing.T) {
+	console, dial := startTestConsole(t, "secret")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := dial().Stream(ctx)
+	assert.Nil(t, err)
+	dir := t.TempDir()
+	local := new(bytes.Buffer)
+	client := &wrapClient{stream: stream, local: local, dir: func() string { return dir }}
+	assert.Nil(t, client.hello("secret", "host: bash"))
+	go client.handleCommands(ctx)
+
+	assert.True(t, waitForTerminals(console, 1))
+	terminal, err := console.Terminal("")
+	assert.Nil(t, err)
+	assert.Equal(t, "host: bash", terminal.Description)
+	_, err = console.Terminal("7")
+	assert.NotNil(t, err)
+
+	// the terminal's own output is kept so the console can see it
+	client.outputWriter("").Write([]byte("\x1b[32m$\x1b[0m make\r\nok\r\n"))
+
+	out := new(bytes.Buffer)
+	result, err := terminal.Exec(ctx, "pwd; echo oops; exit 3", out)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, result.Status)
+	assert.Equal(t, dir+"\noops\n", out.String())
+	assert.Equal(t, out.String(), string(result.LastOutput))
+	assert.Contains(t, local.String(), "[butterfish console] pwd; echo oops; exit 3\n"+dir)
+
+	assert.Equal(t, "$ make\nok\n", terminal.RecentOutput())
+	listing := new(bytes.Buffer)
+	console.PrintTerminals(listing, false)
+	assert.Contains(t, listing.String(), "1  host: bash")
+	assert.Contains(t, listing.String(), "   | ok\n")
+	assert.NotContains(t, listing.String(), "make")
+
+	// commands fail rather than hang once the terminal goes away
+	stream.CloseSend()
+	assert.True(t, waitForTerminals(console, 0))
+	_, err = terminal.Exec(ctx, "true", out)
+	assert.NotNil(t, err)
+}
+
+func TestConsoleToken(t *testing.T) {
+	console, dial := startTestConsole(t, "secret")
+
+	stream, err := dial().Stream(context.Background())
+	assert.Nil(t, err)
+	client := &wrapClient{stream: stream}
+	assert.Nil(t, client.hello("wrong", "host: bash"))
+	_, err = stream.Recv()
+	assert.True(t, strings.Contains(err.Error(), "Invalid console token"))
+	assert.Equal(t, 0, len(console.Terminals()))
+}
+
+// Answers HELLO with a proof made without the token, like something else
+// listening on the console's port
+type fakeConsole struct {
+	proto.UnimplementedIbodaiServer
+}
+
+func (this *fakeConsole) Stream(stream proto.Ibodai_StreamServer) error {
+	hello, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	nonce, _, _ := strings.Cut(hello.GetClientToken(), ":")
+	err = stream.Send(&proto.Command{Command: consoleTokenProof("", "console", nonce)})
+	if err != nil {
+		return err
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+func TestWrapChecksConsole(t *testing.T) {
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	proto.RegisterIbodaiServer(server, &fakeConsole{})
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return listener.Dial()
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Nil(t, err)
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := proto.NewIbodaiClient(conn).Stream(ctx)
+	assert.Nil(t, err)
+	client := &wrapClient{stream: stream, local: new(bytes.Buffer), dir: t.TempDir}
+	assert.Nil(t, client.hello("secret", "host: bash"))
+	err = client.handleCommands(ctx)
+	assert.ErrorContains(t, err, "doesn't know the token")
+}
+
+func TestConsoleRequiresToken(t *testing.T) {
+	// an empty token is an HMAC key anyone can use, so it's never accepted
+	console, dial := startTestConsole(t, "")
+	stream, err := dial().Stream(context.Background())
+	assert.Nil(t, err)
+	client := &wrapClient{stream: stream}
+	assert.Nil(t, client.hello("", "host: bash"))
+	_, err = stream.Recv()
+	assert.ErrorContains(t, err, "no token")
+	assert.Equal(t, 0, len(console.Terminals()))
+
+	err = RunWrap(context.Background(), &WrapOptions{Addr: "127.0.0.1:7642"}, []string{"bash"})
+	assert.ErrorContains(t, err, "No console token")
+
+	// the console makes one up and prints it
+	out := new(bytes.Buffer)
+	butterfish := &ButterfishCtx{Ctx: context.Background(), Config: MakeButterfishConfig(), Out: out}
+	err = butterfish.RunConsole(&ConsoleOptions{Addr: "127.0.0.1:0"}, strings.NewReader(""))
+	assert.Nil(t, err)
+	assert.Equal(t, 64, len(butterfish.Console.Token))
+	assert.Contains(t, out.String(), "BUTTERFISH_CONSOLE_TOKEN="+butterfish.Console.Token)
+}
+
+func TestConsoleNeedsTLS(t *testing.T) {
+	assert.True(t, isLoopbackAddr("127.0.0.1:7642"))
+	assert.True(t, isLoopbackAddr("localhost:7642"))
+	assert.True(t, isLoopbackAddr("[::1]:7642"))
+	assert.False(t, isLoopbackAddr(":7642"))
+	assert.False(t, isLoopbackAddr("10.0.0.2:7642"))
+
+	_, err := wrapCredentials(&WrapOptions{Addr: "10.0.0.2:7642"})
+	assert.ErrorContains(t, err, "needs TLS")
+	_, err = wrapCredentials(&WrapOptions{Addr: "10.0.0.2:7642", TLS: true})
+	assert.Nil(t, err)
+
+	butterfish := &ButterfishCtx{Ctx: context.Background(), Config: MakeButterfishConfig(), Out: new(bytes.Buffer)}
+	err = butterfish.RunConsole(&ConsoleOptions{Addr: "0.0.0.0:0"}, strings.NewReader(""))
+	assert.ErrorContains(t, err, "needs TLS")
+}
+
+func TestConsoleCommands(t *testing.T) {
+	out := new(bytes.Buffer)
+	butterfish := &ButterfishCtx{
+		Ctx:    context.Background(),
+		Config: MakeButterfishConfig(),
+		Out:    out,
+	}
+
+	err := butterfish.Command("execremote ls")
+	assert.ErrorContains(t, err, "Console Mode")
+
+	butterfish.Console = NewConsoleServer("", out)
+	assert.ErrorContains(t, butterfish.Command("execremote ls"), "No terminals are connected")
+	assert.Nil(t, butterfish.Command("terminals"))
+	assert.Contains(t, out.String(), "No terminals are connected")
+}
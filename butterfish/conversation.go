@@ -0,0 +1,104 @@
+package butterfish
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// CLI conversations, `butterfish prompt -c` continues from the previous
+// prompt call by sending earlier turns as history. Turns are kept per profile
+// in <state dir>/conversation.json. A prompt without -c starts a new
+// conversation, and `--new` clears it.
+
+const conversationFileName = "conversation.json"
+
+type ConversationTurn struct {
+	Prompt   string `json:"prompt"`
+	Response string `json:"response"`
+}
+
+type Conversation struct {
+	Path  string             `json:"-"`
+	Turns []ConversationTurn `json:"turns"`
+}
+
+// Load the conversation from the state dir, a missing file is an empty
+// conversation.
+func LoadConversation(stateDir string) (*Conversation, error) {
+	conversation := &Conversation{
+		Path: filepath.Join(stateDir, conversationFileName),
+	}
+
+	data, err := os.ReadFile(conversation.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return conversation, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, conversation)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse conversation file %s: %s", conversation.Path, err)
+	}
+	return conversation, nil
+}
+
+func (this *Conversation) Append(prompt, response string) {
+	this.Turns = append(this.Turns, ConversationTurn{
+		Prompt:   prompt,
+		Response: response,
+	})
+}
+
+func (this *Conversation) Clear() error {
+	this.Turns = nil
+	err := os.Remove(this.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (this *Conversation) Save() error {
+	data, err := json.MarshalIndent(this, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(this.Path), 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(this.Path, data, 0644)
+}
+
+// Previous turns as history for the next completion request, keeping the
+// most recent whole turns that fit in maxTokens
+func (this *Conversation) HistoryBlocks(maxTokens int) []util.HistoryBlock {
+	first := len(this.Turns)
+	usedTokens := 0
+	for first > 0 {
+		turn := this.Turns[first-1]
+		turnTokens := estimateTokens(turn.Prompt) + estimateTokens(turn.Response)
+		if usedTokens+turnTokens > maxTokens {
+			break
+		}
+		usedTokens += turnTokens
+		first--
+	}
+
+	blocks := []util.HistoryBlock{}
+	for _, turn := range this.Turns[first:] {
+		blocks = append(blocks,
+			util.HistoryBlock{Type: historyTypePrompt, Content: turn.Prompt},
+			util.HistoryBlock{Type: historyTypeLLMOutput, Content: turn.Response})
+	}
+	return blocks
+}
@@ -0,0 +1,55 @@
+package butterfish
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConversation(t *testing.T) {
+	stateDir := t.TempDir()
+
+	conversation, err := LoadConversation(stateDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(conversation.Turns))
+
+	conversation.Append("hi", "hello")
+	conversation.Append("how are you", "fine")
+	assert.Nil(t, conversation.Save())
+
+	conversation, err = LoadConversation(stateDir)
+	assert.Nil(t, err)
+	history := conversation.HistoryBlocks(1000)
+	assert.Equal(t, 4, len(history))
+	assert.Equal(t, historyTypePrompt, history[2].Type)
+	assert.Equal(t, "how are you", history[2].Content)
+	assert.Equal(t, historyTypeLLMOutput, history[3].Type)
+	assert.Equal(t, "fine", history[3].Content)
+
+	assert.Nil(t, conversation.Clear())
+	assert.Nil(t, conversation.Clear())
+	conversation, err = LoadConversation(stateDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(conversation.Turns))
+}
+
+func TestConversationHistoryTokens(t *testing.T) {
+	conversation := &Conversation{}
+	conversation.Append(strings.Repeat("a", 400), strings.Repeat("b", 400))
+	conversation.Append("how are you", "fine")
+	conversation.Append("and now", "still fine")
+
+	// the oldest turn is 200 tokens and doesn't fit, later turns are kept
+	history := conversation.HistoryBlocks(100)
+	assert.Equal(t, 4, len(history))
+	assert.Equal(t, "how are you", history[0].Content)
+	assert.Equal(t, "still fine", history[3].Content)
+
+	// a turn is kept or dropped whole
+	history = conversation.HistoryBlocks(5)
+	assert.Equal(t, 2, len(history))
+	assert.Equal(t, "and now", history[0].Content)
+
+	assert.Equal(t, 0, len(conversation.HistoryBlocks(0)))
+}
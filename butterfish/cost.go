@@ -0,0 +1,98 @@
+package butterfish
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// Prices and cost estimates shared by commands that can send a lot of
+// tokens. Before index, summarize, and goal mode send more than
+// Config.CostThreshold dollars of input they ask for confirmation, --yes
+// skips the question.
+
+const DefaultCostThreshold = 0.50
+
+// Input prices in US cents per million tokens, from
+// https://openai.com/api/pricing, last checked 2024-08-07. Like the context
+// windows, a model that isn't listed uses the price of its longest listed
+// prefix, e.g. gpt-4-turbo-2024-04-09 uses gpt-4-turbo.
+var MODEL_TO_INPUT_PRICE = map[string]int{
+	"gpt-4o":                 500,
+	"gpt-4o-2024-08-06":      250,
+	"gpt-4o-mini":            15,
+	"gpt-4":                  3000,
+	"gpt-4-32k":              6000,
+	"gpt-4-turbo":            1000,
+	"gpt-4-1106":             1000,
+	"gpt-4-0125-preview":     1000,
+	"gpt-4-vision":           1000,
+	"gpt-3.5-turbo":          50,
+	"gpt-3.5-turbo-0613":     150,
+	"gpt-3.5-turbo-1106":     100,
+	"gpt-3.5-turbo-16k":      300,
+	"gpt-3.5-turbo-instruct": 150,
+	"text-embedding-ada-002": 10,
+	"text-embedding-3-small": 2,
+	"text-embedding-3-large": 13,
+}
+
+// The cost in dollars of sending tokens to a model as input, false if we
+// don't know the model's price
+func InputCostForModel(model string, tokens int) (float64, bool) {
+	foundModel, cents := findModelValue(model, MODEL_TO_INPUT_PRICE)
+	if foundModel == "" {
+		return 0, false
+	}
+	return float64(tokens) * float64(cents) / 100 / 1e6, true
+}
+
+// Roughly what an operation will send to a model
+type CostEstimate struct {
+	Model    string
+	Tokens   int
+	Requests int
+}
+
+func (this *CostEstimate) Dollars() (float64, bool) {
+	return InputCostForModel(this.Model, this.Tokens)
+}
+
+func (this *CostEstimate) String() string {
+	str := fmt.Sprintf("~%d tokens to %s in %d requests", this.Tokens, this.Model, this.Requests)
+	if dollars, ok := this.Dollars(); ok {
+		str += fmt.Sprintf(", about $%.2f", dollars)
+	}
+	return str
+}
+
+// Whether the estimate costs at least threshold dollars, a threshold of 0
+// turns the check off and models we don't have a price for never need it
+func (this *CostEstimate) OverThreshold(threshold float64) bool {
+	dollars, ok := this.Dollars()
+	return ok && threshold > 0 && dollars >= threshold
+}
+
+// Ask before going ahead with an estimate over the cost threshold, unless yes
+// is set. Without a terminal to ask on we stop and suggest --yes.
+func (this *ButterfishCtx) ConfirmCost(estimate *CostEstimate, yes bool) error {
+	if yes || !estimate.OverThreshold(this.Config.CostThreshold) {
+		return nil
+	}
+
+	message := fmt.Sprintf("This will send %s, over the cost threshold of $%.2f", estimate, this.Config.CostThreshold)
+	if this.InConsoleMode || !term.IsTerminal(int(os.Stdin.Fd())) {
+		return fmt.Errorf("%s, pass --yes to go ahead or raise --cost-threshold", message)
+	}
+
+	this.StylePrintf(this.Config.Styles.Question, "%s. Continue? [y/N]: ", message)
+	var input string
+	fmt.Scanln(&input)
+	if strings.ToLower(strings.TrimSpace(input)) != "y" {
+		return errors.New("Canceled")
+	}
+	return nil
+}
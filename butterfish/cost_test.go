@@ -0,0 +1,39 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCostEstimate(t *testing.T) {
+	estimate := &CostEstimate{Model: "gpt-4-turbo", Tokens: 120000, Requests: 34}
+	assert.Equal(t, "~120000 tokens to gpt-4-turbo in 34 requests, about $1.20", estimate.String())
+	assert.True(t, estimate.OverThreshold(0.5))
+	assert.False(t, estimate.OverThreshold(2))
+	assert.False(t, estimate.OverThreshold(0))
+
+	// no price means no confirmation
+	estimate = &CostEstimate{Model: "llama3", Tokens: 120000, Requests: 34}
+	assert.Equal(t, "~120000 tokens to llama3 in 34 requests", estimate.String())
+	assert.False(t, estimate.OverThreshold(0.5))
+}
+
+func TestConfirmCost(t *testing.T) {
+	butterfish := &ButterfishCtx{
+		Ctx:    context.Background(),
+		Config: MakeButterfishConfig(),
+		Out:    new(bytes.Buffer),
+	}
+	estimate := &CostEstimate{Model: "gpt-4", Tokens: 100000, Requests: 20}
+
+	assert.Nil(t, butterfish.ConfirmCost(estimate, true))
+	// tests don't have a terminal to ask on
+	err := butterfish.ConfirmCost(estimate, false)
+	assert.ErrorContains(t, err, "about $3.00, over the cost threshold of $0.50, pass --yes")
+
+	butterfish.Config.CostThreshold = 5
+	assert.Nil(t, butterfish.ConfirmCost(estimate, false))
+}
@@ -0,0 +1,624 @@
+package butterfish
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/sashabaranov/go-openai/jsonschema"
+	"github.com/sergi/go-diff/diffmatchpatch"
+	"golang.org/x/term"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// The edit command can edit a single file or a directory. We keep a
+// LineBuffer for each file the model opens, keyed by its path relative to the
+// directory, and only write them once the model is done, so that a failed
+// edit never leaves a half-changed tree behind.
+
+const (
+	// Maximum number of files listed in the prompt when editing a directory
+	maxEditListedFiles = 500
+	// Number of unchanged lines around each change in a diff
+	diffContextLines = 3
+)
+
+var EditMultiSysMsg = `You're helping an expert programmer edit the files in a directory. You can either respond with questions and clarifications, or use the tools. view() shows a file with line numbers, view a file before editing it. edit() replaces a range of lines in a file with new code, and can create a file by inserting at line 1 of a path that doesn't exist. In some cases you may want to call edit() multiple times, I will apply the edits and give you the updated file after every call. Use the most recent version of a file for your edits. If there are no more edits, just say "DONE!"`
+
+var EditMultiTools = []util.ToolDefinition{
+	{
+		Type: "function",
+		Function: util.FunctionDefinition{
+			Name:        "view",
+			Description: "View a file with line numbers.",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"path": {
+						Type:        jsonschema.String,
+						Description: "Path of the file, relative to the directory being edited",
+					},
+				},
+				Required: []string{"path"},
+			},
+		},
+	},
+	EditTools[0],
+}
+
+// The files opened during an edit, with their original content so that we
+// can diff and write only what changed
+type EditSession struct {
+	// Directory that paths are relative to
+	Root string
+	// Path edit calls without a path apply to, set when editing a single file
+	DefaultPath string
+	Files       map[string]*LineBuffer
+	// Content of each file when it was opened, "" for new files
+	Originals map[string]string
+	// Paths in the order they were opened
+	Paths []string
+	// If set, WriteAll snapshots files here first so they can be restored
+	// with butterfish undo, under this command name
+	Journal *UndoJournal
+	Command string
+}
+
+// Start an edit of a file or directory, a single file is opened immediately
+// and doesn't need to exist yet
+func NewEditSession(path string) (*EditSession, error) {
+	session := &EditSession{
+		Root:      path,
+		Files:     map[string]*LineBuffer{},
+		Originals: map[string]string{},
+	}
+
+	info, err := os.Stat(path)
+	if err == nil && info.IsDir() {
+		return session, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	session.Root = filepath.Dir(path)
+	session.DefaultPath = filepath.Base(path)
+	_, _, err = session.Open(session.DefaultPath)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Get the buffer for a path, reading the file the first time it's opened.
+// Returns the cleaned relative path.
+func (this *EditSession) Open(path string) (*LineBuffer, string, error) {
+	if path == "" {
+		path = this.DefaultPath
+	}
+	if path == "" {
+		return nil, "", errors.New("A path is required when editing a directory")
+	}
+	if filepath.IsAbs(path) {
+		rel, err := filepath.Rel(this.Root, path)
+		if err != nil {
+			return nil, "", err
+		}
+		path = rel
+	}
+	path = filepath.Clean(path)
+	if path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+		return nil, "", fmt.Errorf("%s is outside of %s", path, this.Root)
+	}
+
+	if buffer, ok := this.Files[path]; ok {
+		return buffer, path, nil
+	}
+
+	buffer, err := NewLineBuffer(filepath.Join(this.Root, path))
+	if os.IsNotExist(err) {
+		buffer = &LineBuffer{Lines: []string{""}}
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	this.Files[path] = buffer
+	this.Originals[path] = buffer.String()
+	this.Paths = append(this.Paths, path)
+	return buffer, path, nil
+}
+
+// The numbered lines of a file for the model, with its path when editing a
+// directory
+func (this *EditSession) fileContext(path string, buffer *LineBuffer) string {
+	if this.DefaultPath != "" {
+		return buffer.PrefixLineNumbers()
+	}
+	return fmt.Sprintf("%s:\n%s", path, buffer.PrefixLineNumbers())
+}
+
+// Apply a view or edit tool call, returning the tool output for the model
+func (this *EditSession) ApplyToolCall(toolCall *util.ToolCall) (string, error) {
+	var params struct {
+		Path string `json:"path"`
+	}
+	err := unmarshalToolArguments(toolCall.Function.Parameters, &params)
+	if err != nil {
+		return "", err
+	}
+
+	switch toolCall.Function.Name {
+	case "view":
+		buffer, path, err := this.Open(params.Path)
+		if err != nil {
+			return err.Error(), nil
+		}
+		return this.fileContext(path, buffer), nil
+
+	case "edit":
+		buffer, path, err := this.Open(params.Path)
+		if err != nil {
+			return err.Error(), nil
+		}
+		err = ApplyEditToolToLineBuffer(toolCall, buffer)
+		if err != nil {
+			return "", err
+		}
+		return this.fileContext(path, buffer), nil
+	}
+
+	return "", errors.New("Unknown tool call: " + toolCall.Function.Name)
+}
+
+// Paths of the files whose content has changed, in the order they were opened
+func (this *EditSession) Changed() []string {
+	changed := []string{}
+	for _, path := range this.Paths {
+		if this.Files[path].String() != this.Originals[path] {
+			changed = append(changed, path)
+		}
+	}
+	return changed
+}
+
+// Write every changed file. Each is first written to a temp file next to it
+// and they're only renamed into place once all have been written and
+// journaled, so an error leaves every file as it was.
+func (this *EditSession) WriteAll() error {
+	type pending struct {
+		temp, path string
+	}
+	written := []pending{}
+	cleanup := func() {
+		for _, file := range written {
+			os.Remove(file.temp)
+		}
+	}
+
+	for _, rel := range this.Changed() {
+		path := filepath.Join(this.Root, rel)
+		mode := fs.FileMode(0644)
+		if info, err := os.Stat(path); err == nil {
+			mode = info.Mode().Perm()
+		}
+
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			cleanup()
+			return err
+		}
+		file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+		if err != nil {
+			cleanup()
+			return err
+		}
+		written = append(written, pending{file.Name(), path})
+
+		_, err = file.WriteString(this.Files[rel].String())
+		closeErr := file.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Chmod(file.Name(), mode)
+		}
+		if err != nil {
+			cleanup()
+			return err
+		}
+	}
+
+	if this.Journal != nil && len(written) > 0 {
+		contents := map[string]string{}
+		for _, rel := range this.Changed() {
+			path, err := filepath.Abs(filepath.Join(this.Root, rel))
+			if err != nil {
+				cleanup()
+				return err
+			}
+			contents[path] = this.Files[rel].String()
+		}
+		_, err := this.Journal.Record(this.Command, contents)
+		if err != nil {
+			cleanup()
+			return fmt.Errorf("Unable to save undo snapshot: %w", err)
+		}
+	}
+
+	for i, file := range written {
+		err := os.Rename(file.temp, file.path)
+		if err != nil {
+			cleanup()
+			return fmt.Errorf("Wrote %d of %d files, failed on %s: %w", i, len(written), file.path, err)
+		}
+	}
+	return nil
+}
+
+// List the files under a directory for the model, skipping hidden files and
+// directories
+func listEditableFiles(root string) ([]string, error) {
+	files := []string{}
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != root && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		if len(files) >= maxEditListedFiles {
+			return filepath.SkipAll
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, rel)
+		return nil
+	})
+
+	sort.Strings(files)
+	return files, err
+}
+
+// A hunk of a unified diff, Lines are prefixed with ' ', '-', or '+'
+type DiffHunk struct {
+	OldStart, OldLines int
+	NewStart, NewLines int
+	Lines              []string
+	// Each line as it appears in the file, with its newline if it has one
+	raw []string
+}
+
+func (this *DiffHunk) Header() string {
+	return fmt.Sprintf("@@ -%d,%d +%d,%d @@", this.OldStart, this.OldLines, this.NewStart, this.NewLines)
+}
+
+// Whether any of the first n+1 lines is a change, i.e. the next hunk's
+// leading context would overlap this one's trailing context
+func changeWithin(lines []string, n int) bool {
+	for i := 0; i <= n && i < len(lines); i++ {
+		if lines[i][0] != ' ' {
+			return true
+		}
+	}
+	return false
+}
+
+// Diff two texts by lines. go-diff's own line mode encodes each line as a
+// decimal index and then diffs those strings character by character, which
+// can split indexes, so we map each distinct line to a rune instead.
+func diffLines(a, b string) []diffmatchpatch.Diff {
+	lineRunes := map[string]rune{}
+	lines := []string{}
+	toRunes := func(text string) []rune {
+		runes := []rune{}
+		for _, line := range strings.SplitAfter(text, "\n") {
+			if line == "" {
+				continue
+			}
+			r, ok := lineRunes[line]
+			if !ok {
+				// stay clear of the surrogate range, which isn't valid in strings
+				r = rune(len(lines) + 1)
+				if r >= 0xD800 {
+					r += 0x800
+				}
+				lineRunes[line] = r
+				lines = append(lines, line)
+			}
+			runes = append(runes, r)
+		}
+		return runes
+	}
+	runesA := toRunes(a)
+	runesB := toRunes(b)
+
+	dmp := diffmatchpatch.New()
+	diffs := dmp.DiffMainRunes(runesA, runesB, false)
+	for i := range diffs {
+		text := strings.Builder{}
+		for _, r := range diffs[i].Text {
+			if r >= 0xE000 {
+				r -= 0x800
+			}
+			text.WriteString(lines[r-1])
+		}
+		diffs[i].Text = text.String()
+	}
+	return diffs
+}
+
+// Diff two texts line by line and group the changes into hunks with
+// diffContextLines of context
+func DiffHunks(a, b string) []*DiffHunk {
+	diffs := diffLines(a, b)
+
+	// flatten into one prefixed line per entry
+	lines := []string{}
+	raw := []string{}
+	for _, diff := range diffs {
+		prefix := " "
+		switch diff.Type {
+		case diffmatchpatch.DiffInsert:
+			prefix = "+"
+		case diffmatchpatch.DiffDelete:
+			prefix = "-"
+		}
+		for _, line := range strings.SplitAfter(diff.Text, "\n") {
+			if line == "" {
+				continue
+			}
+			lines = append(lines, prefix+strings.TrimSuffix(line, "\n"))
+			raw = append(raw, line)
+		}
+	}
+
+	hunks := []*DiffHunk{}
+	var hunk *DiffHunk
+	oldLine, newLine := 1, 1
+	lastChange := -1
+
+	for i, line := range lines {
+		if line[0] != ' ' {
+			if hunk == nil {
+				start := max(0, i-diffContextLines)
+				hunk = &DiffHunk{
+					OldStart: oldLine - (i - start),
+					NewStart: newLine - (i - start),
+				}
+				hunk.Lines = append(hunk.Lines, lines[start:i]...)
+				hunk.raw = append(hunk.raw, raw[start:i]...)
+				hunk.OldLines += i - start
+				hunk.NewLines += i - start
+			}
+			lastChange = i
+		}
+
+		if hunk != nil {
+			if line[0] == ' ' && i-lastChange > diffContextLines && !changeWithin(lines[i:], diffContextLines) {
+				hunks = append(hunks, hunk)
+				hunk = nil
+			} else {
+				hunk.Lines = append(hunk.Lines, line)
+				hunk.raw = append(hunk.raw, raw[i])
+				if line[0] != '+' {
+					hunk.OldLines++
+				}
+				if line[0] != '-' {
+					hunk.NewLines++
+				}
+			}
+		}
+
+		if line[0] != '+' {
+			oldLine++
+		}
+		if line[0] != '-' {
+			newLine++
+		}
+	}
+	if hunk != nil {
+		hunks = append(hunks, hunk)
+	}
+
+	return hunks
+}
+
+// Apply some of the hunks from DiffHunks(original, ...) to original, hunks
+// must be in order
+func ApplyHunks(original string, hunks []*DiffHunk) string {
+	lines := strings.SplitAfter(original, "\n")
+	builder := strings.Builder{}
+	next := 0
+
+	for _, hunk := range hunks {
+		for ; next < hunk.OldStart-1 && next < len(lines); next++ {
+			builder.WriteString(lines[next])
+		}
+		for i, line := range hunk.Lines {
+			if line[0] != '-' {
+				builder.WriteString(hunk.raw[i])
+			}
+			if line[0] != '+' {
+				next++
+			}
+		}
+	}
+	for ; next < len(lines); next++ {
+		builder.WriteString(lines[next])
+	}
+
+	return builder.String()
+}
+
+// Render a colored unified diff of a file
+func (this *ButterfishCtx) renderFileDiff(path string, hunks []*DiffHunk) string {
+	builder := strings.Builder{}
+	builder.WriteString(this.StyleSprintf(this.Config.Styles.Highlight, "--- a/%s\n+++ b/%s", path, path))
+	builder.WriteString("\n")
+	for _, hunk := range hunks {
+		builder.WriteString(this.StyleSprintf(this.Config.Styles.Grey, "%s", hunk.Header()))
+		builder.WriteString("\n")
+		for _, line := range hunk.Lines {
+			style := this.Config.Styles.Foreground
+			switch line[0] {
+			case '+':
+				style = this.Config.Styles.Go
+			case '-':
+				style = this.Config.Styles.Error
+			}
+			builder.WriteString(this.StyleSprintf(style, "%s", line))
+			builder.WriteString("\n")
+		}
+	}
+	return builder.String()
+}
+
+// Render a diff of every changed file in the session
+func (this *ButterfishCtx) renderSessionDiff(session *EditSession) string {
+	builder := strings.Builder{}
+	for _, path := range session.Changed() {
+		hunks := DiffHunks(session.Originals[path], session.Files[path].String())
+		builder.WriteString(this.renderFileDiff(path, hunks))
+	}
+	return builder.String()
+}
+
+// Edit a directory, the model sees a list of its files and opens the ones
+// it needs with the view tool
+func (this *ButterfishCtx) EditFiles(session *EditSession, prompt string, options *CliCommandConfig) error {
+	cmd := &promptCommand{
+		SysMsg:      EditSysMsg,
+		Model:       options.Edit.Model,
+		NumTokens:   options.Edit.NumTokens,
+		Temperature: options.Edit.Temperature,
+		NoColor:     options.Edit.NoColor,
+		NoBackticks: options.Edit.NoBackticks,
+		Verbose:     this.Config.Verbose,
+	}
+	if session.DefaultPath != "" {
+		return this.editLoop(session, prompt, cmd)
+	}
+
+	files, err := listEditableFiles(session.Root)
+	if err != nil {
+		return err
+	}
+	cmd.SysMsg = EditMultiSysMsg
+	cmd.Tools = EditMultiTools
+	prompt = fmt.Sprintf("%s\n\nFiles in %s:\n%s", prompt, session.Root, strings.Join(files, "\n"))
+	return this.editLoop(session, prompt, cmd)
+}
+
+func (this *ButterfishCtx) editCommand(options *CliCommandConfig) error {
+	path := options.Edit.Filepath
+	if path == "" {
+		return errors.New("Please provide a filepath")
+	}
+
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	session, err := NewEditSession(path)
+	if err != nil {
+		return err
+	}
+	session.Journal = this.undoJournal()
+	session.Command = "edit"
+
+	err = this.EditFiles(session, options.Edit.Prompt, options)
+	if err != nil {
+		return err
+	}
+
+	showDiff := options.Edit.Diff ||
+		(!options.Edit.NoDiff && term.IsTerminal(int(os.Stdout.Fd())))
+	if showDiff {
+		return this.confirmEdits(session, options.Edit.Yes)
+	}
+	if options.Edit.InPlace {
+		return session.WriteAll()
+	}
+
+	if session.DefaultPath != "" {
+		fmt.Fprintf(this.Out, "%s\n", session.Files[session.DefaultPath].String())
+	} else {
+		fmt.Fprintf(this.Out, "%s", this.renderSessionDiff(session))
+	}
+	return nil
+}
+
+// Show a diff of the changes and write them if the user agrees, they can
+// also pick which hunks to apply
+func (this *ButterfishCtx) confirmEdits(session *EditSession, yes bool) error {
+	changed := session.Changed()
+	if len(changed) == 0 {
+		this.StylePrintf(this.Config.Styles.Grey, "No changes to apply\n")
+		return nil
+	}
+
+	this.Printf("\n%s", this.renderSessionDiff(session))
+	if !yes {
+		this.StylePrintf(this.Config.Styles.Question, "Apply changes to %d file(s)? [y/N/s(elect hunks)]: ", len(changed))
+		var input string
+		fmt.Scanln(&input)
+
+		switch strings.ToLower(strings.TrimSpace(input)) {
+		case "y":
+		case "s":
+			this.selectHunks(session)
+		default:
+			return nil
+		}
+	}
+
+	return session.WriteAll()
+}
+
+// Ask about each hunk and reset each file to its original content with only
+// the accepted hunks applied
+func (this *ButterfishCtx) selectHunks(session *EditSession) {
+	quit := false
+	for _, path := range session.Changed() {
+		original := session.Originals[path]
+		hunks := DiffHunks(original, session.Files[path].String())
+		selected := []*DiffHunk{}
+
+		for _, hunk := range hunks {
+			if quit {
+				break
+			}
+			this.Printf("\n%s", this.renderFileDiff(path, []*DiffHunk{hunk}))
+			this.StylePrintf(this.Config.Styles.Question, "Apply this hunk? [y/N/q(uit)]: ")
+			var input string
+			fmt.Scanln(&input)
+
+			switch strings.ToLower(strings.TrimSpace(input)) {
+			case "y":
+				selected = append(selected, hunk)
+			case "q":
+				quit = true
+			}
+		}
+
+		session.Files[path].Lines = strings.Split(ApplyHunks(original, selected), "\n")
+	}
+}
@@ -0,0 +1,107 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func TestDiffHunks(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	b := "1\ntwo\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n"
+
+	hunks := DiffHunks(a, b)
+	assert.Equal(t, 2, len(hunks))
+	assert.Equal(t, "@@ -1,5 +1,5 @@", hunks[0].Header())
+	assert.Equal(t, []string{" 1", "-2", "+two", " 3", " 4", " 5"}, hunks[0].Lines)
+	assert.Equal(t, "@@ -10,3 +10,4 @@", hunks[1].Header())
+	assert.Equal(t, []string{" 10", " 11", " 12", "+13"}, hunks[1].Lines)
+
+	// changes close together share a hunk
+	hunks = DiffHunks("1\n2\n3\n4\n5\n6\n", "one\n2\n3\n4\n5\nsix\n")
+	assert.Equal(t, 1, len(hunks))
+	assert.Equal(t, "@@ -1,6 +1,6 @@", hunks[0].Header())
+
+	assert.Equal(t, 0, len(DiffHunks(a, a)))
+}
+
+func TestEditSession(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "a.go"), []byte("func Foo() {}\n"), 0600))
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "sub", "b.go"), []byte("x := Foo()\n"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, ".hidden"), []byte("secret\n"), 0644))
+
+	edit := func(id, params string) *util.ToolCall {
+		return &util.ToolCall{Id: id, Function: util.FunctionCall{Name: "edit", Parameters: params}}
+	}
+	llm := &functionCallLLM{responses: []*util.CompletionResponse{
+		{ToolCalls: []*util.ToolCall{
+			{Id: "1", Function: util.FunctionCall{Name: "view", Parameters: `{"path": "sub/b.go"}`}},
+			edit("2", `{"path": "a.go", "range_start": 1, "range_end": 2, "code_edit": "func Bar() {}"}`),
+		}},
+		{ToolCalls: []*util.ToolCall{
+			edit("3", `{"path": "sub/b.go", "range_start": 1, "range_end": 2, "code_edit": "x := Bar()"}`),
+			edit("4", `{"path": "../outside.go", "range_start": 1, "range_end": 1, "code_edit": "oops"}`),
+			edit("5", `{"path": "new/c.go", "range_start": 1, "range_end": 1, "code_edit": "// Bar"}`),
+		}},
+		{Completion: "DONE!"},
+	}}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+		Out:           new(bytes.Buffer),
+	}
+
+	session, err := NewEditSession(dir)
+	assert.Nil(t, err)
+	options := &CliCommandConfig{}
+	err = butterfish.EditFiles(session, "rename Foo to Bar", options)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 3, len(llm.requests))
+	assert.Equal(t, EditMultiTools, llm.requests[0].Tools)
+	assert.Contains(t, llm.requests[0].HistoryBlocks[0].Content, "sub/b.go")
+	assert.NotContains(t, llm.requests[0].HistoryBlocks[0].Content, ".hidden")
+	assert.Equal(t, "sub/b.go:\n1 x := Foo()\n2 ", llm.requests[1].HistoryBlocks[2].Content)
+	assert.Contains(t, llm.requests[2].HistoryBlocks[6].Content, "outside")
+
+	assert.Equal(t, []string{"sub/b.go", "a.go", "new/c.go"}, session.Changed())
+	assert.Contains(t, butterfish.renderSessionDiff(session), "+x := Bar()")
+
+	// nothing is written until WriteAll
+	content, _ := os.ReadFile(filepath.Join(dir, "a.go"))
+	assert.Equal(t, "func Foo() {}\n", string(content))
+
+	assert.Nil(t, session.WriteAll())
+	content, _ = os.ReadFile(filepath.Join(dir, "a.go"))
+	assert.Equal(t, "func Bar() {}\n", string(content))
+	info, _ := os.Stat(filepath.Join(dir, "a.go"))
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	content, _ = os.ReadFile(filepath.Join(dir, "sub", "b.go"))
+	assert.Equal(t, "x := Bar()\n", string(content))
+	content, _ = os.ReadFile(filepath.Join(dir, "new", "c.go"))
+	assert.Equal(t, "// Bar\n", string(content))
+	_, err = os.Stat(filepath.Join(filepath.Dir(dir), "outside.go"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestApplyHunks(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12"
+	b := "1\ntwo\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n"
+	hunks := DiffHunks(a, b)
+	assert.Equal(t, 2, len(hunks))
+
+	assert.Equal(t, b, ApplyHunks(a, hunks))
+	assert.Equal(t, a, ApplyHunks(a, nil))
+	assert.Equal(t, "1\ntwo\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12", ApplyHunks(a, hunks[:1]))
+	assert.Equal(t, "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n", ApplyHunks(a, hunks[1:]))
+}
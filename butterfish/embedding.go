@@ -0,0 +1,61 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/bakks/butterfish/embedding"
+)
+
+// Selecting the embeddings backend used by the index commands. OpenAI
+// embeddings go through the LLM client so they share its base URL and usage
+// tracking, the other backends don't need an API key so indexing and search
+// can run fully offline.
+
+const (
+	EmbeddingBackendOpenAI  = "openai"
+	EmbeddingBackendOllama  = "ollama"
+	EmbeddingBackendCommand = "command"
+)
+
+var EmbeddingBackends = []string{
+	EmbeddingBackendOpenAI,
+	EmbeddingBackendOllama,
+	EmbeddingBackendCommand,
+}
+
+// Whether the configured embeddings backend needs an OpenAI API key
+func (this *ButterfishConfig) EmbeddingNeedsToken() bool {
+	return this.EmbeddingBackend == "" || this.EmbeddingBackend == EmbeddingBackendOpenAI
+}
+
+// Adapts the LLM client to the embedding.Embedder interface
+type llmEmbedder struct {
+	llm     LLM
+	verbose bool
+}
+
+func (this *llmEmbedder) CalculateEmbeddings(ctx context.Context, content []string) ([][]float32, error) {
+	return this.llm.Embeddings(ctx, content, this.verbose)
+}
+
+func (this *ButterfishCtx) newEmbedder() (embedding.Embedder, error) {
+	switch this.Config.EmbeddingBackend {
+	case "", EmbeddingBackendOpenAI:
+		return &llmEmbedder{llm: this.LLMClient, verbose: this.Config.Verbose > 0}, nil
+
+	case EmbeddingBackendOllama:
+		return embedding.NewOllamaEmbedder(this.Config.EmbeddingURL, this.Config.EmbeddingModel), nil
+
+	case EmbeddingBackendCommand:
+		if this.Config.EmbeddingCommand == "" {
+			return nil, errors.New("The command embeddings backend needs a command, set it with --embedding-command")
+		}
+		return embedding.NewCommandEmbedder(this.Config.EmbeddingCommand), nil
+
+	default:
+		return nil, fmt.Errorf("Unknown embeddings backend %s, expected one of %v",
+			this.Config.EmbeddingBackend, EmbeddingBackends)
+	}
+}
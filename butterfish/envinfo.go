@@ -0,0 +1,161 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/sashabaranov/go-openai/jsonschema"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Goal mode usually starts with the agent running pwd, ls, uname, and git
+// status to get its bearings, a step and a round trip each. The env_info
+// function answers all of those at once: the directory and the project files
+// in it, git state, OS, package managers on the PATH, and the env vars
+// recorded for sessions. Env vars that look like credentials are included by
+// name only.
+
+const maxEnvInfoChangedFiles = 50
+
+var envInfoFunction = util.FunctionDefinition{
+	Name:        "env_info",
+	Description: "Get the current directory and its project files, git status, OS, available package managers, and key environment variables in one call, use this rather than running commands like pwd, ls, or uname",
+	Parameters: jsonschema.Definition{
+		Type:       jsonschema.Object,
+		Properties: map[string]jsonschema.Definition{},
+	},
+}
+
+// Package managers and build tools we look for on the PATH
+var envInfoPackageManagers = []string{
+	"brew", "port", "apt", "dnf", "yum", "pacman", "apk", "zypper", "nix",
+	"pip", "pip3", "uv", "poetry", "conda", "npm", "yarn", "pnpm", "bun",
+	"cargo", "go", "gem", "bundle", "composer", "mvn", "gradle", "dotnet",
+}
+
+// Files that tell the agent what kind of project a directory is
+var envInfoProjectFiles = []string{
+	"go.mod", "package.json", "Cargo.toml", "pyproject.toml", "setup.py",
+	"requirements.txt", "Pipfile", "Gemfile", "composer.json", "pom.xml",
+	"build.gradle", "CMakeLists.txt", "Makefile", "Dockerfile",
+	"docker-compose.yml", ".tool-versions",
+}
+
+type GitEnvInfo struct {
+	Branch string `json:"branch,omitempty"`
+	Commit string `json:"commit,omitempty"`
+	// git status --porcelain lines, up to maxEnvInfoChangedFiles
+	Changed      []string `json:"changed"`
+	ChangedTotal int      `json:"changed_total"`
+}
+
+type EnvInfo struct {
+	Directory       string            `json:"cwd"`
+	ProjectFiles    []string          `json:"project_files"`
+	OS              string            `json:"os"`
+	Arch            string            `json:"arch"`
+	Kernel          string            `json:"kernel,omitempty"`
+	Shell           string            `json:"shell,omitempty"`
+	Git             *GitEnvInfo       `json:"git,omitempty"`
+	PackageManagers []string          `json:"package_managers"`
+	Env             map[string]string `json:"env"`
+}
+
+// Gather info about a directory, envVars adds name patterns to
+// DefaultSessionEnvVars
+func CaptureEnvInfo(ctx context.Context, dir string, envVars []string) *EnvInfo {
+	ctx, cancel := context.WithTimeout(ctx, systemInfoTimeout)
+	defer cancel()
+
+	info := &EnvInfo{
+		Directory:       dir,
+		ProjectFiles:    []string{},
+		OS:              runtime.GOOS,
+		Arch:            runtime.GOARCH,
+		Shell:           os.Getenv("SHELL"),
+		PackageManagers: []string{},
+		Env:             map[string]string{},
+	}
+
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(2)
+	go func() {
+		defer waitGroup.Done()
+		if runtime.GOOS != "windows" {
+			info.Kernel = commandOutputIn(ctx, dir, "uname", "-sr")
+		}
+	}()
+	go func() {
+		defer waitGroup.Done()
+		info.Git = gitEnvInfo(ctx, dir)
+	}()
+
+	for _, name := range envInfoProjectFiles {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			info.ProjectFiles = append(info.ProjectFiles, name)
+		}
+	}
+	for _, name := range envInfoPackageManagers {
+		if _, err := exec.LookPath(name); err == nil {
+			info.PackageManagers = append(info.PackageManagers, name)
+		}
+	}
+
+	patterns := append(append([]string{}, DefaultSessionEnvVars...), envVars...)
+	for _, keyValue := range os.Environ() {
+		key, value, _ := strings.Cut(keyValue, "=")
+		for _, pattern := range patterns {
+			if matched, _ := filepath.Match(pattern, key); !matched {
+				continue
+			}
+			if secretEnvVarPattern.MatchString(key) {
+				value = "[REDACTED:env]"
+			}
+			info.Env[key] = value
+			break
+		}
+	}
+
+	waitGroup.Wait()
+	return info
+}
+
+// nil if the directory isn't in a git repo
+func gitEnvInfo(ctx context.Context, dir string) *GitEnvInfo {
+	commit := commandOutputIn(ctx, dir, "git", "rev-parse", "--short", "HEAD")
+	if commit == "" {
+		return nil
+	}
+
+	git := &GitEnvInfo{
+		Branch:  commandOutputIn(ctx, dir, "git", "symbolic-ref", "--quiet", "--short", "HEAD"),
+		Commit:  commit,
+		Changed: []string{},
+	}
+	status := commandOutputIn(ctx, dir, "git", "status", "--porcelain")
+	if status != "" {
+		lines := strings.Split(status, "\n")
+		for i := range lines {
+			lines[i] = strings.TrimSpace(lines[i])
+		}
+		git.ChangedTotal = len(lines)
+		git.Changed = lines[:min(len(lines), maxEnvInfoChangedFiles)]
+	}
+	return git
+}
+
+// The env_info function output
+func envInfoOutput(ctx context.Context, dir string, envVars []string) string {
+	output, err := json.Marshal(CaptureEnvInfo(ctx, dir, envVars))
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	return string(output)
+}
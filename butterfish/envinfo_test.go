@@ -0,0 +1,56 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func TestCaptureEnvInfo(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/foo\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "Makefile"), []byte("all:\n"), 0644)
+	t.Setenv("MY_REGION", "us-east-1")
+	t.Setenv("MY_API_TOKEN", "hunter2")
+	t.Setenv("OTHER_VAR", "x")
+
+	info := CaptureEnvInfo(context.Background(), dir, []string{"MY_*"})
+	assert.Equal(t, dir, info.Directory)
+	assert.Equal(t, []string{"go.mod", "Makefile"}, info.ProjectFiles)
+	assert.Nil(t, info.Git)
+	assert.Contains(t, info.PackageManagers, "go")
+	assert.Equal(t, "us-east-1", info.Env["MY_REGION"])
+	assert.Equal(t, "[REDACTED:env]", info.Env["MY_API_TOKEN"])
+	assert.NotContains(t, info.Env, "OTHER_VAR")
+}
+
+func TestAgentEnvInfo(t *testing.T) {
+	t.Setenv("MY_REGION", "us-east-1")
+	llm := &functionCallLLM{responses: []*util.CompletionResponse{
+		callFunction("env_info", `{}`),
+		callFunction("finish", `{"success": true}`),
+	}}
+	executor := &fakeExecutor{}
+
+	agent := NewAgent(llm, executor, "gpt-4o")
+	agent.Unsafe = true
+	agent.EnvVars = []string{"MY_REGION"}
+	result, err := agent.Run(context.Background(), "where am I")
+	assert.NoError(t, err)
+	assert.True(t, result.Success)
+	assert.Empty(t, executor.commands)
+
+	output := lastHistoryBlock(llm.requests[1])
+	assert.Equal(t, "env_info", output.FunctionName)
+	info := &EnvInfo{}
+	assert.NoError(t, json.Unmarshal([]byte(output.Content), info))
+	dir, _ := os.Getwd()
+	assert.Equal(t, dir, info.Directory)
+	assert.Equal(t, "us-east-1", info.Env["MY_REGION"])
+}
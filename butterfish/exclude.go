@@ -0,0 +1,75 @@
+package butterfish
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Commands matching these patterns are kept out of the shell history, both
+// the command and its output, so they're never sent to the LLM. Patterns are
+// globs where * matches anything, matched case-insensitively against each
+// command in a line like `cd x && vault read secret/y`. More can be added
+// with --exclude or exclude_commands in config.yaml.
+var DefaultShellExcludeCommands = []string{
+	"gpg *",
+	"pass *",
+	"vault *",
+	"*password*",
+}
+
+// Separates commands in a line, we don't care about quoting here since
+// matching too much just means we exclude more
+var commandSeparatorRegex = regexp.MustCompile(`&&|\|\||[;&|]`)
+
+type CommandExcluder struct {
+	patterns []*regexp.Regexp
+}
+
+func globToRegex(glob string) *regexp.Regexp {
+	var builder strings.Builder
+	builder.WriteString("(?is)^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			builder.WriteString(".*")
+		case '?':
+			builder.WriteString(".")
+		default:
+			builder.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	builder.WriteString("$")
+	return regexp.MustCompile(builder.String())
+}
+
+func NewCommandExcluder(patterns []string) *CommandExcluder {
+	excluder := &CommandExcluder{}
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern != "" {
+			excluder.patterns = append(excluder.patterns, globToRegex(pattern))
+		}
+	}
+	return excluder
+}
+
+func (this *CommandExcluder) Excluded(command string) bool {
+	if this == nil {
+		return false
+	}
+
+	for _, part := range commandSeparatorRegex.Split(command, -1) {
+		part = strings.TrimSpace(part)
+		// sudo vault ... should match vault *
+		part = strings.TrimSpace(strings.TrimPrefix(part, "sudo "))
+		if part == "" {
+			continue
+		}
+		for _, pattern := range this.patterns {
+			if pattern.MatchString(part) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package butterfish
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandExcluder(t *testing.T) {
+	excluder := NewCommandExcluder(append(DefaultShellExcludeCommands, "op *", " "))
+
+	excluded := []string{
+		"gpg --decrypt ~/secrets.gpg",
+		"pass show email/work",
+		"cd infra && vault read secret/db",
+		"sudo vault login",
+		"mysql --password=hunter2",
+		"echo $DB_PASSWORD | psql",
+		"OP item get github",
+	}
+	for _, command := range excluded {
+		assert.True(t, excluder.Excluded(command), command)
+	}
+
+	included := []string{
+		"ls -l",
+		"git log",
+		"passwd",
+		"vim pass.txt",
+		"",
+	}
+	for _, command := range included {
+		assert.False(t, excluder.Excluded(command), command)
+	}
+
+	var none *CommandExcluder
+	assert.False(t, none.Excluded("pass show x"))
+}
+
+func TestExcludeChildOut(t *testing.T) {
+	shellState := &ShellState{}
+	assert.False(t, shellState.excludeChildOut("total 0\n", 0))
+
+	// an excluded command was submitted, its output is dropped until the
+	// next prompt and counted as one block
+	shellState.ExcludingOutput = true
+	shellState.ExcludedBlocks = 1
+	assert.True(t, shellState.excludeChildOut("secret\n", 0))
+	assert.True(t, shellState.excludeChildOut("more secret\n$ ", 1))
+	assert.False(t, shellState.ExcludingOutput)
+	assert.Equal(t, 2, shellState.ExcludedBlocks)
+
+	assert.False(t, shellState.excludeChildOut("ls output\n", 0))
+}
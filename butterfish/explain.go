@@ -0,0 +1,333 @@
+package butterfish
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sashabaranov/go-openai/jsonschema"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// The explain command splits a command line into pipeline stages locally, then
+// asks the model for a structured explanation of each stage and its arguments
+// which we render like a man page, or print as JSON with --json.
+
+// A single command within a command line, e.g. `grep -v foo` in
+// `cat x | grep -v foo`
+type CommandStage struct {
+	// The operator joining this stage to the previous one, e.g. |, &&, ;
+	// Empty for the first stage
+	Operator string
+	// The stage as written, including quotes
+	Text string
+	// The stage split into words with quotes removed
+	Words []string
+}
+
+var commandOperators = []string{"||", "&&", "|&", "|", ";", "&", "\n"}
+
+// Split a command line into stages on pipes and control operators. This
+// handles quoting and escapes but not subshells or heredocs, which end up
+// inside a stage's words.
+func SplitCommandLine(cmdline string) ([]*CommandStage, error) {
+	stages := []*CommandStage{}
+	current := &CommandStage{}
+	start := 0
+	word := strings.Builder{}
+	inWord := false
+
+	endWord := func() {
+		if inWord {
+			current.Words = append(current.Words, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+
+	endStage := func(end int, operator string) error {
+		endWord()
+		current.Text = strings.TrimSpace(cmdline[start:end])
+		if len(current.Words) == 0 {
+			// blank lines and trailing separators are fine, but e.g. a pipe
+			// needs a command on both sides
+			previous := current.Operator
+			if (previous == "" || previous == ";" || previous == "&" || previous == "\n") &&
+				(operator == "" || operator == "\n") {
+				return nil
+			}
+			if operator == "" {
+				operator = previous
+			}
+			return fmt.Errorf("Unexpected %q in command", operator)
+		}
+		stages = append(stages, current)
+		current = &CommandStage{Operator: operator}
+		return nil
+	}
+
+	for i := 0; i < len(cmdline); i++ {
+		c := cmdline[i]
+
+		switch {
+		case c == '\\' && i+1 < len(cmdline):
+			i++
+			if cmdline[i] != '\n' {
+				word.WriteByte(cmdline[i])
+				inWord = true
+			}
+
+		case c == '\'':
+			end := strings.IndexByte(cmdline[i+1:], '\'')
+			if end == -1 {
+				return nil, errors.New("Unterminated single quote in command")
+			}
+			word.WriteString(cmdline[i+1 : i+1+end])
+			inWord = true
+			i += end + 1
+
+		case c == '"':
+			i++
+			for ; i < len(cmdline) && cmdline[i] != '"'; i++ {
+				if cmdline[i] == '\\' && i+1 < len(cmdline) && strings.IndexByte("\"\\$`", cmdline[i+1]) != -1 {
+					i++
+				}
+				word.WriteByte(cmdline[i])
+			}
+			if i >= len(cmdline) {
+				return nil, errors.New("Unterminated double quote in command")
+			}
+			inWord = true
+
+		case c == '#' && !inWord:
+			// a comment runs to the end of the line
+			end := strings.IndexByte(cmdline[i:], '\n')
+			if end == -1 {
+				i = len(cmdline)
+			} else {
+				i += end - 1
+			}
+
+		case c == ' ' || c == '\t':
+			endWord()
+
+		default:
+			operator := ""
+			for _, op := range commandOperators {
+				if strings.HasPrefix(cmdline[i:], op) {
+					operator = op
+					break
+				}
+			}
+			// & is also used in redirections like 2>&1 and &>
+			if (operator == "&" && i > 0 && cmdline[i-1] == '>') ||
+				(operator == "&" && i+1 < len(cmdline) && cmdline[i+1] == '>') {
+				operator = ""
+			}
+
+			if operator == "" {
+				word.WriteByte(c)
+				inWord = true
+				continue
+			}
+
+			err := endStage(i, operator)
+			if err != nil {
+				return nil, err
+			}
+			i += len(operator) - 1
+			start = i + 1
+		}
+	}
+
+	err := endStage(len(cmdline), "")
+	if err != nil {
+		return nil, err
+	}
+	if len(stages) == 0 {
+		return nil, errors.New("No command to explain")
+	}
+	for _, stage := range stages {
+		if stage.Operator == "\n" {
+			stage.Operator = ";"
+		}
+	}
+
+	return stages, nil
+}
+
+type ArgumentExplanation struct {
+	Argument    string `json:"argument"`
+	Explanation string `json:"explanation"`
+}
+
+type StageExplanation struct {
+	Operator    string                `json:"operator,omitempty"`
+	Command     string                `json:"command"`
+	Explanation string                `json:"explanation"`
+	Arguments   []ArgumentExplanation `json:"arguments"`
+}
+
+type CommandExplanation struct {
+	Command  string             `json:"command"`
+	Summary  string             `json:"summary"`
+	Stages   []StageExplanation `json:"stages"`
+	Warnings []string           `json:"warnings"`
+}
+
+// The schema the model's response must match, strict structured output
+// requires every property to be required and no additional properties.
+func commandExplanationSchema() jsonschema.Definition {
+	argument := jsonschema.Definition{
+		Type: jsonschema.Object,
+		Properties: map[string]jsonschema.Definition{
+			"argument":    {Type: jsonschema.String, Description: "The flag or argument as written"},
+			"explanation": {Type: jsonschema.String},
+		},
+		Required:             []string{"argument", "explanation"},
+		AdditionalProperties: false,
+	}
+
+	stage := jsonschema.Definition{
+		Type: jsonschema.Object,
+		Properties: map[string]jsonschema.Definition{
+			"command":     {Type: jsonschema.String, Description: "The stage as written"},
+			"explanation": {Type: jsonschema.String, Description: "What this stage does"},
+			"arguments":   {Type: jsonschema.Array, Items: &argument},
+		},
+		Required:             []string{"command", "explanation", "arguments"},
+		AdditionalProperties: false,
+	}
+
+	return jsonschema.Definition{
+		Type: jsonschema.Object,
+		Properties: map[string]jsonschema.Definition{
+			"summary":  {Type: jsonschema.String},
+			"stages":   {Type: jsonschema.Array, Items: &stage},
+			"warnings": {Type: jsonschema.Array, Items: &jsonschema.Definition{Type: jsonschema.String}},
+		},
+		Required:             []string{"summary", "stages", "warnings"},
+		AdditionalProperties: false,
+	}
+}
+
+// Explain a command line, with extracts of each command's documentation from
+// docs in the prompt if it's not nil
+func (this *ButterfishCtx) ExplainCommand(cmdline, model string, numTokens int, docs CommandDocsFunc) (*CommandExplanation, error) {
+	cmdline = strings.TrimSpace(cmdline)
+	stages, err := SplitCommandLine(cmdline)
+	if err != nil {
+		return nil, err
+	}
+
+	stageList := strings.Builder{}
+	for i, stage := range stages {
+		fmt.Fprintf(&stageList, "%d. %s\n", i+1, stage.Text)
+	}
+
+	commandDocs := ""
+	if docs != nil {
+		commandDocs = stagesCommandDocs(this.Ctx, stages, docs)
+	}
+
+	explainPrompt, err := this.PromptLibrary.GetPrompt(prompt.PromptExplainCommand,
+		"command", cmdline,
+		"stages", stageList.String(),
+		"docs", commandDocs)
+	if err != nil {
+		return nil, err
+	}
+	sysMsg, err := this.PromptLibrary.GetPrompt(prompt.PromptSystemMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := commandExplanationSchema()
+	schemaJson, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &util.CompletionRequest{
+		Ctx:           this.Ctx,
+		Prompt:        explainPrompt,
+		Model:         model,
+		MaxTokens:     numTokens,
+		Temperature:   0,
+		SystemMessage: sysMsg,
+		Verbose:       this.Config.Verbose > 0,
+		TokenTimeout:  this.Config.TokenTimeout,
+		JSONSchema:    json.RawMessage(schemaJson),
+	}
+	this.Config.LimitRequest(FeaturePrompt, req)
+
+	output, err := this.structuredCompletion(req, schema, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	explanation := &CommandExplanation{}
+	err = json.Unmarshal([]byte(output), explanation)
+	if err != nil {
+		return nil, err
+	}
+	explanation.Command = cmdline
+
+	// Our own split is authoritative for the stage text and operators, the
+	// model's is only used if it disagrees about how many stages there are
+	if len(explanation.Stages) == len(stages) {
+		for i, stage := range stages {
+			explanation.Stages[i].Command = stage.Text
+			explanation.Stages[i].Operator = stage.Operator
+		}
+	}
+
+	return explanation, nil
+}
+
+// Render an explanation like a man page
+func (this *ButterfishCtx) PrintExplanation(explanation *CommandExplanation) {
+	heading := this.Config.Styles.Highlight
+	indent := "       "
+
+	this.StylePrintf(heading, "COMMAND\n")
+	this.Printf("%s%s\n\n", indent, explanation.Command)
+	this.StylePrintf(heading, "DESCRIPTION\n")
+	this.Printf("%s%s\n\n", indent, explanation.Summary)
+
+	if len(explanation.Stages) > 0 {
+		this.StylePrintf(heading, "STAGES\n")
+	}
+	for i, stage := range explanation.Stages {
+		operator := ""
+		if stage.Operator != "" {
+			operator = stage.Operator + " "
+		}
+		this.StylePrintf(this.Config.Styles.Answer, "%s%s%s\n", indent, operator, stage.Command)
+		this.Printf("%s    %s\n", indent, stage.Explanation)
+
+		width := 0
+		for _, arg := range stage.Arguments {
+			width = max(width, len(arg.Argument))
+		}
+		width = min(width, 24)
+
+		for _, arg := range stage.Arguments {
+			this.Printf("%s    %-*s  %s\n", indent, width, arg.Argument, arg.Explanation)
+		}
+		if i < len(explanation.Stages)-1 {
+			this.Printf("\n")
+		}
+	}
+
+	if len(explanation.Warnings) > 0 {
+		this.Printf("\n")
+		this.StylePrintf(heading, "WARNINGS\n")
+		for _, warning := range explanation.Warnings {
+			this.StylePrintf(this.Config.Styles.Error, "%s%s\n", indent, warning)
+		}
+	}
+}
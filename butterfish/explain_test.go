@@ -0,0 +1,127 @@
+package butterfish
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	stages, err := SplitCommandLine(`find . -name "*.go" | xargs grep -l 'foo | bar' 2>&1 && echo done\;; # comment`)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(stages))
+
+	assert.Equal(t, "", stages[0].Operator)
+	assert.Equal(t, `find . -name "*.go"`, stages[0].Text)
+	assert.Equal(t, []string{"find", ".", "-name", "*.go"}, stages[0].Words)
+
+	assert.Equal(t, "|", stages[1].Operator)
+	assert.Equal(t, []string{"xargs", "grep", "-l", "foo | bar", "2>&1"}, stages[1].Words)
+
+	assert.Equal(t, "&&", stages[2].Operator)
+	assert.Equal(t, []string{"echo", "done;"}, stages[2].Words)
+
+	stages, err = SplitCommandLine("cd /tmp\n\nls -la")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(stages))
+	assert.Equal(t, ";", stages[1].Operator)
+
+	for _, cmdline := range []string{
+		"",
+		"ls |",
+		"| grep foo",
+		"ls && && pwd",
+		`echo "unterminated`,
+		"echo 'unterminated",
+	} {
+		_, err = SplitCommandLine(cmdline)
+		assert.NotNil(t, err, cmdline)
+	}
+}
+
+func TestExplainCommand(t *testing.T) {
+	llm := &scriptedLLM{responses: []string{`{
+		"summary": "List files and count them",
+		"stages": [
+			{"command": "ls", "explanation": "List files", "arguments": [{"argument": "-a", "explanation": "Include hidden files"}]},
+			{"command": "wc -l", "explanation": "Count lines", "arguments": []}
+		],
+		"warnings": []
+	}`}}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+	}
+
+	docs := func(ctx context.Context, name string) string {
+		if name == "ls" {
+			return "LS(1)\n\nNAME\n  ls - list\n\nOPTIONS\n  -a, --all\n    do not ignore entries starting with .\n"
+		}
+		return ""
+	}
+
+	explanation, err := butterfish.ExplainCommand(" ls -a|wc -l ", "gpt-4o", 100, docs)
+	assert.Nil(t, err)
+	assert.Equal(t, "ls -a|wc -l", explanation.Command)
+	assert.Equal(t, 2, len(explanation.Stages))
+	assert.Equal(t, "ls -a", explanation.Stages[0].Command)
+	assert.Equal(t, "|", explanation.Stages[1].Operator)
+	assert.Equal(t, "Include hidden files", explanation.Stages[0].Arguments[0].Explanation)
+	assert.NotNil(t, llm.requests[0].JSONSchema)
+	assert.Equal(t, float32(0), llm.requests[0].Temperature)
+	assert.Contains(t, llm.requests[0].Prompt, "Documentation for ls:")
+	assert.Contains(t, llm.requests[0].Prompt, "do not ignore entries")
+	assert.NotContains(t, llm.requests[0].Prompt, "Documentation for wc:")
+}
+
+func TestCommandDocsExtract(t *testing.T) {
+	docs := `TAR(1)
+
+NAME
+       tar - an archiving utility
+
+SYNOPSIS
+       tar [OPTION...] [FILE]...
+
+DESCRIPTION
+       GNU tar saves many files together into a single tape or disk archive.
+       It can restore individual files from the archive.
+       Line 1
+       Line 2
+       Line 3
+       Line 4
+       Line 5
+
+OPTIONS
+       -c, --create
+              Create a new archive.
+
+       -x, --extract, --get
+              Extract files from an archive.
+              Arguments are optional.
+       -v, --verbose
+              Verbosely list files processed.
+
+       -f, --file=ARCHIVE
+              Use archive file or device ARCHIVE.
+       --exclude=PATTERN
+              Exclude files matching PATTERN.
+`
+	extract := CommandDocsExtract(docs, []string{"-xvf", "--exclude"})
+	assert.Contains(t, extract, "tar - an archiving utility")
+	assert.Contains(t, extract, "Extract files from an archive.\n              Arguments are optional.\n")
+	assert.Contains(t, extract, "Verbosely list files")
+	assert.Contains(t, extract, "Use archive file")
+	assert.Contains(t, extract, "Exclude files matching PATTERN.")
+	assert.NotContains(t, extract, "Create a new archive")
+	assert.NotContains(t, extract, "Line 5")
+
+	name, flags := stageCommandAndFlags(&CommandStage{
+		Words: []string{"FOO=1", "sudo", "tar", "-xvf", "a.tar", "--exclude=*.log", "--", "-weird"},
+	})
+	assert.Equal(t, "tar", name)
+	assert.Equal(t, []string{"-xvf", "--exclude"}, flags)
+}
@@ -0,0 +1,167 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// A profile can list fallback models to fail over to, in order, when the
+// primary model errors, times out, or is still rate limited after its
+// retries. A fallback can be on another OpenAI compatible provider, e.g. a
+// local llama served by ollama. The model that actually answered is set on
+// the response so that commands can tell the user, and each failover is
+// logged.
+
+type Fallback struct {
+	Model string `yaml:"model"`
+	// Provider, leave these out to use the same one as the primary model
+	BaseURL        string `yaml:"base_url,omitempty"`
+	OpenAIToken    string `yaml:"openai_token,omitempty"`
+	OpenAITokenEnv string `yaml:"openai_token_env,omitempty"`
+}
+
+// Resolve the API token for this fallback, returns an empty string if it
+// doesn't specify one.
+func (this *Fallback) Token() string {
+	if this.OpenAIToken != "" {
+		return this.OpenAIToken
+	}
+	if this.OpenAITokenEnv != "" {
+		return os.Getenv(this.OpenAITokenEnv)
+	}
+	return ""
+}
+
+type failoverBackend struct {
+	// Empty for the primary, which answers with the requested model
+	model string
+	llm   LLM
+}
+
+// An LLM wrapper that tries each backend in order until one answers
+type FailoverLLM struct {
+	backends []failoverBackend
+}
+
+func NewFailoverLLM(primary LLM) *FailoverLLM {
+	return &FailoverLLM{
+		backends: []failoverBackend{{llm: primary}},
+	}
+}
+
+// Add a fallback model, tried after the ones added before it
+func (this *FailoverLLM) Add(model string, llm LLM) {
+	this.backends = append(this.backends, failoverBackend{model: model, llm: llm})
+}
+
+// Unwraps to the primary
+func (this *FailoverLLM) Unwrap() LLM {
+	return this.backends[0].llm
+}
+
+// Whether a failed request is worth sending to the next model
+func shouldFailOver(request *util.CompletionRequest, err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	// the caller gave up, e.g. autosuggest after more typing
+	return request.Ctx == nil || request.Ctx.Err() == nil
+}
+
+func (this *FailoverLLM) try(
+	request *util.CompletionRequest,
+	call func(llm LLM, request *util.CompletionRequest) (*util.CompletionResponse, error),
+	canFailOver func() bool,
+) (*util.CompletionResponse, error) {
+	failures := []string{}
+
+	for i, backend := range this.backends {
+		req := request
+		if backend.model != "" {
+			copied := *request
+			copied.Model = backend.model
+			req = &copied
+		}
+
+		response, err := call(backend.llm, req)
+		if err == nil {
+			if i > 0 && response != nil {
+				response.Model = req.Model
+			}
+			return response, nil
+		}
+
+		failures = append(failures, fmt.Sprintf("%s: %s", req.Model, err))
+		if i == len(this.backends)-1 || !shouldFailOver(request, err) || !canFailOver() {
+			if i > 0 {
+				return response, fmt.Errorf("All models failed, %s: %w", strings.Join(failures[:i], ", "), err)
+			}
+			return response, err
+		}
+
+		next := this.backends[i+1].model
+		log.Printf("%s failed (%s), failing over to %s\n", req.Model, err, next)
+		if request.Verbose {
+			PrintLoggingBox(LoggingBox{
+				Title:   " Failover ",
+				Content: fmt.Sprintf("%s failed: %s\ntrying %s", req.Model, err, next),
+				Color:   3,
+			})
+		}
+	}
+
+	// unreachable, there's always a primary
+	return nil, errors.New("No models to try")
+}
+
+// Tracks whether anything was streamed, once part of an answer is shown we
+// can't start over with another model
+type streamTracker struct {
+	writer io.Writer
+	wrote  bool
+}
+
+func (this *streamTracker) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		this.wrote = true
+	}
+	return this.writer.Write(p)
+}
+
+func (this *FailoverLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	tracker := &streamTracker{writer: writer}
+	return this.try(request,
+		func(llm LLM, request *util.CompletionRequest) (*util.CompletionResponse, error) {
+			return llm.CompletionStream(request, tracker)
+		},
+		func() bool { return !tracker.wrote })
+}
+
+func (this *FailoverLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	return this.try(request,
+		func(llm LLM, request *util.CompletionRequest) (*util.CompletionResponse, error) {
+			return llm.Completion(request)
+		},
+		func() bool { return true })
+}
+
+// Embeddings always come from the primary, the index has to be built and
+// searched with a single model
+func (this *FailoverLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	return this.backends[0].llm.Embeddings(ctx, input, verbose)
+}
+
+// A note for the user when a fallback model answered, empty otherwise
+func failoverNote(request *util.CompletionRequest, response *util.CompletionResponse) string {
+	if response == nil || response.Model == "" || response.Model == request.Model {
+		return ""
+	}
+	return fmt.Sprintf("(answered by %s, %s failed)", response.Model, request.Model)
+}
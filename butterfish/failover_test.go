@@ -0,0 +1,132 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Fails with err if set, otherwise answers with the requested model
+type failoverTestLLM struct {
+	err      error
+	partial  string
+	refusal  string
+	requests []string
+}
+
+func (this *failoverTestLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	writer.Write([]byte(this.partial))
+	response, err := this.Completion(request)
+	if err == nil {
+		writer.Write([]byte(response.Completion))
+	}
+	return response, err
+}
+
+func (this *failoverTestLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	this.requests = append(this.requests, request.Model)
+	if this.err != nil {
+		return nil, this.err
+	}
+	if this.refusal != "" {
+		return &util.CompletionResponse{Refusal: this.refusal}, nil
+	}
+	return &util.CompletionResponse{Completion: "from " + request.Model}, nil
+}
+
+func (this *failoverTestLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	return nil, nil
+}
+
+func TestFailoverLLM(t *testing.T) {
+	primary := &failoverTestLLM{err: &openai.APIError{HTTPStatusCode: 429, Message: "rate limited"}}
+	broken := &failoverTestLLM{err: errors.New("connection refused")}
+	local := &failoverTestLLM{}
+	llm := NewFailoverLLM(primary)
+	llm.Add("claude-3-5-sonnet", broken)
+	llm.Add("llama3.2", local)
+
+	request := &util.CompletionRequest{Ctx: context.Background(), Model: "gpt-4o"}
+	out := new(bytes.Buffer)
+	response, err := llm.CompletionStream(request, out)
+	assert.Nil(t, err)
+	assert.Equal(t, "from llama3.2", out.String())
+	assert.Equal(t, "llama3.2", response.Model)
+	assert.Equal(t, "(answered by llama3.2, gpt-4o failed)", failoverNote(request, response))
+	assert.Equal(t, []string{"gpt-4o"}, primary.requests)
+	assert.Equal(t, []string{"claude-3-5-sonnet"}, broken.requests)
+	// the caller's request is left alone
+	assert.Equal(t, "gpt-4o", request.Model)
+
+	// the primary answering isn't noted
+	primary.err = nil
+	response, err = llm.Completion(request)
+	assert.Nil(t, err)
+	assert.Equal(t, "", response.Model)
+	assert.Equal(t, "", failoverNote(request, response))
+
+	// every model failing reports each failure
+	primary.err = errors.New("timeout")
+	local.err = errors.New("model not found")
+	_, err = llm.Completion(request)
+	assert.EqualError(t, err, "All models failed, gpt-4o: timeout, claude-3-5-sonnet: connection refused: model not found")
+}
+
+func TestFailoverLLMStops(t *testing.T) {
+	primary := &failoverTestLLM{err: errors.New("stream broke"), partial: "half an answer"}
+	fallback := &failoverTestLLM{}
+	llm := NewFailoverLLM(primary)
+	llm.Add("llama3.2", fallback)
+
+	// part of the answer was already shown
+	out := new(bytes.Buffer)
+	_, err := llm.CompletionStream(&util.CompletionRequest{Model: "gpt-4o"}, out)
+	assert.EqualError(t, err, "stream broke")
+	assert.Equal(t, "half an answer", out.String())
+
+	// the caller gave up
+	primary.err = context.Canceled
+	_, err = llm.Completion(&util.CompletionRequest{Model: "gpt-4o"})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	primary.err = errors.New("timeout")
+	_, err = llm.Completion(&util.CompletionRequest{Ctx: ctx, Model: "gpt-4o"})
+	assert.EqualError(t, err, "timeout")
+	assert.Empty(t, fallback.requests)
+}
+
+func TestLoadConfigFileFallbacks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`
+profiles:
+  work:
+    fallbacks:
+      - model: gpt-4o-mini
+      - model: llama3.2
+        base_url: http://localhost:11434/v1
+`), 0644)
+	assert.Nil(t, err)
+
+	configFile, err := LoadConfigFile(path)
+	assert.Nil(t, err)
+	fallbacks := configFile.Profiles["work"].Fallbacks
+	assert.Equal(t, 2, len(fallbacks))
+	assert.Equal(t, "llama3.2", fallbacks[1].Model)
+	assert.Equal(t, "http://localhost:11434/v1", fallbacks[1].BaseURL)
+
+	err = os.WriteFile(path, []byte("profiles:\n  work:\n    fallbacks:\n      - base_url: http://localhost:11434/v1\n"), 0644)
+	assert.Nil(t, err)
+	_, err = LoadConfigFile(path)
+	assert.ErrorContains(t, err, "Fallback without a model in profile work")
+}
@@ -0,0 +1,112 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// When the LLM can't be reached the exec fix loop falls back to these local
+// heuristics, which recognize a few common failures from the command output
+// and suggest a fix without calling the API.
+
+type localFix struct {
+	// Shown to the user, explains what we think went wrong
+	Explanation string
+	// A command to run instead, empty if we can only explain
+	Command string
+}
+
+// Package managers in the order we prefer them, with the install command
+var packageManagers = []struct {
+	bin     string
+	install string
+}{
+	{"brew", "brew install %s"},
+	{"apt-get", "sudo apt-get install %s"},
+	{"dnf", "sudo dnf install %s"},
+	{"yum", "sudo yum install %s"},
+	{"pacman", "sudo pacman -S %s"},
+	{"apk", "sudo apk add %s"},
+	{"zypper", "sudo zypper install %s"},
+}
+
+// Matches the messages from zsh, bash, and dash respectively
+var commandNotFoundRegexes = []*regexp.Regexp{
+	regexp.MustCompile(`command not found: ([^\s:]+)`),
+	regexp.MustCompile(`([^\s:]+): command not found`),
+	regexp.MustCompile(`([^\s:]+): not found`),
+}
+
+var permissionDeniedRegex = regexp.MustCompile(`(?i)permission denied|operation not permitted|EACCES`)
+
+// Returns true if the error means the API couldn't be reached or didn't
+// answer, rather than that it rejected the request, e.g. for a bad API key
+func llmUnreachable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || retryableError(err) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// Suggest a fix for a failed command from its output, returns nil if nothing
+// matched. lookPath is used to detect the package manager, i.e. exec.LookPath.
+func suggestLocalFix(
+	cmd string,
+	status int,
+	output string,
+	lookPath func(string) (string, error),
+) *localFix {
+	for _, regex := range commandNotFoundRegexes {
+		matches := regex.FindStringSubmatch(output)
+		if len(matches) != 2 {
+			continue
+		}
+
+		program := matches[1]
+		for _, manager := range packageManagers {
+			if _, err := lookPath(manager.bin); err == nil {
+				return &localFix{
+					Explanation: fmt.Sprintf("%s isn't installed or isn't on your PATH, try installing it with %s. The package name may be different from the command name.", program, manager.bin),
+					Command:     fmt.Sprintf(manager.install, program),
+				}
+			}
+		}
+
+		return &localFix{
+			Explanation: fmt.Sprintf("%s isn't installed or isn't on your PATH, and no package manager was found to install it with.", program),
+		}
+	}
+
+	if !permissionDeniedRegex.MatchString(output) {
+		return nil
+	}
+
+	// 126 means the shell found the command but couldn't execute it, usually
+	// a script without the executable bit
+	fields := strings.Fields(cmd)
+	if status == 126 && len(fields) > 0 && strings.Contains(fields[0], "/") {
+		return &localFix{
+			Explanation: fmt.Sprintf("%s isn't executable, try making it executable.", fields[0]),
+			Command:     fmt.Sprintf("chmod +x %s && %s", fields[0], cmd),
+		}
+	}
+
+	if len(fields) > 0 && fields[0] == "sudo" {
+		return &localFix{
+			Explanation: "The command was denied permission even with sudo, check the ownership and permissions of the files it uses.",
+		}
+	}
+
+	return &localFix{
+		Explanation: "The command was denied permission, try running it with sudo.",
+		Command:     "sudo " + cmd,
+	}
+}
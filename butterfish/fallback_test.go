@@ -0,0 +1,55 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSuggestLocalFix(t *testing.T) {
+	onlyApt := func(bin string) (string, error) {
+		if bin == "apt-get" {
+			return "/usr/bin/apt-get", nil
+		}
+		return "", errors.New("not found")
+	}
+	nothing := func(bin string) (string, error) {
+		return "", errors.New("not found")
+	}
+
+	fix := suggestLocalFix("jq .foo x.json", 127, "zsh: command not found: jq\n", onlyApt)
+	assert.Equal(t, "sudo apt-get install jq", fix.Command)
+
+	fix = suggestLocalFix("rg foo", 127, "bash: rg: command not found\n", onlyApt)
+	assert.Equal(t, "sudo apt-get install rg", fix.Command)
+
+	fix = suggestLocalFix("rg foo", 127, "/bin/sh: 1: rg: not found\n", nothing)
+	assert.Equal(t, "", fix.Command)
+	assert.Contains(t, fix.Explanation, "no package manager")
+
+	fix = suggestLocalFix("./build.sh --release", 126, "/bin/sh: 1: ./build.sh: Permission denied\n", nothing)
+	assert.Equal(t, "chmod +x ./build.sh && ./build.sh --release", fix.Command)
+
+	fix = suggestLocalFix("cat /etc/shadow", 1, "cat: /etc/shadow: Permission denied\n", nothing)
+	assert.Equal(t, "sudo cat /etc/shadow", fix.Command)
+
+	fix = suggestLocalFix("sudo rm /mnt/ro/x", 1, "rm: cannot remove '/mnt/ro/x': Operation not permitted\n", nothing)
+	assert.Equal(t, "", fix.Command)
+
+	assert.Nil(t, suggestLocalFix("false", 1, "", onlyApt))
+}
+
+func TestLLMUnreachable(t *testing.T) {
+	assert.False(t, llmUnreachable(nil))
+	assert.False(t, llmUnreachable(context.Canceled))
+	assert.False(t, llmUnreachable(&openai.APIError{HTTPStatusCode: 401, Message: "Incorrect API key"}))
+
+	assert.True(t, llmUnreachable(&openai.APIError{HTTPStatusCode: 503}))
+	assert.True(t, llmUnreachable(&timedOutError{"Request timed out"}))
+	assert.True(t, llmUnreachable(fmt.Errorf("Post: %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")})))
+}
@@ -0,0 +1,222 @@
+package butterfish
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai/jsonschema"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// gencmd --json prints the command and a one line explanation as JSON, so
+// scripts and editor plugins don't have to guess where the command is in the
+// output, and --explain prints the explanation under the command. Both ask
+// for structured output, plain gencmd asks for only the command.
+//
+// On a terminal gencmd then asks whether to run the command, edit it, or
+// generate it again with feedback, like confirming a command in goal mode.
+// Commands that are run are appended to the shell's history file so they can
+// be recalled with the up arrow.
+
+type GeneratedCommand struct {
+	Command     string `json:"command"`
+	Explanation string `json:"explanation"`
+}
+
+func generatedCommandSchema() jsonschema.Definition {
+	return jsonschema.Definition{
+		Type: jsonschema.Object,
+		Properties: map[string]jsonschema.Definition{
+			"command":     {Type: jsonschema.String, Description: "The shell command, on one line unless it needs more"},
+			"explanation": {Type: jsonschema.String, Description: "One short line on how the command works"},
+		},
+		Required:             []string{"command", "explanation"},
+		AdditionalProperties: false,
+	}
+}
+
+// Generate a shell command from a description along with an explanation of it
+func (this *ButterfishCtx) GenerateExplainedCommand(description string) (*GeneratedCommand, error) {
+	model := this.Config.GencmdModel
+	promptStr, err := this.PromptLibrary.GetPromptForModel(prompt.PromptGenerateExplained,
+		model, "content", description)
+	if err != nil {
+		return nil, err
+	}
+	sysMsg, err := this.PromptLibrary.GetPromptForModel(prompt.PromptSystemMessage, model)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := generatedCommandSchema()
+	schemaJson, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &util.CompletionRequest{
+		Ctx:           this.Ctx,
+		Prompt:        promptStr,
+		Model:         model,
+		MaxTokens:     this.Config.GencmdMaxTokens,
+		Temperature:   this.Config.GencmdTemperature,
+		SystemMessage: sysMsg,
+		Verbose:       this.Config.Verbose > 0,
+		TokenTimeout:  this.Config.TokenTimeout,
+		JSONSchema:    json.RawMessage(schemaJson),
+	}
+	this.Config.LimitRequest(FeatureGencmd, req)
+
+	output, err := this.structuredCompletion(req, schema, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	generated := &GeneratedCommand{}
+	err = json.Unmarshal([]byte(output), generated)
+	if err != nil {
+		return nil, err
+	}
+	generated.Command = strings.TrimSpace(generated.Command)
+	generated.Explanation = strings.TrimSpace(generated.Explanation)
+
+	this.updateCommandRegister(generated.Command)
+	return generated, nil
+}
+
+// Generates a command from a description, with an explanation if asked for
+type commandGenerator func(description string) (*GeneratedCommand, error)
+
+// Add feedback on a generated command to the description so the next attempt
+// takes it into account
+func gencmdFeedback(description, cmd, feedback string) string {
+	return fmt.Sprintf("%s\n\nA previous attempt was `%s`, change it as follows: %s",
+		description, cmd, feedback)
+}
+
+// Show a generated command and ask what to do with it, reading answers from
+// in until the command is run or the user gives up
+func (this *ButterfishCtx) gencmdMenu(
+	in io.Reader,
+	description string,
+	generated *GeneratedCommand,
+	generate commandGenerator,
+) error {
+	reader := bufio.NewReader(in)
+	readLine := func() string {
+		line, _ := reader.ReadString('\n')
+		return strings.TrimSpace(line)
+	}
+
+	for {
+		this.StylePrintf(this.Config.Styles.Highlight, "%s\n", generated.Command)
+		if generated.Explanation != "" {
+			this.StylePrintf(this.Config.Styles.Grey, "%s\n", generated.Explanation)
+		}
+		this.StylePrintf(this.Config.Styles.Question, "Run this command? [r(un)/e(dit)/g(enerate again)/N]: ")
+
+		switch strings.ToLower(readLine()) {
+		case "r", "y":
+			err := appendShellHistory(generated.Command)
+			if err != nil {
+				this.ErrorPrintf("Could not add the command to your shell history: %s\n", err)
+			}
+			_, err = this.execCommand(generated.Command)
+			return err
+
+		case "e":
+			cmd, err := editInEditor("", "butterfish-gencmd-*.sh", generated.Command)
+			if err != nil {
+				return err
+			}
+			if cmd == "" {
+				return nil
+			}
+			generated = &GeneratedCommand{Command: cmd}
+
+		case "g":
+			this.StylePrintf(this.Config.Styles.Question, "What should change? ")
+			feedback := readLine()
+			if feedback != "" {
+				description = gencmdFeedback(description, generated.Command, feedback)
+			}
+			next, err := generate(description)
+			if err != nil {
+				return err
+			}
+			generated = next
+
+		default:
+			return nil
+		}
+	}
+}
+
+// The user's shell history file, $HISTFILE if it's exported, otherwise the
+// default for $SHELL
+func shellHistoryFile() string {
+	if path := os.Getenv("HISTFILE"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	switch filepath.Base(os.Getenv("SHELL")) {
+	case "zsh":
+		return filepath.Join(home, ".zsh_history")
+	case "bash":
+		return filepath.Join(home, ".bash_history")
+	}
+	return ""
+}
+
+var (
+	zshHistoryRegex  = regexp.MustCompile(`^: \d+:\d+;`)
+	bashHistoryRegex = regexp.MustCompile(`^#\d+$`)
+)
+
+// Format a history entry like the existing ones in history: zsh's extended
+// format, bash with timestamps, or one command per line
+func formatHistoryEntry(history []byte, cmd string, now time.Time) string {
+	lines := strings.Split(strings.TrimRight(string(history), "\n"), "\n")
+	last := lines[len(lines)-1]
+	if zshHistoryRegex.MatchString(last) {
+		cmd = strings.ReplaceAll(cmd, "\n", "\\\n")
+		return fmt.Sprintf(": %d:0;%s\n", now.Unix(), cmd)
+	}
+	if len(lines) > 1 && bashHistoryRegex.MatchString(lines[len(lines)-2]) {
+		return fmt.Sprintf("#%d\n%s\n", now.Unix(), cmd)
+	}
+	return cmd + "\n"
+}
+
+// Append a command to the shell history file. zsh with SHARE_HISTORY picks it
+// up right away, bash when it next reads the file, e.g. with history -n.
+func appendShellHistory(cmd string) error {
+	path := shellHistoryFile()
+	if path == "" {
+		return nil
+	}
+	history, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(formatHistoryEntry(history, cmd, time.Now()))
+	return err
+}
@@ -0,0 +1,198 @@
+package butterfish
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+
+	"github.com/bakks/butterfish/prompt"
+)
+
+// The gentest command writes tests for a source file. We guess the language
+// from the file extension and the test framework from the project files, e.g.
+// go.mod or package.json, then run the edit tool loop on the test file, which
+// starts empty or with the existing tests, and write it after confirmation.
+
+// The language, framework, and test file to generate tests for a source file
+type TestTarget struct {
+	Language  string
+	Framework string
+	TestPath  string
+	// Extra instructions for the prompt, e.g. the Go package name
+	Notes string
+}
+
+var goPackageRegex = regexp.MustCompile(`(?m)^package\s+(\w+)`)
+
+// Find the closest file with this name in dir or its parents, returning its
+// contents, or "" if there isn't one
+func readNearestFile(dir, name string) string {
+	for {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			return string(content)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// Guess the language and test framework for a source file, and where its
+// tests go by the language's convention. framework overrides the guess.
+func DetectTestTarget(path, source, framework string) (*TestTarget, error) {
+	dir := filepath.Dir(path)
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(filepath.Base(path), ext)
+	target := &TestTarget{}
+
+	switch ext {
+	case ".go":
+		if strings.HasSuffix(base, "_test") {
+			return nil, fmt.Errorf("%s is already a test file", path)
+		}
+		target.Language = "Go"
+		target.Framework = "go test"
+		if strings.Contains(readNearestFile(dir, "go.mod"), "github.com/stretchr/testify") {
+			target.Framework = "go test with the testify assert package"
+		}
+		target.TestPath = filepath.Join(dir, base+"_test.go")
+		if match := goPackageRegex.FindStringSubmatch(source); match != nil {
+			target.Notes = fmt.Sprintf("Put the tests in package %s so they can use unexported identifiers.", match[1])
+		}
+
+	case ".py":
+		if strings.HasPrefix(base, "test_") {
+			return nil, fmt.Errorf("%s is already a test file", path)
+		}
+		target.Language = "Python"
+		target.Framework = "pytest"
+		target.TestPath = filepath.Join(dir, "test_"+base+".py")
+		target.Notes = fmt.Sprintf("Import the code under test from the %s module.", base)
+
+	case ".js", ".jsx", ".mjs", ".cjs", ".ts", ".tsx":
+		if strings.HasSuffix(base, ".test") || strings.HasSuffix(base, ".spec") {
+			return nil, fmt.Errorf("%s is already a test file", path)
+		}
+		target.Language = "JavaScript"
+		if strings.HasPrefix(ext, ".ts") {
+			target.Language = "TypeScript"
+		}
+		target.Framework = "jest"
+		packageJson := readNearestFile(dir, "package.json")
+		if strings.Contains(packageJson, `"vitest"`) {
+			target.Framework = "vitest"
+		} else if strings.Contains(packageJson, `"mocha"`) {
+			target.Framework = "mocha"
+		}
+		target.TestPath = filepath.Join(dir, base+".test"+ext)
+		target.Notes = fmt.Sprintf("Import the code under test from ./%s.", base)
+
+	default:
+		return nil, fmt.Errorf("Can't tell what language %s is, gentest supports Go, Python, JavaScript, and TypeScript", path)
+	}
+
+	if framework != "" {
+		target.Framework = framework
+	}
+	return target, nil
+}
+
+// Write tests for the source file into an edit session of the test file,
+// which has the existing tests if there are any
+func (this *ButterfishCtx) GenerateTests(path, source string, target *TestTarget, session *EditSession, cmd *promptCommand) error {
+	testPrompt, err := this.PromptLibrary.GetPromptForModel(prompt.PromptGenerateTests, cmd.Model,
+		"language", target.Language,
+		"framework", target.Framework,
+		"path", filepath.Base(path),
+		"test_path", filepath.Base(target.TestPath),
+		"notes", target.Notes,
+		"source", source)
+	if err != nil {
+		return err
+	}
+
+	return this.editLoop(session, testPrompt, cmd)
+}
+
+func (this *ButterfishCtx) gentestCommand(options *CliCommandConfig) error {
+	opts := options.Gentest
+
+	path, err := homedir.Expand(opts.File)
+	if err != nil {
+		return err
+	}
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	target, err := DetectTestTarget(path, string(source), opts.Framework)
+	if err != nil {
+		return err
+	}
+	if opts.Output != "" {
+		target.TestPath, err = homedir.Expand(opts.Output)
+		if err != nil {
+			return err
+		}
+	}
+
+	session, err := NewEditSession(target.TestPath)
+	if err != nil {
+		return err
+	}
+	session.Journal = this.undoJournal()
+	session.Command = "gentest"
+	existing := session.Originals[session.DefaultPath]
+
+	this.StylePrintf(this.Config.Styles.Grey, "Writing %s tests with %s to %s\n",
+		target.Language, target.Framework, target.TestPath)
+
+	err = this.GenerateTests(path, string(source), target, session, &promptCommand{
+		SysMsg:      EditSysMsg,
+		Model:       opts.Model,
+		NumTokens:   opts.NumTokens,
+		Temperature: opts.Temperature,
+		NoColor:     opts.NoColor,
+		Verbose:     this.Config.Verbose,
+	})
+	if err != nil {
+		return err
+	}
+
+	testBuffer := session.Files[session.DefaultPath]
+	tests := testBuffer.String()
+	if strings.TrimSpace(tests) == strings.TrimSpace(existing) {
+		return errors.New("The model didn't write any tests")
+	}
+	if !strings.HasSuffix(tests, "\n") {
+		tests += "\n"
+		testBuffer.Lines = append(testBuffer.Lines, "")
+	}
+
+	if opts.Print {
+		fmt.Fprintf(this.Out, "%s", tests)
+		return nil
+	}
+
+	if !opts.Yes {
+		this.Printf("\n%s\n", this.renderSessionDiff(session))
+		this.StylePrintf(this.Config.Styles.Question, "Write tests to %s? [y/N]: ", target.TestPath)
+
+		var input string
+		fmt.Scanln(&input)
+		if strings.ToLower(strings.TrimSpace(input)) != "y" {
+			return nil
+		}
+	}
+
+	return session.WriteAll()
+}
@@ -0,0 +1,77 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func TestDetectTestTarget(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "go.mod"),
+		[]byte("module x\n\nrequire github.com/stretchr/testify v1.8.0\n"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "package.json"),
+		[]byte(`{"devDependencies": {"vitest": "^1.0.0"}}`), 0644))
+	sub := filepath.Join(dir, "pkg")
+
+	target, err := DetectTestTarget(filepath.Join(sub, "foo.go"), "// hi\npackage foo\n", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "Go", target.Language)
+	assert.Equal(t, "go test with the testify assert package", target.Framework)
+	assert.Equal(t, filepath.Join(sub, "foo_test.go"), target.TestPath)
+	assert.Contains(t, target.Notes, "package foo")
+
+	target, err = DetectTestTarget(filepath.Join(sub, "foo.py"), "", "unittest")
+	assert.Nil(t, err)
+	assert.Equal(t, "unittest", target.Framework)
+	assert.Equal(t, filepath.Join(sub, "test_foo.py"), target.TestPath)
+
+	target, err = DetectTestTarget(filepath.Join(sub, "foo.tsx"), "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "TypeScript", target.Language)
+	assert.Equal(t, "vitest", target.Framework)
+	assert.Equal(t, filepath.Join(sub, "foo.test.tsx"), target.TestPath)
+
+	_, err = DetectTestTarget(filepath.Join(sub, "foo_test.go"), "", "")
+	assert.NotNil(t, err)
+	_, err = DetectTestTarget(filepath.Join(sub, "foo.rs"), "", "")
+	assert.NotNil(t, err)
+}
+
+func TestGenerateTests(t *testing.T) {
+	llm := &functionCallLLM{responses: []*util.CompletionResponse{
+		{ToolCalls: []*util.ToolCall{{
+			Id: "1",
+			Function: util.FunctionCall{
+				Name:       "edit",
+				Parameters: `{"range_start": 1, "range_end": 1, "code_edit": "package foo\n\nfunc TestFoo(t *testing.T) {}\n"}`,
+			},
+		}}},
+		{Completion: "DONE!"},
+	}}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+		Out:           new(bytes.Buffer),
+	}
+
+	target := &TestTarget{Language: "Go", Framework: "go test", TestPath: "foo_test.go"}
+	session, err := NewEditSession(filepath.Join(t.TempDir(), "foo_test.go"))
+	assert.Nil(t, err)
+	err = butterfish.GenerateTests("foo.go", "package foo\n", target, session,
+		&promptCommand{SysMsg: EditSysMsg, Model: "gpt-4o", NoColor: true})
+	assert.Nil(t, err)
+	assert.Equal(t, "package foo\n\nfunc TestFoo(t *testing.T) {}\n", session.Files["foo_test.go"].String())
+	assert.Equal(t, []string{"foo_test.go"}, session.Changed())
+	assert.Equal(t, 2, len(llm.requests))
+	assert.Contains(t, llm.requests[0].HistoryBlocks[0].Content, "go test")
+	assert.Equal(t, EditTools, llm.requests[0].Tools)
+}
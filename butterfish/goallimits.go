@@ -0,0 +1,164 @@
+package butterfish
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// A goal can keep running commands for a long time if the model doesn't
+// make progress, so goal mode limits the commands it runs, the time since it
+// started, and the tokens it uses. Once a limit is reached the model is told
+// so and only offered user_input and finish, so that it hands back to the
+// user with an explanation rather than being cut off mid-step. If it carries
+// on anyway the goal stops.
+
+type GoalLimits struct {
+	// Commands run, 0 means no limit
+	MaxCommands int
+	// Time since the goal started, 0 means no limit
+	MaxTime time.Duration
+	// Estimated tokens sent and received, 0 means no limit
+	MaxTokens int
+}
+
+var DefaultGoalLimits = GoalLimits{
+	MaxCommands: 30,
+	MaxTime:     30 * time.Minute,
+}
+
+func (this GoalLimits) String() string {
+	limits := []string{}
+	if this.MaxCommands > 0 {
+		limits = append(limits, fmt.Sprintf("%d commands", this.MaxCommands))
+	}
+	if this.MaxTime > 0 {
+		limits = append(limits, this.MaxTime.String())
+	}
+	if this.MaxTokens > 0 {
+		limits = append(limits, fmt.Sprintf("%d tokens", this.MaxTokens))
+	}
+	if len(limits) == 0 {
+		return "none"
+	}
+	return strings.Join(limits, ", ")
+}
+
+// What a goal has used so far. Sub-agents share their parent's usage, so it's
+// safe to use from several goroutines through its methods.
+type GoalUsage struct {
+	mutex sync.Mutex
+
+	Limits   GoalLimits
+	Start    time.Time
+	Commands int
+	Tokens   int
+	// The limit the model has been told it reached, empty until then
+	Reached string
+}
+
+func NewGoalUsage(limits GoalLimits) *GoalUsage {
+	return &GoalUsage{
+		Limits: limits,
+		Start:  time.Now(),
+	}
+}
+
+// The limit that has been reached, empty if there's none
+func (this *GoalUsage) Exceeded() string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.exceeded()
+}
+
+// Like Exceeded, but also records the limit as Reached
+func (this *GoalUsage) Reach() string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	limit := this.exceeded()
+	if limit != "" {
+		this.Reached = limit
+	}
+	return limit
+}
+
+// Count a command that's about to run, false if it would go over
+// MaxCommands, e.g. because sub-agents ran commands since the limits were
+// last checked
+func (this *GoalUsage) StartCommand() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.Limits.MaxCommands > 0 && this.Commands >= this.Limits.MaxCommands {
+		return false
+	}
+	this.Commands++
+	return true
+}
+
+func (this *GoalUsage) AddTokens(tokens int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.Tokens += tokens
+}
+
+func (this *GoalUsage) exceeded() string {
+	limits := this.Limits
+	switch {
+	case limits.MaxCommands > 0 && this.Commands >= limits.MaxCommands:
+		return fmt.Sprintf("the limit of %d commands", limits.MaxCommands)
+	case limits.MaxTime > 0 && time.Since(this.Start) >= limits.MaxTime:
+		return fmt.Sprintf("the time limit of %s", limits.MaxTime)
+	case limits.MaxTokens > 0 && this.Tokens >= limits.MaxTokens:
+		return fmt.Sprintf("the limit of %d tokens", limits.MaxTokens)
+	}
+	return ""
+}
+
+func (this *GoalUsage) String() string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	of := func(limit string, set bool) string {
+		if !set {
+			return ""
+		}
+		return " of " + limit
+	}
+	limits := this.Limits
+	return fmt.Sprintf("%d%s commands, %s%s, ~%d%s tokens",
+		this.Commands, of(fmt.Sprint(limits.MaxCommands), limits.MaxCommands > 0),
+		time.Since(this.Start).Round(time.Second), of(limits.MaxTime.String(), limits.MaxTime > 0),
+		this.Tokens, of(fmt.Sprint(limits.MaxTokens), limits.MaxTokens > 0))
+}
+
+// Tell the model it has to stop, added to the next prompt
+func goalLimitMessage(prompt, reason string) string {
+	message := fmt.Sprintf("You've reached %s for this goal. Don't run any more commands, call user_input to hand the goal back to the user or call finish.", reason)
+	if prompt == "" {
+		return message
+	}
+	return prompt + "\n\n" + message
+}
+
+// The goal mode functions that are still offered once a limit is reached
+var goalModeStopFunctions = func() []util.FunctionDefinition {
+	functions := []util.FunctionDefinition{}
+	for _, function := range goalModeFunctions {
+		if function.Name == "user_input" || function.Name == "finish" {
+			functions = append(functions, function)
+		}
+	}
+	return functions
+}()
+
+// Whether a function stops the goal or hands it back to the user
+func isGoalStopFunction(name string) bool {
+	for _, function := range goalModeStopFunctions {
+		if function.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package butterfish
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGoalUsage(t *testing.T) {
+	usage := NewGoalUsage(GoalLimits{MaxCommands: 2, MaxTokens: 100})
+	assert.Equal(t, "", usage.Exceeded())
+	assert.Equal(t, "0 of 2 commands, 0s, ~0 of 100 tokens", usage.String())
+
+	usage.Tokens = 100
+	assert.Equal(t, "the limit of 100 tokens", usage.Exceeded())
+	usage.Commands = 2
+	assert.Equal(t, "the limit of 2 commands", usage.Exceeded())
+
+	usage = NewGoalUsage(GoalLimits{MaxTime: time.Minute})
+	usage.Start = time.Now().Add(-2 * time.Minute)
+	assert.Equal(t, "the time limit of 1m0s", usage.Exceeded())
+
+	assert.Equal(t, "none", GoalLimits{}.String())
+	assert.Equal(t, "30 commands, 30m0s", DefaultGoalLimits.String())
+}
+
+func TestGoalModeStopFunctions(t *testing.T) {
+	names := []string{}
+	for _, function := range goalModeStopFunctions {
+		names = append(names, function.Name)
+	}
+	assert.Equal(t, []string{"user_input", "finish"}, names)
+	assert.False(t, isGoalStopFunction("command"))
+	assert.False(t, isGoalStopFunction(""))
+}
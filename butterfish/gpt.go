@@ -3,12 +3,12 @@ package butterfish
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"math"
+	"net/http"
 	"strings"
 	"time"
 
@@ -19,26 +19,13 @@ import (
 const ERR_429 = "429:insufficient_quota"
 const ERR_429_HELP = "You are likely using a free OpenAI account without a subscription activated, this error means you are out of credits. To resolve it, set up a subscription at https://platform.openai.com/account/billing/overview. This requires a credit card and payment, run `butterfish help` for guidance on managing cost. Once you have a subscription set up you must issue a NEW OpenAI token, your previous token will not reflect the subscription."
 
-var LegacyModelTypes = []string{
-	openai.GPT3TextAda001,
-	openai.GPT3TextBabbage001,
-	openai.GPT3TextCurie001,
-	openai.GPT3TextDavinci001,
-	openai.GPT3TextDavinci002,
-	openai.GPT3TextDavinci003,
-}
-
-func IsLegacyModel(model string) bool {
-	for _, legacyModel := range LegacyModelTypes {
-		if model == legacyModel {
-			return true
-		}
-	}
-	return false
-}
-
+// The OpenAI backend, retries and timeouts between them are left to the
+// retry middleware, see middleware.go
 type GPT struct {
 	client *openai.Client
+	// Whether the API supports response_format json_schema, we assume only
+	// OpenAI itself does and emulate it with a tool call elsewhere
+	nativeJSONSchema bool
 }
 
 func NewGPT(token, baseUrl string) *GPT {
@@ -46,11 +33,51 @@ func NewGPT(token, baseUrl string) *GPT {
 	if baseUrl != "" {
 		config.BaseURL = baseUrl
 	}
+	config.HTTPClient = &http.Client{
+		Transport: &retryAfterTransport{base: http.DefaultTransport},
+	}
 
 	client := openai.NewClientWithConfig(config)
 
 	return &GPT{
-		client: client,
+		client:           client,
+		nativeJSONSchema: strings.Contains(config.BaseURL, "api.openai.com"),
+	}
+}
+
+// Name of the tool we force the model to call when emulating structured output
+const jsonSchemaToolName = "respond"
+
+// Set up a chat request to return JSON matching the request's schema, either
+// with response_format or by forcing a call to a tool whose parameters are
+// the schema.
+func (this *GPT) applyJSONSchema(req *openai.ChatCompletionRequest, request *util.CompletionRequest) {
+	if request.JSONSchema == nil {
+		return
+	}
+
+	if this.nativeJSONSchema {
+		req.ResponseFormat = &openai.ChatCompletionResponseFormat{
+			Type: openai.ChatCompletionResponseFormatTypeJSONSchema,
+			JSONSchema: &openai.ChatCompletionResponseFormatJSONSchema{
+				Name:   "response",
+				Schema: request.JSONSchema,
+			},
+		}
+		return
+	}
+
+	req.Tools = []openai.Tool{{
+		Type: openai.ToolTypeFunction,
+		Function: &openai.FunctionDefinition{
+			Name:        jsonSchemaToolName,
+			Description: "Respond with structured output",
+			Parameters:  request.JSONSchema,
+		},
+	}}
+	req.ToolChoice = openai.ToolChoice{
+		Type:     openai.ToolTypeFunction,
+		Function: openai.ToolFunction{Name: jsonSchemaToolName},
 	}
 }
 
@@ -73,171 +100,6 @@ func JSONString(input any) string {
 	return string(prettyJSON)
 }
 
-func LogCompletionResponse(resp util.CompletionResponse, id string) {
-	box := LoggingBox{
-		Title:    "Completion Response " + id,
-		Content:  resp.Completion,
-		Color:    0,
-		Children: []LoggingBox{},
-	}
-
-	if resp.FunctionName != "" {
-		params := PrettyJSON(resp.FunctionParameters)
-		box.Children = []LoggingBox{
-			{
-				Title:   "Function Call",
-				Content: fmt.Sprintf("%s\n%s", resp.FunctionName, params),
-				Color:   2,
-			},
-		}
-	}
-
-	if resp.ToolCalls != nil {
-		for _, toolCall := range resp.ToolCalls {
-			params := PrettyJSON(toolCall.Function.Parameters)
-			box.Children = append(box.Children, LoggingBox{
-				Title:   "Tool Call",
-				Content: fmt.Sprintf("%s  %s\n%s", toolCall.Function.Name, toolCall.Id, params),
-				Color:   2,
-			})
-		}
-	}
-
-	PrintLoggingBox(box)
-}
-
-func LogCompletionRequest(req openai.CompletionRequest) {
-	meta := fmt.Sprintf("model:       %s\ntemperature: %f\nmax_tokens:  %d",
-		req.Model, req.Temperature, req.MaxTokens)
-
-	box := LoggingBox{
-		Title:   " Completion Request /v1/completions ",
-		Content: meta,
-		Color:   0,
-		Children: []LoggingBox{
-			{
-				Title:   "Prompt",
-				Content: req.Prompt.(string),
-				Color:   1,
-			},
-		},
-	}
-
-	PrintLoggingBox(box)
-}
-
-// function to accept a string and replace non basic printable ascii characters with
-// their hex values
-func replaceNonAscii(s string) string {
-	out := []rune{}
-	for _, r := range s {
-		if !(r >= 33 && r < 127) {
-			out = append(out, []rune(fmt.Sprintf("\\x%02x", r))...)
-		} else {
-			out = append(out, r)
-		}
-	}
-	return string(out)
-}
-
-func LogChatCompletionRequest(req openai.ChatCompletionRequest) {
-	meta := fmt.Sprintf("model:       %s\ntemperature: %f\nmax_tokens:  %d",
-		req.Model, req.Temperature, req.MaxTokens)
-
-	historyBoxes := []LoggingBox{}
-	for _, message := range req.Messages {
-		color := 0
-		title := message.Role
-
-		switch message.Role {
-		case "user":
-			color = 4
-		case "assistant":
-			color = 5
-		case "system":
-			color = 6
-		case "function":
-			color = 3
-			title = fmt.Sprintf("%s: %s", message.Role, message.Name)
-		case "tool":
-			color = 3
-			title = fmt.Sprintf("%s: %s %s", message.Role, message.Name, message.ToolCallID)
-		}
-
-		historyBox := LoggingBox{
-			Title:   title,
-			Content: message.Content,
-			Color:   color,
-		}
-
-		if message.FunctionCall != nil {
-			historyBox.Children = []LoggingBox{
-				{
-					Title:   "Function Call",
-					Content: fmt.Sprintf("%s\n%s", message.FunctionCall.Name, message.FunctionCall.Arguments),
-					Color:   3,
-				},
-			}
-		}
-
-		if message.ToolCalls != nil {
-			for _, tool := range message.ToolCalls {
-				historyBox.Children = append(historyBox.Children, LoggingBox{
-					Title:   "Tool Call",
-					Content: fmt.Sprintf("%s\n%s", tool.Function.Name, tool.Function.Arguments),
-					Color:   3,
-				})
-			}
-		}
-
-		historyBoxes = append(historyBoxes, historyBox)
-	}
-
-	box := LoggingBox{
-		Title:   "Completion Request /v1/chat/completions",
-		Content: meta,
-		Color:   0,
-		Children: []LoggingBox{
-			{
-				Title:    "Messages",
-				Children: historyBoxes,
-				Color:    1,
-			},
-		},
-	}
-
-	functionBoxes := []LoggingBox{}
-
-	for _, function := range req.Functions {
-		// list function parameters in a string
-		functionBoxes = append(functionBoxes, LoggingBox{
-			Title:   function.Name,
-			Content: fmt.Sprintf("%s\n%s", function.Description, function.Parameters),
-			Color:   3,
-		})
-	}
-
-	for _, tool := range req.Tools {
-		params := PrettyJSON(JSONString(tool.Function.Parameters))
-		// list function parameters in a string
-		functionBoxes = append(functionBoxes, LoggingBox{
-			Title:   tool.Function.Name,
-			Content: fmt.Sprintf("%s\n%s", tool.Function.Description, params),
-			Color:   3,
-		})
-	}
-
-	if len(functionBoxes) > 0 {
-		box.Children = append(box.Children, LoggingBox{
-			Title:    "Functions",
-			Children: functionBoxes,
-			Color:    2,
-		})
-	}
-
-	PrintLoggingBox(box)
-}
-
 func ChatCompletionRequestMessagesString(msgs []openai.ChatCompletionMessage) string {
 	out := []string{}
 	for _, msg := range msgs {
@@ -333,6 +195,11 @@ func ShellHistoryBlocksToGPTChat(systemMsg string, blocks []util.HistoryBlock) [
 func (this *GPT) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
 	var result *util.CompletionResponse
 	var err error
+	if err := checkModelSupport(request); err != nil {
+		return nil, err
+	}
+	request, cancel := withRequestTimeout(request)
+	defer cancel()
 
 	if IsCompletionModel(request.Model) {
 		result, err = this.InstructCompletion(request)
@@ -341,6 +208,21 @@ func (this *GPT) Completion(request *util.CompletionRequest) (*util.CompletionRe
 	} else {
 		result, err = this.FullChatCompletion(request)
 	}
+	if refusal := contentFilterRefusal(err); refusal != nil {
+		return refusal, nil
+	}
+	err = timeoutError(request, err)
+	learnContextWindow(request.Model, err)
+
+	// When emulating structured output the JSON is in the tool call arguments
+	if err == nil && request.JSONSchema != nil && result.Completion == "" {
+		for _, toolCall := range result.ToolCalls {
+			if toolCall.Function.Name == jsonSchemaToolName {
+				result.Completion = toolCall.Function.Parameters
+				break
+			}
+		}
+	}
 
 	// This error means the user needs to set up a subscription, give advice
 	if err != nil && strings.Contains(err.Error(), ERR_429) {
@@ -350,17 +232,16 @@ func (this *GPT) Completion(request *util.CompletionRequest) (*util.CompletionRe
 	return result, err
 }
 
-// If the model is legacy or ends with -instruct then it should use completion
-// api, otherwise it should use the chat api.
-func IsCompletionModel(modelName string) bool {
-	return IsLegacyModel(modelName) || strings.HasSuffix(modelName, "-instruct")
-}
-
 // We're doing completions through the chat API by default, this routes
 // to the legacy completion API if the model is the legacy model.
 func (this *GPT) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
 	var result *util.CompletionResponse
 	var err error
+	if err := checkModelSupport(request); err != nil {
+		return nil, err
+	}
+	request, cancel := withRequestTimeout(request)
+	defer cancel()
 
 	if IsCompletionModel(request.Model) {
 		result, err = this.InstructCompletionStream(request, writer)
@@ -369,6 +250,11 @@ func (this *GPT) CompletionStream(request *util.CompletionRequest, writer io.Wri
 	} else {
 		result, err = this.FullChatCompletionStream(request, writer)
 	}
+	if refusal := contentFilterRefusal(err); refusal != nil {
+		return refusal, nil
+	}
+	err = timeoutError(request, err)
+	learnContextWindow(request.Model, err)
 
 	// This error means the user needs to set up a subscription, give advice
 	if err != nil && strings.Contains(err.Error(), ERR_429) {
@@ -387,22 +273,31 @@ func (this *GPT) InstructCompletionStream(request *util.CompletionRequest, write
 	}
 
 	strBuilder := strings.Builder{}
+	finishReason := ""
+	metrics := &util.CompletionMetrics{}
+	start := time.Now()
 
 	callback := func(resp openai.CompletionResponse) {
 		if resp.Choices == nil || len(resp.Choices) == 0 {
 			return
 		}
+		if resp.Choices[0].FinishReason != "" {
+			finishReason = resp.Choices[0].FinishReason
+		}
 
 		text := resp.Choices[0].Text
+		if text != "" {
+			metrics.CountToken(start)
+		}
 		writer.Write([]byte(text))
 		strBuilder.WriteString(text)
 	}
 
-	if request.Verbose {
-		LogCompletionRequest(req)
-	}
+	start = time.Now()
 	stream, err := this.client.CreateCompletionStream(request.Ctx, req)
-	var id string
+	if err != nil {
+		return nil, err
+	}
 
 	for {
 		response, err := stream.Recv()
@@ -411,20 +306,18 @@ func (this *GPT) InstructCompletionStream(request *util.CompletionRequest, write
 		}
 
 		if err != nil {
-			return nil, err
+			return interruptedResponse(strBuilder.String(), metrics), err
 		}
 
 		callback(response)
-		id = response.ID
 	}
 	fmt.Fprintf(writer, "\n") // GPT doesn't finish with a newline
 
+	metrics.Duration = time.Since(start)
 	response := util.CompletionResponse{
 		Completion: strBuilder.String(),
-	}
-
-	if request.Verbose {
-		LogCompletionResponse(response, id)
+		Refusal:    refusalReason(finishReason, ""),
+		Metrics:    metrics,
 	}
 
 	return &response, err
@@ -442,10 +335,7 @@ func (this *GPT) SimpleChatCompletionStream(request *util.CompletionRequest, wri
 				Role:    "system",
 				Content: request.SystemMessage,
 			},
-			{
-				Role:    "user",
-				Content: request.Prompt,
-			},
+			chatUserMessage(request),
 		},
 		MaxTokens:   request.MaxTokens,
 		Temperature: request.Temperature,
@@ -454,7 +344,38 @@ func (this *GPT) SimpleChatCompletionStream(request *util.CompletionRequest, wri
 		Tools:       convertToOpenaiTools(request.Tools),
 	}
 
-	return this.doChatStreamCompletion(request.Ctx, req, writer, request.TokenTimeout, request.Verbose)
+	return this.doChatStreamCompletion(request.Ctx, req, writer, request.TokenTimeout)
+}
+
+// The user message for a request's prompt, with its images if there are any
+func chatUserMessage(request *util.CompletionRequest) openai.ChatCompletionMessage {
+	if len(request.Images) == 0 {
+		return openai.ChatCompletionMessage{
+			Role:    "user",
+			Content: request.Prompt,
+		}
+	}
+
+	parts := []openai.ChatMessagePart{}
+	if request.Prompt != "" {
+		parts = append(parts, openai.ChatMessagePart{
+			Type: openai.ChatMessagePartTypeText,
+			Text: request.Prompt,
+		})
+	}
+	for _, image := range request.Images {
+		parts = append(parts, openai.ChatMessagePart{
+			Type: openai.ChatMessagePartTypeImageURL,
+			ImageURL: &openai.ChatMessageImageURL{
+				URL:    fmt.Sprintf("data:%s;base64,%s", image.MimeType, base64.StdEncoding.EncodeToString(image.Data)),
+				Detail: openai.ImageURLDetailAuto,
+			},
+		})
+	}
+	return openai.ChatCompletionMessage{
+		Role:         "user",
+		MultiContent: parts,
+	}
 }
 
 func convertToOpenaiFunctions(funcs []util.FunctionDefinition) []openai.FunctionDefinition {
@@ -502,10 +423,7 @@ func (this *GPT) FullChatCompletionStream(request *util.CompletionRequest, write
 	}
 
 	if request.Prompt != "" {
-		gptHistory = append(gptHistory, openai.ChatCompletionMessage{
-			Role:    "user",
-			Content: request.Prompt,
-		})
+		gptHistory = append(gptHistory, chatUserMessage(request))
 	}
 
 	req := openai.ChatCompletionRequest{
@@ -519,7 +437,7 @@ func (this *GPT) FullChatCompletionStream(request *util.CompletionRequest, write
 	}
 
 	return this.doChatStreamCompletion(
-		request.Ctx, req, writer, request.TokenTimeout, request.Verbose)
+		request.Ctx, req, writer, request.TokenTimeout)
 }
 
 func (this *GPT) doChatStreamCompletion(
@@ -527,12 +445,16 @@ func (this *GPT) doChatStreamCompletion(
 	req openai.ChatCompletionRequest,
 	printWriter io.Writer,
 	tokenTimeout time.Duration, // max time before first chunk and between chunks
-	verbose bool) (*util.CompletionResponse, error) {
+) (*util.CompletionResponse, error) {
 
 	var responseContent strings.Builder
 	var functionName string
 	var functionArgs strings.Builder
 	var toolCalls []*util.ToolCall
+	var refusal strings.Builder
+	var finishReason openai.FinishReason
+	metrics := &util.CompletionMetrics{}
+	var start time.Time
 
 	// We already have a context that sets an overall timeout, but we also
 	// want to timeout if we don't get a chunk back for a while.
@@ -551,7 +473,7 @@ func (this *GPT) doChatStreamCompletion(
 
 		select {
 		case <-time.After(tokenTimeout):
-			chunkTimeoutErr = fmt.Errorf("Timed out waiting for streaming response, this call set a timeout of %v between streaming token responses, set by the --token-timeout (-z) parameter.", tokenTimeout)
+			chunkTimeoutErr = &timedOutError{fmt.Sprintf("Timed out waiting for streaming response, this call set a timeout of %v between streaming token responses, set by the --token-timeout (-z) parameter.", tokenTimeout)}
 			cancel()
 
 			// if we get a chunk or the context fininshes we don't do anything
@@ -574,9 +496,17 @@ func (this *GPT) doChatStreamCompletion(
 			return
 		}
 
+		if resp.Choices[0].FinishReason != "" {
+			finishReason = resp.Choices[0].FinishReason
+		}
+		refusal.WriteString(resp.Choices[0].Delta.Refusal)
+
 		text := resp.Choices[0].Delta.Content
 		functionCall := resp.Choices[0].Delta.FunctionCall
 		chunkToolCalls := resp.Choices[0].Delta.ToolCalls
+		if text != "" || functionCall != nil || len(chunkToolCalls) > 0 {
+			metrics.CountToken(start)
+		}
 
 		// When a function is streaming back we appear to get the function name
 		// always as one string (even if very long) followed by small chunks
@@ -633,16 +563,8 @@ func (this *GPT) doChatStreamCompletion(
 		responseContent.WriteString(text)
 	}
 
-	if verbose {
-		LogChatCompletionRequest(req)
-	}
-	var stream *openai.ChatCompletionStream
-
-	err := withExponentialBackoff(func() error {
-		var innerErr error
-		stream, innerErr = this.client.CreateChatCompletionStream(innerCtx, req)
-		return innerErr
-	})
+	start = time.Now()
+	stream, err := this.client.CreateChatCompletionStream(innerCtx, req)
 
 	// if chunkTimeoutErr is set then err is "context cancelled", which isn't
 	// helpful, so we return a more specific error instead
@@ -654,7 +576,6 @@ func (this *GPT) doChatStreamCompletion(
 		return nil, err
 	}
 
-	var id string
 	for {
 		response, err := stream.Recv()
 		if errors.Is(err, io.EOF) {
@@ -663,13 +584,12 @@ func (this *GPT) doChatStreamCompletion(
 
 		if err != nil {
 			if chunkTimeoutErr != nil {
-				return nil, chunkTimeoutErr
+				err = chunkTimeoutErr
 			}
-			return nil, err
+			return interruptedResponse(responseContent.String(), metrics), err
 		}
 
 		callback(response)
-		id = response.ID
 	}
 
 	// this doesn't yet handle multiple tool calls
@@ -679,19 +599,32 @@ func (this *GPT) doChatStreamCompletion(
 
 	fmt.Fprintf(printWriter, "\n") // GPT doesn't finish with a newline
 
+	metrics.Duration = time.Since(start)
 	response := util.CompletionResponse{
 		Completion:         responseContent.String(),
 		FunctionName:       functionName,
 		ToolCalls:          toolCalls,
 		FunctionParameters: functionArgs.String(),
+		Refusal:            refusalReason(string(finishReason), refusal.String()),
+		Metrics:            metrics,
 	}
 
-	if verbose {
-		LogCompletionResponse(response, id)
-	}
 	return &response, err
 }
 
+// The part of a streamed answer that arrived before the stream failed, e.g.
+// because the user cancelled it, nil if nothing did
+func interruptedResponse(partial string, metrics *util.CompletionMetrics) *util.CompletionResponse {
+	if partial == "" {
+		return nil
+	}
+	return &util.CompletionResponse{
+		Completion:  partial,
+		Interrupted: true,
+		Metrics:     metrics,
+	}
+}
+
 // Run a GPT completion request and return the response
 func (this *GPT) InstructCompletion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
 	req := openai.CompletionRequest{
@@ -701,14 +634,16 @@ func (this *GPT) InstructCompletion(request *util.CompletionRequest) (*util.Comp
 		Temperature: request.Temperature,
 	}
 
-	if request.Verbose {
-		LogCompletionRequest(req)
-	}
-
+	start := time.Now()
 	resp, err := this.client.CreateCompletion(request.Ctx, req)
 	if err != nil {
 		return nil, err
 	}
+	metrics := &util.CompletionMetrics{
+		Duration:     time.Since(start),
+		Tokens:       resp.Usage.CompletionTokens,
+		PromptTokens: resp.Usage.PromptTokens,
+	}
 
 	if len(resp.Choices) == 0 {
 		return nil, errors.New("No completions returned from a completion request with 200 response.")
@@ -720,11 +655,10 @@ func (this *GPT) InstructCompletion(request *util.CompletionRequest) (*util.Comp
 
 	response := util.CompletionResponse{
 		Completion: text,
+		Refusal:    refusalReason(resp.Choices[0].FinishReason, ""),
+		Metrics:    metrics,
 	}
 
-	if request.Verbose {
-		LogCompletionResponse(response, resp.ID)
-	}
 	return &response, nil
 }
 
@@ -732,10 +666,7 @@ func (this *GPT) FullChatCompletion(request *util.CompletionRequest) (*util.Comp
 	gptHistory := ShellHistoryBlocksToGPTChat(request.SystemMessage, request.HistoryBlocks)
 
 	if request.Prompt != "" {
-		gptHistory = append(gptHistory, openai.ChatCompletionMessage{
-			Role:    "user",
-			Content: request.Prompt,
-		})
+		gptHistory = append(gptHistory, chatUserMessage(request))
 	}
 
 	if len(gptHistory) == 0 || gptHistory[0].Role != "system" {
@@ -750,8 +681,9 @@ func (this *GPT) FullChatCompletion(request *util.CompletionRequest) (*util.Comp
 		N:           1,
 		Functions:   convertToOpenaiFunctions(request.Functions),
 	}
+	this.applyJSONSchema(&req, request)
 
-	return this.doChatCompletion(request.Ctx, req, request.Verbose)
+	return this.doChatCompletion(request.Ctx, req)
 }
 
 func (this *GPT) SimpleChatCompletion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
@@ -766,39 +698,42 @@ func (this *GPT) SimpleChatCompletion(request *util.CompletionRequest) (*util.Co
 				Role:    "system",
 				Content: request.SystemMessage,
 			},
-			{
-				Role:    "user",
-				Content: request.Prompt,
-			},
+			chatUserMessage(request),
 		},
 		MaxTokens:   request.MaxTokens,
 		Temperature: request.Temperature,
 		N:           1,
 		Functions:   convertToOpenaiFunctions(request.Functions),
 	}
+	this.applyJSONSchema(&req, request)
 
-	return this.doChatCompletion(request.Ctx, req, request.Verbose)
+	return this.doChatCompletion(request.Ctx, req)
 }
 
-func (this *GPT) doChatCompletion(ctx context.Context, request openai.ChatCompletionRequest, verbose bool) (*util.CompletionResponse, error) {
-	if verbose {
-		LogChatCompletionRequest(request)
-	}
-	var resp openai.ChatCompletionResponse
-
-	err := withExponentialBackoff(func() error {
-		var innerErr error
-		resp, innerErr = this.client.CreateChatCompletion(ctx, request)
-		return innerErr
-	})
+func (this *GPT) doChatCompletion(
+	ctx context.Context,
+	request openai.ChatCompletionRequest,
+) (*util.CompletionResponse, error) {
+	start := time.Now()
+	resp, err := this.client.CreateChatCompletion(ctx, request)
 	if err != nil {
 		return nil, err
 	}
+	metrics := &util.CompletionMetrics{
+		Duration:     time.Since(start),
+		Tokens:       resp.Usage.CompletionTokens,
+		PromptTokens: resp.Usage.PromptTokens,
+	}
 
+	if len(resp.Choices) == 0 {
+		return nil, errors.New("No completions returned from a completion request with 200 response.")
+	}
 	responseText := resp.Choices[0].Message.Content
 
 	response := util.CompletionResponse{
 		Completion: responseText,
+		Refusal:    refusalReason(string(resp.Choices[0].FinishReason), resp.Choices[0].Message.Refusal),
+		Metrics:    metrics,
 	}
 
 	funcCall := resp.Choices[0].Message.FunctionCall
@@ -807,32 +742,82 @@ func (this *GPT) doChatCompletion(ctx context.Context, request openai.ChatComple
 		response.FunctionParameters = funcCall.Arguments
 	}
 
-	if verbose {
-		LogCompletionResponse(response, resp.ID)
+	for _, toolCall := range resp.Choices[0].Message.ToolCalls {
+		response.ToolCalls = append(response.ToolCalls, &util.ToolCall{
+			Id:   toolCall.ID,
+			Type: string(toolCall.Type),
+			Function: util.FunctionCall{
+				Name:       toolCall.Function.Name,
+				Parameters: toolCall.Function.Arguments,
+			},
+		})
 	}
+
 	return &response, nil
 }
 
+// Describe why the provider declined to answer, or return "" if it didn't
+func refusalReason(finishReason string, refusal string) string {
+	if refusal != "" {
+		return refusal
+	}
+	if finishReason == string(openai.FinishReasonContentFilter) {
+		return "the response was blocked by the provider's content filter"
+	}
+	return ""
+}
+
+// Some providers (e.g. Azure) reject a request outright when the prompt trips
+// their content filter, we treat that as a refusal rather than an error
+func contentFilterRefusal(err error) *util.CompletionResponse {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) && apiErr.Code == "content_filter" {
+		return &util.CompletionResponse{Refusal: apiErr.Message}
+	}
+	return nil
+}
+
 const GPTEmbeddingsMaxTokens = 8192
 const GPTEmbeddingsModel = openai.AdaEmbeddingV2
 
-func withExponentialBackoff(f func() error) error {
-	for i := 0; ; i++ {
-		err := f()
+// Apply the request's hard timeout, if it has one, to a copy of the request
+func withRequestTimeout(request *util.CompletionRequest) (*util.CompletionRequest, context.CancelFunc) {
+	if request.Timeout <= 0 {
+		return request, func() {}
+	}
 
-		if err != nil && strings.Contains(err.Error(), "429") {
-			// TODO should probably have a better error detection
-			sleepTime := time.Duration(math.Pow(1.6, float64(i+1))) * time.Second
-			log.Printf("Rate limited, sleeping for %s\n", sleepTime)
-			time.Sleep(sleepTime)
+	ctx := request.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
 
-			if i > 3 {
-				return fmt.Errorf("Getting 429s from OpenAI API, this means you're hitting the rate limit, giving up after %d retries", i)
-			}
-			continue
-		}
-		return err
+	timed := *request
+	var cancel context.CancelFunc
+	timed.Ctx, cancel = context.WithTimeout(ctx, request.Timeout)
+	return &timed, cancel
+}
+
+// Replace the unhelpful "context deadline exceeded" when a request hits its
+// hard timeout
+func timeoutError(request *util.CompletionRequest, err error) error {
+	if err != nil && request.Timeout > 0 && errors.Is(request.Ctx.Err(), context.DeadlineExceeded) {
+		return &timedOutError{fmt.Sprintf("Request timed out after %s, this is set per feature by request_limits in the config file", request.Timeout)}
 	}
+	return err
+}
+
+// A timeout with an explanation of which setting caused it, matches
+// context.DeadlineExceeded with errors.Is
+type timedOutError struct {
+	message string
+}
+
+func (this *timedOutError) Error() string {
+	return this.message
+}
+
+func (this *timedOutError) Unwrap() error {
+	return context.DeadlineExceeded
 }
 
 func (this *GPT) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
@@ -841,33 +826,14 @@ func (this *GPT) Embeddings(ctx context.Context, input []string, verbose bool) (
 		Model: GPTEmbeddingsModel,
 	}
 
-	if verbose {
-		summary := fmt.Sprintf("Embedding %d strings: [", len(input))
-		for i, s := range input {
-			if i > 0 {
-				summary += ",\n"
-			} else {
-				summary += "\n"
-			}
-			summary += s[:util.Min(20, len(s))]
-		}
-		summary += "\n]"
-		fmt.Printf("%s\n", summary)
+	resp, err := this.client.CreateEmbeddings(ctx, req)
+	if err != nil {
+		return nil, err
 	}
 
 	result := [][]float32{}
-
-	err := withExponentialBackoff(func() error {
-		resp, err := this.client.CreateEmbeddings(ctx, req)
-		if err != nil {
-			return err
-		}
-
-		for _, embedding := range resp.Data {
-			result = append(result, embedding.Embedding)
-		}
-		return nil
-	})
-
-	return result, err
+	for _, embedding := range resp.Data {
+		result = append(result, embedding.Embedding)
+	}
+	return result, nil
 }
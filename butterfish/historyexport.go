@@ -0,0 +1,334 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The shell history, prompts, answers, commands and their output, can be
+// exported as a markdown transcript or as JSON, e.g. to document a debugging
+// session. Secrets go through the same redaction as requests to the API. The
+// "History export" local command writes the shell's own history, and
+// butterfish history export asks a running shell for it over the socket that
+// snap uses.
+//
+// butterfish shell --resume <file> starts a shell with the history from a
+// JSON export, so a conversation can pick up where it left off. Only the
+// most recent blocks that fit in half of the prompt's token budget are
+// loaded, leaving room for the new session.
+
+const (
+	HistoryFormatMarkdown = "markdown"
+	HistoryFormatJSON     = "json"
+)
+
+type HistoryExportBlock struct {
+	// prompt, answer, command, output, or function
+	Type    string `json:"type"`
+	Content string `json:"content"`
+	// For commands that have finished
+	ExitCode   *int  `json:"exit_code,omitempty"`
+	DurationMs int64 `json:"duration_ms,omitempty"`
+	// For function calls in goal mode
+	Function string `json:"function,omitempty"`
+}
+
+type HistoryExport struct {
+	Session  string                `json:"session,omitempty"`
+	Exported time.Time             `json:"exported"`
+	Blocks   []*HistoryExportBlock `json:"blocks"`
+}
+
+// The history oldest first, with escape codes stripped and secrets redacted
+func (this *ShellHistory) Export(redactor *Redactor) []*HistoryExportBlock {
+	blocks := []*HistoryExportBlock{}
+	this.IterateBlocks(func(block *HistoryBuffer) bool {
+		content := strings.TrimRight(stripANSI(block.Content.String()), " \t\r\n")
+		if content == "" {
+			return true
+		}
+		exported := &HistoryExportBlock{
+			Type:     pluginHistoryTypes[block.Type],
+			Content:  redactor.Redact(content),
+			Function: block.FunctionName,
+		}
+		if block.Type == historyTypeShellInput && block.Finished {
+			exitCode := block.ExitCode
+			exported.ExitCode = &exitCode
+			exported.DurationMs = block.Duration.Milliseconds()
+		}
+		blocks = append(blocks, exported)
+		return true
+	})
+
+	// oldest first
+	for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+		blocks[i], blocks[j] = blocks[j], blocks[i]
+	}
+	return blocks
+}
+
+// The shell's history for export, for the local command and the socket
+func (this *ShellState) historyExport() *HistoryExport {
+	export := &HistoryExport{Exported: time.Now()}
+	if this.Session != nil {
+		export.Session = this.Session.ID
+	}
+
+	var redactConfig *RedactConfig
+	if this.Butterfish.Config.ConfigFile != nil {
+		redactConfig = this.Butterfish.Config.ConfigFile.Redact
+	}
+	redactor, err := NewRedactor(redactConfig)
+	if err != nil {
+		// the config was checked when the shell started
+		redactor, _ = NewRedactor(nil)
+	}
+	export.Blocks = this.History.Export(redactor)
+	return export
+}
+
+// Read a session exported as JSON
+func LoadHistoryExport(path string) (*HistoryExport, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".md" || ext == ".markdown" {
+		return nil, fmt.Errorf("%s is a markdown transcript, resume needs a session exported as JSON, e.g. with 'History export session.json'", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	export := &HistoryExport{}
+	err = json.Unmarshal(data, export)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse %s, resume needs a session exported as JSON: %s", path, err)
+	}
+	return export, nil
+}
+
+// History types by their names in an export
+var exportHistoryTypes = map[string]int{
+	"prompt":   historyTypePrompt,
+	"command":  historyTypeShellInput,
+	"output":   historyTypeShellOutput,
+	"answer":   historyTypeLLMOutput,
+	"function": historyTypeFunctionOutput,
+}
+
+// Add the most recent blocks of an export that fit in budget tokens to the
+// history, counting each block as at most blockBudget tokens since longer
+// blocks are cut down when they're sent. Returns the number of blocks added.
+func (this *ShellHistory) Resume(export *HistoryExport, budget, blockBudget int, count func(string) int) int {
+	start := len(export.Blocks)
+	used := 0
+	for start > 0 {
+		block := export.Blocks[start-1]
+		if _, ok := exportHistoryTypes[block.Type]; !ok {
+			start--
+			continue
+		}
+		tokens := min(count(block.Content), blockBudget)
+		if used+tokens > budget {
+			break
+		}
+		used += tokens
+		start--
+	}
+	// output without the command that produced it isn't much use
+	for start < len(export.Blocks) && export.Blocks[start].Type == "output" {
+		start++
+	}
+
+	added := 0
+	for _, block := range export.Blocks[start:] {
+		historyType, ok := exportHistoryTypes[block.Type]
+		if !ok {
+			continue
+		}
+		this.AddBlock(historyType, block.Content)
+		added++
+
+		this.mutex.Lock()
+		buffer := this.Blocks[len(this.Blocks)-1]
+		buffer.FunctionName = block.Function
+		if historyType == historyTypeShellInput && block.ExitCode != nil {
+			buffer.Finished = true
+			buffer.ExitCode = *block.ExitCode
+			buffer.Duration = time.Duration(block.DurationMs) * time.Millisecond
+		}
+		this.mutex.Unlock()
+	}
+	return added
+}
+
+// Load the session given with --resume into the history
+func (this *ShellState) resumeHistory(export *HistoryExport) {
+	this.updateTokenBudgets()
+	count := tokenCounter(this.Butterfish.Config.ShellPromptModel)
+	added := this.History.Resume(export, this.PromptMaxTokens/2, this.HistoryBlockMaxTokens, count)
+	log.Printf("Resumed %d of %d history blocks from session %s", added, len(export.Blocks), export.Session)
+}
+
+// A code fence longer than any run of backticks in content
+func markdownFence(content string) string {
+	fence := "```"
+	for strings.Contains(content, fence) {
+		fence += "`"
+	}
+	return fence
+}
+
+func WriteHistoryMarkdown(out io.Writer, export *HistoryExport) {
+	title := "Butterfish session"
+	if export.Session != "" {
+		title += " " + export.Session
+	}
+	fmt.Fprintf(out, "# %s\n\nExported %s\n", title, export.Exported.Local().Format(time.RFC1123))
+
+	for i, block := range export.Blocks {
+		switch block.Type {
+		case "prompt":
+			fmt.Fprintf(out, "\n## Prompt\n\n%s\n", block.Content)
+
+		case "answer":
+			fmt.Fprintf(out, "\n### Answer\n\n%s\n", block.Content)
+
+		case "command":
+			// the command and its output go in one block, like a terminal
+			text := "$ " + block.Content
+			if i+1 < len(export.Blocks) && export.Blocks[i+1].Type == "output" {
+				text += "\n" + export.Blocks[i+1].Content
+			}
+			fence := markdownFence(text)
+			fmt.Fprintf(out, "\n%sconsole\n%s\n%s\n", fence, text, fence)
+			if block.ExitCode != nil && *block.ExitCode != 0 {
+				fmt.Fprintf(out, "\nExited with status %d\n", *block.ExitCode)
+			}
+
+		case "output":
+			if i > 0 && export.Blocks[i-1].Type == "command" {
+				continue
+			}
+			fence := markdownFence(block.Content)
+			fmt.Fprintf(out, "\n%s\n%s\n%s\n", fence, block.Content, fence)
+
+		default:
+			fence := markdownFence(block.Content)
+			label := "Function output"
+			if block.Function != "" {
+				label = fmt.Sprintf("Function `%s`", block.Function)
+			}
+			fmt.Fprintf(out, "\n%s:\n\n%s\n%s\n%s\n", label, fence, block.Content, fence)
+		}
+	}
+}
+
+func WriteHistory(out io.Writer, export *HistoryExport, format string) error {
+	switch format {
+	case HistoryFormatMarkdown:
+		WriteHistoryMarkdown(out, export)
+		return nil
+	case HistoryFormatJSON:
+		data, err := json.MarshalIndent(export, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "%s\n", data)
+		return err
+	}
+	return fmt.Errorf("Unknown history format %s, use markdown or json", format)
+}
+
+// JSON for .json files, markdown otherwise
+func historyFormatForPath(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return HistoryFormatJSON
+	}
+	return HistoryFormatMarkdown
+}
+
+func writeHistoryFile(path string, export *HistoryExport, format string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = WriteHistory(file, export, format)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Handle "History export [path]" in the shell, the path is relative to the
+// shell's directory and defaults to butterfish-<session>.md
+func (this *ShellState) ExportHistory(path string) {
+	export := this.historyExport()
+	if path == "" {
+		name := "history"
+		if export.Session != "" {
+			name = export.Session
+		}
+		path = fmt.Sprintf("butterfish-%s.md", name)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(childShellDir(), path)
+	}
+
+	err := writeHistoryFile(path, export, historyFormatForPath(path))
+	if err != nil {
+		this.Prompt.Clear()
+		this.PrintError(fmt.Errorf("Unable to export the history: %s", err))
+		return
+	}
+	this.printLocalResponse(fmt.Sprintf("Exported %d history blocks to %s\n", len(export.Blocks), path))
+}
+
+// Handle `butterfish history ...`, this reads the history of a running shell
+// so it works without an API key
+func RunHistoryCommand(ctx context.Context, out io.Writer, stateBaseDir, command string, options *CliCommandConfig) error {
+	switch command {
+	case "history export":
+		opts := options.History.Export
+		if stateBaseDir == "" {
+			return errors.New("No state directory, history export needs one to find running shells")
+		}
+
+		format := opts.Format
+		if format == "" {
+			format = HistoryFormatMarkdown
+			if opts.Output != "" {
+				format = historyFormatForPath(opts.Output)
+			}
+		}
+
+		export := &HistoryExport{}
+		err := readRunningShell(ctx, stateBaseDir, opts.Session, shellRequestHistory, export)
+		if err != nil {
+			return err
+		}
+
+		if opts.Output == "" || opts.Output == "-" {
+			return WriteHistory(out, export, format)
+		}
+		err = writeHistoryFile(opts.Output, export, format)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Exported %d history blocks to %s\n", len(export.Blocks), opts.Output)
+
+	default:
+		return errors.New("Unrecognized command: " + command)
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func exportTestHistory() *ShellHistory {
+	history := NewShellHistory()
+	history.Append(historyTypePrompt, "Why did the deploy fail?")
+	history.Append(historyTypeLLMOutput, "Check the logs with `make logs`.")
+	history.AddCommand("make logs", time.Now())
+	history.Append(historyTypeShellOutput, "\x1b[31merror:\x1b[0m bad token\nexport API_TOKEN=abc123\n")
+	history.FinishCommand(2, time.Now())
+	return history
+}
+
+func TestHistoryExport(t *testing.T) {
+	redactor, err := NewRedactor(nil)
+	assert.Nil(t, err)
+	blocks := exportTestHistory().Export(redactor)
+
+	exitCode := 2
+	assert.Equal(t, 4, len(blocks))
+	assert.Equal(t, &HistoryExportBlock{Type: "prompt", Content: "Why did the deploy fail?"}, blocks[0])
+	assert.Equal(t, "answer", blocks[1].Type)
+	assert.Equal(t, "command", blocks[2].Type)
+	assert.Equal(t, &exitCode, blocks[2].ExitCode)
+	assert.Equal(t, &HistoryExportBlock{Type: "output", Content: "error: bad token\nexport API_TOKEN=[REDACTED:password]"}, blocks[3])
+
+	export := &HistoryExport{Session: "20240102-030405-aaaa", Blocks: blocks}
+	out := new(bytes.Buffer)
+	assert.Nil(t, WriteHistory(out, export, HistoryFormatMarkdown))
+	assert.Contains(t, out.String(), "# Butterfish session 20240102-030405-aaaa\n")
+	assert.Contains(t, out.String(), "\n## Prompt\n\nWhy did the deploy fail?\n\n### Answer\n\nCheck the logs with `make logs`.\n"+
+		"\n```console\n$ make logs\nerror: bad token\nexport API_TOKEN=[REDACTED:password]\n```\n\nExited with status 2\n")
+
+	out.Reset()
+	assert.Nil(t, WriteHistory(out, export, HistoryFormatJSON))
+	decoded := &HistoryExport{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), decoded))
+	assert.Equal(t, blocks, decoded.Blocks)
+
+	assert.NotNil(t, WriteHistory(out, export, "html"))
+	assert.Equal(t, "````", markdownFence("```go\nfoo\n```"))
+}
+
+func TestHistoryExportCommand(t *testing.T) {
+	stateDir := t.TempDir()
+	history := exportTestHistory()
+	redactor, _ := NewRedactor(nil)
+	listener, err := ServeScreen(ScreenSocketPath(stateDir, "20240102-030405-aaaa"), NewScreen(20, 3),
+		func() *HistoryExport {
+			return &HistoryExport{Session: "20240102-030405-aaaa", Blocks: history.Export(redactor)}
+		})
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	ctx := context.Background()
+	options := &CliCommandConfig{}
+	out := new(bytes.Buffer)
+	assert.Nil(t, RunHistoryCommand(ctx, out, stateDir, "history export", options))
+	assert.Contains(t, out.String(), "$ make logs\n")
+
+	// the format follows the output file's extension
+	path := filepath.Join(t.TempDir(), "session.json")
+	options.History.Export.Output = path
+	out.Reset()
+	assert.Nil(t, RunHistoryCommand(ctx, out, stateDir, "history export", options))
+	assert.Equal(t, "Exported 4 history blocks to "+path+"\n", out.String())
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	decoded := &HistoryExport{}
+	assert.Nil(t, json.Unmarshal(content, decoded))
+	assert.Equal(t, "20240102-030405-aaaa", decoded.Session)
+	assert.Equal(t, 4, len(decoded.Blocks))
+
+	options.History.Export.Session = "2023"
+	assert.ErrorContains(t, RunHistoryCommand(ctx, out, stateDir, "history export", options), "No running shell matches")
+}
+
+func TestHistoryExportLocalCommand(t *testing.T) {
+	state := &ShellState{
+		Butterfish: &ButterfishCtx{Config: MakeButterfishConfig()},
+		Prompt:     NewShellBuffer(),
+		History:    NewShellHistory(),
+	}
+
+	// more than one word after the command is a prompt, not a path
+	state.Prompt.Write("History export the failing tests as a table")
+	assert.False(t, state.HandleLocalPrompt())
+	_, err := os.Stat("the failing tests as a table")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestHistoryResume(t *testing.T) {
+	exitCode := 2
+	export := &HistoryExport{Session: "20240102-030405-aaaa", Blocks: []*HistoryExportBlock{
+		{Type: "prompt", Content: "an older prompt that won't fit"},
+		{Type: "command", Content: "make logs", ExitCode: &exitCode, DurationMs: 1500},
+		{Type: "output", Content: "error: bad token"},
+		{Type: "prompt", Content: "Why did the deploy fail?"},
+		{Type: "answer", Content: "The token is wrong."},
+	}}
+	// one token per character
+	count := func(s string) int { return len(s) }
+
+	history := NewShellHistory()
+	added := history.Resume(export, 70, 1024, count)
+	assert.Equal(t, 4, added)
+	assert.Equal(t, historyTypeShellInput, history.Blocks[0].Type)
+	assert.Equal(t, "make logs", history.Blocks[0].Content.String())
+	assert.True(t, history.Blocks[0].Finished)
+	assert.Equal(t, 2, history.Blocks[0].ExitCode)
+	assert.Equal(t, 1500*time.Millisecond, history.Blocks[0].Duration)
+	assert.Equal(t, historyTypeLLMOutput, history.Blocks[3].Type)
+
+	// output isn't loaded without its command, and long blocks count as
+	// their truncated size
+	history = NewShellHistory()
+	assert.Equal(t, 2, history.Resume(export, 60, 20, count))
+	assert.Equal(t, historyTypePrompt, history.Blocks[0].Type)
+
+	// round trips through a file
+	path := filepath.Join(t.TempDir(), "session.json")
+	out := new(bytes.Buffer)
+	assert.Nil(t, WriteHistory(out, export, HistoryFormatJSON))
+	assert.Nil(t, os.WriteFile(path, out.Bytes(), 0600))
+	loaded, err := LoadHistoryExport(path)
+	assert.Nil(t, err)
+	assert.Equal(t, export.Blocks, loaded.Blocks)
+
+	_, err = LoadHistoryExport(filepath.Join(t.TempDir(), "session.md"))
+	assert.ErrorContains(t, err, "needs a session exported as JSON")
+}
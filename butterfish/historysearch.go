@@ -0,0 +1,204 @@
+package butterfish
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/drewlanenga/govector"
+)
+
+// Find: <query> in shell mode searches past commands by meaning rather than
+// text, so "the curl that posted to the api" finds a curl command from an hour
+// ago without scrolling. Each command is embedded with the first lines of its
+// output the first time we search, and cached by that text, so later searches
+// only embed new commands and the query.
+
+const (
+	// how many of the most recent commands we search
+	historySearchCommands = 500
+	historySearchResults  = 5
+	// lines of output embedded and shown with each command
+	historySearchOutputLines = 3
+)
+
+type historyCommand struct {
+	Command string
+	Output  string
+}
+
+type historySearchResult struct {
+	historyCommand
+	Score float64
+}
+
+// The most recent shell commands in the history with their output, oldest
+// first
+func (this *ShellHistory) Commands(max int) []historyCommand {
+	commands := []historyCommand{}
+	output := []string{}
+
+	this.IterateBlocks(func(block *HistoryBuffer) bool {
+		switch block.Type {
+		case historyTypeShellOutput:
+			output = append([]string{block.Content.String()}, output...)
+		case historyTypeShellInput:
+			commands = append(commands, historyCommand{
+				Command: strings.TrimSpace(block.Content.String()),
+				Output:  strings.Join(output, ""),
+			})
+			output = []string{}
+		default:
+			// output after a prompt or function call isn't the command's
+			output = []string{}
+		}
+		return len(commands) < max
+	})
+
+	for i, j := 0, len(commands)-1; i < j; i, j = i+1, j-1 {
+		commands[i], commands[j] = commands[j], commands[i]
+	}
+	return commands
+}
+
+// The first non-empty lines of command output, without control codes
+func firstOutputLines(output string, n int) []string {
+	lines := []string{}
+	for _, line := range strings.Split(sanitizeTTYString(output), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		lines = append(lines, line)
+		if len(lines) == n {
+			break
+		}
+	}
+	return lines
+}
+
+func historySearchText(command historyCommand) string {
+	lines := firstOutputLines(command.Output, historySearchOutputLines)
+	return strings.Join(append([]string{command.Command}, lines...), "\n")
+}
+
+// Rank commands by cosine similarity to the query, embedding anything that
+// isn't in the cache yet. A command that was run more than once shows up
+// once, with its latest output.
+func searchHistory(
+	ctx context.Context,
+	commands []historyCommand,
+	query string,
+	cache map[string][]float32,
+	embed func(context.Context, []string) ([][]float32, error),
+	numResults int,
+) ([]*historySearchResult, error) {
+	latest := map[string]historyCommand{}
+	for _, command := range commands {
+		if command.Command != "" {
+			latest[command.Command] = command
+		}
+	}
+
+	texts := map[string]string{}
+	toEmbed := []string{query}
+	for name, command := range latest {
+		text := historySearchText(command)
+		texts[name] = text
+		if _, ok := cache[text]; !ok {
+			toEmbed = append(toEmbed, text)
+		}
+	}
+
+	vectors, err := embed(ctx, toEmbed)
+	if err != nil {
+		return nil, err
+	}
+	if len(vectors) != len(toEmbed) {
+		return nil, fmt.Errorf("Expected %d embeddings, got %d", len(toEmbed), len(vectors))
+	}
+	for i, text := range toEmbed[1:] {
+		cache[text] = vectors[i+1]
+	}
+
+	queryVector, err := govector.AsVector(vectors[0])
+	if err != nil {
+		return nil, err
+	}
+	results := []*historySearchResult{}
+	for name, command := range latest {
+		vector, err := govector.AsVector(cache[texts[name]])
+		if err != nil {
+			return nil, err
+		}
+		score, err := govector.Cosine(queryVector, vector)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, &historySearchResult{historyCommand: command, Score: score})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Command < results[j].Command
+	})
+	return results[:min(len(results), numResults)], nil
+}
+
+func formatHistorySearch(results []*historySearchResult) string {
+	builder := strings.Builder{}
+	for _, result := range results {
+		builder.WriteString(fmt.Sprintf("%s  (%.2f)\n", result.Command, result.Score))
+		for _, line := range firstOutputLines(result.Output, historySearchOutputLines) {
+			builder.WriteString(fmt.Sprintf("    %s\n", line))
+		}
+	}
+	return builder.String()
+}
+
+// Search the history in the background, like a prompt the search can be
+// canceled with Ctrl-C
+func (this *ShellState) FindLocalCommand(query string) {
+	if query == "" {
+		this.printLocalResponse("Find searches past commands, e.g. Find: the curl that posted to the api\n")
+		return
+	}
+
+	commands := this.History.Commands(historySearchCommands)
+	if len(commands) == 0 {
+		this.printLocalResponse("There are no commands in the history yet\n")
+		return
+	}
+
+	embedder, err := this.Butterfish.newEmbedder()
+	if err != nil {
+		this.Prompt.Clear()
+		this.PrintError(err)
+		return
+	}
+	if this.HistorySearchCache == nil {
+		this.HistorySearchCache = map[string][]float32{}
+	}
+
+	this.setState(statePromptResponse)
+	requestCtx, cancel := context.WithCancel(context.Background())
+	this.PromptResponseCancel = cancel
+
+	// only one search runs at a time since we're in the prompt response state
+	// until it's done, so the cache doesn't need a lock
+	go func() {
+		results, err := searchHistory(requestCtx, commands, query,
+			this.HistorySearchCache, embedder.CalculateEmbeddings, historySearchResults)
+		if requestCtx.Err() != nil {
+			return
+		}
+		if err != nil {
+			this.PrintError(err)
+			return
+		}
+		this.printLocalResponse(formatHistorySearch(results))
+	}()
+}
@@ -0,0 +1,79 @@
+package butterfish
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistoryCommands(t *testing.T) {
+	history := NewShellHistory()
+	history.Append(historyTypeShellInput, "ls")
+	history.Append(historyTypeShellOutput, "\r\na.txt\r\n")
+	history.Append(historyTypePrompt, "What is a.txt?")
+	history.Append(historyTypeLLMOutput, "A text file")
+	history.Append(historyTypeShellInput, "cat a.txt")
+	history.Append(historyTypeShellOutput, "hello\r\n\x1b[31mworld\x1b[0m\r\n")
+
+	commands := history.Commands(10)
+	assert.Equal(t, 2, len(commands))
+	assert.Equal(t, "ls", commands[0].Command)
+	assert.Equal(t, "cat a.txt", commands[1].Command)
+	assert.Equal(t, []string{"hello", "world"}, firstOutputLines(commands[1].Output, 3))
+
+	commands = history.Commands(1)
+	assert.Equal(t, 1, len(commands))
+	assert.Equal(t, "cat a.txt", commands[0].Command)
+}
+
+func TestSearchHistory(t *testing.T) {
+	// embed on whether the text mentions curl
+	embedded := []string{}
+	embed := func(ctx context.Context, texts []string) ([][]float32, error) {
+		embedded = append(embedded, texts...)
+		vectors := [][]float32{}
+		for _, text := range texts {
+			if strings.Contains(text, "curl") {
+				vectors = append(vectors, []float32{1, 0.1})
+			} else {
+				vectors = append(vectors, []float32{0.1, 1})
+			}
+		}
+		return vectors, nil
+	}
+
+	commands := []historyCommand{
+		{Command: "curl -X POST https://api.example.com", Output: "{\"ok\": false}\n"},
+		{Command: "ls", Output: "a.txt\n"},
+		{Command: "curl -X POST https://api.example.com", Output: "{\"ok\": true}\n"},
+	}
+	cache := map[string][]float32{}
+	results, err := searchHistory(context.Background(), commands, "the curl to the api", cache, embed, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, "curl -X POST https://api.example.com", results[0].Command)
+	assert.Contains(t, formatHistorySearch(results), "    {\"ok\": true}\n")
+	assert.Equal(t, 3, len(embedded))
+
+	// cached commands aren't embedded again
+	embedded = []string{}
+	results, err = searchHistory(context.Background(), commands, "list files", cache, embed, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"list files"}, embedded)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "ls", results[0].Command)
+}
+
+func TestFindLocalCommand(t *testing.T) {
+	shell := pluginShell()
+
+	// prompts that start with the word go to the LLM
+	shell.Prompt.Write("Find all files over 1GB in my home directory")
+	assert.False(t, shell.HandleLocalPrompt())
+
+	shell.Prompt.Clear()
+	shell.Prompt.Write("Find: the curl that posted to the api")
+	assert.True(t, shell.HandleLocalPrompt())
+}
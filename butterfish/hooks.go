@@ -0,0 +1,280 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Hooks run the user's own programs on events like sending a prompt or
+// running a command, for logging, metrics, or enforcing a policy without
+// changing butterfish. They're listed in the config file:
+//
+//	hooks:
+//	  - event: pre_command
+//	    command: ~/bin/check-command
+//	    timeout: 2s
+//	  - event: post_response
+//	    command: jq -c . >> ~/butterfish-responses.jsonl
+//
+// Each hook is run with sh and gets a JSON HookPayload describing the event
+// on stdin. pre_prompt and post_response hooks run around every request to
+// the LLM, including autosuggest, so they should be quick, and they see
+// prompts after secrets are redacted. pre_command hooks run before exec,
+// goal mode, or the agent runs a command, and the command is blocked if a
+// hook exits with a non-zero status or times out, with the hook's output as
+// the reason. session_end hooks run when a shell session ends.
+
+const (
+	HookPrePrompt    = "pre_prompt"
+	HookPostResponse = "post_response"
+	HookPreCommand   = "pre_command"
+	HookSessionEnd   = "session_end"
+)
+
+var HookEvents = []string{HookPrePrompt, HookPostResponse, HookPreCommand, HookSessionEnd}
+
+const DefaultHookTimeout = 5 * time.Second
+
+// A hook from the config file
+type Hook struct {
+	Event   string `yaml:"event"`
+	Command string `yaml:"command"`
+	// How long the hook may run, DefaultHookTimeout if unset
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+func (this *Hook) Validate() error {
+	if !slices.Contains(HookEvents, this.Event) {
+		return fmt.Errorf("Unknown hook event %s, expected one of %v", this.Event, HookEvents)
+	}
+	if this.Command == "" {
+		return fmt.Errorf("Hook for %s without a command", this.Event)
+	}
+	if this.Timeout < 0 {
+		return fmt.Errorf("Hook timeout for %s must not be negative", this.Event)
+	}
+	return nil
+}
+
+// What a hook gets on stdin, fields that don't apply to the event are left
+// out
+type HookPayload struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+
+	// pre_prompt and post_response
+	Model              string `json:"model,omitempty"`
+	Prompt             string `json:"prompt,omitempty"`
+	Response           string `json:"response,omitempty"`
+	FunctionName       string `json:"function_name,omitempty"`
+	FunctionParameters string `json:"function_parameters,omitempty"`
+	Error              string `json:"error,omitempty"`
+
+	// pre_command
+	Command string `json:"command,omitempty"`
+	Dir     string `json:"dir,omitempty"`
+
+	// session_end
+	SessionID string `json:"session_id,omitempty"`
+}
+
+// A pre_command hook blocked a command
+type HookVeto struct {
+	Hook   string
+	Reason string
+}
+
+func (this *HookVeto) Error() string {
+	if this.Reason == "" {
+		return fmt.Sprintf("Command blocked by hook %s", this.Hook)
+	}
+	return fmt.Sprintf("Command blocked by hook %s: %s", this.Hook, this.Reason)
+}
+
+// A nil Hooks does nothing, so it's safe to call when no hooks are
+// configured
+type Hooks struct {
+	hooks []*Hook
+	// run a hook with the payload on stdin, returning its output, replaced
+	// in tests
+	run func(ctx context.Context, hook *Hook, payload []byte) ([]byte, error)
+}
+
+// Returns nil if there are no hooks
+func NewHooks(hooks []*Hook) *Hooks {
+	if len(hooks) == 0 {
+		return nil
+	}
+	return &Hooks{
+		hooks: hooks,
+		run:   runHook,
+	}
+}
+
+// The hooks from the config file, nil if there aren't any
+func configHooks(config *ButterfishConfig) *Hooks {
+	if config.ConfigFile == nil {
+		return nil
+	}
+	return NewHooks(config.ConfigFile.Hooks)
+}
+
+func runHook(ctx context.Context, hook *Hook, payload []byte) ([]byte, error) {
+	timeout := hook.Timeout
+	if timeout == 0 {
+		timeout = DefaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", hook.Command)
+	cmd.Stdin = bytes.NewReader(payload)
+	// don't wait for anything the hook left running in the background
+	cmd.WaitDelay = time.Second
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return output, fmt.Errorf("timed out after %s", timeout)
+	}
+	return output, err
+}
+
+// Whether any hooks are configured for the event
+func (this *Hooks) Has(event string) bool {
+	if this == nil {
+		return false
+	}
+	for _, hook := range this.hooks {
+		if hook.Event == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Run the hooks for the payload's event in order, stopping at the first
+// that fails. Failures are logged and returned.
+func (this *Hooks) Run(ctx context.Context, payload *HookPayload) (*Hook, string, error) {
+	if !this.Has(payload.Event) {
+		return nil, "", nil
+	}
+
+	payload.Time = time.Now()
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, hook := range this.hooks {
+		if hook.Event != payload.Event {
+			continue
+		}
+		output, err := this.run(ctx, hook, data)
+		if err != nil {
+			log.Printf("Hook %s for %s failed: %s", hook.Command, hook.Event, err)
+			return hook, strings.TrimSpace(string(output)), err
+		}
+	}
+	return nil, "", nil
+}
+
+// Run the pre_command hooks, a HookVeto means the command mustn't run
+func (this *Hooks) PreCommand(ctx context.Context, command, dir string) error {
+	hook, reason, err := this.Run(ctx, &HookPayload{
+		Event:   HookPreCommand,
+		Command: command,
+		Dir:     dir,
+	})
+	if err == nil {
+		return nil
+	}
+	if hook == nil {
+		return err
+	}
+	if reason == "" {
+		reason = err.Error()
+	}
+	return &HookVeto{Hook: hook.Command, Reason: reason}
+}
+
+// Run the session_end hooks, the session is over so we only log failures
+func (this *Hooks) SessionEnd(sessionID string) {
+	this.Run(context.Background(), &HookPayload{
+		Event:     HookSessionEnd,
+		SessionID: sessionID,
+	})
+}
+
+// The hooks middleware runs the pre_prompt and post_response hooks around
+// each request
+type HookingLLM struct {
+	LLM   LLM
+	Hooks *Hooks
+}
+
+func NewHookingLLM(llm LLM, hooks *Hooks) *HookingLLM {
+	return &HookingLLM{
+		LLM:   llm,
+		Hooks: hooks,
+	}
+}
+
+func (this *HookingLLM) Unwrap() LLM {
+	return this.LLM
+}
+
+func (this *HookingLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	this.prePrompt(request)
+	response, err := this.LLM.CompletionStream(request, writer)
+	this.postResponse(request, response, err)
+	return response, err
+}
+
+func (this *HookingLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	this.prePrompt(request)
+	response, err := this.LLM.Completion(request)
+	this.postResponse(request, response, err)
+	return response, err
+}
+
+func (this *HookingLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	return this.LLM.Embeddings(ctx, input, verbose)
+}
+
+// The request's context may be cancelled before the response hooks run, so
+// hooks only get their own timeout
+func (this *HookingLLM) prePrompt(request *util.CompletionRequest) {
+	this.Hooks.Run(context.Background(), &HookPayload{
+		Event:  HookPrePrompt,
+		Model:  request.Model,
+		Prompt: request.Prompt,
+	})
+}
+
+func (this *HookingLLM) postResponse(request *util.CompletionRequest, response *util.CompletionResponse, err error) {
+	payload := &HookPayload{
+		Event: HookPostResponse,
+		Model: request.Model,
+	}
+	if response != nil {
+		payload.Response = response.Completion
+		payload.FunctionName = response.FunctionName
+		payload.FunctionParameters = response.FunctionParameters
+		if response.Model != "" {
+			payload.Model = response.Model
+		}
+	}
+	if err != nil {
+		payload.Error = err.Error()
+	}
+	this.Hooks.Run(context.Background(), payload)
+}
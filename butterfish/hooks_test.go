@@ -0,0 +1,119 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// Hooks that record their payloads, failing with the output of fail if it
+// isn't empty
+func testHooks(hooks []*Hook, fail func(hook *Hook, payload *HookPayload) string) (*Hooks, *[]*HookPayload) {
+	payloads := []*HookPayload{}
+	result := NewHooks(hooks)
+	result.run = func(ctx context.Context, hook *Hook, data []byte) ([]byte, error) {
+		payload := &HookPayload{}
+		json.Unmarshal(data, payload)
+		payloads = append(payloads, payload)
+		if output := fail(hook, payload); output != "" {
+			return []byte(output), errors.New("exit status 1")
+		}
+		return nil, nil
+	}
+	return result, &payloads
+}
+
+func TestHooksPreCommand(t *testing.T) {
+	// blocks rm -rf by printing a reason and exiting 1
+	hooks := NewHooks([]*Hook{
+		{Event: HookPostResponse, Command: "exit 1"},
+		{Event: HookPreCommand, Command: `grep -q '"command":"rm -rf' && { echo no deleting; exit 1; }; exit 0`},
+	})
+	assert.Nil(t, hooks.PreCommand(context.Background(), "ls", ""))
+	err := hooks.PreCommand(context.Background(), "rm -rf /", "/src")
+	assert.EqualError(t, err, `Command blocked by hook grep -q '"command":"rm -rf' && { echo no deleting; exit 1; }; exit 0: no deleting`)
+
+	// a hook that doesn't answer in time blocks too
+	hooks = NewHooks([]*Hook{{Event: HookPreCommand, Command: "sleep 5", Timeout: 100 * time.Millisecond}})
+	err = hooks.PreCommand(context.Background(), "ls", "")
+	assert.EqualError(t, err, "Command blocked by hook sleep 5: timed out after 100ms")
+
+	// no hooks, nothing to block
+	var none *Hooks
+	assert.Nil(t, none.PreCommand(context.Background(), "rm -rf /", ""))
+	none.SessionEnd("abc")
+}
+
+func TestHookingLLM(t *testing.T) {
+	hooks, payloads := testHooks([]*Hook{
+		{Event: HookPrePrompt, Command: "log-prompt"},
+		{Event: HookPostResponse, Command: "log-response"},
+		{Event: HookPostResponse, Command: "metrics"},
+	}, func(hook *Hook, payload *HookPayload) string {
+		if hook.Command == "log-response" {
+			return "disk full"
+		}
+		return ""
+	})
+	llm := NewHookingLLM(&echoLLM{}, hooks)
+
+	response, err := llm.Completion(&util.CompletionRequest{Prompt: "hi", Model: "gpt-4o"})
+	assert.Nil(t, err)
+	// a failing hook doesn't fail the request, but stops the hooks after it
+	assert.Equal(t, "echo: hi", response.Completion)
+	assert.Len(t, *payloads, 2)
+	assert.Equal(t, HookPrePrompt, (*payloads)[0].Event)
+	assert.Equal(t, "hi", (*payloads)[0].Prompt)
+	assert.Equal(t, HookPostResponse, (*payloads)[1].Event)
+	assert.Equal(t, "echo: hi", (*payloads)[1].Response)
+	assert.Equal(t, "gpt-4o", (*payloads)[1].Model)
+}
+
+func TestAgentHookVeto(t *testing.T) {
+	llm := &functionCallLLM{responses: []*util.CompletionResponse{
+		callFunction("command", `{"cmd": "rm -rf build"}`),
+		callFunction("command", `{"cmd": "make clean"}`),
+		callFunction("finish", `{"success": true}`),
+	}}
+	executor := &fakeExecutor{}
+	hooks, payloads := testHooks([]*Hook{{Event: HookPreCommand, Command: "check"}},
+		func(hook *Hook, payload *HookPayload) string {
+			if payload.Command == "rm -rf build" {
+				return "not allowed"
+			}
+			return ""
+		})
+
+	agent := NewAgent(llm, executor, "gpt-4o")
+	agent.Unsafe = true
+	agent.Hooks = hooks
+	_, err := agent.Run(context.Background(), "clean up")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"make clean"}, executor.commands)
+	assert.Len(t, *payloads, 2)
+	assert.Equal(t, "Command blocked by hook check: not allowed", lastHistoryBlock(llm.requests[1]).Content)
+}
+
+func TestLoadConfigFileHooks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := "hooks:\n  - event: session_end\n    command: ./report\n    timeout: 1s\n"
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+	configFile, err := LoadConfigFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []*Hook{{Event: HookSessionEnd, Command: "./report", Timeout: time.Second}}, configFile.Hooks)
+
+	assert.Nil(t, os.WriteFile(path, []byte("hooks:\n  - event: pre_exec\n    command: ./check\n"), 0644))
+	_, err = LoadConfigFile(path)
+	assert.ErrorContains(t, err, "Unknown hook event pre_exec")
+
+	assert.Nil(t, os.WriteFile(path, []byte("hooks:\n  - event: pre_command\n"), 0644))
+	_, err = LoadConfigFile(path)
+	assert.ErrorContains(t, err, "Hook for pre_command without a command")
+}
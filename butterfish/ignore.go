@@ -0,0 +1,143 @@
+package butterfish
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A small implementation of .gitignore rules for walking a directory tree,
+// covering what most projects use: globs with * ? [] and **, ! to re-include,
+// a trailing / to match only directories, and a / at the start or in the
+// middle to anchor a pattern to the directory of its .gitignore.
+
+type ignoreRule struct {
+	// directory of the .gitignore, relative to the walk root, "" for the root
+	base    string
+	regex   *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+type IgnoreRules struct {
+	rules []*ignoreRule
+}
+
+// Turn a .gitignore glob into a regex matching a slash separated path
+func ignoreGlobToRegex(glob string) string {
+	builder := strings.Builder{}
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			builder.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			builder.WriteString("(/.*)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			builder.WriteString(".*")
+			i++
+		case c == '*':
+			builder.WriteString("[^/]*")
+		case c == '?':
+			builder.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				builder.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			builder.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			builder.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			builder.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return builder.String()
+}
+
+// Add the rules from a .gitignore's content, base is its directory relative
+// to the walk root
+func (this *IgnoreRules) Add(base, content string) {
+	if base == "." {
+		base = ""
+	}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := &ignoreRule{base: filepath.ToSlash(base)}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+
+		pattern := ignoreGlobToRegex(strings.TrimPrefix(line, "/"))
+		if !strings.Contains(line, "/") {
+			// no slash matches the name at any depth
+			pattern = "(.*/)?" + pattern
+		}
+		regex, err := regexp.Compile("^" + pattern + "$")
+		if err != nil {
+			continue
+		}
+		rule.regex = regex
+		this.rules = append(this.rules, rule)
+	}
+}
+
+// Add the rules in dir/.gitignore if there is one
+func (this *IgnoreRules) AddFile(root, dir string) error {
+	content, err := os.ReadFile(filepath.Join(root, dir, ".gitignore"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	this.Add(dir, string(content))
+	return nil
+}
+
+// Whether a path relative to the walk root is ignored, later rules override
+// earlier ones like in git
+func (this *IgnoreRules) Ignored(path string, isDir bool) bool {
+	path = filepath.ToSlash(path)
+	ignored := false
+	for _, rule := range this.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		rel := path
+		if rule.base != "" {
+			if !strings.HasPrefix(path, rule.base+"/") {
+				continue
+			}
+			rel = strings.TrimPrefix(path, rule.base+"/")
+		}
+		if rule.regex.MatchString(rel) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
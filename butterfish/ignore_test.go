@@ -0,0 +1,33 @@
+package butterfish
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	rules := &IgnoreRules{}
+	rules.Add("", "# comment\n*.log\n!keep.log\nbuild/\n/dist\ndocs/**/*.tmp\nfoo[0-9].txt\n")
+	rules.Add("sub", "local.txt\n/anchored.txt\n")
+
+	assert.True(t, rules.Ignored("debug.log", false))
+	assert.True(t, rules.Ignored("a/b/debug.log", false))
+	assert.False(t, rules.Ignored("keep.log", false))
+	assert.True(t, rules.Ignored("build", true))
+	assert.True(t, rules.Ignored("a/build", true))
+	assert.False(t, rules.Ignored("build", false))
+	assert.True(t, rules.Ignored("dist", true))
+	assert.False(t, rules.Ignored("a/dist", true))
+	assert.True(t, rules.Ignored("docs/x.tmp", false))
+	assert.True(t, rules.Ignored("docs/a/b/x.tmp", false))
+	assert.False(t, rules.Ignored("x.tmp", false))
+	assert.True(t, rules.Ignored("foo1.txt", false))
+	assert.False(t, rules.Ignored("fooa.txt", false))
+
+	assert.True(t, rules.Ignored("sub/local.txt", false))
+	assert.True(t, rules.Ignored("sub/x/local.txt", false))
+	assert.False(t, rules.Ignored("local.txt", false))
+	assert.True(t, rules.Ignored("sub/anchored.txt", false))
+	assert.False(t, rules.Ignored("sub/x/anchored.txt", false))
+}
@@ -0,0 +1,82 @@
+package butterfish
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// The image command sends an image to a vision model with a prompt, which
+// defaults to asking for a description
+
+const (
+	defaultImagePrompt = "Describe this image."
+	// OpenAI rejects larger images
+	maxImageBytes = 20 * 1024 * 1024
+)
+
+// Read an image from path, or from stdin if path is empty or -, and check
+// that it looks like an image
+func readImage(path string, stdin io.Reader) (*util.CompletionImage, error) {
+	var data []byte
+	var err error
+	if path == "" || path == "-" {
+		if stdin == nil {
+			return nil, errors.New("Please provide an image path or pipe an image on stdin")
+		}
+		path = "stdin"
+		data, err = io.ReadAll(io.LimitReader(stdin, maxImageBytes+1))
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	if len(data) > maxImageBytes {
+		return nil, fmt.Errorf("%s is too large, images can be at most %d MB", path, maxImageBytes/1024/1024)
+	}
+	mimeType := http.DetectContentType(data)
+	if !strings.HasPrefix(mimeType, "image/") {
+		return nil, fmt.Errorf("%s doesn't look like an image, detected %s", path, mimeType)
+	}
+
+	return &util.CompletionImage{MimeType: mimeType, Data: data}, nil
+}
+
+func (this *ButterfishCtx) imageCommand(options *CliCommandConfig) error {
+	image, err := readImage(options.Image.Path, this.getPipedStdinReader())
+	if err != nil {
+		return err
+	}
+
+	prompt := strings.Join(options.Image.Prompt, " ")
+	if prompt == "" {
+		prompt = defaultImagePrompt
+	}
+
+	response, err := this.Prompt(&promptCommand{
+		Prompt:      prompt,
+		Model:       options.Image.Model,
+		NumTokens:   options.Image.NumTokens,
+		Temperature: options.Image.Temperature,
+		NoColor:     options.Image.NoColor,
+		Verbose:     this.Config.Verbose,
+		Images:      []util.CompletionImage{*image},
+	})
+	if err != nil {
+		return err
+	}
+	if response.Refusal != "" {
+		return errors.New(response.RefusalMessage())
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// enough of a PNG for content sniffing
+var testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func TestReadImage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shot.png")
+	assert.Nil(t, os.WriteFile(path, testPNG, 0644))
+
+	image, err := readImage(path, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "image/png", image.MimeType)
+	assert.Equal(t, testPNG, image.Data)
+
+	image, err = readImage("-", bytes.NewReader(testPNG))
+	assert.Nil(t, err)
+	assert.Equal(t, "image/png", image.MimeType)
+
+	_, err = readImage("", strings.NewReader("just text"))
+	assert.ErrorContains(t, err, "stdin doesn't look like an image")
+	_, err = readImage("", nil)
+	assert.ErrorContains(t, err, "Please provide an image")
+}
+
+func TestImageCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shot.png")
+	assert.Nil(t, os.WriteFile(path, testPNG, 0644))
+
+	llm := &echoLLM{}
+	out := new(bytes.Buffer)
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+		Out:           out,
+		// keep the test's stdin out of it
+		InConsoleMode: true,
+	}
+
+	options := &CliCommandConfig{}
+	options.Image.Path = path
+	options.Image.Model = "gpt-4o"
+	options.Image.NoColor = true
+	assert.Nil(t, butterfish.imageCommand(options))
+	assert.Equal(t, "echo: "+defaultImagePrompt, out.String())
+
+	request := llm.requests[0]
+	assert.Equal(t, "gpt-4o", request.Model)
+	assert.Equal(t, []util.CompletionImage{{MimeType: "image/png", Data: testPNG}}, request.Images)
+
+	message := chatUserMessage(request)
+	assert.Equal(t, "", message.Content)
+	assert.Equal(t, defaultImagePrompt, message.MultiContent[0].Text)
+	assert.True(t, strings.HasPrefix(message.MultiContent[1].ImageURL.URL, "data:image/png;base64,iVBORw0KGgo"))
+}
@@ -0,0 +1,137 @@
+package butterfish
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bakks/butterfish/embedding"
+)
+
+// butterfish indexstats reports what's indexed under each path and how stale
+// it is, with what it would take to bring it up to date, so it's easy to
+// decide whether to run butterfish index again.
+
+type IndexStatsReport struct {
+	*embedding.IndexStats
+	// What butterfish index would embed for the path, new files as well as
+	// stale ones
+	RefreshFiles  int `json:"refresh_files"`
+	RefreshChunks int `json:"refresh_chunks"`
+	// Estimated cost of the refresh, nil for backends that don't cost
+	// anything
+	RefreshCost    *CostEstimate `json:"-"`
+	RefreshTokens  int           `json:"refresh_tokens,omitempty"`
+	RefreshDollars float64       `json:"refresh_dollars,omitempty"`
+}
+
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, word)
+	}
+	return fmt.Sprintf("%d %ss", n, word)
+}
+
+func WriteIndexStats(out io.Writer, report *IndexStatsReport) {
+	stats := report.IndexStats
+	fmt.Fprintf(out, "%s\n", stats.Path)
+	if stats.Files == 0 {
+		fmt.Fprintf(out, "  Not indexed\n")
+	} else {
+		fmt.Fprintf(out, "  Files:    %s in %s\n", plural(stats.Files, "file"), plural(stats.Directories, "directory index"))
+		fmt.Fprintf(out, "  Chunks:   %d\n", stats.Chunks)
+		fmt.Fprintf(out, "  On disk:  %s\n", formatBytes(stats.DiskBytes))
+		fmt.Fprintf(out, "  Embedded: %s to %s\n",
+			stats.Oldest.Local().Format(time.DateTime), stats.Newest.Local().Format(time.DateTime))
+		fmt.Fprintf(out, "  Stale:    %s modified since embedding\n", plural(len(stats.Stale), "file"))
+		for _, path := range stats.Stale {
+			fmt.Fprintf(out, "    %s\n", path)
+		}
+		if len(stats.Deleted) > 0 {
+			fmt.Fprintf(out, "  Deleted:  %s deleted since embedding\n", plural(len(stats.Deleted), "file"))
+			for _, path := range stats.Deleted {
+				fmt.Fprintf(out, "    %s\n", path)
+			}
+		}
+	}
+
+	if report.RefreshFiles == 0 {
+		fmt.Fprintf(out, "  Refresh:  up to date\n")
+		return
+	}
+	refresh := fmt.Sprintf("%s, %s", plural(report.RefreshFiles, "file"), plural(report.RefreshChunks, "chunk"))
+	if report.RefreshCost != nil {
+		refresh += ", " + report.RefreshCost.String()
+	}
+	fmt.Fprintf(out, "  Refresh:  %s\n", refresh)
+}
+
+func (this *ButterfishCtx) indexStatsCommand(options *CliCommandConfig) error {
+	opts := options.Indexstats
+	paths := opts.Paths
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	index, err := this.NewEmbeddingIndex(this.Out)
+	if err != nil {
+		return err
+	}
+
+	reports := []*IndexStatsReport{}
+	for _, path := range paths {
+		stats, err := index.Stats(this.Ctx, path)
+		if err != nil {
+			return err
+		}
+		refresh, err := index.EstimatePaths(this.Ctx, []string{path}, false, opts.ChunkSize, opts.MaxChunks)
+		if err != nil {
+			return err
+		}
+
+		report := &IndexStatsReport{
+			IndexStats:    stats,
+			RefreshFiles:  refresh.Files,
+			RefreshChunks: refresh.Chunks,
+		}
+		// only the OpenAI backend costs anything
+		if refresh.Files > 0 && this.Config.EmbeddingNeedsToken() {
+			report.RefreshCost = &CostEstimate{
+				Model:    string(GPTEmbeddingsModel),
+				Tokens:   int(refresh.Bytes / 4),
+				Requests: refresh.Calls,
+			}
+			report.RefreshTokens = report.RefreshCost.Tokens
+			report.RefreshDollars, _ = report.RefreshCost.Dollars()
+		}
+		reports = append(reports, report)
+	}
+
+	if opts.Json {
+		output, err := json.MarshalIndent(reports, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(this.Out, "%s\n", output)
+		return nil
+	}
+
+	for _, report := range reports {
+		WriteIndexStats(this.Out, report)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package butterfish
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/embedding"
+)
+
+func TestWriteIndexStats(t *testing.T) {
+	embedded := time.Date(2024, 5, 1, 10, 12, 3, 0, time.Local)
+	report := &IndexStatsReport{
+		IndexStats: &embedding.IndexStats{
+			Path:        "/src/hello",
+			Directories: 1,
+			Files:       2,
+			Chunks:      5,
+			DiskBytes:   2048,
+			Oldest:      embedded,
+			Newest:      embedded,
+			Stale:       []string{"/src/hello/main.go"},
+		},
+		RefreshFiles:  1,
+		RefreshChunks: 3,
+	}
+
+	out := new(bytes.Buffer)
+	WriteIndexStats(out, report)
+	assert.Equal(t, `/src/hello
+  Files:    2 files in 1 directory index
+  Chunks:   5
+  On disk:  2.0 KB
+  Embedded: 2024-05-01 10:12:03 to 2024-05-01 10:12:03
+  Stale:    1 file modified since embedding
+    /src/hello/main.go
+  Refresh:  1 file, 3 chunks
+`, out.String())
+
+	out.Reset()
+	WriteIndexStats(out, &IndexStatsReport{IndexStats: &embedding.IndexStats{Path: "/tmp"}})
+	assert.Equal(t, "/tmp\n  Not indexed\n  Refresh:  up to date\n", out.String())
+}
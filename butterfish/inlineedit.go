@@ -0,0 +1,231 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// Inline edit rewrites the command being typed in shell mode. While typing a
+// command the user presses the inline edit key, ctrl-x ctrl-b by default, and
+// types an instruction on the line below, e.g. "make it recursive and ignore
+// node_modules". On enter we ask the LLM for the rewritten command and swap
+// it into the shell's line editor, nothing is executed.
+
+const DefaultInlineEditKey = "ctrl-x ctrl-b"
+
+const inlineEditMarker = "✎ "
+
+// Parse a key sequence like "ctrl-x ctrl-b" or "alt-e" into the bytes the
+// terminal sends for it. "none" or an empty string returns nil.
+func ParseKeySequence(spec string) ([]byte, error) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	if spec == "" || spec == "none" {
+		return nil, nil
+	}
+
+	sequence := []byte{}
+	for _, key := range strings.Fields(spec) {
+		switch {
+		case strings.HasPrefix(key, "ctrl-") && len(key) == 6:
+			c := key[5]
+			if c < 'a' || c > 'z' {
+				return nil, fmt.Errorf("Unsupported key %s, ctrl keys must be a letter", key)
+			}
+			sequence = append(sequence, c-'a'+1)
+		case strings.HasPrefix(key, "alt-") && len(key) == 5:
+			sequence = append(sequence, 0x1b, key[4])
+		case key == "esc":
+			sequence = append(sequence, 0x1b)
+		default:
+			return nil, fmt.Errorf("Unsupported key %s, use keys like ctrl-x or alt-e", key)
+		}
+	}
+
+	// these would never reach us as a key press
+	switch sequence[0] {
+	case 0x03, '\r', '\t':
+		return nil, fmt.Errorf("%s is already used by the shell", spec)
+	}
+	return sequence, nil
+}
+
+type InlineEditResult struct {
+	Command string
+	Err     error
+}
+
+// Pull the command out of the LLM's answer, which should only be the command
+// but sometimes comes in a code block
+func cleanInlineEdit(completion string) (string, error) {
+	command := strings.TrimSpace(completion)
+	if strings.HasPrefix(command, "```") {
+		lines := strings.Split(command, "\n")
+		lines = lines[1:]
+		if len(lines) > 0 && strings.HasPrefix(strings.TrimSpace(lines[len(lines)-1]), "```") {
+			lines = lines[:len(lines)-1]
+		}
+		command = strings.TrimSpace(strings.Join(lines, "\n"))
+	}
+	command = strings.TrimPrefix(command, "$ ")
+
+	if command == "" {
+		return "", errors.New("The LLM didn't return a command")
+	}
+	if strings.Contains(command, "\n") {
+		// a newline in the line editor would run the command
+		return "", errors.New("The rewrite has more than one line, try asking for a single line")
+	}
+	return command, nil
+}
+
+// This is a function rather than a routine so it only touches what it's
+// passed while running as a goroutine
+func RequestInlineEdit(request *util.CompletionRequest, llmClient LLM, resultChan chan<- *InlineEditResult) {
+	response, err := llmClient.Completion(request)
+	if request.Ctx.Err() != nil {
+		// canceled by the user
+		return
+	}
+	if err != nil {
+		resultChan <- &InlineEditResult{Err: err}
+		return
+	}
+
+	command, err := cleanInlineEdit(response.Completion)
+	resultChan <- &InlineEditResult{Command: command, Err: err}
+}
+
+// The user pressed the inline edit key, open the instruction line below the
+// command
+func (this *ShellState) InlineEditStart() {
+	this.ClearAutosuggest(this.Color.Command)
+	if this.AutosuggestCancel != nil {
+		this.AutosuggestCancel()
+	}
+
+	_, col := this.GetCursorPosition()
+	this.InlineEditColumn = col
+	this.InlineEditCommand = this.Command.String()
+	this.setState(stateInlineEdit)
+
+	fmt.Fprintf(this.ParentOut, "\r\n%s%s", this.Color.Prompt, inlineEditMarker)
+	_, col = this.GetCursorPosition()
+	this.InlineEditBuffer = NewShellBuffer()
+	this.InlineEditBuffer.SetTerminalWidth(this.TerminalWidth)
+	this.InlineEditBuffer.SetColor(this.Color.Prompt)
+	this.InlineEditBuffer.SetPromptLength(col - 1)
+}
+
+// Send the command and instruction to the LLM, the answer comes back on
+// InlineEditChan
+func (this *ShellState) InlineEditSubmit() {
+	instruction := strings.TrimSpace(this.InlineEditBuffer.String())
+	if instruction == "" {
+		this.InlineEditFinish("", "")
+		return
+	}
+
+	config := this.Butterfish.Config
+	editPrompt, err := this.Butterfish.PromptLibrary.GetPromptForModel(
+		prompt.ShellInlineEdit, config.ShellPromptModel,
+		"command", this.InlineEditCommand,
+		"instruction", instruction,
+		"sysinfo", this.Butterfish.SystemInfo(childShellDir()))
+	if err != nil {
+		log.Printf("Could not retrieve inline edit prompt: %s", err)
+		this.InlineEditFinish("", err.Error())
+		return
+	}
+
+	requestCtx, cancel := context.WithCancel(context.Background())
+	this.InlineEditCancel = cancel
+
+	request := &util.CompletionRequest{
+		Ctx:         requestCtx,
+		Prompt:      editPrompt,
+		Model:       config.ShellPromptModel,
+		MaxTokens:   256,
+		Temperature: 0.2,
+		Verbose:     config.Verbose > 0,
+	}
+	config.LimitRequest(FeaturePrompt, request)
+
+	go RequestInlineEdit(request, this.Butterfish.LLMClient, this.InlineEditChan)
+}
+
+func (this *ShellState) InlineEditDone(result *InlineEditResult) {
+	if this.State != stateInlineEdit || this.InlineEditCancel == nil {
+		// the user canceled while we were waiting
+		return
+	}
+	this.InlineEditCancel = nil
+
+	if result.Err != nil {
+		log.Printf("Inline edit error: %s", result.Err)
+		this.InlineEditFinish("", result.Err.Error())
+		return
+	}
+	this.InlineEditFinish(result.Command, "")
+}
+
+// Leave inline edit, moving the cursor back to where it was in the command.
+// If we have a new command it replaces the one in the shell's line editor,
+// if we have a message it stays on the instruction line.
+func (this *ShellState) InlineEditFinish(command, message string) {
+	if this.InlineEditCancel != nil {
+		this.InlineEditCancel()
+		this.InlineEditCancel = nil
+	}
+
+	fmt.Fprintf(this.ParentOut, "\r%s", ESC_CLEAR)
+	if message != "" {
+		fmt.Fprintf(this.ParentOut, "%s%s", this.Color.Error, message)
+	}
+	fmt.Fprintf(this.ParentOut, ESC_UP+"\r", 1)
+	if this.InlineEditColumn > 1 {
+		fmt.Fprintf(this.ParentOut, ESC_RIGHT, this.InlineEditColumn-1)
+	}
+	this.ParentOut.Write([]byte(this.Color.Command))
+	this.setState(stateShell)
+
+	if command == "" || command == this.InlineEditCommand {
+		return
+	}
+	// Ctrl-E Ctrl-U clears the line in the emacs keymaps of bash and zsh, then
+	// the shell echoes the new command, without a newline it isn't run
+	this.ChildIn.Write([]byte("\x05\x15" + command))
+	this.Command = NewShellBuffer()
+	this.Command.Write(command)
+}
+
+func (this *ShellState) InlineEditInput(data []byte) []byte {
+	if this.InlineEditCancel != nil {
+		// Waiting on the LLM, Ctrl-C cancels, other input is buffered until
+		// we're done
+		if data[0] == 0x03 {
+			this.InlineEditFinish("", "")
+			return data[1:]
+		}
+		return data
+	}
+
+	if index := strings.IndexByte(string(data), '\r'); index != -1 {
+		this.ParentOut.Write(this.InlineEditBuffer.Write(string(data[:index])))
+		this.InlineEditSubmit()
+		return data[index+1:]
+	}
+
+	if data[0] == 0x03 || (len(data) == 1 && data[0] == 0x1b) { // Ctrl-C or Esc
+		this.InlineEditFinish("", "")
+		return data[1:]
+	}
+
+	this.ParentOut.Write(this.InlineEditBuffer.Write(string(data)))
+	return nil
+}
@@ -0,0 +1,79 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func TestParseKeySequence(t *testing.T) {
+	key, err := ParseKeySequence(DefaultInlineEditKey)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x18, 0x02}, key)
+
+	key, err = ParseKeySequence("Alt-e")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x1b, 'e'}, key)
+
+	key, err = ParseKeySequence("none")
+	assert.Nil(t, err)
+	assert.Nil(t, key)
+
+	_, err = ParseKeySequence("ctrl-1")
+	assert.NotNil(t, err)
+	_, err = ParseKeySequence("ctrl-c")
+	assert.NotNil(t, err)
+	_, err = ParseKeySequence("shift-x")
+	assert.NotNil(t, err)
+}
+
+func TestCleanInlineEdit(t *testing.T) {
+	command, err := cleanInlineEdit("  grep -r foo . --exclude-dir=node_modules\n")
+	assert.Nil(t, err)
+	assert.Equal(t, "grep -r foo . --exclude-dir=node_modules", command)
+
+	command, err = cleanInlineEdit("```bash\n$ ls -la\n```")
+	assert.Nil(t, err)
+	assert.Equal(t, "ls -la", command)
+
+	_, err = cleanInlineEdit("cd foo\nls")
+	assert.NotNil(t, err)
+	_, err = cleanInlineEdit("```\n```")
+	assert.NotNil(t, err)
+}
+
+func TestInlineEdit(t *testing.T) {
+	llm := &scriptedLLM{responses: []string{"```\ngrep -r foo . --exclude-dir=node_modules\n```"}}
+	resultChan := make(chan *InlineEditResult, 1)
+	request := &util.CompletionRequest{Ctx: context.Background(), Prompt: "rewrite"}
+	RequestInlineEdit(request, llm, resultChan)
+	result := <-resultChan
+	assert.Nil(t, result.Err)
+
+	childIn := new(bytes.Buffer)
+	state := &ShellState{
+		Butterfish:        &ButterfishCtx{Config: MakeButterfishConfig()},
+		ParentOut:         new(bytes.Buffer),
+		ChildIn:           childIn,
+		Color:             DarkShellColorScheme,
+		State:             stateInlineEdit,
+		Command:           NewShellBuffer(),
+		InlineEditCommand: "grep foo .",
+		InlineEditColumn:  12,
+		InlineEditCancel:  func() {},
+	}
+	state.InlineEditDone(result)
+
+	assert.Equal(t, stateShell, state.State)
+	assert.Equal(t, "\x05\x15grep -r foo . --exclude-dir=node_modules", childIn.String())
+	assert.Equal(t, "grep -r foo . --exclude-dir=node_modules", state.Command.String())
+
+	// a late result after canceling is dropped
+	childIn.Reset()
+	state.InlineEditDone(result)
+	assert.Equal(t, "", childIn.String())
+}
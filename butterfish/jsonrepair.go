@@ -0,0 +1,235 @@
+package butterfish
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+)
+
+// Models, especially small local ones, often write function arguments that
+// are almost JSON: a shell command with unescaped quotes or bash escapes like
+// \; in it, a trailing comma, single quotes, a literal newline in a string, a
+// code fence around the object, or an object cut off at the end. RepairJSON
+// rewrites these as valid JSON, guessing at what the model meant, and
+// unmarshalToolArguments uses it for every function and tool call.
+//
+// The guess for quotes inside a string: a quote ends the string only if
+// what follows could come after a string, e.g. a comma and the next key, and
+// otherwise is part of it.
+
+// Unmarshal function or tool call arguments, repairing them if they aren't
+// valid JSON
+func unmarshalToolArguments(params string, v any) error {
+	err := json.Unmarshal([]byte(params), v)
+	if err == nil {
+		return nil
+	}
+	repaired := RepairJSON(params)
+	if repaired == params || json.Unmarshal([]byte(repaired), v) != nil {
+		return err
+	}
+	log.Printf("Repaired malformed JSON arguments: %s", params)
+	return nil
+}
+
+// Rewrite almost-JSON as valid JSON, valid JSON is returned as it is
+func RepairJSON(s string) string {
+	if json.Valid([]byte(s)) {
+		return s
+	}
+	repairer := &jsonRepairer{input: []rune(stripCodeFence(s))}
+	return repairer.repair()
+}
+
+// Remove a markdown code fence around the JSON, e.g. ```json ... ```
+func stripCodeFence(s string) string {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "```") {
+		return s
+	}
+	s = strings.TrimPrefix(s, "```")
+	if newline := strings.Index(s, "\n"); newline != -1 {
+		s = s[newline+1:]
+	}
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "```"))
+}
+
+type jsonRepairer struct {
+	input []rune
+	pos   int
+	out   strings.Builder
+	// open objects and arrays, { or [
+	stack []rune
+}
+
+func (this *jsonRepairer) repair() string {
+	for this.pos < len(this.input) {
+		ch := this.input[this.pos]
+		switch {
+		case ch == '"' || ch == '\'':
+			this.readString(ch)
+			continue
+		case ch == '{' || ch == '[':
+			this.stack = append(this.stack, ch)
+		case ch == '}' || ch == ']':
+			if len(this.stack) > 0 {
+				this.stack = this.stack[:len(this.stack)-1]
+			}
+		case ch == ',':
+			// drop a trailing comma
+			if next := this.nextNonSpace(this.pos + 1); next < len(this.input) &&
+				(this.input[next] == '}' || this.input[next] == ']') {
+				this.pos++
+				continue
+			}
+		case unicode.IsLetter(ch) || ch == '_':
+			this.readBareWord()
+			continue
+		}
+		this.out.WriteRune(ch)
+		this.pos++
+	}
+
+	// close whatever was cut off
+	for i := len(this.stack) - 1; i >= 0; i-- {
+		if this.stack[i] == '{' {
+			this.out.WriteRune('}')
+		} else {
+			this.out.WriteRune(']')
+		}
+	}
+	return this.out.String()
+}
+
+// Read a string delimited by quote, writing it out double quoted and escaped
+func (this *jsonRepairer) readString(quote rune) {
+	this.out.WriteRune('"')
+	this.pos++
+
+	for this.pos < len(this.input) {
+		ch := this.input[this.pos]
+		switch {
+		case ch == '\\' && this.pos+1 < len(this.input):
+			next := this.input[this.pos+1]
+			switch {
+			case strings.ContainsRune(`"\/bfnrt`, next):
+				this.out.WriteRune('\\')
+				this.out.WriteRune(next)
+			case next == 'u' && this.pos+5 < len(this.input) && isHex(this.input[this.pos+2:this.pos+6]):
+				this.out.WriteString(`\u`)
+			case next == '\'':
+				this.out.WriteRune('\'')
+			default:
+				// a bash escape like \; means a literal backslash
+				this.out.WriteString(`\\`)
+				this.out.WriteRune(next)
+			}
+			this.pos += 2
+			continue
+		case ch == quote && this.endsString(this.pos+1):
+			this.out.WriteRune('"')
+			this.pos++
+			return
+		case ch == '"':
+			this.out.WriteString(`\"`)
+		case ch == '\\':
+			this.out.WriteString(`\\`)
+		case ch == '\n':
+			this.out.WriteString(`\n`)
+		case ch == '\r':
+			this.out.WriteString(`\r`)
+		case ch == '\t':
+			this.out.WriteString(`\t`)
+		case ch < 0x20:
+			fmt.Fprintf(&this.out, `\u%04x`, ch)
+		default:
+			this.out.WriteRune(ch)
+		}
+		this.pos++
+	}
+
+	// the input ended inside the string
+	this.out.WriteRune('"')
+}
+
+// Whether a quote followed by the input at pos ends a string
+func (this *jsonRepairer) endsString(pos int) bool {
+	next := this.nextNonSpace(pos)
+	if next >= len(this.input) {
+		return true
+	}
+	switch this.input[next] {
+	case ':', '}', ']':
+		return true
+	case ',':
+		after := this.nextNonSpace(next + 1)
+		if after >= len(this.input) {
+			return true
+		}
+		if len(this.stack) > 0 && this.stack[len(this.stack)-1] == '[' {
+			return true
+		}
+		// in an object a comma is followed by the next key
+		ch := this.input[after]
+		return ch == '"' || ch == '\'' || ch == '}' || this.isBareKey(after)
+	}
+	return false
+}
+
+// Read an unquoted word outside a string: a key, a literal, or Python's
+// True, False, and None
+func (this *jsonRepairer) readBareWord() {
+	start := this.pos
+	for this.pos < len(this.input) && isWordRune(this.input[this.pos]) {
+		this.pos++
+	}
+	word := string(this.input[start:this.pos])
+
+	switch {
+	case this.isBareKey(start):
+		this.out.WriteString(`"` + word + `"`)
+	case word == "True":
+		this.out.WriteString("true")
+	case word == "False":
+		this.out.WriteString("false")
+	case word == "None":
+		this.out.WriteString("null")
+	default:
+		this.out.WriteString(word)
+	}
+}
+
+// Whether there's an unquoted key at pos, i.e. a word followed by a colon
+func (this *jsonRepairer) isBareKey(pos int) bool {
+	end := pos
+	for end < len(this.input) && isWordRune(this.input[end]) {
+		end++
+	}
+	if end == pos || unicode.IsDigit(this.input[pos]) {
+		return false
+	}
+	colon := this.nextNonSpace(end)
+	return colon < len(this.input) && this.input[colon] == ':'
+}
+
+func (this *jsonRepairer) nextNonSpace(pos int) int {
+	for pos < len(this.input) && unicode.IsSpace(this.input[pos]) {
+		pos++
+	}
+	return pos
+}
+
+func isWordRune(ch rune) bool {
+	return unicode.IsLetter(ch) || unicode.IsDigit(ch) || ch == '_'
+}
+
+func isHex(runes []rune) bool {
+	for _, ch := range runes {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", ch) {
+			return false
+		}
+	}
+	return true
+}
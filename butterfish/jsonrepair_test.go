@@ -0,0 +1,50 @@
+package butterfish
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type jsonRepairCase struct {
+	Name  string `yaml:"name"`
+	Input string `yaml:"input"`
+	Want  string `yaml:"want"`
+}
+
+func TestRepairJSONCorpus(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "jsonrepair", "corpus.yaml"))
+	assert.Nil(t, err)
+	cases := []*jsonRepairCase{}
+	assert.Nil(t, yaml.UnmarshalStrict(data, &cases))
+	assert.NotEmpty(t, cases)
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			repaired := RepairJSON(c.Input)
+			assert.True(t, json.Valid([]byte(repaired)), repaired)
+			assert.JSONEq(t, c.Want, repaired)
+		})
+	}
+}
+
+func TestParseCommandParams(t *testing.T) {
+	cmd, err := parseCommandParams(`{"cmd": "git commit -m "Fix the parser""}`)
+	assert.Nil(t, err)
+	assert.Equal(t, `git commit -m "Fix the parser"`, cmd)
+
+	cmd, err = parseCommandParams("{\n  \"cmd\": \"ls ~\",\n}")
+	assert.Nil(t, err)
+	assert.Equal(t, "ls ~", cmd)
+
+	_, err = parseCommandParams(`ls ~`)
+	assert.ErrorContains(t, err, "Unable to parse command params")
+
+	params, err := parseFinishParams(`{'success': True}`)
+	assert.Nil(t, err)
+	assert.True(t, params.Success)
+}
@@ -0,0 +1,480 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// The log middleware prints each LLM request and response to the log as
+// nested boxes with -v, the same for any backend. With --log-format=jsonl we
+// write one JSON record per LLM request to the log file instead of the
+// boxes, so that traffic can be analyzed with tools like jq or attached to
+// bug reports. Records are written without the log's timestamp prefix, so
+// `grep '^{' butterfish.log` finds them.
+
+const (
+	LogFormatBoxes = "boxes"
+	LogFormatJSONL = "jsonl"
+)
+
+// Long content is truncated to keep the log a reasonable size
+const maxLogContentLength = 2000
+
+type llmLogMessage struct {
+	Type    string `json:"type"`
+	Content string `json:"content"`
+}
+
+type llmLogFunctionCall struct {
+	ID        string `json:"id,omitempty"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type llmLogRecord struct {
+	Time          time.Time            `json:"time"`
+	Request       string               `json:"request"`
+	Model         string               `json:"model,omitempty"`
+	Temperature   float32              `json:"temperature,omitempty"`
+	MaxTokens     int                  `json:"max_tokens,omitempty"`
+	SystemMessage string               `json:"system_message,omitempty"`
+	Prompt        string               `json:"prompt,omitempty"`
+	History       []llmLogMessage      `json:"history,omitempty"`
+	Functions     []string             `json:"functions,omitempty"`
+	Images        int                  `json:"images,omitempty"`
+	Inputs        int                  `json:"inputs,omitempty"`
+	Completion    string               `json:"completion,omitempty"`
+	FunctionCall  *llmLogFunctionCall  `json:"function_call,omitempty"`
+	ToolCalls     []llmLogFunctionCall `json:"tool_calls,omitempty"`
+	Refusal       string               `json:"refusal,omitempty"`
+	// Prompt tokens as reported by the API, or estimated if it didn't say
+	PromptTokens     int    `json:"prompt_tokens,omitempty"`
+	CompletionTokens int    `json:"completion_tokens,omitempty"`
+	LatencyMs        int64  `json:"latency_ms"`
+	FirstTokenMs     int64  `json:"first_token_ms,omitempty"`
+	Retries          int    `json:"retries,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+// Prints the requests and responses with -v
+type LoggingLLM struct {
+	LLM LLM
+}
+
+func NewLoggingLLM(llm LLM) *LoggingLLM {
+	return &LoggingLLM{LLM: llm}
+}
+
+func (this *LoggingLLM) Unwrap() LLM {
+	return this.LLM
+}
+
+func (this *LoggingLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	logRequestBox(request)
+	response, err := this.LLM.CompletionStream(request, writer)
+	if request.Verbose && err == nil && response != nil {
+		LogCompletionResponse(*response)
+	}
+	return response, err
+}
+
+func (this *LoggingLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	logRequestBox(request)
+	response, err := this.LLM.Completion(request)
+	if request.Verbose && err == nil && response != nil {
+		LogCompletionResponse(*response)
+	}
+	return response, err
+}
+
+func (this *LoggingLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	if verbose {
+		summary := fmt.Sprintf("Embedding %d strings: [", len(input))
+		for i, s := range input {
+			if i > 0 {
+				summary += ",\n"
+			} else {
+				summary += "\n"
+			}
+			summary += s[:util.Min(20, len(s))]
+		}
+		summary += "\n]"
+		fmt.Printf("%s\n", summary)
+	}
+	return this.LLM.Embeddings(ctx, input, verbose)
+}
+
+// Print the request as the OpenAI API would see it, with the legacy
+// completion API for completion models and the chat API otherwise
+func logRequestBox(request *util.CompletionRequest) {
+	if !request.Verbose {
+		return
+	}
+
+	if IsCompletionModel(request.Model) {
+		LogCompletionRequest(openai.CompletionRequest{
+			Prompt:      request.Prompt,
+			Model:       request.Model,
+			MaxTokens:   request.MaxTokens,
+			Temperature: request.Temperature,
+		})
+		return
+	}
+
+	messages := ShellHistoryBlocksToGPTChat(request.SystemMessage, request.HistoryBlocks)
+	if request.Prompt != "" || request.HistoryBlocks == nil {
+		messages = append(messages, chatUserMessage(request))
+	}
+	LogChatCompletionRequest(openai.ChatCompletionRequest{
+		Model:       request.Model,
+		Messages:    messages,
+		MaxTokens:   request.MaxTokens,
+		Temperature: request.Temperature,
+		Functions:   convertToOpenaiFunctions(request.Functions),
+		Tools:       convertToOpenaiTools(request.Tools),
+	})
+}
+
+func LogCompletionResponse(resp util.CompletionResponse) {
+	box := LoggingBox{
+		Title:    "Completion Response",
+		Content:  resp.Completion,
+		Color:    0,
+		Children: []LoggingBox{},
+	}
+
+	if resp.FunctionName != "" {
+		params := PrettyJSON(resp.FunctionParameters)
+		box.Children = []LoggingBox{
+			{
+				Title:   "Function Call",
+				Content: fmt.Sprintf("%s\n%s", resp.FunctionName, params),
+				Color:   2,
+			},
+		}
+	}
+
+	if resp.ToolCalls != nil {
+		for _, toolCall := range resp.ToolCalls {
+			params := PrettyJSON(toolCall.Function.Parameters)
+			box.Children = append(box.Children, LoggingBox{
+				Title:   "Tool Call",
+				Content: fmt.Sprintf("%s  %s\n%s", toolCall.Function.Name, toolCall.Id, params),
+				Color:   2,
+			})
+		}
+	}
+
+	if resp.Metrics != nil {
+		box.Children = append(box.Children, LoggingBox{
+			Title:   "Metrics",
+			Content: resp.Metrics.String(),
+			Color:   3,
+		})
+	}
+
+	PrintLoggingBox(box)
+}
+
+func LogCompletionRequest(req openai.CompletionRequest) {
+	meta := fmt.Sprintf("model:       %s\ntemperature: %f\nmax_tokens:  %d",
+		req.Model, req.Temperature, req.MaxTokens)
+
+	box := LoggingBox{
+		Title:   " Completion Request /v1/completions ",
+		Content: meta,
+		Color:   0,
+		Children: []LoggingBox{
+			{
+				Title:   "Prompt",
+				Content: req.Prompt.(string),
+				Color:   1,
+			},
+		},
+	}
+
+	PrintLoggingBox(box)
+}
+
+// function to accept a string and replace non basic printable ascii characters with
+// their hex values
+func replaceNonAscii(s string) string {
+	out := []rune{}
+	for _, r := range s {
+		if !(r >= 33 && r < 127) {
+			out = append(out, []rune(fmt.Sprintf("\\x%02x", r))...)
+		} else {
+			out = append(out, r)
+		}
+	}
+	return string(out)
+}
+
+func LogChatCompletionRequest(req openai.ChatCompletionRequest) {
+	meta := fmt.Sprintf("model:       %s\ntemperature: %f\nmax_tokens:  %d",
+		req.Model, req.Temperature, req.MaxTokens)
+
+	historyBoxes := []LoggingBox{}
+	for _, message := range req.Messages {
+		color := 0
+		title := message.Role
+
+		switch message.Role {
+		case "user":
+			color = 4
+		case "assistant":
+			color = 5
+		case "system":
+			color = 6
+		case "function":
+			color = 3
+			title = fmt.Sprintf("%s: %s", message.Role, message.Name)
+		case "tool":
+			color = 3
+			title = fmt.Sprintf("%s: %s %s", message.Role, message.Name, message.ToolCallID)
+		}
+
+		content := message.Content
+		for _, part := range message.MultiContent {
+			if part.Type == openai.ChatMessagePartTypeImageURL {
+				// don't log the whole base64 image
+				content += "[image]\n"
+			} else {
+				content += part.Text + "\n"
+			}
+		}
+
+		historyBox := LoggingBox{
+			Title:   title,
+			Content: content,
+			Color:   color,
+		}
+
+		if message.FunctionCall != nil {
+			historyBox.Children = []LoggingBox{
+				{
+					Title:   "Function Call",
+					Content: fmt.Sprintf("%s\n%s", message.FunctionCall.Name, message.FunctionCall.Arguments),
+					Color:   3,
+				},
+			}
+		}
+
+		if message.ToolCalls != nil {
+			for _, tool := range message.ToolCalls {
+				historyBox.Children = append(historyBox.Children, LoggingBox{
+					Title:   "Tool Call",
+					Content: fmt.Sprintf("%s\n%s", tool.Function.Name, tool.Function.Arguments),
+					Color:   3,
+				})
+			}
+		}
+
+		historyBoxes = append(historyBoxes, historyBox)
+	}
+
+	box := LoggingBox{
+		Title:   "Completion Request /v1/chat/completions",
+		Content: meta,
+		Color:   0,
+		Children: []LoggingBox{
+			{
+				Title:    "Messages",
+				Children: historyBoxes,
+				Color:    1,
+			},
+		},
+	}
+
+	functionBoxes := []LoggingBox{}
+
+	for _, function := range req.Functions {
+		// list function parameters in a string
+		functionBoxes = append(functionBoxes, LoggingBox{
+			Title:   function.Name,
+			Content: fmt.Sprintf("%s\n%s", function.Description, function.Parameters),
+			Color:   3,
+		})
+	}
+
+	for _, tool := range req.Tools {
+		params := PrettyJSON(JSONString(tool.Function.Parameters))
+		// list function parameters in a string
+		functionBoxes = append(functionBoxes, LoggingBox{
+			Title:   tool.Function.Name,
+			Content: fmt.Sprintf("%s\n%s", tool.Function.Description, params),
+			Color:   3,
+		})
+	}
+
+	if len(functionBoxes) > 0 {
+		box.Children = append(box.Children, LoggingBox{
+			Title:    "Functions",
+			Children: functionBoxes,
+			Color:    2,
+		})
+	}
+
+	PrintLoggingBox(box)
+}
+
+func truncateLogContent(s string) string {
+	if len(s) <= maxLogContentLength {
+		return s
+	}
+	return fmt.Sprintf("%s... [%d more bytes]", s[:maxLogContentLength], len(s)-maxLogContentLength)
+}
+
+type JSONLLoggingLLM struct {
+	LLM LLM
+	// Where records are written, defaults to the log's output
+	Out   io.Writer
+	mutex sync.Mutex
+}
+
+func NewJSONLLoggingLLM(llm LLM) *JSONLLoggingLLM {
+	return &JSONLLoggingLLM{LLM: llm}
+}
+
+func (this *JSONLLoggingLLM) Unwrap() LLM {
+	return this.LLM
+}
+
+func (this *JSONLLoggingLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	start := time.Now()
+	response, err := this.LLM.CompletionStream(this.quiet(request), writer)
+	this.write(requestLogRecord("completion_stream", request, response, err, start))
+	return response, err
+}
+
+func (this *JSONLLoggingLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	start := time.Now()
+	response, err := this.LLM.Completion(this.quiet(request))
+	this.write(requestLogRecord("completion", request, response, err, start))
+	return response, err
+}
+
+func (this *JSONLLoggingLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	start := time.Now()
+	embeddings, err := this.LLM.Embeddings(ctx, input, false)
+
+	record := &llmLogRecord{
+		Time:      start,
+		Request:   "embeddings",
+		Inputs:    len(input),
+		LatencyMs: time.Since(start).Milliseconds(),
+	}
+	for _, text := range input {
+		record.PromptTokens += estimateTokens(text)
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	this.write(record)
+	return embeddings, err
+}
+
+// The records replace the verbose boxes, so turn off the ones printed by
+// middlewares further down, e.g. retry notices
+func (this *JSONLLoggingLLM) quiet(request *util.CompletionRequest) *util.CompletionRequest {
+	if !request.Verbose {
+		return request
+	}
+	quiet := *request
+	quiet.Verbose = false
+	return &quiet
+}
+
+func requestLogRecord(
+	requestType string,
+	request *util.CompletionRequest,
+	response *util.CompletionResponse,
+	err error,
+	start time.Time,
+) *llmLogRecord {
+	record := &llmLogRecord{
+		Time:          start,
+		Request:       requestType,
+		Model:         request.Model,
+		Temperature:   request.Temperature,
+		MaxTokens:     request.MaxTokens,
+		SystemMessage: truncateLogContent(request.SystemMessage),
+		Prompt:        truncateLogContent(request.Prompt),
+		Images:        len(request.Images),
+		PromptTokens:  estimateRequestTokens(request),
+		LatencyMs:     time.Since(start).Milliseconds(),
+	}
+
+	for _, block := range request.HistoryBlocks {
+		record.History = append(record.History, llmLogMessage{
+			Type:    ShellHistoryTypeToRole(block.Type),
+			Content: truncateLogContent(block.Content),
+		})
+	}
+	for _, function := range request.Functions {
+		record.Functions = append(record.Functions, function.Name)
+	}
+	for _, tool := range request.Tools {
+		record.Functions = append(record.Functions, tool.Function.Name)
+	}
+
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if response == nil {
+		return record
+	}
+
+	record.Completion = truncateLogContent(response.Completion)
+	record.Refusal = response.Refusal
+	record.CompletionTokens = estimateTokens(response.Completion) +
+		estimateTokens(response.FunctionParameters)
+	if response.FunctionName != "" {
+		record.FunctionCall = &llmLogFunctionCall{
+			Name:      response.FunctionName,
+			Arguments: truncateLogContent(response.FunctionParameters),
+		}
+	}
+	for _, toolCall := range response.ToolCalls {
+		record.CompletionTokens += estimateTokens(toolCall.Function.Parameters)
+		record.ToolCalls = append(record.ToolCalls, llmLogFunctionCall{
+			ID:        toolCall.Id,
+			Name:      toolCall.Function.Name,
+			Arguments: truncateLogContent(toolCall.Function.Parameters),
+		})
+	}
+
+	if metrics := response.Metrics; metrics != nil {
+		record.FirstTokenMs = metrics.TimeToFirstToken.Milliseconds()
+		record.Retries = metrics.Retries
+		if metrics.PromptTokens > 0 {
+			record.PromptTokens = metrics.PromptTokens
+		}
+	}
+	return record
+}
+
+func (this *JSONLLoggingLLM) write(record *llmLogRecord) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Unable to marshal LLM log record: %s", err)
+		return
+	}
+
+	out := this.Out
+	if out == nil {
+		out = log.Writer()
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	out.Write(append(data, '\n'))
+}
@@ -0,0 +1,100 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func TestJSONLLoggingLLM(t *testing.T) {
+	inner := &echoLLM{}
+	out := new(bytes.Buffer)
+	llm := NewJSONLLoggingLLM(inner)
+	llm.Out = out
+
+	_, err := llm.CompletionStream(&util.CompletionRequest{
+		Model:         "gpt-4o",
+		Prompt:        strings.Repeat("x", maxLogContentLength+10),
+		SystemMessage: "be brief",
+		HistoryBlocks: []util.HistoryBlock{{Type: historyTypeShellOutput, Content: "ls"}},
+		Functions:     []util.FunctionDefinition{{Name: "command"}},
+		Verbose:       true,
+	}, io.Discard)
+	assert.Nil(t, err)
+	// the records replace the verbose boxes
+	assert.False(t, inner.requests[0].Verbose)
+
+	_, err = llm.Embeddings(context.Background(), []string{"a", "b"}, true)
+	assert.Nil(t, err)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+
+	record := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, "completion_stream", record["request"])
+	assert.Equal(t, "gpt-4o", record["model"])
+	assert.Equal(t, "be brief", record["system_message"])
+	assert.Equal(t, []interface{}{"command"}, record["functions"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"type": "user", "content": "ls"}},
+		record["history"])
+	assert.True(t, strings.HasSuffix(record["prompt"].(string), "... [10 more bytes]"))
+	assert.True(t, strings.HasPrefix(record["completion"].(string), "echo: xxx"))
+	assert.Contains(t, record, "latency_ms")
+
+	record = map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &record))
+	assert.Equal(t, "embeddings", record["request"])
+	assert.Equal(t, 2.0, record["inputs"])
+}
+
+func TestLoggingLLM(t *testing.T) {
+	out := new(bytes.Buffer)
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(out)
+
+	llm := NewLoggingLLM(&echoLLM{})
+	_, err := llm.Completion(&util.CompletionRequest{
+		Model:         "gpt-4o",
+		Prompt:        "list files",
+		SystemMessage: "be brief",
+		Functions:     []util.FunctionDefinition{{Name: "command"}},
+		Verbose:       true,
+	})
+	assert.Nil(t, err)
+	assert.Contains(t, out.String(), "Completion Request /v1/chat/completions")
+	assert.Contains(t, out.String(), "be brief")
+	assert.Contains(t, out.String(), "command")
+	assert.Contains(t, out.String(), "Completion Response")
+	assert.Contains(t, out.String(), "echo: list files")
+
+	// only verbose requests are printed
+	out.Reset()
+	_, err = llm.Completion(&util.CompletionRequest{Model: "gpt-4o", Prompt: "quiet"})
+	assert.Nil(t, err)
+	assert.Equal(t, "", out.String())
+
+	// the log middleware prints boxes with -v, records with jsonl
+	config := MakeButterfishConfig()
+	config.LLMClient = &echoLLM{}
+	config.Middleware = []string{MiddlewareLog}
+	chain, err := initLLM(config)
+	assert.Nil(t, err)
+	assert.IsType(t, &echoLLM{}, chain)
+	config.Verbose = 1
+	chain, err = initLLM(config)
+	assert.Nil(t, err)
+	assert.IsType(t, &LoggingLLM{}, chain)
+	config.LogFormat = LogFormatJSONL
+	chain, err = initLLM(config)
+	assert.Nil(t, err)
+	assert.IsType(t, &JSONLLoggingLLM{}, chain)
+}
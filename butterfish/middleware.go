@@ -0,0 +1,200 @@
+package butterfish
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Everything between a command and the model, like redacting secrets or
+// enforcing the token budget, is a middleware, an LLM that wraps another LLM.
+// The chain of middlewares is the same for any backend: the OpenAI client,
+// replayed fixtures, or a client passed in by code using butterfish as a
+// library. The order can be changed with middleware in the config file,
+// listed from the outermost, which sees a request first, to the innermost,
+// which sits on the backend. Leaving a middleware out turns it off.
+//
+// hooks comes after redact so that hooks never see secrets.
+//
+// failover applies the middlewares after it to each fallback model as well
+// as the primary, so by default every model is retried on its own before
+// failing over, and tools emulates function calling for each model that
+// needs it. record marks where requests are recorded, and when replaying
+// the fixtures take the place of record and everything after it.
+
+const (
+	MiddlewareCache    = "cache"
+	MiddlewareBudget   = "budget"
+	MiddlewareRedact   = "redact"
+	MiddlewareHooks    = "hooks"
+	MiddlewareRecord   = "record"
+	MiddlewareFailover = "failover"
+	MiddlewareTools    = "tools"
+	MiddlewareLog      = "log"
+	MiddlewareRetry    = "retry"
+)
+
+var DefaultMiddleware = []string{
+	MiddlewareCache,
+	MiddlewareBudget,
+	MiddlewareRedact,
+	MiddlewareHooks,
+	MiddlewareRecord,
+	MiddlewareFailover,
+	MiddlewareTools,
+	MiddlewareLog,
+	MiddlewareRetry,
+}
+
+// Check a middleware list from the config file
+func ValidateMiddleware(names []string) error {
+	seen := map[string]bool{}
+	for _, name := range names {
+		if !slices.Contains(DefaultMiddleware, name) {
+			return fmt.Errorf("Unknown middleware %s, expected one of %v", name, DefaultMiddleware)
+		}
+		if seen[name] {
+			return fmt.Errorf("Middleware %s is listed more than once", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// An LLM that wraps another, so that we can find a middleware in the chain
+type wrappingLLM interface {
+	Unwrap() LLM
+}
+
+// Find the usage tracking middleware in a chain, nil if there isn't one
+func findUsageTracker(llm LLM) *UsageTrackingLLM {
+	for llm != nil {
+		if tracking, ok := llm.(*UsageTrackingLLM); ok {
+			return tracking
+		}
+		wrapping, ok := llm.(wrappingLLM)
+		if !ok {
+			return nil
+		}
+		llm = wrapping.Unwrap()
+	}
+	return nil
+}
+
+// Builds the middleware chain for a config, state shared by every backend
+// in the chain, like the usage tracker, is created once here
+type middlewareChain struct {
+	config   *ButterfishConfig
+	names    []string
+	redactor *Redactor
+	hooks    *Hooks
+	tracker  *UsageTracker
+}
+
+// Wrap the backend in the middlewares from the given index on
+func (this *middlewareChain) wrap(backend LLM, from int) LLM {
+	llm := backend
+	for i := len(this.names) - 1; i >= from; i-- {
+		llm = this.middleware(this.names[i], i)(llm)
+	}
+	return llm
+}
+
+func (this *middlewareChain) middleware(name string, index int) func(LLM) LLM {
+	config := this.config
+	unchanged := func(llm LLM) LLM { return llm }
+
+	switch name {
+	case MiddlewareCache:
+		// the shell's history makes repeats rare, and recording or replaying
+		// needs every request to go through
+		if config.ResponseCacheDir == "" || config.ShellMode ||
+			config.LLMMode == LLMModeRecord || config.LLMMode == LLMModeReplay {
+			return unchanged
+		}
+		return func(llm LLM) LLM {
+			cache := NewCachingLLM(llm, config.ResponseCacheDir, config.ResponseCacheTTL)
+			cache.BaseURL = config.BaseURL
+			cache.Profile = config.ProfileName()
+			return cache
+		}
+
+	case MiddlewareBudget:
+		if this.tracker == nil {
+			return unchanged
+		}
+		budget := 0
+		if config.Profile != nil {
+			budget = config.Profile.TokenBudget
+		}
+		return func(llm LLM) LLM {
+			return NewUsageTrackingLLM(llm, this.tracker, config.ProfileName(), budget)
+		}
+
+	case MiddlewareRedact:
+		return func(llm LLM) LLM {
+			return NewRedactingLLM(llm, this.redactor)
+		}
+
+	case MiddlewareHooks:
+		if !this.hooks.Has(HookPrePrompt) && !this.hooks.Has(HookPostResponse) {
+			return unchanged
+		}
+		return func(llm LLM) LLM {
+			return NewHookingLLM(llm, this.hooks)
+		}
+
+	case MiddlewareRecord:
+		if config.LLMMode != LLMModeRecord {
+			return unchanged
+		}
+		return func(llm LLM) LLM {
+			return NewRecordingLLM(llm, config.LLMFixtures)
+		}
+
+	case MiddlewareFailover:
+		if config.Profile == nil || len(config.Profile.Fallbacks) == 0 || config.LLMMode == LLMModeReplay {
+			return unchanged
+		}
+		return func(llm LLM) LLM {
+			failover := NewFailoverLLM(llm)
+			for _, fallback := range config.Profile.Fallbacks {
+				// the primary's token only goes to the primary's provider
+				token, baseURL := fallback.Token(), fallback.BaseURL
+				if baseURL == "" {
+					baseURL = config.BaseURL
+					if token == "" {
+						token = config.OpenAIToken
+					}
+				}
+				backend := NewAuthCheckingLLM(NewGPT(token, baseURL), config.fallbackKeySource(fallback))
+				failover.Add(fallback.Model, this.wrap(backend, index+1))
+			}
+			return failover
+		}
+
+	case MiddlewareTools:
+		return func(llm LLM) LLM {
+			return NewToolEmulatingLLM(llm)
+		}
+
+	case MiddlewareLog:
+		if config.LogFormat == LogFormatJSONL {
+			return func(llm LLM) LLM {
+				return NewJSONLLoggingLLM(llm)
+			}
+		}
+		if config.Verbose == 0 {
+			return unchanged
+		}
+		return func(llm LLM) LLM {
+			return NewLoggingLLM(llm)
+		}
+
+	case MiddlewareRetry:
+		return func(llm LLM) LLM {
+			return NewRetryingLLM(llm, config.RetryPolicy)
+		}
+	}
+
+	return unchanged
+}
@@ -0,0 +1,96 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func TestValidateMiddleware(t *testing.T) {
+	assert.Nil(t, ValidateMiddleware(DefaultMiddleware))
+	assert.Nil(t, ValidateMiddleware([]string{}))
+	assert.ErrorContains(t, ValidateMiddleware([]string{"redact", "compress"}), "Unknown middleware compress")
+	assert.ErrorContains(t, ValidateMiddleware([]string{"retry", "log", "retry"}), "listed more than once")
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	backend := &failoverTestLLM{}
+	config := MakeButterfishConfig()
+	config.LLMClient = backend
+	config.Middleware = []string{MiddlewareRetry, MiddlewareRedact}
+
+	llm, err := initLLM(config)
+	assert.Nil(t, err)
+	retrying, ok := llm.(*RetryingLLM)
+	assert.True(t, ok)
+	redacting, ok := retrying.Unwrap().(*RedactingLLM)
+	assert.True(t, ok)
+	assert.Equal(t, backend, redacting.Unwrap())
+
+	// nothing at all goes straight to the backend
+	config.Middleware = []string{}
+	llm, err = initLLM(config)
+	assert.Nil(t, err)
+	assert.Equal(t, backend, llm)
+
+	config.LLMMode = LLMModeRecord
+	_, err = initLLM(config)
+	assert.ErrorContains(t, err, "needs record in the middleware list")
+}
+
+func TestFindUsageTracker(t *testing.T) {
+	tracking := NewUsageTrackingLLM(&failoverTestLLM{}, NewUsageTracker(t.TempDir()), "", 0)
+	redactor, _ := NewRedactor(nil)
+	cached := NewCachingLLM(NewRedactingLLM(tracking, redactor), t.TempDir(), 0)
+	assert.Equal(t, tracking, findUsageTracker(cached))
+	assert.Nil(t, findUsageTracker(NewRetryingLLM(&failoverTestLLM{}, DefaultRetryPolicy())))
+	assert.Nil(t, findUsageTracker(nil))
+}
+
+func TestRetryingLLM(t *testing.T) {
+	policy := DefaultRetryPolicy()
+	policy.BaseDelay = 0
+	backend := &failoverTestLLM{err: &openai.APIError{HTTPStatusCode: 503, Message: "overloaded"}}
+	llm := NewRetryingLLM(backend, policy)
+
+	request := &util.CompletionRequest{Ctx: context.Background(), Model: "gpt-4o", Retries: 2}
+	_, err := llm.Completion(request)
+	assert.ErrorContains(t, err, "overloaded")
+	assert.Equal(t, 3, len(backend.requests))
+
+	// a stream isn't retried once some of it was written
+	backend.requests = nil
+	backend.partial = "half an ans"
+	_, err = llm.CompletionStream(request, new(bytes.Buffer))
+	assert.ErrorContains(t, err, "overloaded")
+	assert.Equal(t, 1, len(backend.requests))
+}
+
+func TestReplayTakesThePlaceOfRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fixtures.jsonl")
+	recorder := NewRecordingLLM(&failoverTestLLM{}, path)
+	_, err := recorder.Completion(&util.CompletionRequest{Ctx: context.Background(), Model: "gpt-4o", Prompt: "hi"})
+	assert.Nil(t, err)
+
+	config := MakeButterfishConfig()
+	config.LLMMode = LLMModeReplay
+	config.LLMFixtures = path
+	config.Middleware = []string{MiddlewareRedact, MiddlewareRecord, MiddlewareRetry}
+
+	llm, err := initLLM(config)
+	assert.Nil(t, err)
+	redacting, ok := llm.(*RedactingLLM)
+	assert.True(t, ok)
+	_, ok = redacting.Unwrap().(*ReplayLLM)
+	assert.True(t, ok)
+
+	response, err := llm.Completion(&util.CompletionRequest{Ctx: context.Background(), Model: "gpt-4o", Prompt: "hi"})
+	assert.Nil(t, err)
+	assert.Equal(t, "from gpt-4o", response.Completion)
+}
@@ -0,0 +1,186 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The model table is a guess for models served somewhere else, so when
+// butterfish talks to an OpenAI compatible server it asks the server's
+// /models endpoint how big each model's context is. OpenAI itself doesn't
+// say, but vLLM (max_model_len), OpenRouter and Together (context_length),
+// LM Studio (max_context_length), and Groq (context_window) do. A request
+// that's too long anyway fails with an error that gives the real size, which
+// we remember for the next request.
+
+// How long the shell waits for model metadata when it starts
+const modelMetadataTimeout = 3 * time.Second
+
+var liveContextWindows = struct {
+	sync.Mutex
+	windows map[string]int
+}{windows: map[string]int{}}
+
+func liveContextWindow(model string) (int, bool) {
+	liveContextWindows.Lock()
+	defer liveContextWindows.Unlock()
+	window, ok := liveContextWindows.windows[model]
+	return window, ok
+}
+
+// Record context windows reported by the API, these win over the built in
+// table but not over the config file
+func RegisterLiveContextWindows(windows map[string]int) {
+	liveContextWindows.Lock()
+	defer liveContextWindows.Unlock()
+	for model, window := range windows {
+		if window > 0 {
+			liveContextWindows.windows[model] = window
+		}
+	}
+}
+
+// Fields servers use for the context size in /models entries
+var contextWindowFields = []string{"context_length", "max_model_len", "max_context_length", "context_window"}
+
+// Ask an OpenAI compatible server for the context windows of its models,
+// models it doesn't give a size for are left out
+func FetchContextWindows(ctx context.Context, client *http.Client, baseURL, token string) (map[string]int, error) {
+	url := strings.TrimSuffix(baseURL, "/") + "/models"
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	var body struct {
+		Data []map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %s", url, err)
+	}
+
+	windows := map[string]int{}
+	for _, model := range body.Data {
+		id, _ := model["id"].(string)
+		if id == "" {
+			continue
+		}
+		for _, field := range contextWindowFields {
+			if value, ok := model[field].(float64); ok && value > 0 {
+				windows[id] = int(value)
+				break
+			}
+		}
+	}
+	return windows, nil
+}
+
+// Whether we should ask the configured server about its models, OpenAI
+// doesn't report context windows and recorded sessions shouldn't make
+// requests
+func (this *ButterfishConfig) fetchesModelMetadata() bool {
+	return this.BaseURL != "" && !strings.Contains(this.BaseURL, "api.openai.com") &&
+		this.LLMClient == nil && this.LLMMode == LLMModeLive
+}
+
+// Load context windows from the configured server, failures are only logged
+// since the table still works
+func (this *ButterfishCtx) LoadModelMetadata() {
+	config := this.Config
+	if !config.fetchesModelMetadata() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(this.Ctx, modelMetadataTimeout)
+	defer cancel()
+	windows, err := FetchContextWindows(ctx, http.DefaultClient, config.BaseURL, config.OpenAIToken)
+	if err != nil {
+		log.Printf("Unable to fetch model metadata: %s", err)
+		return
+	}
+	log.Printf("Found context windows for %d models at %s", len(windows), config.BaseURL)
+	RegisterLiveContextWindows(windows)
+}
+
+// A model's context window and where it came from, e.g. "8192 tokens (the
+// API)", for the Status command
+func contextWindowDescription(model string) string {
+	info := LookupModel(model)
+	return fmt.Sprintf("%d tokens (%s)", info.ContextWindow, info.ContextSource)
+}
+
+// Largest answer and history block sizes when they aren't configured, smaller
+// windows get a share of the window instead
+const (
+	DefaultShellMaxResponseTokens     = 2048
+	DefaultShellMaxHistoryBlockTokens = 1024
+)
+
+// The shell's token budgets for a model with the given context window: the
+// whole request, each history block, and the answer. The request is capped by
+// ShellMaxPromptTokens, the others are configured or take a share of it, and
+// the answer never gets more than half.
+func shellTokenBudgets(config *ButterfishConfig, contextWindow int) (window, historyBlock, response int) {
+	window = contextWindow
+	if config.ShellMaxPromptTokens > 0 {
+		window = min(window, config.ShellMaxPromptTokens)
+	}
+
+	response = config.ShellMaxResponseTokens
+	if response <= 0 {
+		response = min(DefaultShellMaxResponseTokens, window/4)
+	}
+	response = min(response, window/2)
+
+	historyBlock = config.ShellMaxHistoryBlockTokens
+	if historyBlock <= 0 {
+		historyBlock = min(DefaultShellMaxHistoryBlockTokens, window/8)
+	}
+	return window, historyBlock, response
+}
+
+// e.g. "This model's maximum context length is 8192 tokens. However, your
+// messages resulted in 9000 tokens."
+var contextLengthRegex = regexp.MustCompile(`maximum context length is (\d+) tokens`)
+
+// The context window given in a context length error
+func contextWindowFromError(err error) (int, bool) {
+	if err == nil {
+		return 0, false
+	}
+	match := contextLengthRegex.FindStringSubmatch(err.Error())
+	if match == nil {
+		return 0, false
+	}
+	window, convErr := strconv.Atoi(match[1])
+	return window, convErr == nil && window > 0
+}
+
+// Remember the context window from a context length error, so that the next
+// request for the model fits
+func learnContextWindow(model string, err error) {
+	if window, ok := contextWindowFromError(err); ok {
+		log.Printf("Model %s has a context window of %d tokens", model, window)
+		RegisterLiveContextWindows(map[string]int{model: window})
+	}
+}
@@ -0,0 +1,89 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchContextWindows(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/models" {
+			http.NotFound(w, r)
+			return
+		}
+		assert.Equal(t, "Bearer sk-test", r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"object": "list", "data": [
+			{"id": "llama3.2", "max_model_len": 131072},
+			{"id": "qwen", "context_length": 32768},
+			{"id": "phi", "max_context_length": 4096},
+			{"id": "mixtral", "context_window": 32000},
+			{"id": "gpt-4o"}
+		]}`)
+	}))
+	defer server.Close()
+
+	windows, err := FetchContextWindows(context.Background(), server.Client(), server.URL+"/v1/", "sk-test")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{
+		"llama3.2": 131072,
+		"qwen":     32768,
+		"phi":      4096,
+		"mixtral":  32000,
+	}, windows)
+
+	_, err = FetchContextWindows(context.Background(), server.Client(), server.URL, "sk-test")
+	assert.ErrorContains(t, err, "404 Not Found")
+}
+
+func TestLearnContextWindow(t *testing.T) {
+	defer func() {
+		liveContextWindows.Lock()
+		delete(liveContextWindows.windows, "gpt-4-local")
+		delete(liveContextWindows.windows, "learned-model")
+		liveContextWindows.Unlock()
+		modelRegistry = loadDefaultModels()
+	}()
+
+	_, ok := contextWindowFromError(errors.New("connection refused"))
+	assert.False(t, ok)
+
+	err := errors.New("error, status code: 400, message: This model's maximum context length is 4096 tokens. However, your messages resulted in 5000 tokens.")
+	learnContextWindow("learned-model", err)
+	info := LookupModel("learned-model")
+	assert.Equal(t, 4096, info.ContextWindow)
+	assert.Equal(t, ContextSourceAPI, info.ContextSource)
+
+	// the API beats the table but not the config file
+	RegisterLiveContextWindows(map[string]int{"gpt-4-local": 2048})
+	assert.Equal(t, ContextSourceBuiltIn, LookupModel("gpt-4").ContextSource)
+	assert.Equal(t, 2048, LookupModel("gpt-4-local").ContextWindow)
+	RegisterContextWindows(map[string]int{"gpt-4-local": 16384})
+	info = LookupModel("gpt-4-local")
+	assert.Equal(t, 16384, info.ContextWindow)
+	assert.Equal(t, ContextSourceConfig, info.ContextSource)
+}
+
+func TestShellTokenBudgets(t *testing.T) {
+	config := MakeButterfishConfig()
+	config.ShellMaxPromptTokens = 16384
+
+	window, historyBlock, response := shellTokenBudgets(config, 128000)
+	assert.Equal(t, []int{16384, 1024, 2048}, []int{window, historyBlock, response})
+
+	// a small window gets a share of it
+	window, historyBlock, response = shellTokenBudgets(config, 4096)
+	assert.Equal(t, []int{4096, 512, 1024}, []int{window, historyBlock, response})
+
+	// configured sizes win, but the answer gets at most half
+	config.ShellMaxHistoryBlockTokens = 256
+	config.ShellMaxResponseTokens = 4000
+	window, historyBlock, response = shellTokenBudgets(config, 4096)
+	assert.Equal(t, []int{4096, 256, 2048}, []int{window, historyBlock, response})
+}
@@ -0,0 +1,264 @@
+package butterfish
+
+import (
+	_ "embed"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/bakks/tiktoken-go"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// What butterfish knows about models: the context window, the tokenizer, the
+// chat message overhead, whether the model uses the legacy completion API,
+// and whether it can call functions and take images. The defaults are in
+// models.yaml, config.yaml can add models or override fields with a models
+// section, e.g.
+//
+//	models:
+//	  llama3.2:
+//	    context_window: 131072
+//	    vision: false
+//
+// Models are found by name or by the longest prefix ending before a -, see
+// LookupModel.
+
+//go:embed models.yaml
+var defaultModelsYAML []byte
+
+// A model's entry in the registry, fields left out come from the entry for a
+// shorter prefix of its name or from DefaultModelInfo
+type ModelEntry struct {
+	ContextWindow    int    `yaml:"context_window,omitempty"`
+	Tokenizer        string `yaml:"tokenizer,omitempty"`
+	TokensPerMessage int    `yaml:"tokens_per_message,omitempty"`
+	Completion       *bool  `yaml:"completion,omitempty"`
+	Functions        *bool  `yaml:"functions,omitempty"`
+	Vision           *bool  `yaml:"vision,omitempty"`
+
+	// Where ContextWindow came from, see ModelInfo.ContextSource
+	contextSource string
+}
+
+// Where a model's context window came from, in order of precedence
+const (
+	ContextSourceConfig  = "config.yaml"
+	ContextSourceAPI     = "the API"
+	ContextSourceBuiltIn = "built in"
+	ContextSourceDefault = "default for unknown models"
+)
+
+// Tokenizers tiktoken-go has
+var Tokenizers = []string{
+	tiktoken.MODEL_CL100K_BASE,
+	tiktoken.MODEL_P50K_BASE,
+	tiktoken.MODEL_P50K_EDIT,
+	tiktoken.MODEL_R50K_BASE,
+	"gpt2",
+}
+
+func (this *ModelEntry) Validate() error {
+	if this.ContextWindow < 0 {
+		return fmt.Errorf("context_window must be a positive number of tokens")
+	}
+	if this.TokensPerMessage < 0 {
+		return fmt.Errorf("tokens_per_message can't be negative")
+	}
+	if this.Tokenizer != "" && !slices.Contains(Tokenizers, this.Tokenizer) {
+		return fmt.Errorf("Unknown tokenizer %s, expected one of %v", this.Tokenizer, Tokenizers)
+	}
+	return nil
+}
+
+// A model's capabilities, resolved from the registry
+type ModelInfo struct {
+	// The registry entry that matched, e.g. gpt-4-turbo for
+	// gpt-4-turbo-2024-04-09, empty for a model we don't know
+	Entry            string
+	ContextWindow    int
+	Tokenizer        string
+	TokensPerMessage int
+	Completion       bool
+	Functions        bool
+	Vision           bool
+	// Where ContextWindow came from, e.g. ContextSourceAPI
+	ContextSource string
+}
+
+// What we assume about a model we don't know, e.g. a local model. It's
+// allowed to try functions and images, the server will say if it can't.
+var DefaultModelInfo = ModelInfo{
+	ContextWindow:    8192,
+	Tokenizer:        tiktoken.MODEL_CL100K_BASE,
+	TokensPerMessage: 5,
+	Completion:       false,
+	Functions:        true,
+	Vision:           true,
+	ContextSource:    ContextSourceDefault,
+}
+
+var modelRegistry = loadDefaultModels()
+
+func loadDefaultModels() map[string]*ModelEntry {
+	models := map[string]*ModelEntry{}
+	if err := yaml.UnmarshalStrict(defaultModelsYAML, &models); err != nil {
+		panic(fmt.Sprintf("Error parsing models.yaml: %s", err))
+	}
+	for _, entry := range models {
+		entry.contextSource = ContextSourceBuiltIn
+	}
+	return models
+}
+
+// Add models or override fields of the ones we know from the config file,
+// context windows set here win over what the API says
+func RegisterModels(models map[string]*ModelEntry) {
+	for name, entry := range models {
+		if entry == nil {
+			continue
+		}
+		existing, ok := modelRegistry[name]
+		if !ok {
+			existing = &ModelEntry{}
+			modelRegistry[name] = existing
+		}
+		existing.merge(entry)
+		if entry.ContextWindow != 0 {
+			existing.contextSource = ContextSourceConfig
+		}
+	}
+}
+
+// Set the fields of other that are set
+func (this *ModelEntry) merge(other *ModelEntry) {
+	if other.ContextWindow != 0 {
+		this.ContextWindow = other.ContextWindow
+		this.contextSource = other.contextSource
+	}
+	if other.Tokenizer != "" {
+		this.Tokenizer = other.Tokenizer
+	}
+	if other.TokensPerMessage != 0 {
+		this.TokensPerMessage = other.TokensPerMessage
+	}
+	if other.Completion != nil {
+		this.Completion = other.Completion
+	}
+	if other.Functions != nil {
+		this.Functions = other.Functions
+	}
+	if other.Vision != nil {
+		this.Vision = other.Vision
+	}
+}
+
+// Find a model's capabilities, the most specific entry wins for each field,
+// e.g. gpt-4-turbo-2024-04-09 takes what gpt-4-turbo sets and the rest from
+// gpt-4
+func LookupModel(model string) *ModelInfo {
+	// from the least specific to the most
+	entries := []*ModelEntry{}
+	info := DefaultModelInfo
+	name := model
+	for {
+		if entry, ok := modelRegistry[name]; ok {
+			if info.Entry == "" {
+				info.Entry = name
+			}
+			entries = append([]*ModelEntry{entry}, entries...)
+		}
+		lastDash := strings.LastIndex(name, "-")
+		if lastDash == -1 {
+			break
+		}
+		name = name[:lastDash]
+	}
+
+	merged := &ModelEntry{}
+	for _, entry := range entries {
+		merged.merge(entry)
+	}
+
+	if merged.ContextWindow != 0 {
+		info.ContextWindow = merged.ContextWindow
+		info.ContextSource = merged.contextSource
+	}
+	// what the API says about this exact model beats a guess from the table
+	if window, ok := liveContextWindow(model); ok && info.ContextSource != ContextSourceConfig {
+		info.ContextWindow = window
+		info.ContextSource = ContextSourceAPI
+	}
+	if merged.Tokenizer != "" {
+		info.Tokenizer = merged.Tokenizer
+	}
+	if merged.TokensPerMessage != 0 {
+		info.TokensPerMessage = merged.TokensPerMessage
+	}
+	if merged.Completion != nil {
+		info.Completion = *merged.Completion
+	}
+	if merged.Functions != nil {
+		info.Functions = *merged.Functions
+	}
+	if merged.Vision != nil {
+		info.Vision = *merged.Vision
+	}
+	return &info
+}
+
+// An error if a request needs something the model can't do, so that it fails
+// with an explanation rather than an API error
+func checkModelSupport(request *util.CompletionRequest) error {
+	info := LookupModel(request.Model)
+	if len(request.Images) > 0 && !info.Vision {
+		return fmt.Errorf("Model %s doesn't accept images, use a vision model like gpt-4o, or set vision: true for it under models in config.yaml", request.Model)
+	}
+	if (len(request.Functions) > 0 || len(request.Tools) > 0) && !info.Functions {
+		return fmt.Errorf("Model %s doesn't support function calling, use a model like gpt-4o, or set functions: true for it under models in config.yaml", request.Model)
+	}
+	return nil
+}
+
+func NumTokensForModel(model string) int {
+	info := LookupModel(model)
+
+	if info.ContextSource == ContextSourceAPI {
+		log.Printf("Found model %s context window size of %d tokens from the API", model, info.ContextWindow)
+		return info.ContextWindow
+	}
+
+	// couldn't find model
+	if info.Entry == "" {
+		log.Printf("WARNING: Unknown model %s, using default context window size of %d tokens", model, info.ContextWindow)
+		return info.ContextWindow
+	}
+
+	// found simpler model
+	if info.Entry != model {
+		log.Printf("WARNING: Unknown model %s, using model %s settings instead with context window size of %d tokens", model, info.Entry, info.ContextWindow)
+		return info.ContextWindow
+	}
+
+	log.Printf("Found model %s context window size of %d tokens", model, info.ContextWindow)
+
+	// normal
+	return info.ContextWindow
+}
+
+func NumTokensPerMessageForModel(model string) int {
+	return LookupModel(model).TokensPerMessage
+}
+
+// Whether the model uses the legacy completion API rather than chat
+func IsCompletionModel(model string) bool {
+	return LookupModel(model).Completion
+}
+
+// The tokenizer for a model
+func EncoderForModel(model string) (*tiktoken.Tiktoken, error) {
+	return tiktoken.GetEncoding(LookupModel(model).Tokenizer)
+}
@@ -0,0 +1,75 @@
+package butterfish
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func TestLookupModel(t *testing.T) {
+	// fields come from the most specific entry that sets them
+	info := LookupModel("gpt-4-turbo-2024-04-09")
+	assert.Equal(t, "gpt-4-turbo", info.Entry)
+	assert.Equal(t, 128000, info.ContextWindow)
+	assert.Equal(t, 3, info.TokensPerMessage)
+	assert.True(t, info.Functions)
+	assert.True(t, info.Vision)
+	assert.False(t, LookupModel("gpt-4-turbo-preview").Vision)
+
+	assert.True(t, IsCompletionModel("gpt-3.5-turbo-instruct-0913"))
+	assert.False(t, LookupModel("gpt-3.5-turbo-instruct").Functions)
+	assert.True(t, IsCompletionModel("davinci-002"))
+	assert.False(t, IsCompletionModel("gpt-4o-mini"))
+	assert.Equal(t, 4096, NumTokensForModel("gpt-3.5-turbo-0613"))
+	assert.Equal(t, 4, NumTokensPerMessageForModel("gpt-3.5-turbo-0613"))
+
+	// unknown models, including ones that look like completion models
+	info = LookupModel("mistral-7b-instruct")
+	assert.Equal(t, "", info.Entry)
+	assert.Equal(t, 8192, info.ContextWindow)
+	assert.False(t, info.Completion)
+	assert.True(t, info.Functions)
+}
+
+func TestRegisterModels(t *testing.T) {
+	no := false
+	RegisterModels(map[string]*ModelEntry{
+		"gpt-4o":      {ContextWindow: 64000},
+		"local-model": {ContextWindow: 4096, Functions: &no},
+	})
+	defer func() {
+		modelRegistry = loadDefaultModels()
+	}()
+
+	info := LookupModel("gpt-4o-mini")
+	assert.Equal(t, 64000, info.ContextWindow)
+	assert.True(t, info.Vision)
+
+	err := checkModelSupport(&util.CompletionRequest{Model: "local-model-7b",
+		Tools: []util.ToolDefinition{{Type: "function"}}})
+	assert.EqualError(t, err, "Model local-model-7b doesn't support function calling, use a model like gpt-4o, or set functions: true for it under models in config.yaml")
+
+	err = checkModelSupport(&util.CompletionRequest{Model: "gpt-3.5-turbo",
+		Images: []util.CompletionImage{{MimeType: "image/png"}}})
+	assert.ErrorContains(t, err, "Model gpt-3.5-turbo doesn't accept images")
+	assert.Nil(t, checkModelSupport(&util.CompletionRequest{Model: "gpt-4o",
+		Images: []util.CompletionImage{{MimeType: "image/png"}}}))
+}
+
+func TestLoadConfigFileModels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := "models:\n  llava:\n    context_window: 4096\n    vision: true\n"
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+	configFile, err := LoadConfigFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 4096, configFile.Models["llava"].ContextWindow)
+	assert.True(t, *configFile.Models["llava"].Vision)
+
+	assert.Nil(t, os.WriteFile(path, []byte("models:\n  llava:\n    tokenizer: o200k_base\n"), 0644))
+	_, err = LoadConfigFile(path)
+	assert.ErrorContains(t, err, "Unknown tokenizer o200k_base")
+}
@@ -0,0 +1,170 @@
+package butterfish
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Notifications tell the user that a long answer or a goal has finished, so
+// they can start a goal and switch to another window. The notify command is
+// run with sh when an answer finishes streaming, or when goal mode asks for
+// input or finishes, if it took at least the notify delay and the terminal
+// isn't focused. {event} and {message} in the command are replaced with
+// quoted values, e.g. notify-send Butterfish {message}, and "bell" rings the
+// terminal bell instead of running a command.
+//
+// We find out whether the terminal is focused by turning on focus reporting,
+// the terminal then sends ESC [ I when it gains focus and ESC [ O when it
+// loses it. Terminals without focus reporting never send these, and then we
+// notify whenever the delay has passed. Programs in the shell like vim turn
+// focus reporting on and off themselves, so while they have it on we pass the
+// reports through, and we turn it back on when they're done.
+
+const NotifyBell = "bell"
+
+const (
+	NotifyEventAnswer     = "answer"
+	NotifyEventGoalInput  = "goal_input"
+	NotifyEventGoalFinish = "goal_finish"
+)
+
+var (
+	focusReportingOn  = []byte("\x1b[?1004h")
+	focusReportingOff = []byte("\x1b[?1004l")
+	focusIn           = []byte("\x1b[I")
+	focusOut          = []byte("\x1b[O")
+)
+
+const (
+	focusUnknown = iota
+	focusInTerminal
+	focusOutOfTerminal
+)
+
+// A nil Notifier does nothing, so it's safe to call when notifications are
+// turned off
+type Notifier struct {
+	Command string
+	After   time.Duration
+	// where the bell goes
+	Out io.Writer
+
+	started time.Time
+	focus   int
+	// the child turned on focus reporting
+	childFocus bool
+	// run a command, replaced in tests
+	run func(command string) error
+}
+
+func NewNotifier(command string, after time.Duration, out io.Writer) *Notifier {
+	return &Notifier{
+		Command: command,
+		After:   after,
+		Out:     out,
+		run:     runNotifyCommand,
+	}
+}
+
+func runNotifyCommand(command string) error {
+	cmd := exec.Command("sh", "-c", command)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// Quote a value for sh
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// The user started something we might notify about when it's done
+func (this *Notifier) Start() {
+	if this == nil {
+		return
+	}
+	this.started = time.Now()
+}
+
+// Notify if what was started took long enough and the terminal isn't focused
+func (this *Notifier) Done(event, message string) {
+	if this == nil || this.started.IsZero() {
+		return
+	}
+	elapsed := time.Since(this.started)
+	this.started = time.Time{}
+	if elapsed < this.After || this.focus == focusInTerminal {
+		return
+	}
+
+	if this.Command == NotifyBell {
+		this.Out.Write([]byte("\a"))
+		return
+	}
+	command := strings.NewReplacer(
+		"{event}", shellQuote(event),
+		"{message}", shellQuote(message)).Replace(this.Command)
+	log.Printf("Running notify command: %s", command)
+	if err := this.run(command); err != nil {
+		log.Printf("Notify command failed: %s", err)
+	}
+}
+
+// Take focus reports out of input from the terminal, returning the rest of
+// the input and any reports the child asked for
+func (this *Notifier) FilterFocus(data []byte) ([]byte, []byte) {
+	if this == nil {
+		return data, nil
+	}
+
+	rest := []byte{}
+	reports := []byte{}
+	for len(data) > 0 {
+		switch {
+		case bytes.HasPrefix(data, focusIn):
+			this.focus = focusInTerminal
+		case bytes.HasPrefix(data, focusOut):
+			this.focus = focusOutOfTerminal
+		default:
+			rest = append(rest, data[0])
+			data = data[1:]
+			continue
+		}
+		if this.childFocus {
+			reports = append(reports, data[:len(focusIn)]...)
+		}
+		data = data[len(focusIn):]
+	}
+	return rest, reports
+}
+
+// Watch the child's output for it turning focus reporting on or off, turning
+// it back on for ourselves when it's turned off
+func (this *Notifier) ChildOutput(data string) {
+	if this == nil {
+		return
+	}
+	on := strings.LastIndex(data, string(focusReportingOn))
+	off := strings.LastIndex(data, string(focusReportingOff))
+	switch {
+	case on > off:
+		this.childFocus = true
+	case off > on:
+		this.childFocus = false
+		this.Out.Write(focusReportingOn)
+	}
+}
+
+func (this *Notifier) Describe() string {
+	if this.Command == NotifyBell {
+		return fmt.Sprintf("terminal bell after %s", this.After)
+	}
+	return fmt.Sprintf("%s after %s", this.Command, this.After)
+}
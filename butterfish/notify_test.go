@@ -0,0 +1,80 @@
+package butterfish
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testNotifier(command string) (*Notifier, *[]string, *bytes.Buffer) {
+	out := new(bytes.Buffer)
+	notifier := NewNotifier(command, 0, out)
+	commands := []string{}
+	notifier.run = func(command string) error {
+		commands = append(commands, command)
+		return nil
+	}
+	return notifier, &commands, out
+}
+
+func TestNotifierDone(t *testing.T) {
+	notifier, commands, _ := testNotifier("notify-send Butterfish {message} --hint={event}")
+
+	// nothing was started
+	notifier.Done(NotifyEventAnswer, "done")
+	assert.Empty(t, *commands)
+
+	notifier.Start()
+	notifier.Done(NotifyEventGoalInput, "it's waiting")
+	assert.Equal(t, []string{`notify-send Butterfish 'it'\''s waiting' --hint='goal_input'`}, *commands)
+
+	// not while the terminal has focus
+	rest, _ := notifier.FilterFocus([]byte("\x1b[I"))
+	assert.Empty(t, rest)
+	notifier.Start()
+	notifier.Done(NotifyEventAnswer, "done")
+	assert.Len(t, *commands, 1)
+
+	// or before the delay
+	notifier.FilterFocus([]byte("\x1b[O"))
+	notifier.After = time.Hour
+	notifier.Start()
+	notifier.Done(NotifyEventAnswer, "done")
+	assert.Len(t, *commands, 1)
+
+	// a nil notifier does nothing
+	var none *Notifier
+	none.Start()
+	none.Done(NotifyEventAnswer, "done")
+}
+
+func TestNotifierBell(t *testing.T) {
+	notifier, commands, out := testNotifier(NotifyBell)
+	notifier.Start()
+	notifier.Done(NotifyEventGoalFinish, "done")
+	assert.Empty(t, *commands)
+	assert.Equal(t, "\a", out.String())
+}
+
+func TestNotifierFocusReports(t *testing.T) {
+	notifier, _, out := testNotifier(NotifyBell)
+
+	rest, reports := notifier.FilterFocus([]byte("ls\x1b[O\x1b[D"))
+	assert.Equal(t, "ls\x1b[D", string(rest))
+	assert.Empty(t, reports)
+	assert.Equal(t, focusOutOfTerminal, notifier.focus)
+
+	// while vim has focus reporting on it gets the reports too
+	notifier.ChildOutput("\x1b[?1049h\x1b[?1004h")
+	rest, reports = notifier.FilterFocus([]byte("\x1b[Ij"))
+	assert.Equal(t, "j", string(rest))
+	assert.Equal(t, "\x1b[I", string(reports))
+
+	// and we turn it back on when vim turns it off
+	notifier.ChildOutput("\x1b[?1004l\x1b[?1049l")
+	assert.Equal(t, "\x1b[?1004h", out.String())
+	_, reports = notifier.FilterFocus([]byte("\x1b[O"))
+	assert.Empty(t, reports)
+}
@@ -0,0 +1,153 @@
+package butterfish
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/mattn/go-runewidth"
+	"golang.org/x/term"
+)
+
+// A long answer scrolls its start off the screen while it streams. With
+// --pager, an answer that's taller than the terminal is opened in $PAGER, or
+// less -R, once it's finished, so it can be read from the top. "Page" in the
+// shell opens the last answer in the pager whenever you like.
+//
+// In the shell we can't run the pager ourselves since we're reading the
+// terminal for the child shell, so the answer goes in a temporary file and we
+// run the pager in the child shell instead of asking it for a new prompt. The
+// pager then gets keys like any other command, and its output is kept out of
+// the history.
+
+const defaultPager = "less -R"
+
+// $PAGER, or less -R
+func resolvePager() string {
+	pager := os.Getenv("PAGER")
+	if pager == "" {
+		pager = defaultPager
+	}
+	return pager
+}
+
+// The number of terminal rows text takes up at width, with long lines
+// wrapped
+func textRows(text string, width int) int {
+	rows := 0
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		lineWidth := runewidth.StringWidth(stripANSI(line))
+		if width <= 0 || lineWidth == 0 {
+			rows++
+			continue
+		}
+		rows += (lineWidth + width - 1) / width
+	}
+	return rows
+}
+
+// Whether text is too tall to read without scrolling back, an unknown height
+// never is
+func needsPager(text string, width, height int) bool {
+	return height > 0 && textRows(text, width) >= height
+}
+
+// Run the pager attached to the terminal with text on stdin
+func runPager(pager, text string) error {
+	cmd := exec.Command("sh", "-c", pager)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Open a finished answer in the pager if it doesn't fit in the terminal, for
+// prompt --pager
+func (this *ButterfishCtx) pageAnswer(text string) {
+	stdout := int(os.Stdout.Fd())
+	if this.InConsoleMode || !term.IsTerminal(stdout) {
+		return
+	}
+	width, height, err := term.GetSize(stdout)
+	if err != nil || !needsPager(text, width, height) {
+		return
+	}
+	if err := runPager(resolvePager(), text); err != nil {
+		log.Printf("Unable to run the pager: %s", err)
+	}
+}
+
+// A shell command line that shows text in the pager and then removes the
+// temporary file, it starts with a space to keep it out of the shell's
+// history where that's turned on
+func pagerCommand(pager, text string) (string, error) {
+	file, err := os.CreateTemp("", "butterfish-answer-*.md")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := file.WriteString(text); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	path := shellQuote(file.Name())
+	return fmt.Sprintf(" %s < %s; rm -f %s\n", pager, path, path), nil
+}
+
+// Queue the pager for a finished answer if it's too tall for the terminal
+func (this *ShellState) pageLongAnswer(text string) {
+	if !this.Butterfish.Config.ShellPager || this.GoalMode || this.Screen == nil {
+		return
+	}
+	width, height := this.Screen.Size()
+	if !needsPager(text, width, height) {
+		return
+	}
+	this.queuePager(text)
+}
+
+// Open the most recent answer in the pager, from the Page command
+func (this *ShellState) PageLastAnswer() {
+	answer := ""
+	this.History.IterateBlocks(func(history *HistoryBuffer) bool {
+		if history.Type == historyTypeLLMOutput {
+			answer = history.Content.String()
+		}
+		return answer == ""
+	})
+	if answer == "" {
+		this.printLocalResponse("There's no answer to page yet\n")
+		return
+	}
+	this.queuePager(answer)
+	this.SendPromptResponse("")
+}
+
+func (this *ShellState) queuePager(text string) {
+	command, err := pagerCommand(resolvePager(), text)
+	if err != nil {
+		this.Errorf("Unable to open the pager: %s\n", err)
+		return
+	}
+	this.PagerCommand = command
+}
+
+// Run the queued pager command in the child shell in place of a new prompt,
+// returns false if there isn't one
+func (this *ShellState) openPager() bool {
+	command := this.PagerCommand
+	if command == "" {
+		return false
+	}
+	this.PagerCommand = ""
+
+	// the command line, the pager, and the next prompt stay out of the history
+	this.ExcludingOutput = true
+	this.excludedOutputCounted = true
+	this.ParentOut.Write([]byte("\r\n"))
+	this.ChildIn.Write([]byte(command))
+	return true
+}
@@ -0,0 +1,57 @@
+package butterfish
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTextRows(t *testing.T) {
+	assert.Equal(t, 1, textRows("hello", 80))
+	assert.Equal(t, 3, textRows("one\n\nthree\n", 80))
+	// wrapped lines, escape codes take no room
+	assert.Equal(t, 2, textRows("\x1b[38;5;221m"+strings.Repeat("x", 81), 80))
+	assert.Equal(t, 2, textRows("日本語", 4))
+
+	assert.True(t, needsPager(strings.Repeat("line\n", 24), 80, 24))
+	assert.False(t, needsPager(strings.Repeat("line\n", 23), 80, 24))
+	assert.False(t, needsPager(strings.Repeat("line\n", 100), 80, 0))
+}
+
+func TestPageLastAnswer(t *testing.T) {
+	t.Setenv("PAGER", "")
+	shell := pluginShell()
+	parentOut := new(bytes.Buffer)
+	childIn := new(bytes.Buffer)
+	shell.ParentOut = parentOut
+	shell.ChildIn = childIn
+
+	shell.PageLastAnswer()
+	assert.Equal(t, "There's no answer to page yet\n", (<-shell.PromptOutputChan).Completion)
+	assert.False(t, shell.openPager())
+
+	shell.History.Append(historyTypeLLMOutput, "Use it's")
+	shell.History.Append(historyTypeShellOutput, "go.mod")
+	shell.PageLastAnswer()
+	<-shell.PromptOutputChan
+
+	// the pager runs in the shell, and it and the next prompt stay out of
+	// the history
+	assert.True(t, shell.openPager())
+	assert.True(t, shell.ExcludingOutput)
+	assert.Equal(t, "", shell.PagerCommand)
+	assert.Equal(t, "\r\n", parentOut.String())
+	command := childIn.String()
+	assert.True(t, strings.HasPrefix(command, " less -R < '"), command)
+	assert.True(t, strings.HasSuffix(command, "\n"), command)
+
+	path := strings.Split(command, "'")[1]
+	defer os.Remove(path)
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "Use it's", string(content))
+	assert.Equal(t, " less -R < "+shellQuote(path)+"; rm -f "+shellQuote(path)+"\n", command)
+}
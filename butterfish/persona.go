@@ -0,0 +1,123 @@
+package butterfish
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alecthomas/kong"
+)
+
+// Personas are named system messages from the personas section of the config
+// file, optionally with a model and temperature, e.g. "terse" or "sre".
+// butterfish --persona terse prompt ... uses one for a command, flags given
+// on the command line still win. In the shell "Persona <name>" switches
+// persona for the rest of the session and "Persona default" goes back to the
+// shell's own system message, model, and temperature.
+
+const DefaultPersonaName = "default"
+
+// Whether a flag was given on the command line or set from an env var,
+// rather than left at its default
+func flagSet(parsed *kong.Context, name string) bool {
+	if parsed == nil {
+		return false
+	}
+	for _, path := range parsed.Path {
+		if path.Flag != nil && path.Flag.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Use the persona for the prompt command where flags weren't given
+func (this *Persona) applyPromptOptions(parsed *kong.Context, options *CliCommandConfig) {
+	if options.Prompt.SystemMessage == "" {
+		options.Prompt.SystemMessage = this.SystemMessage
+	}
+	if this.Model != "" && !flagSet(parsed, "model") {
+		options.Prompt.Model = this.Model
+	}
+	if this.Temperature != nil && !flagSet(parsed, "temperature") {
+		options.Prompt.Temperature = *this.Temperature
+	}
+}
+
+// What the shell goes back to with "Persona default"
+type personaBase struct {
+	model       string
+	temperature float32
+}
+
+// Switch the shell to a persona, or back to no persona with nil
+func (this *ShellState) applyPersona(persona *Persona) {
+	config := this.Butterfish.Config
+	if this.Persona == nil {
+		this.personaBase = &personaBase{
+			model:       config.ShellPromptModel,
+			temperature: this.PromptTemperature,
+		}
+	}
+	base := this.personaBase
+
+	this.Persona = persona
+	model := base.model
+	this.PromptTemperature = base.temperature
+	this.SystemMessage = ""
+	if persona != nil {
+		this.SystemMessage = persona.SystemMessage
+		if persona.Model != "" {
+			model = persona.Model
+		}
+		if persona.Temperature != nil {
+			this.PromptTemperature = *persona.Temperature
+		}
+	}
+
+	if model != config.ShellPromptModel {
+		config.ShellPromptModel = model
+		this.ResetModelState()
+	}
+}
+
+// Handle "Persona <name>", with no name we print the current persona and the
+// ones available
+func (this *ShellState) SwitchPersona(name string) {
+	config := this.Butterfish.Config
+	if name == "" {
+		text := "No persona, using the shell's system message\n"
+		if this.Persona != nil {
+			text = fmt.Sprintf("Current persona is %s\n", this.Persona.Name)
+		}
+		if config.ConfigFile != nil && len(config.ConfigFile.Personas) > 0 {
+			text += fmt.Sprintf("Available personas: %s\n", strings.Join(config.ConfigFile.PersonaNames(), ", "))
+		} else {
+			text += "Add personas to the personas section of ~/.config/butterfish/config.yaml\n"
+		}
+		this.printLocalResponse(text)
+		return
+	}
+
+	if strings.EqualFold(name, DefaultPersonaName) {
+		if this.Persona != nil {
+			this.applyPersona(nil)
+		}
+		this.printLocalResponse("Back to the default system message\n")
+		return
+	}
+
+	configFile := config.ConfigFile
+	if configFile == nil {
+		configFile = &ConfigFile{}
+	}
+	persona, err := configFile.GetPersona(name)
+	if err != nil {
+		this.Prompt.Clear()
+		this.PrintError(err)
+		return
+	}
+
+	this.applyPersona(persona)
+	this.printLocalResponse(fmt.Sprintf("Switched to persona %s, prompting with %s at temperature %g\n",
+		persona.Name, config.ShellPromptModel, this.PromptTemperature))
+}
@@ -0,0 +1,102 @@
+package butterfish
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPersonas = `personas:
+  terse:
+    system_message: Answer in as few words as possible.
+    temperature: 0.2
+  teacher:
+    system_message: Explain step by step.
+    model: gpt-4o
+`
+
+func loadTestPersonas(t *testing.T, content string) (*ConfigFile, error) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+	return LoadConfigFile(path)
+}
+
+func TestLoadConfigFilePersonas(t *testing.T) {
+	config, err := loadTestPersonas(t, testPersonas)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"teacher", "terse"}, config.PersonaNames())
+
+	persona, err := config.GetPersona("terse")
+	assert.Nil(t, err)
+	assert.Equal(t, "terse", persona.Name)
+	assert.Equal(t, float32(0.2), *persona.Temperature)
+
+	persona, err = config.GetPersona("")
+	assert.Nil(t, err)
+	assert.Nil(t, persona)
+	_, err = config.GetPersona("nope")
+	assert.ErrorContains(t, err, "Unknown persona nope")
+
+	_, err = loadTestPersonas(t, "personas:\n  empty:\n    model: gpt-4o\n")
+	assert.ErrorContains(t, err, "has no system_message")
+	_, err = loadTestPersonas(t, "personas:\n  default:\n    system_message: hi\n")
+	assert.ErrorContains(t, err, "is reserved")
+	_, err = loadTestPersonas(t, "personas:\n  hot:\n    system_message: hi\n    temperature: 3\n")
+	assert.ErrorContains(t, err, "between 0 and 2")
+}
+
+func TestPersonaPromptOptions(t *testing.T) {
+	config, err := loadTestPersonas(t, testPersonas)
+	assert.Nil(t, err)
+	butterfish := &ButterfishCtx{Config: MakeButterfishConfig()}
+
+	parsed, options, err := butterfish.ParseCommand("prompt hi")
+	assert.Nil(t, err)
+	config.Personas["teacher"].applyPromptOptions(parsed, options)
+	assert.Equal(t, "Explain step by step.", options.Prompt.SystemMessage)
+	assert.Equal(t, "gpt-4o", options.Prompt.Model)
+
+	// flags on the command line win
+	parsed, options, err = butterfish.ParseCommand("prompt -m gpt-4o-mini -s Kindly -T 1 hi")
+	assert.Nil(t, err)
+	config.Personas["teacher"].applyPromptOptions(parsed, options)
+	config.Personas["terse"].applyPromptOptions(parsed, options)
+	assert.Equal(t, "Kindly", options.Prompt.SystemMessage)
+	assert.Equal(t, "gpt-4o-mini", options.Prompt.Model)
+	assert.Equal(t, float32(1), options.Prompt.Temperature)
+}
+
+func TestSwitchPersona(t *testing.T) {
+	shell := pluginShell()
+	configFile, err := loadTestPersonas(t, testPersonas)
+	assert.Nil(t, err)
+	shell.Butterfish.Config.ConfigFile = configFile
+	shell.Butterfish.Config.ShellPromptModel = "gpt-4o-mini"
+	shell.PromptTemperature = 0.7
+	out := shell.PromptAnswerWriter.(*bytes.Buffer)
+
+	shell.Prompt.Write("Persona teacher")
+	assert.True(t, shell.HandleLocalPrompt())
+	assert.Equal(t, "teacher", shell.Persona.Name)
+	assert.Equal(t, "Explain step by step.", shell.SystemMessage)
+	assert.Equal(t, "gpt-4o", shell.Butterfish.Config.ShellPromptModel)
+	assert.Contains(t, out.String(), "Switched to persona teacher, prompting with gpt-4o at temperature 0.7")
+
+	// switching goes back to the original model first
+	shell.SwitchPersona("terse")
+	assert.Equal(t, "gpt-4o-mini", shell.Butterfish.Config.ShellPromptModel)
+	assert.Equal(t, float32(0.2), shell.PromptTemperature)
+
+	shell.SwitchPersona("default")
+	assert.Nil(t, shell.Persona)
+	assert.Equal(t, "", shell.SystemMessage)
+	assert.Equal(t, float32(0.7), shell.PromptTemperature)
+
+	out.Reset()
+	shell.SwitchPersona("")
+	assert.Equal(t, DarkShellColorScheme.Answer+"No persona, using the shell's system message\nAvailable personas: teacher, terse\n"+
+		DarkShellColorScheme.Command, out.String())
+}
@@ -0,0 +1,380 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Plugins are Starlark scripts in ~/.config/butterfish/plugins/*.star that
+// add local commands and prompt preprocessors to shell mode, for things
+// that are more than a prompt, unlike shortcuts, and that need more than a
+// hook. Starlark is a small dialect of Python. A script registers functions
+// with the butterfish module when it's loaded:
+//
+//	def errors(args):
+//	    output = [b["content"] for b in butterfish.history(20) if b["type"] == "output"]
+//	    return butterfish.llm("List the errors in:\n" + "\n".join(output))
+//
+//	butterfish.register_command("errors", errors, help="List recent errors")
+//	butterfish.register_preprocessor(lambda prompt: prompt.replace("k8s", "kubernetes"))
+//
+// A command is run by its name like a shortcut, e.g. "Errors" or "/errors",
+// and gets the text after the name. What it prints with butterfish.print
+// and the string it returns are shown as the answer and go in the history.
+// Commands run in the background and can be cancelled with Ctrl-C.
+// Preprocessors get each prompt before it's sent and return the prompt to
+// send, they block the shell so they should be quick.
+//
+// The butterfish module has:
+//   - register_command(name, fn, help="")
+//   - register_preprocessor(fn)
+//   - history(n=10), the last n history blocks as dicts with type (prompt,
+//     command, output, answer, or function) and content, oldest first
+//   - llm(prompt, system="", model=""), the model's answer to a prompt
+//     without the shell history
+//   - print(text, style="answer"), where style is answer, highlight, error,
+//     or command
+
+const PluginExtension = ".star"
+
+// A local command added by a plugin
+type PluginCommand struct {
+	Name string
+	Help string
+	// the file that registered it
+	Plugin string
+	fn     starlark.Callable
+}
+
+// The plugins loaded for a shell, a nil Plugins has none
+type Plugins struct {
+	Commands []*PluginCommand
+	// Plugins that failed to load, shown by Status
+	Errors []error
+
+	preprocessors []starlark.Callable
+	shell         *ShellState
+}
+
+// Run by a plugin's thread, holds what its builtins need
+type pluginCall struct {
+	ctx    context.Context
+	plugin string
+	// what the call printed, nil while loading and preprocessing
+	out *strings.Builder
+}
+
+const pluginCallKey = "call"
+
+// Load the plugins in dir in alphabetical order, a missing dir means no
+// plugins. A plugin that fails to load is left out and its error kept in
+// Errors.
+func LoadPlugins(dir string, shell *ShellState) (*Plugins, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+PluginExtension))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	plugins := &Plugins{shell: shell}
+	for _, path := range paths {
+		src, err := os.ReadFile(path)
+		if err == nil {
+			err = plugins.Load(filepath.Base(path), src)
+		}
+		if err != nil {
+			log.Printf("Unable to load plugin %s: %s", path, err)
+			plugins.Errors = append(plugins.Errors, err)
+		}
+	}
+	return plugins, nil
+}
+
+// Run a plugin's source, registering its commands and preprocessors
+func (this *Plugins) Load(name string, src []byte) error {
+	thread := this.thread(&pluginCall{ctx: context.Background(), plugin: name})
+	_, err := starlark.ExecFile(thread, name, src, this.predeclared())
+	if err != nil {
+		return fmt.Errorf("Plugin %s: %s", name, pluginError(err))
+	}
+	return nil
+}
+
+// Show the Starlark backtrace for errors in plugin code
+func pluginError(err error) string {
+	var evalErr *starlark.EvalError
+	if errors.As(err, &evalErr) {
+		return evalErr.Backtrace()
+	}
+	return err.Error()
+}
+
+func (this *Plugins) thread(call *pluginCall) *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: call.plugin,
+		Print: func(thread *starlark.Thread, msg string) {
+			log.Printf("Plugin %s: %s", call.plugin, msg)
+		},
+	}
+	thread.SetLocal(pluginCallKey, call)
+	return thread
+}
+
+func (this *Plugins) predeclared() starlark.StringDict {
+	return starlark.StringDict{
+		"butterfish": &starlarkstruct.Module{
+			Name: "butterfish",
+			Members: starlark.StringDict{
+				"register_command":      starlark.NewBuiltin("register_command", this.registerCommand),
+				"register_preprocessor": starlark.NewBuiltin("register_preprocessor", this.registerPreprocessor),
+				"history":               starlark.NewBuiltin("history", this.history),
+				"llm":                   starlark.NewBuiltin("llm", this.llm),
+				"print":                 starlark.NewBuiltin("print", this.print),
+			},
+		},
+	}
+}
+
+func threadCall(thread *starlark.Thread) *pluginCall {
+	return thread.Local(pluginCallKey).(*pluginCall)
+}
+
+func (this *Plugins) registerCommand(thread *starlark.Thread, builtin *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name, help string
+	var fn starlark.Callable
+	err := starlark.UnpackArgs(builtin.Name(), args, kwargs, "name", &name, "fn", &fn, "help?", &help)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" || strings.ContainsAny(name, " \t\n") {
+		return nil, fmt.Errorf("%s: command names must be a single word, got %q", builtin.Name(), name)
+	}
+	if command := this.command(name); command != nil {
+		return nil, fmt.Errorf("%s: %s is already registered by %s", builtin.Name(), name, command.Plugin)
+	}
+
+	this.Commands = append(this.Commands, &PluginCommand{
+		Name:   name,
+		Help:   help,
+		Plugin: threadCall(thread).plugin,
+		fn:     fn,
+	})
+	return starlark.None, nil
+}
+
+func (this *Plugins) registerPreprocessor(thread *starlark.Thread, builtin *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var fn starlark.Callable
+	if err := starlark.UnpackArgs(builtin.Name(), args, kwargs, "fn", &fn); err != nil {
+		return nil, err
+	}
+	this.preprocessors = append(this.preprocessors, fn)
+	return starlark.None, nil
+}
+
+// Names for history types in plugins
+var pluginHistoryTypes = map[int]string{
+	historyTypePrompt:         "prompt",
+	historyTypeShellInput:     "command",
+	historyTypeShellOutput:    "output",
+	historyTypeLLMOutput:      "answer",
+	historyTypeFunctionOutput: "function",
+	historyTypeToolOutput:     "function",
+}
+
+func (this *Plugins) history(thread *starlark.Thread, builtin *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	n := 10
+	if err := starlark.UnpackArgs(builtin.Name(), args, kwargs, "n?", &n); err != nil {
+		return nil, err
+	}
+
+	blocks := []starlark.Value{}
+	this.shell.History.IterateBlocks(func(block *HistoryBuffer) bool {
+		if len(blocks) >= n {
+			return false
+		}
+		dict := starlark.NewDict(2)
+		dict.SetKey(starlark.String("type"), starlark.String(pluginHistoryTypes[block.Type]))
+		dict.SetKey(starlark.String("content"), starlark.String(block.Content.String()))
+		blocks = append(blocks, dict)
+		return true
+	})
+
+	// oldest first
+	for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+		blocks[i], blocks[j] = blocks[j], blocks[i]
+	}
+	return starlark.NewList(blocks), nil
+}
+
+func (this *Plugins) llm(thread *starlark.Thread, builtin *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var promptStr, system, model string
+	err := starlark.UnpackArgs(builtin.Name(), args, kwargs, "prompt", &promptStr, "system?", &system, "model?", &model)
+	if err != nil {
+		return nil, err
+	}
+
+	shell := this.shell
+	config := shell.Butterfish.Config
+	if model == "" {
+		model = config.ShellPromptModel
+	}
+	_, _, responseTokens := shellTokenBudgets(config, LookupModel(model).ContextWindow)
+	request := &util.CompletionRequest{
+		Ctx:           threadCall(thread).ctx,
+		Prompt:        promptStr,
+		Model:         model,
+		MaxTokens:     responseTokens,
+		Temperature:   shell.PromptTemperature,
+		SystemMessage: system,
+		Verbose:       config.Verbose > 0,
+		TokenTimeout:  config.TokenTimeout,
+	}
+	config.LimitRequest(FeaturePrompt, request)
+
+	response, err := shell.Butterfish.LLMClient.Completion(request)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", builtin.Name(), err)
+	}
+	if response.Refusal != "" {
+		return nil, fmt.Errorf("%s: %s", builtin.Name(), response.RefusalMessage())
+	}
+	return starlark.String(response.Completion), nil
+}
+
+func (this *Plugins) print(thread *starlark.Thread, builtin *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var text string
+	style := "answer"
+	if err := starlark.UnpackArgs(builtin.Name(), args, kwargs, "text", &text, "style?", &style); err != nil {
+		return nil, err
+	}
+
+	color := this.shell.Color
+	colors := map[string]string{
+		"answer":    color.Answer,
+		"highlight": color.AnswerHighlight,
+		"error":     color.Error,
+		"command":   color.Command,
+	}
+	code, ok := colors[style]
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown style %s, expected answer, highlight, error, or command", builtin.Name(), style)
+	}
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+
+	fmt.Fprintf(this.shell.PromptAnswerWriter, "%s%s%s", code, text, color.Command)
+	if out := threadCall(thread).out; out != nil {
+		out.WriteString(text)
+	}
+	return starlark.None, nil
+}
+
+func (this *Plugins) command(name string) *PluginCommand {
+	if this == nil {
+		return nil
+	}
+	for _, command := range this.Commands {
+		if strings.EqualFold(command.Name, name) {
+			return command
+		}
+	}
+	return nil
+}
+
+func (this *Plugins) commandNames() []string {
+	if this == nil {
+		return nil
+	}
+	names := []string{}
+	for _, command := range this.Commands {
+		names = append(names, command.Name)
+	}
+	return names
+}
+
+// Run a plugin command, returning what it printed and returned
+func (this *Plugins) RunCommand(ctx context.Context, command *PluginCommand, args string) (string, error) {
+	call := &pluginCall{ctx: ctx, plugin: command.Plugin, out: &strings.Builder{}}
+	thread := this.thread(call)
+	stop := context.AfterFunc(ctx, func() { thread.Cancel("canceled") })
+	defer stop()
+
+	result, err := starlark.Call(thread, command.fn, starlark.Tuple{starlark.String(args)}, nil)
+	if err != nil {
+		return call.out.String(), fmt.Errorf("Plugin command %s: %s", command.Name, pluginError(err))
+	}
+	if text, ok := starlark.AsString(result); ok && text != "" {
+		if !strings.HasSuffix(text, "\n") {
+			text += "\n"
+		}
+		fmt.Fprintf(this.shell.PromptAnswerWriter, "%s%s%s", this.shell.Color.Answer, text, this.shell.Color.Command)
+		call.out.WriteString(text)
+	}
+	return call.out.String(), nil
+}
+
+// Pass a prompt through the preprocessors in the order they were registered
+func (this *Plugins) Preprocess(promptStr string) (string, error) {
+	if this == nil {
+		return promptStr, nil
+	}
+	for _, fn := range this.preprocessors {
+		thread := this.thread(&pluginCall{ctx: context.Background(), plugin: fn.Name()})
+		result, err := starlark.Call(thread, fn, starlark.Tuple{starlark.String(promptStr)}, nil)
+		if err != nil {
+			return "", fmt.Errorf("Prompt preprocessor %s: %s", fn.Name(), pluginError(err))
+		}
+		if result == starlark.None {
+			continue
+		}
+		text, ok := starlark.AsString(result)
+		if !ok {
+			return "", fmt.Errorf("Prompt preprocessor %s returned %s, not a string", fn.Name(), result.Type())
+		}
+		promptStr = text
+	}
+	return promptStr, nil
+}
+
+// Run a plugin command in the background, its output becomes the answer
+func (this *ShellState) RunPluginCommand(command *PluginCommand, args string) {
+	this.Prompt.Clear()
+	this.setState(statePromptResponse)
+	ctx, cancel := context.WithCancel(context.Background())
+	this.PromptResponseCancel = cancel
+
+	go func() {
+		defer cancel()
+		text, err := this.Plugins.RunCommand(ctx, command, args)
+		if err != nil {
+			fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s\n", this.Color.Error, err, this.Color.Command)
+		}
+		this.PromptOutputChan <- &util.CompletionResponse{Completion: text}
+	}()
+}
+
+func (this *Plugins) Describe() string {
+	if this == nil {
+		return "none"
+	}
+	text := fmt.Sprintf("%d commands, %d preprocessors", len(this.Commands), len(this.preprocessors))
+	for _, command := range this.Commands {
+		text += fmt.Sprintf("\n  /%s %s", command.Name, command.Help)
+	}
+	for _, err := range this.Errors {
+		text += "\n  " + strings.ReplaceAll(err.Error(), "\n", "\n  ")
+	}
+	return text
+}
@@ -0,0 +1,105 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func pluginShell() *ShellState {
+	return &ShellState{
+		Butterfish:         &ButterfishCtx{Config: MakeButterfishConfig(), LLMClient: &echoLLM{}},
+		Color:              DarkShellColorScheme,
+		Prompt:             NewShellBuffer(),
+		History:            NewShellHistory(),
+		PromptAnswerWriter: new(bytes.Buffer),
+		PromptOutputChan:   make(chan *util.CompletionResponse, 4),
+	}
+}
+
+const testPlugin = `
+def last(args):
+    blocks = butterfish.history(2)
+    butterfish.print("Found %d blocks" % len(blocks), style="highlight")
+    return butterfish.llm(args + ": " + blocks[-1]["content"], system="Be brief")
+
+butterfish.register_command("last", last, help="Ask about the last output")
+butterfish.register_preprocessor(lambda prompt: prompt.replace("k8s", "kubernetes"))
+butterfish.register_preprocessor(lambda prompt: None)
+`
+
+func TestPluginCommand(t *testing.T) {
+	shell := pluginShell()
+	shell.History.Append(historyTypeShellInput, "ls")
+	shell.History.Append(historyTypeShellOutput, "go.mod")
+	shell.Plugins = &Plugins{shell: shell}
+	assert.Nil(t, shell.Plugins.Load("last.star", []byte(testPlugin)))
+
+	shell.Prompt.Write("Lastly, what's next?")
+	assert.False(t, shell.HandleLocalPrompt())
+
+	shell.Prompt.Clear()
+	shell.Prompt.Write("Last Explain")
+	assert.True(t, shell.HandleLocalPrompt())
+	assert.Equal(t, statePromptResponse, shell.State)
+
+	output := <-shell.PromptOutputChan
+	assert.Equal(t, "Found 2 blocks\necho: Explain: go.mod\n", output.Completion)
+	llm := shell.Butterfish.LLMClient.(*echoLLM)
+	assert.Equal(t, "Be brief", llm.requests[0].SystemMessage)
+	assert.Contains(t, shell.PromptAnswerWriter.(*bytes.Buffer).String(), DarkShellColorScheme.AnswerHighlight+"Found 2 blocks")
+
+	text, err := shell.Plugins.Preprocess("Why is my k8s pod pending?")
+	assert.Nil(t, err)
+	assert.Equal(t, "Why is my kubernetes pod pending?", text)
+}
+
+func TestPluginErrors(t *testing.T) {
+	shell := pluginShell()
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "a.star"), []byte(testPlugin), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "b.star"), []byte(testPlugin), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "c.star"), []byte("def broken(:\n"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a plugin"), 0644))
+
+	plugins, err := LoadPlugins(dir, shell)
+	assert.Nil(t, err)
+	assert.Len(t, plugins.Commands, 1)
+	assert.Len(t, plugins.Errors, 2)
+	assert.ErrorContains(t, plugins.Errors[0], "last is already registered by a.star")
+	assert.ErrorContains(t, plugins.Errors[1], "Plugin c.star")
+
+	// a missing directory has no plugins
+	plugins, err = LoadPlugins(filepath.Join(dir, "missing"), shell)
+	assert.Nil(t, err)
+	assert.Empty(t, plugins.Commands)
+
+	shell.Plugins = &Plugins{shell: shell}
+	assert.Nil(t, shell.Plugins.Load("bad.star", []byte(`
+def spin(args):
+    for i in range(1000000000):
+        pass
+
+butterfish.register_command("spin", spin)
+butterfish.register_preprocessor(lambda prompt: 1)
+`)))
+	_, err = shell.Plugins.Preprocess("hi")
+	assert.EqualError(t, err, "Prompt preprocessor lambda returned int, not a string")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = shell.Plugins.RunCommand(ctx, shell.Plugins.command("spin"), "")
+	assert.ErrorContains(t, err, "canceled")
+
+	// no plugins
+	var none *Plugins
+	text, err := none.Preprocess("hi")
+	assert.Nil(t, err)
+	assert.Equal(t, "hi", text)
+}
@@ -0,0 +1,133 @@
+package butterfish
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/bakks/butterfish/prompt"
+)
+
+// The prompts command lists, shows, and edits the prompt library in
+// prompts.yaml, including the per-model variants of each prompt
+
+// Editors that accept +line to open a file at a line
+var lineNumberEditors = map[string]bool{
+	"vi": true, "vim": true, "nvim": true, "nano": true, "emacs": true,
+}
+
+func RunPromptsCommand(out io.Writer, promptPath, command string, options *CliCommandConfig) error {
+	library, err := NewDiskPromptLibrary(promptPath, false, out)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "prompts list":
+		for _, p := range library.Prompts {
+			fmt.Fprintf(out, "%s", p.Name)
+			if !p.OkToReplace {
+				fmt.Fprintf(out, " (edited)")
+			}
+			for _, variant := range p.Variants {
+				fmt.Fprintf(out, " [%s]", strings.Join(variant.Models, ", "))
+			}
+			fmt.Fprintf(out, "\n")
+		}
+
+	case "prompts show <name>":
+		index := library.ContainsPromptNamed(options.Prompts.Show.Name)
+		if index == -1 {
+			return fmt.Errorf("No prompt named %s, see butterfish prompts list", options.Prompts.Show.Name)
+		}
+		p := library.Prompts[index]
+
+		if options.Prompts.Show.Model != "" {
+			fmt.Fprintf(out, "%s\n", p.ForModel(options.Prompts.Show.Model))
+			return nil
+		}
+		fmt.Fprintf(out, "%s\n", p.Prompt)
+		for _, variant := range p.Variants {
+			fmt.Fprintf(out, "\nVariant for %s:\n%s\n", strings.Join(variant.Models, ", "), variant.Prompt)
+		}
+
+	case "prompts edit", "prompts edit <name>":
+		return editPrompts(out, library, options.Prompts.Edit.Name, resolveEditor(options.Prompts.Edit.Editor))
+
+	default:
+		return errors.New("Unrecognized command: " + command)
+	}
+
+	return nil
+}
+
+// Find the line of a prompt in the library file, 0 if not found
+func promptLine(path, name string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "- name: "+name {
+			return line
+		}
+	}
+	return 0
+}
+
+func editPrompts(out io.Writer, library *prompt.DiskPromptLibrary, name, editor string) error {
+	args := []string{library.Path}
+	if name != "" {
+		line := promptLine(library.Path, name)
+		if line == 0 {
+			return fmt.Errorf("No prompt named %s, see butterfish prompts list", name)
+		}
+		if lineNumberEditors[filepath.Base(editor)] {
+			args = []string{fmt.Sprintf("+%d", line), library.Path}
+		}
+	}
+
+	err := runEditor(editor, args...)
+	if err != nil {
+		return err
+	}
+
+	edited := prompt.NewPromptLibrary(library.Path, false, out)
+	err = edited.Load()
+	if err != nil {
+		return fmt.Errorf("%s Your changes are still in %s", err, library.Path)
+	}
+
+	// Prompts the user changed shouldn't be replaced by the defaults when
+	// Butterfish is upgraded
+	marked := []string{}
+	for i, p := range edited.Prompts {
+		index := library.ContainsPromptNamed(p.Name)
+		if !p.OkToReplace || index == -1 {
+			continue
+		}
+		before := library.Prompts[index]
+		if before.Prompt != p.Prompt || !reflect.DeepEqual(before.Variants, p.Variants) {
+			edited.Prompts[i].OkToReplace = false
+			marked = append(marked, p.Name)
+		}
+	}
+
+	if len(marked) > 0 {
+		err = edited.Save()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Set oktoreplace to false on %s so that upgrades keep your changes\n", strings.Join(marked, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package butterfish
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/prompt"
+)
+
+const testPromptLibrary = `- name: shell_autocomplete_command
+  prompt: default {command}
+  oktoreplace: false
+  variants:
+  - models: [llama3*, "qwen*"]
+    prompt: terse {command}
+  - models: [llama3.2:1b]
+    prompt: tiny {command}
+`
+
+func TestPromptVariants(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prompts.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(testPromptLibrary), 0644))
+
+	library, err := NewDiskPromptLibrary(path, false, io.Discard)
+	assert.Nil(t, err)
+
+	cases := map[string]string{
+		"":                   "default ls",
+		"gpt-4o":             "default ls",
+		"llama3.1:8b":        "terse ls",
+		"Qwen2.5-Coder":      "terse ls",
+		"llama3.2:1b":        "tiny ls",
+		"meta/llama3":        "default ls",
+		"codellama3-example": "default ls",
+	}
+	for model, expected := range cases {
+		p, err := library.GetPromptForModel(prompt.ShellAutosuggestCommand, model, "command", "ls")
+		assert.Nil(t, err)
+		assert.Equal(t, expected, p, model)
+	}
+
+	// the edited prompt survives loading the defaults, and the others are added
+	assert.True(t, len(library.Prompts) > 1)
+	p, err := library.GetUninterpolatedPrompt(prompt.ShellAutosuggestCommand)
+	assert.Nil(t, err)
+	assert.Equal(t, "default {command}", p)
+
+	// reloading keeps the variants
+	library, err = NewDiskPromptLibrary(path, false, io.Discard)
+	assert.Nil(t, err)
+	p, err = library.GetUninterpolatedPromptForModel(prompt.ShellAutosuggestCommand, "qwen2")
+	assert.Nil(t, err)
+	assert.Equal(t, "terse {command}", p)
+}
+
+func TestPromptsCommand(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "prompts.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(testPromptLibrary), 0644))
+
+	out := new(bytes.Buffer)
+	options := &CliCommandConfig{}
+	assert.Nil(t, RunPromptsCommand(out, path, "prompts list", options))
+	assert.Contains(t, out.String(), "shell_autocomplete_command (edited) [llama3*, qwen*] [llama3.2:1b]\n")
+	assert.Contains(t, out.String(), "\nsummarize\n")
+
+	out.Reset()
+	options.Prompts.Show.Name = prompt.ShellAutosuggestCommand
+	assert.Nil(t, RunPromptsCommand(out, path, "prompts show <name>", options))
+	assert.Equal(t, "default {command}\n\nVariant for llama3*, qwen*:\nterse {command}\n\nVariant for llama3.2:1b:\ntiny {command}\n", out.String())
+
+	out.Reset()
+	options.Prompts.Show.Model = "qwen2"
+	assert.Nil(t, RunPromptsCommand(out, path, "prompts show <name>", options))
+	assert.Equal(t, "terse {command}\n", out.String())
+
+	options.Prompts.Show.Name = "nope"
+	assert.ErrorContains(t, RunPromptsCommand(out, path, "prompts show <name>", options), "No prompt named nope")
+
+	// an editor that changes the summarize prompt and records its arguments
+	editor := filepath.Join(dir, "vim")
+	script := "#!/bin/sh\necho \"$@\" > " + filepath.Join(dir, "args") +
+		"\nsed -i.bak 's/summarize the file contents/summarize the file contents in Spanish/' \"$2\"\n"
+	assert.Nil(t, os.WriteFile(editor, []byte(script), 0755))
+
+	out.Reset()
+	options.Prompts.Edit.Name = prompt.PromptSummarize
+	options.Prompts.Edit.Editor = editor
+	assert.Nil(t, RunPromptsCommand(out, path, "prompts edit <name>", options))
+	assert.Equal(t, "Set oktoreplace to false on summarize so that upgrades keep your changes\n", out.String())
+
+	args, err := os.ReadFile(filepath.Join(dir, "args"))
+	assert.Nil(t, err)
+	assert.Equal(t, "+"+strconv.Itoa(promptLine(path, prompt.PromptSummarize))+" "+path+"\n", string(args))
+
+	library, err := NewDiskPromptLibrary(path, false, io.Discard)
+	assert.Nil(t, err)
+	p, err := library.GetPrompt(prompt.PromptSummarize, "content", "x")
+	assert.Nil(t, err)
+	assert.Contains(t, p, "summarize the file contents in Spanish")
+}
+
+const testTemplateLibrary = `- name: goal_mode_system_message
+  prompt: |-
+    Goal: {goal}{{if .functions}}
+    Call one of {{.functions}}.{{end}}
+    {{include "shared_rules"}}
+  oktoreplace: false
+- name: shared_rules
+  prompt: Be brief on {{.sysinfo}}.
+  oktoreplace: false
+- name: looping
+  prompt: '{{include "looping"}}'
+  oktoreplace: false
+`
+
+func TestPromptTemplates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prompts.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(testTemplateLibrary), 0644))
+
+	library, err := NewDiskPromptLibrary(path, false, io.Discard)
+	assert.Nil(t, err)
+
+	p, err := library.GetPrompt(prompt.GoalModeSystemMessage,
+		"goal", "fix {the} build", "sysinfo", "linux", "functions", "command, finish")
+	assert.Nil(t, err)
+	assert.Equal(t, "Goal: fix {the} build\nCall one of command, finish.\nBe brief on linux.", p)
+
+	p, err = library.GetPrompt(prompt.GoalModeSystemMessage,
+		"goal", "x", "sysinfo", "linux", "functions", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "Goal: x\nBe brief on linux.", p)
+
+	// includes are expanded in the uninterpolated prompt
+	raw, err := library.GetUninterpolatedPrompt(prompt.GoalModeSystemMessage)
+	assert.Nil(t, err)
+	assert.Contains(t, raw, "Be brief on {{.sysinfo}}.")
+
+	_, err = library.GetPrompt(prompt.GoalModeSystemMessage, "goal", "x", "sysinfo", "linux")
+	assert.ErrorContains(t, err, `map has no entry for key "functions"`)
+
+	_, err = library.GetPrompt("looping")
+	assert.ErrorContains(t, err, "nested too deeply")
+
+	// simple prompts allow extra arguments but not missing ones
+	p, err = prompt.Interpolate("Hello {name}", "name", "world", "unused", "x")
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello world", p)
+	_, err = prompt.Interpolate("Hello {name}")
+	assert.ErrorContains(t, err, "Missing field {name}")
+}
@@ -0,0 +1,106 @@
+package butterfish
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Snapshot tests for prompt handling. Each file in testdata/ps1 holds the
+// output of a shell with a particular prompt setup, split into the chunks we
+// read from the PTY, along with what ParsePS1 and FilterChildOut returned for
+// each chunk. The test checks that we still return the same. After an
+// intended change, rewrite the expected results with:
+//
+//	go test ./butterfish -run TestPS1Fixtures -update
+//
+// and review the diff. See testdata/ps1/README.md for recording new setups.
+
+var updateFixtures = flag.Bool("update", false, "Rewrite the expected results in test fixtures")
+
+type ps1Fixture struct {
+	Name  string `yaml:"name"`
+	Notes string `yaml:"notes,omitempty"`
+	// The shell binary, decides how we set PS1
+	Shell string `yaml:"shell"`
+	// Recorded with --no-command-prompt, i.e. without the fish icon
+	LeavePromptAlone bool `yaml:"leave_prompt_alone,omitempty"`
+	// empty, goal, or goal_unsafe, decides the icon we swap in
+	Mode string `yaml:"mode,omitempty"`
+	// What we write to the shell to set PS1
+	SetPS1 string      `yaml:"set_ps1"`
+	Chunks []*ps1Chunk `yaml:"chunks"`
+}
+
+type ps1Chunk struct {
+	Data     string `yaml:"data"`
+	Status   int    `yaml:"status"`
+	Prompts  int    `yaml:"prompts"`
+	Cleaned  string `yaml:"cleaned"`
+	Filtered bool   `yaml:"filtered,omitempty"`
+}
+
+func (this *ps1Fixture) shellState() *ShellState {
+	config := MakeButterfishConfig()
+	config.ShellBinary = this.Shell
+	config.ShellLeavePromptAlone = this.LeavePromptAlone
+
+	return &ShellState{
+		Butterfish:     &ButterfishCtx{Config: config},
+		GoalMode:       this.Mode != "",
+		GoalModeUnsafe: this.Mode == "goal_unsafe",
+	}
+}
+
+func TestPS1Fixtures(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "ps1", "*.yaml"))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, paths)
+
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			data, err := os.ReadFile(path)
+			assert.Nil(t, err)
+
+			fixture := &ps1Fixture{}
+			assert.Nil(t, yaml.UnmarshalStrict(data, fixture))
+			shellState := fixture.shellState()
+
+			actual := *fixture
+			actual.Chunks = nil
+			buf := new(bytes.Buffer)
+			shellState.Butterfish.SetPS1(buf)
+			actual.SetPS1 = buf.String()
+
+			for _, chunk := range fixture.Chunks {
+				status, prompts, cleaned := shellState.ParsePS1(chunk.Data)
+				actual.Chunks = append(actual.Chunks, &ps1Chunk{
+					Data:     chunk.Data,
+					Status:   status,
+					Prompts:  prompts,
+					Cleaned:  cleaned,
+					Filtered: shellState.FilterChildOut(chunk.Data),
+				})
+			}
+
+			if *updateFixtures {
+				// one line per string, so diffs are easy to read
+				yaml.FutureLineWrap()
+				out, err := yaml.Marshal(&actual)
+				assert.Nil(t, err)
+				assert.Nil(t, os.WriteFile(path, out, 0644))
+				return
+			}
+
+			assert.Equal(t, fixture.SetPS1, actual.SetPS1, "set_ps1")
+			for i, chunk := range fixture.Chunks {
+				assert.Equal(t, chunk, actual.Chunks[i], "chunk %d", i)
+			}
+		})
+	}
+}
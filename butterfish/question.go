@@ -0,0 +1,117 @@
+package butterfish
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bakks/butterfish/embedding"
+	"github.com/bakks/butterfish/prompt"
+)
+
+// Answering a question from the index: each retrieved snippet is numbered in
+// the prompt along with where it came from, the model is asked to cite
+// snippets by number, and the cited ones are listed as sources after the
+// answer.
+
+// A retrieved chunk as it appears in the question prompt
+type questionSnippet struct {
+	// 1-based, how the model cites the snippet, e.g. [2]
+	Number   int
+	FilePath string
+	// 1-based line range, 0 if the file couldn't be read
+	StartLine int
+	EndLine   int
+	Content   string
+}
+
+func (this *questionSnippet) Location() string {
+	if this.StartLine == 0 {
+		return this.FilePath
+	}
+	return fmt.Sprintf("%s:%d-%d", this.FilePath, this.StartLine, this.EndLine)
+}
+
+// Find the line range of a byte range in a file
+func lineRange(path string, start, end uint64) (int, int) {
+	content, err := os.ReadFile(path)
+	if err != nil || end > uint64(len(content)) || start >= end {
+		return 0, 0
+	}
+
+	startLine := bytes.Count(content[:start], []byte("\n")) + 1
+	// a chunk ending with a newline ends on the line before it
+	endLine := startLine + bytes.Count(content[start:end-1], []byte("\n"))
+	return startLine, endLine
+}
+
+func newQuestionSnippets(results []*embedding.VectorSearchResult) []*questionSnippet {
+	snippets := make([]*questionSnippet, len(results))
+	for i, result := range results {
+		startLine, endLine := lineRange(result.FilePath, result.Start, result.End)
+		snippets[i] = &questionSnippet{
+			Number:    i + 1,
+			FilePath:  result.FilePath,
+			StartLine: startLine,
+			EndLine:   endLine,
+			Content:   result.Content,
+		}
+	}
+	return snippets
+}
+
+// Build the question prompt from search results, returns the snippets in the
+// order they were numbered
+func (this *ButterfishCtx) questionPrompt(
+	question string,
+	results []*embedding.VectorSearchResult,
+) (string, []*questionSnippet, error) {
+	snippets := newQuestionSnippets(results)
+
+	samples := []string{}
+	for _, snippet := range snippets {
+		samples = append(samples,
+			fmt.Sprintf("[%d] %s\n%s", snippet.Number, snippet.Location(), snippet.Content))
+	}
+
+	prompt, err := this.PromptLibrary.GetPrompt(prompt.PromptQuestion,
+		"snippets", strings.Join(samples, "\n---\n"),
+		"question", question)
+	return prompt, snippets, err
+}
+
+var citationRegex = regexp.MustCompile(`\[(\d+)\]`)
+
+// The snippets cited in an answer, in snippet order. If the answer doesn't
+// cite anything we can't tell what was used, so we return all of them.
+func citedSnippets(answer string, snippets []*questionSnippet) []*questionSnippet {
+	cited := map[int]bool{}
+	for _, match := range citationRegex.FindAllStringSubmatch(answer, -1) {
+		number, _ := strconv.Atoi(match[1])
+		cited[number] = true
+	}
+
+	result := []*questionSnippet{}
+	for _, snippet := range snippets {
+		if cited[snippet.Number] {
+			result = append(result, snippet)
+		}
+	}
+	if len(result) == 0 {
+		return snippets
+	}
+	return result
+}
+
+// A "Sources:" section listing where the cited snippets came from
+func formatSources(answer string, snippets []*questionSnippet) string {
+	builder := strings.Builder{}
+	builder.WriteString("Sources:\n")
+	for _, snippet := range citedSnippets(answer, snippets) {
+		fmt.Fprintf(&builder, "[%d] %s\n", snippet.Number, snippet.Location())
+	}
+	return builder.String()
+}
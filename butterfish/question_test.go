@@ -0,0 +1,44 @@
+package butterfish
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/embedding"
+)
+
+func TestQuestionSnippets(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "notes.md")
+	content := "# Title\n\nfirst\nsecond\n\n## Usage\nrun it\n"
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+
+	results := []*embedding.VectorSearchResult{
+		{FilePath: path, Start: 0, End: 22, Content: content[:22]},
+		{FilePath: path, Start: 23, End: uint64(len(content)), Content: content[23:]},
+		{FilePath: filepath.Join(dir, "deleted"), Start: 0, End: 10, Content: "gone"},
+	}
+
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		PromptLibrary: &namePromptLibrary{},
+	}
+	prompt, snippets, err := butterfish.questionPrompt("how do I use it?", results)
+	assert.Nil(t, err)
+	assert.Equal(t, path+":1-4", snippets[0].Location())
+	assert.Equal(t, path+":6-7", snippets[1].Location())
+	assert.Equal(t, filepath.Join(dir, "deleted"), snippets[2].Location())
+	assert.Contains(t, prompt, "[2] "+path+":6-7\n## Usage")
+
+	sources := formatSources("Run it, see [2].", snippets)
+	assert.Equal(t, "Sources:\n[2] "+path+":6-7\n", sources)
+
+	// without citations we list everything that was in the prompt
+	sources = formatSources("Run it.", snippets)
+	assert.Equal(t, 3, len(citedSnippets("Run it [7].", snippets)))
+	assert.Contains(t, sources, "[1] "+path+":1-4\n[2]")
+}
@@ -0,0 +1,176 @@
+package butterfish
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Secrets in the shell history, prompts, or files are replaced with markers
+// like [REDACTED:aws_key] before anything is sent to the API. This happens in
+// a wrapper around the LLM client, so the verbose logs show the redacted
+// request too. Patterns can be added in the config file:
+//
+//	redact:
+//	  patterns:
+//	    - name: internal_token
+//	      regex: 'itk_[A-Za-z0-9]{32}'
+//
+// If a pattern has a group named secret then only that group is redacted,
+// e.g. to keep the variable name in PASSWORD=hunter2.
+
+type RedactConfig struct {
+	// Turn off the built-in patterns, custom patterns still apply
+	DisableBuiltin bool             `yaml:"disable_builtin,omitempty"`
+	Patterns       []*RedactPattern `yaml:"patterns,omitempty"`
+}
+
+type RedactPattern struct {
+	Name  string `yaml:"name"`
+	Regex string `yaml:"regex"`
+
+	regex *regexp.Regexp
+}
+
+func builtinRedactPattern(name, regex string) *RedactPattern {
+	return &RedactPattern{Name: name, Regex: regex, regex: regexp.MustCompile(regex)}
+}
+
+var builtinRedactPatterns = []*RedactPattern{
+	builtinRedactPattern("private_key", `(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?(?:-----END [A-Z ]*PRIVATE KEY-----|$)`),
+	builtinRedactPattern("aws_key", `\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+	builtinRedactPattern("aws_secret", `(?i)aws_?secret_?access_?key["']?\s*[=:]\s*["']?(?P<secret>[A-Za-z0-9/+=]{40})`),
+	builtinRedactPattern("jwt", `\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`),
+	// e.g. DB_PASSWORD=... or export GITHUB_TOKEN="...", but not references
+	// to other variables like TOKEN=$OTHER
+	builtinRedactPattern("password", `(?i)\b[A-Z0-9_]*(?:PASSWORD|PASSWD|SECRET|TOKEN|API_?KEY)[A-Z0-9_]*=(?P<secret>"[^"$]+"|'[^']+'|[^\s"'$][^\s"']*)`),
+}
+
+func (this *RedactPattern) compile() error {
+	if this.Name == "" {
+		return fmt.Errorf("Redact pattern %s has no name", this.Regex)
+	}
+	regex, err := regexp.Compile(this.Regex)
+	if err != nil {
+		return fmt.Errorf("Invalid regex for redact pattern %s: %s", this.Name, err)
+	}
+	this.regex = regex
+	return nil
+}
+
+type Redactor struct {
+	patterns []*RedactPattern
+}
+
+// Build a redactor from the config file section, which may be nil
+func NewRedactor(config *RedactConfig) (*Redactor, error) {
+	if config == nil {
+		config = &RedactConfig{}
+	}
+
+	patterns := []*RedactPattern{}
+	if !config.DisableBuiltin {
+		patterns = append(patterns, builtinRedactPatterns...)
+	}
+	patterns = append(patterns, config.Patterns...)
+
+	redactor := &Redactor{}
+	for _, pattern := range patterns {
+		if pattern.regex == nil {
+			if err := pattern.compile(); err != nil {
+				return nil, err
+			}
+		}
+		redactor.patterns = append(redactor.patterns, pattern)
+	}
+	return redactor, nil
+}
+
+func (this *Redactor) Redact(text string) string {
+	for _, pattern := range this.patterns {
+		marker := "[REDACTED:" + pattern.Name + "]"
+		secret := pattern.regex.SubexpIndex("secret")
+		if secret == -1 {
+			text = pattern.regex.ReplaceAllLiteralString(text, marker)
+			continue
+		}
+
+		var redacted strings.Builder
+		last := 0
+		for _, indexes := range pattern.regex.FindAllStringSubmatchIndex(text, -1) {
+			start, end := indexes[2*secret], indexes[2*secret+1]
+			if start == -1 {
+				continue
+			}
+			redacted.WriteString(text[last:start])
+			redacted.WriteString(marker)
+			last = end
+		}
+		redacted.WriteString(text[last:])
+		text = redacted.String()
+	}
+	return text
+}
+
+// Copy the request with every piece of text redacted, the original is left
+// alone since callers keep the history around
+func (this *Redactor) RedactRequest(request *util.CompletionRequest) *util.CompletionRequest {
+	redacted := *request
+	redacted.Prompt = this.Redact(request.Prompt)
+	redacted.SystemMessage = this.Redact(request.SystemMessage)
+
+	redacted.HistoryBlocks = make([]util.HistoryBlock, len(request.HistoryBlocks))
+	for i, block := range request.HistoryBlocks {
+		block.Content = this.Redact(block.Content)
+		block.FunctionParams = this.Redact(block.FunctionParams)
+		if block.ToolCalls != nil {
+			toolCalls := make([]*util.ToolCall, len(block.ToolCalls))
+			for j, toolCall := range block.ToolCalls {
+				copied := *toolCall
+				copied.Function.Parameters = this.Redact(toolCall.Function.Parameters)
+				toolCalls[j] = &copied
+			}
+			block.ToolCalls = toolCalls
+		}
+		redacted.HistoryBlocks[i] = block
+	}
+
+	return &redacted
+}
+
+// Wraps an LLM client and redacts everything sent through it
+type RedactingLLM struct {
+	LLM      LLM
+	Redactor *Redactor
+}
+
+func NewRedactingLLM(llm LLM, redactor *Redactor) *RedactingLLM {
+	return &RedactingLLM{
+		LLM:      llm,
+		Redactor: redactor,
+	}
+}
+
+func (this *RedactingLLM) Unwrap() LLM {
+	return this.LLM
+}
+
+func (this *RedactingLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	return this.LLM.CompletionStream(this.Redactor.RedactRequest(request), writer)
+}
+
+func (this *RedactingLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	return this.LLM.Completion(this.Redactor.RedactRequest(request))
+}
+
+func (this *RedactingLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	redacted := make([]string, len(input))
+	for i, text := range input {
+		redacted[i] = this.Redactor.Redact(text)
+	}
+	return this.LLM.Embeddings(ctx, redacted, verbose)
+}
@@ -0,0 +1,237 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai/jsonschema"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// Fixing failed commands is shared by exec, which asks the LLM for a fixed
+// command and runs it, and goal mode, where the agent fixes its own commands.
+// Both decide whether to run a command with a CommandPolicy and give up after
+// MaxAttempts failed commands in a row.
+
+type CommandPolicy int
+
+const (
+	// Ask before running each command
+	PolicyConfirm CommandPolicy = iota
+	// Run commands without asking
+	PolicyAuto
+)
+
+const DefaultMaxFixAttempts = 5
+
+// A fix suggested for a failed command
+type CommandFix struct {
+	Explanation string `json:"explanation"`
+	// Empty if there's no fix, only an explanation
+	Command string `json:"cmd"`
+}
+
+var fixCommandFunction = util.FunctionDefinition{
+	Name:        "fix_command",
+	Description: "Give a fixed version of the failed command",
+	Parameters: jsonschema.Definition{
+		Type: jsonschema.Object,
+		Properties: map[string]jsonschema.Definition{
+			"explanation": {
+				Type:        jsonschema.String,
+				Description: "A short explanation of why the command failed and what the fix changes",
+			},
+			"cmd": {
+				Type:        jsonschema.String,
+				Description: "The fixed command including any arguments, without placeholders",
+			},
+		},
+		Required: []string{"explanation", "cmd"},
+	},
+}
+
+type CommandRepair struct {
+	LLM           LLM
+	PromptLibrary PromptLibrary
+	Model         string
+	MaxTokens     int
+	Temperature   float32
+	TokenTimeout  time.Duration
+	RequestLimits RequestLimits
+
+	Policy CommandPolicy
+	// Called before running a command with PolicyConfirm, can edit or reject
+	// the command
+	Confirm func(ctx context.Context, cmd string) (string, bool, error)
+	// Give up after this many failed commands in a row, 0 means no limit
+	MaxAttempts int
+	// Receives explanations of fixes, may be nil
+	Out io.Writer
+	// pre_command hooks can block each command before it runs, may be nil
+	Hooks *Hooks
+
+	failures int
+}
+
+// A CommandRepair using the exec model, request limits, and fix attempts
+// from the config
+func (this *ButterfishCtx) NewCommandRepair(policy CommandPolicy) *CommandRepair {
+	return &CommandRepair{
+		LLM:           this.LLMClient,
+		PromptLibrary: this.PromptLibrary,
+		Model:         this.Config.ExeccheckModel,
+		MaxTokens:     this.Config.ExeccheckMaxTokens,
+		Temperature:   this.Config.ExeccheckTemperature,
+		TokenTimeout:  this.Config.TokenTimeout,
+		RequestLimits: this.Config.RequestLimits[FeatureGencmd],
+		Policy:        policy,
+		MaxAttempts:   this.Config.MaxFixAttempts,
+		Hooks:         this.Hooks,
+	}
+}
+
+// Whether to run a command, which may have been edited when confirming
+func (this *CommandRepair) Approve(ctx context.Context, cmd string) (string, bool, error) {
+	if this.Policy == PolicyAuto {
+		return cmd, true, nil
+	}
+	if this.Confirm == nil {
+		return "", false, errors.New("Commands need confirmation but there's no way to confirm them")
+	}
+	return this.Confirm(ctx, cmd)
+}
+
+// Record the exit status of a command, returns an error once MaxAttempts
+// commands have failed in a row
+func (this *CommandRepair) Record(status int) error {
+	if status == 0 {
+		this.failures = 0
+		return nil
+	}
+
+	this.failures++
+	if this.MaxAttempts > 0 && this.failures >= this.MaxAttempts {
+		return fmt.Errorf("Giving up after %d failed commands in a row", this.failures)
+	}
+	return nil
+}
+
+// Ask the LLM for a fix, or check for common problems locally if it can't be
+// reached
+func (this *CommandRepair) Suggest(ctx context.Context, cmd string, status int, output string) (*CommandFix, error) {
+	promptStr, err := this.PromptLibrary.GetPromptForModel(prompt.PromptFixCommand,
+		this.Model,
+		"command", cmd,
+		"status", fmt.Sprintf("%d", status),
+		"output", output)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &util.CompletionRequest{
+		Ctx:           ctx,
+		Prompt:        promptStr,
+		Model:         this.Model,
+		MaxTokens:     this.MaxTokens,
+		Temperature:   this.Temperature,
+		SystemMessage: "N/A",
+		Functions:     []util.FunctionDefinition{fixCommandFunction},
+		TokenTimeout:  this.TokenTimeout,
+		Timeout:       this.RequestLimits.Timeout,
+		Retries:       this.RequestLimits.Retries,
+	}
+
+	response, err := this.LLM.Completion(req)
+	if llmUnreachable(err) {
+		fix := suggestLocalFix(cmd, status, output, exec.LookPath)
+		if fix == nil {
+			return nil, err
+		}
+		this.printf("Unable to reach the LLM (%s), checking for common problems instead\n", err)
+		return &CommandFix{Explanation: fix.Explanation, Command: fix.Command}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if response.Refusal != "" {
+		return nil, errors.New(response.RefusalMessage())
+	}
+
+	return parseCommandFix(response)
+}
+
+// Read the fix from a fix_command call, or from the text for prompts and
+// models that don't call functions
+func parseCommandFix(response *util.CompletionResponse) (*CommandFix, error) {
+	if response.FunctionName == fixCommandFunction.Name {
+		fix := &CommandFix{}
+		err := unmarshalToolArguments(response.FunctionParameters, fix)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse the suggested fix: %s", err)
+		}
+		fix.Command = strings.TrimSpace(fix.Command)
+		return fix, nil
+	}
+
+	fix := &CommandFix{Explanation: strings.TrimSpace(response.Completion)}
+	cmd, err := fixCommandParse(response.Completion)
+	if err == nil {
+		fix.Command = cmd
+		// we print the command separately
+		fix.Explanation = strings.TrimSpace(strings.Replace(fix.Explanation, "\n> "+cmd, "", 1))
+	}
+	return fix, nil
+}
+
+// Run a command and, while it fails, suggest a fix and run it if the policy
+// allows. run executes a command, locally or in a wrapped terminal.
+func (this *CommandRepair) Run(ctx context.Context, cmd string, run func(string) (*executeResult, error)) error {
+	for {
+		if err := this.Hooks.PreCommand(ctx, cmd, ""); err != nil {
+			return err
+		}
+		result, err := run(cmd)
+		if err != nil {
+			return err
+		}
+		if result.Status == 0 {
+			return nil
+		}
+		err = this.Record(result.Status)
+		if err != nil {
+			return err
+		}
+
+		this.printf("Command failed with status %d, requesting fix...\n", result.Status)
+		fix, err := this.Suggest(ctx, cmd, result.Status, string(result.LastOutput))
+		if err != nil {
+			return err
+		}
+		if fix.Explanation != "" {
+			this.printf("%s\n", fix.Explanation)
+		}
+		if fix.Command == "" {
+			return nil
+		}
+		this.printf("> %s\n", fix.Command)
+
+		var ok bool
+		cmd, ok, err = this.Approve(ctx, fix.Command)
+		if err != nil || !ok {
+			return err
+		}
+	}
+}
+
+func (this *CommandRepair) printf(format string, args ...any) {
+	if this.Out != nil {
+		fmt.Fprintf(this.Out, format, args...)
+	}
+}
@@ -0,0 +1,96 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func TestCommandRepair(t *testing.T) {
+	llm := &functionCallLLM{responses: []*util.CompletionResponse{
+		callFunction("fix_command", `{"explanation": "Typo in ls.", "cmd": "false --retry"}`),
+		{Completion: "The flag doesn't exist.\n> ls -l"},
+	}}
+	out := new(bytes.Buffer)
+	repair := &CommandRepair{
+		LLM:           llm,
+		PromptLibrary: &namePromptLibrary{},
+		Model:         "gpt-4o",
+		Policy:        PolicyAuto,
+		Out:           out,
+	}
+
+	commands := []string{}
+	run := func(cmd string) (*executeResult, error) {
+		commands = append(commands, cmd)
+		if cmd == "ls -l" {
+			return &executeResult{Status: 0}, nil
+		}
+		return &executeResult{Status: 2, LastOutput: []byte("no such option")}, nil
+	}
+
+	assert.Nil(t, repair.Run(context.Background(), "sl", run))
+	assert.Equal(t, []string{"sl", "false --retry", "ls -l"}, commands)
+	assert.Equal(t, "fix_command", llm.requests[0].Functions[0].Name)
+	assert.Contains(t, llm.requests[0].Prompt, "no such option")
+	assert.Equal(t, `Command failed with status 2, requesting fix...
+Typo in ls.
+> false --retry
+Command failed with status 2, requesting fix...
+The flag doesn't exist.
+> ls -l
+`, out.String())
+
+	// declining a fix stops the loop, the confirm callback can edit commands
+	llm = &functionCallLLM{responses: []*util.CompletionResponse{
+		callFunction("fix_command", `{"explanation": "x", "cmd": "ls -a"}`),
+		callFunction("fix_command", `{"explanation": "x", "cmd": "ls"}`),
+	}}
+	commands = []string{}
+	repair = &CommandRepair{
+		LLM:           llm,
+		PromptLibrary: &namePromptLibrary{},
+		Confirm: func(ctx context.Context, cmd string) (string, bool, error) {
+			return cmd + " -l", cmd == "ls", nil
+		},
+	}
+	assert.Nil(t, repair.Run(context.Background(), "sl", run))
+	assert.Equal(t, []string{"sl"}, commands)
+	assert.Nil(t, repair.Run(context.Background(), "sl", run))
+	assert.Equal(t, []string{"sl", "sl", "ls -l"}, commands)
+
+	// gives up after too many failures in a row
+	llm = &functionCallLLM{responses: []*util.CompletionResponse{
+		callFunction("fix_command", `{"explanation": "x", "cmd": "bad"}`),
+	}}
+	repair = &CommandRepair{
+		LLM:           llm,
+		PromptLibrary: &namePromptLibrary{},
+		Policy:        PolicyAuto,
+		MaxAttempts:   2,
+	}
+	err := repair.Run(context.Background(), "bad", run)
+	assert.EqualError(t, err, "Giving up after 2 failed commands in a row")
+	assert.Equal(t, 1, len(llm.requests))
+}
+
+func TestAgentMaxFailedCommands(t *testing.T) {
+	llm := &functionCallLLM{responses: []*util.CompletionResponse{
+		callFunction("command", `{"cmd": "false 1"}`),
+		callFunction("command", `{"cmd": "ls"}`),
+		callFunction("command", `{"cmd": "false 2"}`),
+		callFunction("command", `{"cmd": "false 3"}`),
+	}}
+	executor := &fakeExecutor{}
+
+	agent := NewAgent(llm, executor, "gpt-4o")
+	agent.Unsafe = true
+	agent.MaxFailedCommands = 2
+	_, err := agent.Run(context.Background(), "fail")
+	assert.EqualError(t, err, "Giving up after 2 failed commands in a row")
+	assert.Equal(t, []string{"false 1", "ls", "false 2", "false 3"}, executor.commands)
+}
@@ -0,0 +1,258 @@
+package butterfish
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// With BUTTERFISH_LLM=record every request and its response or error is
+// appended to a fixture file, with BUTTERFISH_LLM=replay the responses come
+// from that file instead of the API, so tests and scripts can run prompt,
+// shell, and goal mode flows offline and without an API key. The fixture file
+// is BUTTERFISH_FIXTURES, one JSON object per line.
+//
+// Replay matches a request by a hash of its content. Prompts with content
+// that changes between runs, like the shell history or the date, won't match
+// exactly, so then the next unused response of the same kind in recorded
+// order is returned.
+
+const (
+	LLMModeLive   = "live"
+	LLMModeRecord = "record"
+	LLMModeReplay = "replay"
+)
+
+const DefaultFixturesPath = "butterfish_fixtures.jsonl"
+
+const (
+	fixtureKindCompletion = "completion"
+	fixtureKindEmbeddings = "embeddings"
+)
+
+// One recorded exchange, the model and prompt are there for reading and
+// editing fixtures by hand
+type fixtureEntry struct {
+	Kind       string                   `json:"kind"`
+	Key        string                   `json:"key"`
+	Model      string                   `json:"model,omitempty"`
+	Prompt     string                   `json:"prompt,omitempty"`
+	Response   *util.CompletionResponse `json:"response,omitempty"`
+	Embeddings [][]float32              `json:"embeddings,omitempty"`
+	Error      string                   `json:"error,omitempty"`
+}
+
+func embeddingsHash(input []string) string {
+	data, _ := json.Marshal(input)
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// An LLM wrapper that appends each exchange to a fixture file
+type RecordingLLM struct {
+	LLM   LLM
+	Path  string
+	mutex sync.Mutex
+}
+
+func NewRecordingLLM(llm LLM, path string) *RecordingLLM {
+	return &RecordingLLM{
+		LLM:  llm,
+		Path: path,
+	}
+}
+
+func (this *RecordingLLM) Unwrap() LLM {
+	return this.LLM
+}
+
+func (this *RecordingLLM) record(entry *fixtureEntry, err error) error {
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	data, marshalErr := json.Marshal(entry)
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if err := os.MkdirAll(filepath.Dir(this.Path), 0755); err != nil {
+		return err
+	}
+	file, fileErr := os.OpenFile(this.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if fileErr != nil {
+		return fileErr
+	}
+	defer file.Close()
+	_, writeErr := file.Write(append(data, '\n'))
+	return writeErr
+}
+
+func (this *RecordingLLM) completion(
+	request *util.CompletionRequest,
+	call func() (*util.CompletionResponse, error),
+) (*util.CompletionResponse, error) {
+	key, err := requestHash(request)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := call()
+	// the caller cancelling isn't something to replay
+	if errors.Is(err, context.Canceled) {
+		return response, err
+	}
+	entry := &fixtureEntry{
+		Kind:     fixtureKindCompletion,
+		Key:      key,
+		Model:    request.Model,
+		Prompt:   request.Prompt,
+		Response: response,
+	}
+	if recordErr := this.record(entry, err); recordErr != nil {
+		return nil, fmt.Errorf("Unable to record to %s: %w", this.Path, recordErr)
+	}
+	return response, err
+}
+
+func (this *RecordingLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	return this.completion(request, func() (*util.CompletionResponse, error) {
+		return this.LLM.CompletionStream(request, writer)
+	})
+}
+
+func (this *RecordingLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	return this.completion(request, func() (*util.CompletionResponse, error) {
+		return this.LLM.Completion(request)
+	})
+}
+
+func (this *RecordingLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	embeddings, err := this.LLM.Embeddings(ctx, input, verbose)
+	if errors.Is(err, context.Canceled) {
+		return embeddings, err
+	}
+	entry := &fixtureEntry{
+		Kind:       fixtureKindEmbeddings,
+		Key:        embeddingsHash(input),
+		Embeddings: embeddings,
+	}
+	if recordErr := this.record(entry, err); recordErr != nil {
+		return nil, fmt.Errorf("Unable to record to %s: %w", this.Path, recordErr)
+	}
+	return embeddings, err
+}
+
+// An LLM that answers from a fixture file without calling an API
+type ReplayLLM struct {
+	Path    string
+	entries []*fixtureEntry
+	used    []bool
+	mutex   sync.Mutex
+}
+
+func LoadReplayLLM(path string) (*ReplayLLM, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open fixtures for replay: %w", err)
+	}
+	defer file.Close()
+
+	this := &ReplayLLM{Path: path}
+	scanner := bufio.NewScanner(file)
+	// responses with images or long completions make for long lines
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		entry := &fixtureEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return nil, fmt.Errorf("Invalid fixture on line %d of %s: %s", line, path, err)
+		}
+		this.entries = append(this.entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	this.used = make([]bool, len(this.entries))
+	return this, nil
+}
+
+// Take the unused entry matching the key, or else the next unused one of the
+// same kind
+func (this *ReplayLLM) next(kind, key, description string) (*fixtureEntry, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	found := -1
+	for i, entry := range this.entries {
+		if !this.used[i] && entry.Kind == kind && entry.Key == key {
+			found = i
+			break
+		}
+	}
+	if found < 0 {
+		for i, entry := range this.entries {
+			if !this.used[i] && entry.Kind == kind {
+				found = i
+				break
+			}
+		}
+	}
+	if found < 0 {
+		return nil, fmt.Errorf("No recorded response left in %s for %s", this.Path, description)
+	}
+
+	this.used[found] = true
+	entry := this.entries[found]
+	if entry.Error != "" {
+		return nil, errors.New(entry.Error)
+	}
+	return entry, nil
+}
+
+func (this *ReplayLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	response, err := this.Completion(request)
+	if err != nil {
+		return nil, err
+	}
+	_, err = writer.Write([]byte(response.Completion))
+	return response, err
+}
+
+func (this *ReplayLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	key, err := requestHash(request)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := this.next(fixtureKindCompletion, key, "a request to "+request.Model)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Response == nil {
+		return &util.CompletionResponse{}, nil
+	}
+	// callers may change the response
+	response := *entry.Response
+	return &response, nil
+}
+
+func (this *ReplayLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	entry, err := this.next(fixtureKindEmbeddings, embeddingsHash(input), "an embeddings request")
+	if err != nil {
+		return nil, err
+	}
+	return entry.Embeddings, nil
+}
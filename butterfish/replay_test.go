@@ -0,0 +1,70 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fixtures", "flow.jsonl")
+	backend := &failoverTestLLM{}
+	recorder := NewRecordingLLM(backend, path)
+
+	first := &util.CompletionRequest{Ctx: context.Background(), Model: "gpt-4o", Prompt: "list files"}
+	second := &util.CompletionRequest{Ctx: context.Background(), Model: "gpt-4o-mini", Prompt: "at 12:00, what next?"}
+	out := new(bytes.Buffer)
+	_, err := recorder.CompletionStream(first, out)
+	assert.Nil(t, err)
+	_, err = recorder.Completion(second)
+	assert.Nil(t, err)
+	backend.err = errors.New("status code: 500")
+	_, err = recorder.Completion(first)
+	assert.EqualError(t, err, "status code: 500")
+	_, err = recorder.Embeddings(context.Background(), []string{"text"}, false)
+	assert.Nil(t, err)
+
+	replay, err := LoadReplayLLM(path)
+	assert.Nil(t, err)
+
+	// requests are matched by content, so order doesn't matter
+	response, err := replay.Completion(&util.CompletionRequest{Model: "gpt-4o", Prompt: "list files"})
+	assert.Nil(t, err)
+	assert.Equal(t, "from gpt-4o", response.Completion)
+
+	// a prompt that changed between runs gets the next response in order
+	out.Reset()
+	response, err = replay.CompletionStream(&util.CompletionRequest{Model: "gpt-4o-mini", Prompt: "at 12:01, what next?"}, out)
+	assert.Nil(t, err)
+	assert.Equal(t, "from gpt-4o-mini", response.Completion)
+	assert.Equal(t, "from gpt-4o-mini", out.String())
+
+	// errors replay too
+	_, err = replay.Completion(first)
+	assert.EqualError(t, err, "status code: 500")
+
+	embeddings, err := replay.Embeddings(context.Background(), []string{"text"}, false)
+	assert.Nil(t, err)
+	assert.Nil(t, embeddings)
+
+	_, err = replay.Completion(first)
+	assert.ErrorContains(t, err, "No recorded response left")
+	assert.Equal(t, 3, len(backend.requests))
+}
+
+func TestLoadReplayLLMErrors(t *testing.T) {
+	_, err := LoadReplayLLM(filepath.Join(t.TempDir(), "missing.jsonl"))
+	assert.ErrorContains(t, err, "Unable to open fixtures for replay")
+
+	path := filepath.Join(t.TempDir(), "bad.jsonl")
+	os.WriteFile(path, []byte(`{"kind": "completion", "key": "a"}`+"\n\nnot json\n"), 0644)
+	_, err = LoadReplayLLM(path)
+	assert.ErrorContains(t, err, "Invalid fixture on line 3")
+}
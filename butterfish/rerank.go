@@ -0,0 +1,146 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sashabaranov/go-openai/jsonschema"
+
+	"github.com/bakks/butterfish/embedding"
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+const DefaultRerankModel = "gpt-4o-mini"
+
+// Reranks by asking an LLM to rate each snippet's relevance, a cheap model is
+// good enough for this and the ratings come back as structured output
+type llmReranker struct {
+	butterfish *ButterfishCtx
+	model      string
+}
+
+type rerankRating struct {
+	Snippet   int `json:"snippet"`
+	Relevance int `json:"relevance"`
+}
+
+type rerankRatings struct {
+	Ratings []rerankRating `json:"ratings"`
+}
+
+func rerankSchema() jsonschema.Definition {
+	rating := jsonschema.Definition{
+		Type: jsonschema.Object,
+		Properties: map[string]jsonschema.Definition{
+			"snippet":   {Type: jsonschema.Integer, Description: "The snippet number"},
+			"relevance": {Type: jsonschema.Integer, Description: "Relevance from 0 to 10"},
+		},
+		Required:             []string{"snippet", "relevance"},
+		AdditionalProperties: false,
+	}
+
+	return jsonschema.Definition{
+		Type: jsonschema.Object,
+		Properties: map[string]jsonschema.Definition{
+			"ratings": {Type: jsonschema.Array, Items: &rating},
+		},
+		Required:             []string{"ratings"},
+		AdditionalProperties: false,
+	}
+}
+
+func (this *llmReranker) Rerank(ctx context.Context, query string, documents []string) ([]float64, error) {
+	snippets := strings.Builder{}
+	for i, document := range documents {
+		fmt.Fprintf(&snippets, "Snippet %d:\n'''\n%s\n'''\n\n", i, document)
+	}
+
+	rerankPrompt, err := this.butterfish.PromptLibrary.GetPrompt(prompt.PromptRerank,
+		"query", query,
+		"snippets", snippets.String())
+	if err != nil {
+		return nil, err
+	}
+
+	schema := rerankSchema()
+	schemaJson, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &util.CompletionRequest{
+		Ctx:           ctx,
+		Prompt:        rerankPrompt,
+		Model:         this.model,
+		MaxTokens:     256 + 16*len(documents),
+		Temperature:   0,
+		SystemMessage: "N/A",
+		Verbose:       this.butterfish.Config.Verbose > 0,
+		TokenTimeout:  this.butterfish.Config.TokenTimeout,
+		JSONSchema:    json.RawMessage(schemaJson),
+	}
+	this.butterfish.Config.LimitRequest(FeaturePrompt, req)
+
+	output, err := this.butterfish.structuredCompletion(req, schema, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	ratings := rerankRatings{}
+	err = json.Unmarshal([]byte(output), &ratings)
+	if err != nil {
+		return nil, err
+	}
+
+	// snippets the model skipped rank below everything it rated
+	scores := make([]float64, len(documents))
+	for i := range scores {
+		scores[i] = -1
+	}
+	for _, rating := range ratings.Ratings {
+		if rating.Snippet >= 0 && rating.Snippet < len(documents) {
+			scores[rating.Snippet] = float64(rating.Relevance) / 10
+		}
+	}
+
+	return scores, nil
+}
+
+func (this *ButterfishCtx) newReranker(options *RerankOptions) embedding.Reranker {
+	if options.RerankURL != "" {
+		return embedding.NewEndpointReranker(options.RerankURL, options.RerankModel)
+	}
+
+	model := options.RerankModel
+	if model == "" {
+		model = DefaultRerankModel
+	}
+	return &llmReranker{butterfish: this, model: model}
+}
+
+// Search the vector index, optionally fetching extra candidates and reranking
+// them down to numResults
+func (this *ButterfishCtx) SearchIndex(
+	query string,
+	numResults int,
+	options *RerankOptions,
+) ([]*embedding.VectorSearchResult, error) {
+	if this.VectorIndex == nil {
+		return nil, errors.New("No vector index loaded")
+	}
+	if options == nil || !options.Rerank {
+		return this.VectorIndex.Search(this.Ctx, query, numResults)
+	}
+
+	candidates := max(options.RerankCandidates, numResults)
+	results, err := this.VectorIndex.Search(this.Ctx, query, candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	return embedding.RerankResults(this.Ctx, this.newReranker(options), query, results, numResults)
+}
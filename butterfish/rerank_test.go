@@ -0,0 +1,28 @@
+package butterfish
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLLMReranker(t *testing.T) {
+	llm := &scriptedLLM{responses: []string{
+		`{"ratings": [{"snippet": 0, "relevance": 2}, {"snippet": 2, "relevance": 9}]}`,
+	}}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+	}
+
+	reranker := butterfish.newReranker(&RerankOptions{})
+	scores, err := reranker.Rerank(context.Background(), "query", []string{"a", "b", "c"})
+	assert.Nil(t, err)
+	// the unrated snippet ranks last
+	assert.Equal(t, []float64{0.2, -1, 0.9}, scores)
+	assert.Equal(t, DefaultRerankModel, llm.requests[0].Model)
+	assert.Equal(t, float32(0), llm.requests[0].Temperature)
+}
@@ -0,0 +1,347 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Requests that fail with a rate limit, a server error, or a network timeout
+// are retried with an exponentially growing, jittered delay, or after the
+// delay the API asks for with a Retry-After header. How many times a request
+// is retried is set per feature by RequestLimits, the rest of the policy is
+// shared and can be changed with retry_policy in the config file.
+
+type RetryPolicy struct {
+	// Delay before the first retry, each one after waits Multiplier times
+	// longer, up to MaxDelay
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	Multiplier float64
+	// Fraction of each delay that's randomized, so that clients that failed
+	// together don't retry together, e.g. 0.2 is +/- 20%
+	Jitter float64
+	// HTTP status codes worth retrying
+	Statuses []int
+	// Retry network timeouts, not a request's own timeout
+	RetryTimeouts bool
+}
+
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		BaseDelay:     1600 * time.Millisecond,
+		MaxDelay:      time.Minute,
+		Multiplier:    1.6,
+		Jitter:        0.2,
+		Statuses:      []int{http.StatusRequestTimeout, http.StatusTooManyRequests, 500, 502, 503, 504},
+		RetryTimeouts: true,
+	}
+}
+
+// The retry policy in the config file, unset fields keep the defaults
+type RetryPolicyOverride struct {
+	BaseDelay     *time.Duration `yaml:"base_delay,omitempty"`
+	MaxDelay      *time.Duration `yaml:"max_delay,omitempty"`
+	Jitter        *float64       `yaml:"jitter,omitempty"`
+	Statuses      []int          `yaml:"statuses,omitempty"`
+	RetryTimeouts *bool          `yaml:"retry_timeouts,omitempty"`
+}
+
+func (this *RetryPolicyOverride) Validate() error {
+	if this.BaseDelay != nil && *this.BaseDelay < 0 {
+		return errors.New("base_delay can't be negative")
+	}
+	if this.MaxDelay != nil && *this.MaxDelay < 0 {
+		return errors.New("max_delay can't be negative")
+	}
+	if this.Jitter != nil && (*this.Jitter < 0 || *this.Jitter > 1) {
+		return errors.New("jitter must be between 0 and 1")
+	}
+	for _, status := range this.Statuses {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("%d isn't an HTTP status code", status)
+		}
+	}
+	return nil
+}
+
+// Apply the retry policy from the config file over the defaults
+func (this *ButterfishConfig) ApplyRetryPolicy(override *RetryPolicyOverride) {
+	if override == nil {
+		return
+	}
+	policy := *this.RetryPolicy
+	if override.BaseDelay != nil {
+		policy.BaseDelay = *override.BaseDelay
+	}
+	if override.MaxDelay != nil {
+		policy.MaxDelay = *override.MaxDelay
+	}
+	if override.Jitter != nil {
+		policy.Jitter = *override.Jitter
+	}
+	if override.Statuses != nil {
+		policy.Statuses = override.Statuses
+	}
+	if override.RetryTimeouts != nil {
+		policy.RetryTimeouts = *override.RetryTimeouts
+	}
+	this.RetryPolicy = &policy
+}
+
+// The HTTP status of an API error, 0 if there isn't one
+func errorStatus(err error) int {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode
+	}
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.HTTPStatusCode
+	}
+	return 0
+}
+
+// Whether an error is worth retrying under the policy
+func (this *RetryPolicy) Retryable(err error) bool {
+	if status := errorStatus(err); status != 0 {
+		return slices.Contains(this.Statuses, status)
+	}
+
+	var netErr net.Error
+	if this.RetryTimeouts && errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	// errors from other clients may only have the status in the message
+	return slices.Contains(this.Statuses, http.StatusTooManyRequests) &&
+		strings.Contains(err.Error(), "429")
+}
+
+// How long to wait before retry number attempt, counting from 0
+func (this *RetryPolicy) Delay(attempt int) time.Duration {
+	delay := float64(this.BaseDelay) * math.Pow(this.Multiplier, float64(attempt))
+	if this.MaxDelay > 0 {
+		delay = math.Min(delay, float64(this.MaxDelay))
+	}
+	delay *= 1 + this.Jitter*(2*rand.Float64()-1)
+	return time.Duration(delay)
+}
+
+// Whether an API error is worth retrying under the default policy
+func retryableError(err error) bool {
+	return DefaultRetryPolicy().Retryable(err)
+}
+
+// The transport records the Retry-After header of a failed response here, it
+// rides along in the request's context since the OpenAI client doesn't give
+// us the headers of errors
+type retryAfter struct {
+	mutex sync.Mutex
+	delay time.Duration
+}
+
+type retryAfterKey struct{}
+
+func (this *retryAfter) get() time.Duration {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.delay
+}
+
+func (this *retryAfter) set(delay time.Duration) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.delay = delay
+}
+
+// Parse a Retry-After header, either seconds or an HTTP date, or OpenAI's
+// retry-after-ms. Returns 0 if there isn't one.
+func parseRetryAfter(header http.Header, now time.Time) time.Duration {
+	if ms, err := strconv.ParseFloat(header.Get("Retry-After-Ms"), 64); err == nil && ms > 0 {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+	value := header.Get("Retry-After")
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// An http.RoundTripper that passes the Retry-After of error responses back
+// to the retry loop
+type retryAfterTransport struct {
+	base http.RoundTripper
+}
+
+func (this *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := this.base.RoundTrip(req)
+	if err != nil || resp.StatusCode < 400 {
+		return resp, err
+	}
+	if holder, ok := req.Context().Value(retryAfterKey{}).(*retryAfter); ok {
+		holder.set(parseRetryAfter(resp.Header, time.Now()))
+	}
+	return resp, err
+}
+
+// Call f, retrying up to the given number of times on errors the policy
+// allows, waiting for Retry-After if the API sent one and otherwise backing
+// off exponentially. A Retry-After longer than MaxDelay gives up. The context
+// passed to f carries the Retry-After. Returns the number of retries made.
+func (this *RetryPolicy) Do(
+	ctx context.Context,
+	retries int,
+	verbose bool,
+	f func(ctx context.Context) error,
+) (int, error) {
+	holder := &retryAfter{}
+	ctx = context.WithValue(ctx, retryAfterKey{}, holder)
+
+	for i := 0; ; i++ {
+		holder.set(0)
+		err := f(ctx)
+		if err == nil || !this.Retryable(err) || ctx.Err() != nil {
+			return i, err
+		}
+
+		if i >= retries {
+			if strings.Contains(err.Error(), "429") && retries > 0 {
+				return i, fmt.Errorf("Getting 429s from OpenAI API, this means you're hitting the rate limit, giving up after %d retries", i)
+			}
+			return i, err
+		}
+
+		delay := this.Delay(i)
+		reason := "backoff"
+		if after := holder.get(); after > 0 {
+			// e.g. a daily quota, not worth waiting for
+			if this.MaxDelay > 0 && after > this.MaxDelay {
+				return i, fmt.Errorf("%w, the API asked us to retry in %s, longer than the max_delay of %s", err, after, this.MaxDelay)
+			}
+			delay = after
+			reason = "Retry-After"
+		}
+		logRetry(i+1, retries, err, delay, reason, verbose)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return i, err
+		}
+	}
+}
+
+func logRetry(attempt, retries int, err error, delay time.Duration, reason string, verbose bool) {
+	if !verbose {
+		log.Printf("Request failed (%s), retrying in %s\n", err, delay)
+		return
+	}
+
+	PrintLoggingBox(LoggingBox{
+		Title:   fmt.Sprintf(" Retry %d of %d ", attempt, retries),
+		Content: fmt.Sprintf("error: %s\nwait:  %s (%s)", err, delay.Round(time.Millisecond), reason),
+		Color:   3,
+	})
+}
+
+// Embeddings are only used when indexing, which isn't latency sensitive
+const embeddingsRetries = 4
+
+// An LLM middleware that retries failed requests under the policy, the
+// number of retries comes from the request, see RequestLimits. The request's
+// hard timeout covers all of its retries.
+type RetryingLLM struct {
+	LLM    LLM
+	Policy *RetryPolicy
+}
+
+func NewRetryingLLM(llm LLM, policy *RetryPolicy) *RetryingLLM {
+	if policy == nil {
+		policy = DefaultRetryPolicy()
+	}
+	return &RetryingLLM{
+		LLM:    llm,
+		Policy: policy,
+	}
+}
+
+func (this *RetryingLLM) Unwrap() LLM {
+	return this.LLM
+}
+
+func (this *RetryingLLM) completion(
+	request *util.CompletionRequest,
+	call func(request *util.CompletionRequest) (*util.CompletionResponse, error),
+	canRetry func() bool,
+) (*util.CompletionResponse, error) {
+	request, cancel := withRequestTimeout(request)
+	defer cancel()
+	ctx := request.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	var response *util.CompletionResponse
+	// an error we can't retry even if the policy allows it
+	var finalErr error
+	retried, err := this.Policy.Do(ctx, request.Retries, request.Verbose, func(ctx context.Context) error {
+		attempt := *request
+		attempt.Ctx = ctx
+		var innerErr error
+		response, innerErr = call(&attempt)
+		if innerErr != nil && !canRetry() {
+			finalErr = innerErr
+			return nil
+		}
+		return innerErr
+	})
+	if finalErr != nil {
+		err = finalErr
+	}
+	if response != nil && response.Metrics != nil {
+		response.Metrics.Retries = retried
+	}
+	return response, timeoutError(request, err)
+}
+
+func (this *RetryingLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	// once part of an answer is shown we can't start over
+	tracker := &streamTracker{writer: writer}
+	return this.completion(request,
+		func(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+			return this.LLM.CompletionStream(request, tracker)
+		},
+		func() bool { return !tracker.wrote })
+}
+
+func (this *RetryingLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	return this.completion(request, this.LLM.Completion, func() bool { return true })
+}
+
+func (this *RetryingLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	var result [][]float32
+	_, err := this.Policy.Do(ctx, embeddingsRetries, verbose, func(ctx context.Context) error {
+		var innerErr error
+		result, innerErr = this.LLM.Embeddings(ctx, input, verbose)
+		return innerErr
+	})
+	return result, err
+}
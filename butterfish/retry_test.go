@@ -0,0 +1,133 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+)
+
+type netTimeout struct{}
+
+func (netTimeout) Error() string   { return "i/o timeout" }
+func (netTimeout) Timeout() bool   { return true }
+func (netTimeout) Temporary() bool { return true }
+
+func TestRetryable(t *testing.T) {
+	policy := DefaultRetryPolicy()
+	assert.True(t, policy.Retryable(&openai.APIError{HTTPStatusCode: 503}))
+	assert.True(t, policy.Retryable(fmt.Errorf("wrapped: %w", &openai.RequestError{HTTPStatusCode: 502})))
+	assert.False(t, policy.Retryable(&openai.APIError{HTTPStatusCode: 400}))
+	assert.True(t, policy.Retryable(errors.New("error, status code: 429")))
+	assert.True(t, policy.Retryable(netTimeout{}))
+	assert.False(t, policy.Retryable(errors.New("bad request")))
+
+	policy.RetryTimeouts = false
+	policy.Statuses = []int{429}
+	assert.False(t, policy.Retryable(netTimeout{}))
+	assert.False(t, policy.Retryable(&openai.APIError{HTTPStatusCode: 503}))
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := &RetryPolicy{BaseDelay: time.Second, MaxDelay: 3 * time.Second, Multiplier: 2}
+	assert.Equal(t, time.Second, policy.Delay(0))
+	assert.Equal(t, 2*time.Second, policy.Delay(1))
+	assert.Equal(t, 3*time.Second, policy.Delay(5))
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay := policy.Delay(0)
+		assert.True(t, delay >= 500*time.Millisecond && delay <= 1500*time.Millisecond)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	header := http.Header{}
+	assert.Equal(t, time.Duration(0), parseRetryAfter(header, now))
+
+	header.Set("Retry-After", "2")
+	assert.Equal(t, 2*time.Second, parseRetryAfter(header, now))
+
+	header.Set("Retry-After", now.Add(time.Minute).Format(http.TimeFormat))
+	assert.Equal(t, time.Minute, parseRetryAfter(header, now))
+
+	header.Set("Retry-After-Ms", "250")
+	assert.Equal(t, 250*time.Millisecond, parseRetryAfter(header, now))
+}
+
+func TestRetryPolicyHonorsRetryAfter(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		if requests == 1 {
+			w.Header().Set("Retry-After-Ms", "10")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"error": {"message": "overloaded", "type": "server_error"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"object": "list", "data": [{"object": "embedding", "index": 0, "embedding": [0.5]}]}`)
+	}))
+	defer server.Close()
+
+	// the backoff alone would wait an hour
+	policy := DefaultRetryPolicy()
+	policy.BaseDelay = time.Hour
+	policy.MaxDelay = 0
+	llm := NewRetryingLLM(NewGPT("token", server.URL), policy)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	embeddings, err := llm.Embeddings(ctx, []string{"text"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]float32{{0.5}}, embeddings)
+	assert.Equal(t, 2, requests)
+}
+
+func TestRetryPolicyGivesUpOnLongRetryAfter(t *testing.T) {
+	policy := DefaultRetryPolicy()
+	policy.MaxDelay = time.Second
+	calls := 0
+	retried, err := policy.Do(context.Background(), 3, false, func(ctx context.Context) error {
+		calls++
+		ctx.Value(retryAfterKey{}).(*retryAfter).set(time.Hour)
+		return &openai.APIError{HTTPStatusCode: 429, Message: "quota exceeded"}
+	})
+	assert.Equal(t, 0, retried)
+	assert.Equal(t, 1, calls)
+	assert.ErrorContains(t, err, "longer than the max_delay of 1s")
+}
+
+func TestApplyRetryPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`
+retry_policy:
+  max_delay: 30s
+  statuses: [429, 503]
+  retry_timeouts: false
+`), 0644)
+	assert.Nil(t, err)
+
+	configFile, err := LoadConfigFile(path)
+	assert.Nil(t, err)
+	config := MakeButterfishConfig()
+	config.ApplyRetryPolicy(configFile.RetryPolicy)
+	assert.Equal(t, 30*time.Second, config.RetryPolicy.MaxDelay)
+	assert.Equal(t, DefaultRetryPolicy().BaseDelay, config.RetryPolicy.BaseDelay)
+	assert.Equal(t, []int{429, 503}, config.RetryPolicy.Statuses)
+	assert.False(t, config.RetryPolicy.RetryTimeouts)
+
+	err = os.WriteFile(path, []byte("retry_policy:\n  jitter: 2\n"), 0644)
+	assert.Nil(t, err)
+	_, err = LoadConfigFile(path)
+	assert.ErrorContains(t, err, "jitter must be between 0 and 1")
+}
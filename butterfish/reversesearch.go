@@ -0,0 +1,96 @@
+package butterfish
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Ctrl-R starts the shell's own reverse history search, which redraws the
+// line in ways the command buffer can't follow. So from Ctrl-R we pass all
+// input straight to the shell and stop tracking the command, and show no
+// autosuggestions, until the user runs the command with enter or gives up
+// with Ctrl-C or Ctrl-G. On enter we read the command that was run off the
+// screen model so it still goes into the history, Ctrl-G gets back the
+// command that was being typed, like it does in the shell.
+
+const (
+	keyReverseSearch = 0x12 // ctrl-r
+	keyAbortSearch   = 0x07 // ctrl-g
+)
+
+// bash and readline show the match after the search string, e.g.
+// (reverse-i-search)`gi': git status
+var readlineSearchRegex = regexp.MustCompile("\\((?:failed )?(?:reverse-)?i-search\\)`[^']*': (.*)$")
+
+// zsh shows the search on its own line, e.g. bck-i-search: gi_
+var zshSearchRegex = regexp.MustCompile(`^(?:failing )?(?:bck|fwd)-i-search:`)
+
+// Start passing input through for the shell's history search, data starts
+// with Ctrl-R
+func (this *ShellState) ReverseSearchStart(data []byte) []byte {
+	this.ClearAutosuggest(this.Color.Command)
+	if this.AutosuggestCancel != nil {
+		this.AutosuggestCancel()
+	}
+
+	if this.Command == nil || this.State != stateShell {
+		this.Command = NewShellBuffer()
+	}
+	// where the command starts, to read it back later
+	this.ReverseSearchColumn = this.Screen.CursorColumn() -
+		(this.Command.Width() - this.Command.WidthAfterCursor())
+	this.ReverseSearchCommand = this.Command
+	this.Command = NewShellBuffer()
+	this.setState(stateReverseSearch)
+
+	this.ChildIn.Write(data[:1])
+	return data[1:]
+}
+
+func (this *ShellState) ReverseSearchInput(data []byte) []byte {
+	for i, b := range data {
+		switch b {
+		case '\r':
+			this.ChildIn.Write(data[:i+1])
+			this.setState(stateNormal)
+			command := searchedCommand(this.Screen.CursorLine(0),
+				this.Screen.CursorLine(this.ReverseSearchColumn))
+			if command != "" {
+				this.submitCommand(command)
+			}
+			return data[i+1:]
+
+		case 0x03:
+			this.ChildIn.Write(data[:i+1])
+			this.setState(stateNormal)
+			return data[i+1:]
+
+		case keyAbortSearch:
+			this.ChildIn.Write(data[:i+1])
+			this.Command = this.ReverseSearchCommand
+			if this.Command.Size() > 0 {
+				this.setState(stateShell)
+			} else {
+				this.setState(stateNormal)
+			}
+			return data[i+1:]
+		}
+	}
+
+	this.ChildIn.Write(data)
+	return nil
+}
+
+// The command run from a history search, given the line the cursor was on
+// and the same line from the column the command started in. That's either
+// the match in a readline search or the line from the column, empty if we
+// can't tell.
+func searchedCommand(line, fromColumn string) string {
+	if matches := readlineSearchRegex.FindStringSubmatch(line); matches != nil {
+		return strings.TrimSpace(matches[1])
+	}
+	if zshSearchRegex.MatchString(line) {
+		return ""
+	}
+	return strings.TrimSpace(fromColumn)
+}
@@ -0,0 +1,82 @@
+package butterfish
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func reverseSearchShell(prompt string) *ShellState {
+	state := &ShellState{
+		Butterfish: &ButterfishCtx{Config: MakeButterfishConfig()},
+		ParentOut:  new(bytes.Buffer),
+		ChildIn:    new(bytes.Buffer),
+		Color:      DarkShellColorScheme,
+		State:      stateNormal,
+		Command:    NewShellBuffer(),
+		History:    NewShellHistory(),
+		Screen:     NewScreen(60, 5),
+		Excluder:   NewCommandExcluder(DefaultShellExcludeCommands),
+	}
+	state.Screen.Write([]byte(prompt))
+	return state
+}
+
+func TestReverseSearchReadline(t *testing.T) {
+	state := reverseSearchShell("$ ")
+	childIn := state.ChildIn.(*bytes.Buffer)
+
+	state.ParentInput(nil, []byte{keyReverseSearch})
+	assert.Equal(t, stateReverseSearch, state.State)
+
+	// typing goes to the shell without being tracked as a command
+	state.ParentInput(nil, []byte("gi"))
+	assert.Equal(t, "", state.Command.String())
+	state.Screen.Write([]byte("\r(reverse-i-search)`gi': git status"))
+
+	leftover := state.ParentInput(nil, []byte("\rls"))
+	assert.Equal(t, []byte("ls"), leftover)
+	assert.Equal(t, stateNormal, state.State)
+	assert.Equal(t, "\x12gi\r", childIn.String())
+
+	command, _ := state.History.LastCommand()
+	assert.Equal(t, "git status", command.Content.String())
+}
+
+func TestReverseSearchZsh(t *testing.T) {
+	state := reverseSearchShell("% ")
+	state.ParentInput(nil, []byte{keyReverseSearch})
+	state.ParentInput(nil, []byte("gi"))
+	state.Screen.Write([]byte("git status\r\nbck-i-search: gi_\x1b[A\r\x1b[6C"))
+
+	state.ParentInput(nil, []byte("\r"))
+	command, _ := state.History.LastCommand()
+	assert.Equal(t, "git status", command.Content.String())
+}
+
+func TestReverseSearchAbort(t *testing.T) {
+	state := reverseSearchShell("$ ")
+	state.ParentInput(nil, []byte("ls -l"))
+	assert.Equal(t, stateShell, state.State)
+
+	// ctrl-g goes back to the command being typed
+	state.ParentInput(nil, []byte{keyReverseSearch})
+	state.ParentInput(nil, []byte("xyz"))
+	state.ParentInput(nil, []byte{keyAbortSearch})
+	assert.Equal(t, stateShell, state.State)
+	assert.Equal(t, "ls -l", state.Command.String())
+
+	// ctrl-c drops it
+	state.ParentInput(nil, []byte{keyReverseSearch})
+	state.ParentInput(nil, []byte{0x03})
+	assert.Equal(t, stateNormal, state.State)
+	assert.Empty(t, state.History.Blocks)
+}
+
+func TestSearchedCommand(t *testing.T) {
+	assert.Equal(t, "make test", searchedCommand("(reverse-i-search)`ma': make test", ""))
+	assert.Equal(t, "", searchedCommand("(failed reverse-i-search)`zz': ", ""))
+	assert.Equal(t, "", searchedCommand("bck-i-search: ma_", "search: ma_"))
+	assert.Equal(t, "make test", searchedCommand("~/src $ make test", "make test"))
+}
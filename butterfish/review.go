@@ -0,0 +1,320 @@
+package butterfish
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sashabaranov/go-openai/jsonschema"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// The review command splits a diff into chunks that fit a token budget, per
+// file and then per hunk for large files, and asks the model for structured
+// review comments on each chunk. Lines in the diff are numbered with their
+// line in the new file so that comments can point at them. Comments are
+// printed as each chunk is reviewed, or as JSON at the end with --json.
+
+type ReviewComment struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Severity string `json:"severity"`
+	Comment  string `json:"comment"`
+}
+
+const (
+	SeverityInfo    = "info"
+	SeverityWarning = "warning"
+	SeverityError   = "error"
+)
+
+var reviewSeverities = []string{SeverityInfo, SeverityWarning, SeverityError}
+
+func severityRank(severity string) int {
+	for i, s := range reviewSeverities {
+		if s == severity {
+			return i
+		}
+	}
+	return -1
+}
+
+var hunkHeaderRegex = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)`)
+
+// Prefix added and context lines with their line number in the new file
+func numberDiffLines(diff string) string {
+	builder := strings.Builder{}
+	line := 0
+	inHunk := false
+
+	for _, text := range strings.SplitAfter(diff, "\n") {
+		if text == "" {
+			continue
+		}
+		if match := hunkHeaderRegex.FindStringSubmatch(text); match != nil {
+			line, _ = strconv.Atoi(match[1])
+			inHunk = true
+			builder.WriteString(text)
+			continue
+		}
+		if !inHunk {
+			builder.WriteString(text)
+			continue
+		}
+
+		switch text[0] {
+		case '+', ' ':
+			fmt.Fprintf(&builder, "%5d %s", line, text)
+			line++
+		default:
+			fmt.Fprintf(&builder, "      %s", text)
+		}
+	}
+
+	return builder.String()
+}
+
+// Split a file's diff into its header and hunks
+func splitDiffHunks(file string) (string, []string) {
+	parts := strings.Split(file, "\n@@ ")
+	header := parts[0] + "\n"
+	hunks := []string{}
+	for _, hunk := range parts[1:] {
+		hunks = append(hunks, "@@ "+hunk+"\n")
+	}
+	if len(hunks) > 0 {
+		last := len(hunks) - 1
+		hunks[last] = strings.TrimSuffix(hunks[last], "\n")
+	}
+	return header, hunks
+}
+
+// Split a diff into chunks of about tokenBudget tokens. Small files are
+// grouped together, files over the budget are split on hunks with the file
+// header repeated in each chunk. A single hunk over the budget is sent whole.
+func reviewChunks(diff string, tokenBudget int) []string {
+	chunks := []string{}
+	current := strings.Builder{}
+	flush := func() {
+		if current.Len() > 0 {
+			chunks = append(chunks, current.String())
+			current.Reset()
+		}
+	}
+
+	for _, file := range splitDiffFiles(diff) {
+		if strings.TrimSpace(file) == "" {
+			continue
+		}
+		if estimateTokens(file) <= tokenBudget {
+			if estimateTokens(current.String())+estimateTokens(file) > tokenBudget {
+				flush()
+			}
+			current.WriteString(file)
+			continue
+		}
+
+		flush()
+		header, hunks := splitDiffHunks(file)
+		current.WriteString(header)
+		for _, hunk := range hunks {
+			if current.Len() > len(header) &&
+				estimateTokens(current.String())+estimateTokens(hunk) > tokenBudget {
+				flush()
+				current.WriteString(header)
+			}
+			current.WriteString(hunk)
+		}
+		flush()
+	}
+	flush()
+
+	return chunks
+}
+
+func reviewCommentsSchema() jsonschema.Definition {
+	comment := jsonschema.Definition{
+		Type: jsonschema.Object,
+		Properties: map[string]jsonschema.Definition{
+			"file":     {Type: jsonschema.String, Description: "Path of the file in the new version"},
+			"line":     {Type: jsonschema.Integer, Description: "Line number in the new file, 0 if the comment is about the whole file"},
+			"severity": {Type: jsonschema.String, Enum: reviewSeverities},
+			"comment":  {Type: jsonschema.String},
+		},
+		Required:             []string{"file", "line", "severity", "comment"},
+		AdditionalProperties: false,
+	}
+
+	return jsonschema.Definition{
+		Type: jsonschema.Object,
+		Properties: map[string]jsonschema.Definition{
+			"comments": {Type: jsonschema.Array, Items: &comment},
+		},
+		Required:             []string{"comments"},
+		AdditionalProperties: false,
+	}
+}
+
+// Review a unified diff, calling onComments with the comments for each chunk
+// as it's reviewed. Returns all comments.
+func (this *ButterfishCtx) ReviewDiff(
+	diff, model string,
+	numTokens, chunkTokens int,
+	onComments func([]*ReviewComment) error,
+) ([]*ReviewComment, error) {
+	chunks := reviewChunks(numberDiffLines(diff), chunkTokens)
+	if len(chunks) == 0 {
+		return nil, errors.New("The diff is empty, nothing to review")
+	}
+
+	sysMsg, err := this.PromptLibrary.GetPrompt(prompt.PromptSystemMessage)
+	if err != nil {
+		return nil, err
+	}
+	schema := reviewCommentsSchema()
+	schemaJson, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	all := []*ReviewComment{}
+	for _, chunk := range chunks {
+		reviewPrompt, err := this.PromptLibrary.GetPromptForModel(prompt.PromptReviewDiff, model,
+			"diff", chunk)
+		if err != nil {
+			return nil, err
+		}
+
+		req := &util.CompletionRequest{
+			Ctx:           this.Ctx,
+			Prompt:        reviewPrompt,
+			Model:         model,
+			MaxTokens:     numTokens,
+			Temperature:   0,
+			SystemMessage: sysMsg,
+			Verbose:       this.Config.Verbose > 0,
+			TokenTimeout:  this.Config.TokenTimeout,
+			JSONSchema:    json.RawMessage(schemaJson),
+		}
+		this.Config.LimitRequest(FeaturePrompt, req)
+
+		output, err := this.structuredCompletion(req, schema, 2)
+		if err != nil {
+			return nil, err
+		}
+
+		result := struct {
+			Comments []*ReviewComment `json:"comments"`
+		}{}
+		err = json.Unmarshal([]byte(output), &result)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, comment := range result.Comments {
+			comment.Severity = strings.ToLower(comment.Severity)
+			if severityRank(comment.Severity) < 0 {
+				comment.Severity = SeverityInfo
+			}
+		}
+		sort.SliceStable(result.Comments, func(i, j int) bool {
+			a, b := result.Comments[i], result.Comments[j]
+			if a.File != b.File {
+				return a.File < b.File
+			}
+			return a.Line < b.Line
+		})
+
+		if onComments != nil {
+			err = onComments(result.Comments)
+			if err != nil {
+				return nil, err
+			}
+		}
+		all = append(all, result.Comments...)
+	}
+
+	return all, nil
+}
+
+func (this *ButterfishCtx) PrintReviewComment(comment *ReviewComment) {
+	location := comment.File
+	if comment.Line > 0 {
+		location = fmt.Sprintf("%s:%d", comment.File, comment.Line)
+	}
+
+	style := this.Config.Styles.Grey
+	switch comment.Severity {
+	case SeverityError:
+		style = this.Config.Styles.Error
+	case SeverityWarning:
+		style = this.Config.Styles.Question
+	}
+
+	this.StylePrintf(this.Config.Styles.Highlight, "%s ", location)
+	this.StylePrintf(style, "[%s]\n", comment.Severity)
+	this.Printf("  %s\n\n", strings.ReplaceAll(strings.TrimSpace(comment.Comment), "\n", "\n  "))
+}
+
+func (this *ButterfishCtx) reviewCommand(options *CliCommandConfig) error {
+	opts := options.Review
+
+	var diff string
+	if opts.Range != "" {
+		var err error
+		diff, err = runGit(this.Ctx, "diff", opts.Range)
+		if err != nil {
+			return err
+		}
+	} else {
+		diff = this.getPipedStdin()
+	}
+	if strings.TrimSpace(diff) == "" {
+		return errors.New("Please provide a ref range like main..HEAD or pipe in a unified diff")
+	}
+
+	var printComments func([]*ReviewComment) error
+	if !opts.Json {
+		printComments = func(comments []*ReviewComment) error {
+			for _, comment := range comments {
+				this.PrintReviewComment(comment)
+			}
+			return nil
+		}
+	}
+
+	comments, err := this.ReviewDiff(diff, opts.Model, opts.NumTokens, opts.ChunkTokens, printComments)
+	if err != nil {
+		return err
+	}
+
+	if opts.Json {
+		output, err := json.MarshalIndent(map[string]any{"comments": comments}, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(this.Out, "%s\n", output)
+	} else if len(comments) == 0 {
+		this.StylePrintf(this.Config.Styles.Answer, "No comments\n")
+	}
+
+	if opts.FailOn == "none" {
+		return nil
+	}
+	failing := 0
+	for _, comment := range comments {
+		if severityRank(comment.Severity) >= severityRank(opts.FailOn) {
+			failing++
+		}
+	}
+	if failing > 0 {
+		return fmt.Errorf("Review found %d comments at severity %s or above", failing, opts.FailOn)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package butterfish
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testReviewDiff = `diff --git a/a.go b/a.go
+index 1..2 100644
+--- a/a.go
++++ b/a.go
+@@ -10,3 +10,3 @@ func a() {
+ 	x := 1
+-	y := 2
++	y := 3
+ 	return x + y
+@@ -40,2 +40,3 @@ func b() {
+ 	z := 1
++	z++
+ 	return z
+`
+
+func TestNumberDiffLines(t *testing.T) {
+	numbered := numberDiffLines(testReviewDiff)
+	assert.Contains(t, numbered, "+++ b/a.go\n@@ -10,3")
+	assert.Contains(t, numbered, "   10  \tx := 1\n      -\ty := 2\n   11 +\ty := 3\n   12  \treturn x + y\n")
+	assert.Contains(t, numbered, "   41 +\tz++\n")
+}
+
+func TestReviewChunks(t *testing.T) {
+	diff := testReviewDiff + strings.Replace(testReviewDiff, "a.go", "b.go", -1)
+
+	// both files fit in one chunk
+	chunks := reviewChunks(diff, 1000)
+	assert.Equal(t, []string{diff}, chunks)
+
+	// one file per chunk
+	chunks = reviewChunks(diff, 60)
+	assert.Equal(t, 2, len(chunks))
+	assert.True(t, strings.HasPrefix(chunks[1], "diff --git a/b.go"))
+
+	// one hunk per chunk, with the file header repeated
+	chunks = reviewChunks(diff, 30)
+	assert.Equal(t, 4, len(chunks))
+	for _, chunk := range chunks {
+		assert.True(t, strings.HasPrefix(chunk, "diff --git"))
+		assert.Equal(t, 1, strings.Count(chunk, "\n@@ "))
+	}
+	assert.Contains(t, chunks[1], "z++")
+}
+
+func TestReviewDiff(t *testing.T) {
+	llm := &scriptedLLM{responses: []string{
+		`{"comments": [
+			{"file": "a.go", "line": 11, "severity": "Warning", "comment": "Why 3?"},
+			{"file": "a.go", "line": 0, "severity": "critical", "comment": "Needs tests"}
+		]}`,
+	}}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+	}
+
+	streamed := 0
+	comments, err := butterfish.ReviewDiff(testReviewDiff, "gpt-4o", 100, 30,
+		func(comments []*ReviewComment) error {
+			streamed += len(comments)
+			return nil
+		})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(llm.requests))
+	assert.Equal(t, 4, len(comments))
+	assert.Equal(t, 4, streamed)
+	assert.Contains(t, llm.requests[0].Prompt, "   11 +\ty := 3")
+	assert.NotNil(t, llm.requests[0].JSONSchema)
+
+	// sorted by line, severities normalized
+	assert.Equal(t, 0, comments[0].Line)
+	assert.Equal(t, SeverityInfo, comments[0].Severity)
+	assert.Equal(t, SeverityWarning, comments[1].Severity)
+
+	_, err = butterfish.ReviewDiff("", "gpt-4o", 100, 30, nil)
+	assert.NotNil(t, err)
+}
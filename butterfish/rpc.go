@@ -0,0 +1,382 @@
+package butterfish
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// RPC mode, started with `butterfish rpc`, lets other programs embed
+// Butterfish as a long-running subprocess. It speaks JSON-RPC 2.0 over stdio,
+// one JSON object per line in each direction. Requests are handled in order,
+// one at a time. Anything that isn't a response (progress output, logging)
+// goes to stderr so that stdout only ever contains responses.
+//
+// Methods:
+//
+//	complete      {"prompt", "system_message"?, "model"?, "max_tokens"?, "temperature"?}
+//	              -> {"completion"}
+//	summarize     {"content"} or {"path"}, and "max_chunks"?
+//	              -> {"summary"}
+//	gencmd        {"prompt"}
+//	              -> {"command"}
+//	index.search  {"query", "results"?, "paths"?}
+//	              -> {"results": [{"path", "score", "content"}]}
+//
+// Example:
+//
+//	> {"jsonrpc": "2.0", "id": 1, "method": "gencmd", "params": {"prompt": "list files by size"}}
+//	< {"jsonrpc":"2.0","id":1,"result":{"command":"ls -lS"}}
+
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcServerError    = -32000
+)
+
+type RPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (this *RPCError) Error() string {
+	return this.Message
+}
+
+type RPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+// Defaults used when a request doesn't specify them
+type RPCOptions struct {
+	Model       string
+	NumTokens   int
+	Temperature float32
+}
+
+type rpcCompleteParams struct {
+	Prompt        string   `json:"prompt"`
+	SystemMessage string   `json:"system_message"`
+	Model         string   `json:"model"`
+	MaxTokens     int      `json:"max_tokens"`
+	Temperature   *float32 `json:"temperature"`
+}
+
+type rpcSummarizeParams struct {
+	Content string `json:"content"`
+	Path    string `json:"path"`
+	// Chunks to read, 0 means the whole document
+	MaxChunks int `json:"max_chunks"`
+}
+
+type rpcGencmdParams struct {
+	Prompt string `json:"prompt"`
+}
+
+type rpcIndexSearchParams struct {
+	Query   string   `json:"query"`
+	Results int      `json:"results"`
+	Paths   []string `json:"paths"`
+}
+
+type rpcIndexSearchResult struct {
+	Path    string  `json:"path"`
+	Score   float64 `json:"score"`
+	Content string  `json:"content"`
+}
+
+type RPCServer struct {
+	Butterfish *ButterfishCtx
+	Options    *RPCOptions
+	out        io.Writer
+}
+
+func NewRPCServer(butterfish *ButterfishCtx, options *RPCOptions, out io.Writer) *RPCServer {
+	return &RPCServer{
+		Butterfish: butterfish,
+		Options:    options,
+		out:        out,
+	}
+}
+
+// Read requests from the reader until EOF or the context is cancelled
+func (this *RPCServer) Serve(in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		if this.Butterfish.Ctx.Err() != nil {
+			return nil
+		}
+
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		response := this.HandleLine(line)
+		if response != nil {
+			err := this.write(response)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Handle a single line of input, returns nil for notifications (requests
+// without an id) since those don't get a response.
+func (this *RPCServer) HandleLine(line []byte) *RPCResponse {
+	var request RPCRequest
+	err := json.Unmarshal(line, &request)
+	if err != nil {
+		return rpcErrorResponse(nil, rpcParseError, fmt.Sprintf("Parse error: %s", err))
+	}
+	if request.JSONRPC != "2.0" || request.Method == "" {
+		return rpcErrorResponse(request.ID, rpcInvalidRequest, "Invalid request, expected jsonrpc 2.0 and a method")
+	}
+
+	log.Printf("RPC request %s %s", request.Method, string(request.ID))
+	result, err := this.dispatch(&request)
+
+	if request.ID == nil {
+		if err != nil {
+			log.Printf("RPC notification %s failed: %s", request.Method, err)
+		}
+		return nil
+	}
+
+	if err != nil {
+		var rpcErr *RPCError
+		if errors.As(err, &rpcErr) {
+			return rpcErrorResponse(request.ID, rpcErr.Code, rpcErr.Message)
+		}
+		return rpcErrorResponse(request.ID, rpcServerError, err.Error())
+	}
+
+	return &RPCResponse{
+		JSONRPC: "2.0",
+		ID:      request.ID,
+		Result:  result,
+	}
+}
+
+func rpcErrorResponse(id json.RawMessage, code int, message string) *RPCResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &RPCResponse{
+		JSONRPC: "2.0",
+		ID:      id,
+		Error:   &RPCError{Code: code, Message: message},
+	}
+}
+
+func (this *RPCServer) write(response *RPCResponse) error {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	_, err = this.out.Write(append(data, '\n'))
+	return err
+}
+
+func parseRPCParams(raw json.RawMessage, params any) error {
+	if len(raw) == 0 {
+		return &RPCError{Code: rpcInvalidParams, Message: "Missing params"}
+	}
+	err := json.Unmarshal(raw, params)
+	if err != nil {
+		return &RPCError{Code: rpcInvalidParams, Message: fmt.Sprintf("Invalid params: %s", err)}
+	}
+	return nil
+}
+
+func (this *RPCServer) dispatch(request *RPCRequest) (any, error) {
+	switch request.Method {
+	case "complete":
+		var params rpcCompleteParams
+		if err := parseRPCParams(request.Params, &params); err != nil {
+			return nil, err
+		}
+		return this.complete(&params)
+
+	case "summarize":
+		var params rpcSummarizeParams
+		if err := parseRPCParams(request.Params, &params); err != nil {
+			return nil, err
+		}
+		return this.summarize(&params)
+
+	case "gencmd":
+		var params rpcGencmdParams
+		if err := parseRPCParams(request.Params, &params); err != nil {
+			return nil, err
+		}
+		return this.gencmd(&params)
+
+	case "index.search":
+		var params rpcIndexSearchParams
+		if err := parseRPCParams(request.Params, &params); err != nil {
+			return nil, err
+		}
+		return this.indexSearch(&params)
+
+	default:
+		return nil, &RPCError{Code: rpcMethodNotFound, Message: fmt.Sprintf("Method not found: %s", request.Method)}
+	}
+}
+
+func (this *RPCServer) complete(params *rpcCompleteParams) (any, error) {
+	request, err := this.completionRequest(params)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := this.Butterfish.LLMClient.Completion(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.Refusal != "" {
+		return nil, errors.New(response.RefusalMessage())
+	}
+	return map[string]string{"completion": response.Completion}, nil
+}
+
+// Build a completion request from the params, falling back to the server's
+// defaults
+func (this *RPCServer) completionRequest(params *rpcCompleteParams) (*util.CompletionRequest, error) {
+	if params.Prompt == "" {
+		return nil, &RPCError{Code: rpcInvalidParams, Message: "Missing prompt"}
+	}
+
+	model := this.Options.Model
+	if params.Model != "" {
+		model = params.Model
+	}
+
+	sysMsg := params.SystemMessage
+	if sysMsg == "" {
+		var err error
+		sysMsg, err = this.Butterfish.PromptLibrary.GetPromptForModel(prompt.PromptSystemMessage, model)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	request := &util.CompletionRequest{
+		Ctx:           this.Butterfish.Ctx,
+		Prompt:        params.Prompt,
+		Model:         model,
+		MaxTokens:     this.Options.NumTokens,
+		Temperature:   this.Options.Temperature,
+		SystemMessage: sysMsg,
+		Verbose:       this.Butterfish.Config.Verbose > 0,
+		TokenTimeout:  this.Butterfish.Config.TokenTimeout,
+	}
+	this.Butterfish.Config.LimitRequest(FeaturePrompt, request)
+	if params.MaxTokens > 0 {
+		request.MaxTokens = params.MaxTokens
+	}
+	if params.Temperature != nil {
+		request.Temperature = *params.Temperature
+	}
+	return request, nil
+}
+
+func (this *RPCServer) gencmd(params *rpcGencmdParams) (any, error) {
+	if params.Prompt == "" {
+		return nil, &RPCError{Code: rpcInvalidParams, Message: "Missing prompt"}
+	}
+	cmd, err := this.Butterfish.GenerateCommand(params.Prompt)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"command": strings.TrimSpace(cmd)}, nil
+}
+
+func (this *RPCServer) summarize(params *rpcSummarizeParams) (any, error) {
+	var chunks [][]byte
+	var err error
+	maxChunks := UnlimitedChunks(params.MaxChunks)
+
+	switch {
+	case params.Content != "":
+		chunks, err = util.GetChunks(strings.NewReader(params.Content), DefaultSummarizeChunkSize, maxChunks)
+	case params.Path != "":
+		chunks, err = util.GetFileChunks(this.Butterfish.Ctx, afero.NewOsFs(), params.Path, DefaultSummarizeChunkSize, maxChunks)
+	default:
+		return nil, &RPCError{Code: rpcInvalidParams, Message: "Provide either content or path"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := new(bytes.Buffer)
+	err = this.Butterfish.WriteSummary(chunks, buffer)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"summary": strings.TrimSpace(buffer.String())}, nil
+}
+
+func (this *RPCServer) indexSearch(params *rpcIndexSearchParams) (any, error) {
+	if params.Query == "" {
+		return nil, &RPCError{Code: rpcInvalidParams, Message: "Missing query"}
+	}
+	numResults := params.Results
+	if numResults <= 0 {
+		numResults = 5
+	}
+
+	err := this.Butterfish.initVectorIndex(params.Paths)
+	if err != nil {
+		return nil, err
+	}
+	if len(params.Paths) > 0 {
+		err = this.Butterfish.VectorIndex.LoadPaths(this.Butterfish.Ctx, params.Paths)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	results, err := this.Butterfish.VectorIndex.Search(this.Butterfish.Ctx, params.Query, numResults)
+	if err != nil {
+		return nil, err
+	}
+
+	output := []rpcIndexSearchResult{}
+	for _, result := range results {
+		output = append(output, rpcIndexSearchResult{
+			Path:    result.FilePath,
+			Score:   result.Score,
+			Content: result.Content,
+		})
+	}
+	return map[string]any{"results": output}, nil
+}
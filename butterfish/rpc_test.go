@@ -0,0 +1,131 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+type echoLLM struct {
+	mutex    sync.Mutex
+	requests []*util.CompletionRequest
+}
+
+func (this *echoLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	response, err := this.Completion(request)
+	writer.Write([]byte(response.Completion))
+	return response, err
+}
+
+func (this *echoLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.requests = append(this.requests, request)
+	return &util.CompletionResponse{Completion: "echo: " + request.Prompt}, nil
+}
+
+func (this *echoLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	return nil, nil
+}
+
+type namePromptLibrary struct{}
+
+func (this *namePromptLibrary) GetPrompt(name string, args ...string) (string, error) {
+	return name + " " + strings.Join(args, " "), nil
+}
+
+func (this *namePromptLibrary) GetPromptForModel(name, model string, args ...string) (string, error) {
+	return this.GetPrompt(name, args...)
+}
+
+func (this *namePromptLibrary) GetUninterpolatedPrompt(name string) (string, error) {
+	return name, nil
+}
+
+func (this *namePromptLibrary) GetUninterpolatedPromptForModel(name, model string) (string, error) {
+	return name, nil
+}
+
+func (this *namePromptLibrary) InterpolatePrompt(prompt string, args ...string) (string, error) {
+	return prompt, nil
+}
+
+func TestRPCServer(t *testing.T) {
+	llm := &echoLLM{}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+	}
+	out := new(bytes.Buffer)
+	server := NewRPCServer(butterfish, &RPCOptions{Model: "gpt-4o", NumTokens: 100}, out)
+
+	input := strings.Join([]string{
+		`{"jsonrpc": "2.0", "id": 1, "method": "complete", "params": {"prompt": "hi", "max_tokens": 5}}`,
+		`{"jsonrpc": "2.0", "id": "two", "method": "nope"}`,
+		`{"jsonrpc": "2.0", "method": "complete", "params": {"prompt": "notification"}}`,
+		`not json`,
+		`{"jsonrpc": "2.0", "id": 3, "method": "gencmd", "params": {}}`,
+	}, "\n")
+
+	assert.Nil(t, server.Serve(strings.NewReader(input)))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, 4, len(lines))
+
+	var response map[string]any
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &response))
+	assert.Equal(t, float64(1), response["id"])
+	assert.Equal(t, "echo: hi", response["result"].(map[string]any)["completion"])
+
+	assert.Contains(t, lines[1], `"id":"two"`)
+	assert.Contains(t, lines[1], `"code":-32601`)
+	assert.Contains(t, lines[2], `"id":null`)
+	assert.Contains(t, lines[2], `"code":-32700`)
+	assert.Contains(t, lines[3], `"code":-32602`)
+
+	// the notification is still executed, and defaults fill in for the
+	// first request
+	assert.Equal(t, 2, len(llm.requests))
+	assert.Equal(t, "gpt-4o", llm.requests[0].Model)
+	assert.Equal(t, 5, llm.requests[0].MaxTokens)
+}
+
+func TestRPCSummarizeLongContent(t *testing.T) {
+	llm := &echoLLM{}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+	}
+	server := NewRPCServer(butterfish, &RPCOptions{Model: "gpt-4o", NumTokens: 100}, io.Discard)
+
+	// about 9 chunks of 3600 bytes, more than the old cutoff of 8
+	content := strings.Repeat(strings.Repeat("x", 99)+"\n", 9*36) + "the end\n"
+	_, err := server.summarize(&rpcSummarizeParams{Content: content})
+	assert.Nil(t, err)
+
+	prompts := []string{}
+	for _, request := range llm.requests {
+		prompts = append(prompts, request.Prompt)
+	}
+	assert.Contains(t, strings.Join(prompts, "\n"), "the end")
+
+	// max_chunks still caps what's read
+	llm.requests = nil
+	_, err = server.summarize(&rpcSummarizeParams{Content: content, MaxChunks: 2})
+	assert.Nil(t, err)
+	for _, request := range llm.requests {
+		assert.NotContains(t, request.Prompt, "the end")
+	}
+}
@@ -0,0 +1,556 @@
+package butterfish
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/mattn/go-runewidth"
+)
+
+// A Screen is a small terminal emulator that keeps a model of what the child
+// shell has drawn, so that snap can show the LLM what the user is looking at.
+// It understands cursor movement, erasing, scroll regions and the alternate
+// screen, which covers most TUIs, and ignores colors and other attributes.
+//
+// The shell history renders command output through a Screen too, so that
+// progress bars, redraws, and whatever a TUI drew on the alternate screen
+// leave only the text that was left in the terminal. That screen keeps the
+// lines that scroll off the top, see newOutputScreen.
+
+const (
+	screenStateGround = iota
+	screenStateEscape
+	screenStateCSI
+	screenStateOSC
+	screenStateOSCEscape
+	screenStateCharset
+)
+
+// marks the cell covered by the right half of a wide character
+const screenWideFiller = -1
+
+type Screen struct {
+	mutex  sync.Mutex
+	width  int
+	height int
+
+	main      [][]rune
+	alt       [][]rune
+	alternate bool
+
+	row, col int
+	// set after writing to the last column, the next character wraps
+	wrapNext bool
+	savedRow int
+	savedCol int
+
+	// scroll region, inclusive
+	top    int
+	bottom int
+
+	// lines scrolled off the top of the main screen, if kept
+	scrollback     []string
+	keepScrollback bool
+	// line feeds also return to the first column
+	newlineMode bool
+	// characters are drawn as spaces, see WriteHidden
+	hidden bool
+
+	state   int
+	params  []byte
+	utf8Buf []byte
+}
+
+func NewScreen(width, height int) *Screen {
+	width, height = max(width, 1), max(height, 1)
+	return &Screen{
+		width:  width,
+		height: height,
+		main:   newScreenLines(width, height),
+		alt:    newScreenLines(width, height),
+		bottom: height - 1,
+	}
+}
+
+// A screen for rendering command output, it keeps all the lines that scroll
+// off and, since output may also come from Go strings, treats \n as \r\n
+func newOutputScreen(width, height int) *Screen {
+	screen := NewScreen(width, height)
+	screen.keepScrollback = true
+	screen.newlineMode = true
+	return screen
+}
+
+func newScreenLines(width, height int) [][]rune {
+	lines := make([][]rune, height)
+	for i := range lines {
+		lines[i] = newScreenLine(width)
+	}
+	return lines
+}
+
+func newScreenLine(width int) []rune {
+	line := make([]rune, width)
+	for i := range line {
+		line[i] = ' '
+	}
+	return line
+}
+
+func (this *Screen) Size() (int, int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.width, this.height
+}
+
+func (this *Screen) lines() [][]rune {
+	if this.alternate {
+		return this.alt
+	}
+	return this.main
+}
+
+// Resize keeps the bottom of the screen, like a terminal shrinking under a
+// shell prompt
+func (this *Screen) Resize(width, height int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	width, height = max(width, 1), max(height, 1)
+	if width == this.width && height == this.height {
+		return
+	}
+
+	resize := func(lines [][]rune) [][]rune {
+		// drop lines from the top, or add empty ones at the bottom
+		if len(lines) > height {
+			lines = lines[len(lines)-height:]
+		}
+		for len(lines) < height {
+			lines = append(lines, newScreenLine(width))
+		}
+		for i, line := range lines {
+			newLine := newScreenLine(width)
+			copy(newLine, line)
+			lines[i] = newLine
+		}
+		return lines
+	}
+
+	shift := max(this.height-height, 0)
+	this.main = resize(this.main)
+	this.alt = resize(this.alt)
+	this.width, this.height = width, height
+	this.row = min(max(this.row-shift, 0), height-1)
+	this.col = min(this.col, width-1)
+	this.wrapNext = false
+	this.top, this.bottom = 0, height-1
+}
+
+func (this *Screen) Write(p []byte) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for _, b := range p {
+		this.writeByte(b)
+	}
+	return len(p), nil
+}
+
+// Write output that shouldn't be readable from the screen, like the output of
+// an excluded command. Cursor movement and erasing still apply, so that the
+// output after it lands in the right place, but its text is drawn as spaces.
+func (this *Screen) WriteHidden(p []byte) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.hidden = true
+	for _, b := range p {
+		this.writeByte(b)
+	}
+	this.hidden = false
+	return len(p), nil
+}
+
+func (this *Screen) writeByte(b byte) {
+	switch this.state {
+	case screenStateEscape:
+		this.escape(b)
+		return
+
+	case screenStateCSI:
+		if b >= 0x40 && b <= 0x7e {
+			this.csi(string(this.params), b)
+			this.params = this.params[:0]
+			this.state = screenStateGround
+		} else if len(this.params) < 64 {
+			this.params = append(this.params, b)
+		}
+		return
+
+	case screenStateOSC:
+		// terminated by BEL or ST (ESC \)
+		if b == '\a' {
+			this.state = screenStateGround
+		} else if b == 0x1b {
+			this.state = screenStateOSCEscape
+		}
+		return
+
+	case screenStateOSCEscape:
+		this.state = screenStateGround
+		return
+
+	case screenStateCharset:
+		this.state = screenStateGround
+		return
+	}
+
+	// a multibyte character in progress
+	if len(this.utf8Buf) > 0 || b >= 0x80 {
+		this.utf8Buf = append(this.utf8Buf, b)
+		if !utf8.FullRune(this.utf8Buf) {
+			return
+		}
+		r, _ := utf8.DecodeRune(this.utf8Buf)
+		this.utf8Buf = this.utf8Buf[:0]
+		this.put(r)
+		return
+	}
+
+	switch b {
+	case 0x1b:
+		this.state = screenStateEscape
+	case '\r':
+		this.col = 0
+		this.wrapNext = false
+	case '\n', '\v', '\f':
+		if this.newlineMode {
+			this.col = 0
+		}
+		this.lineFeed()
+	case '\b':
+		if this.col > 0 {
+			this.col--
+		}
+		this.wrapNext = false
+	case '\t':
+		this.col = min((this.col/8+1)*8, this.width-1)
+	default:
+		if b >= 0x20 && b != 0x7f {
+			this.put(rune(b))
+		}
+	}
+}
+
+func (this *Screen) escape(b byte) {
+	this.state = screenStateGround
+	switch b {
+	case '[':
+		this.state = screenStateCSI
+	case ']', 'P', '_', '^':
+		// OSC, DCS and friends, all ignored up to the terminator
+		this.state = screenStateOSC
+	case '(', ')', '*', '+', '#', '%':
+		this.state = screenStateCharset
+	case '7':
+		this.savedRow, this.savedCol = this.row, this.col
+	case '8':
+		this.row, this.col = this.savedRow, this.savedCol
+		this.wrapNext = false
+	case 'D':
+		this.lineFeed()
+	case 'E':
+		this.col = 0
+		this.lineFeed()
+	case 'M':
+		// reverse index
+		if this.row == this.top {
+			this.scrollDown(1)
+		} else if this.row > 0 {
+			this.row--
+		}
+	case 'c':
+		this.main = newScreenLines(this.width, this.height)
+		this.alt = newScreenLines(this.width, this.height)
+		this.alternate = false
+		this.row, this.col, this.wrapNext = 0, 0, false
+		this.top, this.bottom = 0, this.height-1
+	}
+}
+
+func (this *Screen) put(r rune) {
+	w := runewidth.RuneWidth(r)
+	if w == 0 {
+		// combining characters and the like, not worth modeling
+		return
+	}
+	if this.wrapNext || this.col+w > this.width {
+		this.col = 0
+		this.lineFeed()
+	}
+
+	line := this.lines()[this.row]
+	if this.hidden {
+		line[this.col] = ' '
+		if w == 2 && this.col+1 < this.width {
+			line[this.col+1] = ' '
+		}
+	} else {
+		line[this.col] = r
+		if w == 2 && this.col+1 < this.width {
+			line[this.col+1] = screenWideFiller
+		}
+	}
+
+	if this.col+w >= this.width {
+		this.col = this.width - 1
+		this.wrapNext = true
+	} else {
+		this.col += w
+	}
+}
+
+func (this *Screen) lineFeed() {
+	this.wrapNext = false
+	if this.row == this.bottom {
+		if this.keepScrollback && !this.alternate && this.top == 0 {
+			this.scrollback = append(this.scrollback, screenLineText(this.main[0]))
+		}
+		this.scrollUp(1)
+	} else if this.row < this.height-1 {
+		this.row++
+	}
+}
+
+func (this *Screen) scrollUp(n int) {
+	lines := this.lines()
+	for i := 0; i < n; i++ {
+		copy(lines[this.top:this.bottom], lines[this.top+1:this.bottom+1])
+		lines[this.bottom] = newScreenLine(this.width)
+	}
+}
+
+func (this *Screen) scrollDown(n int) {
+	lines := this.lines()
+	for i := 0; i < n; i++ {
+		copy(lines[this.top+1:this.bottom+1], lines[this.top:this.bottom])
+		lines[this.top] = newScreenLine(this.width)
+	}
+}
+
+func (this *Screen) clear(row, from, to int) {
+	line := this.lines()[row]
+	for i := max(from, 0); i < min(to, this.width); i++ {
+		line[i] = ' '
+	}
+}
+
+func parseCSIParams(params string) []int {
+	if params == "" {
+		return nil
+	}
+	fields := strings.Split(params, ";")
+	values := make([]int, len(fields))
+	for i, field := range fields {
+		// sub-parameters like 38:5:1 only show up in SGR, which we ignore
+		values[i], _ = strconv.Atoi(field)
+	}
+	return values
+}
+
+func (this *Screen) csi(params string, final byte) {
+	private := strings.HasPrefix(params, "?")
+	if private || strings.HasPrefix(params, ">") || strings.HasPrefix(params, "=") {
+		params = params[1:]
+	}
+	values := parseCSIParams(params)
+	// get a parameter, where 0 or missing means def
+	arg := func(i, def int) int {
+		if i < len(values) && values[i] > 0 {
+			return values[i]
+		}
+		return def
+	}
+
+	if final != 'm' {
+		this.wrapNext = false
+	}
+
+	switch final {
+	case 'A':
+		this.row = max(this.row-arg(0, 1), 0)
+	case 'B':
+		this.row = min(this.row+arg(0, 1), this.height-1)
+	case 'C':
+		this.col = min(this.col+arg(0, 1), this.width-1)
+	case 'D':
+		this.col = max(this.col-arg(0, 1), 0)
+	case 'E':
+		this.row = min(this.row+arg(0, 1), this.height-1)
+		this.col = 0
+	case 'F':
+		this.row = max(this.row-arg(0, 1), 0)
+		this.col = 0
+	case 'G', '`':
+		this.col = min(arg(0, 1), this.width) - 1
+	case 'd':
+		this.row = min(arg(0, 1), this.height) - 1
+	case 'H', 'f':
+		this.row = min(arg(0, 1), this.height) - 1
+		this.col = min(arg(1, 1), this.width) - 1
+
+	case 'J':
+		switch arg(0, 0) {
+		case 0:
+			this.clear(this.row, this.col, this.width)
+			for row := this.row + 1; row < this.height; row++ {
+				this.clear(row, 0, this.width)
+			}
+		case 1:
+			for row := 0; row < this.row; row++ {
+				this.clear(row, 0, this.width)
+			}
+			this.clear(this.row, 0, this.col+1)
+		case 2, 3:
+			for row := 0; row < this.height; row++ {
+				this.clear(row, 0, this.width)
+			}
+		}
+	case 'K':
+		switch arg(0, 0) {
+		case 0:
+			this.clear(this.row, this.col, this.width)
+		case 1:
+			this.clear(this.row, 0, this.col+1)
+		case 2:
+			this.clear(this.row, 0, this.width)
+		}
+	case 'X':
+		this.clear(this.row, this.col, this.col+arg(0, 1))
+
+	case '@':
+		line := this.lines()[this.row]
+		n := min(arg(0, 1), this.width-this.col)
+		copy(line[this.col+n:], line[this.col:])
+		this.clear(this.row, this.col, this.col+n)
+	case 'P':
+		line := this.lines()[this.row]
+		n := min(arg(0, 1), this.width-this.col)
+		copy(line[this.col:], line[this.col+n:])
+		this.clear(this.row, this.width-n, this.width)
+
+	case 'L', 'M':
+		if this.row < this.top || this.row > this.bottom {
+			return
+		}
+		top := this.top
+		this.top = this.row
+		if final == 'L' {
+			this.scrollDown(arg(0, 1))
+		} else {
+			this.scrollUp(arg(0, 1))
+		}
+		this.top = top
+	case 'S':
+		this.scrollUp(arg(0, 1))
+	case 'T':
+		if !private {
+			this.scrollDown(arg(0, 1))
+		}
+
+	case 'r':
+		top, bottom := arg(0, 1)-1, min(arg(1, this.height), this.height)-1
+		if top < bottom {
+			this.top, this.bottom = top, bottom
+			this.row, this.col = 0, 0
+		}
+	case 's':
+		this.savedRow, this.savedCol = this.row, this.col
+	case 'u':
+		this.row, this.col = this.savedRow, this.savedCol
+
+	case 'h', 'l':
+		if !private {
+			if arg(0, 0) == 20 {
+				this.newlineMode = final == 'h'
+			}
+			return
+		}
+		for _, mode := range values {
+			switch mode {
+			case 47, 1047, 1049:
+				this.setAlternate(final == 'h', mode == 1049)
+			}
+		}
+	}
+}
+
+func (this *Screen) setAlternate(on, saveCursor bool) {
+	if on == this.alternate {
+		return
+	}
+	if on {
+		if saveCursor {
+			this.savedRow, this.savedCol = this.row, this.col
+		}
+		this.alt = newScreenLines(this.width, this.height)
+	} else if saveCursor {
+		this.row, this.col = this.savedRow, this.savedCol
+	}
+	this.alternate = on
+	this.top, this.bottom = 0, this.height-1
+}
+
+func (this *Screen) CursorColumn() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.col
+}
+
+// The text of the row the cursor is on, starting from a column
+func (this *Screen) CursorLine(col int) string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	line := this.lines()[this.row]
+	return screenLineText(line[min(max(col, 0), this.width):])
+}
+
+// The visible screen as text, without trailing spaces or empty lines at the
+// bottom
+func (this *Screen) String() string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return screenText(nil, this.lines())
+}
+
+// The scrollback and the main screen as text, what's left in the terminal
+// after a command, ignoring anything on the alternate screen
+func (this *Screen) Text() string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return screenText(this.scrollback, this.main)
+}
+
+func screenText(scrollback []string, lines [][]rune) string {
+	text := append([]string{}, scrollback...)
+	for _, line := range lines {
+		text = append(text, screenLineText(line))
+	}
+	return strings.TrimRight(strings.Join(text, "\n"), "\n")
+}
+
+func screenLineText(line []rune) string {
+	var builder strings.Builder
+	for _, r := range line {
+		if r != screenWideFiller {
+			builder.WriteRune(r)
+		}
+	}
+	return strings.TrimRight(builder.String(), " ")
+}
@@ -0,0 +1,136 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScreen(t *testing.T) {
+	screen := NewScreen(10, 4)
+	screen.Write([]byte("hello\r\n\x1b[31mworld\x1b[0m\r\n"))
+	assert.Equal(t, "hello\nworld", screen.String())
+
+	// wrapping and scrolling off the top
+	screen.Write([]byte("0123456789abc\r\nlast"))
+	assert.Equal(t, "world\n0123456789\nabc\nlast", screen.String())
+
+	// overwrite with cursor movement and erase to the end of the line
+	screen.Write([]byte("\x1b[1;1Hw\x1b[2;4H\x1b[K"))
+	assert.Equal(t, "world\n012\nabc\nlast", screen.String())
+
+	// escape sequences split across writes, and a wide character
+	screen.Write([]byte("\x1b[2"))
+	screen.Write([]byte("J\x1b[H\xe4\xb8"))
+	screen.Write([]byte("\xadx\x1b]0;title\x07"))
+	assert.Equal(t, "中x", screen.String())
+}
+
+func TestScreenHidden(t *testing.T) {
+	screen := NewScreen(20, 4)
+	screen.Write([]byte("$ pass show db\r\n"))
+	// an excluded command's output keeps its place but not its text
+	screen.WriteHidden([]byte("hunter2\r\n\x1b[1mok\x1b[0m $ "))
+	screen.Write([]byte("ls"))
+	assert.Equal(t, "$ pass show db\n\n     ls", screen.String())
+	assert.NotContains(t, screen.Text(), "hunter2")
+}
+
+func TestScreenAlternate(t *testing.T) {
+	screen := NewScreen(20, 3)
+	screen.Write([]byte("$ vim\r\n"))
+
+	// a TUI draws on the alternate screen and we show that while it runs
+	screen.Write([]byte("\x1b[?1049h\x1b[H\x1b[2J~\r\n~\x1b[3;1H\"file\" 1L"))
+	assert.Equal(t, "~\n~\n\"file\" 1L", screen.String())
+
+	screen.Write([]byte("\x1b[?1049l"))
+	assert.Equal(t, "$ vim", screen.String())
+
+	// a scroll region keeps the status line in place
+	screen.Write([]byte("\x1b[?1049h\x1b[3;1Hstatus\x1b[1;2r\x1b[2;1Ha\r\nb\r\nc"))
+	assert.Equal(t, "b\nc\nstatus", screen.String())
+
+	screen.Resize(10, 2)
+	width, height := screen.Size()
+	assert.Equal(t, 10, width)
+	assert.Equal(t, 2, height)
+	assert.Equal(t, "c\nstatus", screen.String())
+}
+
+func TestOutputScreen(t *testing.T) {
+	screen := newOutputScreen(10, 2)
+
+	// lines scrolling off the top are kept, plain newlines return to the
+	// first column
+	screen.Write([]byte("one\ntwo\r\nthree\nfour"))
+	assert.Equal(t, "one\ntwo\nthree\nfour", screen.Text())
+	assert.Equal(t, "three\nfour", screen.String())
+
+	// a progress bar only keeps its last state
+	screen.Write([]byte("\n 10%\r 50%\r\x1b[K100%\n"))
+	assert.Equal(t, "one\ntwo\nthree\nfour\n100%", screen.Text())
+
+	// nothing drawn on the alternate screen is left
+	screen.Write([]byte("\x1b[?1049h\x1b[H\x1b[2Jtop - 10:00\n\x1b[?1049l"))
+	assert.Equal(t, "one\ntwo\nthree\nfour\n100%", screen.Text())
+}
+
+func TestSnap(t *testing.T) {
+	stateDir := t.TempDir()
+	screen := NewScreen(20, 3)
+	screen.Write([]byte("$ ls\r\nfoo  bar\r\n$ "))
+
+	listener, err := ServeScreen(ScreenSocketPath(stateDir, "20240102-030405-aaaa"), screen, nil)
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	// an older shell that went away without cleaning up
+	stalePath := ScreenSocketPath(stateDir, "20240101-030405-bbbb")
+	assert.Nil(t, os.WriteFile(stalePath, []byte{}, 0600))
+
+	ctx := context.Background()
+	snapshot, err := snapScreen(ctx, stateDir, "")
+	assert.Nil(t, err)
+	assert.Equal(t, &screenSnapshot{Width: 20, Height: 3, Text: "$ ls\nfoo  bar\n$"}, snapshot)
+
+	_, err = snapScreen(ctx, stateDir, "20240101")
+	assert.NotNil(t, err)
+	_, err = snapScreen(ctx, stateDir, "2024")
+	assert.ErrorContains(t, err, "is ambiguous")
+
+	llm := &echoLLM{}
+	out := new(bytes.Buffer)
+	config := MakeButterfishConfig()
+	config.StateBaseDir = stateDir
+	butterfish := &ButterfishCtx{
+		Ctx:           ctx,
+		Config:        config,
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+		Out:           out,
+		InConsoleMode: true,
+	}
+
+	options := &CliCommandConfig{}
+	options.Snap.Session = "20240102"
+	options.Snap.Prompt = []string{"what", "happened?"}
+	options.Snap.NoColor = true
+	assert.Nil(t, butterfish.snapCommand(options))
+	assert.Equal(t, "echo: This is the current contents of my 20x3 terminal screen:\n```\n$ ls\nfoo  bar\n$\n```\n\nwhat happened?", out.String())
+
+	out.Reset()
+	options.Snap.Print = true
+	assert.Nil(t, butterfish.snapCommand(options))
+	assert.Equal(t, "$ ls\nfoo  bar\n$\n", out.String())
+
+	listener.Close()
+	_, err = snapScreen(ctx, stateDir, "")
+	assert.ErrorContains(t, err, "No running Butterfish shell found")
+	_, err = os.Stat(filepath.Join(ScreensDir(stateDir), "20240101-030405-bbbb.sock"))
+	assert.True(t, os.IsNotExist(err))
+}
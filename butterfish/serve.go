@@ -0,0 +1,374 @@
+package butterfish
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serve mode, started with `butterfish serve`, exposes the same operations as
+// RPC mode over HTTP on a local port, so that editor plugins and scripts can
+// share one running Butterfish, and its loaded index, without spawning a
+// process per request. Requests and responses are JSON, errors are returned
+// as {"error": "..."} with a 4xx or 5xx status.
+//
+// Endpoints:
+//
+//	POST /v1/prompt        {"prompt", "system_message"?, "model"?, "max_tokens"?, "temperature"?, "stream"?}
+//	                       -> {"completion"}, or server-sent events if streaming
+//	POST /v1/summarize     {"content", "max_chunks"?}
+//	                       -> {"summary"}
+//	POST /v1/gencmd        {"prompt"}
+//	                       -> {"command"}
+//	POST /v1/index/search  {"query", "results"?, "paths"?}
+//	                       -> {"results": [{"path", "score", "content"}]}
+//	GET  /v1/sessions      -> {"sessions": ["<id>", ...]}
+//	GET  /v1/sessions/{id} -> {"id", "entries": [...]}
+//	GET  /v1/health        -> {"status": "ok"}
+//
+// Prompts stream if "stream" is true or the request accepts
+// text/event-stream. Each chunk of output is sent as a `data: {"text"}`
+// event, followed by an `event: done` with the full completion, or an
+// `event: error` with a message.
+//
+// POST requests must have a JSON content type, which browsers can't send
+// cross-origin without a preflight we never approve, so that web pages can't
+// use the server. Every request needs an `Authorization: Bearer <token>`
+// header, since other users on the machine can reach a localhost port too.
+// The token is set with --token, or generated at startup and written to
+// <state dir>/serve-token, readable only by the user. An HTTPServer made
+// without a token only answers requests addressed to localhost, so that a DNS
+// rebinding page whose name resolves to 127.0.0.1 can't use it, and never
+// serves session history. Unlike RPC mode, summarize only takes content, a
+// request can't make us read a file.
+
+const (
+	serveMaxBodyBytes  = 16 * 1024 * 1024
+	serveShutdownDelay = 5 * time.Second
+	serveTokenFileName = "serve-token"
+)
+
+type HTTPServer struct {
+	Butterfish *ButterfishCtx
+	// Bearer token required on every request, if set. Without one session
+	// history isn't served.
+	Token string
+	rpc   *RPCServer
+	// the vector index isn't safe for concurrent loads
+	indexMutex sync.Mutex
+}
+
+type serveError struct {
+	Error string `json:"error"`
+}
+
+type servePromptParams struct {
+	rpcCompleteParams
+	Stream bool `json:"stream"`
+}
+
+func NewHTTPServer(butterfish *ButterfishCtx, options *RPCOptions, token string) *HTTPServer {
+	return &HTTPServer{
+		Butterfish: butterfish,
+		Token:      token,
+		rpc:        NewRPCServer(butterfish, options, io.Discard),
+	}
+}
+
+func (this *HTTPServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/health", func(w http.ResponseWriter, r *http.Request) {
+		writeServeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("POST /v1/prompt", this.handlePrompt)
+	mux.HandleFunc("POST /v1/summarize", serveHandler(this.summarize))
+	mux.HandleFunc("POST /v1/gencmd", serveHandler(this.rpc.gencmd))
+	mux.HandleFunc("POST /v1/index/search", serveHandler(this.indexSearch))
+	mux.HandleFunc("GET /v1/sessions", this.handleSessions)
+	mux.HandleFunc("GET /v1/sessions/{id}", this.handleSession)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("HTTP request %s %s", r.Method, r.URL.Path)
+		if this.Token == "" && !isLoopbackHost(r.Host) {
+			writeServeError(w, http.StatusForbidden, "Requests must be addressed to localhost, use --token to serve other hosts")
+			return
+		}
+		if !this.authorized(r) {
+			writeServeError(w, http.StatusUnauthorized, "Missing or invalid bearer token")
+			return
+		}
+		if r.Method == http.MethodPost && !isJSONContentType(r.Header.Get("Content-Type")) {
+			writeServeError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, serveMaxBodyBytes)
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// Make a token for a server started without --token and write it to a file
+// in stateDir that only this user can read, returns the token and the file
+func writeServeToken(stateDir string) (string, string, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return "", "", err
+	}
+	err = os.MkdirAll(stateDir, 0700)
+	if err != nil {
+		return "", "", err
+	}
+	path := filepath.Join(stateDir, serveTokenFileName)
+	// recreate rather than truncate, so an old file's looser mode isn't kept
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", "", err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", "", err
+	}
+	_, err = file.WriteString(token + "\n")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return token, path, nil
+}
+
+// Listen on addr until the context is cancelled
+func (this *HTTPServer) ListenAndServe(ctx context.Context, addr string, out io.Writer) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler:     this.Handler(),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), serveShutdownDelay)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Fprintf(out, "Listening on http://%s\n", listener.Addr())
+	err = server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (this *HTTPServer) authorized(r *http.Request) bool {
+	if this.Token == "" {
+		return true
+	}
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return found && subtle.ConstantTimeCompare([]byte(token), []byte(this.Token)) == 1
+}
+
+// Whether a Host header names this machine by its loopback address
+func isLoopbackHost(host string) bool {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return strings.EqualFold(host, "localhost") || host == "127.0.0.1" || host == "::1"
+}
+
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "application/json"
+}
+
+// Wrap an RPC method as a handler that decodes the body into its params
+func serveHandler[P any](method func(*P) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var params P
+		if !decodeServeParams(w, r, &params) {
+			return
+		}
+		result, err := method(&params)
+		if err != nil {
+			writeServeRPCError(w, err)
+			return
+		}
+		writeServeJSON(w, http.StatusOK, result)
+	}
+}
+
+func decodeServeParams(w http.ResponseWriter, r *http.Request, params any) bool {
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		writeServeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid params: %s", err))
+		return false
+	}
+	return true
+}
+
+func (this *HTTPServer) summarize(params *rpcSummarizeParams) (any, error) {
+	if params.Path != "" {
+		return nil, &RPCError{Code: rpcInvalidParams, Message: "Summarizing a path isn't supported over HTTP, send its content"}
+	}
+	return this.rpc.summarize(params)
+}
+
+func (this *HTTPServer) indexSearch(params *rpcIndexSearchParams) (any, error) {
+	this.indexMutex.Lock()
+	defer this.indexMutex.Unlock()
+	return this.rpc.indexSearch(params)
+}
+
+func (this *HTTPServer) handlePrompt(w http.ResponseWriter, r *http.Request) {
+	var params servePromptParams
+	if !decodeServeParams(w, r, &params) {
+		return
+	}
+
+	stream := params.Stream || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if !stream {
+		result, err := this.rpc.complete(&params.rpcCompleteParams)
+		if err != nil {
+			writeServeRPCError(w, err)
+			return
+		}
+		writeServeJSON(w, http.StatusOK, result)
+		return
+	}
+
+	request, err := this.rpc.completionRequest(&params.rpcCompleteParams)
+	if err != nil {
+		writeServeRPCError(w, err)
+		return
+	}
+	// stop generating if the client goes away
+	request.Ctx = r.Context()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	events := &sseWriter{w: w}
+
+	response, err := this.Butterfish.LLMClient.CompletionStream(request, events)
+	if err == nil && response.Refusal != "" {
+		err = errors.New(response.RefusalMessage())
+	}
+	if err != nil {
+		events.event("error", serveError{Error: err.Error()})
+		return
+	}
+	events.event("done", map[string]string{"completion": response.Completion})
+}
+
+// Transcripts include environments and command output, so other local users
+// mustn't be able to read them
+func (this *HTTPServer) sessionsAllowed(w http.ResponseWriter) bool {
+	if this.Token == "" {
+		writeServeError(w, http.StatusForbidden, "Session history is only served with a token")
+		return false
+	}
+	return true
+}
+
+// Only the sessions of the profile the server runs with
+func (this *HTTPServer) sessionsDir() string {
+	config := this.Butterfish.Config
+	return SessionsDir(ProfileStateDir(config.StateBaseDir, config.ProfileName()))
+}
+
+func (this *HTTPServer) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if !this.sessionsAllowed(w) {
+		return
+	}
+	ids, err := ListSessions(this.sessionsDir())
+	if err != nil {
+		writeServeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeServeJSON(w, http.StatusOK, map[string]any{"sessions": ids})
+}
+
+func (this *HTTPServer) handleSession(w http.ResponseWriter, r *http.Request) {
+	if !this.sessionsAllowed(w) {
+		return
+	}
+	transcript, err := FindSession(this.sessionsDir(), r.PathValue("id"))
+	if err != nil {
+		writeServeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	entries, err := transcript.Entries()
+	if err != nil {
+		writeServeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeServeJSON(w, http.StatusOK, map[string]any{"id": transcript.ID, "entries": entries})
+}
+
+func writeServeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeServeError(w http.ResponseWriter, status int, message string) {
+	writeServeJSON(w, status, serveError{Error: message})
+}
+
+// Invalid params are the client's fault, anything else is ours
+func writeServeRPCError(w http.ResponseWriter, err error) {
+	var rpcErr *RPCError
+	if errors.As(err, &rpcErr) && rpcErr.Code == rpcInvalidParams {
+		writeServeError(w, http.StatusBadRequest, rpcErr.Message)
+		return
+	}
+	writeServeError(w, http.StatusInternalServerError, err.Error())
+}
+
+// Sends each write as a server-sent event with the text as JSON, so that
+// newlines in the output don't break the framing
+type sseWriter struct {
+	w http.ResponseWriter
+}
+
+func (this *sseWriter) Write(p []byte) (int, error) {
+	err := this.event("", map[string]string{"text": string(p)})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (this *sseWriter) event(name string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if name != "" {
+		_, err = fmt.Fprintf(this.w, "event: %s\n", name)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(this.w, "data: %s\n\n", data)
+	if flusher, ok := this.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return err
+}
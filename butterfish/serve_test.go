@@ -0,0 +1,134 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPServer(t *testing.T) {
+	config := MakeButterfishConfig()
+	config.StateBaseDir = t.TempDir()
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        config,
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     &echoLLM{},
+	}
+	server := NewHTTPServer(butterfish, &RPCOptions{Model: "gpt-4o", NumTokens: 100}, "secret")
+	handler := server.Handler()
+
+	request := func(method, path, body string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Content-Type", "application/json")
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	response := request("POST", "/v1/prompt", `{"prompt": "hi"}`)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"completion": "echo: hi"}`, response.Body.String())
+
+	response = request("POST", "/v1/prompt", `{"prompt": "hi\nthere", "stream": true}`)
+	assert.Equal(t, "text/event-stream", response.Header().Get("Content-Type"))
+	assert.Equal(t, "data: {\"text\":\"echo: hi\\nthere\"}\n\n"+
+		"event: done\ndata: {\"completion\":\"echo: hi\\nthere\"}\n\n", response.Body.String())
+
+	response = request("POST", "/v1/gencmd", `{}`)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.JSONEq(t, `{"error": "Missing prompt"}`, response.Body.String())
+
+	response = request("POST", "/v1/gencmd", `{"prompt": "list files"}`, "Authorization", "Bearer wrong")
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	// browsers can send text/plain cross-origin without a preflight
+	response = request("POST", "/v1/prompt", `{"prompt": "hi"}`, "Content-Type", "text/plain")
+	assert.Equal(t, http.StatusUnsupportedMediaType, response.Code)
+
+	response = request("GET", "/v1/sessions", "")
+	assert.JSONEq(t, `{"sessions": []}`, response.Body.String())
+
+	transcript := NewSessionTranscript(SessionsDir(ProfileStateDir(config.StateBaseDir, "")), "20240102-030405-abcd")
+	assert.Nil(t, transcript.Append(&SessionEntry{Type: "env", Time: time.Unix(0, 0)}))
+	// another profile's sessions aren't served
+	other := NewSessionTranscript(SessionsDir(ProfileStateDir(config.StateBaseDir, "work")), "20250102-030405-abcd")
+	assert.Nil(t, other.Append(&SessionEntry{Type: "env", Time: time.Unix(0, 0)}))
+
+	response = request("GET", "/v1/sessions", "")
+	assert.JSONEq(t, `{"sessions": ["20240102-030405-abcd"]}`, response.Body.String())
+
+	response = request("GET", "/v1/sessions/last", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	var session map[string]any
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &session))
+	assert.Equal(t, "20240102-030405-abcd", session["id"])
+	assert.Equal(t, 1, len(session["entries"].([]any)))
+
+	response = request("GET", "/v1/sessions/nope", "")
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	response = request("POST", "/v1/summarize", `{"path": "/etc/passwd"}`)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
+
+func TestHTTPServerHost(t *testing.T) {
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     &echoLLM{},
+	}
+	handler := NewHTTPServer(butterfish, &RPCOptions{Model: "gpt-4o", NumTokens: 100}, "").Handler()
+
+	for host, status := range map[string]int{
+		"localhost:7641": http.StatusOK,
+		"127.0.0.1:7641": http.StatusOK,
+		"[::1]:7641":     http.StatusOK,
+		"localhost":      http.StatusOK,
+		// a DNS rebinding page's name resolves to 127.0.0.1 but it's still
+		// the Host header
+		"evil.example.com:7641": http.StatusForbidden,
+	} {
+		req := httptest.NewRequest("GET", "/v1/health", nil)
+		req.Host = host
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(t, status, recorder.Code, host)
+	}
+
+	// other local users can reach the port, so session history needs a token
+	req := httptest.NewRequest("GET", "/v1/sessions", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+}
+
+func TestServeToken(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, serveTokenFileName)
+	assert.Nil(t, os.WriteFile(path, []byte("old\n"), 0644))
+
+	token, tokenPath, err := writeServeToken(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, path, tokenPath)
+	assert.Equal(t, 64, len(token))
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, token+"\n", string(content))
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
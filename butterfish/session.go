@@ -0,0 +1,393 @@
+package butterfish
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shell sessions, each Butterfish shell gets an ID and a transcript at
+// <state dir>/profiles/<profile>/sessions/<id>.jsonl, one JSON entry per
+// line. The first entry records the environment the session started in (OS,
+// tool versions, whitelisted env vars) so that exported or replayed sessions
+// carry enough context to reproduce issues. Transcripts are kept with the
+// profile the session started with, like usage, so that listing sessions in
+// one profile doesn't show another's.
+
+const (
+	sessionsDirName       = "sessions"
+	sessionFileExt        = ".jsonl"
+	sessionEntryEnv       = "environment"
+	toolVersionTimeout    = 2 * time.Second
+	maxToolVersionLength  = 120
+	LastSessionID         = "last"
+	sessionIDTimeFormat   = "20060102-150405"
+	sessionIDRandomLength = 2
+)
+
+// Tools whose versions we record, with the arguments that print the version
+var sessionTools = []struct {
+	name string
+	args []string
+}{
+	{"git", []string{"--version"}},
+	{"go", []string{"version"}},
+	{"python3", []string{"--version"}},
+	{"node", []string{"--version"}},
+	{"npm", []string{"--version"}},
+	{"rustc", []string{"--version"}},
+	{"gcc", []string{"--version"}},
+	{"make", []string{"--version"}},
+	{"docker", []string{"--version"}},
+	{"kubectl", []string{"version", "--client"}},
+}
+
+// Env vars we record by default, these are glob patterns matched against the
+// variable name. More can be added with --session-env.
+var DefaultSessionEnvVars = []string{
+	"SHELL", "TERM", "TERM_PROGRAM", "LANG", "LC_*", "EDITOR", "PATH",
+	"VIRTUAL_ENV", "CONDA_DEFAULT_ENV", "GOPATH", "GOFLAGS", "NODE_ENV",
+}
+
+// Env vars that look like credentials are never recorded, even if whitelisted
+var secretEnvVarPattern = regexp.MustCompile(`(?i)(token|key|secret|passw|credential|auth)`)
+
+type SessionEnvironment struct {
+	OS         string            `json:"os"`
+	Arch       string            `json:"arch"`
+	Kernel     string            `json:"kernel,omitempty"`
+	Shell      string            `json:"shell"`
+	Butterfish string            `json:"butterfish"`
+	Profile    string            `json:"profile"`
+	Model      string            `json:"model"`
+	Directory  string            `json:"directory"`
+	Tools      map[string]string `json:"tools"`
+	Env        map[string]string `json:"env"`
+}
+
+type SessionEntry struct {
+	Type        string              `json:"type"`
+	Time        time.Time           `json:"time"`
+	Environment *SessionEnvironment `json:"environment,omitempty"`
+}
+
+type SessionTranscript struct {
+	ID    string
+	Path  string
+	mutex sync.Mutex
+}
+
+// The sessions dir in a profile's state dir, see ProfileStateDir
+func SessionsDir(profileStateDir string) string {
+	return filepath.Join(profileStateDir, sessionsDirName)
+}
+
+// IDs sort by start time, with a random suffix in case two sessions start in
+// the same second
+func NewSessionID(now time.Time) string {
+	suffix := make([]byte, sessionIDRandomLength)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%s", now.Format(sessionIDTimeFormat), hex.EncodeToString(suffix))
+}
+
+func NewSessionTranscript(sessionsDir, id string) *SessionTranscript {
+	return &SessionTranscript{
+		ID:   id,
+		Path: filepath.Join(sessionsDir, id+sessionFileExt),
+	}
+}
+
+func (this *SessionTranscript) Append(entry *SessionEntry) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(this.Path), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(this.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// Record the environment, this runs external commands so it's meant to be
+// called in the background at session start
+func (this *SessionTranscript) RecordEnvironment(ctx context.Context, config *ButterfishConfig) error {
+	env := CaptureEnvironment(ctx, config)
+	return this.Append(&SessionEntry{
+		Type:        sessionEntryEnv,
+		Time:        time.Now(),
+		Environment: env,
+	})
+}
+
+// Run a command and return the first line of its output, or an empty string
+// if it fails
+func firstLineOfCommand(ctx context.Context, name string, args ...string) string {
+	ctx, cancel := context.WithTimeout(ctx, toolVersionTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil && len(output) == 0 {
+		return ""
+	}
+
+	line, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+	line = strings.TrimSpace(line)
+	if len(line) > maxToolVersionLength {
+		line = line[:maxToolVersionLength]
+	}
+	return line
+}
+
+func CaptureEnvironment(ctx context.Context, config *ButterfishConfig) *SessionEnvironment {
+	env := &SessionEnvironment{
+		OS:         runtime.GOOS,
+		Arch:       runtime.GOARCH,
+		Shell:      config.ShellBinary,
+		Butterfish: strings.TrimSpace(strings.Split(config.BuildInfo, "\n")[0]),
+		Profile:    config.ProfileName(),
+		Model:      config.ShellPromptModel,
+		Tools:      make(map[string]string),
+		Env:        make(map[string]string),
+	}
+	env.Directory, _ = os.Getwd()
+
+	if runtime.GOOS != "windows" {
+		env.Kernel = firstLineOfCommand(ctx, "uname", "-sr")
+	}
+	if config.ShellBinary != "" {
+		if version := firstLineOfCommand(ctx, config.ShellBinary, "--version"); version != "" {
+			env.Shell = fmt.Sprintf("%s (%s)", config.ShellBinary, version)
+		}
+	}
+
+	// tool version commands can be slow, run them concurrently
+	var mutex sync.Mutex
+	var waitGroup sync.WaitGroup
+	for _, tool := range sessionTools {
+		if _, err := exec.LookPath(tool.name); err != nil {
+			continue
+		}
+
+		waitGroup.Add(1)
+		go func(name string, args []string) {
+			defer waitGroup.Done()
+			version := firstLineOfCommand(ctx, name, args...)
+			if version != "" {
+				mutex.Lock()
+				env.Tools[name] = version
+				mutex.Unlock()
+			}
+		}(tool.name, tool.args)
+	}
+	waitGroup.Wait()
+
+	patterns := append(append([]string{}, DefaultSessionEnvVars...), config.ShellSessionEnvVars...)
+	for _, keyValue := range os.Environ() {
+		key, value, _ := strings.Cut(keyValue, "=")
+		if secretEnvVarPattern.MatchString(key) {
+			continue
+		}
+		for _, pattern := range patterns {
+			if matched, _ := filepath.Match(pattern, key); matched {
+				env.Env[key] = value
+				break
+			}
+		}
+	}
+
+	return env
+}
+
+// Session IDs in the sessions dir, oldest first
+func ListSessions(sessionsDir string) ([]string, error) {
+	entries, err := os.ReadDir(sessionsDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasSuffix(name, sessionFileExt) {
+			ids = append(ids, strings.TrimSuffix(name, sessionFileExt))
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Resolve a session ID, a unique prefix of one, or "last"
+func FindSession(sessionsDir, id string) (*SessionTranscript, error) {
+	ids, err := ListSessions(sessionsDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("No sessions recorded yet")
+	}
+
+	if id == LastSessionID {
+		return NewSessionTranscript(sessionsDir, ids[len(ids)-1]), nil
+	}
+
+	matches := []string{}
+	for _, candidate := range ids {
+		if candidate == id {
+			return NewSessionTranscript(sessionsDir, candidate), nil
+		}
+		if strings.HasPrefix(candidate, id) {
+			matches = append(matches, candidate)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("No session matches %s", id)
+	case 1:
+		return NewSessionTranscript(sessionsDir, matches[0]), nil
+	default:
+		return nil, fmt.Errorf("Session ID %s is ambiguous, it matches %s", id, strings.Join(matches, ", "))
+	}
+}
+
+// Read all entries of the transcript
+func (this *SessionTranscript) Entries() ([]*SessionEntry, error) {
+	file, err := os.Open(this.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []*SessionEntry{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		entry := &SessionEntry{}
+		err := json.Unmarshal(scanner.Bytes(), entry)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse session %s: %s", this.ID, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+func (this *SessionTranscript) Environment() (*SessionEntry, error) {
+	entries, err := this.Entries()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Type == sessionEntryEnv && entry.Environment != nil {
+			return entry, nil
+		}
+	}
+	return nil, fmt.Errorf("Session %s has no recorded environment", this.ID)
+}
+
+func PrintSessionEnvironment(out io.Writer, id string, entry *SessionEntry) {
+	env := entry.Environment
+	fmt.Fprintf(out, "Session:    %s\n", id)
+	fmt.Fprintf(out, "Started:    %s\n", entry.Time.Local().Format(time.RFC1123))
+	fmt.Fprintf(out, "OS:         %s %s", env.OS, env.Arch)
+	if env.Kernel != "" {
+		fmt.Fprintf(out, " (%s)", env.Kernel)
+	}
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "Shell:      %s\n", env.Shell)
+	fmt.Fprintf(out, "Butterfish: %s\n", env.Butterfish)
+	fmt.Fprintf(out, "Profile:    %s\n", env.Profile)
+	fmt.Fprintf(out, "Model:      %s\n", env.Model)
+	fmt.Fprintf(out, "Directory:  %s\n", env.Directory)
+
+	printSorted := func(title string, values map[string]string, format string) {
+		if len(values) == 0 {
+			return
+		}
+		keys := []string{}
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		fmt.Fprintf(out, "\n%s:\n", title)
+		for _, key := range keys {
+			fmt.Fprintf(out, format, key, values[key])
+		}
+	}
+	printSorted("Tools", env.Tools, "  %-8s %s\n")
+	printSorted("Environment", env.Env, "  %s=%s\n")
+}
+
+// Handle `butterfish sessions ...` for the profile with the given state dir,
+// this doesn't need an API key
+func RunSessionsCommand(out io.Writer, profileStateDir, command string, options *CliCommandConfig) error {
+	sessionsDir := SessionsDir(profileStateDir)
+
+	switch command {
+	case "sessions list":
+		ids, err := ListSessions(sessionsDir)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			fmt.Fprintf(out, "%s\n", id)
+		}
+
+	case "sessions env <id>":
+		session, err := FindSession(sessionsDir, options.Sessions.Env.ID)
+		if err != nil {
+			return err
+		}
+		entry, err := session.Environment()
+		if err != nil {
+			return err
+		}
+
+		if options.Sessions.Env.Json {
+			data, err := json.MarshalIndent(entry, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "%s\n", data)
+			return nil
+		}
+		PrintSessionEnvironment(out, session.ID, entry)
+
+	default:
+		return errors.New("Unrecognized command: " + command)
+	}
+
+	return nil
+}
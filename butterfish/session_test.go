@@ -0,0 +1,63 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionTranscript(t *testing.T) {
+	t.Setenv("LANG", "en_US.UTF-8")
+	t.Setenv("MY_APP_MODE", "debug")
+	t.Setenv("MY_APP_API_KEY", "sk-secret")
+
+	dir := t.TempDir()
+	sessionsDir := SessionsDir(dir)
+
+	_, err := FindSession(sessionsDir, LastSessionID)
+	assert.NotNil(t, err)
+
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	first := NewSessionTranscript(sessionsDir, NewSessionID(start))
+	assert.Contains(t, first.ID, "20240102-030405-")
+
+	config := MakeButterfishConfig()
+	config.ShellSessionEnvVars = []string{"MY_APP_*"}
+	assert.Nil(t, first.RecordEnvironment(context.Background(), config))
+
+	second := NewSessionTranscript(sessionsDir, NewSessionID(start.Add(time.Hour)))
+	assert.Nil(t, second.Append(&SessionEntry{Type: "other", Time: start}))
+
+	ids, err := ListSessions(sessionsDir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{first.ID, second.ID}, ids)
+
+	found, err := FindSession(sessionsDir, LastSessionID)
+	assert.Nil(t, err)
+	assert.Equal(t, second.ID, found.ID)
+	_, err = found.Environment()
+	assert.NotNil(t, err)
+
+	_, err = FindSession(sessionsDir, "2024")
+	assert.NotNil(t, err) // ambiguous
+
+	found, err = FindSession(sessionsDir, "20240102-03")
+	assert.Nil(t, err)
+	entry, err := found.Environment()
+	assert.Nil(t, err)
+	assert.Equal(t, "en_US.UTF-8", entry.Environment.Env["LANG"])
+	assert.Equal(t, "debug", entry.Environment.Env["MY_APP_MODE"])
+	assert.NotContains(t, entry.Environment.Env, "MY_APP_API_KEY")
+
+	out := new(bytes.Buffer)
+	PrintSessionEnvironment(out, found.ID, entry)
+	assert.Contains(t, out.String(), "MY_APP_MODE=debug")
+
+	info, err := os.Stat(first.Path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
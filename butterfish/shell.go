@@ -10,30 +10,21 @@ import (
 	"os"
 	"os/signal"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
-	"unicode"
 
 	"github.com/bakks/butterfish/prompt"
 	"github.com/bakks/butterfish/util"
-	"github.com/sashabaranov/go-openai/jsonschema"
 
 	"github.com/bakks/tiktoken-go"
 	"github.com/mitchellh/go-ps"
 	"golang.org/x/term"
 )
 
-// The default models to use for autosuggest and prompt generation
-// These are the models that are used if we can't find the given model
-// in Tiktoken
-// These models are used specifically for counting tokens to pack into
-// the prompt context
-const DEFAULT_AUTOSUGGEST_ENCODER = "gpt-3.5-turbo-instruct"
-const DEFAULT_PROMPT_ENCODER = "gpt-4-turbo"
-
 const ESC_CUP = "\x1b[6n" // Request the cursor position
 const ESC_UP = "\x1b[%dA"
 const ESC_RIGHT = "\x1b[%dC"
@@ -66,6 +57,8 @@ var DarkShellColorScheme = &ShellColorScheme{
 	Error:            "\x1b[38;5;196m",
 }
 
+var NoColorShellColorScheme = &ShellColorScheme{}
+
 var LightShellColorScheme = &ShellColorScheme{
 	Prompt:           "\x1b[38;5;28m",
 	PromptGoal:       "\x1b[38;5;200m",
@@ -140,11 +133,42 @@ type HistoryBuffer struct {
 	FunctionName   string
 	FunctionParams string
 
+	// For shell input, when the command was submitted and, once the next
+	// prompt shows, its exit code and how long it ran
+	Started  time.Time
+	Finished bool
+	ExitCode int
+	Duration time.Duration
+
+	// For LLM output, the answer was cut off, e.g. with Ctrl-C
+	Interrupted bool
+
+	// Command output is written to a screen and Content is rendered from it
+	// when the history is read, if the history has a terminal size
+	screen *Screen
+	dirty  bool
+
 	// This is to cache tokenization plus truncation of the content
 	// It maps from encoding name to the tokenization of the output
 	Tokenizations map[string]Tokenization
 }
 
+// How a finished command went, e.g. "command failed with exit 127 after
+// 0.2s", empty for other blocks
+func (this *HistoryBuffer) CommandStatus() string {
+	if this.Type != historyTypeShellInput || !this.Finished {
+		return ""
+	}
+	duration := fmt.Sprintf("%.1fs", this.Duration.Seconds())
+	if this.Duration >= time.Minute {
+		duration = this.Duration.Round(time.Second).String()
+	}
+	if this.ExitCode != 0 {
+		return fmt.Sprintf("command failed with exit %d after %s", this.ExitCode, duration)
+	}
+	return fmt.Sprintf("command succeeded after %s", duration)
+}
+
 func (this *HistoryBuffer) SetTokenization(encoding string, inputLength int, numTokens int, data string) {
 	if this.Tokenizations == nil {
 		this.Tokenizations = make(map[string]Tokenization)
@@ -178,6 +202,11 @@ func (this *HistoryBuffer) GetTokenization(encoding string, length int) (string,
 type ShellHistory struct {
 	Blocks []*HistoryBuffer
 	mutex  sync.Mutex
+
+	// the size of the terminal that output is rendered for, 0 to store output
+	// as it's written
+	termWidth  int
+	termHeight int
 }
 
 func NewShellHistory() *ShellHistory {
@@ -188,11 +217,44 @@ func NewShellHistory() *ShellHistory {
 
 func (this *ShellHistory) add(historyType int, block string) {
 	buffer := NewShellBuffer()
-	buffer.Write(block)
-	this.Blocks = append(this.Blocks, &HistoryBuffer{
+	historyBuffer := &HistoryBuffer{
 		Type:    historyType,
 		Content: buffer,
-	})
+	}
+	if this.termWidth > 0 &&
+		(historyType == historyTypeShellOutput || historyType == historyTypeFunctionOutput) {
+		historyBuffer.screen = newOutputScreen(this.termWidth, this.termHeight)
+	}
+	this.Blocks = append(this.Blocks, historyBuffer)
+	historyBuffer.write(block)
+}
+
+func (this *HistoryBuffer) write(data string) {
+	if this.screen == nil {
+		this.Content.Write(data)
+		return
+	}
+	this.screen.Write([]byte(data))
+	this.dirty = true
+}
+
+// Render output written to a screen since the last render into Content
+func (this *HistoryBuffer) render() {
+	if !this.dirty {
+		return
+	}
+	this.Content = NewShellBuffer()
+	this.Content.Write(this.screen.Text())
+	this.Tokenizations = nil
+	this.dirty = false
+}
+
+// Render output from now on as it's left on a terminal of this size, e.g.
+// progress bars only keep their last state and TUIs leave nothing behind
+func (this *ShellHistory) SetTerminalSize(width, height int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.termWidth, this.termHeight = width, height
 }
 
 func (this *ShellHistory) Append(historyType int, data string) {
@@ -210,7 +272,7 @@ func (this *ShellHistory) Append(historyType int, data string) {
 		lastBlock := this.Blocks[numBlocks-1]
 
 		if lastBlock.Type == historyType {
-			lastBlock.Content.Write(data)
+			lastBlock.write(data)
 			return
 		}
 	}
@@ -219,6 +281,71 @@ func (this *ShellHistory) Append(historyType int, data string) {
 	this.add(historyType, data)
 }
 
+// Add a shell command that was just submitted, its status is filled in by
+// FinishCommand
+func (this *ShellHistory) AddCommand(command string, started time.Time) {
+	if len(command) == 0 {
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.add(historyTypeShellInput, command)
+	this.Blocks[len(this.Blocks)-1].Started = started
+}
+
+// Record the exit code of the last command when the shell prints its next
+// prompt, if that command hasn't finished already
+func (this *ShellHistory) FinishCommand(exitCode int, finished time.Time) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for i := len(this.Blocks) - 1; i >= 0; i-- {
+		block := this.Blocks[i]
+		switch block.Type {
+		case historyTypeShellOutput:
+			continue
+		case historyTypeShellInput:
+			if !block.Finished && !block.Started.IsZero() {
+				block.Finished = true
+				block.ExitCode = exitCode
+				block.Duration = finished.Sub(block.Started)
+				// the cached tokenizations don't have the status
+				block.Tokenizations = nil
+			}
+		}
+		return
+	}
+}
+
+// Add a new block even if the last block has the same type
+func (this *ShellHistory) AddBlock(historyType int, data string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.add(historyType, data)
+}
+
+// Add the part of an answer that arrived before it was cut off
+func (this *ShellHistory) AddInterruptedAnswer(data string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.add(historyTypeLLMOutput, data)
+	this.Blocks[len(this.Blocks)-1].Interrupted = true
+}
+
+// Whether the last answer in the history was cut off
+func (this *ShellHistory) LastAnswerInterrupted() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for i := len(this.Blocks) - 1; i >= 0; i-- {
+		if this.Blocks[i].Type == historyTypeLLMOutput {
+			return this.Blocks[i].Interrupted
+		}
+	}
+	return false
+}
+
 func (this *ShellHistory) AddFunctionCall(name, params string) {
 	this.mutex.Lock()
 	defer this.mutex.Unlock()
@@ -246,7 +373,7 @@ func (this *ShellHistory) AppendFunctionOutput(name, data string) {
 	if numBlocks > 0 {
 		lastBlock = this.Blocks[numBlocks-1]
 		if lastBlock.Type == historyTypeFunctionOutput && lastBlock.FunctionName == name {
-			lastBlock.Content.Write(data)
+			lastBlock.write(data)
 			return
 		}
 	}
@@ -257,6 +384,18 @@ func (this *ShellHistory) AppendFunctionOutput(name, data string) {
 	lastBlock.FunctionName = name
 }
 
+// Remove the last block if it's a prompt, e.g. when the response to the
+// prompt shouldn't be kept
+func (this *ShellHistory) RemoveLastPrompt() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	numBlocks := len(this.Blocks)
+	if numBlocks > 0 && this.Blocks[numBlocks-1].Type == historyTypePrompt {
+		this.Blocks = this.Blocks[:numBlocks-1]
+	}
+}
+
 // Go back in history for a certain number of bytes.
 func (this *ShellHistory) GetLastNBytes(numBytes int, truncateLength int) []util.HistoryBlock {
 	this.mutex.Lock()
@@ -266,6 +405,7 @@ func (this *ShellHistory) GetLastNBytes(numBytes int, truncateLength int) []util
 
 	for i := len(this.Blocks) - 1; i >= 0 && numBytes > 0; i-- {
 		block := this.Blocks[i]
+		block.render()
 		content := sanitizeTTYString(block.Content.String())
 		if len(content) > truncateLength {
 			content = content[:truncateLength]
@@ -294,6 +434,7 @@ func (this *ShellHistory) IterateBlocks(cb func(block *HistoryBuffer) bool) {
 	defer this.mutex.Unlock()
 
 	for i := len(this.Blocks) - 1; i >= 0; i-- {
+		this.Blocks[i].render()
 		cont := cb(this.Blocks[i])
 		if !cont {
 			break
@@ -301,6 +442,26 @@ func (this *ShellHistory) IterateBlocks(cb func(block *HistoryBuffer) bool) {
 	}
 }
 
+// Find the most recent shell command and the output it produced. Returns nil
+// if the latest history isn't a shell command, e.g. if it was a prompt.
+func (this *ShellHistory) LastCommand() (*HistoryBuffer, string) {
+	var command *HistoryBuffer
+	output := []string{}
+
+	this.IterateBlocks(func(block *HistoryBuffer) bool {
+		switch block.Type {
+		case historyTypeShellOutput:
+			output = append([]string{block.Content.String()}, output...)
+			return true
+		case historyTypeShellInput:
+			command = block
+		}
+		return false
+	})
+
+	return command, strings.Join(output, "")
+}
+
 // This is not thread safe
 func (this *ShellHistory) LogRecentHistory() {
 	blocks := this.GetLastNBytes(2000, 512)
@@ -329,6 +490,9 @@ const (
 	stateShell
 	statePrompting
 	statePromptResponse
+	stateInlineEdit
+	stateConfirmGoal
+	stateReverseSearch
 )
 
 var stateNames = []string{
@@ -336,6 +500,9 @@ var stateNames = []string{
 	"Shell",
 	"Prompting",
 	"PromptResponse",
+	"InlineEdit",
+	"ConfirmGoal",
+	"ReverseSearch",
 }
 
 type AutosuggestResult struct {
@@ -361,9 +528,44 @@ type ShellState struct {
 	ChildIn    io.Writer
 	Sigwinch   chan os.Signal
 
-	// set based on model
-	PromptMaxTokens      int
-	AutosuggestMaxTokens int
+	// set based on model, see updateTokenBudgets
+	PromptMaxTokens       int
+	AutosuggestMaxTokens  int
+	HistoryBlockMaxTokens int
+	ResponseMaxTokens     int
+	// compact history for models with a small context window
+	PromptCompactHistory      bool
+	AutosuggestCompactHistory bool
+
+	// session overrides for prompting, set with the Temp and System local
+	// commands, an empty SystemMessage means we use the prompt library
+	PromptTemperature float32
+	SystemMessage     string
+	// the persona set with --persona or the Persona local command, and the
+	// model and temperature from before it
+	Persona     *Persona
+	personaBase *personaBase
+	// text to fill in for {name} in prompts, set with the Set local command
+	Variables map[string]string
+
+	// Transcript of this session, nil if we don't have a state dir
+	Session *SessionTranscript
+	// model of the child's screen, served to the snap command
+	Screen *Screen
+
+	// Commands matching the exclude patterns, and their output up to the next
+	// prompt, are kept out of the history
+	Excluder        *CommandExcluder
+	ExcludingOutput bool
+	ExcludedBlocks  int
+	// whether we've counted the output of the current excluded command
+	excludedOutputCounted bool
+
+	// Decides whether goal mode commands run without the user pressing enter
+	// and stops goal mode after too many failures, shared with exec
+	GoalModeRepair *CommandRepair
+	// Commands, time, and tokens used by the current goal
+	GoalModeUsage *GoalUsage
 
 	// The current state of the shell
 	State                  int
@@ -394,6 +596,61 @@ type ShellState struct {
 	AutosuggestEncoder *tiktoken.Tiktoken
 	PromptEncoder      *tiktoken.Tiktoken
 
+	// prompts start with this instead of a capital letter if set, see
+	// trigger.go
+	PromptPrefix string
+	// capitalized executables that are commands rather than prompts
+	CapitalizedCommands map[string]bool
+
+	// a goal waiting for the user to confirm its cost estimate
+	GoalModePending       string
+	GoalModeCostConfirmed bool
+
+	// auto-debug state, the last command we diagnosed and when
+	AutoDebugCommand *HistoryBuffer
+	AutoDebugTime    time.Time
+
+	// directories loaded into the index for --index-context
+	IndexContextDirs map[string]bool
+	// embeddings of past commands for Find, by the text we embedded
+	HistorySearchCache map[string][]float32
+
+	// inline edit of the command being typed, see inlineedit.go
+	InlineEditKey     []byte
+	InlineEditChan    chan *InlineEditResult
+	InlineEditCancel  context.CancelFunc
+	InlineEditBuffer  *ShellBuffer
+	InlineEditCommand string
+	InlineEditColumn  int
+
+	// runs the notify command when a long answer or goal finishes, nil if
+	// there's no notify command, see notify.go
+	Notifier *Notifier
+
+	// commands and prompt preprocessors from Starlark plugins, nil if there
+	// are no plugins, see plugins.go
+	Plugins *Plugins
+
+	// the answer being written in the background with --background-answers,
+	// nil if there isn't one, see background.go
+	Background           *backgroundAnswer
+	BackgroundOutputChan chan *util.CompletionResponse
+
+	// a command from an answer for the Run local command, typed into the shell
+	// after the local response, see answercommand.go
+	AnswerCommand string
+
+	// a command line that opens an answer in the pager, run in the shell in
+	// place of the next prompt, see pager.go
+	PagerCommand string
+
+	// the shell's vi mode, nil if it's in emacs mode, see vimode.go
+	Vi *ViEditor
+
+	// the shell's own history search, see reversesearch.go
+	ReverseSearchColumn  int
+	ReverseSearchCommand *ShellBuffer
+
 	// autosuggest config
 	AutosuggestEnabled bool
 	LastAutosuggest    string
@@ -587,7 +844,9 @@ func (this *ButterfishCtx) ShellMultiplexer(
 	this.SetPS1(childIn)
 
 	colorScheme := DarkShellColorScheme
-	if !this.Config.ColorDark {
+	if this.Config.NoColor {
+		colorScheme = NoColorShellColorScheme
+	} else if !this.Config.ColorDark {
 		colorScheme = LightShellColorScheme
 	}
 
@@ -599,16 +858,13 @@ func (this *ButterfishCtx) ShellMultiplexer(
 	// pushing a new position
 	parentPositionChan := make(chan *cursorPosition, 128)
 
-	termWidth, _, err := term.GetSize(int(os.Stdout.Fd()))
+	termWidth, termHeight, err := term.GetSize(int(os.Stdout.Fd()))
 	if err != nil {
 		panic(err)
 	}
 
 	carriageReturnWriter := util.NewReplaceWriter(parentOut, "\n", "\r\n")
-	codeblocksColorScheme := "monokai"
-	if !this.Config.ColorDark {
-		codeblocksColorScheme = "monokailight"
-	}
+	codeblocksColorScheme := this.Config.CodeTheme()
 	styleCodeblocksWriter := util.NewStyleCodeblocksWriter(
 		carriageReturnWriter,
 		termWidth,
@@ -625,12 +881,10 @@ func (this *ButterfishCtx) ShellMultiplexer(
 	sigwinch := make(chan os.Signal, 1)
 	signal.Notify(sigwinch, syscall.SIGWINCH)
 
-	promptMaxTokens := min(
-		NumTokensForModel(this.Config.ShellPromptModel),
-		this.Config.ShellMaxPromptTokens)
-	autoSuggestMaxTokens := min(
-		NumTokensForModel(this.Config.ShellAutosuggestModel),
-		this.Config.ShellMaxPromptTokens)
+	excludePatterns := append(append([]string{}, DefaultShellExcludeCommands...),
+		this.Config.ShellExcludeCommands...)
+
+	this.LoadModelMetadata()
 
 	shellState := &ShellState{
 		Butterfish:             this,
@@ -644,6 +898,7 @@ func (this *ButterfishCtx) ShellMultiplexer(
 		PrintErrorChan:         make(chan error, 8),
 		History:                NewShellHistory(),
 		PromptOutputChan:       make(chan *util.CompletionResponse),
+		BackgroundOutputChan:   make(chan *util.CompletionResponse),
 		PromptAnswerWriter:     styleCodeblocksWriter,
 		PromptGoalAnswerWriter: styleCodeblocksWriterGoal,
 		StyleWriter:            styleCodeblocksWriter,
@@ -654,12 +909,73 @@ func (this *ButterfishCtx) ShellMultiplexer(
 		AutosuggestChan:        make(chan *AutosuggestResult),
 		Color:                  colorScheme,
 		parentInBuffer:         []byte{},
-		PromptMaxTokens:        promptMaxTokens,
-		AutosuggestMaxTokens:   autoSuggestMaxTokens,
+		PromptTemperature:      defaultPromptTemperature,
+		Screen:                 NewScreen(termWidth, termHeight),
+		Excluder:               NewCommandExcluder(excludePatterns),
+		InlineEditKey:          this.Config.ShellInlineEditKey,
+		PromptPrefix:           this.Config.ShellPromptPrefix,
+		CapitalizedCommands:    capitalizedCommands(os.Getenv("PATH")),
+		InlineEditChan:         make(chan *InlineEditResult),
+	}
+	shellState.ResetModelState()
+	if this.Config.Persona != nil {
+		shellState.applyPersona(this.Config.Persona)
+	}
+	if this.Config.ShellViMode {
+		shellState.Vi = &ViEditor{}
+	}
+	if this.Config.ShellPluginDir != "" {
+		plugins, err := LoadPlugins(this.Config.ShellPluginDir, shellState)
+		if err != nil {
+			log.Printf("Unable to load plugins: %s", err)
+		} else if len(plugins.Commands) > 0 || len(plugins.preprocessors) > 0 || len(plugins.Errors) > 0 {
+			shellState.Plugins = plugins
+		}
+	}
+	if this.Config.ShellNotifyCommand != "" {
+		shellState.Notifier = NewNotifier(this.Config.ShellNotifyCommand,
+			this.Config.ShellNotifyAfter, parentOut)
+		parentOut.Write(focusReportingOn)
+		defer parentOut.Write(focusReportingOff)
 	}
 
+	shellState.History.SetTerminalSize(termWidth, termHeight)
 	shellState.Prompt.SetTerminalWidth(termWidth)
 	shellState.Prompt.SetColor(colorScheme.Prompt)
+	for _, name := range this.Config.ShellCapitalizedCommands {
+		shellState.CapitalizedCommands[name] = true
+	}
+
+	if this.Config.StateBaseDir != "" {
+		sessionsDir := SessionsDir(ProfileStateDir(this.Config.StateBaseDir, this.Config.ProfileName()))
+		shellState.Session = NewSessionTranscript(sessionsDir, NewSessionID(time.Now()))
+		go func() {
+			err := shellState.Session.RecordEnvironment(this.Ctx, this.Config)
+			if err != nil {
+				log.Printf("Unable to record session environment: %s", err)
+			}
+		}()
+
+		socketPath := ScreenSocketPath(this.Config.StateBaseDir, shellState.Session.ID)
+		listener, err := ServeScreen(socketPath, shellState.Screen, shellState.historyExport)
+		if err != nil {
+			log.Printf("Unable to serve the screen for snap: %s", err)
+		} else {
+			defer listener.Close()
+		}
+	}
+
+	if this.Config.ShellResume != nil {
+		shellState.resumeHistory(this.Config.ShellResume)
+	}
+
+	// capture the pane before we show any of the child shell's output
+	if this.Config.ShellTmuxContext {
+		_, err := shellState.AddTmuxContext("")
+		if err != nil {
+			log.Printf("Unable to add tmux context: %s", err)
+		}
+	}
 
 	go readerToChannel(childOut, childOutReader)
 	go readerToChannelWithPosition(parentIn, parentInReader, parentPositionChan)
@@ -669,6 +985,28 @@ func (this *ButterfishCtx) ShellMultiplexer(
 
 	// start
 	shellState.Mux()
+
+	sessionID := ""
+	if shellState.Session != nil {
+		sessionID = shellState.Session.ID
+	}
+	this.Hooks.SessionEnd(sessionID)
+}
+
+// Returns true if this child output belongs to an excluded command and should
+// stay out of the history. A prompt means the command finished.
+func (this *ShellState) excludeChildOut(childOutStr string, prompts int) bool {
+	if !this.ExcludingOutput {
+		return false
+	}
+	if prompts > 0 {
+		this.ExcludingOutput = false
+	}
+	if childOutStr != "" && !this.excludedOutputCounted {
+		this.excludedOutputCounted = true
+		this.ExcludedBlocks++
+	}
+	return true
 }
 
 func (this *ShellState) Errorf(format string, args ...any) {
@@ -691,18 +1029,15 @@ type CommandParams struct {
 	Cmd string `json:"cmd"`
 }
 
-var commandRegex = regexp.MustCompile("^\\s*\\{\\s*\"cmd\"\\s*:\\s*\"(.*)\"\\s*\\}\\s*$")
-
 // Parse the arguments from the command function returned in a Chat completion.
-// We parse this with a regex rather than unmarshalling because the command
-// may contain unescaped quotes, which would cause the unmarshal to fail.
+// The command may contain unescaped quotes or bash escapes, which RepairJSON
+// fixes.
 func parseCommandParams(params string) (string, error) {
-	// get cmd value using commandRegex
-	matches := commandRegex.FindStringSubmatch(params)
-	if len(matches) != 2 {
+	var commandParams CommandParams
+	if err := unmarshalToolArguments(params, &commandParams); err != nil {
 		return "", fmt.Errorf("Unable to parse command params: %s", params)
 	}
-	cmd := matches[1]
+	cmd := commandParams.Cmd
 
 	// check for an uneven number of quotes
 	if strings.Count(cmd, "\"")%2 == 1 {
@@ -722,25 +1057,29 @@ type UserInputParams struct {
 func parseUserInputParams(params string) (string, error) {
 	// unmarshal UserInputParams from FunctionParameters
 	var userInputParams UserInputParams
-	err := json.Unmarshal([]byte(params), &userInputParams)
+	err := unmarshalToolArguments(params, &userInputParams)
 	return userInputParams.Question, err
 }
 
 type FinishParams struct {
 	Success bool `json:"success"`
+	// Only asked of sub-agents
+	Summary string `json:"summary,omitempty"`
 }
 
-func parseFinishParams(params string) (bool, error) {
+func parseFinishParams(params string) (*FinishParams, error) {
 	// unmarshal FinishParams from FunctionParameters
 	var finishParams FinishParams
-	err := json.Unmarshal([]byte(params), &finishParams)
-	return finishParams.Success, err
+	err := unmarshalToolArguments(params, &finishParams)
+	return &finishParams, err
 }
 
 // TODO add a diagram of streams here
 func (this *ShellState) Mux() {
 	log.Printf("Started shell mux")
 	childOutBuffer := []byte{}
+	// the part of the buffered output that goes in the history
+	childOutBufferHistory := []byte{}
 
 	for {
 		select {
@@ -766,7 +1105,7 @@ func (this *ShellState) Mux() {
 
 		// the terminal window resized and we got a SIGWINCH
 		case <-this.Sigwinch:
-			termWidth, _, err := term.GetSize(int(os.Stdout.Fd()))
+			termWidth, termHeight, err := term.GetSize(int(os.Stdout.Fd()))
 			if err != nil {
 				log.Printf("Error getting terminal size after SIGWINCH: %s", err)
 			}
@@ -774,6 +1113,8 @@ func (this *ShellState) Mux() {
 				log.Printf("Got SIGWINCH with new width %d", termWidth)
 			}
 			this.TerminalWidth = termWidth
+			this.Screen.Resize(termWidth, termHeight)
+			this.History.SetTerminalSize(termWidth, termHeight)
 			this.Prompt.SetTerminalWidth(termWidth)
 			this.StyleWriter.SetTerminalWidth(termWidth)
 			if this.AutosuggestBuffer != nil {
@@ -795,7 +1136,7 @@ func (this *ShellState) Mux() {
 				buffer = this.Prompt
 			case stateShell, stateNormal:
 				buffer = this.Command
-			case statePromptResponse:
+			case statePromptResponse, stateInlineEdit, stateConfirmGoal, stateReverseSearch:
 				continue
 			default:
 				log.Printf("Got autosuggest result in unexpected state %d", this.State)
@@ -804,11 +1145,29 @@ func (this *ShellState) Mux() {
 
 			this.ShowAutosuggest(buffer, result, col-1, this.TerminalWidth)
 
+		// We got a rewritten command for an inline edit
+		case result := <-this.InlineEditChan:
+			this.InlineEditDone(result)
+			this.ParentInputLoop([]byte{})
+
 		// We got an LLM prompt response, handle the response by adding to history,
 		// calling functions returned, etc.
 		case output := <-this.PromptOutputChan:
+			// A refusal stays in history and tends to make the model refuse
+			// related follow-ups, so we drop it and the prompt that caused it
+			if output.Refusal != "" {
+				this.History.RemoveLastPrompt()
+				output = &util.CompletionResponse{}
+				if this.GoalMode {
+					fmt.Fprintf(this.PromptGoalAnswerWriter, "%sExited goal mode.%s\n", this.Color.Answer, this.Color.Command)
+					this.GoalMode = false
+				}
+			}
+
 			historyData := output.Completion
-			if historyData != "" {
+			if output.Interrupted {
+				this.History.AddInterruptedAnswer(historyData)
+			} else if historyData != "" {
 				this.History.Append(historyTypeLLMOutput, historyData)
 			}
 			if output.FunctionName != "" {
@@ -818,12 +1177,22 @@ func (this *ShellState) Mux() {
 			// If there is child output waiting to be printed, print that now
 			if len(childOutBuffer) > 0 {
 				this.ParentOut.Write(childOutBuffer)
-				this.History.Append(historyTypeShellOutput, string(childOutBuffer))
+				this.History.Append(historyTypeShellOutput, string(childOutBufferHistory))
 				childOutBuffer = []byte{}
+				childOutBufferHistory = []byte{}
+			}
+
+			// Get a new prompt, or open a long answer in the pager
+			if !output.Interrupted {
+				this.pageLongAnswer(historyData)
+			}
+			if !this.openPager() {
+				this.ChildIn.Write([]byte("\n"))
 			}
 
-			// Get a new prompt
-			this.ChildIn.Write([]byte("\n"))
+			if !this.GoalMode && !output.Interrupted {
+				this.Notifier.Done(NotifyEventAnswer, "Butterfish answered your prompt")
+			}
 
 			if this.GoalMode {
 				this.ActiveFunction = output.FunctionName
@@ -833,10 +1202,18 @@ func (this *ShellState) Mux() {
 				}
 			}
 
-			this.RequestAutosuggest(0, "")
-			this.setState(stateNormal)
+			if this.AnswerCommand != "" {
+				this.typeAnswerCommand()
+			} else {
+				this.RequestAutosuggest(0, "")
+				this.setState(stateNormal)
+			}
 			this.ParentInputLoop([]byte{})
 
+		// A prompt answered in the background finished
+		case output := <-this.BackgroundOutputChan:
+			this.backgroundAnswerDone(output)
+
 		case childOutMsg := <-this.ChildOutReader:
 			if childOutMsg == nil {
 				log.Println("Child out reader closed")
@@ -850,6 +1227,16 @@ func (this *ShellState) Mux() {
 
 			lastStatus, prompts, childOutStr := this.ParsePS1(string(childOutMsg.Data))
 			this.PromptSuffixCounter += prompts
+			if prompts > 0 {
+				this.History.FinishCommand(lastStatus, time.Now())
+			}
+			excluded := this.excludeChildOut(childOutStr, prompts)
+			// snap shouldn't see excluded output either
+			if excluded {
+				this.Screen.WriteHidden([]byte(childOutStr))
+			} else {
+				this.Screen.Write([]byte(childOutStr))
+			}
 
 			if prompts > 0 && this.State == stateNormal && !this.GoalMode {
 				// If we get a prompt and we're at the start of a command
@@ -865,6 +1252,9 @@ func (this *ShellState) Mux() {
 				// In goal mode we throw it away
 				if !this.GoalMode {
 					childOutBuffer = append(childOutBuffer, childOutStr...)
+					if !excluded {
+						childOutBufferHistory = append(childOutBufferHistory, childOutStr...)
+					}
 				}
 				continue
 			}
@@ -885,7 +1275,8 @@ func (this *ShellState) Mux() {
 			// If we're getting child output while typing in a shell command, this
 			// could mean the user is paging through old commands, or doing a tab
 			// completion, or something unknown, so we don't want to add to history.
-			if this.State != stateShell && !this.FilterChildOut(string(childOutMsg.Data)) {
+			if this.State != stateShell && this.State != stateInlineEdit &&
+				this.State != stateReverseSearch && !excluded && !this.FilterChildOut(string(childOutMsg.Data)) {
 				if this.ActiveFunction != "" {
 					this.History.AppendFunctionOutput(this.ActiveFunction, childOutStr)
 				} else {
@@ -913,15 +1304,33 @@ func (this *ShellState) Mux() {
 			}
 
 			this.ParentOut.Write([]byte(childOutStr))
+			this.Notifier.ChildOutput(childOutStr)
+
+			// a background answer waits for the next prompt
+			if prompts > 0 && this.Background != nil && this.atIdlePrompt() {
+				this.printBackgroundAnswer()
+			}
+
+			if prompts > 0 && lastStatus != 0 && this.State == stateNormal && !this.GoalMode {
+				this.AutoDebug(lastStatus)
+			}
 
 			if endOfFunctionCall {
 				// move cursor to the beginning of the line and clear the line
 				fmt.Fprintf(this.ParentOut, "\r%s", ESC_CLEAR)
 				var status string
+				var repairErr error
 				if this.ActiveFunction == "command" {
 					status = fmt.Sprintf("Exit Code: %d\n", lastStatus)
+					repairErr = this.GoalModeRepair.Record(lastStatus)
+					this.GoalModeUsage.Commands++
+				}
+				if repairErr != nil {
+					this.History.AppendFunctionOutput(this.ActiveFunction, status)
+					this.GoalModeStop(repairErr)
+				} else {
+					this.GoalModeFunctionResponse(status)
 				}
-				this.GoalModeFunctionResponse(status)
 				this.ActiveFunction = ""
 				this.GoalModeBuffer = ""
 				this.PromptSuffixCounter = 0
@@ -961,6 +1370,15 @@ func (this *ShellState) ParentInputLoop(data []byte) {
 		return
 	}
 
+	// focus reports are for notifications, unless the child asked for them
+	data, focusReports := this.Notifier.FilterFocus(data)
+	if len(focusReports) > 0 {
+		this.ChildIn.Write(focusReports)
+	}
+	if len(data) == 0 {
+		return
+	}
+
 	for {
 		// The InputFromParent function consumes bytes from the passed in data
 		// buffer and returns unprocessed bytes, so we loop and continue to
@@ -1026,18 +1444,49 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 			if this.Prompt != nil {
 				this.Prompt.Clear()
 			}
+			if this.Vi != nil {
+				this.Vi.Reset(0)
+			}
 			this.setState(stateNormal)
 			this.ChildIn.Write([]byte{data[0]})
 
 			return data[1:]
 		}
 
-		// Check if the first character is uppercase or a bang
-		if unicode.IsUpper(rune(data[0])) || data[0] == '!' {
+		if this.Vi != nil && (this.Vi.Normal || viEscapeIndex(data) == 0) {
+			// keys in vi normal mode are commands, not the start of a prompt
+			if this.Command == nil {
+				this.Command = NewShellBuffer()
+			}
+			index := bytes.IndexByte(data, '\r')
+			if index == 0 {
+				this.Vi.Reset(0)
+				this.ChildIn.Write(data[:1])
+				return data[1:]
+			} else if index > 0 {
+				this.ViInput(data[:index])
+				return data[index:]
+			}
+			this.ViInput(data)
+			return nil
+		}
+
+		if data[0] == keyReverseSearch {
+			return this.ReverseSearchStart(data)
+		}
+
+		if this.partialPromptPrefix(data) {
+			// could be the start of the prompt prefix, wait for the rest
+			return data
+		}
+
+		// Check if the input starts with an uppercase letter, the prompt
+		// prefix, or a bang
+		if start := this.promptStartLength(data); start > 0 {
 			this.setState(statePrompting)
 			this.ClearAutosuggest(this.Color.Command)
 			this.Prompt.Clear()
-			this.Prompt.Write(string(data))
+			this.Prompt.Write(string(data[:start]))
 
 			// Write the actual prompt start
 			color := this.Color.Prompt
@@ -1045,13 +1494,13 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 				color = this.Color.PromptGoal
 			}
 			this.Prompt.SetColor(color)
-			fmt.Fprintf(this.ParentOut, "%s%s", color, data)
+			fmt.Fprintf(this.ParentOut, "%s%s", color, data[:start])
 
 			// We're starting a prompt managed here in the wrapper, so we want to
 			// get the cursor position
 			_, col := this.GetCursorPosition()
-			this.Prompt.SetPromptLength(col - 1 - this.Prompt.Size())
-			return data[1:]
+			this.Prompt.SetPromptLength(col - 1 - this.Prompt.Width())
+			return data[start:]
 
 		} else if data[0] == '\t' { // user is asking to fill in an autosuggest
 			if this.LastAutosuggest != "" {
@@ -1068,10 +1517,16 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 		} else if data[0] == '\r' {
 			this.ClearAutosuggest(this.Color.Command)
 			this.ChildIn.Write(data)
+			if this.Vi != nil {
+				this.Vi.Reset(0)
+			}
 			return data[1:]
 
 		} else {
 			this.Command = NewShellBuffer()
+			if this.Vi != nil {
+				this.Vi.Reset(this.Screen.CursorColumn())
+			}
 			this.Command.Write(string(data))
 
 			if this.Command.Size() > 0 {
@@ -1094,17 +1549,28 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 			index := bytes.Index(data, []byte{'\r'})
 			toAdd := data[:index]
 			toPrint := this.Prompt.Write(string(toAdd))
-
 			this.ParentOut.Write(toPrint)
+
+			if this.isCapitalizedCommand(this.Prompt.String()) {
+				// let the shell state handle the carriage return
+				this.promptToCommand()
+				return data[index:]
+			}
 			this.ParentOut.Write([]byte("\n\r"))
 
-			promptStr := this.Prompt.String()
+			promptStr := this.promptText()
 			if this.HandleLocalPrompt() {
 				// This was a local prompt like "help", we're done now
 				return data[index+1:]
 			}
 
-			if promptStr[0] == '!' {
+			if promptStr == "" {
+				// just the prompt prefix
+				this.Prompt.Clear()
+				this.ParentOut.Write([]byte(this.Color.Command))
+				this.setState(stateNormal)
+				this.ChildIn.Write([]byte{'\r'})
+			} else if promptStr[0] == '!' {
 				this.GoalModeStart()
 			} else if this.GoalMode {
 				this.GoalModeChat()
@@ -1113,7 +1579,7 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 			}
 			return data[index+1:]
 
-		} else if data[0] == '!' && this.Prompt.String() == "!" {
+		} else if data[0] == '!' && this.promptText() == "!" {
 			// If the user is prefixing the prompt with two bangs then they may
 			// be entering unsafe goal mode, color the prompt accordingly
 			this.Prompt.SetColor(this.Color.PromptGoalUnsafe)
@@ -1145,6 +1611,14 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 
 		} else { // otherwise user is typing a prompt
 			toPrint := this.Prompt.Write(string(data))
+			prompt := this.Prompt.String()
+			if space := strings.Index(prompt, " "); space >= len(prompt)-len(data) &&
+				this.isCapitalizedCommand(prompt) {
+				// the first word was just finished and it's an executable
+				this.ParentOut.Write(toPrint)
+				this.promptToCommand()
+				return nil
+			}
 			this.RefreshAutosuggest(data, this.Prompt, this.Color.Prompt)
 			this.ParentOut.Write(toPrint)
 
@@ -1155,6 +1629,17 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 		}
 
 	case stateShell:
+		if len(this.InlineEditKey) > 0 {
+			if bytes.HasPrefix(data, this.InlineEditKey) {
+				this.InlineEditStart()
+				return data[len(this.InlineEditKey):]
+			}
+			if bytes.HasPrefix(this.InlineEditKey, data) {
+				// could be the start of the key, wait for the rest
+				return data
+			}
+		}
+
 		if hasCarriageReturn { // user is submitting a command
 			this.ClearAutosuggest(this.Color.Command)
 
@@ -1162,7 +1647,12 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 
 			index := bytes.Index(data, []byte{'\r'})
 			this.ChildIn.Write(data[:index+1])
-			this.History.Append(historyTypeShellInput, this.Command.String())
+			command := this.Command.String()
+			if this.Vi != nil {
+				command = this.viCommand()
+				this.Vi.Reset(0)
+			}
+			this.submitCommand(command)
 			this.Command = NewShellBuffer()
 
 			if this.AutosuggestCancel != nil {
@@ -1172,8 +1662,14 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 
 			return data[index+1:]
 
+		} else if data[0] == keyReverseSearch {
+			return this.ReverseSearchStart(data)
+
 		} else if data[0] == 0x03 { // Ctrl-C
 			this.Command.Clear()
+			if this.Vi != nil {
+				this.Vi.Reset(0)
+			}
 			this.setState(stateNormal)
 			this.ChildIn.Write([]byte{data[0]})
 
@@ -1195,6 +1691,9 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 			}
 			return data[1:]
 
+		} else if this.Vi != nil {
+			this.ViInput(data)
+
 		} else { // otherwise user is typing a command
 			this.Command.Write(string(data))
 			this.RefreshAutosuggest(data, this.Command, this.Color.Command)
@@ -1204,6 +1703,15 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 			}
 		}
 
+	case stateInlineEdit:
+		return this.InlineEditInput(data)
+
+	case stateConfirmGoal:
+		return this.GoalModeConfirmInput(data)
+
+	case stateReverseSearch:
+		return this.ReverseSearchInput(data)
+
 	default:
 		panic("Unknown state")
 	}
@@ -1211,6 +1719,18 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 	return nil
 }
 
+// Add a command the user ran to the history, unless it's excluded
+func (this *ShellState) submitCommand(command string) {
+	if this.Excluder.Excluded(command) {
+		log.Printf("Excluding command from history")
+		this.ExcludingOutput = true
+		this.excludedOutputCounted = false
+		this.ExcludedBlocks++
+		return
+	}
+	this.History.AddCommand(command, time.Now())
+}
+
 // We want to queue up the prompt response, which does the processing (except
 // for actually printing it). The processing like adding to history or
 // executing the next step in goal mode. We have to do this in a goroutine
@@ -1225,15 +1745,141 @@ func (this *ShellState) PrintStatus() {
 	text := fmt.Sprintf("You're using Butterfish Shell\n%s\n\n", this.Butterfish.Config.BuildInfo)
 
 	if this.GoalMode {
-		text += fmt.Sprintf("You're in Goal mode, the goal you've given to the agent is:\n%s\n\n", this.GoalModeGoal)
+		text += fmt.Sprintf("You're in Goal mode, the goal you've given to the agent is:\n%s\n", this.GoalModeGoal)
+		text += fmt.Sprintf("Used so far: %s\n\n", this.GoalModeUsage)
 	}
 
+	if this.Session != nil {
+		text += fmt.Sprintf("Session:               %s\n", this.Session.ID)
+	}
+	text += fmt.Sprintf("Profile:               %s\n", this.Butterfish.Config.ProfileName())
+	if tracking := findUsageTracker(this.Butterfish.LLMClient); tracking != nil {
+		usage := tracking.Tracker.CurrentMonth()
+		text += fmt.Sprintf("Usage this month:      %d requests, ~%d tokens", usage.Requests, usage.Total())
+		if tracking.Budget > 0 {
+			text += fmt.Sprintf(" of %d budget", tracking.Budget)
+		}
+		text += "\n"
+
+		models := tracking.Tracker.CurrentMonthModels()
+		names := []string{}
+		for name, counts := range models {
+			if counts.Latency != nil {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			text += fmt.Sprintf("Latency %-14s %s\n", name+":", models[name].Latency)
+		}
+	}
 	text += fmt.Sprintf("Prompting model:       %s\n", this.Butterfish.Config.ShellPromptModel)
-	text += fmt.Sprintf("Prompt history window: %d tokens\n", this.PromptMaxTokens)
+	if profile := this.Butterfish.Config.Profile; profile != nil && len(profile.Fallbacks) > 0 {
+		models := []string{}
+		for _, fallback := range profile.Fallbacks {
+			models = append(models, fallback.Model)
+		}
+		text += fmt.Sprintf("Fallback models:       %s\n", strings.Join(models, ", "))
+	}
+	this.updateTokenBudgets()
+	text += fmt.Sprintf("Prompt context window: %s\n",
+		contextWindowDescription(this.Butterfish.Config.ShellPromptModel))
+	text += fmt.Sprintf("Prompt history window: %d tokens%s\n", this.PromptMaxTokens,
+		compactHistoryNote(this.PromptCompactHistory))
+	text += fmt.Sprintf("Response budget:       %d tokens\n", this.ResponseMaxTokens)
+	text += fmt.Sprintf("History block budget:  %d tokens\n", this.HistoryBlockMaxTokens)
+	text += fmt.Sprintf("Prompt temperature:    %g\n", this.PromptTemperature)
+	text += fmt.Sprintf("Prompt trigger:        %s\n", triggerDescription(this.PromptPrefix))
+	text += fmt.Sprintf("Goal mode limits:      %s\n", this.Butterfish.Config.GoalLimits)
+	if this.Persona != nil {
+		text += fmt.Sprintf("Persona:               %s\n", this.Persona.Name)
+	}
+	if this.SystemMessage != "" {
+		text += fmt.Sprintf("System message:        %s\n", this.SystemMessage)
+	}
+	if len(this.Variables) > 0 {
+		text += fmt.Sprintf("Variables:             %s\n", strings.Join(this.variableNames(), ", "))
+	}
+	if shortcuts := shortcutNames(this.Butterfish.PromptLibrary); len(shortcuts) > 0 {
+		text += fmt.Sprintf("Shortcuts:             /%s\n", strings.Join(shortcuts, ", /"))
+	}
+	if this.Notifier != nil {
+		text += fmt.Sprintf("Notify:                %s\n", this.Notifier.Describe())
+	}
+	if this.Plugins != nil {
+		text += fmt.Sprintf("Plugins:               %s\n", this.Plugins.Describe())
+	}
+	if this.Butterfish.Config.ShellTmuxContext {
+		text += fmt.Sprintf("Tmux context:          %t\n", inTmux())
+	}
+	if this.Butterfish.Config.ShellPager {
+		text += fmt.Sprintf("Pager:                 %s for long answers\n", resolvePager())
+	}
+	if this.Butterfish.Config.ShellBackgroundAnswers {
+		background := "on"
+		if this.Background != nil {
+			background = "on, answering a prompt"
+		}
+		text += fmt.Sprintf("Background answers:    %s\n", background)
+	}
+	if this.Butterfish.Config.ShellIndexContext {
+		text += fmt.Sprintf("Index context:         up to %d tokens\n", this.Butterfish.Config.ShellIndexContextTokens)
+	}
+	text += fmt.Sprintf("Excluded from history: %d blocks\n", this.ExcludedBlocks)
 	text += fmt.Sprintf("Autosuggest:           %t\n", this.Butterfish.Config.ShellAutosuggestEnabled)
 	text += fmt.Sprintf("Autosuggest model:     %s\n", this.Butterfish.Config.ShellAutosuggestModel)
 	text += fmt.Sprintf("Autosuggest timeout:   %s\n", this.Butterfish.Config.ShellAutosuggestTimeout)
-	text += fmt.Sprintf("Autosuggest history:   %d tokens\n", this.AutosuggestMaxTokens)
+	text += fmt.Sprintf("Autosuggest context:   %s\n",
+		contextWindowDescription(this.Butterfish.Config.ShellAutosuggestModel))
+	text += fmt.Sprintf("Autosuggest history:   %d tokens%s\n", this.AutosuggestMaxTokens,
+		compactHistoryNote(this.AutosuggestCompactHistory))
+	limits := []string{}
+	for _, feature := range Features {
+		featureLimits := this.Butterfish.Config.RequestLimits[feature]
+		limits = append(limits, fmt.Sprintf("%s %s/%d retries", feature, featureLimits.Timeout, featureLimits.Retries))
+	}
+	text += fmt.Sprintf("Request limits:        %s\n", strings.Join(limits, ", "))
+	fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s", this.Color.Answer, text, this.Color.Command)
+	this.SendPromptResponse(text)
+}
+
+// Request metrics for this session by model, to help pick a model and a
+// --token-timeout
+func sessionStatsText(models map[string]UsageCounts, tokenTimeout time.Duration) string {
+	if len(models) == 0 {
+		return "No requests yet this session\n"
+	}
+
+	names := []string{}
+	for name := range models {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	text := "Requests this session:\n"
+	for _, name := range names {
+		counts := models[name]
+		text += fmt.Sprintf("\n%s\n", name)
+		text += fmt.Sprintf("  Requests:            %d\n", counts.Requests)
+		text += fmt.Sprintf("  Tokens:              ~%d prompt, ~%d completion\n",
+			counts.PromptTokens, counts.CompletionTokens)
+		if latency := counts.Latency; latency != nil {
+			text += fmt.Sprintf("  Latency:             %s\n", latency)
+			if latency.Streamed > 0 {
+				text += fmt.Sprintf("  Slowest first token: %s, token timeout is %s\n",
+					time.Duration(latency.MaxFirstTokenMs)*time.Millisecond, tokenTimeout)
+			}
+			text += fmt.Sprintf("  Retries:             %d\n", latency.Retries)
+		}
+	}
+	return text
+}
+
+func (this *ShellState) PrintStats() {
+	text := "Request stats aren't available without usage tracking\n"
+	if tracking := findUsageTracker(this.Butterfish.LLMClient); tracking != nil {
+		text = sessionStatsText(tracking.Tracker.SessionModels(), this.Butterfish.Config.TokenTimeout)
+	}
 	fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s", this.Color.Answer, text, this.Color.Command)
 	this.SendPromptResponse(text)
 }
@@ -1243,19 +1889,37 @@ func (this *ShellState) PrintHelp() {
 
 	- Type a normal command, like "ls -l" and press enter to execute it
 	- Start a command with a capital letter to send it to GPT, like "How do I find local .py files?"
+	- Type "Trigger <prefix>" to start prompts with a prefix instead, e.g. "Trigger :" and then ":how do I find local .py files?", so commands like Rscript go to the shell. "Trigger capital" goes back to capital letters
 	- Autosuggest will print command completions, press tab to fill them in
+	- While typing a command, press the inline edit key (ctrl-x ctrl-b by default) and type an instruction like "make it recursive" to have GPT rewrite the command without running it
 	- GPT will be able to see your shell history, so you can ask contextual questions like "why didn't my last command work?"
 	- Type "Status" to show the current Butterfish configuration
+	- Type "Stats" to show request latency and token counts for this session
 	- Type "History" to show the recent history that will be sent to GPT
+	- Type "History export [path]" to save this session's prompts, answers, commands, and output as a markdown transcript, or JSON if the path ends in .json, with secrets redacted
+	- Press Ctrl-C to stop an answer, the part you saw stays in the history. Type "Continue" to have GPT pick up where it stopped
+	- Type "Page" to open the last answer in your pager
+	- Type "Profile <name>" to switch to a profile from ~/.config/butterfish/config.yaml
+	- Type "Key <key>" to use a new API key if the current one was rejected, "Key" shows where the key comes from
+	- Type "Model <name>" to switch the prompting model, e.g. "Model gpt-4o"
+	- Type "Temp <value>" to set the prompting temperature, e.g. "Temp 0.2"
+	- Type "System: <text>" to replace the system message for this session, "System: default" restores it
+	- Type "Persona <name>" to switch to a persona from ~/.config/butterfish/config.yaml, a system message with its own model and temperature, "Persona default" goes back
+	- Type "Context tmux [pane]" to add the scrollback of a tmux pane to the history, defaults to this pane
+	- Type "Find: <query>" to search past commands by meaning, e.g. "Find: the curl that posted to the api"
+	- Type "Set <name>=<value>" to save text for this session, then use {name} in prompts, e.g. "Set ticket=ENG-1234" and "Write a branch name for {ticket}". "Get <name>" prints it
+	- Type "Run" to put the command from the code block in the last answer on the command line, ready to run with enter, or "Copy" to copy the code block to the clipboard
+	- Start a prompt with the name of a shortcut from the prompt library and a colon, like "Review:", "Explain:" or "Tldr:", or with "review" or "/review" after a prompt prefix, to send that prompt with the text after it and the last command's output. "Status" lists the shortcuts
+	- Add your own commands and prompt preprocessors with Starlark plugins in ~/.config/butterfish/plugins, "Status" lists the plugin commands
 `
 	fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s", this.Color.Answer, text, this.Color.Command)
 	this.SendPromptResponse(text)
 }
 
 func (this *ShellState) PrintHistory() {
-	maxHistoryBlockTokens := this.Butterfish.Config.ShellMaxHistoryBlockTokens
+	maxHistoryBlockTokens := this.HistoryBlockMaxTokens
 	historyBlocks, _ := getHistoryBlocksByTokens(this.History, this.getPromptEncoder(),
-		maxHistoryBlockTokens, this.PromptMaxTokens, 4)
+		maxHistoryBlockTokens, this.PromptMaxTokens, 4, this.PromptCompactHistory)
 	strBuilder := strings.Builder{}
 
 	for _, block := range historyBlocks {
@@ -1281,7 +1945,7 @@ func (this *ShellState) PrintHistory() {
 
 func (this *ShellState) GoalModeStart() {
 	// Get the prompt after the bang
-	goal := this.Prompt.String()[1:]
+	goal := this.expandedPromptText()[1:]
 	if goal == "" {
 		return
 	}
@@ -1289,29 +1953,122 @@ func (this *ShellState) GoalModeStart() {
 	// If the prompt is preceded with two bangs then go to unsafe mode
 	if goal[0] == '!' {
 		goal = goal[1:]
+		profile := this.Butterfish.Config.Profile
+		if profile != nil && profile.DisableUnsafeGoalMode {
+			this.PrintError(fmt.Errorf("Unsafe goal mode is disabled by profile %s", profile.Name))
+			this.Prompt.Clear()
+			return
+		}
 		this.GoalModeUnsafe = true
 	} else {
 		this.GoalModeUnsafe = false
 	}
 
+	if !this.GoalModeCostConfirmed {
+		estimate := this.goalModeCostEstimate(goal)
+		threshold := this.Butterfish.Config.CostThreshold
+		if estimate != nil && estimate.OverThreshold(threshold) {
+			this.GoalModePending = this.promptText()
+			this.Prompt.Clear()
+			this.setState(stateConfirmGoal)
+			fmt.Fprintf(this.ParentOut, "%sGoal mode will send %s over %d steps, more than the cost threshold of $%.2f. Start? [y/N] %s",
+				this.Color.Answer, estimate, goalModeEstimatedSteps, threshold, this.Color.Command)
+			return
+		}
+	}
+	this.GoalModeCostConfirmed = false
+
 	this.GoalMode = true
+	// in the shell the user confirms a command by pressing enter
+	this.GoalModeRepair = &CommandRepair{
+		Policy:      PolicyConfirm,
+		MaxAttempts: this.Butterfish.Config.MaxFixAttempts,
+	}
+	if this.GoalModeUnsafe {
+		this.GoalModeRepair.Policy = PolicyAuto
+	}
+	this.GoalModeUsage = NewGoalUsage(this.Butterfish.Config.GoalLimits)
 	fmt.Fprintf(this.PromptGoalAnswerWriter, "%sGoal mode starting...%s\n", this.Color.Answer, this.Color.Command)
 	this.GoalModeGoal = goal
 	this.Prompt.Clear()
 
 	prompt := "Start now."
 	log.Printf("Starting goal mode: %s", this.GoalModeGoal)
+	this.Notifier.Start()
 	this.goalModePrompt(prompt)
 }
 
+// A goal usually takes a handful of commands, each step sends the whole
+// context again
+const goalModeEstimatedSteps = 10
+
+// Estimate what a goal will send from the size of its first request, nil if
+// we can't build the request
+func (this *ShellState) goalModeCostEstimate(goal string) *CostEstimate {
+	model := this.Butterfish.Config.ShellPromptModel
+	sysMsg, err := this.Butterfish.PromptLibrary.GetPromptForModel(
+		prompt.GoalModeSystemMessage, model,
+		"goal", goal,
+		"sysinfo", this.Butterfish.SystemInfo(childShellDir()))
+	if err != nil {
+		return nil
+	}
+	functions := getGoalModeFunctionsString()
+	lastPrompt, historyBlocks, err := this.AssembleChat("Start now.", sysMsg, functions, agentResponseTokens)
+	if err != nil {
+		return nil
+	}
+
+	encoder := this.getPromptEncoder()
+	tokens := len(encoder.Encode(sysMsg+functions+lastPrompt, nil, nil))
+	for _, block := range historyBlocks {
+		tokens += len(encoder.Encode(block.Content, nil, nil))
+	}
+	return &CostEstimate{
+		Model:    model,
+		Tokens:   tokens * goalModeEstimatedSteps,
+		Requests: goalModeEstimatedSteps,
+	}
+}
+
+// Start the pending goal if the user answers y, anything else cancels it
+func (this *ShellState) GoalModeConfirmInput(data []byte) []byte {
+	pending := this.GoalModePending
+	this.GoalModePending = ""
+	this.ParentOut.Write([]byte("\n\r"))
+
+	if data[0] != 'y' && data[0] != 'Y' {
+		this.setState(statePromptResponse)
+		this.printLocalResponse("Goal mode canceled\n")
+		return data[1:]
+	}
+
+	this.setState(statePrompting)
+	this.Prompt.Write(pending)
+	this.GoalModeCostConfirmed = true
+	this.GoalModeStart()
+	return data[1:]
+}
+
 func (this *ShellState) GoalModeChat() {
-	prompt := this.Prompt.String()
+	prompt := this.expandedPromptText()
 	this.Prompt.Clear()
 
 	log.Printf("Goal mode chat: %s\n", prompt)
+	this.Notifier.Start()
 	this.goalModePrompt(prompt)
 }
 
+// Leave goal mode without asking the LLM for another step
+func (this *ShellState) GoalModeStop(reason error) {
+	log.Printf("Goal mode stopping: %s", reason)
+	this.GoalMode = false
+	this.setState(stateNormal)
+	fmt.Fprintf(this.PromptGoalAnswerWriter, "%sExited goal mode with FAILURE: %s.%s\n",
+		this.Color.Answer, reason, this.Color.Command)
+	this.Notifier.Done(NotifyEventGoalFinish, "Goal mode failed")
+}
+
 func (this *ShellState) GoalModeFunctionResponse(output string) {
 	log.Printf("Goal mode response: %s\n", output)
 	if output != "" {
@@ -1322,147 +2079,73 @@ func (this *ShellState) GoalModeFunctionResponse(output string) {
 }
 
 func (this *ShellState) GoalModeFunction(output *util.CompletionResponse) {
-	switch output.FunctionName {
-	case "command":
-		log.Printf("Goal mode command: %s", output.FunctionParameters)
-		this.GoalModeBuffer = ""
-		this.PromptSuffixCounter = 0
-		this.setState(stateNormal)
-		cmd, err := parseCommandParams(output.FunctionParameters)
+	this.GoalModeBuffer = ""
+	this.GoalModeUsage.AddTokens(estimateResponseTokens(output))
+	if limit := this.GoalModeUsage.Reached; limit != "" && !isGoalStopFunction(output.FunctionName) {
+		this.GoalModeStop(fmt.Errorf("the agent didn't stop after reaching %s", limit))
+		return
+	}
+	action := parseAgentAction(output)
+
+	switch action.Kind {
+	case agentActionCommand:
+		log.Printf("Goal mode command: %s", action.Command)
+		err := this.Butterfish.Hooks.PreCommand(this.Butterfish.Ctx, action.Command, childShellDir())
 		if err != nil {
-			// we failed to parse the command json, send error back to model
-			log.Printf("Error parsing function arguments: %s", err)
-			modelStr := fmt.Sprintf("Error parsing your json, try again: %s", err)
-			this.GoalModeFunctionResponse(modelStr)
+			fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s\n", this.Color.Error, err, this.Color.Command)
+			this.GoalModeFunctionResponse(err.Error())
 			return
 		}
-		log.Printf("Goal mode command: %s", cmd)
-		fmt.Fprintf(this.ChildIn, "%s", cmd)
-		if this.GoalModeUnsafe {
+		this.PromptSuffixCounter = 0
+		this.setState(stateNormal)
+		fmt.Fprintf(this.ChildIn, "%s", action.Command)
+		if this.GoalModeRepair.Policy == PolicyAuto {
 			fmt.Fprintf(this.ChildIn, "\n")
 		}
 
-	case "user_input":
-		log.Printf("Goal mode user_input: %s", output.FunctionParameters)
-		this.GoalModeBuffer = ""
+	case agentActionUserInput:
+		log.Printf("Goal mode user_input: %s", action.Question)
 		this.PromptSuffixCounter = -999999
 		this.setState(stateNormal)
-		question, err := parseUserInputParams(output.FunctionParameters)
-		if err != nil {
-			log.Printf("Error parsing function arguments: %s", err)
-			modelStr := fmt.Sprintf("Error parsing your json, try again: %s", err)
-			this.GoalModeFunctionResponse(modelStr)
-			return
-		}
+		fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s\n", this.Color.Answer, action.Question, this.Color.Command)
+		this.Notifier.Done(NotifyEventGoalInput, "Goal mode needs your input")
 
-		fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s\n", this.Color.Answer, question, this.Color.Command)
-
-	case "finish":
+	case agentActionFinish:
 		log.Printf("Goal mode finishing: %s", output.FunctionParameters)
-		this.GoalModeBuffer = ""
 		this.setState(stateNormal)
-		success, err := parseFinishParams(output.FunctionParameters)
-		if err != nil {
-			log.Printf("Error parsing function arguments: %s", err)
-			modelStr := fmt.Sprintf("Error parsing your json, try again: %s", err)
-			this.History.AppendFunctionOutput(output.FunctionName, modelStr)
-			this.GoalModeFunctionResponse(modelStr)
-			return
-		}
-
 		result := "SUCCESS"
-		if !success {
+		if !action.Success {
 			result = "FAILURE"
 		}
 
 		fmt.Fprintf(this.PromptGoalAnswerWriter, "%sExited goal mode with %s.%s\n", this.Color.Answer, result, this.Color.Command)
 		this.GoalMode = false
+		this.Notifier.Done(NotifyEventGoalFinish, "Goal mode finished with "+result)
 
-	case "":
+	case agentActionEnvInfo:
+		log.Printf("Goal mode env_info")
+		this.GoalModeFunctionResponse(envInfoOutput(this.Butterfish.Ctx, childShellDir(),
+			this.Butterfish.Config.ShellSessionEnvVars))
+
+	case agentActionNone:
 		log.Printf("No function called in goal mode")
-		modelStr := fmt.Sprintf("You must call a function in goal mode responses.")
-		this.History.Append(historyTypePrompt, modelStr)
+		this.History.Append(historyTypePrompt, action.Error)
 		this.GoalModeFunctionResponse("")
 
 	default:
-		log.Printf("Invalid function name called in goal mode: %s", output.FunctionName)
-		modelStr := fmt.Sprintf("Invalid function name: %s", output.FunctionName)
-		this.GoalModeFunctionResponse(modelStr)
-
-	}
-}
-
-var goalModeFunctions = []util.FunctionDefinition{
-	{
-		Name:        "command",
-		Description: "Run a command in the shell to help achieve your goal",
-		Parameters: jsonschema.Definition{
-			Type: jsonschema.Object,
-			Properties: map[string]jsonschema.Definition{
-				"cmd": {
-					Type:        jsonschema.String,
-					Description: "The string command including any arguments, for example 'ls ~'",
-				},
-			},
-			Required: []string{"cmd"},
-		},
-	},
-
-	{
-		Name:        "user_input",
-		Description: "Resolve an ambiguity in the goal or provide additional information or hand off a goal that can't be accomplished to the user.",
-		Parameters: jsonschema.Definition{
-			Type: jsonschema.Object,
-			Properties: map[string]jsonschema.Definition{
-				"question": {
-					Type:        jsonschema.String,
-					Description: "The question to ask the user",
-				},
-			},
-			Required: []string{"question"},
-		},
-	},
-
-	{
-		Name:        "finish",
-		Description: "Finish the goal and exit goal mode, call only if the goal is accomplished or multiple strategies have been attempted and the goal is impossible.",
-		Parameters: jsonschema.Definition{
-			Type: jsonschema.Object,
-			Properties: map[string]jsonschema.Definition{
-				"success": {
-					Type:        jsonschema.Boolean,
-					Description: "Whether the goal was accomplished",
-				},
-			},
-			Required: []string{"success"},
-		},
-	},
-}
-
-var goalModeFunctionsString string
-
-// serialize goalModeFunctions to json and cache in goalModeFunctionsString
-func getGoalModeFunctionsString() string {
-	if goalModeFunctionsString == "" {
-		bytes, err := json.Marshal(goalModeFunctions)
-		if err != nil {
-			log.Fatal(err)
-		}
-		goalModeFunctionsString = string(bytes)
-		log.Printf("goalModeFunctionsString: %s", goalModeFunctionsString)
+		this.GoalModeFunctionResponse(action.Error)
 	}
-	return goalModeFunctionsString
 }
 
 func (this *ShellState) goalModePrompt(lastPrompt string) {
 	this.setState(statePromptResponse)
-	requestCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	requestCtx, cancel := context.WithCancel(context.Background())
 	this.PromptResponseCancel = cancel
 
-	sysMsg, err := this.Butterfish.PromptLibrary.GetPrompt(
-		prompt.GoalModeSystemMessage,
+	sysMsg, err := this.Butterfish.PromptLibrary.GetPromptForModel(
+		prompt.GoalModeSystemMessage, this.Butterfish.Config.ShellPromptModel,
 		"goal", this.GoalModeGoal,
-		"sysinfo", GetSystemInfo())
+		"sysinfo", this.Butterfish.SystemInfo(childShellDir()))
 	if err != nil {
 		msg := fmt.Errorf("ERROR: could not retrieve prompting system message: %s", err)
 		log.Println(msg)
@@ -1470,8 +2153,18 @@ func (this *ShellState) goalModePrompt(lastPrompt string) {
 		return
 	}
 
-	tokensForAnswer := 1024
-	lastPrompt, historyBlocks, err := this.AssembleChat(lastPrompt, sysMsg, getGoalModeFunctionsString(), tokensForAnswer)
+	functions := goalModeFunctions
+	functionsString := getGoalModeFunctionsString()
+	if limit := this.GoalModeUsage.Reach(); limit != "" {
+		log.Printf("Goal mode reached %s", limit)
+		lastPrompt = goalLimitMessage(lastPrompt, limit)
+		functions = goalModeStopFunctions
+		functionsBytes, _ := json.Marshal(functions)
+		functionsString = string(functionsBytes)
+	}
+
+	tokensForAnswer := agentResponseTokens
+	lastPrompt, historyBlocks, err := this.AssembleChat(lastPrompt, sysMsg, functionsString, tokensForAnswer)
 	if err != nil {
 		this.PrintError(err)
 		return
@@ -1482,33 +2175,299 @@ func (this *ShellState) goalModePrompt(lastPrompt string) {
 		Prompt:        lastPrompt,
 		Model:         this.Butterfish.Config.ShellPromptModel,
 		MaxTokens:     tokensForAnswer,
-		Temperature:   0.6,
+		Temperature:   agentTemperature,
 		HistoryBlocks: historyBlocks,
 		SystemMessage: sysMsg,
-		Functions:     goalModeFunctions,
+		Functions:     functions,
 		Verbose:       this.Butterfish.Config.Verbose > 0,
 	}
+	this.Butterfish.Config.LimitRequest(FeatureAgent, request)
+	this.GoalModeUsage.AddTokens(estimateRequestTokens(request))
 
 	// we run this in a goroutine so that we can still receive input
 	// like Ctrl-C while waiting for the response
-	go CompletionRoutine(request, this.Butterfish.LLMClient,
-		this.PromptGoalAnswerWriter, this.PromptOutputChan,
-		this.Color.GoalMode, this.Color.Error, this.StyleWriter)
+	go this.spinnerCompletionRoutine(request, this.PromptGoalAnswerWriter,
+		this.Color.GoalMode)
+}
+
+// Recalculate the state that depends on which models we're using, i.e. the
+// tokenizers and token limits. Call this after changing models in the config.
+func (this *ShellState) ResetModelState() {
+	this.PromptEncoder = nil
+	this.AutosuggestEncoder = nil
+	// logs where each model's context window comes from
+	NumTokensForModel(this.Butterfish.Config.ShellPromptModel)
+	NumTokensForModel(this.Butterfish.Config.ShellAutosuggestModel)
+	this.updateTokenBudgets()
+	this.AutosuggestEnabled = this.Butterfish.Config.ShellAutosuggestEnabled
+}
+
+// Size the prompt, history block, and response budgets from the models'
+// context windows. These can change while the shell runs, e.g. when a context
+// length error tells us the real window, so this runs before each request.
+func (this *ShellState) updateTokenBudgets() {
+	config := this.Butterfish.Config
+	promptContext := LookupModel(config.ShellPromptModel).ContextWindow
+	autosuggestContext := LookupModel(config.ShellAutosuggestModel).ContextWindow
+	this.PromptMaxTokens, this.HistoryBlockMaxTokens, this.ResponseMaxTokens =
+		shellTokenBudgets(config, promptContext)
+	this.AutosuggestMaxTokens, _, _ = shellTokenBudgets(config, autosuggestContext)
+	this.PromptCompactHistory = isSmallContext(promptContext)
+	this.AutosuggestCompactHistory = isSmallContext(autosuggestContext)
+}
+
+func (this *ShellState) printLocalResponse(text string) {
+	fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s", this.Color.Answer, text, this.Color.Command)
+	this.SendPromptResponse(text)
+}
+
+// Switch to a different profile and reset model-dependent shell state
+func (this *ShellState) SwitchProfile(name string) {
+	config := this.Butterfish.Config
+	if name == "" {
+		text := fmt.Sprintf("Current profile is %s\n", config.ProfileName())
+		if config.ConfigFile != nil {
+			text += fmt.Sprintf("Available profiles: %s\n", strings.Join(config.ConfigFile.ProfileNames(), ", "))
+		}
+		this.printLocalResponse(text)
+		return
+	}
+
+	err := this.Butterfish.SwitchProfile(name)
+	if err != nil {
+		this.Prompt.Clear()
+		this.PrintError(err)
+		return
+	}
+
+	this.ResetModelState()
+	this.printLocalResponse(fmt.Sprintf("Switched to profile %s\n", config.ProfileName()))
+}
+
+// "Key <key>" replaces the API key, a short word after Key is a normal prompt,
+// e.g. "Key takeaways?"
+func keyCommand(prompt string) (string, bool) {
+	key, ok := localCommandArg(prompt, "key")
+	if !ok || key != "" && len(key) < 20 {
+		return "", false
+	}
+	return key, true
+}
+
+// Replace the API key, with no key we print where the current one came from.
+// The key itself is never printed.
+func (this *ShellState) SetKey(key string) {
+	if key == "" {
+		source := this.Butterfish.Config.KeySource()
+		if source == "" {
+			source = "not from a known place"
+		}
+		this.printLocalResponse(fmt.Sprintf("The API key is %s\n", source))
+		return
+	}
+
+	text, err := this.Butterfish.SetKey(key)
+	if err != nil {
+		this.Prompt.Clear()
+		this.PrintError(err)
+		return
+	}
+	this.printLocalResponse(text + "\n")
+}
+
+// Switch the model used when prompting, with no name we print the current one
+func (this *ShellState) SwitchModel(name string) {
+	config := this.Butterfish.Config
+	if name == "" {
+		this.printLocalResponse(fmt.Sprintf("Prompting model is %s\n", config.ShellPromptModel))
+		return
+	}
+
+	// The client doesn't need rebuilding, it picks the chat or legacy
+	// completions API from each request's model and the tools middleware
+	// emulates functions per model, we only say which applies
+	config.ShellPromptModel = name
+	this.ResetModelState()
+	api := "the chat API"
+	info := LookupModel(name)
+	if info.Completion {
+		api = "the legacy completions API"
+	}
+	if !info.Functions {
+		api += " with function calls emulated in the prompt"
+	}
+	this.printLocalResponse(fmt.Sprintf("Switched prompting model to %s using %s, history window is %d tokens\n",
+		name, api, this.PromptMaxTokens))
+}
+
+// Set the prompting temperature, with no value we print the current one
+func (this *ShellState) SetTemperature(value string) {
+	if value == "" {
+		this.printLocalResponse(fmt.Sprintf("Prompt temperature is %g\n", this.PromptTemperature))
+		return
+	}
+
+	temperature, err := strconv.ParseFloat(value, 32)
+	if err != nil || temperature < 0 || temperature > 2 {
+		this.Prompt.Clear()
+		this.PrintError(fmt.Errorf("Invalid temperature %s, expected a number between 0 and 2", value))
+		return
+	}
+
+	this.PromptTemperature = float32(temperature)
+	this.printLocalResponse(fmt.Sprintf("Prompt temperature set to %g\n", this.PromptTemperature))
+}
+
+// Override the system message for the rest of the session, "default" goes
+// back to the shell_system_message prompt and no text prints the current one
+func (this *ShellState) SetSystemMessage(text string) {
+	switch {
+	case text == "" && this.SystemMessage == "":
+		this.printLocalResponse("Using the default system message from prompts.yaml\n")
+	case text == "":
+		this.printLocalResponse(fmt.Sprintf("System message is: %s\n", this.SystemMessage))
+	case strings.EqualFold(text, "default"):
+		this.SystemMessage = ""
+		this.printLocalResponse("Restored the default system message\n")
+	default:
+		this.SystemMessage = text
+		this.printLocalResponse("System message set for this session\n")
+	}
+}
+
+// If the prompt is a local command, like "History export notes.md", return the text
+// after the command. The command is matched regardless of case but the text
+// keeps its original case.
+func localCommandText(prompt, command string) (string, bool) {
+	prompt = strings.TrimSpace(prompt)
+	if len(prompt) < len(command) || !strings.EqualFold(prompt[:len(command)], command) {
+		return "", false
+	}
+	rest := prompt[len(command):]
+	if rest != "" && rest[0] != ' ' {
+		return "", false
+	}
+	return strings.TrimSpace(rest), true
+}
+
+// Like localCommandText but for commands that take free text, which has to
+// follow a colon, like "System: be terse", so that prompts starting with the
+// same word, e.g. "System load is high, why?", still go to the LLM. The bare
+// command matches with empty text.
+func localCommandColonText(prompt, command string) (string, bool) {
+	prompt = strings.TrimSpace(prompt)
+	if strings.EqualFold(prompt, command) {
+		return "", true
+	}
+	if len(prompt) <= len(command) || !strings.EqualFold(prompt[:len(command)], command) ||
+		prompt[len(command)] != ':' {
+		return "", false
+	}
+	return strings.TrimSpace(prompt[len(command)+1:]), true
+}
+
+// Like localCommandText but for commands that take a single argument, like
+// "Model gpt-4o". Anything with more than one argument is a normal prompt,
+// e.g. "Model the data as a graph".
+func localCommandArg(prompt, command string) (string, bool) {
+	arg, ok := localCommandText(prompt, command)
+	if !ok || strings.ContainsAny(arg, " \t") {
+		return "", false
+	}
+	return arg, true
 }
 
 func (this *ShellState) HandleLocalPrompt() bool {
-	promptStr := strings.ToLower(this.Prompt.String())
+	prompt := this.promptText()
+	promptStr := strings.ToLower(prompt)
 	promptStr = strings.TrimSpace(promptStr)
 
+	if name, ok := localCommandArg(prompt, "profile"); ok {
+		this.SwitchProfile(name)
+		return true
+	}
+	if name, ok := localCommandArg(prompt, "model"); ok {
+		this.SwitchModel(name)
+		return true
+	}
+	if name, ok := localCommandArg(prompt, "persona"); ok {
+		this.SwitchPersona(name)
+		return true
+	}
+	if value, ok := localCommandArg(prompt, "temp"); ok {
+		this.SetTemperature(value)
+		return true
+	}
+	if key, ok := keyCommand(prompt); ok {
+		this.SetKey(key)
+		return true
+	}
+	if text, ok := localCommandColonText(prompt, "system"); ok {
+		this.SetSystemMessage(text)
+		return true
+	}
+	if pane, ok := tmuxContextCommand(prompt); ok {
+		this.tmuxContextLocalCommand(pane)
+		return true
+	}
+	// a single path, so "History export the failures as a table" is a prompt
+	if path, ok := localCommandArg(prompt, "history export"); ok {
+		this.ExportHistory(path)
+		return true
+	}
+	if query, ok := localCommandColonText(prompt, "find"); ok {
+		this.FindLocalCommand(query)
+		return true
+	}
+	if arg, ok := triggerCommand(prompt); ok {
+		this.SetTrigger(arg)
+		return true
+	}
+	if name, value, ok := setVariableCommand(prompt); ok {
+		this.SetVariable(name, value)
+		return true
+	}
+	if name, ok := this.getVariableCommand(prompt); ok {
+		this.GetVariable(name)
+		return true
+	}
+	if answerCommand(prompt, "run") {
+		this.RunAnswerCommand()
+		return true
+	}
+	if answerCommand(prompt, "copy") {
+		this.CopyAnswerCommand()
+		return true
+	}
+	if name, args, ok := shortcutCommand(prompt, shortcutNames(this.Butterfish.PromptLibrary), this.promptPrefixed()); ok {
+		this.RunShortcut(name, expandVariables(args, this.Variables))
+		return true
+	}
+
 	switch promptStr {
 	case "status":
 		this.PrintStatus()
+	case "stats":
+		this.PrintStats()
 	case "help":
 		this.PrintHelp()
 	case "history":
 		this.PrintHistory()
+	case "page":
+		this.PageLastAnswer()
+	case "continue":
+		// otherwise it's a prompt like any other
+		if !this.History.LastAnswerInterrupted() {
+			return false
+		}
+		this.sendPromptText(continuePrompt)
 	default:
-		return false
+		// plugin commands are named by the user, so the bare name is enough
+		name, args, ok := shortcutCommand(prompt, this.Plugins.commandNames(), true)
+		if !ok {
+			return false
+		}
+		this.RunPluginCommand(this.Plugins.command(name), expandVariables(args, this.Variables))
 	}
 
 	return true
@@ -1536,16 +2495,18 @@ func countAndTruncate(data string,
 // calculating token limits.
 func (this *ShellState) AssembleChat(prompt, sysMsg, functions string, reserveForAnswer int) (string, []util.HistoryBlock, error) {
 	// How many tokens can this model handle
+	this.updateTokenBudgets()
 	totalTokens := this.PromptMaxTokens
 	maxPromptTokens := 512 // for the prompt specifically
 	// for each individual history block
-	maxHistoryBlockTokens := this.Butterfish.Config.ShellMaxHistoryBlockTokens
+	maxHistoryBlockTokens := this.HistoryBlockMaxTokens
 	// How much for the total request (prompt, history, sys msg)
 	maxCombinedPromptTokens := totalTokens - reserveForAnswer
 
 	return assembleChat(prompt, sysMsg, functions, this.History,
 		this.Butterfish.Config.ShellPromptModel, this.getPromptEncoder(),
-		maxPromptTokens, maxHistoryBlockTokens, maxCombinedPromptTokens)
+		maxPromptTokens, maxHistoryBlockTokens, maxCombinedPromptTokens,
+		this.PromptCompactHistory)
 }
 
 // Build a list of HistoryBlocks for use in GPT chat history, and ensure the
@@ -1561,6 +2522,7 @@ func assembleChat(
 	maxPromptTokens int,
 	maxHistoryBlockTokens int,
 	maxTokens int,
+	compact bool,
 ) (string, []util.HistoryBlock, error) {
 
 	tokensPerMessage := NumTokensPerMessageForModel(model)
@@ -1602,7 +2564,8 @@ func assembleChat(
 		encoder,
 		maxHistoryBlockTokens,
 		maxTokens-usedTokens,
-		tokensPerMessage)
+		tokensPerMessage,
+		compact)
 	usedTokens += historyTokens
 
 	if usedTokens > maxTokens {
@@ -1615,7 +2578,8 @@ func assembleChat(
 // Iterate through a history and build a list of HistoryBlocks up until the
 // maximum number of tokens is reached. A single block will be truncated to
 // the maxHistoryBlockTokens number. Each block will start at a baseline of
-// tokensPerMessage number of tokens.
+// tokensPerMessage number of tokens. If compact is set blocks are compacted
+// for a small context model, see smallcontext.go.
 // We return the history blocks and the number of tokens it uses.
 func getHistoryBlocksByTokens(
 	history *ShellHistory,
@@ -1623,11 +2587,19 @@ func getHistoryBlocksByTokens(
 	maxHistoryBlockTokens,
 	maxTokens,
 	tokensPerMessage int,
+	compact bool,
 ) ([]util.HistoryBlock, int) {
 
 	blocks := []util.HistoryBlock{}
 	usedTokens := 0
 
+	// compact content is cached separately
+	encoding := encoder.EncoderName()
+	if compact {
+		maxHistoryBlockTokens = min(maxHistoryBlockTokens, compactHistoryBlockTokens)
+		encoding += "/compact"
+	}
+
 	history.IterateBlocks(func(block *HistoryBuffer) bool {
 		if block.Content.Size() == 0 && block.FunctionName == "" {
 			// empty block, skip
@@ -1650,22 +2622,33 @@ func getHistoryBlocksByTokens(
 
 		// check existing block tokenizations
 		contentLen := block.Content.Size()
-		content, contentTokens, ok := block.GetTokenization(encoder.EncoderName(), contentLen)
+		content, contentTokens, ok := block.GetTokenization(encoding, contentLen)
 
 		if !ok { // cache miss
 			contentStr := block.Content.String()
-			// avoid processing super long strings with a ceiling
+			// avoid processing super long strings with a ceiling, output keeps
+			// its start and end so it's truncated from the whole output
+			output := block.Type == historyTypeShellOutput || block.Type == historyTypeFunctionOutput
 			ceiling := maxHistoryBlockTokens * 4
-			if contentLen > ceiling {
+			if contentLen > ceiling && !output {
 				contentStr = contentStr[:ceiling]
 			}
 
-			// remove ANSI escape codes
-			historyContent := sanitizeTTYString(contentStr)
+			cleaned := historyContent(block.Type, contentStr, compact)
+			if status := block.CommandStatus(); status != "" {
+				cleaned = fmt.Sprintf("%s\n(%s)", strings.TrimRight(cleaned, "\n"), status)
+			}
+			if block.Interrupted {
+				cleaned = fmt.Sprintf("%s\n(answer interrupted by the user)", strings.TrimRight(cleaned, "\n"))
+			}
 			// encode and truncate
-			contentTokens, content, _ = countAndTruncate(historyContent, encoder, maxHistoryBlockTokens)
+			if output {
+				contentTokens, content = countAndTruncateOutput(cleaned, encoder, maxHistoryBlockTokens)
+			} else {
+				contentTokens, content, _ = countAndTruncate(cleaned, encoder, maxHistoryBlockTokens)
+			}
 			// save truncated string
-			block.SetTokenization(encoder.EncoderName(), contentLen, contentTokens, content)
+			block.SetTokenization(encoding, contentLen, contentTokens, content)
 		}
 		msgTokens += contentTokens
 
@@ -1690,23 +2673,65 @@ func getHistoryBlocksByTokens(
 	return blocks, usedTokens
 }
 
+// Temperature used when prompting unless changed with the Temp command
+const defaultPromptTemperature = 0.7
+
+// Sent by the Continue command after an answer was interrupted
+const continuePrompt = "Continue your last answer from exactly where it was cut off, without repeating what you already wrote."
+
 func (this *ShellState) SendPrompt() {
+	this.sendPromptText(this.expandedPromptText())
+}
+
+// Send a prompt with the history, text is what goes into the history
+func (this *ShellState) sendPromptText(text string) {
+	text, err := this.Plugins.Preprocess(text)
+	if err != nil {
+		this.Prompt.Clear()
+		this.PrintError(err)
+		return
+	}
+	background := this.answerInBackground()
+	if background && this.Background != nil {
+		this.Prompt.Clear()
+		this.PrintError(errBackgroundAnswerRunning)
+		return
+	}
 	this.setState(statePromptResponse)
 
 	requestCtx, cancel := context.WithCancel(context.Background())
-	this.PromptResponseCancel = cancel
+	var backgroundCancel context.CancelFunc
+	if background {
+		backgroundCancel = cancel
+	} else {
+		this.PromptResponseCancel = cancel
+	}
 
-	sysMsg, err := this.Butterfish.PromptLibrary.GetPrompt(
-		prompt.ShellSystemMessage, "sysinfo", GetSystemInfo())
-	if err != nil {
-		msg := fmt.Errorf("Could not retrieve prompting system message: %s", err)
-		this.PrintError(msg)
-		return
+	sysMsg := this.SystemMessage
+	if sysMsg == "" {
+		var err error
+		sysMsg, err = this.Butterfish.PromptLibrary.GetPromptForModel(
+			prompt.ShellSystemMessage, this.Butterfish.Config.ShellPromptModel,
+			"sysinfo", this.Butterfish.SystemInfo(childShellDir()))
+		if err != nil {
+			msg := fmt.Errorf("Could not retrieve prompting system message: %s", err)
+			this.PrintError(msg)
+			return
+		}
+	}
+
+	prompt := text
+	this.updateTokenBudgets()
+	tokensReservedForAnswer := this.ResponseMaxTokens
+
+	// the index snippets are found after we've returned, so leave room for them
+	indexContextTokens := 0
+	if this.Butterfish.Config.ShellIndexContext && isQuestionPrompt(prompt) {
+		indexContextTokens = this.Butterfish.Config.ShellIndexContextTokens
 	}
 
-	prompt := this.Prompt.String()
-	tokensReservedForAnswer := this.Butterfish.Config.ShellMaxResponseTokens
-	prompt, historyBlocks, err := this.AssembleChat(prompt, sysMsg, "", tokensReservedForAnswer)
+	prompt, historyBlocks, err := this.AssembleChat(prompt, sysMsg, "",
+		tokensReservedForAnswer+indexContextTokens)
 	if err != nil {
 		this.PrintError(err)
 		return
@@ -1717,22 +2742,118 @@ func (this *ShellState) SendPrompt() {
 		Prompt:        prompt,
 		Model:         this.Butterfish.Config.ShellPromptModel,
 		MaxTokens:     tokensReservedForAnswer,
-		Temperature:   0.7,
+		Temperature:   this.PromptTemperature,
 		HistoryBlocks: historyBlocks,
 		SystemMessage: sysMsg,
 		Verbose:       this.Butterfish.Config.Verbose > 0,
 		TokenTimeout:  this.Butterfish.Config.TokenTimeout,
 	}
+	this.Butterfish.Config.LimitRequest(FeaturePrompt, request)
+
+	this.History.Append(historyTypePrompt, text)
+	this.Notifier.Start()
+
+	addIndexContext := func() {
+		if indexContextTokens > 0 {
+			// if the lookup fails we still answer, just without the snippets
+			snippets, err := this.indexContext(requestCtx, childShellDir(), prompt, indexContextTokens)
+			if err != nil {
+				log.Printf("Index context lookup failed: %s", err)
+			}
+			request.SystemMessage += snippets
+		}
+	}
 
-	this.History.Append(historyTypePrompt, this.Prompt.String())
+	this.Prompt.Clear()
+	if background {
+		this.startBackgroundAnswer(request, backgroundCancel, addIndexContext)
+		return
+	}
 
 	// we run this in a goroutine so that we can still receive input
 	// like Ctrl-C while waiting for the response
-	go CompletionRoutine(request, this.Butterfish.LLMClient,
-		this.PromptAnswerWriter, this.PromptOutputChan,
-		this.Color.Answer, this.Color.Error, this.StyleWriter)
+	go func() {
+		addIndexContext()
+		this.spinnerCompletionRoutine(request, this.PromptAnswerWriter,
+			this.Color.Answer)
+	}()
+}
 
-	this.Prompt.Clear()
+// Clean up and truncate command output to put in a prompt
+func (this *ShellState) promptOutput(output string) string {
+	if this.PromptCompactHistory {
+		_, output, _ = countAndTruncate(compactTerminalText(output),
+			this.getPromptEncoder(), compactHistoryBlockTokens*2)
+	} else {
+		_, output = countAndTruncateOutput(sanitizeTTYString(output),
+			this.getPromptEncoder(), this.HistoryBlockMaxTokens)
+	}
+	return output
+}
+
+// The exit status shells report when a command is interrupted with Ctrl-C,
+// we don't diagnose these
+const exitStatusInterrupted = 130
+
+// Called when we see a prompt with a non-zero exit status. If auto-debug is
+// enabled we send the failing command and its output to the LLM and print a
+// short diagnosis in the error color. We only diagnose each command once, and
+// at most once per ShellAutoDebugInterval so repeated failures don't spam.
+func (this *ShellState) AutoDebug(status int) {
+	config := this.Butterfish.Config
+	if !config.ShellAutoDebug || status == exitStatusInterrupted {
+		return
+	}
+
+	command, output := this.History.LastCommand()
+	if command == nil || command == this.AutoDebugCommand {
+		return
+	}
+	if time.Since(this.AutoDebugTime) < config.ShellAutoDebugInterval {
+		log.Printf("Skipping auto-debug, last diagnosis was at %s", this.AutoDebugTime)
+		return
+	}
+	this.AutoDebugCommand = command
+	this.AutoDebugTime = time.Now()
+
+	output = this.promptOutput(output)
+
+	debugPrompt, err := this.Butterfish.PromptLibrary.GetPromptForModel(
+		prompt.ShellAutoDebug, config.ShellPromptModel,
+		"command", command.Content.String(),
+		"status", fmt.Sprintf("%d", status),
+		"output", output)
+	if err != nil {
+		log.Printf("Could not retrieve auto-debug prompt: %s", err)
+		return
+	}
+
+	sysMsg, err := this.Butterfish.PromptLibrary.GetPromptForModel(
+		prompt.ShellSystemMessage, config.ShellPromptModel,
+		"sysinfo", this.Butterfish.SystemInfo(childShellDir()))
+	if err != nil {
+		log.Printf("Could not retrieve prompting system message: %s", err)
+		return
+	}
+
+	this.setState(statePromptResponse)
+	requestCtx, cancel := context.WithCancel(context.Background())
+	this.PromptResponseCancel = cancel
+
+	request := &util.CompletionRequest{
+		Ctx:           requestCtx,
+		Prompt:        debugPrompt,
+		Model:         config.ShellPromptModel,
+		MaxTokens:     256,
+		Temperature:   0.3,
+		SystemMessage: sysMsg,
+		Verbose:       config.Verbose > 0,
+		TokenTimeout:  config.TokenTimeout,
+	}
+	config.LimitRequest(FeaturePrompt, request)
+
+	go this.spinnerCompletionRoutine(request, this.PromptAnswerWriter,
+		this.Color.Error)
 }
 
 func CompletionRoutine(
@@ -1748,20 +2869,44 @@ func CompletionRoutine(
 	output, err := client.CompletionStream(request, writer)
 
 	// handle any completion errors
+	canceled := false
 	if err != nil {
 		errStr := fmt.Sprintf("Error prompting LLM: %s\n", err)
 
 		log.Printf("%s", errStr)
 
-		if !strings.Contains(errStr, "context canceled") {
+		canceled = strings.Contains(errStr, "context canceled")
+		if !canceled {
 			fmt.Fprintf(writer, "%s%s", errorColor, errStr)
 		}
+		if output != nil && output.Interrupted && !canceled {
+			fmt.Fprintf(writer, "Type \"Continue\" to pick up the answer where it stopped\n")
+		}
+		if IsAuthError(err) {
+			fmt.Fprintf(writer, "Type \"Key <key>\" to use a new key\n")
+		}
+		if window, ok := contextWindowFromError(err); ok {
+			fmt.Fprintf(writer, "%s has a context window of %d tokens, the history window has been adjusted, send the prompt again\n",
+				request.Model, window)
+		}
 	}
 
-	if output == nil && err != nil {
+	if output == nil && canceled {
+		// the user stopped it before anything arrived
+		output = &util.CompletionResponse{}
+	} else if output == nil && err != nil {
 		output = &util.CompletionResponse{Completion: err.Error()}
 	}
 
+	if output != nil && output.Refusal != "" {
+		log.Printf("LLM refused: %s", output.Refusal)
+		fmt.Fprintf(writer, "%s%s\n", errorColor, output.RefusalMessage())
+	}
+
+	if note := failoverNote(request, output); note != "" {
+		fmt.Fprintf(writer, "\n%s%s\n", errorColor, note)
+	}
+
 	if styleWriter != nil {
 		styleWriter.Reset()
 	}
@@ -1782,14 +2927,10 @@ func (this *ShellState) RealizeAutosuggest(buffer *ShellBuffer, sendToChild bool
 
 	// If we're not at the end of the line, we write out the remaining command
 	// before writing the autosuggest
-	jumpforward := buffer.Size() - buffer.Cursor()
-	if jumpforward > 0 {
-		// go right for the length of the suffix
-		for i := 0; i < jumpforward; i++ {
-			// move cursor right
-			fmt.Fprintf(writer, "\x1b[C")
-			buffer.Write("\x1b[C")
-		}
+	// go right for the length of the suffix, a character at a time
+	for buffer.Cursor() < buffer.Size() {
+		fmt.Fprintf(writer, "\x1b[C")
+		buffer.Write("\x1b[C")
 	}
 
 	// set color
@@ -1861,8 +3002,7 @@ func (this *ShellState) ShowAutosuggest(
 	}
 
 	// Print out autocomplete suggestion
-	cmdLen := buffer.Size()
-	jumpForward := cmdLen - buffer.Cursor()
+	jumpForward := buffer.WidthAfterCursor()
 
 	this.ClearAutosuggest(this.Color.Command)
 	this.LastAutosuggest = suggestion
@@ -1893,7 +3033,7 @@ func (this *ShellState) RefreshAutosuggest(
 		if colorStr != "" {
 			this.ParentOut.Write([]byte(colorStr))
 		}
-		this.AutosuggestBuffer.EatAutosuggestRune()
+		this.AutosuggestBuffer.EatAutosuggest(string(newData))
 		return
 	}
 
@@ -1921,13 +3061,9 @@ func (this *ShellState) ClearAutosuggest(colorStr string) {
 func (this *ShellState) getAutosuggestEncoder() *tiktoken.Tiktoken {
 	if this.AutosuggestEncoder == nil {
 		modelName := this.Butterfish.Config.ShellAutosuggestModel
-		encoder, err := tiktoken.EncodingForModel(modelName)
+		encoder, err := EncoderForModel(modelName)
 		if err != nil {
-			log.Printf("Warning: Error getting encoder for autosuggest model %s: %s", modelName, err)
-			encoder, err = tiktoken.EncodingForModel(DEFAULT_AUTOSUGGEST_ENCODER)
-			if err != nil {
-				panic(fmt.Sprintf("Error getting encoder for fallback autosuggest model %s: %s", modelName, err))
-			}
+			panic(fmt.Sprintf("Error getting encoder for autosuggest model %s: %s", modelName, err))
 		}
 
 		this.AutosuggestEncoder = encoder
@@ -1939,13 +3075,9 @@ func (this *ShellState) getAutosuggestEncoder() *tiktoken.Tiktoken {
 func (this *ShellState) getPromptEncoder() *tiktoken.Tiktoken {
 	if this.PromptEncoder == nil {
 		modelName := this.Butterfish.Config.ShellPromptModel
-		encoder, err := tiktoken.EncodingForModel(modelName)
+		encoder, err := EncoderForModel(modelName)
 		if err != nil {
-			log.Printf("Warning: Error getting encoder for prompt model %s: %s", modelName, err)
-			encoder, err = tiktoken.EncodingForModel(DEFAULT_PROMPT_ENCODER)
-			if err != nil {
-				panic(fmt.Sprintf("Error getting encoder for fallback prompt model %s: %s", modelName, err))
-			}
+			panic(fmt.Sprintf("Error getting encoder for prompt model %s: %s", modelName, err))
 		}
 
 		this.PromptEncoder = encoder
@@ -1959,31 +3091,36 @@ func (this *ShellState) RequestAutosuggest(delay time.Duration, command string)
 	if !this.AutosuggestEnabled {
 		return
 	}
+	// every request would fail the same way until there's a new key
+	if keyRejected(this.Butterfish.LLMClient) {
+		return
+	}
 
 	if this.AutosuggestCancel != nil {
 		// clear out a previous request
 		this.AutosuggestCancel()
 	}
 	this.AutosuggestCtx, this.AutosuggestCancel = context.WithCancel(context.Background())
+	this.updateTokenBudgets()
 
 	// if command is only whitespace, don't bother sending it
 	if len(command) > 0 && strings.TrimSpace(command) == "" {
 		return
 	}
 
-	var suggestPrompt string
-	var err error
-
+	var promptName string
 	if len(command) == 0 {
 		// command completion when we haven't started a command
-		suggestPrompt, err = this.Butterfish.PromptLibrary.GetUninterpolatedPrompt(prompt.ShellAutosuggestNewCommand)
-	} else if !unicode.IsUpper(rune(command[0])) {
+		promptName = prompt.ShellAutosuggestNewCommand
+	} else if !this.isPromptText(command) {
 		// command completion when we have started typing a command
-		suggestPrompt, err = this.Butterfish.PromptLibrary.GetUninterpolatedPrompt(prompt.ShellAutosuggestCommand)
+		promptName = prompt.ShellAutosuggestCommand
 	} else {
 		// prompt completion, like we're asking a question
-		suggestPrompt, err = this.Butterfish.PromptLibrary.GetUninterpolatedPrompt(prompt.ShellAutosuggestPrompt)
+		promptName = prompt.ShellAutosuggestPrompt
 	}
+	suggestPrompt, err := this.Butterfish.PromptLibrary.GetUninterpolatedPromptForModel(
+		promptName, this.Butterfish.Config.ShellAutosuggestModel)
 
 	if err != nil {
 		log.Printf("Error getting prompt from library: %s", err)
@@ -1997,9 +3134,11 @@ func (this *ShellState) RequestAutosuggest(delay time.Duration, command string)
 		suggestPrompt,
 		this.Butterfish.LLMClient,
 		this.Butterfish.Config.ShellAutosuggestModel,
+		this.Butterfish.Config.RequestLimits[FeatureAutosuggest],
 		this.Butterfish.Config.Verbose > 1,
 		this.History,
-		this.Butterfish.Config.ShellMaxHistoryBlockTokens,
+		this.HistoryBlockMaxTokens,
+		this.AutosuggestCompactHistory,
 		this.AutosuggestChan,
 		this.getAutosuggestEncoder())
 
@@ -2014,9 +3153,11 @@ func RequestCancelableAutosuggest(
 	rawPrompt string,
 	llmClient LLM,
 	model string,
+	limits RequestLimits,
 	verbose bool,
 	history *ShellHistory,
 	maxHistoryBlockTokens int,
+	compactHistory bool,
 	autosuggestChan chan<- *AutosuggestResult,
 	encoder *tiktoken.Tiktoken,
 ) {
@@ -2033,7 +3174,7 @@ func RequestCancelableAutosuggest(
 	var err error
 
 	historyBlocks, _ := getHistoryBlocksByTokens(history, encoder,
-		maxHistoryBlockTokens, totalTokens-reserveForAnswer, 4)
+		maxHistoryBlockTokens, totalTokens-reserveForAnswer, 4, compactHistory)
 
 	historyStr := HistoryBlocksToString(historyBlocks)
 	var prmpt string
@@ -2059,6 +3200,8 @@ func RequestCancelableAutosuggest(
 		MaxTokens:   reserveForAnswer,
 		Temperature: 0.2,
 		Verbose:     verbose,
+		Timeout:     limits.Timeout,
+		Retries:     limits.Retries,
 	}
 
 	response, err := llmClient.Completion(request)
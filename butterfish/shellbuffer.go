@@ -5,11 +5,19 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"unicode/utf8"
+
+	"github.com/mattn/go-runewidth"
+	"github.com/rivo/uniseg"
 )
 
 // This holds a buffer that represents a tty shell buffer. Incoming data
 // manipulates the buffer, for example the left arrow will move the cursor left,
 // a backspace would erase the end of the buffer.
+// The cursor moves over and backspace deletes whole grapheme clusters, e.g. an
+// accented letter or an emoji sequence, and cursor positions on the terminal
+// are worked out from the display width of each cluster, so CJK and emoji
+// take two columns.
 type ShellBuffer struct {
 	// The buffer itself
 	buffer       []rune
@@ -17,6 +25,8 @@ type ShellBuffer struct {
 	termWidth    int
 	promptLength int
 	color        string
+	// the start of a multibyte character split across writes
+	partial []byte
 
 	lastAutosuggestLen int
 	lastJumpForward    int
@@ -29,13 +39,19 @@ func (this *ShellBuffer) SetColor(color string) {
 }
 
 func (this *ShellBuffer) Clear() []byte {
-	for i := 0; i < len(this.buffer); i++ {
-		this.buffer[i] = ' '
+	startRow, startCol := this.position(this.cursor)
+
+	// overwrite every column the buffer took up with spaces, including any
+	// left empty by a wide character wrapping to the next line
+	endRow, endCol := this.position(len(this.buffer))
+	columns := this.Width()
+	if this.termWidth > 0 {
+		columns = endRow*this.termWidth + endCol - this.promptLength
 	}
+	this.buffer = []rune(strings.Repeat(" ", max(columns, 0)))
 
-	originalCursor := this.cursor
 	this.cursor = 0
-	update := this.calculateShellUpdate(originalCursor)
+	update := this.calculateShellUpdate(startRow, startCol)
 
 	this.buffer = make([]rune, 0)
 
@@ -58,6 +74,133 @@ func (this *ShellBuffer) Cursor() int {
 	return this.cursor
 }
 
+// The number of terminal columns the buffer takes up
+func (this *ShellBuffer) Width() int {
+	return runewidth.StringWidth(string(this.buffer))
+}
+
+// The number of terminal columns between the cursor and the end of the buffer
+func (this *ShellBuffer) WidthAfterCursor() int {
+	return runewidth.StringWidth(string(this.buffer[this.cursor:]))
+}
+
+// Replace runes from, to with text and move the cursor to from, without
+// anything written to the terminal
+func (this *ShellBuffer) replace(from, to int, text []rune) {
+	newBuffer := make([]rune, 0, len(this.buffer)-(to-from)+len(text))
+	newBuffer = append(newBuffer, this.buffer[:from]...)
+	newBuffer = append(newBuffer, text...)
+	newBuffer = append(newBuffer, this.buffer[to:]...)
+	this.buffer = newBuffer
+	this.cursor = from
+}
+
+// The index of the rune after the grapheme cluster that starts at i
+func (this *ShellBuffer) nextBoundary(i int) int {
+	cluster, _, _, _ := uniseg.FirstGraphemeClusterInString(string(this.buffer[i:]), -1)
+	return i + max(utf8.RuneCountInString(cluster), 1)
+}
+
+// The index of the first rune of the grapheme cluster that ends at i
+func (this *ShellBuffer) prevBoundary(i int) int {
+	start, end := 0, 0
+	state := -1
+	rest := string(this.buffer[:i])
+	for rest != "" {
+		var cluster string
+		cluster, rest, _, state = uniseg.FirstGraphemeClusterInString(rest, state)
+		start = end
+		end += utf8.RuneCountInString(cluster)
+	}
+	return start
+}
+
+// Where the terminal cursor ends up after printing the prompt and the first n
+// runes of the buffer, as a row counted from the prompt's row and a column.
+// Like the terminal, a wide character that doesn't fit at the end of a row
+// goes on the next one.
+func (this *ShellBuffer) position(n int) (int, int) {
+	row, col := 0, this.promptLength
+	if this.termWidth > 0 {
+		row, col = col/this.termWidth, col%this.termWidth
+	}
+
+	// history blocks can be long, skip segmenting plain ASCII
+	if width, ok := asciiWidth(this.buffer[:n]); ok {
+		col += width
+		if this.termWidth > 0 {
+			row, col = row+col/this.termWidth, col%this.termWidth
+		}
+		return row, col
+	}
+
+	state := -1
+	rest := string(this.buffer[:n])
+	for rest != "" {
+		var cluster string
+		cluster, rest, _, state = uniseg.FirstGraphemeClusterInString(rest, state)
+		width := runewidth.StringWidth(cluster)
+		if this.termWidth == 0 {
+			col += width
+			continue
+		}
+		if col+width > this.termWidth && col > 0 {
+			row, col = row+1, 0
+		}
+		col += width
+		row, col = row+col/this.termWidth, col%this.termWidth
+	}
+	return row, col
+}
+
+// The display width of ASCII runes, false if there are others
+func asciiWidth(runes []rune) (int, bool) {
+	width := 0
+	for _, r := range runes {
+		if r >= utf8.RuneSelf {
+			return 0, false
+		}
+		if r >= 0x20 && r != 0x7f {
+			width++
+		}
+	}
+	return width, true
+}
+
+// The buffer as written to the terminal, with spaces in the columns left
+// empty where a wide character goes on the next row so that redrawing
+// overwrites whatever was there
+func (this *ShellBuffer) display() string {
+	var builder strings.Builder
+	col := this.promptLength % this.termWidth
+	state := -1
+	rest := string(this.buffer)
+	for rest != "" {
+		var cluster string
+		cluster, rest, _, state = uniseg.FirstGraphemeClusterInString(rest, state)
+		width := runewidth.StringWidth(cluster)
+		if col+width > this.termWidth && col > 0 {
+			builder.WriteString(strings.Repeat(" ", this.termWidth-col))
+			col = 0
+		}
+		builder.WriteString(cluster)
+		col = (col + width) % this.termWidth
+	}
+	return builder.String()
+}
+
+// Split off the start of a multibyte character at the end of data
+func splitPartialRune(data string) (string, []byte) {
+	start := len(data) - 1
+	for start > 0 && start > len(data)-utf8.UTFMax && !utf8.RuneStart(data[start]) {
+		start--
+	}
+	if start < 0 || utf8.FullRuneInString(data[start:]) {
+		return data, nil
+	}
+	return data[:start], []byte(data[start:])
+}
+
 var CONTROL_STARTS = map[byte]bool{
 	0x1b: true,
 	0x7f: true,
@@ -67,11 +210,15 @@ var CONTROL_STARTS = map[byte]bool{
 }
 
 func (this *ShellBuffer) Write(data string) []byte {
+	if len(this.partial) > 0 {
+		data = string(this.partial) + data
+	}
+	data, this.partial = splitPartialRune(data)
 	if len(data) == 0 {
 		return []byte{}
 	}
 
-	startingCursor := this.cursor
+	startRow, startCol := this.position(this.cursor)
 	runes := []rune(data)
 
 	this.oldLength = len(this.buffer)
@@ -90,7 +237,7 @@ func (this *ShellBuffer) Write(data string) []byte {
 			case 'C':
 				// right arrow
 				if this.cursor < len(this.buffer) {
-					this.cursor++
+					this.cursor = this.nextBoundary(this.cursor)
 				}
 				i += 2
 				continue
@@ -98,7 +245,7 @@ func (this *ShellBuffer) Write(data string) []byte {
 			case 'D':
 				// left arrow
 				if this.cursor > 0 {
-					this.cursor--
+					this.cursor = this.prevBoundary(this.cursor)
 				}
 				i += 2
 				continue
@@ -150,8 +297,9 @@ func (this *ShellBuffer) Write(data string) []byte {
 
 		case 0x08, 0x7f: // backspace
 			if this.cursor > 0 && len(this.buffer) > 0 {
-				this.buffer = append(this.buffer[:this.cursor-1], this.buffer[this.cursor:]...)
-				this.cursor--
+				start := this.prevBoundary(this.cursor)
+				this.buffer = append(this.buffer[:start], this.buffer[this.cursor:]...)
+				this.cursor = start
 			}
 
 		case 0x01: // ctrl-a
@@ -189,10 +337,11 @@ func (this *ShellBuffer) Write(data string) []byte {
 
 	//log.Printf("Buffer update, cursor: %d, buffer: %s, written: %s  %x", this.cursor, string(this.buffer), data, []byte(data))
 
-	return this.calculateShellUpdate(startingCursor)
+	return this.calculateShellUpdate(startRow, startCol)
 }
 
-func (this *ShellBuffer) calculateShellUpdate(startingCursor int) []byte {
+// startRow and startCol are the cursor position before the update
+func (this *ShellBuffer) calculateShellUpdate(startRow, startCol int) []byte {
 	// We've updated the buffer. Now we need to figure out what to print.
 	// The assumption here is that we need to print new stuff, that might fill
 	// multiple lines, might start with a prompt (i.e. not at column 0), and
@@ -206,20 +355,18 @@ func (this *ShellBuffer) calculateShellUpdate(startingCursor int) []byte {
 	// if we have no termwidth we just print out, don't worry about wrapping
 	if this.termWidth == 0 {
 		// go left from the starting cursor
-		fmt.Fprintf(w, ESC_LEFT, startingCursor)
+		fmt.Fprintf(w, ESC_LEFT, startCol-this.promptLength)
 		// print the buffer
 		fmt.Fprintf(w, "%s", string(this.buffer))
 		// go back to the ending cursor
-		fmt.Fprintf(w, ESC_LEFT, len(this.buffer)-this.cursor)
+		fmt.Fprintf(w, ESC_LEFT, this.WidthAfterCursor())
 
 		return buf.Bytes()
 	}
 
-	newNumLines := (max(len(this.buffer), this.cursor+1) + this.promptLength) / this.termWidth
-	oldCursorLine := (startingCursor + this.promptLength) / this.termWidth
-	newCursorLine := (this.cursor + this.promptLength) / this.termWidth
-	newColumn := (this.cursor + this.promptLength) % this.termWidth
-	posAfterWriting := (len(this.buffer) + this.promptLength) % this.termWidth
+	newNumLines, posAfterWriting := this.position(len(this.buffer))
+	oldCursorLine := startRow
+	newCursorLine, newColumn := this.position(this.cursor)
 
 	// get cursor back to the beginning of the prompt
 	// carriage return to go to left side of term
@@ -241,7 +388,7 @@ func (this *ShellBuffer) calculateShellUpdate(startingCursor int) []byte {
 	}
 
 	// write the full new buffer
-	w.Write([]byte(string(this.buffer)))
+	w.Write([]byte(this.display()))
 
 	if posAfterWriting == 0 {
 		// if we are at the beginning of a new line, we need to go down
@@ -301,8 +448,9 @@ func (this *ShellBuffer) WriteAutosuggest(autosuggestText string, jumpForward in
 	var buf bytes.Buffer
 	w = &buf
 
-	numLines := (len(autosuggestText) + jumpForward + this.promptLength - 1) / this.termWidth
-	this.lastAutosuggestLen = len(autosuggestText)
+	width := runewidth.StringWidth(autosuggestText)
+	numLines := (width + jumpForward + this.promptLength - 1) / this.termWidth
+	this.lastAutosuggestLen = width
 	this.lastJumpForward = jumpForward
 
 	//log.Printf("Applying autosuggest, numLines: %d, jumpForward: %d, promptLength: %d, autosuggestText: %s", numLines, jumpForward, this.promptLength, autosuggestText)
@@ -353,11 +501,13 @@ func (this *ShellBuffer) ClearLast(colorStr string) []byte {
 	return this.WriteAutosuggest(emptyBuf, this.lastJumpForward, colorStr)
 }
 
-func (this *ShellBuffer) EatAutosuggestRune() {
+// The user typed the start of the autosuggest, which is now in the buffer
+func (this *ShellBuffer) EatAutosuggest(text string) {
 	if this.lastJumpForward > 0 {
 		panic("jump forward should be 0")
 	}
 
-	this.lastAutosuggestLen--
-	this.promptLength++
+	width := runewidth.StringWidth(text)
+	this.lastAutosuggestLen -= width
+	this.promptLength += width
 }
@@ -0,0 +1,118 @@
+package butterfish
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Edit a buffer on a virtual terminal: the prompt is printed, then each
+// keystroke goes to the buffer and its update to the screen, as it would go
+// to the pty
+type bufferTerminal struct {
+	t      *testing.T
+	screen *Screen
+	buffer *ShellBuffer
+}
+
+func newBufferTerminal(t *testing.T, width int, prompt string) *bufferTerminal {
+	screen := NewScreen(width, 4)
+	screen.Write([]byte(prompt))
+	buffer := NewShellBuffer()
+	buffer.SetTerminalWidth(width)
+	buffer.SetPromptLength(screen.col)
+	return &bufferTerminal{t: t, screen: screen, buffer: buffer}
+}
+
+func (this *bufferTerminal) Type(keys ...string) {
+	for _, key := range keys {
+		this.screen.Write(this.buffer.Write(key))
+	}
+}
+
+// Check the screen and the cursor position on it
+func (this *bufferTerminal) Expect(text string, row, col int) {
+	this.t.Helper()
+	assert.Equal(this.t, text, this.screen.String())
+	assert.Equal(this.t, []int{row, col}, []int{this.screen.row, this.screen.col})
+}
+
+const (
+	keyLeft      = "\x1b[D"
+	keyRight     = "\x1b[C"
+	keyBackspace = "\x7f"
+)
+
+func TestShellBufferWideCharacters(t *testing.T) {
+	term := newBufferTerminal(t, 20, "$ ")
+	term.Type("a", "中", "b")
+	term.Expect("$ a中b", 0, 6)
+
+	// the cursor moves over the two columns of 中
+	term.Type(keyLeft, keyLeft, "x")
+	term.Expect("$ ax中b", 0, 4)
+	term.Type(keyRight, keyBackspace)
+	term.Expect("$ axb", 0, 4)
+	assert.Equal(t, "axb", term.buffer.String())
+
+	// a combining accent is edited with its letter, the screen drops accents
+	term.Type(keyRight, "👍", "e\u0301")
+	term.Expect("$ axb👍e", 0, 8)
+	term.Type(keyBackspace, keyLeft, keyBackspace)
+	term.Expect("$ ax👍", 0, 4)
+	assert.Equal(t, "ax👍", term.buffer.String())
+}
+
+func TestShellBufferGraphemes(t *testing.T) {
+	buffer := NewShellBuffer()
+	buffer.Write("a👍🏽👨\u200d👩\u200d👧")
+	assert.Equal(t, 5, buffer.Width())
+	buffer.Write(keyLeft)
+	assert.Equal(t, 3, buffer.Cursor())
+	buffer.Write(keyBackspace)
+	assert.Equal(t, "a👨\u200d👩\u200d👧", buffer.String())
+	buffer.Write(keyRight + keyBackspace)
+	assert.Equal(t, "a", buffer.String())
+}
+
+func TestShellBufferWideWrap(t *testing.T) {
+	// 中 doesn't fit in the last column so the terminal puts it on the next row
+	term := newBufferTerminal(t, 6, "$ ")
+	term.Type("abc", "中", "d")
+	term.Expect("$ abc\n中d", 1, 3)
+
+	// inserting before it redraws both rows
+	term.Type(keyLeft, keyLeft, "x")
+	term.Expect("$ abcx\n中d", 1, 0)
+	term.Type(keyBackspace)
+	term.Expect("$ abc\n中d", 0, 5)
+
+	term.screen.Write(term.buffer.Clear())
+	term.Expect("$", 0, 2)
+}
+
+func TestShellBufferSplitCharacters(t *testing.T) {
+	buffer := NewShellBuffer()
+	buffer.Write("a\xe4\xb8")
+	assert.Equal(t, "a", buffer.String())
+	buffer.Write("\xadb")
+	assert.Equal(t, "a中b", buffer.String())
+	assert.Equal(t, 4, buffer.Width())
+}
+
+func TestShellBufferWideAutosuggest(t *testing.T) {
+	term := newBufferTerminal(t, 20, "$ ")
+	term.Type("ls")
+
+	autosuggest := NewShellBuffer()
+	autosuggest.SetPromptLength(term.screen.col)
+	autosuggest.SetTerminalWidth(20)
+	term.screen.Write(autosuggest.WriteAutosuggest(" 文件", 0, ""))
+	term.Expect("$ ls 文件", 0, 4)
+
+	// typing the start of the suggestion, then clearing the rest
+	term.Type(" 文")
+	autosuggest.EatAutosuggest(" 文")
+	term.screen.Write(autosuggest.ClearLast(""))
+	term.Expect("$ ls 文", 0, 7)
+}
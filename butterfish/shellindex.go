@@ -0,0 +1,165 @@
+package butterfish
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/mitchellh/go-ps"
+
+	"github.com/bakks/butterfish/embedding"
+)
+
+// With --index-context, shell prompts that ask a question are also used to
+// search the index for the shell's current directory, and the best snippets
+// are added to the system message, so that a question like "Where is the retry
+// logic implemented?" can be answered from the code. The directory's
+// .butterfish_index files have to exist already, i.e. run `butterfish index`
+// there first.
+
+// How many snippets to add at most, fewer if they don't fit the budget
+const indexContextResults = 5
+
+var questionWords = map[string]bool{
+	"what": true, "where": true, "when": true, "why": true, "how": true,
+	"which": true, "who": true, "is": true, "are": true, "does": true,
+	"do": true, "can": true, "should": true, "explain": true, "find": true,
+	"show": true,
+}
+
+// Returns true if a prompt reads like a question, i.e. ends with a question
+// mark or starts with a question word
+func isQuestionPrompt(prompt string) bool {
+	prompt = strings.TrimSpace(prompt)
+	if strings.HasSuffix(prompt, "?") {
+		return true
+	}
+	fields := strings.Fields(prompt)
+	return len(fields) > 1 && questionWords[strings.ToLower(fields[0])]
+}
+
+// Find the working directory of the shell we're wrapping, which changes as the
+// user moves around, falling back to our own
+func childShellDir() string {
+	dir, err := childShellDirFromProcess(os.Getpid())
+	if err != nil {
+		log.Printf("Unable to find the shell's directory: %s", err)
+		dir, _ = os.Getwd()
+	}
+	return dir
+}
+
+func childShellDirFromProcess(parent int) (string, error) {
+	processes, err := ps.Processes()
+	if err != nil {
+		return "", err
+	}
+
+	pid := -1
+	for _, process := range processes {
+		if process.PPid() == parent {
+			pid = process.Pid()
+			break
+		}
+	}
+	if pid < 0 {
+		return "", fmt.Errorf("No child process of %d", parent)
+	}
+
+	if runtime.GOOS == "linux" {
+		return os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+	}
+
+	// elsewhere, e.g. on macOS, ask lsof, which prints the cwd on a line
+	// starting with n
+	output, err := exec.Command("lsof", "-a", "-p", strconv.Itoa(pid), "-d", "cwd", "-Fn").Output()
+	if err != nil {
+		return "", err
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "n") {
+			return line[1:], nil
+		}
+	}
+	return "", fmt.Errorf("No cwd in lsof output for %d", pid)
+}
+
+// Search the index for the directory and format the best snippets for the
+// system message, up to maxTokens. Returns an empty string if there's nothing
+// relevant, e.g. if the directory isn't indexed.
+func (this *ShellState) indexContext(ctx context.Context, dir, question string, maxTokens int) (string, error) {
+	butterfish := this.Butterfish
+	if butterfish.VectorIndex == nil {
+		err := butterfish.initVectorIndex([]string{dir})
+		if err != nil {
+			return "", err
+		}
+		// keep index messages out of the terminal
+		if index, ok := butterfish.VectorIndex.(*embedding.DiskCachedEmbeddingIndex); ok {
+			index.SetOutput(log.Writer())
+		}
+		this.IndexContextDirs = map[string]bool{dir: true}
+	} else if !this.IndexContextDirs[dir] {
+		err := butterfish.VectorIndex.LoadPaths(ctx, []string{dir})
+		if err != nil {
+			return "", err
+		}
+		this.IndexContextDirs[dir] = true
+	}
+
+	if len(butterfish.VectorIndex.IndexedFiles()) == 0 {
+		return "", nil
+	}
+
+	// other directories may be loaded too, so search wider and filter
+	results, err := butterfish.VectorIndex.Search(ctx, question, indexContextResults*4)
+	if err != nil {
+		return "", err
+	}
+	inDir := []*embedding.VectorSearchResult{}
+	for _, result := range results {
+		if len(inDir) < indexContextResults && isInDir(result.FilePath, dir) {
+			inDir = append(inDir, result)
+		}
+	}
+
+	return formatIndexContext(newQuestionSnippets(inDir), func(s string) int {
+		return len(this.getPromptEncoder().Encode(s, nil, nil))
+	}, maxTokens), nil
+}
+
+func isInDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Format snippets for the system message, most relevant first, stopping at
+// the first one that doesn't fit in maxTokens
+func formatIndexContext(snippets []*questionSnippet, countTokens func(string) int, maxTokens int) string {
+	header := "\n\nHere are snippets from indexed files in the user's current directory that may help answer their question, each with its file and line range. Mention the files you use.\n"
+	used := countTokens(header)
+
+	builder := strings.Builder{}
+	for _, snippet := range snippets {
+		text := fmt.Sprintf("---\n%s\n%s\n", snippet.Location(), strings.TrimRight(snippet.Content, "\n"))
+		tokens := countTokens(text)
+		if used+tokens > maxTokens {
+			break
+		}
+		used += tokens
+		builder.WriteString(text)
+	}
+
+	if builder.Len() == 0 {
+		return ""
+	}
+	return header + builder.String()
+}
@@ -0,0 +1,64 @@
+package butterfish
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsQuestionPrompt(t *testing.T) {
+	assert.True(t, isQuestionPrompt("Where is the retry logic implemented?"))
+	assert.True(t, isQuestionPrompt("How does the index get saved"))
+	assert.True(t, isQuestionPrompt("Is this thing on ? "))
+	assert.False(t, isQuestionPrompt("Write a haiku about shells"))
+	assert.False(t, isQuestionPrompt("Why"))
+}
+
+func TestFormatIndexContext(t *testing.T) {
+	snippets := []*questionSnippet{
+		{FilePath: "/src/gpt.go", StartLine: 10, EndLine: 12, Content: "func retry() {\n}\n"},
+		{FilePath: "/src/shell.go", StartLine: 1, EndLine: 40, Content: strings.Repeat("x", 500)},
+		{FilePath: "/src/small.go", Content: "small"},
+	}
+	countBytes := func(s string) int { return len(s) }
+
+	context := formatIndexContext(snippets, countBytes, 400)
+	assert.Contains(t, context, "---\n/src/gpt.go:10-12\nfunc retry() {\n}\n")
+	// we stop at the first snippet that doesn't fit rather than skipping it,
+	// so the most relevant snippets always come first
+	assert.NotContains(t, context, "shell.go")
+	assert.NotContains(t, context, "small.go")
+
+	assert.Equal(t, "", formatIndexContext(snippets, countBytes, 10))
+	assert.Equal(t, "", formatIndexContext(nil, countBytes, 1000))
+
+	assert.True(t, isInDir("/src/pkg/a.go", "/src"))
+	assert.False(t, isInDir("/srcs/a.go", "/src"))
+	assert.False(t, isInDir("/a.go", "/src"))
+}
+
+func TestChildShellDir(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("reads /proc")
+	}
+
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	assert.Nil(t, err)
+	cmd := exec.Command("sleep", "10")
+	cmd.Dir = dir
+	assert.Nil(t, cmd.Start())
+	defer func() {
+		// wait for it too, a zombie still counts as a running child
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	childDir, err := childShellDirFromProcess(os.Getpid())
+	assert.Nil(t, err)
+	assert.Equal(t, dir, childDir)
+}
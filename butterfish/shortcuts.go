@@ -0,0 +1,92 @@
+package butterfish
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bakks/butterfish/prompt"
+)
+
+// Shortcuts are prompts from the prompt library that are run by name in shell
+// mode, so a prompt that's used often doesn't have to be typed out each time.
+// A library prompt named shortcut_review is run by a prompt starting with
+// "Review:", or with ":review" or ":/review" when the prompt prefix is ":", but
+// not by a bare "Review", so "Explain how tar works" is still a normal prompt.
+// The text after the name is {args}, and the last command and its
+// output are {command} and {output}, so "git diff" then "/review" reviews the
+// diff. Add shortcuts by adding prompts to prompts.yaml.
+
+// Prompt libraries that can list their prompts, so that we can find shortcuts
+type promptNamer interface {
+	Names() []string
+}
+
+func promptNames(library PromptLibrary) []string {
+	if namer, ok := library.(promptNamer); ok {
+		return namer.Names()
+	}
+	return nil
+}
+
+// The names of the shortcuts in the prompt library, without the prefix
+func shortcutNames(library PromptLibrary) []string {
+	names := []string{}
+	for _, name := range promptNames(library) {
+		if shortcut, ok := strings.CutPrefix(name, prompt.ShortcutPrefix); ok && shortcut != "" {
+			names = append(names, shortcut)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// If the prompt starts with the name of a shortcut, return the name and the
+// text after it. The name needs a slash before it or a colon after it, unless
+// the prompt prefix was typed.
+func shortcutCommand(promptText string, names []string, prefixed bool) (string, string, bool) {
+	word, args, _ := strings.Cut(strings.TrimSpace(promptText), " ")
+	word, slash := strings.CutPrefix(word, "/")
+	word, colon := strings.CutSuffix(word, ":")
+	if !slash && !colon && !prefixed {
+		return "", "", false
+	}
+	word = strings.ToLower(word)
+	for _, name := range names {
+		if word == strings.ToLower(name) {
+			return name, strings.TrimSpace(args), true
+		}
+	}
+	return "", "", false
+}
+
+// Fill in a shortcut's prompt with the arguments and the last command
+func (this *ShellState) expandShortcut(name, args string) (string, error) {
+	command, output := this.History.LastCommand()
+	commandText := ""
+	if command != nil {
+		commandText = command.Content.String()
+		output = this.promptOutput(output)
+	}
+
+	text, err := this.Butterfish.PromptLibrary.GetPromptForModel(
+		prompt.ShortcutPrefix+name, this.Butterfish.Config.ShellPromptModel,
+		"args", args,
+		"command", commandText,
+		"output", output)
+	if err != nil {
+		return "", fmt.Errorf("Could not use shortcut %s: %s", name, err)
+	}
+	return strings.TrimSpace(text), nil
+}
+
+// Send a shortcut's prompt like a prompt the user typed
+func (this *ShellState) RunShortcut(name, args string) {
+	text, err := this.expandShortcut(name, args)
+	if err != nil {
+		this.Prompt.Clear()
+		this.PrintError(err)
+		return
+	}
+	this.sendPromptText(text)
+}
@@ -0,0 +1,63 @@
+package butterfish
+
+import (
+	"testing"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShortcutCommand(t *testing.T) {
+	names := []string{"review", "tldr"}
+
+	name, args, ok := shortcutCommand("/review check the error handling", names, false)
+	assert.True(t, ok)
+	assert.Equal(t, "review", name)
+	assert.Equal(t, "check the error handling", args)
+
+	name, args, ok = shortcutCommand("Tldr:", names, false)
+	assert.True(t, ok)
+	assert.Equal(t, "tldr", name)
+	assert.Equal(t, "", args)
+
+	// a bare name is a normal prompt unless the prompt prefix was typed
+	_, _, ok = shortcutCommand("Tldr", names, false)
+	assert.False(t, ok)
+	_, _, ok = shortcutCommand("Review the plan before we start", names, false)
+	assert.False(t, ok)
+	name, args, ok = shortcutCommand("review the plan", names, true)
+	assert.True(t, ok)
+	assert.Equal(t, "review", name)
+	assert.Equal(t, "the plan", args)
+
+	_, _, ok = shortcutCommand("Reviewers are busy", names, true)
+	assert.False(t, ok)
+}
+
+func TestExpandShortcut(t *testing.T) {
+	library := prompt.NewPromptLibrary("", false, nil)
+	library.ReplacePrompts(prompt.DefaultPrompts)
+	library.ReplacePrompts([]prompt.Prompt{{Name: "shortcut_ticket", Prompt: "Write a branch name for {args}"}})
+	state := &ShellState{
+		Butterfish: &ButterfishCtx{
+			Config:        MakeButterfishConfig(),
+			PromptLibrary: NewLazyPromptLibrary(func() (PromptLibrary, error) { return library, nil }),
+		},
+		History: NewShellHistory(),
+	}
+
+	assert.Equal(t, []string{"explain", "review", "ticket", "tldr"},
+		shortcutNames(state.Butterfish.PromptLibrary))
+
+	text, err := state.expandShortcut("ticket", "ENG-1234")
+	assert.Nil(t, err)
+	assert.Equal(t, "Write a branch name for ENG-1234", text)
+
+	// with no command in the history the defaults leave it out
+	text, err = state.expandShortcut("explain", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "Explain what the last command did and what its output means. Keep it short.", text)
+	text, err = state.expandShortcut("tldr", "the errors")
+	assert.Nil(t, err)
+	assert.Equal(t, "Summarize our conversation so far in at most 5 short bullet points, focusing on the errors.", text)
+}
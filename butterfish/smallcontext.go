@@ -0,0 +1,107 @@
+package butterfish
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Models with a small context window, e.g. a 4k local model, get a compact
+// history: shell output is reduced to a one-line summary, terminal noise
+// like progress bars is dropped, and each block gets a much smaller token
+// budget, so that a few verbose commands don't crowd out everything else.
+// This is picked from the model's context window rather than configured.
+
+// Models with a context window below this get compact history
+const SmallContextWindow = 8192
+
+// Token budget for each history block in compact mode
+const compactHistoryBlockTokens = 128
+
+func isSmallContext(contextWindow int) bool {
+	return contextWindow < SmallContextWindow
+}
+
+// Add or override model context window sizes, e.g. for local models from the
+// config file, a shorthand for the context_window of RegisterModels
+func RegisterContextWindows(windows map[string]int) {
+	for model, tokens := range windows {
+		RegisterModels(map[string]*ModelEntry{model: {ContextWindow: tokens}})
+	}
+}
+
+// Strip terminal output down to plain text: ANSI codes and other control
+// characters are removed, lines redrawn with carriage returns (e.g. progress
+// bars) keep only their final state, and runs of blank lines are collapsed
+func compactTerminalText(data string) string {
+	lines := strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n")
+	compacted := []string{}
+	blank := false
+
+	for _, line := range lines {
+		if i := strings.LastIndex(strings.TrimRight(line, "\r"), "\r"); i >= 0 {
+			line = line[i+1:]
+		}
+		line = strings.TrimRight(sanitizeTTYString(line), " \t\r")
+
+		if line == "" {
+			if !blank && len(compacted) > 0 {
+				compacted = append(compacted, "")
+			}
+			blank = true
+			continue
+		}
+		blank = false
+		compacted = append(compacted, line)
+	}
+
+	return strings.TrimSpace(strings.Join(compacted, "\n"))
+}
+
+var errorLineRegex = regexp.MustCompile(`(?i)\b(error|failed|failure|fatal|exception|panic|denied|not found|no such)\b`)
+
+// Reduce shell output to one line, the first line that looks like an error
+// since that's usually what matters, otherwise the last line
+func summarizeShellOutput(output string) string {
+	lines := []string{}
+	for _, line := range strings.Split(compactTerminalText(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	switch len(lines) {
+	case 0:
+		return ""
+	case 1:
+		return lines[0]
+	}
+
+	summary := lines[len(lines)-1]
+	for _, line := range lines {
+		if errorLineRegex.MatchString(line) {
+			summary = line
+			break
+		}
+	}
+	return fmt.Sprintf("[%d lines of output] %s", len(lines), summary)
+}
+
+func compactHistoryNote(compact bool) string {
+	if compact {
+		return " (compact, small context model)"
+	}
+	return ""
+}
+
+// Prepare a history block's content for the LLM
+func historyContent(blockType int, content string, compact bool) string {
+	if !compact {
+		// remove ANSI escape codes
+		return sanitizeTTYString(content)
+	}
+	if blockType == historyTypeShellOutput {
+		return summarizeShellOutput(content)
+	}
+	return compactTerminalText(content)
+}
@@ -0,0 +1,39 @@
+package butterfish
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactTerminalText(t *testing.T) {
+	output := "\x1b[32mDownloading\x1b[0m\r\n" +
+		"  10%\r  50%\r 100%\r\n" +
+		"\n\n\n" +
+		"done   \n"
+	assert.Equal(t, "Downloading\n 100%\n\ndone", compactTerminalText(output))
+}
+
+func TestSummarizeShellOutput(t *testing.T) {
+	assert.Equal(t, "", summarizeShellOutput("\n\n"))
+	assert.Equal(t, "ok", summarizeShellOutput("\x1b[1mok\x1b[0m\n"))
+
+	output := "compiling foo\ncompiling bar\nerror: missing semicolon\nbuild stopped\n"
+	assert.Equal(t, "[4 lines of output] error: missing semicolon", summarizeShellOutput(output))
+
+	output = "a.txt\nb.txt\nc.txt\n"
+	assert.Equal(t, "[3 lines of output] c.txt", summarizeShellOutput(output))
+
+	// only shell output is summarized, everything else is just cleaned up
+	assert.Equal(t, "a.txt\nb.txt", historyContent(historyTypeLLMOutput, "a.txt\n\x1b[0mb.txt\n", true))
+	assert.Equal(t, "a.txt\nb.txt\n", historyContent(historyTypeShellOutput, "a.txt\n\x1b[0mb.txt\n", false))
+}
+
+func TestContextWindows(t *testing.T) {
+	assert.False(t, isSmallContext(NumTokensForModel("gpt-4o")))
+
+	RegisterContextWindows(map[string]int{"tiny-local-model": 4096})
+	defer delete(modelRegistry, "tiny-local-model")
+	assert.Equal(t, 4096, NumTokensForModel("tiny-local-model"))
+	assert.True(t, isSmallContext(NumTokensForModel("tiny-local-model")))
+}
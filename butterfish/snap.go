@@ -0,0 +1,222 @@
+package butterfish
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// While a shell runs it keeps a Screen model of the child's output and serves
+// it on a unix socket in the state dir, named after the session. The snap
+// command reads the screen from the socket and asks the LLM about it, e.g.
+// "why does my TUI look broken?". We don't take OS screenshots, the model sees
+// the text the terminal would show.
+//
+// Clients send a request line first: "screen" for the screen, or "history"
+// for the shell history, which is how butterfish history export reads it.
+
+const (
+	screensDirName    = "screens"
+	screenSocketExt   = ".sock"
+	screenDialTimeout = 2 * time.Second
+
+	shellRequestScreen  = "screen"
+	shellRequestHistory = "history"
+
+	defaultSnapPrompt = "Here's what my terminal looks like, does anything look wrong?"
+)
+
+func ScreensDir(stateBaseDir string) string {
+	return filepath.Join(stateBaseDir, screensDirName)
+}
+
+func ScreenSocketPath(stateBaseDir, sessionID string) string {
+	return filepath.Join(ScreensDir(stateBaseDir), sessionID+screenSocketExt)
+}
+
+type screenSnapshot struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Text   string `json:"text"`
+}
+
+// Serve the screen and history on a unix socket, each connection is sent what
+// it asks for and closed. Closing the listener removes the socket.
+func ServeScreen(path string, screen *Screen, history func() *HistoryExport) (net.Listener, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	// a shell that crashed may have left its socket behind
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			conn.SetDeadline(time.Now().Add(screenDialTimeout))
+			request, _ := bufio.NewReader(conn).ReadString('\n')
+
+			var response any
+			if strings.TrimSpace(request) == shellRequestHistory {
+				response = history()
+			} else {
+				width, height := screen.Size()
+				response = &screenSnapshot{
+					Width:  width,
+					Height: height,
+					Text:   screen.String(),
+				}
+			}
+			err = json.NewEncoder(conn).Encode(response)
+			if err != nil {
+				log.Printf("Error sending %s: %s", strings.TrimSpace(request), err)
+			}
+			conn.Close()
+		}
+	}()
+
+	return listener, nil
+}
+
+// Send a request to a shell's socket and decode the response into v
+func readShellSocket(ctx context.Context, path, request string, v any) error {
+	dialer := net.Dialer{Timeout: screenDialTimeout}
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(screenDialTimeout))
+
+	_, err = fmt.Fprintf(conn, "%s\n", request)
+	if err != nil {
+		return err
+	}
+	err = json.NewDecoder(conn).Decode(v)
+	if err != nil {
+		return fmt.Errorf("Unable to read the %s from %s: %w", request, path, err)
+	}
+	return nil
+}
+
+// Read the screen of the shell with the given session ID or unique prefix of
+// one, or of the most recently started shell that's still running if id is
+// empty
+func snapScreen(ctx context.Context, stateBaseDir, id string) (*screenSnapshot, error) {
+	snapshot := &screenSnapshot{}
+	err := readRunningShell(ctx, stateBaseDir, id, shellRequestScreen, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Send a request to the shell with the given session ID or unique prefix of
+// one, or to the most recently started shell that's still running if id is
+// empty. Sockets of shells that have gone away are cleaned up.
+func readRunningShell(ctx context.Context, stateBaseDir, id, request string, v any) error {
+	dir := ScreensDir(stateBaseDir)
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+screenSocketExt))
+	if err != nil {
+		return err
+	}
+	// session IDs sort by start time, newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+
+	if id != "" {
+		matches := []string{}
+		for _, path := range paths {
+			candidate := strings.TrimSuffix(filepath.Base(path), screenSocketExt)
+			if candidate == id {
+				matches = []string{path}
+				break
+			}
+			if strings.HasPrefix(candidate, id) {
+				matches = append(matches, path)
+			}
+		}
+		switch len(matches) {
+		case 0:
+			return fmt.Errorf("No running shell matches session %s", id)
+		case 1:
+			return readShellSocket(ctx, matches[0], request, v)
+		default:
+			return fmt.Errorf("Session ID %s is ambiguous, it matches %d running shells", id, len(matches))
+		}
+	}
+
+	for _, path := range paths {
+		err := readShellSocket(ctx, path, request, v)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+			os.Remove(path)
+			continue
+		}
+		return err
+	}
+
+	return fmt.Errorf("No running Butterfish shell found, the %s is read from a shell started with 'butterfish shell'", request)
+}
+
+// The message we send to the LLM, the screen goes in a code block so that
+// the model keeps its layout
+func snapPrompt(snapshot *screenSnapshot, prompt string) string {
+	if prompt == "" {
+		prompt = defaultSnapPrompt
+	}
+	return fmt.Sprintf("This is the current contents of my %dx%d terminal screen:\n```\n%s\n```\n\n%s",
+		snapshot.Width, snapshot.Height, snapshot.Text, prompt)
+}
+
+func (this *ButterfishCtx) snapCommand(options *CliCommandConfig) error {
+	if this.Config.StateBaseDir == "" {
+		return errors.New("No state directory, snap needs one to find running shells")
+	}
+
+	snapshot, err := snapScreen(this.Ctx, this.Config.StateBaseDir, options.Snap.Session)
+	if err != nil {
+		return err
+	}
+
+	if options.Snap.Print {
+		fmt.Fprintln(this.Out, snapshot.Text)
+		return nil
+	}
+
+	response, err := this.Prompt(&promptCommand{
+		Prompt:      snapPrompt(snapshot, strings.Join(options.Snap.Prompt, " ")),
+		Model:       options.Snap.Model,
+		NumTokens:   options.Snap.NumTokens,
+		Temperature: options.Snap.Temperature,
+		NoColor:     options.Snap.NoColor,
+		Verbose:     this.Config.Verbose,
+	})
+	if err != nil {
+		return err
+	}
+	if response.Refusal != "" {
+		return errors.New(response.RefusalMessage())
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package butterfish
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// While we wait for the first token of an answer the prompt line shows a
+// spinner, the seconds waited, and the model, e.g. "⠙ 3s gpt-4o", so a slow
+// model doesn't look like a hung shell. The spinner draws on the line where
+// the answer will start and erases it when the first visible output arrives,
+// or when the request finishes without any, e.g. on an error or a function
+// call.
+
+var spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+const (
+	// wait this long before showing the spinner so fast answers don't flicker
+	spinnerDelay    = 250 * time.Millisecond
+	spinnerInterval = 100 * time.Millisecond
+)
+
+type promptSpinner struct {
+	out   io.Writer
+	model string
+	color string
+	start time.Time
+	delay time.Duration
+	// the interval between frames
+	interval time.Duration
+
+	mutex   sync.Mutex
+	stopped bool
+	drawn   bool
+	frame   int
+	done    chan struct{}
+	exited  chan struct{}
+}
+
+func newPromptSpinner(out io.Writer, model, color string) *promptSpinner {
+	return &promptSpinner{
+		out:      out,
+		model:    model,
+		color:    color,
+		delay:    spinnerDelay,
+		interval: spinnerInterval,
+		done:     make(chan struct{}),
+		exited:   make(chan struct{}),
+	}
+}
+
+func (this *promptSpinner) Start() {
+	this.start = time.Now()
+	go this.run()
+}
+
+func (this *promptSpinner) run() {
+	defer close(this.exited)
+
+	select {
+	case <-this.done:
+		return
+	case <-time.After(this.delay):
+	}
+
+	ticker := time.NewTicker(this.interval)
+	defer ticker.Stop()
+	for {
+		this.draw()
+		select {
+		case <-this.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (this *promptSpinner) draw() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.stopped {
+		return
+	}
+
+	elapsed := int(time.Since(this.start).Seconds())
+	frame := spinnerFrames[this.frame%len(spinnerFrames)]
+	this.frame++
+	fmt.Fprintf(this.out, "\r%s%s %ds %s\x1b[0m\x1b[K", this.color, frame, elapsed, this.model)
+	this.drawn = true
+}
+
+// Stop the spinner and erase it, it's safe to call more than once
+func (this *promptSpinner) Stop() {
+	this.mutex.Lock()
+	if this.stopped {
+		this.mutex.Unlock()
+		return
+	}
+	this.stopped = true
+	if this.drawn {
+		this.out.Write([]byte("\r\x1b[K"))
+	}
+	close(this.done)
+	this.mutex.Unlock()
+
+	if !this.start.IsZero() {
+		<-this.exited
+	}
+}
+
+// Wraps the answer writer, the first write with visible content stops the
+// spinner before it's written. Writes of only escape codes, like the answer
+// color, are held until then so they don't end up before the spinner.
+type spinnerWriter struct {
+	spinner *promptSpinner
+	writer  io.Writer
+	held    []byte
+	started bool
+}
+
+func (this *spinnerWriter) Write(p []byte) (int, error) {
+	if !this.started {
+		if stripANSI(string(p)) == "" {
+			this.held = append(this.held, p...)
+			return len(p), nil
+		}
+		this.Flush()
+	}
+	return this.writer.Write(p)
+}
+
+// Stop the spinner and write anything held back
+func (this *spinnerWriter) Flush() {
+	if this.started {
+		return
+	}
+	this.started = true
+	this.spinner.Stop()
+	if len(this.held) > 0 {
+		this.writer.Write(this.held)
+		this.held = nil
+	}
+}
+
+// Run CompletionRoutine with a spinner on the prompt line until the answer
+// starts
+func (this *ShellState) spinnerCompletionRoutine(
+	request *util.CompletionRequest,
+	writer io.Writer,
+	normalColor string,
+) {
+	spinner := newPromptSpinner(this.ParentOut, request.Model, this.Color.Autosuggest)
+	spinner.Start()
+	spinnerWriter := &spinnerWriter{spinner: spinner, writer: writer}
+
+	outputChan := make(chan *util.CompletionResponse, 1)
+	CompletionRoutine(request, this.Butterfish.LLMClient, spinnerWriter,
+		outputChan, normalColor, this.Color.Error, this.StyleWriter)
+	spinnerWriter.Flush()
+	this.PromptOutputChan <- <-outputChan
+}
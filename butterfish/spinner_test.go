@@ -0,0 +1,44 @@
+package butterfish
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPromptSpinner(t *testing.T) {
+	out := new(bytes.Buffer)
+	spinner := newPromptSpinner(out, "gpt-4o", "")
+	spinner.delay = 0
+	spinner.interval = time.Millisecond
+	spinner.Start()
+	writer := &spinnerWriter{spinner: spinner, writer: out}
+
+	// the answer color is held until the answer starts, so it comes after
+	// the spinner is erased
+	writer.Write([]byte("\x1b[38;5;221m"))
+	time.Sleep(20 * time.Millisecond)
+	writer.Write([]byte("Hello"))
+	drawn := out.String()
+	assert.Equal(t, 1, strings.Count(drawn, "\x1b[38;5;221m"))
+	assert.True(t, strings.HasPrefix(drawn, "\r⠋ 0s gpt-4o\x1b[0m\x1b[K"), drawn)
+	assert.True(t, strings.HasSuffix(drawn, "\r\x1b[K\x1b[38;5;221mHello"), drawn)
+
+	// nothing is drawn once it's stopped
+	time.Sleep(5 * time.Millisecond)
+	writer.Write([]byte(" world"))
+	writer.Flush()
+	assert.Equal(t, drawn+" world", out.String())
+}
+
+func TestPromptSpinnerStopsBeforeDrawing(t *testing.T) {
+	out := new(bytes.Buffer)
+	spinner := newPromptSpinner(out, "gpt-4o", "")
+	spinner.Start()
+	spinner.Stop()
+	spinner.Stop()
+	assert.Equal(t, "", out.String())
+}
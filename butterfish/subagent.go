@@ -0,0 +1,194 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/sashabaranov/go-openai/jsonschema"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// An agent with a Manager can hand independent subtasks to sub-agents with
+// spawn_task, e.g. "run the test suite and summarize the failures" while it
+// looks at something else. Each sub-agent starts with an empty history, runs
+// its own commands with the parent's executor and confirmation, and finishes
+// with a summary. The tasks of one call run at the same time, at most
+// MaxConcurrent of them, and the parent gets all of the reports back as the
+// function output once they're done. Sub-agents can't spawn tasks themselves,
+// and share the parent's GoalUsage, so their commands and tokens count
+// towards the parent's limits as they go.
+
+const DefaultMaxSubagents = 3
+
+var spawnTaskFunction = util.FunctionDefinition{
+	Name:        "spawn_task",
+	Description: "Hand independent subtasks to sub-agents that run at the same time, e.g. 'run the test suite and summarize the failures'. Each sub-agent starts without your history, so describe each task fully. Returns a report from each sub-agent once all have finished.",
+	Parameters: jsonschema.Definition{
+		Type: jsonschema.Object,
+		Properties: map[string]jsonschema.Definition{
+			"tasks": {
+				Type:        jsonschema.Array,
+				Items:       &jsonschema.Definition{Type: jsonschema.String},
+				Description: "The subtasks, one sub-agent is started for each",
+			},
+		},
+		Required: []string{"tasks"},
+	},
+}
+
+// finish for sub-agents, the summary is their report to the parent
+var subtaskFinishFunction = util.FunctionDefinition{
+	Name:        "finish",
+	Description: "Finish the task, call only if the task is accomplished or multiple strategies have been attempted and the task is impossible.",
+	Parameters: jsonschema.Definition{
+		Type: jsonschema.Object,
+		Properties: map[string]jsonschema.Definition{
+			"success": {
+				Type:        jsonschema.Boolean,
+				Description: "Whether the task was accomplished",
+			},
+			"summary": {
+				Type:        jsonschema.String,
+				Description: "A short report of what you did and found, for the agent that gave you the task",
+			},
+		},
+		Required: []string{"success", "summary"},
+	},
+}
+
+const subtaskGoal = `%s
+
+You're working on this as a subtask for another agent. When you're done, call finish with a summary of what you did and found.`
+
+// What a sub-agent reports back to its parent
+type SubtaskReport struct {
+	Task    string `json:"task"`
+	Success bool   `json:"success"`
+	Summary string `json:"summary,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Runs sub-agents for spawn_task, at most MaxConcurrent at once however many
+// tasks are spawned
+type AgentManager struct {
+	MaxConcurrent int
+
+	slots chan struct{}
+	// serializes confirmations and events from sub-agents running at once
+	mutex sync.Mutex
+	tasks int
+}
+
+func NewAgentManager(maxConcurrent int) *AgentManager {
+	return &AgentManager{
+		MaxConcurrent: maxConcurrent,
+		slots:         make(chan struct{}, max(maxConcurrent, 1)),
+	}
+}
+
+// Run a sub-agent of the parent for each task, returns their reports in the
+// same order
+func (this *AgentManager) Run(ctx context.Context, parent *Agent, tasks []string) []*SubtaskReport {
+	reports := make([]*SubtaskReport, len(tasks))
+	agents := make([]*Agent, len(tasks))
+	var wait sync.WaitGroup
+	for i, task := range tasks {
+		this.mutex.Lock()
+		this.tasks++
+		id := this.tasks
+		this.mutex.Unlock()
+
+		agents[i] = this.subagent(parent, id)
+		wait.Add(1)
+		go func(i int, task string) {
+			defer wait.Done()
+			reports[i] = this.runTask(ctx, agents[i], task)
+		}(i, task)
+	}
+	wait.Wait()
+	return reports
+}
+
+func (this *AgentManager) runTask(ctx context.Context, agent *Agent, task string) *SubtaskReport {
+	report := &SubtaskReport{Task: task}
+	select {
+	case this.slots <- struct{}{}:
+		defer func() { <-this.slots }()
+	case <-ctx.Done():
+		report.Error = ctx.Err().Error()
+		return report
+	}
+
+	result, err := agent.Run(ctx, fmt.Sprintf(subtaskGoal, task))
+	if err != nil {
+		report.Error = err.Error()
+	}
+	if result != nil {
+		report.Success = result.Success
+		report.Summary = result.Summary
+		if result.Question != "" {
+			report.Error = fmt.Sprintf("The sub-agent stopped to ask: %s", result.Question)
+		}
+	}
+	return report
+}
+
+// A sub-agent with the parent's settings and usage, and an empty history
+func (this *AgentManager) subagent(parent *Agent, id int) *Agent {
+	agent := *parent
+	agent.History = NewShellHistory()
+	agent.Out = nil
+	agent.AskUser = nil
+	agent.Manager = nil
+	agent.subtask = true
+	agent.goal = ""
+	agent.step = 0
+	agent.repair = CommandRepair{}
+
+	if parent.Confirm != nil {
+		agent.Confirm = func(ctx context.Context, cmd string) (string, bool, error) {
+			this.mutex.Lock()
+			defer this.mutex.Unlock()
+			return parent.Confirm(ctx, cmd)
+		}
+	}
+	if parent.OnEvent != nil {
+		agent.OnEvent = func(event *AgentEvent) {
+			event.Task = id
+			this.mutex.Lock()
+			defer this.mutex.Unlock()
+			parent.OnEvent(event)
+		}
+	}
+	return &agent
+}
+
+type spawnTaskParams struct {
+	Tasks []string `json:"tasks"`
+}
+
+// Handle a spawn_task call, returning the function output for the model
+func (this *Agent) spawnTasks(ctx context.Context, params string) string {
+	var spawnParams spawnTaskParams
+	err := unmarshalToolArguments(params, &spawnParams)
+	if err != nil {
+		return fmt.Sprintf("Error parsing your json, try again: %s", err)
+	}
+	if len(spawnParams.Tasks) == 0 {
+		return "Error: no tasks given"
+	}
+	maxTasks := max(this.Manager.MaxConcurrent, 1)
+	if len(spawnParams.Tasks) > maxTasks {
+		return fmt.Sprintf("Error: at most %d tasks can be spawned at once, you gave %d", maxTasks, len(spawnParams.Tasks))
+	}
+
+	reports := this.Manager.Run(ctx, this, spawnParams.Tasks)
+	output, err := json.Marshal(reports)
+	if err != nil {
+		return fmt.Sprintf("Error: %s", err)
+	}
+	return string(output)
+}
@@ -0,0 +1,172 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+var subtaskPattern = regexp.MustCompile(`Goal: (.*)\n\nYou're working on this as a subtask`)
+
+// The parent spawns two tasks and finishes, each sub-agent runs a command
+// with its task's name and finishes with a summary
+type spawningLLM struct {
+	mutex    sync.Mutex
+	running  int
+	peak     int
+	requests map[string]int
+	// the parent's requests
+	parent []*util.CompletionRequest
+}
+
+func (this *spawningLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	return this.Completion(request)
+}
+
+func (this *spawningLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	this.mutex.Lock()
+	this.running++
+	this.peak = max(this.peak, this.running)
+	matches := subtaskPattern.FindStringSubmatch(request.SystemMessage)
+	task := ""
+	if matches != nil {
+		task = matches[1]
+	} else {
+		this.parent = append(this.parent, request)
+	}
+	this.requests[task]++
+	count := this.requests[task]
+	this.mutex.Unlock()
+
+	// give the other sub-agents a chance to run at the same time
+	time.Sleep(10 * time.Millisecond)
+	this.mutex.Lock()
+	this.running--
+	this.mutex.Unlock()
+
+	switch {
+	case task == "" && count == 1:
+		return callFunction("spawn_task", `{"tasks": ["alpha", "beta", "gamma"]}`), nil
+	case task == "":
+		return callFunction("finish", `{"success": true}`), nil
+	case count == 1:
+		return callFunction("command", fmt.Sprintf(`{"cmd": "echo %s"}`, task)), nil
+	}
+	return callFunction("finish", fmt.Sprintf(`{"success": true, "summary": "did %s"}`, task)), nil
+}
+
+func (this *spawningLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	return nil, nil
+}
+
+type lockedExecutor struct {
+	fakeExecutor
+	mutex sync.Mutex
+}
+
+func (this *lockedExecutor) Execute(ctx context.Context, cmd string) (string, int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.fakeExecutor.Execute(ctx, cmd)
+}
+
+func TestAgentSpawnTask(t *testing.T) {
+	llm := &spawningLLM{requests: map[string]int{}}
+	executor := &lockedExecutor{}
+
+	agent := NewAgent(llm, executor, "gpt-4o")
+	agent.SystemMessage = "Goal: {goal}"
+	agent.Unsafe = true
+	agent.Manager = NewAgentManager(3)
+	events := []*AgentEvent{}
+	agent.OnEvent = func(event *AgentEvent) {
+		events = append(events, event)
+	}
+
+	result, err := agent.Run(context.Background(), "check everything")
+	assert.NoError(t, err)
+	assert.True(t, result.Success)
+	assert.Equal(t, 3, llm.peak)
+	assert.ElementsMatch(t, []string{"echo alpha", "echo beta", "echo gamma"}, executor.commands)
+	assert.Equal(t, 3, agent.usage.Commands)
+
+	// the reports come back in order as the spawn_task output
+	reports := []*SubtaskReport{}
+	output := lastHistoryBlock(llm.parent[1])
+	assert.Equal(t, "spawn_task", output.FunctionName)
+	assert.NoError(t, json.Unmarshal([]byte(output.Content), &reports))
+	assert.Equal(t, []*SubtaskReport{
+		{Task: "alpha", Success: true, Summary: "did alpha"},
+		{Task: "beta", Success: true, Summary: "did beta"},
+		{Task: "gamma", Success: true, Summary: "did gamma"},
+	}, reports)
+
+	// sub-agents finish with a summary and can't spawn tasks themselves
+	tasks := map[int]bool{}
+	for _, event := range events {
+		if event.Task > 0 {
+			tasks[event.Task] = true
+		}
+	}
+	assert.Equal(t, map[int]bool{1: true, 2: true, 3: true}, tasks)
+	assert.Contains(t, functionNames(llm.parent[0].Functions), "spawn_task")
+}
+
+func TestSubagentsShareLimits(t *testing.T) {
+	llm := &spawningLLM{requests: map[string]int{}}
+	executor := &lockedExecutor{}
+
+	agent := NewAgent(llm, executor, "gpt-4o")
+	agent.SystemMessage = "Goal: {goal}"
+	agent.Unsafe = true
+	agent.Manager = NewAgentManager(3)
+	agent.Limits = GoalLimits{MaxCommands: 2}
+
+	// three sub-agents each try a command, only two fit in the parent's limit
+	result, err := agent.Run(context.Background(), "check everything")
+	assert.NoError(t, err)
+	assert.Equal(t, "the limit of 2 commands", result.Limit)
+	assert.Len(t, executor.commands, 2)
+	assert.Equal(t, 2, agent.usage.Commands)
+	assert.Greater(t, agent.usage.Tokens, 0)
+}
+
+func TestSpawnTaskCap(t *testing.T) {
+	agent := NewAgent(&functionCallLLM{}, &fakeExecutor{}, "gpt-4o")
+	agent.Manager = NewAgentManager(2)
+	output := agent.spawnTasks(context.Background(), `{"tasks": ["a", "b", "c"]}`)
+	assert.Equal(t, "Error: at most 2 tasks can be spawned at once, you gave 3", output)
+}
+
+func functionNames(functions []util.FunctionDefinition) []string {
+	names := []string{}
+	for _, function := range functions {
+		names = append(names, function.Name)
+	}
+	return names
+}
+
+func TestSubagentFunctions(t *testing.T) {
+	manager := NewAgentManager(1)
+	parent := NewAgent(&functionCallLLM{}, &fakeExecutor{}, "gpt-4o")
+	parent.Manager = manager
+	parent.Unsafe = true
+	assert.Equal(t, []string{"command", "user_input", "finish", "env_info", "spawn_task"},
+		functionNames(parent.functions(false)))
+	assert.Equal(t, []string{"user_input", "finish"}, functionNames(parent.functions(true)))
+
+	subagent := manager.subagent(parent, 1)
+	functions := subagent.functions(false)
+	assert.Equal(t, []string{"command", "user_input", "finish", "env_info"}, functionNames(functions))
+	assert.Equal(t, subtaskFinishFunction, functions[2])
+	assert.NotSame(t, parent.History, subagent.History)
+}
@@ -0,0 +1,571 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/spf13/afero"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// Summarizing a long document asks for facts from each chunk, these requests
+// run on a pool of workers, up to SummarizeConcurrency at a time, and the
+// facts are merged in chunk order. When one worker is rate limited all of
+// them back off together, rather than each retrying into the same limit.
+
+const DefaultSummarizeConcurrency = 4
+
+// Bytes of a document summarized at a time, the default for summarize -c
+const DefaultSummarizeChunkSize = 3600
+
+// A backoff shared by a pool of workers, when one request is rate limited no
+// worker starts a request until the delay has passed
+type sharedBackoff struct {
+	mutex    sync.Mutex
+	until    time.Time
+	failures int
+	policy   *RetryPolicy
+}
+
+func newSharedBackoff(policy *RetryPolicy) *sharedBackoff {
+	if policy == nil {
+		policy = DefaultRetryPolicy()
+	}
+	return &sharedBackoff{policy: policy}
+}
+
+func (this *sharedBackoff) wait(ctx context.Context) error {
+	for {
+		this.mutex.Lock()
+		delay := time.Until(this.until)
+		this.mutex.Unlock()
+		if delay <= 0 {
+			return ctx.Err()
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (this *sharedBackoff) failed() time.Duration {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	delay := this.policy.Delay(this.failures)
+	this.failures++
+	if until := time.Now().Add(delay); until.After(this.until) {
+		this.until = until
+	}
+	return delay
+}
+
+func (this *sharedBackoff) succeeded() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.failures = 0
+}
+
+// Call f, retrying rate limit and server errors up to retries times
+func (this *sharedBackoff) do(ctx context.Context, retries int, f func() (string, error)) (string, error) {
+	for attempt := 0; ; attempt++ {
+		err := this.wait(ctx)
+		if err != nil {
+			return "", err
+		}
+
+		result, err := f()
+		if err == nil {
+			this.succeeded()
+			return result, nil
+		}
+		if !this.policy.Retryable(err) || attempt >= retries || ctx.Err() != nil {
+			return "", err
+		}
+		delay := this.failed()
+		log.Printf("Request failed (%s), pausing all workers for %s\n", err, delay)
+	}
+}
+
+// Call f for each index from 0 to n with up to concurrency calls at a time,
+// returning the results in index order. Rate limit and server errors are
+// retried with a shared backoff under the policy, any other error stops the
+// pool.
+func runOrdered(
+	ctx context.Context,
+	n, concurrency, retries int,
+	policy *RetryPolicy,
+	f func(ctx context.Context, i int) (string, error),
+) ([]string, error) {
+	return runOrderedWithBackoff(ctx, newSharedBackoff(policy), n, concurrency, retries, f)
+}
+
+// Like runOrdered, but with a backoff shared with other pools, so that a rate
+// limit in one pauses the workers of all of them
+func runOrderedWithBackoff(
+	ctx context.Context,
+	backoff *sharedBackoff,
+	n, concurrency, retries int,
+	f func(ctx context.Context, i int) (string, error),
+) ([]string, error) {
+	poolCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]string, n)
+	indexes := make(chan int)
+	var waitGroup sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+
+	for w := 0; w < min(max(concurrency, 1), n); w++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for i := range indexes {
+				result, err := backoff.do(poolCtx, retries, func() (string, error) {
+					return f(poolCtx, i)
+				})
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					continue
+				}
+				results[i] = result
+			}
+		}()
+	}
+
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case indexes <- i:
+		case <-poolCtx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	waitGroup.Wait()
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return results, nil
+}
+
+// A document of any length is summarized map-reduce style: each chunk's facts
+// are requested, then while the facts don't fit in one request they're
+// grouped into requests that fit and each group is merged into a shorter list,
+// until one request can summarize all of them.
+
+// Keep merge requests small even for models with a huge context, the model
+// drops facts when asked to condense too much at once
+const summarizeMaxMergeTokens = 12000
+
+// How many tokens of facts we put in one request for a model, leaving room
+// for the prompt and the response
+func summarizeMergeBudget(model string, maxTokens int) int {
+	budget := NumTokensForModel(model) - maxTokens - 512
+	return max(min(budget, summarizeMaxMergeTokens), 1024)
+}
+
+// Count tokens with the model's tokenizer, if it can't be loaded (it's
+// downloaded the first time) estimate 4 bytes per token
+func tokenCounter(model string) func(string) int {
+	encoder, err := EncoderForModel(model)
+	if err != nil {
+		log.Printf("Estimating token counts: %s", err)
+		return func(s string) int {
+			return len(s)/4 + 1
+		}
+	}
+	return func(s string) int {
+		return len(encoder.Encode(s, nil, nil))
+	}
+}
+
+// What summarizing chunks sends before any merges, a request for the facts
+// in each chunk and one for the summary, or one request for a single chunk
+func (this *ButterfishCtx) summarizeCostEstimate(chunks [][]byte, countTokens func(string) int) *CostEstimate {
+	estimate := &CostEstimate{Model: this.Config.SummarizeModel, Requests: len(chunks)}
+	if len(chunks) > 1 {
+		estimate.Requests++
+	}
+	for _, chunk := range chunks {
+		estimate.Tokens += countTokens(string(chunk))
+	}
+	return estimate
+}
+
+// Split items into consecutive groups of at most budget tokens each, an item
+// that's over budget by itself gets its own group
+func groupByTokens(items []string, countTokens func(string) int, budget int) [][]string {
+	groups := [][]string{}
+	group := []string{}
+	tokens := 0
+	for _, item := range items {
+		n := countTokens(item)
+		if len(group) > 0 && tokens+n > budget {
+			groups = append(groups, group)
+			group = []string{}
+			tokens = 0
+		}
+		group = append(group, item)
+		tokens += n
+	}
+	if len(group) > 0 {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// Merge lists of facts in groups of at most budget tokens until they all fit
+// in one request. The request is copied for each merge, if progress isn't nil
+// each round is printed to it.
+func (this *ButterfishCtx) reduceFacts(
+	facts []string,
+	req *util.CompletionRequest,
+	budget, concurrency, retries int,
+	backoff *sharedBackoff,
+	countTokens func(string) int,
+	progress io.Writer,
+) ([]string, error) {
+	if backoff == nil {
+		backoff = newSharedBackoff(this.Config.RetryPolicy)
+	}
+	for {
+		groups := groupByTokens(facts, countTokens, budget)
+		// stop when everything fits, or when no group has more than one list
+		// and merging wouldn't make progress
+		if len(groups) <= 1 || len(groups) == len(facts) {
+			return facts, nil
+		}
+		if progress != nil {
+			fmt.Fprintf(progress, "Merging %d lists of facts in %d requests\n", len(facts), len(groups))
+		}
+
+		merged, err := runOrderedWithBackoff(req.Ctx, backoff, len(groups), concurrency, retries,
+			func(ctx context.Context, i int) (string, error) {
+				mergePrompt, err := this.PromptLibrary.GetPromptForModel(prompt.PromptSummarizeMergeFacts, req.Model,
+					"content", strings.Join(groups[i], ""))
+				if err != nil {
+					return "", err
+				}
+				mergeReq := *req
+				mergeReq.Ctx = ctx
+				mergeReq.Prompt = mergePrompt
+				resp, err := this.LLMClient.Completion(&mergeReq)
+				if err != nil {
+					return "", err
+				}
+				return resp.Completion + "\n", nil
+			})
+		if err != nil {
+			return nil, err
+		}
+		facts = merged
+	}
+}
+
+// Summarizing a directory walks its tree, skipping hidden files, anything in
+// a .gitignore, and files that aren't text, then summarizes each file, rolls
+// the file summaries up into a summary of each directory, deepest first, and
+// the top directory's into an overview of the whole project. The report is
+// markdown with a heading for each directory and file.
+
+// Stop rather than run up a bill on a huge tree
+const maxSummarizeFiles = 200
+
+// A file or directory in a summary report
+type SummaryNode struct {
+	// Relative to the directory being summarized, "." for itself
+	Path     string
+	Dir      bool
+	Summary  string
+	Children []*SummaryNode
+	depth    int
+}
+
+// Guess whether a file is text from its first bytes
+func looksLikeText(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	buf := make([]byte, 1024)
+	n, _ := io.ReadFull(file, buf)
+	buf = buf[:n]
+	if n == 0 || bytes.IndexByte(buf, 0) != -1 {
+		return false
+	}
+	// the read may have cut a multibyte rune in half
+	for i := 0; i < utf8.UTFMax && len(buf) > 0 && !utf8.Valid(buf); i++ {
+		buf = buf[:len(buf)-1]
+	}
+	return utf8.Valid(buf)
+}
+
+// Walk the tree under root, descending at most maxDepth levels, 0 means no
+// limit. Directories without any files to summarize are left out.
+func walkSummaryTree(root string, maxDepth int) (*SummaryNode, int, error) {
+	rules := &IgnoreRules{}
+	count := 0
+
+	var walk func(rel string, depth int) (*SummaryNode, error)
+	walk = func(rel string, depth int) (*SummaryNode, error) {
+		node := &SummaryNode{Path: rel, Dir: true, depth: depth}
+		err := rules.AddFile(root, rel)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := os.ReadDir(filepath.Join(root, rel))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			name := entry.Name()
+			path := filepath.Join(rel, name)
+			if strings.HasPrefix(name, ".") || rules.Ignored(path, entry.IsDir()) {
+				continue
+			}
+
+			if entry.IsDir() {
+				if maxDepth > 0 && depth+1 >= maxDepth {
+					continue
+				}
+				child, err := walk(path, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				if len(child.Children) > 0 {
+					node.Children = append(node.Children, child)
+				}
+				continue
+			}
+
+			if !entry.Type().IsRegular() || !looksLikeText(filepath.Join(root, path)) {
+				continue
+			}
+			count++
+			if count > maxSummarizeFiles {
+				return nil, fmt.Errorf("%s has more than %d files to summarize, use --max-depth or summarize a subdirectory", root, maxSummarizeFiles)
+			}
+			node.Children = append(node.Children, &SummaryNode{Path: path, depth: depth + 1})
+		}
+		return node, nil
+	}
+
+	node, err := walk(".", 0)
+	return node, count, err
+}
+
+// Nodes in the tree, parents before children
+func (this *SummaryNode) Walk(cb func(node *SummaryNode)) {
+	cb(this)
+	for _, child := range this.Children {
+		child.Walk(cb)
+	}
+}
+
+// The summaries of a directory's children as the content of its prompt
+func directoryPromptContent(node *SummaryNode) string {
+	builder := strings.Builder{}
+	for _, child := range node.Children {
+		name := filepath.Base(child.Path)
+		if child.Dir {
+			name += "/"
+		}
+		fmt.Fprintf(&builder, "%s:\n%s\n\n", name, strings.TrimSpace(child.Summary))
+	}
+	return builder.String()
+}
+
+// The name of the directory being summarized, even if it's given as "."
+func summaryRootName(root string) string {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return filepath.Base(root)
+	}
+	return filepath.Base(abs)
+}
+
+func (this *ButterfishCtx) summarizeDirectoryNode(ctx context.Context, rootName string, node *SummaryNode) (string, error) {
+	promptName := prompt.PromptSummarizeDirectory
+	if node.Path == "." {
+		promptName = prompt.PromptSummarizeProject
+	}
+	summaryPrompt, err := this.PromptLibrary.GetPromptForModel(promptName, this.Config.SummarizeModel,
+		"path", filepath.ToSlash(filepath.Join(rootName, node.Path)),
+		"content", directoryPromptContent(node))
+	if err != nil {
+		return "", err
+	}
+
+	req := &util.CompletionRequest{
+		Ctx:           ctx,
+		Prompt:        summaryPrompt,
+		Model:         this.Config.SummarizeModel,
+		MaxTokens:     this.Config.SummarizeMaxTokens,
+		Temperature:   this.Config.SummarizeTemperature,
+		SystemMessage: "N/A",
+	}
+	this.Config.LimitRequest(FeatureSummarize, req)
+	req.Retries = 0
+	resp, err := this.LLMClient.Completion(req)
+	if err != nil {
+		return "", err
+	}
+	return resp.Completion, nil
+}
+
+// Summarize the files in a directory tree, then each directory, then the
+// whole tree, returning a markdown report
+func (this *ButterfishCtx) SummarizeDirectory(root string, chunkSize, maxChunks, maxDepth int, yes bool) (string, error) {
+	tree, count, err := walkSummaryTree(root, maxDepth)
+	if err != nil {
+		return "", err
+	}
+	if count == 0 {
+		return "", fmt.Errorf("No files to summarize in %s", root)
+	}
+	estimate, err := this.summarizeDirectoryCostEstimate(root, tree, chunkSize, maxChunks)
+	if err != nil {
+		return "", err
+	}
+	this.StylePrintf(this.Config.Styles.Question, "Summarizing %d files in %s, %s\n", count, root, estimate)
+	err = this.ConfirmCost(estimate, yes)
+	if err != nil {
+		return "", err
+	}
+
+	files := []*SummaryNode{}
+	dirsByDepth := map[int][]*SummaryNode{}
+	deepest := 0
+	tree.Walk(func(node *SummaryNode) {
+		if node.Dir {
+			dirsByDepth[node.depth] = append(dirsByDepth[node.depth], node)
+			deepest = max(deepest, node.depth)
+		} else {
+			files = append(files, node)
+		}
+	})
+
+	retries := this.Config.RequestLimits[FeatureSummarize].Retries
+	var outputMutex sync.Mutex
+	fs := afero.NewOsFs()
+	// every request, for any file or directory, waits on the same backoff
+	backoff := newSharedBackoff(this.Config.RetryPolicy)
+
+	// each file's chunks are summarized one at a time, the pool is across
+	// files. Requests are retried on their own, so a file isn't restarted.
+	summaries, err := runOrderedWithBackoff(this.Ctx, backoff, len(files), this.Config.SummarizeConcurrency, 0,
+		func(ctx context.Context, i int) (string, error) {
+			path := filepath.Join(root, files[i].Path)
+			chunks, err := util.GetFileChunks(ctx, fs, path, chunkSize, maxChunks)
+			if err != nil {
+				return "", err
+			}
+			summary := new(bytes.Buffer)
+			err = this.summarizeChunksConcurrently(this.summarizeRequest(), chunks, summary, 1, nil, backoff)
+			if err != nil {
+				return "", fmt.Errorf("%s: %w", path, err)
+			}
+
+			outputMutex.Lock()
+			this.StylePrintf(this.Config.Styles.Grey, "Summarized %s\n", path)
+			outputMutex.Unlock()
+			return summary.String(), nil
+		})
+	if err != nil {
+		return "", err
+	}
+	for i, summary := range summaries {
+		files[i].Summary = summary
+	}
+
+	// a directory's summary needs its subdirectories' summaries first
+	for depth := deepest; depth >= 0; depth-- {
+		dirs := dirsByDepth[depth]
+		summaries, err := runOrderedWithBackoff(this.Ctx, backoff, len(dirs), this.Config.SummarizeConcurrency, retries,
+			func(ctx context.Context, i int) (string, error) {
+				return this.summarizeDirectoryNode(ctx, summaryRootName(root), dirs[i])
+			})
+		if err != nil {
+			return "", err
+		}
+		for i, summary := range summaries {
+			dirs[i].Summary = summary
+		}
+	}
+
+	return renderSummaryReport(root, tree), nil
+}
+
+// Estimate a directory summary from file sizes, at 4 bytes per token, rather
+// than reading every file
+func (this *ButterfishCtx) summarizeDirectoryCostEstimate(root string, tree *SummaryNode, chunkSize, maxChunks int) (*CostEstimate, error) {
+	estimate := &CostEstimate{Model: this.Config.SummarizeModel}
+	var err error
+	tree.Walk(func(node *SummaryNode) {
+		if node.Dir {
+			estimate.Requests++
+			return
+		}
+		info, statErr := os.Stat(filepath.Join(root, node.Path))
+		if statErr != nil {
+			err = statErr
+			return
+		}
+		size := info.Size()
+		if limit := int64(chunkSize) * int64(maxChunks); maxChunks > 0 && size > limit {
+			size = limit
+		}
+		chunks := int((size + int64(chunkSize) - 1) / int64(chunkSize))
+		estimate.Tokens += int(size / 4)
+		estimate.Requests += chunks
+		if chunks > 1 {
+			estimate.Requests++
+		}
+	})
+	return estimate, err
+}
+
+// Render the tree as markdown, a heading for each directory and file nested
+// by depth, starting with the project overview
+func renderSummaryReport(root string, tree *SummaryNode) string {
+	builder := strings.Builder{}
+	fmt.Fprintf(&builder, "# %s\n\n%s\n", summaryRootName(root), strings.TrimSpace(tree.Summary))
+
+	tree.Walk(func(node *SummaryNode) {
+		if node == tree {
+			return
+		}
+		heading := strings.Repeat("#", min(node.depth+1, 6))
+		name := filepath.ToSlash(node.Path)
+		if node.Dir {
+			name += "/"
+		}
+		fmt.Fprintf(&builder, "\n%s `%s`\n\n%s\n", heading, name, strings.TrimSpace(node.Summary))
+	})
+	return builder.String()
+}
@@ -0,0 +1,358 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Answers each chunk with its content, rate limiting the first request and
+// counting how many requests are in flight at once
+type concurrentLLM struct {
+	mutex       sync.Mutex
+	inFlight    int
+	maxInFlight int
+	requests    int
+	rateLimited bool
+	final       string
+}
+
+func (this *concurrentLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	this.final = request.Prompt
+	writer.Write([]byte("summary"))
+	return &util.CompletionResponse{Completion: "summary"}, nil
+}
+
+func (this *concurrentLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	this.mutex.Lock()
+	this.requests++
+	if !this.rateLimited {
+		this.rateLimited = true
+		this.mutex.Unlock()
+		return nil, errors.New("error, status code: 429, message: Rate limit reached")
+	}
+	this.inFlight++
+	this.maxInFlight = max(this.maxInFlight, this.inFlight)
+	this.mutex.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	this.mutex.Lock()
+	this.inFlight--
+	this.mutex.Unlock()
+	content := request.Prompt[strings.Index(request.Prompt, "chunk"):]
+	return &util.CompletionResponse{Completion: "facts from " + content}, nil
+}
+
+func (this *concurrentLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	return nil, nil
+}
+
+func TestSummarizeChunksConcurrently(t *testing.T) {
+	llm := &concurrentLLM{}
+	config := MakeButterfishConfig()
+	config.SummarizeConcurrency = 3
+	config.RequestLimits[FeatureSummarize] = RequestLimits{Retries: 2}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        config,
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+		Out:           new(bytes.Buffer),
+	}
+
+	chunks := [][]byte{}
+	for i := 0; i < 8; i++ {
+		chunks = append(chunks, []byte(fmt.Sprintf("chunk %d of the document", i)))
+	}
+	chunks = append(chunks, []byte("tiny"))
+
+	out := new(bytes.Buffer)
+	err := butterfish.WriteSummary(chunks, out)
+	assert.Nil(t, err)
+	assert.Equal(t, "summary", out.String())
+	// the tiny chunk is skipped and the rate limited request retried
+	assert.Equal(t, 9, llm.requests)
+	assert.True(t, llm.maxInFlight > 1 && llm.maxInFlight <= 3)
+
+	// facts are merged in chunk order
+	expected := []string{}
+	for i := 0; i < 8; i++ {
+		expected = append(expected, fmt.Sprintf("facts from chunk %d of the document\n", i))
+	}
+	assert.Contains(t, llm.final, strings.Join(expected, ""))
+}
+
+func TestRunOrderedStopsOnError(t *testing.T) {
+	calls := 0
+	var mutex sync.Mutex
+	_, err := runOrdered(context.Background(), 20, 1, 3, DefaultRetryPolicy(), func(ctx context.Context, i int) (string, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		calls++
+		if i == 2 {
+			return "", errors.New("bad request")
+		}
+		return "ok", nil
+	})
+	assert.EqualError(t, err, "bad request")
+	assert.True(t, calls < 20)
+}
+
+// Answers summarize prompts from the namePromptLibrary, safe to call from the
+// worker pool
+type summaryLLM struct {
+	mutex   sync.Mutex
+	prompts []string
+}
+
+func (this *summaryLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	response, err := this.Completion(request)
+	writer.Write([]byte(response.Completion))
+	return response, err
+}
+
+func (this *summaryLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	this.mutex.Lock()
+	this.prompts = append(this.prompts, request.Prompt)
+	this.mutex.Unlock()
+
+	fields := strings.Fields(request.Prompt)
+	switch fields[0] {
+	case "summarize_directory":
+		return &util.CompletionResponse{Completion: "directory " + fields[2]}, nil
+	case "summarize_project":
+		return &util.CompletionResponse{Completion: "overview of " + fields[2]}, nil
+	}
+	return &util.CompletionResponse{Completion: "file with " + fields[len(fields)-1]}, nil
+}
+
+func (this *summaryLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	return nil, nil
+}
+
+// Rate limits the first facts request, then answers like summaryLLM,
+// recording when each request starts
+type rateLimitOnceLLM struct {
+	summaryLLM
+	limitedAt time.Time
+	starts    []time.Time
+}
+
+func (this *rateLimitOnceLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	this.mutex.Lock()
+	now := time.Now()
+	if this.limitedAt.IsZero() && strings.HasPrefix(request.Prompt, "summarize_facts") {
+		this.limitedAt = now
+		this.mutex.Unlock()
+		return nil, errors.New("error, status code: 429, message: Rate limit reached")
+	}
+	this.starts = append(this.starts, now)
+	this.mutex.Unlock()
+	// keep the other file's worker busy while the limit is hit
+	time.Sleep(5 * time.Millisecond)
+	return this.summaryLLM.Completion(request)
+}
+
+func (this *rateLimitOnceLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	response, err := this.Completion(request)
+	if err != nil {
+		return nil, err
+	}
+	writer.Write([]byte(response.Completion))
+	return response, nil
+}
+
+func TestSummarizeDirectoryRateLimit(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"one", "two"} {
+		lines := []string{}
+		for i := 0; i < 3; i++ {
+			lines = append(lines, fmt.Sprintf("line %d of file %s", i, name))
+		}
+		assert.Nil(t, os.WriteFile(filepath.Join(root, name+".txt"), []byte(strings.Join(lines, "\n")), 0644))
+	}
+
+	llm := &rateLimitOnceLLM{}
+	config := MakeButterfishConfig()
+	config.RequestLimits[FeatureSummarize] = RequestLimits{Retries: 2}
+	config.SummarizeConcurrency = 2
+	delay := 100 * time.Millisecond
+	config.RetryPolicy = &RetryPolicy{BaseDelay: delay, MaxDelay: delay, Multiplier: 1, Statuses: []int{429}}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        config,
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+		Out:           new(bytes.Buffer),
+	}
+	_, err := butterfish.SummarizeDirectory(root, 20, 8, 0, false)
+	assert.Nil(t, err)
+
+	// only the rate limited request is retried, not every chunk of its file
+	facts := 0
+	for _, prompt := range llm.prompts {
+		if strings.HasPrefix(prompt, "summarize_facts") {
+			facts++
+		}
+	}
+	assert.Equal(t, 6, facts)
+
+	// and the other file's worker waited for the backoff too
+	for _, start := range llm.starts {
+		if start.After(llm.limitedAt) {
+			assert.GreaterOrEqual(t, start.Sub(llm.limitedAt), delay)
+		}
+	}
+}
+
+func TestSummarizeDirectory(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "proj")
+	files := map[string]string{
+		"main.go":            "package main",
+		".gitignore":         "build/\n*.log\n!keep.log\n",
+		"debug.log":          "noise",
+		"keep.log":           "kept",
+		"build/out.txt":      "generated",
+		".hidden/secret.txt": "secret",
+		"pkg/util.go":        "package pkg",
+		"pkg/deep/more.go":   "package deep",
+		"pkg/empty/data.bin": "\x00\x01",
+	}
+	for path, content := range files {
+		path = filepath.Join(root, path)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+	}
+
+	tree, count, err := walkSummaryTree(root, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, count)
+	paths := []string{}
+	tree.Walk(func(node *SummaryNode) { paths = append(paths, node.Path) })
+	assert.Equal(t, []string{".", "keep.log", "main.go", "pkg", "pkg/deep", "pkg/deep/more.go", "pkg/util.go"}, paths)
+
+	_, count, err = walkSummaryTree(root, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+
+	llm := &summaryLLM{}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+		Out:           new(bytes.Buffer),
+	}
+	report, err := butterfish.SummarizeDirectory(root, 3600, 8, 0, false)
+	assert.Nil(t, err)
+	assert.Equal(t, `# proj
+
+overview of proj
+
+## `+"`keep.log`"+`
+
+file with kept
+
+## `+"`main.go`"+`
+
+file with main
+
+## `+"`pkg/`"+`
+
+directory proj/pkg
+
+### `+"`pkg/deep/`"+`
+
+directory proj/pkg/deep
+
+#### `+"`pkg/deep/more.go`"+`
+
+file with deep
+
+### `+"`pkg/util.go`"+`
+
+file with pkg
+`, report)
+
+	// the directory prompt has its children's summaries
+	for _, prompt := range llm.prompts {
+		if strings.HasPrefix(prompt, "summarize_directory path proj/pkg ") {
+			assert.Contains(t, prompt, "deep/:\ndirectory proj/pkg/deep")
+			assert.Contains(t, prompt, "util.go:\nfile with pkg")
+		}
+	}
+}
+
+// Merges lists of facts by keeping the first two lines
+type mergeLLM struct {
+	mutex  sync.Mutex
+	merges int
+}
+
+func (this *mergeLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (this *mergeLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	this.mutex.Lock()
+	this.merges++
+	this.mutex.Unlock()
+
+	content := strings.TrimPrefix(request.Prompt, "summarize_merge_facts content ")
+	lines := strings.SplitN(content, "\n", 3)
+	return &util.CompletionResponse{Completion: lines[0] + "\n" + lines[1]}, nil
+}
+
+func (this *mergeLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	return nil, nil
+}
+
+func TestReduceFacts(t *testing.T) {
+	countTokens := func(s string) int { return len(strings.Fields(s)) }
+
+	groups := groupByTokens([]string{"a b\n", "c\n", "d e f g\n", "h\n"}, countTokens, 3)
+	assert.Equal(t, [][]string{{"a b\n", "c\n"}, {"d e f g\n"}, {"h\n"}}, groups)
+
+	llm := &mergeLLM{}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+		Out:           new(bytes.Buffer),
+	}
+	facts := []string{}
+	for i := 0; i < 8; i++ {
+		facts = append(facts, fmt.Sprintf("fact %d\nminor %d\n", i, i))
+	}
+	req := &util.CompletionRequest{Ctx: context.Background(), Model: "gpt-4o"}
+	progress := new(bytes.Buffer)
+
+	// 8 lists of 4 tokens in groups of 8 tokens merge into 4 lists, then
+	// into 2 lists that fit in one request
+	reduced, err := butterfish.reduceFacts(facts, req, 8, 2, 0, nil, countTokens, progress)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"fact 0\nminor 0\n", "fact 4\nminor 4\n"}, reduced)
+	assert.Equal(t, 4+2, llm.merges)
+	assert.Equal(t, "Merging 8 lists of facts in 4 requests\nMerging 4 lists of facts in 2 requests\n", progress.String())
+
+	// facts that already fit aren't merged
+	llm.merges = 0
+	reduced, err = butterfish.reduceFacts(facts, req, 100, 2, 0, nil, countTokens, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, facts, reduced)
+	assert.Equal(t, 0, llm.merges)
+}
@@ -0,0 +1,181 @@
+package butterfish
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// System info is added to the system message as {sysinfo}. It's built by a
+// chain of providers, each adding a line about the environment, e.g. the OS
+// or the git branch of the shell's directory. Providers can be turned on and
+// off by name with system_info in config.yaml, e.g.
+//
+//	system_info:
+//	  kubectl: true
+//	  git: false
+
+const systemInfoTimeout = 2 * time.Second
+
+type SystemInfoProvider struct {
+	Name string
+	// Whether the provider runs if config.yaml doesn't mention it, providers
+	// that run slow tools or share more than usual are off by default
+	Default bool
+	// Returns a line of info for the directory or "" if there's nothing to add
+	Info func(ctx context.Context, dir string) string
+}
+
+var SystemInfoProviders = []*SystemInfoProvider{
+	{Name: "os", Default: true, Info: osSystemInfo},
+	{Name: "git", Default: true, Info: gitSystemInfo},
+	{Name: "virtualenv", Default: true, Info: virtualenvSystemInfo},
+	{Name: "node", Default: false, Info: nodeSystemInfo},
+	{Name: "kubectl", Default: false, Info: kubectlSystemInfo},
+}
+
+func SystemInfoProviderNames() []string {
+	names := []string{}
+	for _, provider := range SystemInfoProviders {
+		names = append(names, provider.Name)
+	}
+	return names
+}
+
+func findSystemInfoProvider(name string) *SystemInfoProvider {
+	for _, provider := range SystemInfoProviders {
+		if provider.Name == name {
+			return provider
+		}
+	}
+	return nil
+}
+
+type SystemInfo struct {
+	providers []*SystemInfoProvider
+}
+
+// Create a chain of the default providers, with overrides by name
+func NewSystemInfo(enabled map[string]bool) *SystemInfo {
+	info := &SystemInfo{}
+	for _, provider := range SystemInfoProviders {
+		on, ok := enabled[provider.Name]
+		if !ok {
+			on = provider.Default
+		}
+		if on {
+			info.providers = append(info.providers, provider)
+		}
+	}
+	return info
+}
+
+// Run the providers concurrently for the directory and join their lines in
+// order
+func (this *SystemInfo) Get(ctx context.Context, dir string) string {
+	ctx, cancel := context.WithTimeout(ctx, systemInfoTimeout)
+	defer cancel()
+
+	lines := make([]string, len(this.providers))
+	var waitGroup sync.WaitGroup
+	for i, provider := range this.providers {
+		waitGroup.Add(1)
+		go func(i int, provider *SystemInfoProvider) {
+			defer waitGroup.Done()
+			lines[i] = strings.TrimSpace(provider.Info(ctx, dir))
+		}(i, provider)
+	}
+	waitGroup.Wait()
+
+	result := []string{}
+	for _, line := range lines {
+		if line != "" {
+			result = append(result, line)
+		}
+	}
+	return strings.Join(result, "\n")
+}
+
+// Run a command in a directory and return its trimmed output, "" on error
+func commandOutputIn(ctx context.Context, dir, name string, args ...string) string {
+	if _, err := exec.LookPath(name); err != nil {
+		return ""
+	}
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	if err != nil {
+		log.Printf("System info %s %v failed: %s", name, args, err)
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func osSystemInfo(ctx context.Context, dir string) string {
+	return GetSystemInfo()
+}
+
+func gitSystemInfo(ctx context.Context, dir string) string {
+	head := "on branch " + commandOutputIn(ctx, dir, "git", "symbolic-ref", "--quiet", "--short", "HEAD")
+	if head == "on branch " {
+		commit := commandOutputIn(ctx, dir, "git", "rev-parse", "--short", "HEAD")
+		if commit == "" {
+			return ""
+		}
+		head = "detached at " + commit
+	}
+
+	status := commandOutputIn(ctx, dir, "git", "status", "--porcelain")
+	if status == "" {
+		return fmt.Sprintf("Git: %s, no uncommitted changes", head)
+	}
+	return fmt.Sprintf("Git: %s, %d changed files", head, len(strings.Split(status, "\n")))
+}
+
+// We can't see the wrapped shell's environment after it activates a
+// virtualenv, so we also look for one in the directory
+func virtualenvSystemInfo(ctx context.Context, dir string) string {
+	if env := os.Getenv("VIRTUAL_ENV"); env != "" {
+		return "Python virtualenv: " + env
+	}
+	if env := os.Getenv("CONDA_DEFAULT_ENV"); env != "" {
+		return "Conda environment: " + env
+	}
+
+	for _, name := range []string{".venv", "venv"} {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(filepath.Join(path, "pyvenv.cfg")); err == nil {
+			return "Python virtualenv in directory: " + path
+		}
+	}
+	return ""
+}
+
+func nodeSystemInfo(ctx context.Context, dir string) string {
+	version := commandOutputIn(ctx, dir, "node", "--version")
+	if version == "" {
+		return ""
+	}
+	return "Node: " + version
+}
+
+func kubectlSystemInfo(ctx context.Context, dir string) string {
+	current := commandOutputIn(ctx, dir, "kubectl", "config", "current-context")
+	if current == "" {
+		return ""
+	}
+	return "Kubernetes context: " + current
+}
+
+// System info for the prompt about a directory, using the providers turned on
+// in the config
+func (this *ButterfishCtx) SystemInfo(dir string) string {
+	return NewSystemInfo(this.Config.SystemInfo).Get(this.Ctx, dir)
+}
@@ -0,0 +1,63 @@
+package butterfish
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSystemInfoProviders(t *testing.T) {
+	info := NewSystemInfo(nil)
+	names := []string{}
+	for _, provider := range info.providers {
+		names = append(names, provider.Name)
+	}
+	assert.Equal(t, []string{"os", "git", "virtualenv"}, names)
+
+	info = NewSystemInfo(map[string]bool{"os": false, "git": false, "kubectl": true})
+	names = []string{}
+	for _, provider := range info.providers {
+		names = append(names, provider.Name)
+	}
+	assert.Equal(t, []string{"virtualenv", "kubectl"}, names)
+
+	// providers with nothing to say are skipped and the rest stay in order
+	info = &SystemInfo{providers: []*SystemInfoProvider{
+		{Name: "a", Info: func(ctx context.Context, dir string) string { return "A in " + dir }},
+		{Name: "b", Info: func(ctx context.Context, dir string) string { return "" }},
+		{Name: "c", Info: func(ctx context.Context, dir string) string { return "C\n" }},
+	}}
+	assert.Equal(t, "A in /tmp\nC", info.Get(context.Background(), "/tmp"))
+}
+
+func TestSystemInfoDirectory(t *testing.T) {
+	t.Setenv("VIRTUAL_ENV", "")
+	t.Setenv("CONDA_DEFAULT_ENV", "")
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	assert.Equal(t, "", virtualenvSystemInfo(ctx, dir))
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, ".venv"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, ".venv", "pyvenv.cfg"), []byte("home = /usr/bin\n"), 0644))
+	assert.Equal(t, "Python virtualenv in directory: "+filepath.Join(dir, ".venv"), virtualenvSystemInfo(ctx, dir))
+
+	assert.Equal(t, "", gitSystemInfo(ctx, dir))
+	if commandOutputIn(ctx, dir, "git", "init", "-q", "-b", "trunk") == "" {
+		assert.Equal(t, "Git: on branch trunk, 1 changed files", gitSystemInfo(ctx, dir))
+	}
+}
+
+func TestLoadConfigFileSystemInfo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte("system_info:\n  kubectl: true\n  git: false\n"), 0644))
+	config, err := LoadConfigFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{"kubectl": true, "git": false}, config.SystemInfo)
+
+	assert.Nil(t, os.WriteFile(path, []byte("system_info:\n  kube: true\n"), 0644))
+	_, err = LoadConfigFile(path)
+	assert.ErrorContains(t, err, "Unknown provider kube in system_info")
+}
@@ -0,0 +1,375 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// butterfish tail <logfile> [question] follows a log file like tail -f.
+// Rather than re-reading the file, only lines added since the last update are
+// summarized, as facts like the chunks of a long document in summarize. The
+// facts from recent updates are kept as a running summary of the log,
+// condensed with the same merge requests when they grow too long, and older
+// ones slide out. Without a question the facts for each update are printed.
+// With one, e.g. "tell me when payments start failing", the new lines and the
+// running summary are sent with it and the answer is printed only when there's
+// something to say.
+
+const (
+	// How often the file is checked for new lines
+	tailPollInterval = 500 * time.Millisecond
+	// A line longer than this without a newline is summarized as is
+	tailMaxPartial = 64 * 1024
+	// Response from the question prompt when there's nothing to report
+	tailNothing = "NOTHING"
+	// At most this many chunks of lines wait to be summarized, older lines are
+	// dropped if the log grows faster than we can summarize it or updates
+	// keep failing
+	tailMaxPendingChunks = 8
+)
+
+type TailOptions struct {
+	Path     string
+	Question string
+	// Start with this many lines from the end of the file
+	Lines int
+	// Summarize new lines at most this often, or sooner once ChunkSize bytes
+	// have arrived
+	Interval  time.Duration
+	ChunkSize int
+	// How many lists of facts the running summary keeps
+	Window int
+}
+
+// Reads lines appended to a file. A file that's truncated or replaced, e.g.
+// by log rotation, is read again from the start.
+type fileFollower struct {
+	path    string
+	file    *os.File
+	offset  int64
+	partial string
+	// we skipped ahead into the middle of a line, drop the rest of it
+	skipLine bool
+}
+
+// The offset of the start of the last n lines of a file
+func lastLinesOffset(file io.ReaderAt, size int64, n int) (int64, error) {
+	if n <= 0 {
+		return size, nil
+	}
+
+	buf := make([]byte, 4096)
+	newlines := 0
+	for offset := size; offset > 0; {
+		readSize := int64(len(buf))
+		if offset < readSize {
+			readSize = offset
+		}
+		offset -= readSize
+		_, err := file.ReadAt(buf[:readSize], offset)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := readSize - 1; i >= 0; i-- {
+			// a newline at the very end finishes the last line
+			if buf[i] != '\n' || offset+i == size-1 {
+				continue
+			}
+			newlines++
+			if newlines == n {
+				return offset + i + 1, nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+func openFollower(path string, lines int) (*fileFollower, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+
+	offset, err := lastLinesOffset(file, info.Size(), lines)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &fileFollower{path: path, file: file, offset: offset}, nil
+}
+
+// Complete lines added since the last read, reading at most limit bytes. If
+// more than that was added, the older lines are skipped.
+func (this *fileFollower) read(limit int) (string, error) {
+	info, err := this.file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	// the file was rotated, finish the old one before moving to the new one
+	if pathInfo, err := os.Stat(this.path); err == nil && !os.SameFile(info, pathInfo) && info.Size() <= this.offset {
+		file, err := os.Open(this.path)
+		if err != nil {
+			return "", err
+		}
+		this.file.Close()
+		this.file = file
+		this.offset = 0
+		this.partial = ""
+		this.skipLine = false
+		info = pathInfo
+	}
+
+	if info.Size() < this.offset {
+		// truncated
+		this.offset = 0
+		this.partial = ""
+		this.skipLine = false
+	}
+	if info.Size() == this.offset {
+		return "", nil
+	}
+	if info.Size()-this.offset > int64(limit) {
+		log.Printf("Skipping %d bytes of %s, it grew faster than we can summarize", info.Size()-this.offset-int64(limit), this.path)
+		this.offset = info.Size() - int64(limit)
+		this.partial = ""
+		this.skipLine = true
+	}
+
+	data := make([]byte, info.Size()-this.offset)
+	n, err := this.file.ReadAt(data, this.offset)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	this.offset += int64(n)
+
+	text := this.partial + string(data[:n])
+	if this.skipLine {
+		newline := strings.Index(text, "\n")
+		if newline < 0 {
+			return "", nil
+		}
+		text = text[newline+1:]
+		this.skipLine = false
+	}
+	end := strings.LastIndex(text, "\n") + 1
+	this.partial = text[end:]
+	if len(this.partial) > tailMaxPartial {
+		end = len(text)
+		this.partial = ""
+	}
+	return text[:end], nil
+}
+
+func (this *fileFollower) Close() error {
+	return this.file.Close()
+}
+
+type logTail struct {
+	butterfish  *ButterfishCtx
+	options     *TailOptions
+	countTokens func(string) int
+	// Lines that haven't been summarized yet, kept until an update succeeds
+	pending string
+	// The running summary, lists of facts oldest first
+	facts []string
+}
+
+func newLogTail(butterfish *ButterfishCtx, options *TailOptions) *logTail {
+	return &logTail{
+		butterfish:  butterfish,
+		options:     options,
+		countTokens: tokenCounter(butterfish.Config.SummarizeModel),
+	}
+}
+
+// The most pending lines we keep
+func (this *logTail) maxPending() int {
+	return this.options.ChunkSize * tailMaxPendingChunks
+}
+
+// Queue lines for the next update, dropping the oldest ones past maxPending
+func (this *logTail) add(lines string) {
+	this.pending += lines
+	if len(this.pending) <= this.maxPending() {
+		return
+	}
+	pending := this.pending[len(this.pending)-this.maxPending():]
+	if newline := strings.Index(pending, "\n"); newline >= 0 {
+		pending = pending[newline+1:]
+	}
+	log.Printf("Dropping %d bytes of %s that weren't summarized", len(this.pending)-len(pending), this.options.Path)
+	this.pending = pending
+}
+
+// Summarize the lines added since the last update into the running summary,
+// then print the new facts or the answer to the question. The lines stay
+// pending if summarizing them fails, so that the next update tries again.
+func (this *logTail) update(ctx context.Context) error {
+	content := this.pending
+	if strings.TrimSpace(content) == "" {
+		this.pending = ""
+		return nil
+	}
+
+	butterfish := this.butterfish
+	config := butterfish.Config
+	req := &util.CompletionRequest{
+		Ctx:           ctx,
+		Model:         config.SummarizeModel,
+		MaxTokens:     config.SummarizeMaxTokens,
+		Temperature:   config.SummarizeTemperature,
+		SystemMessage: "N/A",
+	}
+	config.LimitRequest(FeatureSummarize, req)
+
+	chunks, err := util.GetChunks(strings.NewReader(content), this.options.ChunkSize, -1)
+	if err != nil {
+		return err
+	}
+
+	// the pool does the retrying so that rate limits pause every worker
+	factsReq := *req
+	factsReq.Retries = 0
+	facts, err := runOrdered(ctx, len(chunks), config.SummarizeConcurrency, req.Retries, config.RetryPolicy,
+		func(ctx context.Context, i int) (string, error) {
+			factsPrompt, err := butterfish.PromptLibrary.GetPromptForModel(prompt.PromptSummarizeFacts, req.Model,
+				"content", string(chunks[i]))
+			if err != nil {
+				return "", err
+			}
+			chunkReq := factsReq
+			chunkReq.Ctx = ctx
+			chunkReq.Prompt = factsPrompt
+			resp, err := butterfish.LLMClient.Completion(&chunkReq)
+			if err != nil {
+				return "", err
+			}
+			return strings.TrimSpace(resp.Completion) + "\n", nil
+		})
+	if err != nil {
+		return err
+	}
+
+	window := append(append([]string{}, this.facts...), facts...)
+	if len(window) > this.options.Window {
+		window = window[len(window)-this.options.Window:]
+	}
+	budget := summarizeMergeBudget(req.Model, req.MaxTokens)
+	window, err = butterfish.reduceFacts(window, &factsReq, budget,
+		config.SummarizeConcurrency, req.Retries, nil, this.countTokens, nil)
+	if err != nil {
+		return err
+	}
+	// the lines are in the summary now, if the question fails the next one
+	// still sees them there
+	this.facts = window
+	this.pending = ""
+
+	lineCount := strings.Count(content, "\n")
+	if this.options.Question == "" {
+		butterfish.StylePrintf(config.Styles.Grey, "[%s] %s\n", time.Now().Format(time.TimeOnly), plural(lineCount, "new line"))
+		butterfish.Printf("%s\n", strings.Join(facts, ""))
+		return nil
+	}
+
+	// the question only needs the latest lines, the summary covers the rest
+	recent := string(chunks[len(chunks)-1])
+	questionPrompt, err := butterfish.PromptLibrary.GetPromptForModel(prompt.PromptTailQuestion, req.Model,
+		"path", this.options.Path,
+		"facts", strings.Join(this.facts, ""),
+		"content", recent,
+		"question", this.options.Question)
+	if err != nil {
+		return err
+	}
+	questionReq := *req
+	questionReq.Prompt = questionPrompt
+	resp, err := butterfish.LLMClient.Completion(&questionReq)
+	if err != nil {
+		return err
+	}
+
+	answer := strings.TrimSpace(resp.Completion)
+	if answer == "" || strings.HasPrefix(answer, tailNothing) {
+		return nil
+	}
+	butterfish.StylePrintf(config.Styles.Grey, "[%s] %s\n", time.Now().Format(time.TimeOnly), plural(lineCount, "new line"))
+	butterfish.StylePrintf(config.Styles.Answer, "%s\n", answer)
+	return nil
+}
+
+// Follow a log file until the context is cancelled, summarizing new lines
+// as they arrive
+func (this *ButterfishCtx) TailFile(options *TailOptions) error {
+	if this.InConsoleMode {
+		return errors.New("tail runs until it's interrupted, it doesn't work in Console Mode")
+	}
+	if options.ChunkSize <= 0 {
+		return errors.New("Chunk size must be greater than 0")
+	}
+	if options.Window <= 0 {
+		options.Window = 1
+	}
+
+	follower, err := openFollower(options.Path, options.Lines)
+	if err != nil {
+		return err
+	}
+	defer follower.Close()
+
+	tail := newLogTail(this, options)
+	this.StylePrintf(this.Config.Styles.Grey, "Following %s, summarizing new lines every %s\n", options.Path, options.Interval)
+
+	ticker := time.NewTicker(tailPollInterval)
+	defer ticker.Stop()
+	// the last lines of the file are summarized straight away
+	lastUpdate := time.Time{}
+	failed := false
+
+	for {
+		lines, err := follower.read(tail.maxPending())
+		if err != nil {
+			return err
+		}
+		tail.add(lines)
+
+		// after a failure wait for the interval rather than retrying as soon
+		// as a chunk is pending
+		pending := len(tail.pending)
+		due := time.Since(lastUpdate) >= options.Interval
+		if pending > 0 && (due || pending >= options.ChunkSize && !failed) {
+			lastUpdate = time.Now()
+			err = tail.update(this.Ctx)
+			failed = err != nil
+			if err != nil && this.Ctx.Err() == nil {
+				// keep following, the API may come back
+				this.printError(err, "tail")
+			}
+		}
+
+		select {
+		case <-this.Ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
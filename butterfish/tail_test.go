@@ -0,0 +1,129 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileFollower(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	assert.Nil(t, os.WriteFile(path, []byte("one\ntwo\nthree\n"), 0644))
+
+	follower, err := openFollower(path, 2)
+	assert.Nil(t, err)
+	defer follower.Close()
+	lines, err := follower.read(1024)
+	assert.Nil(t, err)
+	assert.Equal(t, "two\nthree\n", lines)
+
+	// partial lines wait for their newline
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	file.WriteString("four\nfi")
+	lines, _ = follower.read(1024)
+	assert.Equal(t, "four\n", lines)
+	file.WriteString("ve\n")
+	file.Close()
+	lines, _ = follower.read(1024)
+	assert.Equal(t, "five\n", lines)
+
+	// truncated and rotated files start over
+	assert.Nil(t, os.WriteFile(path, []byte("six\n"), 0644))
+	lines, _ = follower.read(1024)
+	assert.Equal(t, "six\n", lines)
+	assert.Nil(t, os.Rename(path, path+".1"))
+	assert.Nil(t, os.WriteFile(path, []byte("seven\n"), 0644))
+	lines, _ = follower.read(1024)
+	assert.Equal(t, "seven\n", lines)
+
+	// when more arrives than we'd keep, only the most recent lines are read
+	assert.Nil(t, os.WriteFile(path, []byte("seven\neight\nnine\nten\n"), 0644))
+	lines, _ = follower.read(12)
+	assert.Equal(t, "nine\nten\n", lines)
+
+	offset, err := lastLinesOffset(bytes.NewReader([]byte("a\nb\nc")), 5, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), offset)
+}
+
+func TestLogTailUpdate(t *testing.T) {
+	llm := &scriptedLLM{responses: []string{"- payments failing\n", "Payments started failing at 10:02."}}
+	out := new(bytes.Buffer)
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+		Out:           out,
+	}
+	options := &TailOptions{Path: "app.log", Question: "tell me when payments fail", ChunkSize: 3600, Window: 2}
+	tail := &logTail{butterfish: butterfish, options: options, countTokens: estimateTokens}
+
+	tail.add("10:02 payment declined\n")
+	assert.Nil(t, tail.update(context.Background()))
+	assert.Equal(t, 2, len(llm.requests))
+	assert.Contains(t, llm.requests[0].Prompt, "10:02 payment declined")
+	assert.Contains(t, llm.requests[1].Prompt, "tell me when payments fail")
+	assert.Contains(t, llm.requests[1].Prompt, "- payments failing")
+	assert.Contains(t, out.String(), "1 new line\n")
+	assert.Contains(t, out.String(), "Payments started failing at 10:02.")
+
+	// nothing is printed when there's nothing to report, and the oldest facts
+	// slide out of the summary
+	llm.responses = []string{"- b\n", "NOTHING"}
+	llm.requests = nil
+	out.Reset()
+	tail.add("b\n")
+	assert.Nil(t, tail.update(context.Background()))
+	tail.add("c\n")
+	assert.Nil(t, tail.update(context.Background()))
+	assert.Equal(t, "", out.String())
+	assert.Equal(t, []string{"- b\n", "- b\n"}, tail.facts)
+
+	// without a question the new facts are printed
+	options.Question = ""
+	llm.responses = []string{"- the cache warmed up\n"}
+	tail.add("cache ready\n")
+	assert.Nil(t, tail.update(context.Background()))
+	assert.Contains(t, out.String(), "- the cache warmed up")
+}
+
+func TestLogTailFailure(t *testing.T) {
+	llm := &failoverTestLLM{err: errors.New("service unavailable")}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+		Out:           new(bytes.Buffer),
+	}
+	options := &TailOptions{Path: "app.log", ChunkSize: 10, Window: 2}
+	tail := &logTail{butterfish: butterfish, options: options, countTokens: estimateTokens}
+
+	// lines stay pending until they're summarized
+	tail.add("payment declined\n")
+	assert.NotNil(t, tail.update(context.Background()))
+	assert.Equal(t, "payment declined\n", tail.pending)
+	assert.Equal(t, 0, len(tail.facts))
+
+	// but only the most recent ones
+	for i := 0; i < 20; i++ {
+		tail.add("line " + strconv.Itoa(i) + "\n")
+	}
+	assert.LessOrEqual(t, len(tail.pending), tail.maxPending())
+	assert.True(t, strings.HasPrefix(tail.pending, "line "))
+	assert.True(t, strings.HasSuffix(tail.pending, "line 19\n"))
+
+	llm.err = nil
+	assert.Nil(t, tail.update(context.Background()))
+	assert.Equal(t, "", tail.pending)
+	assert.NotEqual(t, 0, len(tail.facts))
+}
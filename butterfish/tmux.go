@@ -0,0 +1,114 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// When running inside tmux, the scrollback of a pane can be added to the shell
+// history, so that prompts can refer to output of programs that didn't run
+// under Butterfish, e.g. in another pane or before the shell started. This is
+// done with the "Context tmux [pane]" shell command, or with --tmux for the
+// current pane when the shell starts.
+
+// How many lines of scrollback we ask tmux for
+const tmuxCaptureLines = 2000
+
+func inTmux() bool {
+	return os.Getenv("TMUX") != ""
+}
+
+// Capture a pane's scrollback, pane is a tmux target like %3 or 1.0, or empty
+// for the pane we're running in
+func captureTmuxPane(ctx context.Context, pane string) (string, error) {
+	if !inTmux() {
+		return "", errors.New("Not running inside tmux")
+	}
+	if pane == "" {
+		pane = os.Getenv("TMUX_PANE")
+	}
+
+	// -J joins wrapped lines, -S reaches back into the scrollback
+	args := []string{"capture-pane", "-p", "-J", "-S", fmt.Sprintf("-%d", tmuxCaptureLines)}
+	if pane != "" {
+		args = append(args, "-t", pane)
+	}
+	output, err := exec.CommandContext(ctx, "tmux", args...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("tmux capture-pane failed: %s", strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", err
+	}
+
+	// the visible part of the pane is padded with empty lines
+	return strings.TrimRight(string(output), "\n "), nil
+}
+
+// Keep the last lines of text that fit in maxBytes, since the end of the
+// scrollback is usually what a prompt is about
+func tailLines(text string, maxBytes int) string {
+	if len(text) <= maxBytes {
+		return text
+	}
+	text = text[len(text)-maxBytes:]
+	if i := strings.IndexByte(text, '\n'); i != -1 {
+		text = text[i+1:]
+	}
+	return text
+}
+
+// Parse "Context tmux [pane]", returning the pane, which may be empty. Other
+// prompts starting with Context are normal prompts.
+func tmuxContextCommand(prompt string) (string, bool) {
+	text, ok := localCommandText(prompt, "context")
+	if !ok {
+		return "", false
+	}
+	fields := strings.Fields(text)
+	if len(fields) == 0 || len(fields) > 2 || !strings.EqualFold(fields[0], "tmux") {
+		return "", false
+	}
+	if len(fields) == 2 {
+		return fields[1], true
+	}
+	return "", true
+}
+
+// Add a tmux pane's scrollback to the history as a block of shell output
+func (this *ShellState) AddTmuxContext(pane string) (int, error) {
+	scrollback, err := captureTmuxPane(this.Butterfish.Ctx, pane)
+	if err != nil {
+		return 0, err
+	}
+	if pane == "" {
+		pane = os.Getenv("TMUX_PANE")
+	}
+
+	// history blocks are truncated from the end, so trim them here first,
+	// assuming a few bytes per token
+	maxBytes := this.HistoryBlockMaxTokens * 3
+	scrollback = tailLines(sanitizeTTYString(scrollback), maxBytes)
+	if scrollback == "" {
+		return 0, nil
+	}
+
+	this.History.AddBlock(historyTypeShellOutput,
+		fmt.Sprintf("Scrollback of tmux pane %s:\n%s\n", pane, scrollback))
+	return strings.Count(scrollback, "\n") + 1, nil
+}
+
+func (this *ShellState) tmuxContextLocalCommand(pane string) {
+	lines, err := this.AddTmuxContext(pane)
+	if err != nil {
+		this.Prompt.Clear()
+		this.PrintError(err)
+		return
+	}
+	this.printLocalResponse(fmt.Sprintf("Added %d lines of tmux scrollback to the history\n", lines))
+}
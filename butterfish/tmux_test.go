@@ -0,0 +1,62 @@
+package butterfish
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTmuxContextCommand(t *testing.T) {
+	pane, ok := tmuxContextCommand("Context tmux")
+	assert.True(t, ok)
+	assert.Equal(t, "", pane)
+	pane, ok = tmuxContextCommand("context TMUX %3")
+	assert.True(t, ok)
+	assert.Equal(t, "%3", pane)
+
+	_, ok = tmuxContextCommand("Context matters, what does this output mean?")
+	assert.False(t, ok)
+	_, ok = tmuxContextCommand("Contexts tmux")
+	assert.False(t, ok)
+
+	assert.Equal(t, "short", tailLines("short", 100))
+	assert.Equal(t, "three\nfour", tailLines("one\ntwo\nthree\nfour", 12))
+}
+
+func TestAddTmuxContext(t *testing.T) {
+	// a fake tmux that prints its arguments and some colored output
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho \"$@\"\nprintf '\\033[31mpanic: boom\\033[0m\\n\\n\\n'\n"
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "tmux"), []byte(script), 0755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("TMUX", "/tmp/tmux-1000/default,1,0")
+	t.Setenv("TMUX_PANE", "%1")
+
+	config := MakeButterfishConfig()
+	shellState := &ShellState{
+		Butterfish:            &ButterfishCtx{Ctx: context.Background(), Config: config},
+		History:               NewShellHistory(),
+		HistoryBlockMaxTokens: 1024,
+	}
+	shellState.History.Append(historyTypeShellOutput, "earlier output\n")
+
+	lines, err := shellState.AddTmuxContext("")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, lines)
+	lines, err = shellState.AddTmuxContext("%3")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, lines)
+
+	// each capture is its own block rather than being appended to the last
+	assert.Equal(t, 3, len(shellState.History.Blocks))
+	assert.Equal(t, "Scrollback of tmux pane %1:\ncapture-pane -p -J -S -2000 -t %1\npanic: boom\n",
+		shellState.History.Blocks[1].Content.String())
+	assert.Contains(t, shellState.History.Blocks[2].Content.String(), "-t %3\n")
+
+	t.Setenv("TMUX", "")
+	_, err = shellState.AddTmuxContext("")
+	assert.ErrorContains(t, err, "Not running inside tmux")
+}
@@ -0,0 +1,106 @@
+package butterfish
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+// butterfish tokens counts the tokens in stdin or files for one or more
+// models, with the share of each model's context window and what sending it
+// as input would cost, so you can check before pasting a big file into a
+// prompt.
+
+// One model's row in a token count table
+type modelTokenCount struct {
+	Model  string
+	Tokens int
+}
+
+// Count the tokens in text for each model, using each model's tokenizer
+func countTokensForModels(text string, models []string) ([]modelTokenCount, error) {
+	counts := []modelTokenCount{}
+	for _, model := range models {
+		encoder, err := EncoderForModel(model)
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, modelTokenCount{
+			Model:  model,
+			Tokens: len(encoder.Encode(text, nil, nil)),
+		})
+	}
+	return counts, nil
+}
+
+// Write a table of token counts with the share of each model's context
+// window and the input cost
+func writeTokenCounts(out io.Writer, counts []modelTokenCount) {
+	writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "Model\tTokens\tContext\tInput cost\n")
+	for _, count := range counts {
+		context := fmt.Sprintf("%.1f%%", 100*float64(count.Tokens)/float64(NumTokensForModel(count.Model)))
+		cost := "unknown"
+		if dollars, ok := InputCostForModel(count.Model, count.Tokens); ok {
+			cost = fmt.Sprintf("$%.4f", dollars)
+		}
+		fmt.Fprintf(writer, "%s\t%d\t%s\t%s\n", count.Model, count.Tokens, context, cost)
+	}
+	writer.Flush()
+}
+
+func (this *ButterfishCtx) tokensCommand(options *CliCommandConfig) error {
+	models := options.Tokens.Models
+	if len(models) == 0 {
+		return errors.New("Please provide a model with -m")
+	}
+
+	if len(options.Tokens.Files) == 0 {
+		content, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		counts, err := countTokensForModels(string(content), models)
+		if err != nil {
+			return err
+		}
+		writeTokenCounts(this.Out, counts)
+		return nil
+	}
+
+	files := options.Tokens.Files
+	totals := make([]modelTokenCount, len(models))
+	for i, model := range models {
+		totals[i].Model = model
+	}
+
+	for _, path := range files {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		counts, err := countTokensForModels(string(content), models)
+		if err != nil {
+			return err
+		}
+		for i, count := range counts {
+			totals[i].Tokens += count.Tokens
+		}
+
+		if len(files) > 1 {
+			this.StylePrintf(this.Config.Styles.Question, "%s\n", path)
+		}
+		writeTokenCounts(this.Out, counts)
+		if len(files) > 1 {
+			fmt.Fprintln(this.Out)
+		}
+	}
+
+	if len(files) > 1 {
+		this.StylePrintf(this.Config.Styles.Question, "Total\n")
+		writeTokenCounts(this.Out, totals)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package butterfish
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInputCostForModel(t *testing.T) {
+	cost, ok := InputCostForModel("gpt-4-turbo", 1000000)
+	assert.True(t, ok)
+	assert.InDelta(t, 10.0, cost, 0.0001)
+
+	// dated models use the price of the base model
+	cost, ok = InputCostForModel("gpt-4-turbo-2024-04-09", 2000)
+	assert.True(t, ok)
+	assert.InDelta(t, 0.02, cost, 0.0001)
+
+	_, ok = InputCostForModel("llama3", 2000)
+	assert.False(t, ok)
+}
+
+func TestWriteTokenCounts(t *testing.T) {
+	out := new(bytes.Buffer)
+	writeTokenCounts(out, []modelTokenCount{
+		{Model: "gpt-4-turbo", Tokens: 12800},
+		{Model: "llama3", Tokens: 4096},
+	})
+	assert.Equal(t, `Model        Tokens  Context  Input cost
+gpt-4-turbo  12800   10.0%    $0.1280
+llama3       4096    50.0%    unknown
+`, out.String())
+}
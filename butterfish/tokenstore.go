@@ -0,0 +1,537 @@
+package butterfish
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/joho/godotenv"
+	"golang.org/x/term"
+)
+
+// API tokens are kept in the OS keychain when there is one we can use, the
+// macOS Keychain through the security command or the Secret Service
+// (GNOME Keyring, KWallet) through libsecret's secret-tool, or the Windows
+// Credential Manager through PowerShell, and otherwise in butterfish.env as
+// plain text. Tokens are saved per provider, the default
+// one butterfish uses is "openai", and in butterfish.env a provider's token
+// is the <PROVIDER>_TOKEN variable, e.g. OPENAI_TOKEN.
+//
+// The store is picked with token_store in config.yaml, keychain or env,
+// empty means the keychain if there is one. Tokens in butterfish.env are
+// still read when the keychain is used, so an existing setup keeps working
+// until the token is moved with `butterfish auth set openai`.
+
+const (
+	TokenStoreKeychain = "keychain"
+	TokenStoreEnvFile  = "env"
+)
+
+var TokenStores = []string{TokenStoreKeychain, TokenStoreEnvFile}
+
+// The provider whose token is used for the API
+const DefaultTokenProvider = "openai"
+
+// Entries in the keychain are saved under this service name
+const keychainService = "butterfish"
+
+var ErrTokenNotFound = errors.New("Token not found")
+
+type TokenStore interface {
+	// Returns ErrTokenNotFound if there's no token for the provider
+	Get(provider string) (string, error)
+	Set(provider, token string) error
+	// Returns ErrTokenNotFound if there's no token for the provider
+	Delete(provider string) error
+	// Where the provider's token is kept, e.g. "OPENAI_TOKEN in
+	// ~/.config/butterfish/butterfish.env"
+	Describe(provider string) string
+}
+
+var providerRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]*$`)
+
+func ValidateTokenProvider(provider string) error {
+	if !providerRegex.MatchString(provider) {
+		return fmt.Errorf("Invalid provider name %q, use letters, numbers, - and _", provider)
+	}
+	return nil
+}
+
+// Tokens go on the command line of the keychain tools, so we keep them to a
+// single word
+func validateToken(token string) error {
+	if token == "" {
+		return errors.New("Empty token")
+	}
+	if strings.ContainsAny(token, " \t\r\n\"'\\") {
+		return errors.New("Tokens can't contain spaces, quotes, or backslashes")
+	}
+	return nil
+}
+
+// The env var that holds a provider's token, e.g. OPENAI_TOKEN
+func TokenEnvVar(provider string) string {
+	return strings.ToUpper(strings.ReplaceAll(provider, "-", "_")) + "_TOKEN"
+}
+
+func ValidateTokenStore(name string) error {
+	if name != "" && name != TokenStoreKeychain && name != TokenStoreEnvFile {
+		return fmt.Errorf("Unknown token_store %s, expected one of %v", name, TokenStores)
+	}
+	return nil
+}
+
+// The store to save tokens in given the token_store setting, and the stores
+// to read them from in order
+func NewTokenStores(name, envFile string) (TokenStore, []TokenStore, error) {
+	envStore := &EnvFileTokenStore{Path: envFile}
+	if name == TokenStoreEnvFile {
+		return envStore, []TokenStore{envStore}, nil
+	}
+
+	keychain, err := NewKeychainTokenStore()
+	if err != nil {
+		if name == TokenStoreKeychain {
+			return nil, nil, err
+		}
+		return envStore, []TokenStore{envStore}, nil
+	}
+	return keychain, []TokenStore{keychain, envStore}, nil
+}
+
+// Find a provider's token in the first store that has it
+func LookupToken(stores []TokenStore, provider string) (string, TokenStore, error) {
+	for _, store := range stores {
+		token, err := store.Get(provider)
+		if errors.Is(err, ErrTokenNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		return token, store, nil
+	}
+	return "", nil, ErrTokenNotFound
+}
+
+// Tokens as <PROVIDER>_TOKEN lines in an env file, usually butterfish.env
+type EnvFileTokenStore struct {
+	Path string
+}
+
+func (this *EnvFileTokenStore) Get(provider string) (string, error) {
+	vars, err := godotenv.Read(this.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", ErrTokenNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	token := vars[TokenEnvVar(provider)]
+	if token == "" {
+		return "", ErrTokenNotFound
+	}
+	return token, nil
+}
+
+func (this *EnvFileTokenStore) Set(provider, token string) error {
+	if err := validateToken(token); err != nil {
+		return err
+	}
+	lines, _, err := this.otherLines(provider)
+	if err != nil {
+		return err
+	}
+	lines = append(lines, TokenEnvVar(provider)+"="+token)
+
+	err = os.MkdirAll(filepath.Dir(this.Path), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(this.Path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
+func (this *EnvFileTokenStore) Delete(provider string) error {
+	lines, found, err := this.otherLines(provider)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrTokenNotFound
+	}
+	return os.WriteFile(this.Path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
+// The lines of the file except the provider's token, and whether the token
+// was there
+func (this *EnvFileTokenStore) otherLines(provider string) ([]string, bool, error) {
+	data, err := os.ReadFile(this.Path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, false, err
+	}
+
+	prefix := TokenEnvVar(provider) + "="
+	lines := []string{}
+	found := false
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), prefix) {
+			found = true
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, found, nil
+}
+
+func (this *EnvFileTokenStore) Describe(provider string) string {
+	return fmt.Sprintf("%s in %s", TokenEnvVar(provider), this.Path)
+}
+
+// Runs a keychain tool with the given stdin, returning its stdout and exit
+// code, i.e. exec.Command
+type keychainRunner func(stdin, name string, args ...string) (string, int, error)
+
+func runKeychainTool(stdin, name string, args ...string) (string, int, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return stdout.String(), exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return stdout.String(), 0, nil
+}
+
+// Reads and writes generic credentials in the Windows Credential Manager,
+// there's no command line tool that can read them back so PowerShell calls
+// advapi32 directly. $Op, $Target and $User are set before it runs, the token
+// comes from stdin. Exits with 1 when there's no credential.
+const windowsCredentialScript = `Add-Type -TypeDefinition '
+using System;
+using System.Runtime.InteropServices;
+using FILETIME = System.Runtime.InteropServices.ComTypes.FILETIME;
+
+public static class ButterfishCredential {
+	[StructLayout(LayoutKind.Sequential, CharSet = CharSet.Unicode)]
+	struct CREDENTIAL {
+		public int Flags;
+		public int Type;
+		public string TargetName;
+		public string Comment;
+		public FILETIME LastWritten;
+		public int CredentialBlobSize;
+		public IntPtr CredentialBlob;
+		public int Persist;
+		public int AttributeCount;
+		public IntPtr Attributes;
+		public string TargetAlias;
+		public string UserName;
+	}
+
+	[DllImport("advapi32.dll", CharSet = CharSet.Unicode, SetLastError = true)]
+	static extern bool CredRead(string target, int type, int flags, out IntPtr credential);
+	[DllImport("advapi32.dll", CharSet = CharSet.Unicode, SetLastError = true)]
+	static extern bool CredWrite(ref CREDENTIAL credential, int flags);
+	[DllImport("advapi32.dll", CharSet = CharSet.Unicode, SetLastError = true)]
+	static extern bool CredDelete(string target, int type, int flags);
+	[DllImport("advapi32.dll")]
+	static extern void CredFree(IntPtr credential);
+
+	public static string Read(string target) {
+		IntPtr ptr;
+		if (!CredRead(target, 1, 0, out ptr)) {
+			return null;
+		}
+		try {
+			CREDENTIAL credential = (CREDENTIAL)Marshal.PtrToStructure(ptr, typeof(CREDENTIAL));
+			return Marshal.PtrToStringUni(credential.CredentialBlob, credential.CredentialBlobSize / 2);
+		} finally {
+			CredFree(ptr);
+		}
+	}
+
+	public static bool Write(string target, string user, string secret) {
+		CREDENTIAL credential = new CREDENTIAL();
+		credential.Type = 1;
+		credential.TargetName = target;
+		credential.UserName = user;
+		credential.Persist = 2;
+		credential.CredentialBlobSize = secret.Length * 2;
+		credential.CredentialBlob = Marshal.StringToCoTaskMemUni(secret);
+		try {
+			return CredWrite(ref credential, 0);
+		} finally {
+			Marshal.FreeCoTaskMem(credential.CredentialBlob);
+		}
+	}
+
+	public static bool Delete(string target) {
+		return CredDelete(target, 1, 0);
+	}
+}
+'
+switch ($Op) {
+	'get' {
+		$token = [ButterfishCredential]::Read($Target)
+		if ($token -eq $null) { exit 1 }
+		[Console]::Out.Write($token)
+	}
+	'set' {
+		$token = [Console]::In.ReadToEnd().Trim()
+		if (-not [ButterfishCredential]::Write($Target, $User, $token)) { exit 2 }
+	}
+	'delete' {
+		if (-not [ButterfishCredential]::Delete($Target)) { exit 1 }
+	}
+}
+exit 0
+`
+
+// The powershell arguments to run the credential script, it's passed as
+// -EncodedCommand (base64 UTF-16LE) so Windows command line quoting can't
+// mangle it. Provider names are letters, numbers, - and _ so they're safe to
+// put in single quotes.
+func windowsCredentialArgs(op, provider string) []string {
+	script := fmt.Sprintf("$Op = '%s'\n$Target = '%s:%s'\n$User = '%s'\n%s",
+		op, keychainService, provider, provider, windowsCredentialScript)
+	encoded := []byte{}
+	for _, unit := range utf16.Encode([]rune(script)) {
+		encoded = binary.LittleEndian.AppendUint16(encoded, unit)
+	}
+	return []string{"-NoProfile", "-NonInteractive", "-EncodedCommand",
+		base64.StdEncoding.EncodeToString(encoded)}
+}
+
+// Tokens in the OS keychain, through the security command on macOS,
+// secret-tool on Linux and PowerShell on Windows
+type KeychainTokenStore struct {
+	// e.g. macOS Keychain
+	Name string
+	tool string
+	run  keychainRunner
+}
+
+// The keychain for this OS, an error if there isn't one we can use
+func NewKeychainTokenStore() (*KeychainTokenStore, error) {
+	store := &KeychainTokenStore{run: runKeychainTool}
+	switch runtime.GOOS {
+	case "darwin":
+		store.Name, store.tool = "macOS Keychain", "security"
+	case "linux", "freebsd", "openbsd":
+		store.Name, store.tool = "Secret Service", "secret-tool"
+	case "windows":
+		store.Name, store.tool = "Windows Credential Manager", "powershell"
+	default:
+		return nil, fmt.Errorf("No supported keychain on %s", runtime.GOOS)
+	}
+
+	if _, err := exec.LookPath(store.tool); err != nil {
+		return nil, fmt.Errorf("No keychain, %s isn't installed", store.tool)
+	}
+	return store, nil
+}
+
+func (this *KeychainTokenStore) Get(provider string) (string, error) {
+	var output string
+	var status int
+	var err error
+	switch this.tool {
+	case "security":
+		output, status, err = this.run("", this.tool, "find-generic-password",
+			"-s", keychainService, "-a", provider, "-w")
+	case "powershell":
+		output, status, err = this.run("", this.tool, windowsCredentialArgs("get", provider)...)
+	default:
+		output, status, err = this.run("", this.tool, "lookup",
+			"service", keychainService, "provider", provider)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// security exits with 44 for a missing item, secret-tool and the
+	// credential script with 1
+	token := strings.TrimSpace(output)
+	if status == 44 || status == 1 && token == "" {
+		return "", ErrTokenNotFound
+	}
+	if status != 0 {
+		return "", fmt.Errorf("%s exited with status %d reading the %s token", this.tool, status, provider)
+	}
+	if token == "" {
+		return "", ErrTokenNotFound
+	}
+	return token, nil
+}
+
+func (this *KeychainTokenStore) Set(provider, token string) error {
+	if err := validateToken(token); err != nil {
+		return err
+	}
+
+	var status int
+	var err error
+	switch this.tool {
+	case "security":
+		// security -i reads the command from stdin, so the token doesn't show
+		// up in the process list
+		command := fmt.Sprintf("add-generic-password -U -s %s -a %s -l \"Butterfish %s token\" -w \"%s\"\n",
+			keychainService, provider, provider, token)
+		_, status, err = this.run(command, this.tool, "-i")
+	case "powershell":
+		_, status, err = this.run(token, this.tool, windowsCredentialArgs("set", provider)...)
+	default:
+		_, status, err = this.run(token, this.tool, "store",
+			"--label", fmt.Sprintf("Butterfish %s token", provider),
+			"service", keychainService, "provider", provider)
+	}
+	if err != nil {
+		return err
+	}
+	if status != 0 {
+		return fmt.Errorf("%s exited with status %d saving the %s token", this.tool, status, provider)
+	}
+	return nil
+}
+
+func (this *KeychainTokenStore) Delete(provider string) error {
+	// secret-tool clear succeeds whether or not there's a token
+	if _, err := this.Get(provider); err != nil {
+		return err
+	}
+
+	var status int
+	var err error
+	switch this.tool {
+	case "security":
+		_, status, err = this.run("", this.tool, "delete-generic-password",
+			"-s", keychainService, "-a", provider)
+	case "powershell":
+		_, status, err = this.run("", this.tool, windowsCredentialArgs("delete", provider)...)
+	default:
+		_, status, err = this.run("", this.tool, "clear",
+			"service", keychainService, "provider", provider)
+	}
+	if err != nil {
+		return err
+	}
+	if status != 0 {
+		return fmt.Errorf("%s exited with status %d deleting the %s token", this.tool, status, provider)
+	}
+	return nil
+}
+
+func (this *KeychainTokenStore) Describe(provider string) string {
+	return fmt.Sprintf("the %s token in the %s", provider, this.Name)
+}
+
+// Read a token from the terminal without echoing it, or from piped input
+func readToken(in io.Reader, provider string) (string, error) {
+	if file, ok := in.(*os.File); ok && term.IsTerminal(int(file.Fd())) {
+		fmt.Fprintf(os.Stderr, "Paste the %s token: ", provider)
+		data, err := term.ReadPassword(int(file.Fd()))
+		fmt.Fprintf(os.Stderr, "\n")
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// The auth set/get/delete commands, store is where tokens are saved and
+// stores are where they're read from
+func RunAuthCommand(in io.Reader, out io.Writer, store TokenStore, stores []TokenStore, command string, options *CliCommandConfig) error {
+	switch command {
+	case "auth set <provider>":
+		provider := options.Auth.Set.Provider
+		if err := ValidateTokenProvider(provider); err != nil {
+			return err
+		}
+		token, err := readToken(in, provider)
+		if err != nil {
+			return err
+		}
+		if err := store.Set(provider, token); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Saved %s\n", store.Describe(provider))
+
+		// don't leave a plain text copy behind
+		for _, other := range stores {
+			if other == store {
+				continue
+			}
+			err := other.Delete(provider)
+			if err == nil {
+				fmt.Fprintf(out, "Removed %s\n", other.Describe(provider))
+			} else if !errors.Is(err, ErrTokenNotFound) {
+				return err
+			}
+		}
+
+	case "auth get <provider>":
+		provider := options.Auth.Get.Provider
+		if err := ValidateTokenProvider(provider); err != nil {
+			return err
+		}
+		token, _, err := LookupToken(stores, provider)
+		if errors.Is(err, ErrTokenNotFound) {
+			return fmt.Errorf("No %s token saved, see butterfish auth set", provider)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s\n", token)
+
+	case "auth delete <provider>":
+		provider := options.Auth.Delete.Provider
+		if err := ValidateTokenProvider(provider); err != nil {
+			return err
+		}
+		deleted := false
+		for _, store := range stores {
+			err := store.Delete(provider)
+			if errors.Is(err, ErrTokenNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			deleted = true
+			fmt.Fprintf(out, "Deleted %s\n", store.Describe(provider))
+		}
+		if !deleted {
+			return fmt.Errorf("No %s token saved", provider)
+		}
+
+	default:
+		return errors.New("Unrecognized command: " + command)
+	}
+
+	return nil
+}
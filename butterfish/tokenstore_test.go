@@ -0,0 +1,170 @@
+package butterfish
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A keychain tool that keeps tokens in a map, answering like secret-tool,
+// security or the Windows credential script
+type fakeKeychain struct {
+	tokens map[string]string
+	calls  []string
+}
+
+func (this *fakeKeychain) run(stdin, name string, args ...string) (string, int, error) {
+	this.calls = append(this.calls, name+" "+strings.Join(args, " "))
+	missing := 1
+	if name == "security" {
+		missing = 44
+	}
+	if name == "powershell" {
+		return this.runCredentialScript(stdin, args[len(args)-1])
+	}
+
+	switch args[0] {
+	case "lookup", "find-generic-password":
+		token, ok := this.tokens[args[len(args)-1]]
+		if name == "security" {
+			token, ok = this.tokens[args[4]]
+		}
+		if !ok {
+			return "", missing, nil
+		}
+		return token + "\n", 0, nil
+	case "store":
+		this.tokens[args[len(args)-1]] = stdin
+	case "-i":
+		fields := strings.Fields(stdin)
+		this.tokens[fields[5]] = strings.Trim(fields[len(fields)-1], `"`)
+	case "clear":
+		delete(this.tokens, args[len(args)-1])
+	case "delete-generic-password":
+		delete(this.tokens, args[4])
+	}
+	return "", 0, nil
+}
+
+// Decodes the -EncodedCommand script and reads the variables set before it
+func (this *fakeKeychain) runCredentialScript(stdin, encoded string) (string, int, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", 2, err
+	}
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(data[i*2:])
+	}
+	lines := strings.Split(string(utf16.Decode(units)), "\n")
+	op := strings.Trim(strings.TrimPrefix(lines[0], "$Op = "), "'")
+	target := strings.Trim(strings.TrimPrefix(lines[1], "$Target = "), "'")
+	provider := strings.TrimPrefix(target, keychainService+":")
+
+	switch op {
+	case "get":
+		token, ok := this.tokens[provider]
+		if !ok {
+			return "", 1, nil
+		}
+		return token, 0, nil
+	case "set":
+		this.tokens[provider] = strings.TrimSpace(stdin)
+	case "delete":
+		if _, ok := this.tokens[provider]; !ok {
+			return "", 1, nil
+		}
+		delete(this.tokens, provider)
+	}
+	return "", 0, nil
+}
+
+func TestKeychainTokenStore(t *testing.T) {
+	for _, tool := range []string{"secret-tool", "security", "powershell"} {
+		keychain := &fakeKeychain{tokens: map[string]string{}}
+		store := &KeychainTokenStore{Name: "Test Keychain", tool: tool, run: keychain.run}
+
+		_, err := store.Get("openai")
+		assert.ErrorIs(t, err, ErrTokenNotFound)
+		assert.Nil(t, store.Set("openai", "sk-abc"))
+		token, err := store.Get("openai")
+		assert.Nil(t, err)
+		assert.Equal(t, "sk-abc", token)
+		assert.Nil(t, store.Delete("openai"))
+		assert.ErrorIs(t, store.Delete("openai"), ErrTokenNotFound)
+		assert.Error(t, store.Set("openai", `sk-" -w other`))
+
+		// the token never goes on the command line
+		for _, call := range keychain.calls {
+			assert.NotContains(t, call, "sk-abc")
+		}
+	}
+}
+
+func TestRunAuthCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "butterfish.env")
+	assert.Nil(t, os.WriteFile(path, []byte("WORK_OPENAI_KEY=sk-work\nOPENAI_TOKEN=sk-plain\n"), 0600))
+	envStore := &EnvFileTokenStore{Path: path}
+	keychain := &KeychainTokenStore{Name: "Test Keychain", tool: "secret-tool",
+		run: (&fakeKeychain{tokens: map[string]string{}}).run}
+	stores := []TokenStore{keychain, envStore}
+	options := &CliCommandConfig{}
+
+	// the env file is read until the token moves to the keychain
+	token, found, err := LookupToken(stores, DefaultTokenProvider)
+	assert.Nil(t, err)
+	assert.Equal(t, "sk-plain", token)
+	assert.Equal(t, envStore, found)
+
+	out := new(bytes.Buffer)
+	options.Auth.Set.Provider = "openai"
+	err = RunAuthCommand(strings.NewReader("sk-secret\n"), out, keychain, stores, "auth set <provider>", options)
+	assert.Nil(t, err)
+	assert.Equal(t, "Saved the openai token in the Test Keychain\nRemoved OPENAI_TOKEN in "+path+"\n", out.String())
+	data, _ := os.ReadFile(path)
+	assert.Equal(t, "WORK_OPENAI_KEY=sk-work\n", string(data))
+
+	out.Reset()
+	options.Auth.Get.Provider = "openai"
+	assert.Nil(t, RunAuthCommand(nil, out, keychain, stores, "auth get <provider>", options))
+	assert.Equal(t, "sk-secret\n", out.String())
+
+	out.Reset()
+	options.Auth.Delete.Provider = "openai"
+	assert.Nil(t, RunAuthCommand(nil, out, keychain, stores, "auth delete <provider>", options))
+	assert.Equal(t, "Deleted the openai token in the Test Keychain\n", out.String())
+	err = RunAuthCommand(nil, out, keychain, stores, "auth get <provider>", options)
+	assert.EqualError(t, err, "No openai token saved, see butterfish auth set")
+
+	options.Auth.Set.Provider = "open ai"
+	err = RunAuthCommand(strings.NewReader("sk-secret\n"), out, keychain, stores, "auth set <provider>", options)
+	assert.ErrorContains(t, err, "Invalid provider name")
+}
+
+func TestEnvFileTokenStore(t *testing.T) {
+	store := &EnvFileTokenStore{Path: filepath.Join(t.TempDir(), "butterfish", "butterfish.env")}
+	_, err := store.Get("openai")
+	assert.ErrorIs(t, err, ErrTokenNotFound)
+
+	assert.Nil(t, store.Set("openai", "sk-first"))
+	assert.Nil(t, store.Set("local-llm", "abc"))
+	assert.Nil(t, store.Set("openai", "sk-second"))
+	data, err := os.ReadFile(store.Path)
+	assert.Nil(t, err)
+	assert.Equal(t, "LOCAL_LLM_TOKEN=abc\nOPENAI_TOKEN=sk-second\n", string(data))
+
+	token, err := store.Get("local-llm")
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", token)
+
+	_, stores, err := NewTokenStores(TokenStoreEnvFile, store.Path)
+	assert.Nil(t, err)
+	assert.Equal(t, []TokenStore{store}, stores)
+}
@@ -0,0 +1,352 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Many local models, e.g. on llama.cpp or ollama, can't call functions, which
+// goal mode needs. For those we emulate it in the prompt: the function
+// definitions go in the system message with instructions to answer with a
+// JSON envelope, and the envelope is parsed back into a function or tool
+// call. A reply that tries to call a function but gets it wrong is sent back
+// to the model with the problem. Emulation is used for models with
+// functions: false in the model registry, and for models whose server rejects
+// a request with functions, which we remember for the rest of the session.
+
+// How many times a malformed function call is sent back to the model
+const toolEmulationRetries = 2
+
+var emulatedToolModels = struct {
+	sync.Mutex
+	models map[string]bool
+}{models: map[string]bool{}}
+
+// Whether function calls to the model are emulated in the prompt
+func usesEmulatedTools(model string) bool {
+	if !LookupModel(model).Functions {
+		return true
+	}
+	emulatedToolModels.Lock()
+	defer emulatedToolModels.Unlock()
+	return emulatedToolModels.models[model]
+}
+
+func rememberEmulatedTools(model string) {
+	emulatedToolModels.Lock()
+	defer emulatedToolModels.Unlock()
+	emulatedToolModels.models[model] = true
+}
+
+// Errors servers give for a request with functions or tools they can't
+// handle, e.g. ollama's "llama2 does not support tools", llama.cpp without
+// --jinja, and vLLM without --enable-auto-tool-choice
+var noToolSupportRegex = regexp.MustCompile(`(?i)does not support (tools|functions|function calling)|(tools?|functions?|function calling) (is|are) not supported|requires --jinja|--enable-auto-tool-choice|unrecognized request argument supplied: (functions|tools)`)
+
+func isNoToolSupportError(err error) bool {
+	return err != nil && noToolSupportRegex.MatchString(err.Error())
+}
+
+// Wraps an LLM to emulate function calling for models that can't do it
+type ToolEmulatingLLM struct {
+	LLM LLM
+}
+
+func NewToolEmulatingLLM(llm LLM) *ToolEmulatingLLM {
+	return &ToolEmulatingLLM{LLM: llm}
+}
+
+func (this *ToolEmulatingLLM) Unwrap() LLM {
+	return this.LLM
+}
+
+func (this *ToolEmulatingLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	if len(requestFunctions(request)) == 0 {
+		return this.LLM.Completion(request)
+	}
+	if !usesEmulatedTools(request.Model) {
+		response, err := this.LLM.Completion(request)
+		if !isNoToolSupportError(err) {
+			return response, err
+		}
+		log.Printf("Model %s doesn't support function calling, emulating it: %s", request.Model, err)
+		rememberEmulatedTools(request.Model)
+	}
+	return this.emulate(request)
+}
+
+// The reply isn't streamed since it may be a function call, it's written out
+// the way a streamed reply would be once it's parsed
+func (this *ToolEmulatingLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	if len(requestFunctions(request)) == 0 {
+		return this.LLM.CompletionStream(request, writer)
+	}
+	if !usesEmulatedTools(request.Model) {
+		// nothing is written before the server turns down the request
+		response, err := this.LLM.CompletionStream(request, writer)
+		if !isNoToolSupportError(err) {
+			return response, err
+		}
+		log.Printf("Model %s doesn't support function calling, emulating it: %s", request.Model, err)
+		rememberEmulatedTools(request.Model)
+	}
+
+	response, err := this.emulate(request)
+	if err != nil {
+		return response, err
+	}
+	writer.Write([]byte(response.Completion))
+	if response.FunctionName != "" {
+		fmt.Fprintf(writer, "%s(%s)", response.FunctionName, response.FunctionParameters)
+	}
+	for _, toolCall := range response.ToolCalls {
+		fmt.Fprintf(writer, "%s(%s)", toolCall.Function.Name, toolCall.Function.Parameters)
+	}
+	fmt.Fprintf(writer, "\n")
+	return response, nil
+}
+
+func (this *ToolEmulatingLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	return this.LLM.Embeddings(ctx, input, verbose)
+}
+
+// Send the request with the functions described in the prompt, and send a
+// malformed function call back to the model until it gets it right
+func (this *ToolEmulatingLLM) emulate(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	functions := requestFunctions(request)
+	prompt := request.Prompt
+	history := textHistoryBlocks(request.HistoryBlocks)
+
+	for attempt := 0; ; attempt++ {
+		emulated := emulatedToolRequest(request, functions, prompt, history)
+		response, err := this.LLM.Completion(emulated)
+		if err != nil || response.Refusal != "" {
+			return response, err
+		}
+
+		content, call, parseErr := parseToolEnvelope(response.Completion, functions)
+		if parseErr == nil {
+			return emulatedToolResponse(request, response, content, call), nil
+		}
+		if attempt == toolEmulationRetries {
+			return nil, fmt.Errorf("Model %s didn't call a function correctly after %d tries: %s",
+				request.Model, attempt+1, parseErr)
+		}
+		log.Printf("Malformed emulated function call from %s: %s", request.Model, parseErr)
+
+		// show the model its reply and what's wrong with it
+		if prompt != "" {
+			history = append(history, util.HistoryBlock{Type: historyTypePrompt, Content: prompt})
+		}
+		history = append(history, util.HistoryBlock{Type: historyTypeLLMOutput, Content: response.Completion})
+		prompt = fmt.Sprintf("That function call can't be used: %s. Reply again with only the JSON object.", parseErr)
+	}
+}
+
+// The functions a request offers, whether as functions or as tools
+func requestFunctions(request *util.CompletionRequest) []util.FunctionDefinition {
+	functions := append([]util.FunctionDefinition{}, request.Functions...)
+	for _, tool := range request.Tools {
+		if tool.Type == "" || tool.Type == "function" {
+			functions = append(functions, tool.Function)
+		}
+	}
+	return functions
+}
+
+const toolEmulationInstructions = `You can call these functions:
+%s
+
+To call a function, reply with a JSON object in this form and nothing after it:
+{"function": "<function name>", "arguments": {<the function's parameters>}}
+Call at most one function per reply. To answer without calling a function, reply with plain text.`
+
+// A copy of the request without functions, they're described in the system
+// message instead. The legacy completion API only takes a prompt, so for
+// completion models everything goes in the prompt.
+func emulatedToolRequest(request *util.CompletionRequest, functions []util.FunctionDefinition,
+	prompt string, history []util.HistoryBlock) *util.CompletionRequest {
+	definitions, _ := json.MarshalIndent(functions, "", "  ")
+	instructions := fmt.Sprintf(toolEmulationInstructions, definitions)
+
+	emulated := *request
+	emulated.Functions = nil
+	emulated.Tools = nil
+	emulated.Prompt = prompt
+	emulated.HistoryBlocks = history
+	emulated.SystemMessage = strings.TrimSpace(request.SystemMessage + "\n\n" + instructions)
+
+	if IsCompletionModel(request.Model) {
+		emulated.Prompt = completionPrompt(emulated.SystemMessage, history, prompt)
+		emulated.SystemMessage = ""
+		emulated.HistoryBlocks = nil
+	}
+	return &emulated
+}
+
+// Rewrite function calls and their results in history as text, a server that
+// can't call functions may not accept function messages
+func textHistoryBlocks(blocks []util.HistoryBlock) []util.HistoryBlock {
+	if blocks == nil {
+		return nil
+	}
+
+	out := make([]util.HistoryBlock, 0, len(blocks))
+	for _, block := range blocks {
+		switch {
+		case block.Type == historyTypeFunctionOutput || block.Type == historyTypeToolOutput:
+			block = util.HistoryBlock{
+				Type:    historyTypePrompt,
+				Content: fmt.Sprintf("Result of %s:\n%s", block.FunctionName, block.Content),
+			}
+		case block.FunctionName != "" || block.ToolCalls != nil:
+			lines := []string{}
+			if block.Content != "" {
+				lines = append(lines, block.Content)
+			}
+			if block.FunctionName != "" {
+				lines = append(lines, toolEnvelopeString(block.FunctionName, block.FunctionParams))
+			}
+			for _, toolCall := range block.ToolCalls {
+				lines = append(lines, toolEnvelopeString(toolCall.Function.Name, toolCall.Function.Parameters))
+			}
+			block = util.HistoryBlock{Type: block.Type, Content: strings.Join(lines, "\n")}
+		}
+		out = append(out, block)
+	}
+	return out
+}
+
+// A single prompt for the legacy completion API, with the history as a
+// transcript
+func completionPrompt(sysMsg string, history []util.HistoryBlock, prompt string) string {
+	builder := strings.Builder{}
+	builder.WriteString(sysMsg)
+	builder.WriteString("\n\n")
+	for _, block := range history {
+		if block.Content == "" {
+			continue
+		}
+		role := "User"
+		if ShellHistoryTypeToRole(block.Type) == "assistant" {
+			role = "Assistant"
+		}
+		fmt.Fprintf(&builder, "%s: %s\n", role, block.Content)
+	}
+	if prompt != "" {
+		fmt.Fprintf(&builder, "User: %s\n", prompt)
+	}
+	builder.WriteString("Assistant:")
+	return builder.String()
+}
+
+type toolEnvelope struct {
+	Function  string          `json:"function"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+func toolEnvelopeString(name, arguments string) string {
+	if arguments == "" {
+		arguments = "{}"
+	}
+	envelope, err := json.Marshal(toolEnvelope{Function: name, Arguments: json.RawMessage(arguments)})
+	if err != nil {
+		// arguments that aren't JSON go in as a string
+		envelope, _ = json.Marshal(map[string]string{"function": name, "arguments": arguments})
+	}
+	return string(envelope)
+}
+
+// Find the function call in a reply, along with any text before it. The
+// call is nil for a plain text reply, and an error means the reply tried to
+// call a function but got it wrong.
+func parseToolEnvelope(reply string, functions []util.FunctionDefinition) (string, *util.FunctionCall, error) {
+	start := strings.Index(reply, "{")
+	end := strings.LastIndex(reply, "}")
+	if start == -1 || end < start || !strings.Contains(reply[start:end+1], `"function"`) {
+		return reply, nil, nil
+	}
+
+	var envelope toolEnvelope
+	if err := unmarshalToolArguments(reply[start:end+1], &envelope); err != nil {
+		return "", nil, fmt.Errorf("it isn't valid JSON (%s)", err)
+	}
+	if envelope.Function == "" {
+		return "", nil, errors.New("it has no function name")
+	}
+
+	var function *util.FunctionDefinition
+	names := []string{}
+	for i := range functions {
+		names = append(names, functions[i].Name)
+		if functions[i].Name == envelope.Function {
+			function = &functions[i]
+		}
+	}
+	if function == nil {
+		return "", nil, fmt.Errorf("there is no function named %s, the functions are %s",
+			envelope.Function, strings.Join(names, ", "))
+	}
+
+	arguments := map[string]any{}
+	if len(envelope.Arguments) > 0 && string(envelope.Arguments) != "null" {
+		if err := json.Unmarshal(envelope.Arguments, &arguments); err != nil {
+			return "", nil, fmt.Errorf("the arguments of %s must be a JSON object", envelope.Function)
+		}
+	}
+	for _, required := range function.Parameters.Required {
+		if _, ok := arguments[required]; !ok {
+			return "", nil, fmt.Errorf("%s is missing the required argument %s", envelope.Function, required)
+		}
+	}
+
+	parameters := "{}"
+	if len(arguments) > 0 {
+		compacted := bytes.Buffer{}
+		json.Compact(&compacted, envelope.Arguments)
+		parameters = compacted.String()
+	}
+
+	// text before the call, without the opening of a code block around it
+	content := strings.TrimSpace(reply[:start])
+	content = strings.TrimSpace(strings.TrimSuffix(strings.TrimSuffix(content, "json"), "```"))
+	return content, &util.FunctionCall{Name: envelope.Function, Parameters: parameters}, nil
+}
+
+var emulatedToolCallCount atomic.Int64
+
+// The response the caller would have had from a model that calls functions,
+// a function offered as a tool comes back as a tool call
+func emulatedToolResponse(request *util.CompletionRequest, response *util.CompletionResponse,
+	content string, call *util.FunctionCall) *util.CompletionResponse {
+	out := *response
+	out.Completion = content
+	if call == nil {
+		return &out
+	}
+
+	for _, function := range request.Functions {
+		if function.Name == call.Name {
+			out.FunctionName = call.Name
+			out.FunctionParameters = call.Parameters
+			return &out
+		}
+	}
+	out.ToolCalls = []*util.ToolCall{{
+		Id:       fmt.Sprintf("call_emulated_%d", emulatedToolCallCount.Add(1)),
+		Type:     "function",
+		Function: *call,
+	}}
+	return &out
+}
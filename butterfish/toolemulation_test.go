@@ -0,0 +1,151 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Replies with each of replies in turn, or fails requests with functions
+type toolTestLLM struct {
+	replies       []string
+	rejectsTools  bool
+	requests      []*util.CompletionRequest
+	streamedCalls int
+}
+
+func (this *toolTestLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	this.streamedCalls++
+	return this.Completion(request)
+}
+
+func (this *toolTestLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	this.requests = append(this.requests, request)
+	if this.rejectsTools && (len(request.Functions) > 0 || len(request.Tools) > 0) {
+		return nil, errors.New("error, status code: 400, message: registry.ollama.ai/library/llama2:latest does not support tools")
+	}
+	reply := this.replies[0]
+	this.replies = this.replies[1:]
+	return &util.CompletionResponse{Completion: reply}, nil
+}
+
+func (this *toolTestLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	return nil, nil
+}
+
+func TestParseToolEnvelope(t *testing.T) {
+	content, call, err := parseToolEnvelope("Let me look.\n```json\n{\"function\": \"command\", \"arguments\": {\"cmd\": \"ls ~\"}}\n```", goalModeFunctions)
+	assert.Nil(t, err)
+	assert.Equal(t, "Let me look.", content)
+	assert.Equal(t, &util.FunctionCall{Name: "command", Parameters: `{"cmd":"ls ~"}`}, call)
+
+	// plain text, including code with braces
+	content, call, err = parseToolEnvelope("Use `find . -exec rm {} \\;`", goalModeFunctions)
+	assert.Nil(t, err)
+	assert.Nil(t, call)
+	assert.Equal(t, "Use `find . -exec rm {} \\;`", content)
+
+	// a cut off call is repaired, one with too many braces isn't
+	_, call, err = parseToolEnvelope(`{"function": "command", "arguments": {"cmd": "ls"`+"\n}", goalModeFunctions)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"cmd":"ls"}`, call.Parameters)
+	_, _, err = parseToolEnvelope(`{"function": "command", "arguments": {"cmd": "ls"}}}`, goalModeFunctions)
+	assert.ErrorContains(t, err, "isn't valid JSON")
+	_, _, err = parseToolEnvelope(`{"function": "delete", "arguments": {}}`, goalModeFunctions)
+	assert.EqualError(t, err, "there is no function named delete, the functions are command, user_input, finish, env_info")
+	_, _, err = parseToolEnvelope(`{"function": "command", "arguments": "ls"}`, goalModeFunctions)
+	assert.EqualError(t, err, "the arguments of command must be a JSON object")
+	_, _, err = parseToolEnvelope(`{"function": "command", "arguments": {"command": "ls"}}`, goalModeFunctions)
+	assert.EqualError(t, err, "command is missing the required argument cmd")
+}
+
+func TestToolEmulatingLLM(t *testing.T) {
+	defer func() {
+		emulatedToolModels.Lock()
+		delete(emulatedToolModels.models, "llama2")
+		emulatedToolModels.Unlock()
+	}()
+
+	backend := &toolTestLLM{
+		rejectsTools: true,
+		replies: []string{
+			`{"function": "command", "arguments": {}}`,
+			`{"function": "command", "arguments": {"cmd": "make test"}}`,
+		},
+	}
+	llm := NewToolEmulatingLLM(backend)
+	request := &util.CompletionRequest{
+		Ctx:           context.Background(),
+		Model:         "llama2",
+		Prompt:        "Start now.",
+		SystemMessage: "Run the tests",
+		Functions:     goalModeFunctions,
+		HistoryBlocks: []util.HistoryBlock{
+			{Type: historyTypeLLMOutput, FunctionName: "command", FunctionParams: `{"cmd":"ls"}`},
+			{Type: historyTypeFunctionOutput, FunctionName: "command", Content: "Makefile"},
+		},
+	}
+
+	out := new(bytes.Buffer)
+	response, err := llm.CompletionStream(request, out)
+	assert.Nil(t, err)
+	assert.Equal(t, "command", response.FunctionName)
+	assert.Equal(t, `{"cmd":"make test"}`, response.FunctionParameters)
+	assert.Equal(t, "command({\"cmd\":\"make test\"})\n", out.String())
+
+	// rejected once, then a malformed call sent back to the model
+	assert.Equal(t, 3, len(backend.requests))
+	assert.True(t, usesEmulatedTools("llama2"))
+	emulated := backend.requests[1]
+	assert.Nil(t, emulated.Functions)
+	assert.Contains(t, emulated.SystemMessage, `"name": "user_input"`)
+	assert.Equal(t, []util.HistoryBlock{
+		{Type: historyTypeLLMOutput, Content: `{"function":"command","arguments":{"cmd":"ls"}}`},
+		{Type: historyTypePrompt, Content: "Result of command:\nMakefile"},
+	}, emulated.HistoryBlocks)
+	retry := backend.requests[2]
+	assert.Equal(t, "That function call can't be used: command is missing the required argument cmd. Reply again with only the JSON object.", retry.Prompt)
+
+	// the model is remembered, so the next request goes straight to emulation
+	backend.replies = []string{"All done."}
+	response, err = llm.Completion(request)
+	assert.Nil(t, err)
+	assert.Equal(t, "All done.", response.Completion)
+	assert.Equal(t, "", response.FunctionName)
+	assert.Equal(t, 4, len(backend.requests))
+}
+
+func TestToolEmulationForCompletionModels(t *testing.T) {
+	backend := &toolTestLLM{replies: []string{`{"function": "respond", "arguments": {"answer": "42"}}`}}
+	llm := NewToolEmulatingLLM(backend)
+	respond := util.FunctionDefinition{Name: "respond"}
+	response, err := llm.Completion(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Model:         "gpt-3.5-turbo-instruct",
+		Prompt:        "What's the answer?",
+		SystemMessage: "Answer questions",
+		Tools:         []util.ToolDefinition{{Type: "function", Function: respond}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(response.ToolCalls))
+	assert.Equal(t, "respond", response.ToolCalls[0].Function.Name)
+
+	// everything goes in the prompt
+	request := backend.requests[0]
+	assert.Equal(t, "", request.SystemMessage)
+	assert.True(t, strings.HasPrefix(request.Prompt, "Answer questions\n\nYou can call these functions:"))
+	assert.True(t, strings.HasSuffix(request.Prompt, "User: What's the answer?\nAssistant:"))
+
+	// requests without functions go through untouched
+	backend.replies = []string{"hi"}
+	_, err = llm.CompletionStream(&util.CompletionRequest{Model: "llama2"}, new(bytes.Buffer))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, backend.streamedCalls)
+}
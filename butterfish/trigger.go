@@ -0,0 +1,206 @@
+package butterfish
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// By default a line that starts with a capital letter is a prompt, which gets
+// in the way of commands like Rscript or Xvfb. With a prompt prefix only lines
+// starting with the prefix are prompts, e.g. ":How do I find .py files?", and
+// capitalized commands go to the shell. The prefix comes from --prompt-prefix
+// or prompt_prefix in the config file, and can be changed for the session
+// with the Trigger command. Goal mode still starts with ! either way.
+//
+// Without a prefix, executables on the PATH that start with a capital letter
+// are found when the shell starts, and a prompt whose first word is one of
+// them is handed to the shell as a command once the word is typed. Names from
+// capitalized_commands in the config file are added, e.g. for aliases.
+
+// Trigger argument for going back to capital letter detection
+const TriggerCapital = "capital"
+
+// Check a prompt prefix from a flag or the config file
+func ValidatePromptPrefix(prefix string) error {
+	if strings.HasPrefix(prefix, "!") {
+		return fmt.Errorf("Invalid prompt prefix %q, ! starts goal mode", prefix)
+	}
+	for _, char := range prefix {
+		if unicode.IsControl(char) {
+			return fmt.Errorf("Invalid prompt prefix %q, it can't contain control characters", prefix)
+		}
+	}
+	return nil
+}
+
+// Parse the argument of the Trigger command: capital, space for two spaces,
+// or a prefix, quoted if it has spaces
+func parseTrigger(arg string) (string, error) {
+	switch {
+	case strings.EqualFold(arg, TriggerCapital):
+		return "", nil
+	case strings.EqualFold(arg, "space"):
+		return "  ", nil
+	case strings.HasPrefix(arg, `"`):
+		prefix, err := strconv.Unquote(arg)
+		if err != nil {
+			return "", fmt.Errorf("Invalid prompt prefix %s, expected a quoted string", arg)
+		}
+		if prefix == "" {
+			return "", fmt.Errorf("Empty prompt prefix, use Trigger %s for capital letters", TriggerCapital)
+		}
+		return prefix, ValidatePromptPrefix(prefix)
+	}
+	return arg, ValidatePromptPrefix(arg)
+}
+
+// Parse "Trigger [prefix]", returning the argument, which may be empty.
+// Other prompts starting with Trigger, like "Trigger the build", are normal
+// prompts, so a prefix with spaces has to be quoted.
+func triggerCommand(prompt string) (string, bool) {
+	arg, ok := localCommandText(prompt, "trigger")
+	if !ok {
+		return "", false
+	}
+	quoted := len(arg) > 1 && strings.HasPrefix(arg, `"`) && strings.HasSuffix(arg, `"`)
+	if strings.ContainsAny(arg, " \t") && !quoted {
+		return "", false
+	}
+	return arg, true
+}
+
+func triggerDescription(prefix string) string {
+	if prefix == "" {
+		return "a capital letter"
+	}
+	return fmt.Sprintf("the prefix %q", prefix)
+}
+
+// How many bytes at the start of typed input start a prompt, 0 if it's a
+// command
+func (this *ShellState) promptStartLength(data []byte) int {
+	if data[0] == '!' {
+		return 1
+	}
+	if this.PromptPrefix == "" {
+		if unicode.IsUpper(rune(data[0])) {
+			return 1
+		}
+		return 0
+	}
+	if strings.HasPrefix(string(data), this.PromptPrefix) {
+		return len(this.PromptPrefix)
+	}
+	return 0
+}
+
+// Whether typed input could still turn into the prompt prefix
+func (this *ShellState) partialPromptPrefix(data []byte) bool {
+	return len(data) < len(this.PromptPrefix) &&
+		strings.HasPrefix(this.PromptPrefix, string(data))
+}
+
+// Whether text being typed is a prompt rather than a command
+func (this *ShellState) isPromptText(text string) bool {
+	return text != "" && this.promptStartLength([]byte(text)) > 0 &&
+		!this.isCapitalizedCommand(text)
+}
+
+// The prompt that was typed, without the prompt prefix
+func (this *ShellState) promptText() string {
+	return strings.TrimPrefix(this.Prompt.String(), this.PromptPrefix)
+}
+
+// Whether the prompt was started with the prompt prefix rather than a capital
+// letter
+func (this *ShellState) promptPrefixed() bool {
+	return this.PromptPrefix != "" && strings.HasPrefix(this.Prompt.String(), this.PromptPrefix)
+}
+
+// Executables in the directories of a PATH whose names start with a capital
+// letter, like Rscript or Xvfb
+func capitalizedCommands(path string) map[string]bool {
+	commands := map[string]bool{}
+	for _, dir := range filepath.SplitList(path) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if !unicode.IsUpper(rune(name[0])) {
+				continue
+			}
+			// stat rather than entry.Info() to follow symlinks
+			info, err := os.Stat(filepath.Join(dir, name))
+			if err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+				continue
+			}
+			commands[name] = true
+		}
+	}
+	return commands
+}
+
+// Local commands that are typed as prompts, these win over executables
+var localCommandNames = []string{
+	"status", "stats", "help", "history", "profile", "model", "temp",
+	"system", "context", "find", "trigger",
+}
+
+// Whether a prompt is really a command because its first word is a
+// capitalized executable
+func (this *ShellState) isCapitalizedCommand(text string) bool {
+	if this.PromptPrefix != "" {
+		return false
+	}
+	name, _, _ := strings.Cut(text, " ")
+	if !this.CapitalizedCommands[name] {
+		return false
+	}
+	for _, command := range localCommandNames {
+		if strings.EqualFold(name, command) {
+			return false
+		}
+	}
+	return true
+}
+
+// Hand a prompt that turned out to be a command over to the shell, as if it
+// had been typed there
+func (this *ShellState) promptToCommand() {
+	text := this.Prompt.String()
+	log.Printf("Running %s as a command rather than a prompt", text)
+	this.ClearAutosuggest(this.Color.Command)
+	this.ParentOut.Write(this.Prompt.Clear())
+	this.ParentOut.Write([]byte(this.Color.Command))
+	this.Command = NewShellBuffer()
+	this.Command.Write(text)
+	this.ChildIn.Write([]byte(text))
+	this.setState(stateShell)
+}
+
+// Switch how prompts are started for the session, with no argument we print
+// the current trigger
+func (this *ShellState) SetTrigger(arg string) {
+	if arg == "" {
+		this.printLocalResponse(fmt.Sprintf("Prompts start with %s\n",
+			triggerDescription(this.PromptPrefix)))
+		return
+	}
+
+	prefix, err := parseTrigger(arg)
+	if err != nil {
+		this.Prompt.Clear()
+		this.PrintError(err)
+		return
+	}
+
+	this.PromptPrefix = prefix
+	this.printLocalResponse(fmt.Sprintf("Prompts now start with %s\n", triggerDescription(prefix)))
+}
@@ -0,0 +1,125 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func TestParseTrigger(t *testing.T) {
+	prefix, err := parseTrigger(":")
+	assert.Nil(t, err)
+	assert.Equal(t, ":", prefix)
+
+	prefix, err = parseTrigger(`" :"`)
+	assert.Nil(t, err)
+	assert.Equal(t, " :", prefix)
+
+	prefix, err = parseTrigger("Space")
+	assert.Nil(t, err)
+	assert.Equal(t, "  ", prefix)
+
+	prefix, err = parseTrigger("capital")
+	assert.Nil(t, err)
+	assert.Equal(t, "", prefix)
+
+	_, err = parseTrigger("!")
+	assert.ErrorContains(t, err, "starts goal mode")
+	_, err = parseTrigger(`""`)
+	assert.ErrorContains(t, err, "Empty prompt prefix")
+
+	arg, ok := triggerCommand(`trigger " :"`)
+	assert.True(t, ok)
+	assert.Equal(t, `" :"`, arg)
+	_, ok = triggerCommand("Trigger the build on main")
+	assert.False(t, ok)
+}
+
+func TestPromptStart(t *testing.T) {
+	state := &ShellState{Prompt: NewShellBuffer()}
+	assert.Equal(t, 1, state.promptStartLength([]byte("Rscript")))
+	assert.Equal(t, 1, state.promptStartLength([]byte("!goal")))
+	assert.Equal(t, 0, state.promptStartLength([]byte("ls")))
+
+	state.PromptPrefix = "  "
+	assert.Equal(t, 0, state.promptStartLength([]byte("Rscript")))
+	assert.Equal(t, 1, state.promptStartLength([]byte("!goal")))
+	assert.Equal(t, 2, state.promptStartLength([]byte("  how")))
+	assert.True(t, state.partialPromptPrefix([]byte(" ")))
+	assert.False(t, state.partialPromptPrefix([]byte(" l")))
+	assert.True(t, state.isPromptText("  why"))
+	assert.False(t, state.isPromptText("Xvfb :1"))
+
+	state.Prompt.Write("  why did that fail")
+	assert.Equal(t, "why did that fail", state.promptText())
+}
+
+func TestTriggerLocalCommand(t *testing.T) {
+	out := new(bytes.Buffer)
+	state := &ShellState{
+		Butterfish:         &ButterfishCtx{Config: MakeButterfishConfig()},
+		Color:              DarkShellColorScheme,
+		Prompt:             NewShellBuffer(),
+		PromptAnswerWriter: out,
+		PromptOutputChan:   make(chan *util.CompletionResponse, 4),
+	}
+
+	state.Prompt.Write("Trigger :")
+	assert.True(t, state.HandleLocalPrompt())
+	assert.Equal(t, ":", state.PromptPrefix)
+	assert.Contains(t, out.String(), `Prompts now start with the prefix ":"`)
+
+	// local commands are typed after the prefix
+	state.Prompt.Clear()
+	state.Prompt.Write(":trigger capital")
+	assert.True(t, state.HandleLocalPrompt())
+	assert.Equal(t, "", state.PromptPrefix)
+}
+
+func TestCapitalizedCommands(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "Rscript"), []byte("#!/bin/sh\n"), 0755)
+	os.WriteFile(filepath.Join(dir, "README"), []byte("not executable\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "ls"), []byte("#!/bin/sh\n"), 0755)
+	os.Mkdir(filepath.Join(dir, "Library"), 0755)
+	commands := capitalizedCommands(dir + string(os.PathListSeparator) + filepath.Join(dir, "missing"))
+	assert.Equal(t, map[string]bool{"Rscript": true}, commands)
+
+	commands["Status"] = true
+	state := &ShellState{CapitalizedCommands: commands}
+	assert.True(t, state.isCapitalizedCommand("Rscript foo.R"))
+	assert.False(t, state.isCapitalizedCommand("Rscripts are what?"))
+	assert.False(t, state.isPromptText("Rscript"))
+	// local commands win
+	assert.False(t, state.isCapitalizedCommand("Status"))
+
+	state.PromptPrefix = ":"
+	assert.False(t, state.isCapitalizedCommand("Rscript foo.R"))
+}
+
+func TestPromptToCommand(t *testing.T) {
+	childIn := new(bytes.Buffer)
+	state := &ShellState{
+		Butterfish:          &ButterfishCtx{Config: MakeButterfishConfig()},
+		ParentOut:           new(bytes.Buffer),
+		ChildIn:             childIn,
+		Color:               DarkShellColorScheme,
+		State:               statePrompting,
+		Prompt:              NewShellBuffer(),
+		AutosuggestBuffer:   NewShellBuffer(),
+		CapitalizedCommands: map[string]bool{"Xvfb": true},
+	}
+	state.Prompt.Write("X")
+
+	assert.Nil(t, state.ParentInput(context.Background(), []byte("vfb :1")))
+	assert.Equal(t, stateShell, state.State)
+	assert.Equal(t, "Xvfb :1", childIn.String())
+	assert.Equal(t, "Xvfb :1", state.Command.String())
+	assert.Equal(t, 0, state.Prompt.Size())
+}
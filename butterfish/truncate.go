@@ -0,0 +1,138 @@
+package butterfish
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bakks/tiktoken-go"
+)
+
+// Long command output usually matters most at the end, where builds and
+// tests print their errors and summaries, so rather than cutting it off
+// after the first tokens we keep lines from the start and the end and drop
+// the middle, marking what was left out. Lines from the middle that look
+// like errors are kept too if there's room. Only the lines we might keep are
+// tokenized, so this is cheap even for very long output.
+
+// Marks lines dropped from output
+const elisionMarker = "... [%d lines omitted] ..."
+
+// Tokens reserved for each elision marker
+const elisionMarkerTokens = 12
+
+// Output longer than this many bytes per token of the limit is assumed not
+// to fit without tokenizing all of it
+const outputBytesPerToken = 8
+
+// Truncate output to fit maxTokens, about a quarter of the budget goes to
+// the first lines, half to the last lines, and the rest to error lines in
+// between. countTokens counts the tokens in a string.
+func truncateOutput(output string, maxTokens int, countTokens func(string) int) string {
+	lines := strings.Split(output, "\n")
+	// room for the marker between the first and last lines
+	budget := maxTokens - elisionMarkerTokens
+	if len(lines) < 3 || budget <= 0 {
+		return truncateChars(output, maxTokens, countTokens)
+	}
+
+	keep := make([]bool, len(lines))
+	used := 0
+	add := func(i, limit int) bool {
+		tokens := countTokens(lines[i]) + 1 // for the newline
+		if used+tokens > limit {
+			return false
+		}
+		keep[i] = true
+		used += tokens
+		return true
+	}
+
+	head := 0
+	for head < len(lines) && add(head, budget/4) {
+		head++
+	}
+	tail := len(lines) - 1
+	for tail >= head && add(tail, budget/4+budget/2) {
+		tail--
+	}
+	if head > tail {
+		return output
+	}
+
+	// error lines in the middle, each may need a marker of its own
+	for i := head; i <= tail && used+elisionMarkerTokens < budget; i++ {
+		if !errorLineRegex.MatchString(lines[i]) {
+			continue
+		}
+		used += elisionMarkerTokens
+		if !add(i, budget) {
+			used -= elisionMarkerTokens
+		}
+	}
+
+	if used == 0 {
+		// lines too long to keep any of them whole
+		return truncateChars(output, maxTokens, countTokens)
+	}
+
+	kept := []string{}
+	omitted := 0
+	for i, line := range lines {
+		if !keep[i] {
+			omitted++
+			continue
+		}
+		if omitted > 0 {
+			kept = append(kept, fmt.Sprintf(elisionMarker, omitted))
+			omitted = 0
+		}
+		kept = append(kept, line)
+	}
+	if omitted > 0 {
+		kept = append(kept, fmt.Sprintf(elisionMarker, omitted))
+	}
+	return strings.Join(kept, "\n")
+}
+
+// Keep the start and end of a string without regard to lines, shrinking it
+// until it fits
+func truncateChars(output string, maxTokens int, countTokens func(string) int) string {
+	tokens := countTokens(output)
+	if tokens <= maxTokens {
+		return output
+	}
+
+	runes := []rune(output)
+	keep := len(runes) * maxTokens / tokens
+	for keep > 0 {
+		head := keep / 3
+		truncated := string(runes[:head]) + " ... " + string(runes[len(runes)-(keep-head):])
+		if countTokens(truncated) <= maxTokens {
+			return truncated
+		}
+		keep = keep * 9 / 10
+	}
+	return ""
+}
+
+// Truncate command output for the history with truncateOutput, returns the
+// number of tokens and the truncated output
+func countAndTruncateOutput(data string, encoder *tiktoken.Tiktoken, maxTokens int) (int, string) {
+	countTokens := func(s string) int {
+		return len(encoder.Encode(s, nil, nil))
+	}
+	if len(data) <= maxTokens*outputBytesPerToken {
+		if tokens := countTokens(data); tokens <= maxTokens {
+			return tokens, data
+		}
+	}
+
+	data = truncateOutput(data, maxTokens, countTokens)
+	tokens := countTokens(data)
+	if tokens > maxTokens {
+		// markers can take a few more tokens than we reserved
+		data = truncateChars(data, maxTokens, countTokens)
+		tokens = countTokens(data)
+	}
+	return tokens, data
+}
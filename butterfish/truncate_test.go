@@ -0,0 +1,54 @@
+package butterfish
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// One token per word
+func countWords(s string) int {
+	return len(strings.Fields(s))
+}
+
+func TestTruncateOutput(t *testing.T) {
+	lines := []string{}
+	for i := 1; i <= 100; i++ {
+		lines = append(lines, fmt.Sprintf("compiling package %d", i))
+	}
+	lines[49] = "main.go:12: error: undefined: foo"
+	lines[99] = "build failed"
+	output := strings.Join(lines, "\n")
+
+	truncated := truncateOutput(output, 100, countWords)
+	assert.LessOrEqual(t, countWords(truncated), 100)
+	assert.True(t, strings.HasPrefix(truncated, "compiling package 1\n"))
+	assert.True(t, strings.HasSuffix(truncated, "\nbuild failed"))
+	assert.Contains(t, truncated, "\nmain.go:12: error: undefined: foo\n")
+	assert.Contains(t, truncated, "lines omitted] ...")
+
+	// the kept lines and omitted counts add up to the whole output
+	total := 0
+	for _, line := range strings.Split(truncated, "\n") {
+		var omitted int
+		if _, err := fmt.Sscanf(line, elisionMarker, &omitted); err == nil {
+			total += omitted
+		} else {
+			total++
+		}
+	}
+	assert.Equal(t, 100, total)
+
+	// output that fits is unchanged
+	assert.Equal(t, output, truncateOutput(output, 1000, countWords))
+}
+
+func TestTruncateChars(t *testing.T) {
+	output := strings.Repeat("word ", 100) + "end"
+	truncated := truncateOutput(output, 20, countWords)
+	assert.LessOrEqual(t, countWords(truncated), 20)
+	assert.True(t, strings.HasSuffix(truncated, "end"))
+	assert.Contains(t, truncated, " ... ")
+}
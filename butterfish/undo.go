@@ -0,0 +1,287 @@
+package butterfish
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Before edit or gentest write files we snapshot what they're replacing in
+// <state dir>/undo/<id>/, one directory per write with an entry.json
+// describing the files and a copy of each. butterfish undo restores the most
+// recent entries and removes them. Like sessions, the journal isn't
+// per-profile.
+
+const (
+	undoDirName       = "undo"
+	undoEntryFileName = "entry.json"
+	maxUndoEntries    = 100
+)
+
+func UndoDir(stateBaseDir string) string {
+	return filepath.Join(stateBaseDir, undoDirName)
+}
+
+// A file as it was before a write
+type UndoFile struct {
+	Path string `json:"path"`
+	// Whether the file existed, if not undoing deletes it
+	Existed bool        `json:"existed"`
+	Mode    fs.FileMode `json:"mode"`
+	// Name of the copy of the old content in the entry directory
+	Snapshot string `json:"snapshot,omitempty"`
+	// Hash of what we wrote, so we can tell if the file changed since
+	WrittenHash string `json:"written_hash"`
+}
+
+type UndoEntry struct {
+	ID      string     `json:"id"`
+	Time    time.Time  `json:"time"`
+	Command string     `json:"command"`
+	Files   []UndoFile `json:"files"`
+}
+
+type UndoJournal struct {
+	Dir string
+}
+
+func NewUndoJournal(stateBaseDir string) *UndoJournal {
+	return &UndoJournal{Dir: UndoDir(stateBaseDir)}
+}
+
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// Snapshot files before they're overwritten, contents maps each absolute
+// path to what's about to be written to it
+func (this *UndoJournal) Record(command string, contents map[string]string) (*UndoEntry, error) {
+	now := time.Now()
+	entry := &UndoEntry{
+		ID:      NewSessionID(now),
+		Time:    now,
+		Command: command,
+	}
+	entryDir := filepath.Join(this.Dir, entry.ID)
+	err := os.MkdirAll(entryDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for path := range contents {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for i, path := range paths {
+		file := UndoFile{
+			Path:        path,
+			WrittenHash: contentHash([]byte(contents[path])),
+		}
+
+		old, err := os.ReadFile(path)
+		if err == nil {
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			file.Existed = true
+			file.Mode = info.Mode().Perm()
+			file.Snapshot = strconv.Itoa(i)
+			err = os.WriteFile(filepath.Join(entryDir, file.Snapshot), old, 0600)
+			if err != nil {
+				return nil, err
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		entry.Files = append(entry.Files, file)
+	}
+
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(filepath.Join(entryDir, undoEntryFileName), data, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, this.prune()
+}
+
+// Entries in the journal, oldest first
+func (this *UndoJournal) List() ([]*UndoEntry, error) {
+	dirs, err := os.ReadDir(this.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*UndoEntry{}
+	for _, dir := range dirs {
+		data, err := os.ReadFile(filepath.Join(this.Dir, dir.Name(), undoEntryFileName))
+		if err != nil {
+			// a write that was interrupted before its entry was saved
+			continue
+		}
+		entry := &UndoEntry{}
+		err = json.Unmarshal(data, entry)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read undo entry %s: %s", dir.Name(), err)
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].Time.Equal(entries[j].Time) {
+			return entries[i].Time.Before(entries[j].Time)
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries, nil
+}
+
+// Drop the oldest entries beyond maxUndoEntries
+func (this *UndoJournal) prune() error {
+	entries, err := this.List()
+	if err != nil {
+		return err
+	}
+	for len(entries) > maxUndoEntries {
+		err = this.Remove(entries[0])
+		if err != nil {
+			return err
+		}
+		entries = entries[1:]
+	}
+	return nil
+}
+
+func (this *UndoJournal) Remove(entry *UndoEntry) error {
+	return os.RemoveAll(filepath.Join(this.Dir, entry.ID))
+}
+
+// Put back the files of an entry and remove it from the journal. Files that
+// changed after we wrote them are only restored with force.
+func (this *UndoJournal) Undo(entry *UndoEntry, force bool) error {
+	if !force {
+		for _, file := range entry.Files {
+			current, err := os.ReadFile(file.Path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			if err != nil || contentHash(current) != file.WrittenHash {
+				return fmt.Errorf("%s has changed since %s wrote it, use --force to restore it anyway", file.Path, entry.Command)
+			}
+		}
+	}
+
+	for _, file := range entry.Files {
+		if !file.Existed {
+			err := os.Remove(file.Path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+
+		err := this.restore(entry, file)
+		if err != nil {
+			return err
+		}
+	}
+
+	return this.Remove(entry)
+}
+
+func (this *UndoJournal) restore(entry *UndoEntry, file UndoFile) error {
+	snapshot, err := os.Open(filepath.Join(this.Dir, entry.ID, file.Snapshot))
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	err = os.MkdirAll(filepath.Dir(file.Path), 0755)
+	if err != nil {
+		return err
+	}
+	err = writeFileOnSuccess(file.Path, func(out io.Writer) error {
+		_, err := io.Copy(out, snapshot)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return os.Chmod(file.Path, file.Mode)
+}
+
+func (this *ButterfishCtx) undoJournal() *UndoJournal {
+	if this.Config.StateBaseDir == "" {
+		return nil
+	}
+	return NewUndoJournal(this.Config.StateBaseDir)
+}
+
+func (this *ButterfishCtx) undoCommand(options *CliCommandConfig) error {
+	journal := this.undoJournal()
+	if journal == nil {
+		return errors.New("Undo needs a state directory")
+	}
+	entries, err := journal.List()
+	if err != nil {
+		return err
+	}
+
+	if options.Undo.List {
+		for i := len(entries) - 1; i >= 0; i-- {
+			entry := entries[i]
+			this.StylePrintf(this.Config.Styles.Highlight, "%s", entry.ID)
+			this.Printf("  %s  %s\n", entry.Time.Format("2006-01-02 15:04:05"), entry.Command)
+			for _, file := range entry.Files {
+				created := ""
+				if !file.Existed {
+					created = " (created)"
+				}
+				this.Printf("    %s%s\n", file.Path, created)
+			}
+		}
+		return nil
+	}
+
+	if len(entries) == 0 {
+		return errors.New("Nothing to undo")
+	}
+	count := min(max(options.Undo.Count, 1), len(entries))
+
+	// most recent first, so a file changed twice ends up at its oldest version
+	for i := len(entries) - 1; i >= len(entries)-count; i-- {
+		entry := entries[i]
+		err := journal.Undo(entry, options.Undo.Force)
+		if err != nil {
+			return err
+		}
+		for _, file := range entry.Files {
+			verb := "Restored"
+			if !file.Existed {
+				verb = "Removed"
+			}
+			this.Printf("%s %s\n", verb, file.Path)
+		}
+	}
+	return nil
+}
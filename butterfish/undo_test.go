@@ -0,0 +1,53 @@
+package butterfish
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUndoJournal(t *testing.T) {
+	dir := t.TempDir()
+	journal := NewUndoJournal(t.TempDir())
+	existing := filepath.Join(dir, "a.go")
+	assert.Nil(t, os.WriteFile(existing, []byte("old\n"), 0600))
+
+	session, err := NewEditSession(dir)
+	assert.Nil(t, err)
+	session.Journal = journal
+	session.Command = "edit"
+
+	buffer, _, err := session.Open("a.go")
+	assert.Nil(t, err)
+	buffer.Lines = []string{"new", ""}
+	buffer, _, err = session.Open("sub/b.go")
+	assert.Nil(t, err)
+	buffer.Lines = []string{"created", ""}
+	assert.Nil(t, session.WriteAll())
+
+	entries, err := journal.List()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "edit", entries[0].Command)
+	assert.Equal(t, 2, len(entries[0].Files))
+
+	// refuse to clobber changes made after the edit
+	assert.Nil(t, os.WriteFile(existing, []byte("changed by hand\n"), 0600))
+	assert.NotNil(t, journal.Undo(entries[0], false))
+	assert.Nil(t, os.WriteFile(existing, []byte("new\n"), 0600))
+
+	assert.Nil(t, journal.Undo(entries[0], false))
+	content, err := os.ReadFile(existing)
+	assert.Nil(t, err)
+	assert.Equal(t, "old\n", string(content))
+	info, _ := os.Stat(existing)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	_, err = os.Stat(filepath.Join(dir, "sub", "b.go"))
+	assert.True(t, os.IsNotExist(err))
+
+	entries, err = journal.List()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+}
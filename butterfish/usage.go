@@ -0,0 +1,329 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Usage tracking, we keep rough per-month counts of requests and tokens for
+// each profile in <state dir>/usage.json. Token counts are estimates based
+// on string length since streaming responses don't report usage.
+
+const usageFileName = "usage.json"
+
+type UsageCounts struct {
+	Requests         int           `json:"requests"`
+	PromptTokens     int           `json:"prompt_tokens"`
+	CompletionTokens int           `json:"completion_tokens"`
+	Latency          *LatencyStats `json:"latency,omitempty"`
+}
+
+func (this *UsageCounts) Total() int {
+	return this.PromptTokens + this.CompletionTokens
+}
+
+// Summed request timings, averaged for display so that models can be
+// compared on speed
+type LatencyStats struct {
+	Requests     int   `json:"requests"`
+	DurationMs   int64 `json:"duration_ms"`
+	Streamed     int   `json:"streamed"`
+	FirstTokenMs int64 `json:"first_token_ms"`
+	Tokens       int   `json:"tokens"`
+	GenerationMs int64 `json:"generation_ms"`
+	// The slowest first token, useful for setting --token-timeout
+	MaxFirstTokenMs int64 `json:"max_first_token_ms,omitempty"`
+	Retries         int   `json:"retries,omitempty"`
+}
+
+func (this *LatencyStats) Add(metrics *util.CompletionMetrics) {
+	this.Requests++
+	this.DurationMs += metrics.Duration.Milliseconds()
+	if metrics.TimeToFirstToken > 0 {
+		this.Streamed++
+		this.FirstTokenMs += metrics.TimeToFirstToken.Milliseconds()
+		if firstToken := metrics.TimeToFirstToken.Milliseconds(); firstToken > this.MaxFirstTokenMs {
+			this.MaxFirstTokenMs = firstToken
+		}
+	}
+	this.Retries += metrics.Retries
+	this.Tokens += metrics.Tokens
+	this.GenerationMs += (metrics.Duration - metrics.TimeToFirstToken).Milliseconds()
+}
+
+func (this *LatencyStats) String() string {
+	if this.Requests == 0 {
+		return "no timed requests"
+	}
+
+	str := fmt.Sprintf("avg %s", time.Duration(this.DurationMs/int64(this.Requests))*time.Millisecond)
+	if this.Streamed > 0 {
+		str += fmt.Sprintf(", %s to first token", time.Duration(this.FirstTokenMs/int64(this.Streamed))*time.Millisecond)
+	}
+	if this.GenerationMs > 0 {
+		str += fmt.Sprintf(", %.1f tokens/s", float64(this.Tokens)/(float64(this.GenerationMs)/1000))
+	}
+	return str
+}
+
+// Usage for a single month, keyed by model
+type MonthUsage struct {
+	Total  UsageCounts             `json:"total"`
+	Models map[string]*UsageCounts `json:"models"`
+}
+
+type UsageTracker struct {
+	Path   string
+	Months map[string]*MonthUsage
+	// Usage since this process started, keyed by model, not saved
+	Session map[string]*UsageCounts
+	loaded  bool
+	mutex   sync.Mutex
+}
+
+func NewUsageTracker(stateDir string) *UsageTracker {
+	return &UsageTracker{
+		Path:    filepath.Join(stateDir, usageFileName),
+		Months:  make(map[string]*MonthUsage),
+		Session: make(map[string]*UsageCounts),
+	}
+}
+
+// Read the usage file on first use rather than at startup, must be called
+// with the mutex held
+func (this *UsageTracker) load() {
+	if this.loaded {
+		return
+	}
+	this.loaded = true
+
+	data, err := os.ReadFile(this.Path)
+	if err == nil {
+		err = json.Unmarshal(data, &this.Months)
+		if err != nil {
+			log.Printf("Unable to parse usage file %s: %s", this.Path, err)
+			this.Months = make(map[string]*MonthUsage)
+		}
+	}
+}
+
+func usageMonth(t time.Time) string {
+	return t.Format("2006-01")
+}
+
+// Rough token estimate, about 4 characters per token for English text
+func estimateTokens(s string) int {
+	return (len(s) + 3) / 4
+}
+
+func estimateRequestTokens(request *util.CompletionRequest) int {
+	total := estimateTokens(request.Prompt) + estimateTokens(request.SystemMessage)
+	for _, block := range request.HistoryBlocks {
+		total += estimateTokens(block.Content)
+	}
+	return total
+}
+
+func estimateResponseTokens(response *util.CompletionResponse) int {
+	total := estimateTokens(response.Completion) + estimateTokens(response.FunctionParameters)
+	for _, toolCall := range response.ToolCalls {
+		total += estimateTokens(toolCall.Function.Parameters)
+	}
+	return total
+}
+
+func (this *UsageTracker) CurrentMonth() UsageCounts {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.load()
+
+	month, ok := this.Months[usageMonth(time.Now())]
+	if !ok {
+		return UsageCounts{}
+	}
+	return month.Total
+}
+
+// Usage by model for the current month
+func (this *UsageTracker) CurrentMonthModels() map[string]UsageCounts {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.load()
+
+	models := make(map[string]UsageCounts)
+	if month, ok := this.Months[usageMonth(time.Now())]; ok {
+		for model, counts := range month.Models {
+			models[model] = *counts
+		}
+	}
+	return models
+}
+
+// Usage by model since this process started
+func (this *UsageTracker) SessionModels() map[string]UsageCounts {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	models := make(map[string]UsageCounts)
+	for model, counts := range this.Session {
+		models[model] = *counts
+	}
+	return models
+}
+
+func (this *UsageTracker) Record(
+	model string,
+	promptTokens, completionTokens int,
+	metrics *util.CompletionMetrics,
+) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.load()
+
+	key := usageMonth(time.Now())
+	month, ok := this.Months[key]
+	if !ok {
+		month = &MonthUsage{Models: make(map[string]*UsageCounts)}
+		this.Months[key] = month
+	}
+	modelUsage, ok := month.Models[model]
+	if !ok {
+		modelUsage = &UsageCounts{}
+		month.Models[model] = modelUsage
+	}
+
+	sessionUsage, ok := this.Session[model]
+	if !ok {
+		sessionUsage = &UsageCounts{}
+		this.Session[model] = sessionUsage
+	}
+
+	for _, counts := range []*UsageCounts{&month.Total, modelUsage, sessionUsage} {
+		counts.Requests++
+		counts.PromptTokens += promptTokens
+		counts.CompletionTokens += completionTokens
+		if metrics != nil {
+			if counts.Latency == nil {
+				counts.Latency = &LatencyStats{}
+			}
+			counts.Latency.Add(metrics)
+		}
+	}
+
+	err := this.save()
+	if err != nil {
+		log.Printf("Unable to save usage file %s: %s", this.Path, err)
+	}
+}
+
+func (this *UsageTracker) save() error {
+	data, err := json.MarshalIndent(this.Months, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(this.Path), 0700)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(this.Path, data, 0600)
+}
+
+// An LLM wrapper that records usage and enforces a monthly token budget
+type UsageTrackingLLM struct {
+	LLM     LLM
+	Tracker *UsageTracker
+	Profile string
+	Budget  int
+}
+
+func NewUsageTrackingLLM(llm LLM, tracker *UsageTracker, profile string, budget int) *UsageTrackingLLM {
+	return &UsageTrackingLLM{
+		LLM:     llm,
+		Tracker: tracker,
+		Profile: profile,
+		Budget:  budget,
+	}
+}
+
+func (this *UsageTrackingLLM) Unwrap() LLM {
+	return this.LLM
+}
+
+func (this *UsageTrackingLLM) checkBudget() error {
+	if this.Budget <= 0 {
+		return nil
+	}
+
+	counts := this.Tracker.CurrentMonth()
+	used := counts.Total()
+	if used >= this.Budget {
+		return fmt.Errorf("Token budget exhausted for profile %s: used about %d of %d tokens this month", this.Profile, used, this.Budget)
+	}
+	return nil
+}
+
+func (this *UsageTrackingLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	if err := this.checkBudget(); err != nil {
+		return nil, err
+	}
+
+	response, err := this.LLM.CompletionStream(request, writer)
+	this.record(request, response)
+	return response, err
+}
+
+func (this *UsageTrackingLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	if err := this.checkBudget(); err != nil {
+		return nil, err
+	}
+
+	response, err := this.LLM.Completion(request)
+	this.record(request, response)
+	return response, err
+}
+
+func (this *UsageTrackingLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	if err := this.checkBudget(); err != nil {
+		return nil, err
+	}
+
+	tokens := 0
+	for _, s := range input {
+		tokens += estimateTokens(s)
+	}
+
+	result, err := this.LLM.Embeddings(ctx, input, verbose)
+	if err == nil {
+		this.Tracker.Record(string(GPTEmbeddingsModel), tokens, 0, nil)
+	}
+	return result, err
+}
+
+func (this *UsageTrackingLLM) record(request *util.CompletionRequest, response *util.CompletionResponse) {
+	if response == nil {
+		return
+	}
+
+	completionTokens := estimateResponseTokens(response)
+	promptTokens := estimateRequestTokens(request)
+	if response.Metrics != nil && response.Metrics.PromptTokens > 0 {
+		promptTokens = response.Metrics.PromptTokens
+	}
+
+	model := request.Model
+	if response.Model != "" {
+		model = response.Model
+	}
+	this.Tracker.Record(model, promptTokens, completionTokens, response.Metrics)
+}
@@ -0,0 +1,117 @@
+package butterfish
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Variables hold text for the rest of the session, like a ticket number or a
+// snippet of code, so it doesn't have to be pasted into each prompt. "Set
+// ticket=ENG-1234" sets one and prompts like "Write a commit message for
+// {ticket}" get the value in place of {ticket} before they're sent. Braces
+// around anything that isn't a variable are left alone, so code in prompts
+// still works. "Get ticket" prints a value, and Set or Get on their own list
+// them all.
+
+var (
+	variableNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	variableRefRegex  = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+)
+
+// Parse "Set [name=value]", the name and value are empty if there's no
+// argument. Other prompts starting with Set, like "Set up a cron job", are
+// normal prompts.
+func setVariableCommand(prompt string) (string, string, bool) {
+	arg, ok := localCommandText(prompt, "set")
+	if !ok {
+		return "", "", false
+	}
+	if arg == "" {
+		return "", "", true
+	}
+	name, value, found := strings.Cut(arg, "=")
+	name = strings.TrimSpace(name)
+	if !found || !variableNameRegex.MatchString(name) {
+		return "", "", false
+	}
+	return name, strings.TrimSpace(value), true
+}
+
+// Parse "Get [name]", only a variable that's been set is a name so prompts
+// like "Get started" aren't swallowed
+func (this *ShellState) getVariableCommand(prompt string) (string, bool) {
+	name, ok := localCommandArg(prompt, "get")
+	if !ok {
+		return "", false
+	}
+	if _, set := this.Variables[name]; name != "" && !set {
+		return "", false
+	}
+	return name, true
+}
+
+// Replace {name} with the value of each variable that's set
+func expandVariables(text string, variables map[string]string) string {
+	if len(variables) == 0 {
+		return text
+	}
+	return variableRefRegex.ReplaceAllStringFunc(text, func(ref string) string {
+		if value, ok := variables[ref[1:len(ref)-1]]; ok {
+			return value
+		}
+		return ref
+	})
+}
+
+// The prompt that was typed with variables filled in
+func (this *ShellState) expandedPromptText() string {
+	return expandVariables(this.promptText(), this.Variables)
+}
+
+// Set a variable, an empty value unsets it and no name lists them
+func (this *ShellState) SetVariable(name, value string) {
+	switch {
+	case name == "":
+		this.printLocalResponse(this.variablesText())
+	case value == "":
+		delete(this.Variables, name)
+		this.printLocalResponse(fmt.Sprintf("Unset {%s}\n", name))
+	default:
+		if this.Variables == nil {
+			this.Variables = map[string]string{}
+		}
+		this.Variables[name] = value
+		this.printLocalResponse(fmt.Sprintf("Set {%s}, use it in prompts like \"Explain {%s}\"\n", name, name))
+	}
+}
+
+// Print a variable, no name lists them
+func (this *ShellState) GetVariable(name string) {
+	if name == "" {
+		this.printLocalResponse(this.variablesText())
+		return
+	}
+	this.printLocalResponse(this.Variables[name] + "\n")
+}
+
+func (this *ShellState) variableNames() []string {
+	names := []string{}
+	for name := range this.Variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (this *ShellState) variablesText() string {
+	if len(this.Variables) == 0 {
+		return "No variables set, use Set name=value\n"
+	}
+	text := ""
+	for _, name := range this.variableNames() {
+		text += fmt.Sprintf("%s=%s\n", name, this.Variables[name])
+	}
+	return text
+}
@@ -0,0 +1,65 @@
+package butterfish
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bakks/butterfish/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandVariables(t *testing.T) {
+	variables := map[string]string{"ticket": "ENG-1234", "host": "api.example.com"}
+	assert.Equal(t, "Branch name for ENG-1234 on api.example.com",
+		expandVariables("Branch name for {ticket} on {host}", variables))
+	// braces that aren't variables are left alone
+	assert.Equal(t, "Why does func() { return {x} } fail",
+		expandVariables("Why does func() { return {x} } fail", variables))
+}
+
+func TestSetVariableCommand(t *testing.T) {
+	name, value, ok := setVariableCommand("Set ticket = ENG-1234 and more")
+	assert.True(t, ok)
+	assert.Equal(t, "ticket", name)
+	assert.Equal(t, "ENG-1234 and more", value)
+
+	name, _, ok = setVariableCommand("set")
+	assert.True(t, ok)
+	assert.Equal(t, "", name)
+
+	_, _, ok = setVariableCommand("Set up a cron job where x=1")
+	assert.False(t, ok)
+	_, _, ok = setVariableCommand("Settings are broken")
+	assert.False(t, ok)
+}
+
+func TestVariableLocalCommands(t *testing.T) {
+	out := new(bytes.Buffer)
+	state := &ShellState{
+		Butterfish:         &ButterfishCtx{Config: MakeButterfishConfig()},
+		Color:              DarkShellColorScheme,
+		Prompt:             NewShellBuffer(),
+		PromptAnswerWriter: out,
+		PromptOutputChan:   make(chan *util.CompletionResponse, 8),
+	}
+	run := func(prompt string) bool {
+		state.Prompt.Clear()
+		state.Prompt.Write(prompt)
+		return state.HandleLocalPrompt()
+	}
+
+	assert.False(t, run("Get started with go"))
+	assert.True(t, run("Set ticket=ENG-1234"))
+	assert.Equal(t, map[string]string{"ticket": "ENG-1234"}, state.Variables)
+
+	out.Reset()
+	assert.True(t, run("Get ticket"))
+	assert.Contains(t, out.String(), "ENG-1234\n")
+
+	state.Prompt.Clear()
+	state.Prompt.Write("Summarize {ticket}")
+	assert.Equal(t, "Summarize ENG-1234", state.expandedPromptText())
+
+	assert.True(t, run("Set ticket="))
+	assert.Empty(t, state.Variables)
+}
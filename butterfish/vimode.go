@@ -0,0 +1,441 @@
+package butterfish
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Shells in vi mode, set -o vi in bash or bindkey -v in zsh, start each line
+// in insert mode, where keys edit the line as usual, and escape switches to
+// normal mode, where keys are commands that move the cursor and change the
+// line. ViEditor follows along so that the command buffer matches the
+// shell's line: it models motions, the common operators, and the commands
+// that go back to insert mode. After a command it doesn't model, like undo or
+// moving through the shell's history, the buffer is marked lost and the
+// command is read off the screen model when it's run. In normal mode keys
+// aren't text, so capital letters don't start a prompt and there are no
+// autosuggestions.
+
+type ViEditor struct {
+	// In normal mode rather than insert mode
+	Normal bool
+	// The buffer no longer matches the shell's line
+	Lost bool
+	// The screen column the line starts in
+	Column int
+
+	// keys of a normal mode command that isn't complete yet, e.g. "d2"
+	pending []rune
+	// text deleted or yanked, for p and P
+	register []rune
+}
+
+var (
+	inputrcViRegex = regexp.MustCompile(`(?m)^\s*set\s+editing-mode\s+vi\b`)
+	bashViRegex    = regexp.MustCompile(`(?m)^\s*set\s+-o\s+vi\b`)
+	zshViRegex     = regexp.MustCompile(`(?m)^\s*(bindkey\s+-v\b|plugins=\(.*\bvi-mode\b)`)
+)
+
+// Whether the user's shell config puts the line editor in vi mode
+func DetectViMode(shell, home string) bool {
+	matches := func(re *regexp.Regexp, paths ...string) bool {
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			if err == nil && re.Match(data) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch filepath.Base(shell) {
+	case "bash":
+		inputrc := os.Getenv("INPUTRC")
+		if inputrc == "" {
+			inputrc = filepath.Join(home, ".inputrc")
+		}
+		return matches(inputrcViRegex, inputrc) ||
+			matches(bashViRegex, filepath.Join(home, ".bashrc"), filepath.Join(home, ".bash_profile"))
+	case "zsh":
+		dir := os.Getenv("ZDOTDIR")
+		if dir == "" {
+			dir = home
+		}
+		return matches(zshViRegex, filepath.Join(dir, ".zshrc"))
+	}
+	return false
+}
+
+// Pass keys to the shell in vi mode, data has no carriage return
+func (this *ShellState) ViInput(data []byte) {
+	if this.State == stateNormal && this.Command.Size() == 0 && !this.Vi.Normal {
+		this.Vi.Column = this.Screen.CursorColumn()
+	}
+
+	this.Vi.Write(this.Command, data)
+	this.ChildIn.Write(data)
+
+	if this.Vi.Normal || this.Vi.Lost {
+		this.ClearAutosuggest(this.Color.Command)
+	} else {
+		this.RefreshAutosuggest(data, this.Command, this.Color.Command)
+	}
+	if this.Vi.Lost || this.Command.Size() > 0 {
+		this.setState(stateShell)
+	} else {
+		this.setState(stateNormal)
+	}
+}
+
+// The command to run, read off the screen if the buffer was lost
+func (this *ShellState) viCommand() string {
+	if !this.Vi.Lost {
+		return this.Command.String()
+	}
+	return searchedCommand(this.Screen.CursorLine(0), this.Screen.CursorLine(this.Vi.Column))
+}
+
+// Start a new line in insert mode
+func (this *ViEditor) Reset(column int) {
+	this.Normal = false
+	this.Lost = false
+	this.Column = column
+	this.pending = nil
+}
+
+// Apply keys the user typed to the buffer
+func (this *ViEditor) Write(buffer *ShellBuffer, data []byte) {
+	for len(data) > 0 && !this.Lost {
+		if !this.Normal {
+			i := viEscapeIndex(data)
+			if i < 0 {
+				buffer.Write(string(data))
+				return
+			}
+			buffer.Write(string(data[:i]))
+			data = data[i+1:]
+			// leaving insert mode moves back onto the last character
+			this.Normal = true
+			if buffer.cursor > 0 {
+				buffer.cursor = buffer.prevBoundary(buffer.cursor)
+			}
+			continue
+		}
+
+		// arrow keys move in normal mode too
+		if len(data) >= 3 && data[0] == 0x1b && (data[1] == '[' || data[1] == 'O') {
+			switch data[2] {
+			case 'C':
+				this.key(buffer, 'l')
+			case 'D':
+				this.key(buffer, 'h')
+			default:
+				this.lose()
+			}
+			data = data[3:]
+			continue
+		}
+
+		r, size := utf8.DecodeRune(data)
+		data = data[size:]
+		if r == 0x1b {
+			// escape in normal mode cancels a pending command
+			this.pending = nil
+			continue
+		}
+		this.key(buffer, r)
+	}
+}
+
+// The index of an escape that leaves insert mode rather than starting a key
+// sequence like an arrow key, -1 if there's none
+func viEscapeIndex(data []byte) int {
+	for i := 0; i < len(data); i++ {
+		if data[i] != 0x1b {
+			continue
+		}
+		if i+1 < len(data) && (data[i+1] == '[' || data[i+1] == 'O') {
+			i += 2
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+// Parse a count at the start of keys, 0 if there's none
+func viCount(keys []rune) (int, []rune) {
+	count := 0
+	for len(keys) > 0 && (keys[0] >= '1' && keys[0] <= '9' || count > 0 && keys[0] == '0') {
+		count = count*10 + int(keys[0]-'0')
+		keys = keys[1:]
+	}
+	return count, keys
+}
+
+// Handle a key in normal mode
+func (this *ViEditor) key(buffer *ShellBuffer, r rune) {
+	this.pending = append(this.pending, r)
+	count, keys := viCount(this.pending)
+	if len(keys) == 0 {
+		return
+	}
+	count = max(count, 1)
+	line := buffer.buffer
+	cursor := buffer.cursor
+
+	command := keys[0]
+	switch command {
+	case 'd', 'c', 'y':
+		motionCount, motion := viCount(keys[1:])
+		if len(motion) == 0 || viNeedsArg(motion[0]) && len(motion) < 2 {
+			return
+		}
+		count *= max(motionCount, 1)
+
+		from, to := 0, len(line)
+		if motion[0] != command {
+			// cw changes to the end of the word, like ce
+			if command == 'c' && motion[0] == 'w' {
+				motion[0] = 'e'
+			} else if command == 'c' && motion[0] == 'W' {
+				motion[0] = 'E'
+			}
+			var arg rune
+			if len(motion) > 1 {
+				arg = motion[1]
+			}
+			target, ok := viMotion(line, cursor, motion[0], arg, count)
+			if !ok {
+				this.lose()
+				return
+			}
+			from, to = min(cursor, target), max(cursor, target)
+			if viInclusive(motion[0]) {
+				to = min(to+1, len(line))
+			}
+		}
+
+		this.register = append([]rune{}, line[from:to]...)
+		if command == 'y' {
+			if motion[0] != command {
+				buffer.cursor = from
+			}
+		} else {
+			buffer.replace(from, to, nil)
+		}
+		if command == 'c' {
+			this.Normal = false
+		}
+
+	case 'r', 'f', 'F', 't', 'T':
+		if len(keys) < 2 {
+			return
+		}
+		if command == 'r' {
+			if cursor+count > len(line) {
+				break
+			}
+			buffer.replace(cursor, cursor+count, []rune(strings.Repeat(string(keys[1]), count)))
+			buffer.cursor = cursor + count - 1
+			break
+		}
+		if target, ok := viMotion(line, cursor, command, keys[1], count); ok {
+			buffer.cursor = target
+		}
+
+	case 'x', 's':
+		to := min(cursor+count, len(line))
+		this.register = append([]rune{}, line[cursor:to]...)
+		buffer.replace(cursor, to, nil)
+		this.Normal = command == 'x'
+	case 'X':
+		from := max(cursor-count, 0)
+		this.register = append([]rune{}, line[from:cursor]...)
+		buffer.replace(from, cursor, nil)
+	case 'D', 'C':
+		this.register = append([]rune{}, line[cursor:]...)
+		buffer.replace(cursor, len(line), nil)
+		this.Normal = command == 'D'
+	case 'S':
+		this.register = append([]rune{}, line...)
+		buffer.replace(0, len(line), nil)
+		this.Normal = false
+	case '~':
+		to := min(cursor+count, len(line))
+		toggled := []rune{}
+		for _, c := range line[cursor:to] {
+			if unicode.IsUpper(c) {
+				toggled = append(toggled, unicode.ToLower(c))
+			} else {
+				toggled = append(toggled, unicode.ToUpper(c))
+			}
+		}
+		buffer.replace(cursor, to, toggled)
+		buffer.cursor = to
+	case 'p', 'P':
+		at := cursor
+		if command == 'p' && len(line) > 0 {
+			at++
+		}
+		text := []rune(strings.Repeat(string(this.register), count))
+		buffer.replace(at, at, text)
+		buffer.cursor = max(at+len(text)-1, 0)
+
+	case 'i':
+		this.Normal = false
+	case 'a':
+		buffer.cursor = min(cursor+1, len(line))
+		this.Normal = false
+	case 'I':
+		buffer.cursor, _ = viMotion(line, cursor, '^', 0, 1)
+		this.Normal = false
+	case 'A':
+		buffer.cursor = len(line)
+		this.Normal = false
+
+	default:
+		target, ok := viMotion(line, cursor, command, 0, count)
+		if !ok {
+			// undo, history, searches and the like
+			this.lose()
+			return
+		}
+		buffer.cursor = target
+	}
+
+	this.pending = nil
+	if this.Normal && buffer.cursor >= len(buffer.buffer) {
+		// normal mode stays on a character
+		buffer.cursor = max(len(buffer.buffer)-1, 0)
+	}
+}
+
+func (this *ViEditor) lose() {
+	this.Lost = true
+	this.pending = nil
+}
+
+func viNeedsArg(motion rune) bool {
+	return strings.ContainsRune("fFtT", motion)
+}
+
+// Motions that include the character they end on when used with an operator
+func viInclusive(motion rune) bool {
+	return strings.ContainsRune("eEfFtT$", motion)
+}
+
+// vi word characters, other non-blank characters make up words of their own
+func viWordClass(r rune, bigWord bool) int {
+	switch {
+	case unicode.IsSpace(r):
+		return 0
+	case bigWord || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r):
+		return 1
+	}
+	return 2
+}
+
+// Where a motion moves the cursor, false if it's not a motion
+func viMotion(line []rune, cursor int, motion, arg rune, count int) (int, bool) {
+	last := max(len(line)-1, 0)
+	bigWord := unicode.IsUpper(motion)
+	class := func(i int) int {
+		return viWordClass(line[i], bigWord)
+	}
+
+	for n := 0; n < count; n++ {
+		switch motion {
+		case 'h':
+			cursor = max(cursor-1, 0)
+		case 'l', ' ':
+			cursor = min(cursor+1, last)
+		case '0':
+			return 0, true
+		case '^':
+			i := 0
+			for i < last && unicode.IsSpace(line[i]) {
+				i++
+			}
+			return i, true
+		case '$':
+			return last, true
+
+		case 'w', 'W':
+			i := cursor
+			if i < len(line) && class(i) != 0 {
+				start := class(i)
+				for i < len(line) && class(i) == start {
+					i++
+				}
+			}
+			for i < len(line) && class(i) == 0 {
+				i++
+			}
+			cursor = i
+		case 'e', 'E':
+			i := cursor + 1
+			for i < len(line) && class(i) == 0 {
+				i++
+			}
+			if i < len(line) {
+				end := class(i)
+				for i+1 < len(line) && class(i+1) == end {
+					i++
+				}
+			}
+			cursor = min(i, last)
+		case 'b', 'B':
+			i := cursor - 1
+			for i > 0 && class(i) == 0 {
+				i--
+			}
+			if i > 0 {
+				start := class(i)
+				for i > 0 && class(i-1) == start {
+					i--
+				}
+			}
+			cursor = max(i, 0)
+
+		case 'f', 't':
+			i := cursor + 1
+			if motion == 't' {
+				i++
+			}
+			for i < len(line) && line[i] != arg {
+				i++
+			}
+			if i >= len(line) {
+				return cursor, true
+			}
+			cursor = i
+			if motion == 't' {
+				cursor--
+			}
+		case 'F', 'T':
+			i := cursor - 1
+			if motion == 'T' {
+				i--
+			}
+			for i >= 0 && line[i] != arg {
+				i--
+			}
+			if i < 0 {
+				return cursor, true
+			}
+			cursor = i
+			if motion == 'T' {
+				cursor++
+			}
+
+		default:
+			return cursor, false
+		}
+	}
+	return cursor, true
+}
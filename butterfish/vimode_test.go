@@ -0,0 +1,92 @@
+package butterfish
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func viEdit(keys ...string) (*ViEditor, *ShellBuffer) {
+	vi := &ViEditor{}
+	buffer := NewShellBuffer()
+	for _, key := range keys {
+		vi.Write(buffer, []byte(key))
+	}
+	return vi, buffer
+}
+
+func TestViEditor(t *testing.T) {
+	cases := []struct {
+		keys    []string
+		command string
+		cursor  int
+	}{
+		{[]string{"git status", "\x1bbcwfoo"}, "git foo", 7},
+		{[]string{"git status", "\x1b", "0dw"}, "status", 0},
+		{[]string{"ls -l /tmp", "\x1b", "Fld$"}, "ls -", 3},
+		{[]string{"echo one two", "\x1b", "0w", "dw", "P"}, "echo one two", 8},
+		{[]string{"cat foo", "\x1b", "0", "3l", "x", "i>\x1bA.txt"}, "cat>foo.txt", 11},
+		{[]string{"abc", "\x1b", "0~~"}, "ABc", 2},
+		{[]string{"make test", "\x1b", "2h", "rX", "I", "sudo "}, "sudo make tXst", 5},
+		{[]string{"echo", "\x1b", "\x1b[D", "\x1b[D", "D"}, "e", 0},
+	}
+	for _, c := range cases {
+		vi, buffer := viEdit(c.keys...)
+		assert.False(t, vi.Lost, c.keys)
+		assert.Equal(t, c.command, buffer.String(), c.keys)
+		assert.Equal(t, c.cursor, buffer.Cursor(), c.keys)
+	}
+
+	// undo isn't modelled
+	vi, _ := viEdit("ls", "\x1bu")
+	assert.True(t, vi.Lost)
+}
+
+func TestViInput(t *testing.T) {
+	state := reverseSearchShell("$ ")
+	state.Vi = &ViEditor{}
+
+	state.ParentInput(nil, []byte("ls"))
+	state.Screen.Write([]byte("ls"))
+	state.ParentInput(nil, []byte("\x1b"))
+	assert.True(t, state.Vi.Normal)
+	assert.Equal(t, stateShell, state.State)
+
+	// deleting the line doesn't start a prompt with the capital letters
+	state.ParentInput(nil, []byte("S"))
+	state.Screen.Write([]byte("\r$ \x1b[K"))
+	state.ParentInput(nil, []byte("\x1b"))
+	assert.Equal(t, "", state.Command.String())
+	assert.Equal(t, stateNormal, state.State)
+	state.ParentInput(nil, []byte("A"))
+	assert.Equal(t, stateNormal, state.State)
+	assert.Equal(t, "ls\x1bS\x1bA", state.ChildIn.(*bytes.Buffer).String())
+
+	// after undo the command is read off the screen
+	state.ParentInput(nil, []byte("\x1bu"))
+	assert.Equal(t, stateShell, state.State)
+	state.Screen.Write([]byte("ls"))
+	state.ParentInput(nil, []byte("\r"))
+	command, _ := state.History.LastCommand()
+	assert.Equal(t, "ls", command.Content.String())
+	assert.False(t, state.Vi.Normal)
+}
+
+func TestDetectViMode(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("INPUTRC", "")
+	t.Setenv("ZDOTDIR", "")
+	assert.False(t, DetectViMode("/bin/bash", home))
+
+	os.WriteFile(filepath.Join(home, ".bashrc"), []byte("alias ll='ls -l'\nset -o vi\n"), 0644)
+	assert.True(t, DetectViMode("/bin/bash", home))
+	assert.False(t, DetectViMode("/bin/zsh", home))
+
+	os.WriteFile(filepath.Join(home, ".zshrc"), []byte("# bindkey -v\n"), 0644)
+	assert.False(t, DetectViMode("/usr/bin/zsh", home))
+	os.WriteFile(filepath.Join(home, ".zshrc"), []byte("plugins=(git vi-mode)\n"), 0644)
+	assert.True(t, DetectViMode("/usr/bin/zsh", home))
+}
@@ -0,0 +1,295 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// butterfish watch -- <command> runs a long-running command in a PTY, e.g. a
+// dev server or tests in watch mode, and passes its output through untouched.
+// The output is also checked for signs of trouble: a stack trace, a burst of
+// error lines, or nothing printed for a while. When we see one we send the
+// recent output to the LLM and print its note inline, at most once per
+// --interval and only until about --budget tokens have been used.
+
+const (
+	// Lines of recent output sent with an annotation request
+	watchContextLines = 60
+	// Partial lines are cut to this, progress bars redraw with \r and never
+	// end a line
+	watchMaxLineLength = 1024
+	// Error lines within this window count towards a spike
+	watchSpikeWindow = time.Minute
+	// Wait this long after a stack trace starts so the rest of it is sent too
+	watchSettle = time.Second
+	// Tokens an annotation can use in its response
+	watchAnnotationTokens = 128
+)
+
+var (
+	watchStackTracePattern = regexp.MustCompile(`^(panic: |Traceback \(most recent call last\)|goroutine \d+ \[|Exception in thread |\s+at \S+\(\S+:\d+\)$)`)
+	watchErrorPattern      = regexp.MustCompile(`(?i)\b(error|fatal|failed|failure|exception)\b`)
+)
+
+type WatchOptions struct {
+	Model string
+	// Stop annotating after about this many tokens
+	Budget   int
+	Interval time.Duration
+	// Annotate when there's been no output for this long, 0 for never
+	Stall time.Duration
+	// Annotate when this many error lines are printed in watchSpikeWindow
+	ErrorSpike int
+}
+
+type outputWatcher struct {
+	butterfish *ButterfishCtx
+	command    string
+	options    *WatchOptions
+	// Where annotations are written
+	out io.Writer
+	now func() time.Time
+
+	mutex   sync.Mutex
+	partial string
+	lines   []string
+	// When recent error lines were printed, for spotting spikes
+	errorTimes []time.Time
+	lastOutput time.Time
+	stallNoted bool
+	// What looks wrong, waiting for watchSettle and the interval to pass
+	pending   string
+	pendingAt time.Time
+
+	lastAnnotation time.Time
+	inFlight       bool
+	used           int
+	exhausted      bool
+}
+
+func newOutputWatcher(butterfish *ButterfishCtx, command string, options *WatchOptions, out io.Writer) *outputWatcher {
+	return &outputWatcher{
+		butterfish: butterfish,
+		command:    command,
+		options:    options,
+		out:        out,
+		now:        time.Now,
+		lastOutput: time.Now(),
+	}
+}
+
+// Record output from the command, this never fails so that the output keeps
+// flowing
+func (this *outputWatcher) Write(p []byte) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	now := this.now()
+	this.lastOutput = now
+	this.stallNoted = false
+
+	lines := strings.Split(this.partial+string(p), "\n")
+	this.partial = lines[len(lines)-1]
+	if len(this.partial) > watchMaxLineLength {
+		this.partial = this.partial[len(this.partial)-watchMaxLineLength:]
+	}
+
+	for _, line := range lines[:len(lines)-1] {
+		// keep what's left after a carriage return, like a terminal shows
+		line = line[strings.LastIndex(strings.TrimRight(line, "\r"), "\r")+1:]
+		line = sanitizeTTYString(line)
+		this.lines = append(this.lines, line)
+		if reason := this.check(line, now); reason != "" && this.pending == "" {
+			this.pending = reason
+			this.pendingAt = now
+		}
+	}
+	if len(this.lines) > watchContextLines {
+		this.lines = this.lines[len(this.lines)-watchContextLines:]
+	}
+	return len(p), nil
+}
+
+// Why a line of output looks wrong, or empty if it doesn't
+func (this *outputWatcher) check(line string, now time.Time) string {
+	if watchStackTracePattern.MatchString(line) {
+		return "its output contains a stack trace"
+	}
+	if this.options.ErrorSpike <= 0 || !watchErrorPattern.MatchString(line) {
+		return ""
+	}
+
+	recent := []time.Time{}
+	for _, t := range this.errorTimes {
+		if now.Sub(t) < watchSpikeWindow {
+			recent = append(recent, t)
+		}
+	}
+	this.errorTimes = append(recent, now)
+	if len(this.errorTimes) < this.options.ErrorSpike {
+		return ""
+	}
+	this.errorTimes = nil
+	return fmt.Sprintf("it printed %d error lines within a minute", this.options.ErrorSpike)
+}
+
+// Called periodically, returns a reason to annotate now or empty
+func (this *outputWatcher) tick() string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	now := this.now()
+
+	if this.pending == "" && !this.stallNoted && this.options.Stall > 0 &&
+		now.Sub(this.lastOutput) >= this.options.Stall {
+		this.stallNoted = true
+		this.pending = fmt.Sprintf("it hasn't printed anything for %s", this.options.Stall)
+		this.pendingAt = now.Add(-watchSettle)
+	}
+
+	if this.pending == "" || now.Sub(this.pendingAt) < watchSettle {
+		return ""
+	}
+	if this.exhausted {
+		this.pending = ""
+		return ""
+	}
+	if this.inFlight || (!this.lastAnnotation.IsZero() && now.Sub(this.lastAnnotation) < this.options.Interval) {
+		return ""
+	}
+
+	reason := this.pending
+	this.pending = ""
+	this.inFlight = true
+	this.lastAnnotation = now
+	return reason
+}
+
+// Ask the LLM about the recent output and print its note, unless it thinks
+// nothing is wrong
+func (this *outputWatcher) annotate(ctx context.Context, reason string) error {
+	this.mutex.Lock()
+	output := strings.Join(this.lines, "\n")
+	if this.partial != "" {
+		output += "\n" + sanitizeTTYString(this.partial)
+	}
+	this.mutex.Unlock()
+
+	defer func() {
+		this.mutex.Lock()
+		this.inFlight = false
+		this.mutex.Unlock()
+	}()
+
+	butterfish := this.butterfish
+	annotatePrompt, err := butterfish.PromptLibrary.GetPrompt(prompt.PromptWatchAnnotate,
+		"command", this.command,
+		"reason", reason,
+		"output", strings.TrimSpace(output))
+	if err != nil {
+		return err
+	}
+
+	request := &util.CompletionRequest{
+		Ctx:          ctx,
+		Prompt:       annotatePrompt,
+		Model:        this.options.Model,
+		MaxTokens:    watchAnnotationTokens,
+		Temperature:  0.3,
+		Verbose:      butterfish.Config.Verbose > 0,
+		TokenTimeout: butterfish.Config.TokenTimeout,
+	}
+	butterfish.Config.LimitRequest(FeaturePrompt, request)
+
+	tokens := estimateRequestTokens(request) + watchAnnotationTokens
+	this.mutex.Lock()
+	if this.used+tokens > this.options.Budget {
+		this.exhausted = true
+		this.mutex.Unlock()
+		fmt.Fprintf(this.out, "\n%s\n", butterfish.StyleSprintf(butterfish.Config.Styles.Grey,
+			"[butterfish] Used the token budget of %d, no more annotations", this.options.Budget))
+		return nil
+	}
+	this.used += tokens
+	this.mutex.Unlock()
+
+	response, err := butterfish.LLMClient.Completion(request)
+	if err != nil {
+		return err
+	}
+
+	note := strings.TrimSpace(response.Completion)
+	if note == "" || strings.EqualFold(strings.TrimRight(note, "."), "OK") {
+		log.Printf("Watch annotation for %q found nothing wrong", reason)
+		return nil
+	}
+	fmt.Fprintf(this.out, "\n%s\n", butterfish.StyleSprintf(butterfish.Config.Styles.Error,
+		"[butterfish] %s", note))
+	return nil
+}
+
+// Annotate as problems come up until the context is cancelled
+func (this *outputWatcher) run(ctx context.Context) {
+	ticker := time.NewTicker(watchSettle / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reason := this.tick()
+			if reason == "" {
+				continue
+			}
+			go func() {
+				err := this.annotate(ctx, reason)
+				if err != nil && ctx.Err() == nil {
+					log.Printf("Unable to annotate watched output: %s", err)
+				}
+			}()
+		}
+	}
+}
+
+// Run a command in a PTY until it exits, annotating its output
+func (this *ButterfishCtx) WatchCommand(command []string, options *WatchOptions) error {
+	if this.InConsoleMode {
+		return errors.New("watch runs a command in this terminal, it doesn't work in Console Mode")
+	}
+	if len(command) > 0 && command[0] == "--" {
+		command = command[1:]
+	}
+	if len(command) == 0 {
+		return errors.New("No command to watch")
+	}
+
+	ctx, cancel := context.WithCancel(this.Ctx)
+	defer cancel()
+
+	ptmx, cleanup, err := ptyCommand(ctx, nil, command)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	// the terminal is in raw mode, so we need carriage returns
+	out := util.NewReplaceWriter(os.Stdout, "\n", "\r\n")
+	watcher := newOutputWatcher(this, strings.Join(command, " "), options, out)
+	go watcher.run(ctx)
+	go io.Copy(ptmx, os.Stdin)
+
+	// returns once the command exits and the PTY closes
+	io.Copy(io.MultiWriter(os.Stdout, watcher), ptmx)
+	return nil
+}
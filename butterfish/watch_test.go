@@ -0,0 +1,73 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputWatcher(t *testing.T) {
+	llm := &scriptedLLM{responses: []string{"The server can't reach the database.", "OK"}}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &namePromptLibrary{},
+		LLMClient:     llm,
+	}
+	out := new(bytes.Buffer)
+	options := &WatchOptions{Model: "gpt-4o-mini", Budget: 1000, Interval: time.Minute, Stall: 5 * time.Minute, ErrorSpike: 3}
+	watcher := newOutputWatcher(butterfish, "npm run dev", options, out)
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	watcher.now = func() time.Time { return now }
+	watcher.lastOutput = now
+
+	watcher.Write([]byte("listening on :3000\nloading 10%\rloading 100%\n"))
+	assert.Equal(t, "", watcher.tick())
+	assert.Equal(t, []string{"listening on :3000", "loading 100%"}, watcher.lines)
+
+	// two errors aren't a spike, the third is, after letting the rest of the
+	// output arrive
+	watcher.Write([]byte("\x1b[31merror:\x1b[0m connection refused\nError: connection refused\n"))
+	assert.Equal(t, "", watcher.tick())
+	watcher.Write([]byte("ERROR connection refused\n"))
+	assert.Equal(t, "", watcher.tick())
+	now = now.Add(watchSettle)
+	reason := watcher.tick()
+	assert.Equal(t, "it printed 3 error lines within a minute", reason)
+
+	assert.Nil(t, watcher.annotate(context.Background(), reason))
+	assert.Contains(t, llm.requests[0].Prompt, "error: connection refused")
+	assert.Equal(t, "gpt-4o-mini", llm.requests[0].Model)
+	assert.Contains(t, out.String(), "[butterfish] The server can't reach the database.")
+
+	// a stack trace within the interval waits for it to pass
+	watcher.Write([]byte("panic: runtime error: invalid memory address\ngoroutine 1 [running]:\n"))
+	now = now.Add(watchSettle)
+	assert.Equal(t, "", watcher.tick())
+	now = now.Add(time.Minute)
+	reason = watcher.tick()
+	assert.Equal(t, "its output contains a stack trace", reason)
+
+	// nothing is printed when the LLM thinks it's fine
+	out.Reset()
+	assert.Nil(t, watcher.annotate(context.Background(), reason))
+	assert.Equal(t, "", out.String())
+
+	// no output for a while
+	now = now.Add(5 * time.Minute)
+	assert.Equal(t, "it hasn't printed anything for 5m0s", watcher.tick())
+	now = now.Add(5 * time.Minute)
+	assert.Equal(t, "", watcher.tick())
+
+	// once the budget is used up we stop
+	watcher.used = options.Budget
+	assert.Nil(t, watcher.annotate(context.Background(), "it hasn't printed anything for 5m0s"))
+	assert.Contains(t, out.String(), "Used the token budget of 1000")
+	assert.Equal(t, 2, len(llm.requests))
+	watcher.Write([]byte("panic: again\n"))
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, "", watcher.tick())
+}
@@ -0,0 +1,226 @@
+package butterfish
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/bakks/butterfish/proto"
+	"github.com/bakks/butterfish/util"
+)
+
+// The client side of console mode, `butterfish wrap <command>` runs the
+// command in a PTY and connects to a console, see console.go for the protocol.
+
+type WrapOptions struct {
+	// Address of the console
+	Addr string
+	// Token the console was started with, required
+	Token string
+	// Name for the terminal in the console
+	Name string
+	// Connect with TLS, checking the console's certificate against the
+	// system roots, or TLSCA if it's set. Needed for anything other than a
+	// loopback address.
+	TLS   bool
+	TLSCA string
+}
+
+type wrapClient struct {
+	stream    proto.Ibodai_StreamClient
+	sendMutex sync.Mutex
+	// the console's proof that it knows the token, see console.go
+	token string
+	nonce string
+	// where commands from the console are echoed locally
+	local io.Writer
+	// the directory to run commands from the console in
+	dir func() string
+}
+
+func (this *wrapClient) send(message *proto.ClientMessage) error {
+	this.sendMutex.Lock()
+	defer this.sendMutex.Unlock()
+	return this.stream.Send(message)
+}
+
+func (this *wrapClient) hello(token, description string) error {
+	nonce, err := newConsoleNonce()
+	if err != nil {
+		return err
+	}
+	this.token = token
+	this.nonce = nonce
+	return this.send(&proto.ClientMessage{
+		Type:        proto.ClientMessageType_HELLO,
+		ClientToken: nonce + ":" + consoleTokenProof(token, "wrap", nonce),
+		Data:        []byte(description),
+	})
+}
+
+// Wait for the console to prove it knows the token
+func (this *wrapClient) checkConsole() error {
+	proof, err := this.stream.Recv()
+	if err != nil {
+		return err
+	}
+	expected := consoleTokenProof(this.token, "console", this.nonce)
+	if proof.GetId() != "" || !hmac.Equal([]byte(proof.GetCommand()), []byte(expected)) {
+		return errors.New("The console doesn't know the token, not running its commands")
+	}
+	return nil
+}
+
+// Returns a writer that sends output to the console, for the command with the
+// given ID or for the wrapped terminal if the ID is empty
+func (this *wrapClient) outputWriter(commandID string) io.Writer {
+	return &wrapOutputWriter{client: this, commandID: commandID}
+}
+
+type wrapOutputWriter struct {
+	client    *wrapClient
+	commandID string
+}
+
+// Never fails, the wrapped terminal should keep working if the console goes
+// away
+func (this *wrapOutputWriter) Write(p []byte) (int, error) {
+	err := this.client.send(&proto.ClientMessage{
+		Type:      proto.ClientMessageType_OUTPUT,
+		CommandId: this.commandID,
+		Data:      append([]byte{}, p...),
+	})
+	if err != nil {
+		log.Printf("Unable to send output to console: %s", err)
+	}
+	return len(p), nil
+}
+
+// Run commands from the console one at a time until the stream closes
+func (this *wrapClient) handleCommands(ctx context.Context) error {
+	err := this.checkConsole()
+	if err != nil {
+		return err
+	}
+
+	for {
+		command, err := this.stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(this.local, "\n[butterfish console] %s\n", command.GetCommand())
+		out := io.MultiWriter(this.local, this.outputWriter(command.GetId()))
+		result, err := executeCommandIn(ctx, this.dir(), command.GetCommand(), out)
+		exitCode := -1
+		if err != nil {
+			fmt.Fprintf(out, "%s\n", err)
+		} else {
+			exitCode = result.Status
+		}
+
+		err = this.send(&proto.ClientMessage{
+			Type:      proto.ClientMessageType_DONE,
+			CommandId: command.GetId(),
+			ExitCode:  int32(exitCode),
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func wrapCredentials(options *WrapOptions) (credentials.TransportCredentials, error) {
+	if options.TLSCA != "" {
+		return credentials.NewClientTLSFromFile(options.TLSCA, "")
+	}
+	if options.TLS {
+		return credentials.NewTLS(&tls.Config{}), nil
+	}
+	if !isLoopbackAddr(options.Addr) {
+		return nil, fmt.Errorf("Connecting to %s needs TLS, use --tls, or connect through an SSH tunnel to localhost", options.Addr)
+	}
+	return insecure.NewCredentials(), nil
+}
+
+// Run command in a PTY connected to the console at options.Addr, until it
+// exits
+func RunWrap(ctx context.Context, options *WrapOptions, command []string) error {
+	if len(command) > 0 && command[0] == "--" {
+		command = command[1:]
+	}
+	if len(command) == 0 {
+		return errors.New("No command to wrap")
+	}
+	if options.Token == "" {
+		return errors.New("No console token, pass --token or set BUTTERFISH_CONSOLE_TOKEN to the token the console printed")
+	}
+
+	creds, err := wrapCredentials(options)
+	if err != nil {
+		return err
+	}
+	addr := options.Addr
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := proto.NewIbodaiClient(conn).Stream(ctx)
+	if err != nil {
+		return fmt.Errorf("Unable to connect to console at %s: %s", addr, err)
+	}
+
+	description := options.Name
+	if description == "" {
+		hostname, _ := os.Hostname()
+		description = fmt.Sprintf("%s: %s", hostname, strings.Join(command, " "))
+	}
+
+	client := &wrapClient{
+		stream: stream,
+		// the terminal is in raw mode, so we need carriage returns
+		local: util.NewReplaceWriter(os.Stdout, "\n", "\r\n"),
+		dir:   childShellDir,
+	}
+	err = client.hello(options.Token, description)
+	if err != nil {
+		return fmt.Errorf("Unable to connect to console at %s: %s", addr, err)
+	}
+
+	ptmx, cleanup, err := ptyCommand(ctx, []string{"BUTTERFISH_WRAPPED=" + addr}, command)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	go func() {
+		err := client.handleCommands(ctx)
+		// e.g. a wrong token, the command keeps running without the console
+		if err != nil && ctx.Err() == nil {
+			fmt.Fprintf(client.local, "\n[butterfish console] Disconnected: %s\n", status.Convert(err).Message())
+		}
+	}()
+	go io.Copy(ptmx, os.Stdin)
+
+	// returns once the command exits and the PTY closes
+	io.Copy(io.MultiWriter(os.Stdout, client.outputWriter("")), ptmx)
+	stream.CloseSend()
+	return nil
+}
@@ -0,0 +1,420 @@
+// Package client lets other Go programs use Butterfish without the CLI:
+// prompting, summarizing, generating shell commands, editing files, and
+// searching an embeddings index. Every call takes a context and returns its
+// result rather than printing it, nothing is read from stdin, and nothing
+// exits the process.
+//
+// Example:
+//
+//	c, err := client.New(client.Config{APIKey: os.Getenv("OPENAI_API_KEY")})
+//	if err != nil {
+//		return err
+//	}
+//	cmd, err := c.Gencmd(ctx, "list files by size")
+//
+// Goal mode without a shell is butterfish.Agent, and butterfish rpc serves
+// the same operations to programs in other languages.
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/afero"
+
+	bf "github.com/bakks/butterfish/butterfish"
+	"github.com/bakks/butterfish/embedding"
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+const (
+	DefaultModel = "gpt-4o"
+
+	defaultPromptTokens      = 1024
+	defaultPromptTemperature = 0.7
+	defaultEditTokens        = 1024
+	defaultEditTemperature   = 0.7
+	defaultIndexChunkSize    = 512
+	defaultIndexMaxChunks    = 256
+)
+
+type Config struct {
+	// OpenAI API key, or a key for the API at BaseURL, not needed if LLM is
+	// set
+	APIKey string
+	// Base URL of an OpenAI compatible API, e.g. http://localhost:11434/v1,
+	// defaults to OpenAI
+	BaseURL string
+	// Send requests to this LLM rather than the API, e.g. a fake in tests
+	LLM bf.LLM
+	// Model used for every request that doesn't name one, defaults to
+	// DefaultModel
+	Model string
+	// Prompt library file, e.g. ~/.config/butterfish/prompts.yaml to share
+	// the CLI's prompts. The built in prompts are used if this isn't set.
+	PromptLibraryPath string
+}
+
+type Client struct {
+	butterfish *bf.ButterfishCtx
+	model      string
+
+	// the index is created the first time it's used, and isn't safe to use
+	// concurrently
+	indexMutex sync.Mutex
+	index      *embedding.DiskCachedEmbeddingIndex
+}
+
+func New(config Config) (*Client, error) {
+	model := config.Model
+	if model == "" {
+		model = DefaultModel
+	}
+
+	bfConfig := bf.MakeButterfishConfig()
+	bfConfig.DisableColor()
+	bfConfig.OpenAIToken = config.APIKey
+	bfConfig.BaseURL = config.BaseURL
+	bfConfig.LLMClient = config.LLM
+	bfConfig.GencmdModel = model
+	bfConfig.SummarizeModel = model
+
+	if config.PromptLibraryPath == "" {
+		library := prompt.NewPromptLibrary("", false, io.Discard)
+		library.ReplacePrompts(prompt.DefaultPrompts)
+		bfConfig.PromptLibrary = library
+	} else {
+		path, err := homedir.Expand(config.PromptLibraryPath)
+		if err != nil {
+			return nil, err
+		}
+		library, err := bf.NewDiskPromptLibrary(path, false, io.Discard)
+		if err != nil {
+			return nil, err
+		}
+		bfConfig.PromptLibrary = library
+	}
+
+	butterfish, err := bf.NewButterfish(context.Background(), bfConfig)
+	if err != nil {
+		return nil, err
+	}
+	butterfish.Out = io.Discard
+
+	return &Client{butterfish: butterfish, model: model}, nil
+}
+
+// The Butterfish context for a single call
+func (this *Client) with(ctx context.Context) *bf.ButterfishCtx {
+	return this.butterfish.WithContext(ctx, io.Discard)
+}
+
+type PromptRequest struct {
+	Prompt string
+	// Defaults to the prompt library's system message
+	SystemMessage string
+	// Defaults to the client's model
+	Model string
+	// Maximum tokens to generate, defaults to 1024
+	MaxTokens int
+	// Defaults to 0.7, use a negative number for 0
+	Temperature float32
+	// Earlier prompts and answers, oldest first
+	History []util.HistoryBlock
+	// If set the answer is streamed here as it arrives
+	Stream io.Writer
+}
+
+type PromptResult struct {
+	Completion string
+	// The model that answered, which is the requested one unless the request
+	// failed over to a fallback
+	Model string
+	// Timing and token counts, may be nil
+	Metrics *util.CompletionMetrics
+}
+
+// Send a prompt to the LLM
+func (this *Client) Prompt(ctx context.Context, request *PromptRequest) (*PromptResult, error) {
+	if request.Prompt == "" {
+		return nil, errors.New("Please provide a prompt")
+	}
+	model := request.Model
+	if model == "" {
+		model = this.model
+	}
+
+	sysMsg := request.SystemMessage
+	if sysMsg == "" {
+		var err error
+		sysMsg, err = this.butterfish.PromptLibrary.GetPromptForModel(prompt.PromptSystemMessage, model)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	completionRequest := &util.CompletionRequest{
+		Ctx:           ctx,
+		Prompt:        request.Prompt,
+		Model:         model,
+		MaxTokens:     request.MaxTokens,
+		Temperature:   request.Temperature,
+		SystemMessage: sysMsg,
+		HistoryBlocks: request.History,
+	}
+	if completionRequest.MaxTokens <= 0 {
+		completionRequest.MaxTokens = defaultPromptTokens
+	}
+	if completionRequest.Temperature == 0 {
+		completionRequest.Temperature = defaultPromptTemperature
+	} else if completionRequest.Temperature < 0 {
+		completionRequest.Temperature = 0
+	}
+	this.butterfish.Config.LimitRequest(bf.FeaturePrompt, completionRequest)
+
+	var response *util.CompletionResponse
+	var err error
+	if request.Stream != nil {
+		response, err = this.butterfish.LLMClient.CompletionStream(completionRequest, request.Stream)
+	} else {
+		response, err = this.butterfish.LLMClient.Completion(completionRequest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if response.Refusal != "" {
+		return nil, errors.New(response.RefusalMessage())
+	}
+
+	result := &PromptResult{
+		Completion: response.Completion,
+		Model:      response.Model,
+		Metrics:    response.Metrics,
+	}
+	if result.Model == "" {
+		result.Model = model
+	}
+	return result, nil
+}
+
+// Generate a shell command from a description, e.g. "list files by size"
+func (this *Client) Gencmd(ctx context.Context, description string) (string, error) {
+	if description == "" {
+		return "", errors.New("Please provide a description of the command")
+	}
+	cmd, err := this.with(ctx).GenerateCommand(description)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(cmd), nil
+}
+
+type SummarizeRequest struct {
+	// Text to summarize, or set Path instead
+	Content string
+	// File to summarize
+	Path string
+	// Bytes summarized at a time when the text has to be split up, defaults
+	// to 3600
+	ChunkSize int
+	// Maximum number of chunks to summarize, 0 means no limit
+	MaxChunks int
+}
+
+// Summarize text or a file, long ones are split into chunks that are
+// summarized as facts and then merged
+func (this *Client) Summarize(ctx context.Context, request *SummarizeRequest) (string, error) {
+	chunkSize := request.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = bf.DefaultSummarizeChunkSize
+	}
+	maxChunks := bf.UnlimitedChunks(request.MaxChunks)
+
+	var chunks [][]byte
+	var err error
+	switch {
+	case request.Content != "":
+		chunks, err = util.GetChunks(strings.NewReader(request.Content), chunkSize, maxChunks)
+	case request.Path != "":
+		chunks, err = util.GetFileChunks(ctx, afero.NewOsFs(), request.Path, chunkSize, maxChunks)
+	default:
+		return "", errors.New("Provide either content or a path to summarize")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	summary := new(strings.Builder)
+	err = this.with(ctx).WriteSummary(chunks, summary)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(summary.String()), nil
+}
+
+type EditRequest struct {
+	// A file, which doesn't have to exist yet, or a directory to edit any of
+	// the files in it
+	Path string
+	// What to change, e.g. "rename Foo to Bar"
+	Instruction string
+	// Defaults to the client's model
+	Model string
+	// Maximum tokens to generate for each step, defaults to 1024
+	MaxTokens int
+	// Defaults to 0.7
+	Temperature float32
+}
+
+type EditedFile struct {
+	// Relative to the directory edited, or the file's name
+	Path     string
+	Original string
+	Content  string
+}
+
+type EditResult struct {
+	// The files that changed, in the order the model opened them
+	Files []*EditedFile
+
+	session *bf.EditSession
+}
+
+// Ask the LLM to edit a file or the files in a directory. Nothing is written
+// until you call Write on the result.
+func (this *Client) Edit(ctx context.Context, request *EditRequest) (*EditResult, error) {
+	if request.Path == "" || request.Instruction == "" {
+		return nil, errors.New("Please provide a path and an instruction")
+	}
+	path, err := homedir.Expand(request.Path)
+	if err != nil {
+		return nil, err
+	}
+	session, err := bf.NewEditSession(path)
+	if err != nil {
+		return nil, err
+	}
+
+	options := &bf.CliCommandConfig{}
+	options.Edit.Model = request.Model
+	if options.Edit.Model == "" {
+		options.Edit.Model = this.model
+	}
+	options.Edit.NumTokens = request.MaxTokens
+	if options.Edit.NumTokens <= 0 {
+		options.Edit.NumTokens = defaultEditTokens
+	}
+	options.Edit.Temperature = request.Temperature
+	if options.Edit.Temperature == 0 {
+		options.Edit.Temperature = defaultEditTemperature
+	}
+	options.Edit.NoColor = true
+
+	err = this.with(ctx).EditFiles(session, request.Instruction, options)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &EditResult{session: session}
+	for _, path := range session.Changed() {
+		result.Files = append(result.Files, &EditedFile{
+			Path:     path,
+			Original: session.Originals[path],
+			Content:  session.Files[path].String(),
+		})
+	}
+	return result, nil
+}
+
+// Write the edited files, either all of them are written or none are
+func (this *EditResult) Write() error {
+	return this.session.WriteAll()
+}
+
+type SearchResult struct {
+	Path  string
+	Score float64
+	// The matching chunk of the file, and its byte range
+	Content string
+	Start   uint64
+	End     uint64
+}
+
+// The index, created the first time it's needed, the caller must hold
+// indexMutex
+func (this *Client) embeddingIndex() (*embedding.DiskCachedEmbeddingIndex, error) {
+	if this.index != nil {
+		return this.index, nil
+	}
+	index, err := this.butterfish.NewEmbeddingIndex(io.Discard)
+	if err != nil {
+		return nil, err
+	}
+	this.index = index
+	return index, nil
+}
+
+// Embed the files under paths. Embeddings are cached in a .butterfish_index
+// file in each directory, like butterfish index, and files that haven't
+// changed are skipped unless force is set.
+func (this *Client) Index(ctx context.Context, paths []string, force bool) error {
+	if len(paths) == 0 {
+		return errors.New("Please provide paths to index")
+	}
+	this.indexMutex.Lock()
+	defer this.indexMutex.Unlock()
+
+	index, err := this.embeddingIndex()
+	if err != nil {
+		return err
+	}
+	return index.IndexPaths(ctx, paths, force, defaultIndexChunkSize, defaultIndexMaxChunks)
+}
+
+// Search the indexed files under paths for the chunks closest to query
+func (this *Client) Search(ctx context.Context, paths []string, query string, numResults int) ([]*SearchResult, error) {
+	if len(paths) == 0 || query == "" {
+		return nil, errors.New("Please provide paths and a query")
+	}
+	if numResults <= 0 {
+		numResults = 5
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+	}
+	this.indexMutex.Lock()
+	defer this.indexMutex.Unlock()
+
+	index, err := this.embeddingIndex()
+	if err != nil {
+		return nil, err
+	}
+	err = index.LoadPaths(ctx, paths)
+	if err != nil {
+		return nil, err
+	}
+	results, err := index.Search(ctx, query, numResults)
+	if err != nil {
+		return nil, err
+	}
+
+	output := []*SearchResult{}
+	for _, result := range results {
+		output = append(output, &SearchResult{
+			Path:    result.FilePath,
+			Score:   result.Score,
+			Content: result.Content,
+			Start:   result.Start,
+			End:     result.End,
+		})
+	}
+	return output, nil
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Answers with each of responses in turn
+type scriptedLLM struct {
+	mutex     sync.Mutex
+	responses []*util.CompletionResponse
+	requests  []*util.CompletionRequest
+}
+
+func (this *scriptedLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	response, err := this.Completion(request)
+	writer.Write([]byte(response.Completion))
+	return response, err
+}
+
+func (this *scriptedLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.requests = append(this.requests, request)
+	response := this.responses[0]
+	this.responses = this.responses[1:]
+	return response, nil
+}
+
+func (this *scriptedLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	return nil, nil
+}
+
+func TestClient(t *testing.T) {
+	llm := &scriptedLLM{responses: []*util.CompletionResponse{
+		{Completion: "The unix shell is a command interpreter."},
+		{Completion: "  ls -lS\n"},
+		{Completion: "A short summary."},
+	}}
+	client, err := New(Config{LLM: llm, Model: "gpt-4o-mini"})
+	assert.Nil(t, err)
+	ctx := context.Background()
+
+	stream := new(bytes.Buffer)
+	result, err := client.Prompt(ctx, &PromptRequest{Prompt: "What is the unix shell?", Stream: stream})
+	assert.Nil(t, err)
+	assert.Equal(t, "The unix shell is a command interpreter.", result.Completion)
+	assert.Equal(t, "gpt-4o-mini", result.Model)
+	assert.Equal(t, result.Completion, stream.String())
+	request := llm.requests[0]
+	assert.Equal(t, float32(0.7), request.Temperature)
+	assert.Equal(t, 1024, request.MaxTokens)
+	assert.NotEqual(t, "", request.SystemMessage)
+
+	cmd, err := client.Gencmd(ctx, "list files by size")
+	assert.Nil(t, err)
+	assert.Equal(t, "ls -lS", cmd)
+	assert.Equal(t, "gpt-4o-mini", llm.requests[1].Model)
+	assert.Contains(t, llm.requests[1].Prompt, "list files by size")
+
+	summary, err := client.Summarize(ctx, &SummarizeRequest{Content: "Butterfish is a shell with AI superpowers."})
+	assert.Nil(t, err)
+	assert.Equal(t, "A short summary.", summary)
+
+	_, err = client.Summarize(ctx, &SummarizeRequest{})
+	assert.EqualError(t, err, "Provide either content or a path to summarize")
+}
+
+func TestClientEdit(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	assert.Nil(t, os.WriteFile(path, []byte("func Foo() {}\n"), 0644))
+
+	llm := &scriptedLLM{responses: []*util.CompletionResponse{
+		{ToolCalls: []*util.ToolCall{{Id: "1", Function: util.FunctionCall{
+			Name:       "edit",
+			Parameters: `{"range_start": 1, "range_end": 2, "code_edit": "func Bar() {}"}`,
+		}}}},
+		{Completion: "DONE!"},
+	}}
+	client, err := New(Config{LLM: llm})
+	assert.Nil(t, err)
+
+	result, err := client.Edit(context.Background(), &EditRequest{Path: path, Instruction: "rename Foo to Bar"})
+	assert.Nil(t, err)
+	assert.Equal(t, []*EditedFile{{Path: "main.go", Original: "func Foo() {}\n", Content: "func Bar() {}\n"}}, result.Files)
+	assert.Equal(t, DefaultModel, llm.requests[0].Model)
+
+	// nothing is written until Write
+	content, _ := os.ReadFile(path)
+	assert.Equal(t, "func Foo() {}\n", string(content))
+	assert.Nil(t, result.Write())
+	content, _ = os.ReadFile(path)
+	assert.Equal(t, "func Bar() {}\n", string(content))
+}
@@ -12,11 +12,12 @@ import (
 
 	"github.com/alecthomas/kong"
 	"github.com/joho/godotenv"
-	"github.com/mitchellh/go-homedir"
+	"golang.org/x/term"
 
 	//_ "net/http/pprof"
 
 	bf "github.com/bakks/butterfish/butterfish"
+	"github.com/bakks/butterfish/embedding"
 	"github.com/bakks/butterfish/util"
 )
 
@@ -30,15 +31,13 @@ const description = `Do useful things with LLMs from the command line, with a be
 
 Butterfish is a command line tool for working with LLMs. It has two modes: CLI command mode, used to prompt LLMs, summarize files, and manage embeddings, and Shell mode: Wraps your local shell to provide easy prompting and autocomplete.
 
-Butterfish looks for an API key in OPENAI_API_KEY, or alternatively stores an OpenAI auth token at ~/.config/butterfish/butterfish.env.
+Butterfish looks for an API key in OPENAI_API_KEY, or alternatively stores an OpenAI auth token in the OS keychain or at ~/.config/butterfish/butterfish.env, see "butterfish auth --help".
 
-Prompts are stored in ~/.config/butterfish/prompts.yaml. Butterfish logs to the system temp dir, usually to /var/tmp/butterfish.log. To print the full prompts and responses from the OpenAI API, use the --verbose flag. Support can be found at https://github.com/bakks/butterfish.
+Prompts are stored in ~/.config/butterfish/prompts.yaml. Named profiles (API keys, base URLs, models, token budgets) can be defined in ~/.config/butterfish/config.yaml and selected with --profile. Butterfish follows the XDG base directory spec, logs and usage counts go to ~/.local/state/butterfish, run "butterfish paths" to see where everything lives. To print the full prompts and responses from the OpenAI API, use the --verbose flag. Support can be found at https://github.com/bakks/butterfish.
 
 If you do not have OpenAI free credits then you will need a subscription and you will need to pay for OpenAI API use. If you're using Shell Mode, autosuggest will probably be the most expensive part. You can reduce spend by disabling shell autosuggest (-A) or increasing the autosuggest timeout (e.g. -t 2000). See "butterfish shell --help".
 `
 const license = "MIT License - Copyright (c) 2023 Peter Bakkum"
-const defaultEnvPath = "~/.config/butterfish/butterfish.env"
-const defaultPromptPath = "~/.config/butterfish/prompts.yaml"
 
 const shell_help = `Start the Butterfish shell wrapper. This wraps your existing shell, giving you access to LLM prompting by starting your command with a capital letter. LLM calls include prior shell context. This is great for keeping a chat-like terminal open, sending written prompts, debugging commands, and iterating on past actions.
 
@@ -46,14 +45,25 @@ Use:
   - Type a normal command, like 'ls -l' and press enter to execute it
   - Start a command with a capital letter to send it to GPT, like 'How do I recursively find local .py files?'
   - Autosuggest will print command completions, press tab to fill them in
+  - While typing a command, press ctrl-x ctrl-b and type an instruction like 'make it recursive' to have GPT rewrite the command without running it
   - GPT will be able to see your shell history, so you can ask contextual questions like 'why didnt my last command work?'
 	- Start a command with ! to enter Goal Mode, in which GPT will act as an Agent attempting to accomplish your goal by executing commands, for example '!Run make in this directory and debug any problems'.
 	- Start a command with !! to enter Unsafe Goal Mode, in which GPT will execute commands without confirmation. USE WITH CAUTION.
+	- With --auto-debug, a command that exits with a non-zero status gets a short automatic diagnosis.
 
 Here are special Butterfish commands:
   - Help : Give hints about usage.
   - Status : Show the current Butterfish configuration.
+  - Stats : Show request latency, retries, and tokens for this session.
   - History : Print out the history that would be sent in a GPT prompt.
+  - History export [path] : Save the session as a markdown transcript or JSON.
+  - Profile <name> : Switch to a profile defined in ~/.config/butterfish/config.yaml.
+  - Model <name> : Switch the prompting model without restarting, e.g. 'Model gpt-4o'.
+  - Temp <value> : Set the prompting temperature for this session, e.g. 'Temp 0.2'.
+  - System: <text> : Replace the prompting system message for this session, 'System: default' restores it.
+  - Persona <name> : Switch to a persona from config.yaml, 'Persona default' goes back.
+  - Context tmux [pane] : Add the scrollback of a tmux pane to the history, defaults to the current pane.
+  - Find: <query> : Search past commands by meaning, e.g. 'Find: the curl that posted to the api'.
 
 If you do not have OpenAI free credits then you will need a subscription and you will need to pay for OpenAI API use. Autosuggest will probably be the most expensive feature. You can reduce spend by disabling shell autosuggest (-A) or increasing the autosuggest timeout (e.g. -t 2000).`
 
@@ -73,51 +83,121 @@ func (v *VerboseFlag) BeforeResolve() error {
 // Kong will parse os.Args based on this struct.
 type CliConfig struct {
 	Verbose      VerboseFlag      `short:"v" default:"false" help:"Verbose mode, prints full LLM prompts (sometimes to log file). Use multiple times for more verbosity, e.g. -vv."`
-	Log          bool             `short:"L" default:"false" help:"Write verbose content to a log file rather than stdout, usually /var/tmp/butterfish.log"`
+	Log          bool             `short:"L" default:"false" help:"Write verbose content to a log file rather than stdout, usually ~/.local/state/butterfish/butterfish.log"`
+	LogFormat    string           `default:"boxes" enum:"boxes,jsonl" help:"Format for logging LLM requests: boxes are printed with -v for reading, jsonl writes a JSON record for every request to the log file."`
 	Version      kong.VersionFlag `short:"V" help:"Print version information and exit."`
 	BaseURL      string           `short:"u" default:"https://api.openai.com/v1" help:"Base URL for OpenAI-compatible API. Enables local models with a compatible interface."`
 	TokenTimeout int              `short:"z" default:"10000" help:"Timeout before first prompt token is received and between individual tokens. In milliseconds."`
 	LightColor   bool             `short:"l" default:"false" help:"Light color mode, appropriate for a terminal with a white(ish) background"`
+	Theme        string           `env:"BUTTERFISH_THEME" help:"Syntax highlighting theme for code blocks, any chroma style like dracula or github, or none. Defaults to theme in config.yaml, then monokai, or monokailight with --light-color."`
+	Profile      string           `env:"BUTTERFISH_PROFILE" help:"Named profile from ~/.config/butterfish/config.yaml, overrides default_profile."`
+	Persona      string           `env:"BUTTERFISH_PERSONA" help:"Named persona from the personas section of ~/.config/butterfish/config.yaml, a system message with an optional model and temperature, for prompt and shell."`
+
+	EmbeddingBackend string `default:"" enum:",openai,ollama,command" help:"Embeddings backend for the index commands: openai, ollama, or command (an external program). Backends other than openai don't need an API key. Overrides embedding_backend in the profile, defaults to openai."`
+	EmbeddingModel   string `default:"" help:"Embedding model for the ollama backend, defaults to nomic-embed-text."`
+	EmbeddingURL     string `default:"http://localhost:11434" help:"Ollama server URL for the ollama embeddings backend."`
+	EmbeddingCommand string `default:"" help:"Command for the command embeddings backend. It gets {\"input\": [...]} as JSON on stdin and must print {\"embeddings\": [[...], ...]} on stdout."`
+	IndexFormat      string `default:"f16" enum:"f16,int8,protobuf" help:"Format for writing .butterfish_index files: f16 or int8 quantize vectors and are memory-mapped when loaded, protobuf is the original full precision format. Any format can be loaded."`
+	ExactSearch      bool   `default:"false" help:"Search the index by comparing against every chunk. By default indexes with 20000 or more chunks are searched with an approximate nearest neighbor graph built on the first search."`
+
+	MaxFixAttempts int           `default:"5" help:"Stop fixing a command in exec, or stop goal mode, after this many failed commands in a row. 0 means no limit."`
+	MaxSteps       int           `default:"30" help:"Commands goal mode can run for a goal before the agent has to ask you or finish. 0 means no limit."`
+	MaxTime        time.Duration `default:"30m" help:"Time goal mode can spend on a goal before the agent has to ask you or finish. 0 means no limit."`
+	MaxGoalTokens  int           `default:"0" help:"Estimated tokens goal mode can send and receive for a goal before the agent has to ask you or finish. 0 means no limit."`
+	MaxSubagents   int           `default:"3" help:"Sub-agents butterfish agent can run at once for subtasks it hands off. 0 means it can't hand off subtasks."`
+	CostThreshold  float64       `default:"0.5" help:"Ask for confirmation before index, summarize, or goal mode send more than this many dollars of input, based on an estimate. 0 means never ask."`
+
+	NoCache  bool          `default:"false" help:"Don't answer from or write to the response cache. Outside of the shell, responses to requests with a temperature of 0 are cached on disk, usually in ~/.cache/butterfish/responses."`
+	CacheTTL time.Duration `default:"24h" help:"How long a cached response is used for, e.g. 1h or 168h. 0 means forever."`
+
+	LLM      string `name:"llm" env:"BUTTERFISH_LLM" default:"live" enum:"live,record,replay" help:"Where responses come from: live calls the API, record calls the API and appends every request and response to the fixtures file, replay answers from the fixtures file without an API key or network."`
+	Fixtures string `env:"BUTTERFISH_FIXTURES" default:"butterfish_fixtures.jsonl" help:"Fixtures file for --llm=record and --llm=replay."`
 
 	Shell struct {
-		Bin                       string `short:"b" help:"Shell to use (e.g. /bin/zsh), defaults to $SHELL."`
-		Model                     string `short:"m" default:"gpt-4o" help:"Model for when the user manually enters a prompt."`
-		AutosuggestDisabled       bool   `short:"A" default:"false" help:"Disable autosuggest."`
-		AutosuggestModel          string `short:"a" default:"gpt-3.5-turbo-instruct" help:"Model for autosuggest"`
-		AutosuggestTimeout        int    `short:"t" default:"500" help:"Delay after typing before autosuggest (lower values trigger more calls and are more expensive). In milliseconds."`
-		NewlineAutosuggestTimeout int    `short:"T" default:"3500" help:"Timeout for autosuggest on a fresh line, i.e. before a command has started. Negative values disable. In milliseconds."`
-		NoCommandPrompt           bool   `short:"p" default:"false" help:"Don't change command prompt (shell PS1 variable). If not set, an emoji will be added to the prompt as a reminder you're in Shell Mode."`
-		MaxPromptTokens           int    `short:"P" default:"16384" help:"Maximum number of tokens, we restrict calls to this size regardless of model capabilities."`
-		MaxHistoryBlockTokens     int    `short:"H" default:"1024" help:"Maximum number of tokens of each block of history. For example, if a command has a very long output, it will be truncated to this length when sending the shell's history."`
-		MaxResponseTokens         int    `short:"R" default:"2048" help:"Maximum number of tokens in a response when prompting."`
+		Bin                       string   `short:"b" help:"Shell to use (e.g. /bin/zsh), defaults to $SHELL."`
+		Model                     string   `short:"m" default:"gpt-4o" help:"Model for when the user manually enters a prompt."`
+		AutosuggestDisabled       bool     `short:"A" default:"false" help:"Disable autosuggest."`
+		AutosuggestModel          string   `short:"a" default:"gpt-3.5-turbo-instruct" help:"Model for autosuggest"`
+		AutosuggestTimeout        int      `short:"t" default:"500" help:"Delay after typing before autosuggest (lower values trigger more calls and are more expensive). In milliseconds."`
+		NewlineAutosuggestTimeout int      `short:"T" default:"3500" help:"Timeout for autosuggest on a fresh line, i.e. before a command has started. Negative values disable. In milliseconds."`
+		NoCommandPrompt           bool     `short:"p" default:"false" help:"Don't change command prompt (shell PS1 variable). If not set, an emoji will be added to the prompt as a reminder you're in Shell Mode."`
+		MaxPromptTokens           int      `short:"P" default:"16384" help:"Maximum number of tokens, we restrict calls to this size regardless of model capabilities."`
+		MaxHistoryBlockTokens     int      `short:"H" default:"0" help:"Maximum number of tokens of each block of history. For example, if a command has a very long output, it will be truncated to this length when sending the shell's history. 0 picks a size from the model's context window."`
+		MaxResponseTokens         int      `short:"R" default:"0" help:"Maximum number of tokens in a response when prompting. 0 picks a size from the model's context window."`
+		AutoDebug                 bool     `default:"false" help:"When a command exits with a non-zero status, automatically ask the LLM for a short diagnosis."`
+		AutoDebugInterval         int      `default:"30000" help:"Minimum time between automatic diagnoses, to avoid spamming on repeated failures. In milliseconds."`
+		BackgroundAnswers         bool     `default:"false" help:"Give the shell back as soon as a prompt is sent, so you can keep typing and running commands, and print the answer at the next prompt once it's finished."`
+		Pager                     bool     `default:"false" help:"Open answers taller than the terminal in $PAGER, or less -R, once they've finished streaming. Type 'Page' in the shell to page the last answer at any time."`
+		Resume                    string   `help:"Start with the history of a session exported as JSON, e.g. with 'History export session.json', to continue an earlier conversation. The most recent blocks that fit in half of the prompt's token budget are loaded."`
+		IndexContext              bool     `default:"false" help:"When a prompt asks a question, search the index for the shell's current directory and give the best snippets to the LLM as context. Run butterfish index in the directory first."`
+		IndexContextTokens        int      `default:"1024" help:"Maximum number of tokens of index snippets to add with --index-context."`
+		Tmux                      bool     `default:"false" help:"When running inside tmux, add the pane's scrollback to the history when the shell starts, so prompts can refer to earlier output. Type 'Context tmux [pane]' in the shell to add a pane's scrollback at any time."`
+		SessionEnv                []string `help:"Extra env var names to record in the session transcript, glob patterns allowed, e.g. --session-env 'AWS_REGION,MY_APP_*'. Names that look like credentials are never recorded."`
+		InlineEditKey             string   `default:"ctrl-x ctrl-b" help:"Key sequence that rewrites the command you're typing with an instruction, e.g. 'make it recursive', without running it. Use keys like ctrl-x or alt-e separated by spaces, or 'none' to disable."`
+		ViMode                    string   `default:"auto" enum:"auto,on,off" help:"Whether the shell's line editor is in vi mode, e.g. with set -o vi or bindkey -v, so that command tracking follows normal mode edits. auto looks for vi mode in your shell's config files."`
+		Notify                    string   `help:"Command to run when an answer or goal takes longer than --notify-after and the terminal isn't focused, e.g. 'notify-send Butterfish {message}'. {message} and {event} are replaced with quoted values. Use 'bell' to ring the terminal bell. Defaults to notify_command in config.yaml."`
+		NotifyAfter               int      `default:"10000" help:"How long an answer or goal has to take before --notify runs. In milliseconds."`
+		NoColor                   bool     `default:"false" help:"Disable color output, same as setting NO_COLOR."`
+		PromptPrefix              string   `help:"Start prompts with this prefix, e.g. ':', rather than a capital letter, so commands like Rscript go to the shell. Defaults to prompt_prefix in config.yaml."`
+		Exclude                   []string `help:"Extra command patterns to keep out of the history, along with their output, e.g. --exclude 'op *,aws sts *'. Patterns in exclude_commands in config.yaml are added too. gpg, pass, vault, and anything mentioning a password are always excluded."`
 	} `cmd:"" help:"${shell_help}"`
 
+	Console struct {
+		Addr    string `default:"127.0.0.1:7642" help:"Address to listen on for wrapped terminals. Anything other than localhost needs --tls-cert and --tls-key."`
+		Token   string `env:"BUTTERFISH_CONSOLE_TOKEN" help:"Token wrapped terminals must know to connect. A random one is generated and printed if not set."`
+		TLSCert string `name:"tls-cert" help:"Certificate file to serve TLS with."`
+		TLSKey  string `name:"tls-key" help:"Private key file for --tls-cert."`
+	} `cmd:"" help:"Start an interactive console for Butterfish commands that terminals started with butterfish wrap can connect to. From the console, terminals lists them and their output, and execremote runs a command in one and helps debug it."`
+
+	Wrap struct {
+		Command []string `arg:"" passthrough:"" help:"Command to wrap, e.g. bash or ssh myhost."`
+		Addr    string   `default:"127.0.0.1:7642" help:"Address of the console to connect to. Anything other than localhost needs --tls."`
+		Token   string   `env:"BUTTERFISH_CONSOLE_TOKEN" help:"Token the console was started with or printed, required. Commands from the console only run once it has proven it knows the token."`
+		Name    string   `default:"" help:"Name for the terminal in the console, defaults to the host name and command."`
+		TLS     bool     `name:"tls" help:"Connect to the console with TLS."`
+		TLSCA   string   `name:"tls-ca" help:"CA certificate to check the console's certificate against, instead of the system roots. Implies --tls."`
+	} `cmd:"" help:"Wrap a command, usually a shell, and connect it to a running butterfish console, which can then see its output and run commands in it with execremote."`
+
 	// We include the cliConsole options here so that we can parse them and hand them
 	// to the console executor, even though we're in the shell context here
 	bf.CliCommandConfig
 }
 
-func getOpenAIToken() string {
-	path, err := homedir.Expand(defaultEnvPath)
-	if err != nil {
-		log.Fatal(err)
-	}
+// Find the default API token, the store it came from, and a description of
+// where it came from, prompting for one if there's none. This is the token
+// for profiles that don't carry their own, the profile's token is applied on
+// top by ApplyProfile so that switching to another profile doesn't keep it.
+func getOpenAIToken(paths *util.Paths, profile *bf.Profile, store bf.TokenStore, stores []bf.TokenStore) (string, bf.TokenStore, string) {
+	// variables from the env file don't override ones that are already set
+	inEnv := os.Getenv("OPENAI_TOKEN") != ""
+
+	// Profiles can read their token from variables in the env file
+	godotenv.Load(paths.EnvFile())
 
-	// We attempt to get a token from env vars plus an env file
-	godotenv.Load(path)
+	if inEnv {
+		return os.Getenv("OPENAI_TOKEN"), nil, "the OPENAI_TOKEN env var"
+	}
 
-	token := os.Getenv("OPENAI_TOKEN")
+	token, found, err := bf.LookupToken(stores, bf.DefaultTokenProvider)
+	if err != nil && err != bf.ErrTokenNotFound {
+		fmt.Fprintf(os.Stderr, "Error reading token: %s\n", err)
+	}
 	if token != "" {
-		return token
+		return token, found, found.Describe(bf.DefaultTokenProvider)
 	}
 
 	token = os.Getenv("OPENAI_API_KEY")
 	if token != "" {
-		return token
+		return token, nil, "the OPENAI_API_KEY env var"
+	}
+
+	// A profile that carries its own token doesn't need the default one
+	if profile.Token() != "" {
+		return "", nil, ""
 	}
 
 	// If we don't have a token, we'll prompt the user to create one
-	fmt.Printf("Butterfish requires an OpenAI API key, please visit https://beta.openai.com/account/api-keys to create one and paste it below (it should start with sk-):\n")
+	fmt.Printf("Butterfish requires an OpenAI API key, please visit %s to create one and paste it below (it should start with sk-):\n", bf.APIKeysURL)
 
 	// read in the token and validate
 	fmt.Scanln(&token)
@@ -129,42 +209,170 @@ func getOpenAIToken() string {
 		log.Fatal("Invalid token provided, exiting")
 	}
 
-	// attempt to write a .env file
-	fmt.Printf("\nSaving token to %s\n", path)
-	err = os.MkdirAll(filepath.Dir(path), 0755)
+	// fall back to the env file if the keychain doesn't work, e.g. it's
+	// locked with no way to unlock it over ssh
+	fmt.Printf("\nSaving token to %s\n", store.Describe(bf.DefaultTokenProvider))
+	err = store.Set(bf.DefaultTokenProvider, token)
+	if err != nil && stores[len(stores)-1] != store {
+		fmt.Printf("Error saving token: %s\n", err.Error())
+		store = stores[len(stores)-1]
+		fmt.Printf("Saving token to %s\n", store.Describe(bf.DefaultTokenProvider))
+		err = store.Set(bf.DefaultTokenProvider, token)
+	}
+	if err != nil {
+		fmt.Printf("Error saving token: %s\n", err.Error())
+		return token, nil, ""
+	}
+
+	fmt.Printf("Token saved, you can change it at any time with butterfish auth set %s\n\n", bf.DefaultTokenProvider)
+
+	return token, store, store.Describe(bf.DefaultTokenProvider)
+}
+
+// After the API rejected the key, offer to save a new one to the token store
+// if that's where the key came from
+func offerNewKey(config *bf.ButterfishConfig) {
+	if !config.CanSaveKey() || !term.IsTerminal(int(os.Stdin.Fd())) {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "Paste a new API key to save it to %s, or press enter to skip: ",
+		config.TokenStore.Describe(bf.DefaultTokenProvider))
+	var key string
+	fmt.Scanln(&key)
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return
+	}
+
+	err := config.TokenStore.Set(bf.DefaultTokenProvider, key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving key: %s\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Saved the new key, run the command again to use it\n")
+}
+
+func loadProfile(paths *util.Paths, options *CliConfig) (*bf.ConfigFile, *bf.Profile) {
+	configFile, err := bf.LoadConfigFile(paths.ConfigFile())
 	if err != nil {
-		fmt.Printf("Error creating directory: %s\n", err.Error())
-		return token
+		log.Fatal(err)
 	}
 
-	envFile, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	profile, err := configFile.GetProfile(options.Profile)
 	if err != nil {
-		fmt.Printf("Error creating file: %s\n", err.Error())
-		return token
+		log.Fatal(err)
 	}
-	defer envFile.Close()
 
-	content := fmt.Sprintf("OPENAI_TOKEN=%s\n", token)
-	_, err = envFile.WriteString(content)
+	return configFile, profile
+}
+
+// The store to save tokens in and the stores to read them from, see
+// token_store in config.yaml
+func loadTokenStores(paths *util.Paths, configFile *bf.ConfigFile) (bf.TokenStore, []bf.TokenStore) {
+	store, stores, err := bf.NewTokenStores(configFile.TokenStore, paths.EnvFile())
 	if err != nil {
-		fmt.Printf("Error writing file: %s\n", err.Error())
+		log.Fatal(err)
 	}
+	return store, stores
+}
 
-	fmt.Printf("Token saved, you can edit it at any time at %s\n\n", path)
+// Index commands only call the embeddings API, so they can run without an
+// OpenAI key when using a local embeddings backend
+var embeddingOnlyCommands = map[string]bool{
+	"index":                true,
+	"index <paths>":        true,
+	"indexsearch <query>":  true,
+	"clearindex":           true,
+	"clearindex <paths>":   true,
+	"loadindex":            true,
+	"loadindex <paths>":    true,
+	"showindex":            true,
+	"showindex <paths>":    true,
+	"migrateindex":         true,
+	"migrateindex <paths>": true,
+	"indexstats":           true,
+	"indexstats <paths>":   true,
+}
 
-	return token
+// Commands that don't call an API at all
+var localCommands = map[string]bool{
+	"tokens":         true,
+	"tokens <files>": true,
+	"paths":          true,
 }
 
-func makeButterfishConfig(options *CliConfig) *bf.ButterfishConfig {
+func makeButterfishConfig(command string, options *CliConfig, paths *util.Paths, configFile *bf.ConfigFile, profile *bf.Profile) *bf.ButterfishConfig {
 	config := bf.MakeButterfishConfig()
-	config.OpenAIToken = getOpenAIToken()
+	config.EmbeddingBackend = options.EmbeddingBackend
+	config.EmbeddingModel = options.EmbeddingModel
+	config.EmbeddingURL = options.EmbeddingURL
+	config.EmbeddingCommand = options.EmbeddingCommand
+	config.IndexFormat = options.IndexFormat
+	config.ExactSearch = options.ExactSearch
+
+	// the profile is applied later, but its backend decides whether we need a
+	// token
+	backend := &bf.ButterfishConfig{EmbeddingBackend: options.EmbeddingBackend}
+	backend.ApplyProfile(profile)
+
+	config.NoLLM = localCommands[command]
+	if localCommands[command] || options.LLM == bf.LLMModeReplay ||
+		embeddingOnlyCommands[command] && !backend.EmbeddingNeedsToken() {
+		// still load the env file in case the profile reads its token from it
+		godotenv.Load(paths.EnvFile())
+	} else {
+		store, stores := loadTokenStores(paths, configFile)
+		config.OpenAIToken, config.TokenStore, config.OpenAITokenSource = getOpenAIToken(paths, profile, store, stores)
+	}
 	config.BaseURL = options.BaseURL
-	config.PromptLibraryPath = defaultPromptPath
+	config.PromptLibraryPath = paths.PromptFile()
 	config.TokenTimeout = time.Duration(options.TokenTimeout) * time.Millisecond
+	config.ConfigFile = configFile
+	config.ApplyRequestLimits(configFile.RequestLimits)
+	config.ApplyRetryPolicy(configFile.RetryPolicy)
+	if configFile.Middleware != nil {
+		config.Middleware = configFile.Middleware
+	}
+	bf.RegisterContextWindows(configFile.ContextWindows)
+	bf.RegisterModels(configFile.Models)
+	config.ShellExcludeCommands = configFile.ExcludeCommands
+	config.SystemInfo = configFile.SystemInfo
+	config.StateBaseDir = paths.StateDir
+	if configFile.IndexStore == embedding.IndexStoreCentral {
+		config.IndexStoreDir = paths.IndexStoreDir()
+	}
 
 	if options.Verbose {
 		config.Verbose = verboseCount
 	}
+	config.LogFormat = options.LogFormat
+	config.MaxFixAttempts = options.MaxFixAttempts
+	config.GoalLimits = bf.GoalLimits{
+		MaxCommands: options.MaxSteps,
+		MaxTime:     options.MaxTime,
+		MaxTokens:   options.MaxGoalTokens,
+	}
+	config.MaxSubagents = options.MaxSubagents
+	config.CostThreshold = options.CostThreshold
+	if !options.NoCache {
+		config.ResponseCacheDir = filepath.Join(paths.CacheDir, "responses")
+	}
+	config.ResponseCacheTTL = options.CacheTTL
+	config.LLMMode = options.LLM
+	config.LLMFixtures = options.Fixtures
+	config.SummarizeConcurrency = options.Summarize.Concurrency
+
+	config.ColorDark = !options.LightColor
+	config.Theme = configFile.Theme
+	if options.Theme != "" {
+		config.Theme = options.Theme
+	}
+	// https://no-color.org, any value turns color off
+	if os.Getenv("NO_COLOR") != "" || configFile.NoColor ||
+		command == "shell" && options.Shell.NoColor {
+		config.DisableColor()
+	}
 
 	return config
 }
@@ -199,9 +407,85 @@ func main() {
 
 	parsedCmd, err := cliParser.Parse(os.Args[1:])
 	cliParser.FatalIfErrorf(err)
+	cliParser.FatalIfErrorf(util.ValidateTheme(cli.Theme))
+
+	paths, err := util.GetPaths()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	config := makeButterfishConfig(cli)
+	// Move files from before we followed the XDG base directory spec
+	moved, err := paths.Migrate()
+	for _, m := range moved {
+		fmt.Fprintf(os.Stderr, "Moved %s\n", m)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+	}
+
+	// These don't need a token so we handle them before creating the config
+	if strings.HasPrefix(parsedCmd.Command(), "prompts ") {
+		err := bf.RunPromptsCommand(os.Stdout, paths.PromptFile(), parsedCmd.Command(), &cli.CliCommandConfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(4)
+		}
+		return
+	}
+	if strings.HasPrefix(parsedCmd.Command(), "history ") {
+		err := bf.RunHistoryCommand(context.Background(), os.Stdout, paths.StateDir, parsedCmd.Command(), &cli.CliCommandConfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(4)
+		}
+		return
+	}
+
+	if parsedCmd.Command() == "wrap <command>" {
+		util.InitLogging(context.Background())
+		err := bf.RunWrap(context.Background(), &bf.WrapOptions{
+			Addr:  cli.Wrap.Addr,
+			Token: cli.Wrap.Token,
+			Name:  cli.Wrap.Name,
+			TLS:   cli.Wrap.TLS,
+			TLSCA: cli.Wrap.TLSCA,
+		}, cli.Wrap.Command)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(4)
+		}
+		return
+	}
+
+	configFile, profile := loadProfile(paths, cli)
+
+	if strings.HasPrefix(parsedCmd.Command(), "sessions ") {
+		err := bf.RunSessionsCommand(os.Stdout, bf.ProfileStateDir(paths.StateDir, profile.Name),
+			parsedCmd.Command(), &cli.CliCommandConfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(4)
+		}
+		return
+	}
+
+	if strings.HasPrefix(parsedCmd.Command(), "auth ") {
+		store, stores := loadTokenStores(paths, configFile)
+		err := bf.RunAuthCommand(os.Stdin, os.Stdout, store, stores, parsedCmd.Command(), &cli.CliCommandConfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(4)
+		}
+		return
+	}
+
+	config := makeButterfishConfig(parsedCmd.Command(), cli, paths, configFile, profile)
 	config.BuildInfo = getBuildInfo()
+	persona, err := configFile.GetPersona(cli.Persona)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.Persona = persona
 	ctx := context.Background()
 
 	errorWriter := util.NewStyledWriter(os.Stderr, config.Styles.Error)
@@ -226,25 +510,93 @@ func main() {
 			os.Exit(7)
 		}
 
+		inlineEditKey, err := bf.ParseKeySequence(cli.Shell.InlineEditKey)
+		if err != nil {
+			fmt.Fprintf(errorWriter, "Invalid --inline-edit-key: %s\n", err)
+			os.Exit(7)
+		}
+
+		promptPrefix := configFile.PromptPrefix
+		if cli.Shell.PromptPrefix != "" {
+			promptPrefix = cli.Shell.PromptPrefix
+		}
+		if err := bf.ValidatePromptPrefix(promptPrefix); err != nil {
+			fmt.Fprintf(errorWriter, "%s\n", err)
+			os.Exit(7)
+		}
+
 		config.ShellBinary = shell
 		config.ShellPromptModel = cli.Shell.Model
 		config.ShellAutosuggestEnabled = !cli.Shell.AutosuggestDisabled
 		config.ShellAutosuggestModel = cli.Shell.AutosuggestModel
 		config.ShellAutosuggestTimeout = time.Duration(cli.Shell.AutosuggestTimeout) * time.Millisecond
 		config.ShellNewlineAutosuggestTimeout = time.Duration(cli.Shell.NewlineAutosuggestTimeout) * time.Millisecond
-		config.ColorDark = !cli.LightColor
 		config.ShellMode = true
 		config.ShellLeavePromptAlone = cli.Shell.NoCommandPrompt
 		config.ShellMaxPromptTokens = cli.Shell.MaxPromptTokens
 		config.ShellMaxHistoryBlockTokens = cli.Shell.MaxHistoryBlockTokens
 		config.ShellMaxResponseTokens = cli.Shell.MaxResponseTokens
+		config.ShellAutoDebug = cli.Shell.AutoDebug
+		config.ShellAutoDebugInterval = time.Duration(cli.Shell.AutoDebugInterval) * time.Millisecond
+		config.ShellBackgroundAnswers = cli.Shell.BackgroundAnswers
+		config.ShellPager = cli.Shell.Pager
+		if cli.Shell.Resume != "" {
+			export, err := bf.LoadHistoryExport(cli.Shell.Resume)
+			if err != nil {
+				fmt.Fprintf(errorWriter, "%s\n", err)
+				os.Exit(7)
+			}
+			fmt.Printf("Resuming session %s from %s\n", export.Session, cli.Shell.Resume)
+			config.ShellResume = export
+		}
+		config.ShellIndexContext = cli.Shell.IndexContext
+		config.ShellIndexContextTokens = cli.Shell.IndexContextTokens
+		config.ShellTmuxContext = cli.Shell.Tmux
+		config.ShellSessionEnvVars = cli.Shell.SessionEnv
+		config.ShellExcludeCommands = append(config.ShellExcludeCommands, cli.Shell.Exclude...)
+		config.ShellInlineEditKey = inlineEditKey
+		config.ShellViMode = cli.Shell.ViMode == "on"
+		if cli.Shell.ViMode == "auto" {
+			home, _ := os.UserHomeDir()
+			config.ShellViMode = bf.DetectViMode(shell, home)
+		}
+		config.ShellPromptPrefix = promptPrefix
+		config.ShellNotifyCommand = configFile.NotifyCommand
+		if cli.Shell.Notify != "" {
+			config.ShellNotifyCommand = cli.Shell.Notify
+		}
+		config.ShellNotifyAfter = time.Duration(cli.Shell.NotifyAfter) * time.Millisecond
+		config.ShellCapitalizedCommands = configFile.CapitalizedCommands
+		config.ShellPluginDir = paths.PluginDir()
+		config.ApplyProfile(profile)
 
 		bf.RunShell(ctx, config)
 
+	case "console":
+		util.InitLogging(ctx)
+		config.ApplyProfile(profile)
+		butterfishCtx, err := bf.NewButterfish(ctx, config)
+		if err != nil {
+			fmt.Fprintf(errorWriter, err.Error())
+			os.Exit(3)
+		}
+
+		err = butterfishCtx.RunConsole(&bf.ConsoleOptions{
+			Addr:    cli.Console.Addr,
+			Token:   cli.Console.Token,
+			TLSCert: cli.Console.TLSCert,
+			TLSKey:  cli.Console.TLSKey,
+		}, os.Stdin)
+		if err != nil {
+			fmt.Fprintf(errorWriter, "Error: %s\n", err.Error())
+			os.Exit(4)
+		}
+
 	default:
-		if cli.Log {
+		if cli.Log || cli.LogFormat == bf.LogFormatJSONL {
 			util.InitLogging(ctx)
 		}
+		config.ApplyProfile(profile)
 		butterfishCtx, err := bf.NewButterfish(ctx, config)
 		if err != nil {
 			fmt.Fprintf(errorWriter, err.Error())
@@ -255,7 +607,11 @@ func main() {
 		err = butterfishCtx.ExecCommand(parsedCmd, &cli.CliCommandConfig)
 
 		if err != nil {
-			butterfishCtx.StylePrintf(config.Styles.Error, "Error: %s\n", err.Error())
+			// errors go to stderr so that stdout only carries command output
+			fmt.Fprintf(errorWriter, "Error: %s\n", err.Error())
+			if bf.IsAuthError(err) {
+				offerNewKey(config)
+			}
 			os.Exit(4)
 		}
 	}
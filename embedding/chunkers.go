@@ -0,0 +1,210 @@
+package embedding
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Chunkers decide where files are split before embedding. Splitting at fixed
+// byte offsets cuts functions and sections in half, so for code we split
+// between top-level declarations and for markdown between sections, then pack
+// consecutive pieces together up to the chunk size. Pieces that are too big
+// on their own are split between lines.
+
+type ChunkRange struct {
+	Start int
+	End   int
+}
+
+type Chunker interface {
+	// Split content into ranges of at most chunkSize bytes that cover all of
+	// it, in order
+	Chunk(content []byte, chunkSize int) []ChunkRange
+}
+
+// Splits every chunkSize bytes
+type FixedChunker struct{}
+
+func (this *FixedChunker) Chunk(content []byte, chunkSize int) []ChunkRange {
+	ranges := []ChunkRange{}
+	for start := 0; start < len(content); start += chunkSize {
+		ranges = append(ranges, ChunkRange{start, min(start+chunkSize, len(content))})
+	}
+	return ranges
+}
+
+// Splits before lines matching Boundary, e.g. function declarations or
+// headings
+type BoundaryChunker struct {
+	Boundary *regexp.Regexp
+	// Lines right before a boundary that belong with it, e.g. doc comments
+	// and decorators
+	Attached *regexp.Regexp
+	// Ignore boundaries inside ``` fenced blocks
+	Fenced bool
+}
+
+var codeAttachedRegex = regexp.MustCompile(`^\s*(//|#|/\*|\*|--|@|\[)`)
+
+func NewCodeChunker(boundary string) *BoundaryChunker {
+	return &BoundaryChunker{
+		Boundary: regexp.MustCompile(boundary),
+		Attached: codeAttachedRegex,
+	}
+}
+
+func NewMarkdownChunker() *BoundaryChunker {
+	return &BoundaryChunker{
+		Boundary: regexp.MustCompile(`^#{1,6}\s`),
+		Fenced:   true,
+	}
+}
+
+// Byte offsets of the start of each line
+func lineStarts(content []byte) []int {
+	starts := []int{0}
+	for i, c := range content {
+		if c == '\n' && i+1 < len(content) {
+			starts = append(starts, i+1)
+		}
+	}
+	return starts
+}
+
+func (this *BoundaryChunker) Chunk(content []byte, chunkSize int) []ChunkRange {
+	if len(content) == 0 {
+		return []ChunkRange{}
+	}
+
+	starts := lineStarts(content)
+	line := func(i int) string {
+		end := len(content)
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		return strings.TrimRight(string(content[starts[i]:end]), "\r\n")
+	}
+
+	// find the lines where sections start
+	sectionStarts := []int{0}
+	inFence := false
+	for i := range starts {
+		text := line(i)
+		if this.Fenced && strings.HasPrefix(strings.TrimSpace(text), "```") {
+			inFence = !inFence
+			continue
+		}
+		if inFence || i == 0 || !this.Boundary.MatchString(text) {
+			continue
+		}
+
+		// pull attached lines like doc comments into the section
+		first := i
+		for this.Attached != nil && first > sectionStarts[len(sectionStarts)-1]+1 &&
+			this.Attached.MatchString(line(first-1)) {
+			first--
+		}
+		if first > sectionStarts[len(sectionStarts)-1] {
+			sectionStarts = append(sectionStarts, first)
+		}
+	}
+
+	sections := make([]ChunkRange, len(sectionStarts))
+	for i, first := range sectionStarts {
+		sections[i].Start = starts[first]
+		if i+1 < len(sectionStarts) {
+			sections[i].End = starts[sectionStarts[i+1]]
+		} else {
+			sections[i].End = len(content)
+		}
+	}
+
+	return packRanges(sections, chunkSize, func(section ChunkRange) []ChunkRange {
+		return splitLines(content, section, chunkSize)
+	})
+}
+
+// Merge consecutive ranges while they fit in chunkSize, ranges that are too
+// big on their own are split with split
+func packRanges(ranges []ChunkRange, chunkSize int, split func(ChunkRange) []ChunkRange) []ChunkRange {
+	packed := []ChunkRange{}
+	for _, r := range ranges {
+		if r.End-r.Start > chunkSize {
+			packed = append(packed, split(r)...)
+			continue
+		}
+
+		last := len(packed) - 1
+		if last >= 0 && r.End-packed[last].Start <= chunkSize {
+			packed[last].End = r.End
+		} else {
+			packed = append(packed, r)
+		}
+	}
+	return packed
+}
+
+// Split a range between lines, lines longer than chunkSize are split at fixed
+// offsets
+func splitLines(content []byte, r ChunkRange, chunkSize int) []ChunkRange {
+	lines := []ChunkRange{}
+	start := r.Start
+	for i := r.Start; i < r.End; i++ {
+		if content[i] == '\n' || i == r.End-1 {
+			lines = append(lines, ChunkRange{start, i + 1})
+			start = i + 1
+		}
+	}
+
+	return packRanges(lines, chunkSize, func(line ChunkRange) []ChunkRange {
+		ranges := (&FixedChunker{}).Chunk(content[line.Start:line.End], chunkSize)
+		for i := range ranges {
+			ranges[i].Start += line.Start
+			ranges[i].End += line.Start
+		}
+		return ranges
+	})
+}
+
+// Chunkers for common languages by file extension, a declaration has to start
+// at the beginning of a line (or be lightly indented for languages where
+// everything is inside a class) to count as a boundary
+func DefaultChunkers() map[string]Chunker {
+	goChunker := NewCodeChunker(`^(func|type|var|const)\b`)
+	pythonChunker := NewCodeChunker(`^(async\s+def|def|class)\s`)
+	jsChunker := NewCodeChunker(`^(export\s+)?(default\s+)?(declare\s+)?(abstract\s+)?(async\s+)?(function\*?|class|interface|type|enum|const|let|var|namespace)\s`)
+	rustChunker := NewCodeChunker(`^(pub(\([^)]*\))?\s+)?(async\s+)?(unsafe\s+)?(fn|struct|enum|trait|impl|mod|type|const|static|macro_rules!)\b`)
+	rubyChunker := NewCodeChunker(`^\s{0,2}(def|class|module)\s`)
+	jvmChunker := NewCodeChunker(`^\s{0,4}((public|private|protected|internal|static|final|abstract|override|sealed|data|open|suspend)\s+)*(class|interface|enum|record|object|fun|void|[\w<>\[\],]+\s+\w+\s*\()`)
+	cChunker := NewCodeChunker(`^((struct|class|enum|union|typedef|namespace|template)\b|[A-Za-z_][\w\s\*&:<>,]*\([^;]*$)`)
+	shellChunker := NewCodeChunker(`^(function\s+[\w-]+|[\w-]+\s*\(\s*\))`)
+	markdownChunker := NewMarkdownChunker()
+
+	chunkers := map[string]Chunker{}
+	add := func(chunker Chunker, extensions ...string) {
+		for _, extension := range extensions {
+			chunkers[extension] = chunker
+		}
+	}
+
+	add(goChunker, ".go")
+	add(pythonChunker, ".py", ".pyi")
+	add(jsChunker, ".js", ".jsx", ".mjs", ".cjs", ".ts", ".tsx", ".mts", ".cts")
+	add(rustChunker, ".rs")
+	add(rubyChunker, ".rb")
+	add(jvmChunker, ".java", ".kt", ".kts", ".scala", ".cs")
+	add(cChunker, ".c", ".h", ".cc", ".cpp", ".cxx", ".hpp", ".hh", ".m", ".mm")
+	add(shellChunker, ".sh", ".bash", ".zsh")
+	add(markdownChunker, ".md", ".markdown", ".mdx")
+	return chunkers
+}
+
+// The chunker for a file, by extension
+func (this *DiskCachedEmbeddingIndex) chunkerFor(path string) Chunker {
+	chunker, ok := this.Chunkers[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		return &FixedChunker{}
+	}
+	return chunker
+}
@@ -0,0 +1,76 @@
+package embedding
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Ranges must cover the content in order and fit in the chunk size
+func assertValidChunks(t *testing.T, content string, ranges []ChunkRange, chunkSize int) []string {
+	chunks := []string{}
+	end := 0
+	for _, r := range ranges {
+		assert.Equal(t, end, r.Start)
+		assert.LessOrEqual(t, r.End-r.Start, chunkSize)
+		chunks = append(chunks, content[r.Start:r.End])
+		end = r.End
+	}
+	assert.Equal(t, len(content), end)
+	return chunks
+}
+
+func TestFixedChunker(t *testing.T) {
+	content := "0123456789"
+	chunks := assertValidChunks(t, content, (&FixedChunker{}).Chunk([]byte(content), 4), 4)
+	assert.Equal(t, []string{"0123", "4567", "89"}, chunks)
+}
+
+func TestCodeChunker(t *testing.T) {
+	content := `package foo
+
+// Add adds
+func Add(a, b int) int {
+	return a + b
+}
+
+// Sub subtracts
+func Sub(a, b int) int {
+	return a - b
+}
+`
+	chunker := DefaultChunkers()[".go"]
+
+	// each function with its doc comment
+	chunks := assertValidChunks(t, content, chunker.Chunk([]byte(content), 60), 60)
+	assert.Equal(t, []string{
+		"package foo\n\n",
+		"// Add adds\nfunc Add(a, b int) int {\n\treturn a + b\n}\n\n",
+		"// Sub subtracts\nfunc Sub(a, b int) int {\n\treturn a - b\n}\n",
+	}, chunks)
+
+	// small sections are packed together
+	chunks = assertValidChunks(t, content, chunker.Chunk([]byte(content), 70), 70)
+	assert.Equal(t, 2, len(chunks))
+	assert.True(t, strings.HasPrefix(chunks[1], "// Sub subtracts"))
+
+	// big sections are split between lines, then long lines at fixed offsets
+	chunks = assertValidChunks(t, content, chunker.Chunk([]byte(content), 20), 20)
+	assert.Contains(t, chunks, "// Add adds\n")
+	assert.Contains(t, chunks, "func Add(a, b int) i")
+}
+
+func TestMarkdownChunker(t *testing.T) {
+	content := "# Title\n\nIntro\n\n## Install\n\n```\n# not a heading\nmake\n```\n\n## Usage\n\nRun it\n"
+	chunker := DefaultChunkers()[".md"]
+
+	chunks := assertValidChunks(t, content, chunker.Chunk([]byte(content), 45), 45)
+	assert.Equal(t, []string{
+		"# Title\n\nIntro\n\n",
+		"## Install\n\n```\n# not a heading\nmake\n```\n\n",
+		"## Usage\n\nRun it\n",
+	}, chunks)
+
+	assert.Empty(t, chunker.Chunk([]byte{}, 40))
+}
@@ -0,0 +1,367 @@
+package embedding
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"syscall"
+
+	pb "github.com/bakks/butterfish/proto"
+	"github.com/golang/protobuf/proto"
+	"github.com/spf13/afero"
+)
+
+// The compact index format stores vectors quantized to float16 or int8 in a
+// single block after the file metadata, so that an index file is 2-4x smaller
+// than the protobuf format and can be memory-mapped rather than deserialized.
+// Vectors are decoded from the mapping as they are searched, only the
+// metadata (file names, timestamps, and chunk offsets) is held in memory.
+//
+// Layout, little-endian:
+//
+//	magic      [4]byte "BFQX"
+//	version    uint8
+//	quant      uint8, 1 for float16, 2 for int8
+//	reserved   uint16
+//	dims       uint32
+//	count      uint32, number of vectors
+//	metaLen    uint64
+//	meta       DirectoryIndex protobuf with the vectors left out
+//	padding    to a multiple of 4 bytes
+//	scales     count float32s, int8 only
+//	vectors    count*dims float16s or int8s, ordered by file name and then
+//	           by chunk
+
+const (
+	IndexFormatProtobuf = "protobuf"
+	IndexFormatFloat16  = "f16"
+	IndexFormatInt8     = "int8"
+)
+
+var IndexFormats = []string{IndexFormatFloat16, IndexFormatInt8, IndexFormatProtobuf}
+
+const (
+	compactMagic      = "BFQX"
+	compactVersion    = 1
+	compactHeaderSize = 24
+
+	quantFloat16 = 1
+	quantInt8    = 2
+)
+
+// Quantized vectors for one directory, backed by a memory-mapped index file
+// or by the file contents when the filesystem can't be mapped
+type compactVectors struct {
+	data    []byte
+	quant   uint8
+	dims    int
+	count   int
+	scales  int // offset of the int8 scales in data
+	vectors int // offset of the vector block in data
+	// maps file name to the row of its first vector
+	rows  map[string]int
+	unmap func() error
+}
+
+func (this *compactVectors) vector(row int) []float32 {
+	if row < 0 || row >= this.count {
+		return nil
+	}
+
+	vector := make([]float32, this.dims)
+	switch this.quant {
+	case quantFloat16:
+		offset := this.vectors + row*this.dims*2
+		for i := range vector {
+			vector[i] = halfToFloat32(binary.LittleEndian.Uint16(this.data[offset+i*2:]))
+		}
+	case quantInt8:
+		scale := math.Float32frombits(binary.LittleEndian.Uint32(this.data[this.scales+row*4:]))
+		offset := this.vectors + row*this.dims
+		for i := range vector {
+			vector[i] = float32(int8(this.data[offset+i])) * scale
+		}
+	}
+	return vector
+}
+
+func (this *compactVectors) close() error {
+	if this.unmap == nil {
+		return nil
+	}
+	err := this.unmap()
+	this.unmap = nil
+	this.data = nil
+	return err
+}
+
+func isCompactIndex(header []byte) bool {
+	return len(header) >= len(compactMagic) && string(header[:len(compactMagic)]) == compactMagic
+}
+
+func quantForFormat(format string) (uint8, error) {
+	switch format {
+	case IndexFormatFloat16:
+		return quantFloat16, nil
+	case IndexFormatInt8:
+		return quantInt8, nil
+	}
+	return 0, fmt.Errorf("Unknown index format %s, expected one of %v", format, IndexFormats)
+}
+
+// Sorted file names, which is the order vectors are stored in
+func sortedFileNames(dirIndex *pb.DirectoryIndex) []string {
+	names := make([]string, 0, len(dirIndex.Files))
+	for name := range dirIndex.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Serialize a directory index in the compact format, vectors are read with
+// the given function since loaded vectors only live in the mapped file
+func marshalCompact(
+	dirIndex *pb.DirectoryIndex,
+	format string,
+	vectorAt func(name string, i int, embedding *pb.AnnotatedEmbedding) []float32,
+) ([]byte, error) {
+	quant, err := quantForFormat(format)
+	if err != nil {
+		return nil, err
+	}
+
+	// copy the metadata without vectors, and gather vectors in storage order
+	meta := NewDirectoryIndex()
+	vectors := [][]float32{}
+	dims := 0
+
+	for _, name := range sortedFileNames(dirIndex) {
+		file := dirIndex.Files[name]
+		metaFile := &pb.FileEmbeddings{
+			Path:      file.Path,
+			UpdatedAt: file.UpdatedAt,
+		}
+
+		for i, embedding := range file.Embeddings {
+			vector := vectorAt(name, i, embedding)
+			if len(vectors) == 0 {
+				dims = len(vector)
+			} else if len(vector) != dims {
+				return nil, fmt.Errorf("%s has vectors with different dimensions, re-index it with --force", name)
+			}
+			vectors = append(vectors, vector)
+			metaFile.Embeddings = append(metaFile.Embeddings, &pb.AnnotatedEmbedding{
+				Start: embedding.Start,
+				End:   embedding.End,
+			})
+		}
+
+		meta.Files[name] = metaFile
+	}
+
+	metaBuf, err := proto.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, compactHeaderSize)
+	copy(header, compactMagic)
+	header[4] = compactVersion
+	header[5] = quant
+	binary.LittleEndian.PutUint32(header[8:], uint32(dims))
+	binary.LittleEndian.PutUint32(header[12:], uint32(len(vectors)))
+	binary.LittleEndian.PutUint64(header[16:], uint64(len(metaBuf)))
+
+	buf := append(header, metaBuf...)
+	for len(buf)%4 != 0 {
+		buf = append(buf, 0)
+	}
+
+	switch quant {
+	case quantFloat16:
+		for _, vector := range vectors {
+			for _, value := range vector {
+				buf = binary.LittleEndian.AppendUint16(buf, float32ToHalf(value))
+			}
+		}
+
+	case quantInt8:
+		// each vector gets its own scale so that its largest component maps
+		// to 127
+		scales := make([]float32, len(vectors))
+		for i, vector := range vectors {
+			var largest float32
+			for _, value := range vector {
+				largest = float32(math.Max(float64(largest), math.Abs(float64(value))))
+			}
+			scales[i] = largest / 127
+			buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(scales[i]))
+		}
+		for i, vector := range vectors {
+			for _, value := range vector {
+				var q float64
+				if scales[i] != 0 {
+					q = math.Round(float64(value / scales[i]))
+				}
+				q = math.Max(-127, math.Min(127, q))
+				buf = append(buf, byte(int8(q)))
+			}
+		}
+	}
+
+	return buf, nil
+}
+
+// Parse a compact index file, the returned vectors reference data rather than
+// copying it
+func unmarshalCompact(data []byte) (*pb.DirectoryIndex, *compactVectors, error) {
+	if len(data) < compactHeaderSize || !isCompactIndex(data) {
+		return nil, nil, errors.New("Not a compact index file")
+	}
+	if data[4] != compactVersion {
+		return nil, nil, fmt.Errorf("Unsupported compact index version %d, try upgrading butterfish", data[4])
+	}
+
+	vectors := &compactVectors{
+		data:  data,
+		quant: data[5],
+		dims:  int(binary.LittleEndian.Uint32(data[8:])),
+		count: int(binary.LittleEndian.Uint32(data[12:])),
+		rows:  make(map[string]int),
+	}
+	metaLen := binary.LittleEndian.Uint64(data[16:])
+	if metaLen > uint64(len(data)-compactHeaderSize) {
+		return nil, nil, errors.New("Compact index file is truncated")
+	}
+
+	var dirIndex pb.DirectoryIndex
+	err := proto.Unmarshal(data[compactHeaderSize:compactHeaderSize+int(metaLen)], &dirIndex)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dirIndex.Files == nil {
+		dirIndex.Files = make(map[string]*pb.FileEmbeddings)
+	}
+
+	offset := compactHeaderSize + int(metaLen)
+	offset += (4 - offset%4) % 4
+
+	size := vectors.count * vectors.dims
+	switch vectors.quant {
+	case quantFloat16:
+		vectors.vectors = offset
+		size = size * 2
+	case quantInt8:
+		vectors.scales = offset
+		vectors.vectors = offset + vectors.count*4
+		size = size + vectors.count*4
+	default:
+		return nil, nil, fmt.Errorf("Unknown compact index quantization %d", vectors.quant)
+	}
+	if offset+size > len(data) {
+		return nil, nil, errors.New("Compact index file is truncated")
+	}
+
+	row := 0
+	for _, name := range sortedFileNames(&dirIndex) {
+		vectors.rows[name] = row
+		row += len(dirIndex.Files[name].Embeddings)
+	}
+	if row != vectors.count {
+		return nil, nil, fmt.Errorf("Compact index file has %d vectors but %d chunks", vectors.count, row)
+	}
+
+	return &dirIndex, vectors, nil
+}
+
+// Memory-map a file read-only when it's on the real filesystem, otherwise
+// read it into memory
+func mapFile(fs afero.Fs, path string) ([]byte, func() error, error) {
+	if _, ok := fs.(*afero.OsFs); !ok {
+		data, err := afero.ReadFile(fs, path)
+		return data, nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Size() == 0 {
+		return []byte{}, nil, nil
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
+
+// Convert to IEEE 754 half precision, rounding to nearest
+func float32ToHalf(value float32) uint16 {
+	bits := math.Float32bits(value)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int32((bits>>23)&0xff) - 127 + 15
+	mant := bits & 0x7fffff
+
+	switch {
+	case (bits>>23)&0xff == 0xff:
+		// infinity or NaN
+		if mant != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	case exp >= 0x1f:
+		// too large, becomes infinity
+		return sign | 0x7c00
+	case exp <= 0:
+		// too small for a normal half, becomes subnormal or zero
+		if exp < -10 {
+			return sign
+		}
+		mant |= 0x800000
+		shift := uint32(14 - exp)
+		half := uint16(mant >> shift)
+		if (mant>>(shift-1))&1 != 0 {
+			half++
+		}
+		return sign | half
+	}
+
+	half := sign | uint16(exp)<<10 | uint16(mant>>13)
+	// rounding can carry into the exponent, which is still correct
+	if mant&0x1000 != 0 {
+		half++
+	}
+	return half
+}
+
+func halfToFloat32(half uint16) float32 {
+	sign := uint32(half&0x8000) << 16
+	exp := uint32(half>>10) & 0x1f
+	mant := uint32(half & 0x3ff)
+
+	switch exp {
+	case 0:
+		// zero or subnormal
+		value := float32(mant) / (1 << 24)
+		if sign != 0 {
+			value = -value
+		}
+		return value
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	}
+
+	return math.Float32frombits(sign | (exp-15+127)<<23 | mant<<13)
+}
@@ -0,0 +1,161 @@
+package embedding
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	pb "github.com/bakks/butterfish/proto"
+	"github.com/golang/protobuf/proto"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHalfConversion(t *testing.T) {
+	for _, value := range []float32{0, 1, -1, 0.5, 0.1, -0.0123, 65504, 1e-6} {
+		converted := halfToFloat32(float32ToHalf(value))
+		assert.InDelta(t, value, converted, math.Max(1e-7, math.Abs(float64(value))/1000), "value %v", value)
+	}
+
+	assert.True(t, math.IsInf(float64(halfToFloat32(float32ToHalf(1e6))), 1))
+	assert.True(t, math.IsNaN(float64(halfToFloat32(float32ToHalf(float32(math.NaN()))))))
+}
+
+func TestCompactRoundTrip(t *testing.T) {
+	dirIndex := NewDirectoryIndex()
+	dirIndex.Files["b.txt"] = &pb.FileEmbeddings{
+		Path: "b.txt",
+		Embeddings: []*pb.AnnotatedEmbedding{
+			{Start: 0, End: 10, Vector: []float32{0.25, -0.5, 0.75}},
+			{Start: 10, End: 20, Vector: []float32{0, 0, 0}},
+		},
+	}
+	dirIndex.Files["a.txt"] = &pb.FileEmbeddings{
+		Path: "a.txt",
+		Embeddings: []*pb.AnnotatedEmbedding{
+			{Start: 0, End: 5, Vector: []float32{-0.1, 0.2, 0.3}},
+		},
+	}
+	vectorAt := func(name string, i int, embedding *pb.AnnotatedEmbedding) []float32 {
+		return embedding.Vector
+	}
+
+	for _, format := range []string{IndexFormatFloat16, IndexFormatInt8} {
+		buf, err := marshalCompact(dirIndex, format, vectorAt)
+		assert.NoError(t, err)
+
+		loaded, vectors, err := unmarshalCompact(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, vectors.count)
+		assert.Equal(t, 3, vectors.dims)
+		assert.Equal(t, uint64(20), loaded.Files["b.txt"].Embeddings[1].End)
+		assert.Empty(t, loaded.Files["b.txt"].Embeddings[0].Vector)
+
+		for name, file := range dirIndex.Files {
+			for i, embedding := range file.Embeddings {
+				vector := vectors.vector(vectors.rows[name] + i)
+				assert.InDeltaSlice(t, embedding.Vector, vector, 0.005, "%s %s %d", format, name, i)
+			}
+		}
+
+		_, _, err = unmarshalCompact(buf[:len(buf)-1])
+		assert.Error(t, err)
+	}
+
+	dirIndex.Files["c.txt"] = &pb.FileEmbeddings{
+		Embeddings: []*pb.AnnotatedEmbedding{{Vector: []float32{1, 2}}},
+	}
+	_, err := marshalCompact(dirIndex, IndexFormatFloat16, vectorAt)
+	assert.Error(t, err)
+}
+
+// Index in the protobuf format, then migrate to int8 and check that searches
+// still work off the compact files
+func TestMigrateIndex(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	ctx := context.Background()
+
+	index, embedder := newTestDiskCachedEmbeddingIndex(fs)
+	index.Format = IndexFormatProtobuf
+	err := index.IndexPath(ctx, "/a", false, 512, 8)
+	assert.NoError(t, err)
+
+	buf, err := afero.ReadFile(fs, "/a/.butterfish_index")
+	assert.NoError(t, err)
+	assert.False(t, isCompactIndex(buf))
+	protobufSize := len(buf)
+
+	index, _ = newTestDiskCachedEmbeddingIndex(fs)
+	index.Format = IndexFormatInt8
+	err = index.MigratePaths(ctx, []string{"/a"})
+	assert.NoError(t, err)
+
+	buf, err = afero.ReadFile(fs, "/a/.butterfish_index")
+	assert.NoError(t, err)
+	assert.True(t, isCompactIndex(buf))
+	assert.Less(t, len(buf), protobufSize)
+
+	index, embedder = newTestDiskCachedEmbeddingIndex(fs)
+	err = index.LoadPath(ctx, "/a")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(index.IndexedFiles()))
+	assert.Empty(t, index.Index["/a"].Files["one"].Embeddings[0].Vector)
+
+	scored, err := index.Search(ctx, "222222", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, "/a/two", scored[0].FilePath)
+	assert.InDelta(t, 1, scored[0].Score, 0.001)
+
+	// Re-indexing a file keeps the rest of the directory from the old file
+	err = afero.WriteFile(fs, "/a/one", []byte("333333"), 0644)
+	assert.NoError(t, err)
+	err = index.IndexPath(ctx, "/a/one", true, 512, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, embedder.Calls)
+
+	scored, err = index.Search(ctx, "333333", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "/a/one", scored[0].FilePath)
+	scored, err = index.Search(ctx, "222222", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "/a/two", scored[0].FilePath)
+
+	// And back to protobuf, which has the vectors inline again
+	index.Format = IndexFormatProtobuf
+	err = index.MigratePaths(ctx, []string{"/a"})
+	assert.NoError(t, err)
+
+	buf, err = afero.ReadFile(fs, "/a/.butterfish_index")
+	assert.NoError(t, err)
+	var dirIndex pb.DirectoryIndex
+	assert.NoError(t, proto.Unmarshal(buf, &dirIndex))
+	assert.Equal(t, 128, len(dirIndex.Files["two"].Embeddings[0].Vector))
+}
+
+// On the real filesystem compact dotfiles are memory-mapped, and saving over a
+// mapped dotfile must not break searches
+func TestCompactMmap(t *testing.T) {
+	dir := t.TempDir()
+	fs := afero.NewOsFs()
+	ctx := context.Background()
+	assert.NoError(t, afero.WriteFile(fs, dir+"/one", []byte("111111"), 0644))
+	assert.NoError(t, afero.WriteFile(fs, dir+"/two", []byte("222222"), 0644))
+
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	err := index.IndexPath(ctx, dir, false, 512, 8)
+	assert.NoError(t, err)
+	assert.NotNil(t, index.vectors[dir].unmap)
+
+	assert.NoError(t, afero.WriteFile(fs, dir+"/three", []byte("333333"), 0644))
+	err = index.IndexPath(ctx, dir, false, 512, 8)
+	assert.NoError(t, err)
+
+	for _, query := range []string{"111", "222", "333"} {
+		scored, err := index.Search(ctx, query, 1)
+		assert.NoError(t, err)
+		assert.InDelta(t, 1, scored[0].Score, 0.001)
+	}
+
+	assert.NoError(t, index.ClearPath(ctx, dir))
+	assert.Empty(t, index.vectors)
+}
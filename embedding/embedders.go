@@ -0,0 +1,137 @@
+package embedding
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+)
+
+// Embedders that don't depend on the OpenAI API, these let the index run
+// fully offline.
+
+const (
+	DefaultOllamaURL   = "http://localhost:11434"
+	DefaultOllamaModel = "nomic-embed-text"
+)
+
+// Calls the embed endpoint of an Ollama server
+type OllamaEmbedder struct {
+	URL    string
+	Model  string
+	Client *http.Client
+}
+
+func NewOllamaEmbedder(url, model string) *OllamaEmbedder {
+	if url == "" {
+		url = DefaultOllamaURL
+	}
+	if model == "" {
+		model = DefaultOllamaModel
+	}
+
+	return &OllamaEmbedder{
+		URL:    strings.TrimSuffix(url, "/"),
+		Model:  model,
+		Client: http.DefaultClient,
+	}
+}
+
+type ollamaEmbedRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type embeddingsResponse struct {
+	Embeddings [][]float32 `json:"embeddings"`
+	Error      string      `json:"error,omitempty"`
+}
+
+func (this *OllamaEmbedder) CalculateEmbeddings(ctx context.Context, content []string) ([][]float32, error) {
+	body, err := json.Marshal(&ollamaEmbedRequest{
+		Model: this.Model,
+		Input: content,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", this.URL+"/api/embed", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := this.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Ollama embedding request failed, is Ollama running at %s? %s", this.URL, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var result embeddingsResponse
+	err = json.Unmarshal(data, &result)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		if result.Error != "" {
+			return nil, fmt.Errorf("Ollama embedding request failed: %s", result.Error)
+		}
+		return nil, fmt.Errorf("Ollama embedding request failed with status %d: %s", resp.StatusCode, string(data))
+	}
+
+	return checkEmbeddings(content, result.Embeddings)
+}
+
+// Runs an external program for each batch of chunks, e.g. a script wrapping
+// an ONNX or gguf model. The program gets {"input": ["chunk", ...]} as JSON on
+// stdin and must print {"embeddings": [[0.1, ...], ...]} on stdout, with one
+// embedding per input in the same order.
+type CommandEmbedder struct {
+	Command string
+}
+
+func NewCommandEmbedder(command string) *CommandEmbedder {
+	return &CommandEmbedder{Command: command}
+}
+
+func (this *CommandEmbedder) CalculateEmbeddings(ctx context.Context, content []string) ([][]float32, error) {
+	input, err := json.Marshal(map[string][]string{"input": content})
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", this.Command)
+	cmd.Stdin = bytes.NewReader(input)
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Embedding command %q failed: %s\n%s", this.Command, err, stderr.String())
+	}
+
+	var result embeddingsResponse
+	err = json.Unmarshal(output, &result)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse output of embedding command %q: %s", this.Command, err)
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("Embedding command %q failed: %s", this.Command, result.Error)
+	}
+
+	return checkEmbeddings(content, result.Embeddings)
+}
+
+func checkEmbeddings(content []string, embeddings [][]float32) ([][]float32, error) {
+	if len(embeddings) != len(content) {
+		return nil, fmt.Errorf("Expected %d embeddings but got %d", len(content), len(embeddings))
+	}
+	return embeddings, nil
+}
@@ -0,0 +1,48 @@
+package embedding
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOllamaEmbedder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/embed", r.URL.Path)
+
+		var req ollamaEmbedRequest
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, DefaultOllamaModel, req.Model)
+
+		resp := embeddingsResponse{}
+		for i := range req.Input {
+			resp.Embeddings = append(resp.Embeddings, []float32{float32(i), 1})
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	embedder := NewOllamaEmbedder(server.URL+"/", "")
+	embeddings, err := embedder.CalculateEmbeddings(context.Background(), []string{"a", "b"})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]float32{{0, 1}, {1, 1}}, embeddings)
+}
+
+func TestCommandEmbedder(t *testing.T) {
+	embedder := NewCommandEmbedder(`cat > /dev/null; echo '{"embeddings": [[0.5, 0.25]]}'`)
+	embeddings, err := embedder.CalculateEmbeddings(context.Background(), []string{"a"})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]float32{{0.5, 0.25}}, embeddings)
+
+	// the number of embeddings must match the input
+	_, err = embedder.CalculateEmbeddings(context.Background(), []string{"a", "b"})
+	assert.NotNil(t, err)
+
+	embedder = NewCommandEmbedder("exit 1")
+	_, err = embedder.CalculateEmbeddings(context.Background(), []string{"a"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,325 @@
+package embedding
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// An HNSW (Hierarchical Navigable Small World) graph for approximate nearest
+// neighbor search, see https://arxiv.org/abs/1603.09320. Each chunk is a node
+// linked to its nearest neighbors on layer 0, and a random subset of nodes is
+// also on sparser upper layers, so a search greedily walks down from the top
+// layer and only compares the query against a small part of the index.
+//
+// To keep building the graph fast, vectors in the graph are hashed down to
+// hnswDims dimensions, where each dimension is the sum of a random subset of
+// the original dimensions with random signs, which roughly preserves dot
+// products. They're then normalized and quantized to int8 so that comparisons
+// are cheap integer dot products. Since this loses precision the graph search
+// collects extra candidates and they're re-scored with the exact vectors.
+
+const (
+	hnswM              = 16
+	hnswEfConstruction = 64
+	hnswMinEfSearch    = 400
+	hnswDims           = 128
+)
+
+// Identifies a chunk in a DiskCachedEmbeddingIndex
+type chunkRef struct {
+	dirPath string
+	name    string
+	chunk   int
+}
+
+type hnswCandidate struct {
+	node       int32
+	similarity int32
+}
+
+type hnswGraph struct {
+	refs    []chunkRef
+	vectors [][]int8
+	// neighbors[node][level] are the node's links on that level
+	neighbors [][][]int32
+	entry     int32
+	maxLevel  int
+	dims      int
+
+	// for each original dimension, the hashed dimension it's added to and
+	// its sign
+	hashDims  []int
+	hashSigns []float32
+
+	levelMult float64
+	rng       *rand.Rand
+
+	// nodes visited during a search are marked with the current stamp
+	visited []uint32
+	stamp   uint32
+}
+
+func newHNSWGraph(dims int) *hnswGraph {
+	graph := &hnswGraph{
+		entry:     -1,
+		dims:      dims,
+		levelMult: 1 / math.Log(hnswM),
+		// seeded so that the graph is the same for the same index
+		rng: rand.New(rand.NewSource(1)),
+	}
+
+	if dims > hnswDims {
+		graph.hashDims = make([]int, dims)
+		graph.hashSigns = make([]float32, dims)
+		for i := range graph.hashDims {
+			graph.hashDims[i] = graph.rng.Intn(hnswDims)
+			graph.hashSigns[i] = float32(graph.rng.Intn(2)*2 - 1)
+		}
+	}
+	return graph
+}
+
+// Hash and quantize a vector for the graph
+func (this *hnswGraph) project(vector []float32) []int8 {
+	if this.hashDims == nil {
+		return quantizeUnit(vector)
+	}
+
+	hashed := make([]float32, hnswDims)
+	for i, value := range vector {
+		hashed[this.hashDims[i]] += value * this.hashSigns[i]
+	}
+	return quantizeUnit(hashed)
+}
+
+// Normalize a vector and scale it to int8, so that the dot product of two
+// quantized vectors is proportional to their cosine similarity
+func quantizeUnit(vector []float32) []int8 {
+	var norm float64
+	for _, value := range vector {
+		norm += float64(value) * float64(value)
+	}
+	norm = math.Sqrt(norm)
+
+	quantized := make([]int8, len(vector))
+	if norm == 0 {
+		return quantized
+	}
+	for i, value := range vector {
+		quantized[i] = int8(math.Round(float64(value) / norm * 127))
+	}
+	return quantized
+}
+
+func dotInt8(a, b []int8) int32 {
+	var sum int32
+	for i := range a {
+		sum += int32(a[i]) * int32(b[i])
+	}
+	return sum
+}
+
+func (this *hnswGraph) Len() int {
+	return len(this.refs)
+}
+
+func (this *hnswGraph) Add(ref chunkRef, vector []float32) {
+	node := int32(len(this.refs))
+	query := this.project(vector)
+	level := int(-math.Log(1-this.rng.Float64()) * this.levelMult)
+
+	this.refs = append(this.refs, ref)
+	this.vectors = append(this.vectors, query)
+	this.neighbors = append(this.neighbors, make([][]int32, level+1))
+	this.visited = append(this.visited, 0)
+
+	if this.entry < 0 {
+		this.entry = node
+		this.maxLevel = level
+		return
+	}
+
+	entry := this.entry
+	for l := this.maxLevel; l > level; l-- {
+		entry = this.greedyClosest(query, entry, l)
+	}
+
+	entries := []int32{entry}
+	for l := min(level, this.maxLevel); l >= 0; l-- {
+		candidates := this.searchLayer(query, entries, hnswEfConstruction, l)
+
+		selected := candidates[:min(hnswM, len(candidates))]
+		links := make([]int32, len(selected))
+		for i, candidate := range selected {
+			links[i] = candidate.node
+		}
+		this.neighbors[node][l] = links
+
+		for _, neighbor := range links {
+			this.link(neighbor, node, l)
+		}
+
+		entries = entries[:0]
+		for _, candidate := range candidates {
+			entries = append(entries, candidate.node)
+		}
+	}
+
+	if level > this.maxLevel {
+		this.entry = node
+		this.maxLevel = level
+	}
+}
+
+// Add a link from node to neighbor, dropping node's least similar link if it
+// has too many
+func (this *hnswGraph) link(node, neighbor int32, level int) {
+	links := append(this.neighbors[node][level], neighbor)
+
+	maxLinks := hnswM
+	if level == 0 {
+		maxLinks = hnswM * 2
+	}
+	if len(links) > maxLinks {
+		vector := this.vectors[node]
+		candidates := make([]hnswCandidate, len(links))
+		for i, link := range links {
+			candidates[i] = hnswCandidate{link, dotInt8(vector, this.vectors[link])}
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].similarity > candidates[j].similarity
+		})
+		links = links[:maxLinks]
+		for i := range links {
+			links[i] = candidates[i].node
+		}
+	}
+
+	this.neighbors[node][level] = links
+}
+
+func (this *hnswGraph) greedyClosest(query []int8, entry int32, level int) int32 {
+	best := entry
+	bestSimilarity := dotInt8(query, this.vectors[entry])
+
+	for changed := true; changed; {
+		changed = false
+		for _, neighbor := range this.neighbors[best][level] {
+			similarity := dotInt8(query, this.vectors[neighbor])
+			if similarity > bestSimilarity {
+				best = neighbor
+				bestSimilarity = similarity
+				changed = true
+			}
+		}
+	}
+	return best
+}
+
+// Beam search on one layer, returns up to ef candidates, most similar first
+func (this *hnswGraph) searchLayer(query []int8, entries []int32, ef int, level int) []hnswCandidate {
+	this.stamp++
+	if this.stamp == 0 {
+		// the stamp wrapped around, reset so old marks aren't mistaken for
+		// this search's
+		for i := range this.visited {
+			this.visited[i] = 0
+		}
+		this.stamp = 1
+	}
+
+	toVisit := &candidateHeap{mostSimilarFirst: true}
+	found := &candidateHeap{}
+
+	for _, entry := range entries {
+		if this.visited[entry] == this.stamp {
+			continue
+		}
+		this.visited[entry] = this.stamp
+		candidate := hnswCandidate{entry, dotInt8(query, this.vectors[entry])}
+		heap.Push(toVisit, candidate)
+		heap.Push(found, candidate)
+	}
+
+	for toVisit.Len() > 0 {
+		current := heap.Pop(toVisit).(hnswCandidate)
+		if found.Len() >= ef && current.similarity < found.items[0].similarity {
+			break
+		}
+
+		for _, neighbor := range this.neighbors[current.node][level] {
+			if this.visited[neighbor] == this.stamp {
+				continue
+			}
+			this.visited[neighbor] = this.stamp
+
+			similarity := dotInt8(query, this.vectors[neighbor])
+			if found.Len() < ef || similarity > found.items[0].similarity {
+				candidate := hnswCandidate{neighbor, similarity}
+				heap.Push(toVisit, candidate)
+				heap.Push(found, candidate)
+				if found.Len() > ef {
+					heap.Pop(found)
+				}
+			}
+		}
+	}
+
+	results := found.items
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].similarity > results[j].similarity
+	})
+	return results
+}
+
+// Returns the refs of up to ef chunks that are approximately the most similar
+// to the vector
+func (this *hnswGraph) Search(vector []float32, ef int) []chunkRef {
+	if this.entry < 0 {
+		return nil
+	}
+
+	query := this.project(vector)
+	entry := this.entry
+	for l := this.maxLevel; l > 0; l-- {
+		entry = this.greedyClosest(query, entry, l)
+	}
+
+	candidates := this.searchLayer(query, []int32{entry}, ef, 0)
+	refs := make([]chunkRef, len(candidates))
+	for i, candidate := range candidates {
+		refs[i] = this.refs[candidate.node]
+	}
+	return refs
+}
+
+// A heap of candidates, least similar on top unless mostSimilarFirst is set
+type candidateHeap struct {
+	items            []hnswCandidate
+	mostSimilarFirst bool
+}
+
+func (this *candidateHeap) Len() int { return len(this.items) }
+
+func (this *candidateHeap) Less(i, j int) bool {
+	if this.mostSimilarFirst {
+		return this.items[i].similarity > this.items[j].similarity
+	}
+	return this.items[i].similarity < this.items[j].similarity
+}
+
+func (this *candidateHeap) Swap(i, j int) {
+	this.items[i], this.items[j] = this.items[j], this.items[i]
+}
+
+func (this *candidateHeap) Push(x any) {
+	this.items = append(this.items, x.(hnswCandidate))
+}
+
+func (this *candidateHeap) Pop() any {
+	last := this.items[len(this.items)-1]
+	this.items = this.items[:len(this.items)-1]
+	return last
+}
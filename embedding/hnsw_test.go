@@ -0,0 +1,84 @@
+package embedding
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	pb "github.com/bakks/butterfish/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+// The approximate search should find nearly all of the exact search's top
+// results. Vectors are clustered around random centers since real embeddings
+// are clustered by topic.
+func TestApproximateSearch(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	centers := make([][]float32, 20)
+	for i := range centers {
+		centers[i] = make([]float32, 256)
+		for j := range centers[i] {
+			centers[i][j] = float32(rng.NormFloat64())
+		}
+	}
+	randomVector := func() []float32 {
+		center := centers[rng.Intn(len(centers))]
+		vector := make([]float32, len(center))
+		for i := range vector {
+			vector[i] = center[i] + float32(rng.NormFloat64())*0.8
+		}
+		return vector
+	}
+
+	index, _ := newTestDiskCachedEmbeddingIndex(nil)
+	for d := 0; d < 20; d++ {
+		dirIndex := NewDirectoryIndex()
+		for f := 0; f < 10; f++ {
+			file := &pb.FileEmbeddings{}
+			for c := 0; c < 10; c++ {
+				file.Embeddings = append(file.Embeddings, &pb.AnnotatedEmbedding{
+					Start:  uint64(c),
+					End:    uint64(c + 1),
+					Vector: randomVector(),
+				})
+			}
+			dirIndex.Files[fmt.Sprintf("file%d", f)] = file
+		}
+		index.Index[fmt.Sprintf("/dir%d", d)] = dirIndex
+	}
+	index.ApproximateThreshold = 1000
+
+	ctx := context.Background()
+	found, total := 0, 0
+	for q := 0; q < 20; q++ {
+		query := randomVector()
+
+		index.ExactSearch = true
+		exact, err := index.SearchWithVector(ctx, query, 10)
+		assert.NoError(t, err)
+		index.ExactSearch = false
+		approximate, err := index.SearchWithVector(ctx, query, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, 10, len(approximate))
+
+		seen := map[string]bool{}
+		for _, result := range approximate {
+			seen[fmt.Sprintf("%s:%d", result.FilePath, result.Start)] = true
+		}
+		for _, result := range exact {
+			if seen[fmt.Sprintf("%s:%d", result.FilePath, result.Start)] {
+				found++
+			}
+			total++
+		}
+	}
+
+	assert.NotNil(t, index.graph)
+	assert.Equal(t, 2000, index.graph.Len())
+	assert.Greater(t, float64(found)/float64(total), 0.9)
+
+	// Changing the index throws away the graph
+	index.forgetDirectory("/dir0")
+	assert.Nil(t, index.graph)
+}
@@ -39,6 +39,10 @@ type FileEmbeddingIndex interface {
 	LoadPath(ctx context.Context, path string) error
 	IndexPaths(ctx context.Context, paths []string, forceUpdate bool, chunkSize, maxChunks int) error
 	IndexPath(ctx context.Context, path string, forceUpdate bool, chunkSize, maxChunks int) error
+	EstimatePaths(ctx context.Context, paths []string, forceUpdate bool, chunkSize, maxChunks int) (*IndexEstimate, error)
+	MigratePaths(ctx context.Context, paths []string) error
+	Stats(ctx context.Context, path string) (*IndexStats, error)
+	WatchPaths(ctx context.Context, paths []string, chunkSize, maxChunks int, debounce time.Duration) error
 	IndexedFiles() []string
 }
 
@@ -74,6 +78,27 @@ type DiskCachedEmbeddingIndex struct {
 	// The name of the file to cache the index on disk
 	DotfileName string
 
+	// Keep index files in this directory rather than in the directories they
+	// index, see store.go
+	StoreDir string
+
+	// The format dotfiles are written in, one of IndexFormats. Dotfiles in
+	// any format can be loaded.
+	Format string
+
+	// Quantized vectors of directories loaded from compact dotfiles, keyed
+	// like Index. Embeddings loaded from these have no Vector in Index.
+	vectors map[string]*compactVectors
+
+	// Always search by comparing against every chunk, rather than using the
+	// approximate search graph for indexes with ApproximateThreshold or more
+	// chunks
+	ExactSearch          bool
+	ApproximateThreshold int
+
+	// Built on the first search after the index changes, nil when stale
+	graph *hnswGraph
+
 	// When we call the embedder we batch chunks together into a single call,
 	// this is the number of chunks to batch together
 	ChunksPerCall int
@@ -83,6 +108,10 @@ type DiskCachedEmbeddingIndex struct {
 
 	// When we embed a path we skip these files
 	IgnoreFiles []string
+
+	// Chunkers by lowercase file extension, other files are split into fixed
+	// size chunks
+	Chunkers map[string]Chunker
 }
 
 func NewDiskCachedEmbeddingIndex(embedder Embedder, writer io.Writer) *DiskCachedEmbeddingIndex {
@@ -101,6 +130,9 @@ func NewDiskCachedEmbeddingIndex(embedder Embedder, writer io.Writer) *DiskCache
 
 func (this *DiskCachedEmbeddingIndex) SetDefaultConfig() {
 	this.DotfileName = ".butterfish_index"
+	this.Format = IndexFormatFloat16
+	this.ApproximateThreshold = 20000
+	this.Chunkers = DefaultChunkers()
 	this.ChunksPerCall = 32
 }
 
@@ -156,11 +188,127 @@ func (this *DiskCachedEmbeddingIndex) Vectorize(ctx context.Context, content str
 	return embeddings[0], nil
 }
 
+// Search for the chunks most similar to queryVector, large indexes use the
+// approximate search graph unless ExactSearch is set
+func (this *DiskCachedEmbeddingIndex) SearchWithVector(ctx context.Context,
+	queryVector []float32, numResults int) ([]*VectorSearchResult, error) {
+	if this.ExactSearch || this.ApproximateThreshold <= 0 ||
+		this.chunkCount() < this.ApproximateThreshold {
+		return this.searchExact(ctx, queryVector, numResults)
+	}
+
+	if this.graph == nil {
+		start := time.Now()
+		graph, err := this.buildGraph(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if graph == nil {
+			// mixed dimensions, the exact search will explain
+			return this.searchExact(ctx, queryVector, numResults)
+		}
+		this.graph = graph
+		fmt.Fprintf(this.Out, "Built approximate search graph for %d chunks in %s\n",
+			graph.Len(), time.Since(start).Round(time.Millisecond))
+	}
+	if this.graph.dims != len(queryVector) {
+		return this.searchExact(ctx, queryVector, numResults)
+	}
+
+	return this.searchGraph(queryVector, numResults)
+}
+
+// Re-score the graph's candidates with the exact vectors
+func (this *DiskCachedEmbeddingIndex) searchGraph(queryVector []float32, numResults int) ([]*VectorSearchResult, error) {
+	query, err := govector.AsVector(queryVector)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := this.graph.Search(queryVector, max(hnswMinEfSearch, numResults*4))
+	results := make([]*VectorSearchResult, 0, len(refs))
+
+	for _, ref := range refs {
+		embedding := this.Index[ref.dirPath].Files[ref.name].Embeddings[ref.chunk]
+		vector := this.embeddingVector(ref.dirPath, ref.name, ref.chunk, embedding)
+
+		govec, err := govector.AsVector(vector)
+		if err != nil {
+			return nil, err
+		}
+		distance, err := govector.Cosine(query, govec)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, &VectorSearchResult{
+			Score:    distance,
+			FilePath: filepath.Join(ref.dirPath, ref.name),
+			Start:    embedding.Start,
+			End:      embedding.End,
+			Vector:   vector,
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	results = results[:util.Min(len(results), numResults)]
+
+	return results, nil
+}
+
+// Build the approximate search graph over every chunk, returns nil if the
+// chunks don't all have the same dimensions
+func (this *DiskCachedEmbeddingIndex) buildGraph(ctx context.Context) (*hnswGraph, error) {
+	if this.Verbosity >= 1 {
+		fmt.Fprintf(this.Out, "Building approximate search graph for %d chunks\n", this.chunkCount())
+	}
+
+	dirPaths := make([]string, 0, len(this.Index))
+	for dirPath := range this.Index {
+		dirPaths = append(dirPaths, dirPath)
+	}
+	sort.Strings(dirPaths)
+
+	var graph *hnswGraph
+	for _, dirPath := range dirPaths {
+		dirIndex := this.Index[dirPath]
+		for _, name := range sortedFileNames(dirIndex) {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			for i, embedding := range dirIndex.Files[name].Embeddings {
+				vector := this.embeddingVector(dirPath, name, i, embedding)
+				if graph == nil {
+					graph = newHNSWGraph(len(vector))
+				} else if len(vector) != graph.dims {
+					return nil, nil
+				}
+				graph.Add(chunkRef{dirPath, name, i}, vector)
+			}
+		}
+	}
+
+	return graph, nil
+}
+
+func (this *DiskCachedEmbeddingIndex) chunkCount() int {
+	count := 0
+	for _, dirIndex := range this.Index {
+		for _, file := range dirIndex.Files {
+			count += len(file.Embeddings)
+		}
+	}
+	return count
+}
+
 // Super naive vector search operation.
 // - First we brute force search by iterating over all stored vectors
 //     and calculating cosine distance
 // - Next we sort based on score
-func (this *DiskCachedEmbeddingIndex) SearchWithVector(ctx context.Context,
+func (this *DiskCachedEmbeddingIndex) searchExact(ctx context.Context,
 	queryVector []float32, numResults int) ([]*VectorSearchResult, error) {
 	// Turn queryVector float array into a govector
 	query, err := govector.AsVector(queryVector)
@@ -176,8 +324,16 @@ func (this *DiskCachedEmbeddingIndex) SearchWithVector(ctx context.Context,
 				return nil, ctx.Err()
 			}
 
-			for _, embedding := range fileIndex.Embeddings {
-				govec, err := govector.AsVector(embedding.Vector)
+			for i, embedding := range fileIndex.Embeddings {
+				vector := this.embeddingVector(dirIndexAbsPath, filename, i, embedding)
+
+				// Vectors from different embedding models can't be compared
+				if len(vector) != len(queryVector) {
+					return nil, fmt.Errorf("%s was indexed with a different embedding model (%d dimensions, the current model has %d), re-index it with --force",
+						filepath.Join(dirIndexAbsPath, filename), len(vector), len(queryVector))
+				}
+
+				govec, err := govector.AsVector(vector)
 
 				distance, err := govector.Cosine(query, govec)
 				if err != nil {
@@ -190,7 +346,7 @@ func (this *DiskCachedEmbeddingIndex) SearchWithVector(ctx context.Context,
 					FilePath: absPath,
 					Start:    embedding.Start,
 					End:      embedding.End,
-					Vector:   embedding.Vector,
+					Vector:   vector,
 				}
 				results = append(results, result)
 			}
@@ -248,8 +404,15 @@ func (this *DiskCachedEmbeddingIndex) PopulateSearchResults(ctx context.Context,
 
 // Assumes the path is a valid butterfish index file
 func (this *DiskCachedEmbeddingIndex) LoadDotfile(dotfile string) error {
-	dotfile = filepath.Clean(dotfile)
+	absPath, err := filepath.Abs(dotfile)
+	if err != nil {
+		return err
+	}
+	return this.loadIndexFile(filepath.Clean(dotfile), filepath.Dir(absPath))
+}
 
+// Load an index file for the directory at indexName, which is an absolute path
+func (this *DiskCachedEmbeddingIndex) loadIndexFile(dotfile, indexName string) error {
 	if this.Verbosity >= 2 {
 		fmt.Fprintf(this.Out, "DiskCachedEmbeddingIndex.LoadDotfile(%s)\n", dotfile)
 	}
@@ -261,11 +424,30 @@ func (this *DiskCachedEmbeddingIndex) LoadDotfile(dotfile string) error {
 	}
 	defer file.Close()
 
+	// Compact dotfiles are mapped rather than read, check the magic bytes
+	header := make([]byte, len(compactMagic))
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if isCompactIndex(header[:n]) {
+		err = this.loadCompactDotfile(dotfile, indexName)
+		if err != nil {
+			return fmt.Errorf("Unable to load %s: %s", dotfile, err)
+		}
+
+		if this.Verbosity >= 1 {
+			fmt.Fprintf(this.Out, "Loaded index cache at %s\n", dotfile)
+		}
+		return nil
+	}
+
 	// Read the entire file into a buffer
-	buf, err := ioutil.ReadAll(file)
+	rest, err := ioutil.ReadAll(file)
 	if err != nil {
 		return err
 	}
+	buf := append(header[:n], rest...)
 
 	// Unmarshal the buffer into a DirectoryIndex
 	var dirIndex pb.DirectoryIndex
@@ -274,13 +456,8 @@ func (this *DiskCachedEmbeddingIndex) LoadDotfile(dotfile string) error {
 		return err
 	}
 
-	absPath, err := filepath.Abs(dotfile)
-	if err != nil {
-		return err
-	}
-	indexName := filepath.Dir(absPath)
-
 	// put the loaded info in the memory index
+	this.forgetDirectory(indexName)
 	this.Index[indexName] = &dirIndex
 
 	if this.Verbosity >= 1 {
@@ -313,26 +490,53 @@ func (this *DiskCachedEmbeddingIndex) SavePath(path string) error {
 		return fmt.Errorf("No index found for %s", path)
 	}
 
-	buf, err := proto.Marshal(dirIndex)
-	if err != nil {
-		return err
+	var buf []byte
+	var err error
+	vectorAt := func(name string, i int, embedding *pb.AnnotatedEmbedding) []float32 {
+		return this.embeddingVector(path, name, i, embedding)
 	}
 
-	if this.DotfileName == "" {
-		panic("DotfileName not set")
+	if this.Format == IndexFormatProtobuf || this.Format == "" {
+		buf, err = proto.Marshal(withVectors(dirIndex, vectorAt))
+	} else {
+		buf, err = marshalCompact(dirIndex, this.Format, vectorAt)
+	}
+	if err != nil {
+		return err
 	}
 
-	dotfilePath := filepath.Join(path, this.DotfileName)
+	dotfilePath := this.indexFilePath(path)
 	if this.Verbosity >= 2 {
 		fmt.Fprintf(this.Out, "Writing index cache to %s\n", dotfilePath)
 	}
+	if this.StoreDir != "" {
+		err = this.Fs.MkdirAll(filepath.Dir(dotfilePath), 0755)
+		if err != nil {
+			return err
+		}
+	}
 
-	// Write the buffer to the dotfile
-	err = afero.WriteFile(this.Fs, dotfilePath, buf, 0644)
+	// Write the buffer to a temporary file and rename it over the dotfile,
+	// the dotfile may be memory-mapped and truncating it in place would break
+	// the mapping
+	tmpPath := dotfilePath + ".tmp"
+	err = afero.WriteFile(this.Fs, tmpPath, buf, 0644)
+	if err != nil {
+		return err
+	}
+	err = this.Fs.Rename(tmpPath, dotfilePath)
 	if err != nil {
 		return err
 	}
 
+	// Swap newly embedded vectors in memory for the mapped file
+	if this.Format != IndexFormatProtobuf && this.Format != "" {
+		err = this.loadCompactDotfile(dotfilePath, path)
+		if err != nil {
+			return err
+		}
+	}
+
 	if this.Verbosity >= 1 {
 		fmt.Fprintf(this.Out, "Saved index cache to %s\n", dotfilePath)
 	}
@@ -361,13 +565,13 @@ func (this *DiskCachedEmbeddingIndex) LoadPath(ctx context.Context, path string)
 		dirPath = filepath.Dir(path)
 	}
 
-	dotfiles, err := this.dotfilesInPath(ctx, dirPath)
+	files, err := this.indexFilesInPath(ctx, dirPath)
 	if err != nil {
 		return err
 	}
 
-	for _, dotfile := range dotfiles {
-		err := this.LoadDotfile(dotfile)
+	for _, file := range files {
+		err := this.loadIndexFile(file.path, file.dirPath)
 		if err != nil {
 			return err
 		}
@@ -397,6 +601,90 @@ func (this *DiskCachedEmbeddingIndex) IndexPaths(ctx context.Context, paths []st
 	return nil
 }
 
+// How much IndexPaths would embed, so that we can estimate the cost first
+type IndexEstimate struct {
+	Files  int
+	Bytes  int64
+	Chunks int
+	// Calls to the embedder, it gets ChunksPerCall chunks at a time
+	Calls int
+}
+
+// Walk the paths like IndexPaths and count what would be embedded, without
+// embedding anything or changing the index
+func (this *DiskCachedEmbeddingIndex) EstimatePaths(ctx context.Context, paths []string, forceUpdate bool, chunkSize, maxChunks int) (*IndexEstimate, error) {
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("Chunk size must be greater than 0")
+	}
+
+	estimate := &IndexEstimate{}
+	for _, path := range paths {
+		err := this.estimatePath(ctx, path, forceUpdate, chunkSize, maxChunks, estimate)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return estimate, nil
+}
+
+func (this *DiskCachedEmbeddingIndex) estimatePath(ctx context.Context, path string, forceUpdate bool, chunkSize, maxChunks int, estimate *IndexEstimate) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	fileInfo, err := this.Fs.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	var files []os.FileInfo
+	dirPath := path
+	if !fileInfo.IsDir() {
+		dirPath = filepath.Dir(path)
+		files = []os.FileInfo{fileInfo}
+	} else {
+		err = util.ForEachSubdir(this.Fs, path, func(path string) error {
+			if this.IndexableDirectory(path) {
+				return this.estimatePath(ctx, path, forceUpdate, chunkSize, maxChunks, estimate)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		files, err = afero.ReadDir(this.Fs, path)
+		if err != nil {
+			return nil
+		}
+	}
+
+	dirIndex, ok := this.Index[dirPath]
+	if !ok {
+		dirIndex = NewDirectoryIndex()
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !this.IndexableFile(dirPath, file, forceUpdate, dirIndex.Files[file.Name()]) {
+			continue
+		}
+
+		size := file.Size()
+		if maxChunks > 0 {
+			size = min(size, int64(chunkSize)*int64(maxChunks))
+		}
+		chunks := int((size + int64(chunkSize) - 1) / int64(chunkSize))
+		estimate.Files++
+		estimate.Bytes += size
+		estimate.Chunks += chunks
+		estimate.Calls += (chunks + this.ChunksPerCall - 1) / this.ChunksPerCall
+	}
+	return nil
+}
+
 // This is a bit of glue to make afero filesystems work with the vfs interface
 type vfsOpener struct {
 	fs afero.Fs
@@ -483,31 +771,6 @@ func (this *DiskCachedEmbeddingIndex) FilterUnindexablefiles(path string, files
 	return filteredFiles
 }
 
-func (this *DiskCachedEmbeddingIndex) dotfilesInPath(ctx context.Context, path string) ([]string, error) {
-	if ctx.Err() != nil {
-		return nil, ctx.Err()
-	}
-
-	dotfiles := []string{}
-
-	// Use Walk to search recursively for dotfiles
-	err := afero.Walk(this.Fs, path, func(path string, info os.FileInfo, err error) error {
-		if ctx.Err() != nil {
-			return ctx.Err()
-		}
-		if err != nil {
-			return err
-		}
-
-		if info.Name() == this.DotfileName {
-			dotfiles = append(dotfiles, path)
-		}
-		return nil
-	})
-
-	return dotfiles, err
-}
-
 func (this *DiskCachedEmbeddingIndex) ClearPaths(ctx context.Context, paths []string) error {
 	for _, path := range paths {
 		err := this.ClearPath(ctx, path)
@@ -527,29 +790,144 @@ func (this *DiskCachedEmbeddingIndex) ClearPath(ctx context.Context, path string
 		return err
 	}
 
-	dotfiles, err := this.dotfilesInPath(ctx, path)
+	files, err := this.indexFilesInPath(ctx, path)
 	if err != nil {
 		return err
 	}
 
-	for _, dotfile := range dotfiles {
+	for _, file := range files {
 		if this.Verbosity >= 2 {
-			fmt.Fprintf(this.Out, "Removing dotfile %s\n", dotfile)
+			fmt.Fprintf(this.Out, "Removing dotfile %s\n", file.path)
 		}
 
-		err = this.Fs.Remove(dotfile)
+		err = this.Fs.Remove(file.path)
 		if err != nil {
 			return err
 		}
 
 		// Remove the in-memory copy
-		dirPath := filepath.Dir(dotfile)
-		delete(this.Index, dirPath)
+		this.forgetDirectory(file.dirPath)
+	}
+
+	return nil
+}
+
+// Rewrite the dotfiles in paths in the current Format, e.g. to move from the
+// protobuf format to a compact one, without re-embedding anything
+func (this *DiskCachedEmbeddingIndex) MigratePaths(ctx context.Context, paths []string) error {
+	for _, path := range paths {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+
+		files, err := this.indexFilesInPath(ctx, path)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			err = this.loadIndexFile(file.path, file.dirPath)
+			if err != nil {
+				return err
+			}
+			err = this.SavePath(file.dirPath)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(this.Out, "Migrated %s to %s\n", file.path, this.Format)
+		}
+	}
+
+	return nil
+}
+
+// Load a compact dotfile, replacing any previously loaded copy of the
+// directory and releasing its mapping
+func (this *DiskCachedEmbeddingIndex) loadCompactDotfile(dotfile, dirPath string) error {
+	data, unmap, err := mapFile(this.Fs, dotfile)
+	if err != nil {
+		return err
+	}
+
+	dirIndex, vectors, err := unmarshalCompact(data)
+	if err != nil {
+		if unmap != nil {
+			unmap()
+		}
+		return err
 	}
+	vectors.unmap = unmap
 
+	this.forgetDirectory(dirPath)
+	if this.vectors == nil {
+		this.vectors = make(map[string]*compactVectors)
+	}
+	this.Index[dirPath] = dirIndex
+	this.vectors[dirPath] = vectors
 	return nil
 }
 
+// Remove a directory from the in-memory index and release its mapping
+func (this *DiskCachedEmbeddingIndex) forgetDirectory(dirPath string) {
+	delete(this.Index, dirPath)
+	this.graph = nil
+	if vectors, ok := this.vectors[dirPath]; ok {
+		vectors.close()
+		delete(this.vectors, dirPath)
+	}
+}
+
+// The vector for an embedding, which is either in memory or in the directory's
+// mapped compact dotfile
+func (this *DiskCachedEmbeddingIndex) embeddingVector(
+	dirPath, name string,
+	i int,
+	embedding *pb.AnnotatedEmbedding,
+) []float32 {
+	if len(embedding.Vector) > 0 {
+		return embedding.Vector
+	}
+
+	vectors, ok := this.vectors[dirPath]
+	if !ok {
+		return nil
+	}
+	row, ok := vectors.rows[name]
+	if !ok || i >= len(this.Index[dirPath].Files[name].Embeddings) {
+		return nil
+	}
+	return vectors.vector(row + i)
+}
+
+// A copy of dirIndex with every vector filled in, for writing the protobuf
+// format
+func withVectors(
+	dirIndex *pb.DirectoryIndex,
+	vectorAt func(name string, i int, embedding *pb.AnnotatedEmbedding) []float32,
+) *pb.DirectoryIndex {
+	result := NewDirectoryIndex()
+	for name, file := range dirIndex.Files {
+		copied := &pb.FileEmbeddings{
+			Path:      file.Path,
+			UpdatedAt: file.UpdatedAt,
+		}
+		for i, embedding := range file.Embeddings {
+			copied.Embeddings = append(copied.Embeddings, &pb.AnnotatedEmbedding{
+				Start:  embedding.Start,
+				End:    embedding.End,
+				Vector: vectorAt(name, i, embedding),
+			})
+		}
+		result.Files[name] = copied
+	}
+	return result
+}
+
 func (this *DiskCachedEmbeddingIndex) IndexedFiles() []string {
 	var paths []string
 	for path, dirIndex := range this.Index {
@@ -634,6 +1012,7 @@ func (this *DiskCachedEmbeddingIndex) IndexPath(ctx context.Context, path string
 		}
 
 		dirIndex.Files[name] = fileEmbeddings
+		this.graph = nil
 		fmt.Fprintf(this.Out, "Indexed %s\n", path)
 	}
 
@@ -668,12 +1047,30 @@ func (this *DiskCachedEmbeddingIndex) EmbedFile(ctx context.Context, path string
 		return nil, fmt.Errorf("Chunk size must be greater than 0")
 	}
 
-	// first we chunk the file
-	chunks, err := util.GetFileChunks(ctx, this.Fs, absPath, chunkSize, maxChunks)
+	// first we chunk the file, reading no more than maxChunks fixed size
+	// chunks would cover
+	file, err := this.Fs.Open(absPath)
+	if err != nil {
+		return nil, err
+	}
+	var reader io.Reader = file
+	if maxChunks > 0 {
+		reader = io.LimitReader(file, int64(chunkSize)*int64(maxChunks))
+	}
+	content, err := io.ReadAll(reader)
+	file.Close()
 	if err != nil {
 		return nil, err
 	}
-	stringChunks := util.ByteToString(chunks)
+
+	chunks := this.chunkerFor(absPath).Chunk(content, chunkSize)
+	if maxChunks > 0 && len(chunks) > maxChunks {
+		chunks = chunks[:maxChunks]
+	}
+	stringChunks := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		stringChunks[i] = string(content[chunk.Start:chunk.End])
+	}
 
 	// then we call the embedding API for each block of chunks
 	for i := 0; i < len(chunks); i += this.ChunksPerCall {
@@ -690,12 +1087,9 @@ func (this *DiskCachedEmbeddingIndex) EmbedFile(ctx context.Context, path string
 
 		// iterate through response, create an annotation, and create an annotated vector
 		for j, embedding := range newEmbeddings {
-			rangeStart := uint64(i+j) * uint64(chunkSize)
-			rangeEnd := rangeStart + uint64(len(callChunks[j]))
-
 			av := &pb.AnnotatedEmbedding{
-				Start:  rangeStart,
-				End:    rangeEnd,
+				Start:  uint64(chunks[i+j].Start),
+				End:    uint64(chunks[i+j].End),
 				Vector: embedding,
 			}
 			annotatedVectors = append(annotatedVectors, av)
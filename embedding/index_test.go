@@ -172,3 +172,24 @@ func TestFileCaching(t *testing.T) {
 
 	// TODO test showindexed
 }
+
+func TestEstimatePaths(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	index, embedder := newTestDiskCachedEmbeddingIndex(fs)
+	ctx := context.Background()
+
+	estimate, err := index.EstimatePaths(ctx, []string{"/a"}, false, 4, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, &IndexEstimate{Files: 4, Bytes: 24, Chunks: 8, Calls: 4}, estimate)
+	assert.Equal(t, 0, embedder.Calls)
+
+	// files that are already indexed are skipped unless forced
+	err = index.IndexPath(ctx, "/a/b/c", false, 4, 8)
+	assert.NoError(t, err)
+	estimate, err = index.EstimatePaths(ctx, []string{"/a"}, false, 4, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, estimate.Files)
+	estimate, err = index.EstimatePaths(ctx, []string{"/a"}, true, 4, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, &IndexEstimate{Files: 4, Bytes: 16, Chunks: 4, Calls: 4}, estimate)
+}
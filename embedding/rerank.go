@@ -0,0 +1,148 @@
+package embedding
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// Reranking re-scores search results with a model that reads the query and
+// each snippet together. This is slower than cosine similarity but much better
+// at telling snippets that answer the query apart from ones that are merely on
+// the same topic, so we fetch extra candidates by cosine similarity and let the
+// reranker pick the best of them.
+
+type Reranker interface {
+	// Returns a relevance score for each document, in the same order, higher
+	// is more relevant
+	Rerank(ctx context.Context, query string, documents []string) ([]float64, error)
+}
+
+// Rerank results and return the top numResults, the result scores are
+// replaced with the reranker's scores
+func RerankResults(
+	ctx context.Context,
+	reranker Reranker,
+	query string,
+	results []*VectorSearchResult,
+	numResults int,
+) ([]*VectorSearchResult, error) {
+	if len(results) == 0 {
+		return results, nil
+	}
+
+	documents := make([]string, len(results))
+	for i, result := range results {
+		documents[i] = result.Content
+	}
+
+	scores, err := reranker.Rerank(ctx, query, documents)
+	if err != nil {
+		return nil, err
+	}
+	if len(scores) != len(results) {
+		return nil, fmt.Errorf("Expected %d rerank scores but got %d", len(results), len(scores))
+	}
+
+	reranked := make([]*VectorSearchResult, len(results))
+	copy(reranked, results)
+	for i, result := range reranked {
+		result.Score = scores[i]
+	}
+	// stable so that ties keep their cosine similarity order
+	sort.SliceStable(reranked, func(i, j int) bool {
+		return reranked[i].Score > reranked[j].Score
+	})
+
+	if numResults < len(reranked) {
+		reranked = reranked[:numResults]
+	}
+	return reranked, nil
+}
+
+// Calls a cross-encoder rerank endpoint using the request format shared by
+// Cohere, Jina, Infinity, vLLM, and llama.cpp, i.e. POST
+// {"model", "query", "documents"} and get back
+// {"results": [{"index", "relevance_score"}, ...]}.
+type EndpointReranker struct {
+	URL    string
+	Model  string
+	Client *http.Client
+}
+
+func NewEndpointReranker(url, model string) *EndpointReranker {
+	return &EndpointReranker{
+		URL:    url,
+		Model:  model,
+		Client: http.DefaultClient,
+	}
+}
+
+type rerankRequest struct {
+	Model     string   `json:"model,omitempty"`
+	Query     string   `json:"query"`
+	Documents []string `json:"documents"`
+}
+
+type rerankResponse struct {
+	Results []struct {
+		Index          int     `json:"index"`
+		RelevanceScore float64 `json:"relevance_score"`
+	} `json:"results"`
+}
+
+func (this *EndpointReranker) Rerank(ctx context.Context, query string, documents []string) ([]float64, error) {
+	body, err := json.Marshal(&rerankRequest{
+		Model:     this.Model,
+		Query:     query,
+		Documents: documents,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", this.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := this.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Rerank request to %s failed: %s", this.URL, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Rerank request failed with status %d: %s", resp.StatusCode, string(data))
+	}
+
+	var result rerankResponse
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse rerank response: %s", err)
+	}
+
+	scores := make([]float64, len(documents))
+	seen := make([]bool, len(documents))
+	for _, ranked := range result.Results {
+		if ranked.Index < 0 || ranked.Index >= len(documents) || seen[ranked.Index] {
+			return nil, fmt.Errorf("Rerank response has an invalid index %d", ranked.Index)
+		}
+		scores[ranked.Index] = ranked.RelevanceScore
+		seen[ranked.Index] = true
+	}
+	if len(result.Results) != len(documents) {
+		return nil, fmt.Errorf("Expected %d rerank results but got %d", len(documents), len(result.Results))
+	}
+
+	return scores, nil
+}
@@ -0,0 +1,59 @@
+package embedding
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type lengthReranker struct{}
+
+// Scores longer documents higher
+func (this *lengthReranker) Rerank(ctx context.Context, query string, documents []string) ([]float64, error) {
+	scores := []float64{}
+	for _, document := range documents {
+		scores = append(scores, float64(len(document)))
+	}
+	return scores, nil
+}
+
+func TestRerankResults(t *testing.T) {
+	results := []*VectorSearchResult{
+		{FilePath: "a", Content: "x", Score: 0.9},
+		{FilePath: "b", Content: "xxx", Score: 0.8},
+		{FilePath: "c", Content: "xx", Score: 0.7},
+	}
+
+	reranked, err := RerankResults(context.Background(), &lengthReranker{}, "q", results, 2)
+	assert.Nil(t, err)
+	assert.Len(t, reranked, 2)
+	assert.Equal(t, "b", reranked[0].FilePath)
+	assert.Equal(t, "c", reranked[1].FilePath)
+	assert.Equal(t, 3.0, reranked[0].Score)
+}
+
+func TestEndpointReranker(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req rerankRequest
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, "bge-reranker", req.Model)
+		assert.Equal(t, "query", req.Query)
+
+		// results come back sorted by relevance rather than input order
+		w.Write([]byte(`{"results": [{"index": 1, "relevance_score": 0.9}, {"index": 0, "relevance_score": 0.1}]}`))
+	}))
+	defer server.Close()
+
+	reranker := NewEndpointReranker(server.URL, "bge-reranker")
+	scores, err := reranker.Rerank(context.Background(), "query", []string{"a", "b"})
+	assert.Nil(t, err)
+	assert.Equal(t, []float64{0.1, 0.9}, scores)
+
+	// every document needs a score
+	_, err = reranker.Rerank(context.Background(), "query", []string{"a", "b", "c"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,108 @@
+package embedding
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// What's indexed under a path, for deciding when to re-index
+type IndexStats struct {
+	Path        string `json:"path"`
+	Directories int    `json:"directories"`
+	Files       int    `json:"files"`
+	Chunks      int    `json:"chunks"`
+	// Size of the index files on disk
+	DiskBytes int64 `json:"disk_bytes"`
+	// When the least and most recently embedded files were embedded, zero if
+	// nothing is indexed
+	Oldest time.Time `json:"oldest"`
+	Newest time.Time `json:"newest"`
+	// Indexed files that have been modified since they were embedded, and
+	// ones that no longer exist
+	Stale   []string `json:"stale"`
+	Deleted []string `json:"deleted"`
+}
+
+// Stats for the index files at or under path, loading any that aren't loaded
+// yet
+func (this *DiskCachedEmbeddingIndex) Stats(ctx context.Context, path string) (*IndexStats, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stats of a file are the stats of its directory's index
+	dirPath := path
+	fileInfo, err := this.Fs.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fileInfo.IsDir() {
+		dirPath = filepath.Dir(path)
+	}
+
+	files, err := this.indexFilesInPath(ctx, dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &IndexStats{Path: path}
+	for _, file := range files {
+		if !fileInfo.IsDir() && file.dirPath != dirPath {
+			continue
+		}
+
+		info, err := this.Fs.Stat(file.path)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := this.Index[file.dirPath]; !ok {
+			err = this.loadIndexFile(file.path, file.dirPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+		dirIndex, ok := this.Index[file.dirPath]
+		if !ok {
+			continue
+		}
+
+		stats.Directories++
+		stats.DiskBytes += info.Size()
+
+		for name, embeddings := range dirIndex.Files {
+			filePath := filepath.Join(file.dirPath, name)
+			if filePath != path && !fileInfo.IsDir() {
+				continue
+			}
+
+			stats.Files++
+			stats.Chunks += len(embeddings.Embeddings)
+
+			updatedAt := embeddings.UpdatedAt.AsTime()
+			if stats.Oldest.IsZero() || updatedAt.Before(stats.Oldest) {
+				stats.Oldest = updatedAt
+			}
+			if updatedAt.After(stats.Newest) {
+				stats.Newest = updatedAt
+			}
+
+			// Compare like IndexableFile does, in whole seconds
+			info, err := this.Fs.Stat(filePath)
+			if os.IsNotExist(err) {
+				stats.Deleted = append(stats.Deleted, filePath)
+			} else if err != nil {
+				return nil, err
+			} else if info.ModTime().Unix() > updatedAt.Unix() {
+				stats.Stale = append(stats.Stale, filePath)
+			}
+		}
+	}
+
+	sort.Strings(stats.Stale)
+	sort.Strings(stats.Deleted)
+	return stats, nil
+}
@@ -0,0 +1,40 @@
+package embedding
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	ctx := context.Background()
+	assert.NoError(t, index.IndexPath(ctx, "/a", false, 2, 8))
+
+	// a new index loads what it needs
+	index, _ = newTestDiskCachedEmbeddingIndex(fs)
+	later := time.Now().Add(time.Hour)
+	assert.NoError(t, fs.Chtimes("/a/two", later, later))
+	assert.NoError(t, fs.Remove("/a/b/nine"))
+
+	stats, err := index.Stats(ctx, "/a")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, stats.Directories)
+	assert.Equal(t, 4, stats.Files)
+	assert.Equal(t, 12, stats.Chunks)
+	assert.Greater(t, stats.DiskBytes, int64(0))
+	assert.False(t, stats.Oldest.After(stats.Newest))
+	assert.Equal(t, []string{"/a/two"}, stats.Stale)
+	assert.Equal(t, []string{"/a/b/nine"}, stats.Deleted)
+
+	// a file only counts itself
+	stats, err = index.Stats(ctx, "/a/one")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.Directories)
+	assert.Equal(t, 1, stats.Files)
+	assert.Equal(t, 3, stats.Chunks)
+	assert.Empty(t, stats.Stale)
+}
@@ -0,0 +1,114 @@
+package embedding
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+// By default each indexed directory gets a .butterfish_index dotfile, which
+// travels with the directory but scatters files through a repo that then need
+// to be ignored in git. With the central store, selected with index_store:
+// central in config.yaml, index files are instead kept under one directory,
+// e.g. ~/.local/state/butterfish/index/<repo>-<hash>/<hash>, grouped by the
+// repo containing them and named by a hash of the absolute path of the
+// directory they index. Dotfiles are still loaded in that mode when a
+// directory has no index in the store, e.g. ones checked into a repo.
+
+const (
+	IndexStoreDirectory = "directory"
+	IndexStoreCentral   = "central"
+)
+
+var IndexStores = []string{IndexStoreDirectory, IndexStoreCentral}
+
+// An index file and the absolute path of the directory it indexes
+type indexFile struct {
+	path    string
+	dirPath string
+}
+
+func pathHash(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(sum[:8])
+}
+
+// The closest directory at or above dirPath containing .git, or the root of
+// the filesystem if there's no repo
+func (this *DiskCachedEmbeddingIndex) repoRoot(dirPath string) string {
+	for dir := dirPath; ; dir = filepath.Dir(dir) {
+		if _, err := this.Fs.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir
+		}
+		if filepath.Dir(dir) == dir {
+			return dir
+		}
+	}
+}
+
+// Where the index for an absolute directory path is saved
+func (this *DiskCachedEmbeddingIndex) indexFilePath(dirPath string) string {
+	if this.StoreDir == "" {
+		if this.DotfileName == "" {
+			panic("DotfileName not set")
+		}
+		return filepath.Join(dirPath, this.DotfileName)
+	}
+
+	root := this.repoRoot(dirPath)
+	name := filepath.Base(root)
+	if name == string(filepath.Separator) || name == "." {
+		name = "root"
+	}
+	repoDir := fmt.Sprintf("%s-%s", name, pathHash(root))
+	return filepath.Join(this.StoreDir, repoDir, pathHash(dirPath))
+}
+
+// Find the index files for directories at or under path. In the central
+// store a directory's file there wins over its dotfile.
+func (this *DiskCachedEmbeddingIndex) indexFilesInPath(ctx context.Context, path string) ([]indexFile, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []indexFile{}
+	stored := map[string]bool{}
+
+	// Use Walk to search recursively for dotfiles, and for directories with
+	// a file in the store
+	err = afero.Walk(this.Fs, path, func(path string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() && this.StoreDir != "" {
+			storePath := this.indexFilePath(path)
+			if _, err := this.Fs.Stat(storePath); err == nil {
+				files = append(files, indexFile{storePath, path})
+				stored[path] = true
+			}
+			return nil
+		}
+
+		dirPath := filepath.Dir(path)
+		if info.Name() == this.DotfileName && !stored[dirPath] {
+			files = append(files, indexFile{path, dirPath})
+		}
+		return nil
+	})
+
+	return files, err
+}
@@ -0,0 +1,55 @@
+package embedding
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCentralStore(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	assert.NoError(t, fs.MkdirAll("/a/.git", 0755))
+	index, embedder := newTestDiskCachedEmbeddingIndex(fs)
+	index.StoreDir = "/store"
+	ctx := context.Background()
+
+	assert.NoError(t, index.IndexPath(ctx, "/a", false, 512, 8))
+	exists, err := afero.Exists(fs, "/a/.butterfish_index")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// files for the repo are grouped together, keyed by directory
+	storePath := index.indexFilePath("/a/b")
+	assert.Equal(t, filepath.Join("/store", "a-"+pathHash("/a"), pathHash("/a/b")), storePath)
+	exists, err = afero.Exists(fs, storePath)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	// a new index loads from the store without re-embedding
+	calls := embedder.Calls
+	index, _ = newTestDiskCachedEmbeddingIndex(fs)
+	index.StoreDir = "/store"
+	assert.NoError(t, index.LoadPath(ctx, "/a/b"))
+	assert.ElementsMatch(t, []string{"/a/b/nine", "/a/b/c/d/four"}, index.IndexedFiles())
+	assert.NoError(t, index.IndexPath(ctx, "/a", false, 512, 8))
+	assert.Equal(t, calls, embedder.Calls)
+
+	// dotfiles are still loaded for directories that aren't in the store
+	dotfiles, _ := newTestDiskCachedEmbeddingIndex(fs)
+	assert.NoError(t, dotfiles.IndexPath(ctx, "/a/b/c", false, 512, 8))
+	assert.NoError(t, index.ClearPath(ctx, "/a/b/c"))
+	exists, err = afero.Exists(fs, "/a/b/c/d/.butterfish_index")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = afero.Exists(fs, index.indexFilePath("/a/b/c/d"))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	index, _ = newTestDiskCachedEmbeddingIndex(fs)
+	index.StoreDir = "/store"
+	assert.NoError(t, index.LoadPath(ctx, "/a/b/c"))
+	assert.Equal(t, []string{"/a/b/c/d/four"}, index.IndexedFiles())
+}
@@ -0,0 +1,241 @@
+package embedding
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watching keeps the index up to date as files change, so that `index` doesn't
+// need to be re-run by hand. fsnotify watches aren't recursive so we watch
+// every indexable directory, and add watches as directories are created.
+// Events are debounced since editors and tools like git touch many files in
+// quick succession, then only the files that changed are re-embedded.
+
+// Remove a file's embeddings, e.g. because it was deleted, and update the
+// dotfile for its directory
+func (this *DiskCachedEmbeddingIndex) RemoveFile(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	dirPath := filepath.Dir(path)
+	name := filepath.Base(path)
+	dirIndex, ok := this.Index[dirPath]
+	if !ok {
+		return nil
+	}
+	if _, ok := dirIndex.Files[name]; !ok {
+		return nil
+	}
+
+	delete(dirIndex.Files, name)
+	this.graph = nil
+	fmt.Fprintf(this.Out, "Removed %s\n", path)
+
+	if len(dirIndex.Files) > 0 {
+		return this.SavePath(dirPath)
+	}
+
+	this.forgetDirectory(dirPath)
+	err = this.Fs.Remove(this.indexFilePath(dirPath))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Forget everything indexed at or under a directory that no longer exists,
+// its dotfiles went with it
+func (this *DiskCachedEmbeddingIndex) removeDirectory(path string) {
+	for dirPath := range this.Index {
+		if dirPath == path || strings.HasPrefix(dirPath, path+string(filepath.Separator)) {
+			this.forgetDirectory(dirPath)
+			fmt.Fprintf(this.Out, "Removed %s\n", dirPath)
+		}
+	}
+}
+
+// Watch paths and re-index files as they change until the context is
+// cancelled. Changes are batched until nothing has changed for the debounce
+// duration. Errors while re-indexing are logged rather than returned so that a
+// flaky embeddings API doesn't stop the watcher.
+func (this *DiskCachedEmbeddingIndex) WatchPaths(
+	ctx context.Context,
+	paths []string,
+	chunkSize, maxChunks int,
+	debounce time.Duration,
+) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	targets := &watchTargets{files: map[string]bool{}}
+	for _, path := range paths {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			targets.dirs = append(targets.dirs, path)
+		} else {
+			targets.files[path] = true
+		}
+		err = this.watchDirectory(watcher, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(this.Out, "Watching %s for changes, press Ctrl-C to stop\n", strings.Join(paths, ", "))
+
+	pending := make(map[string]bool)
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !this.watchedEvent(event) || !targets.includes(event.Name) {
+				continue
+			}
+			pending[event.Name] = true
+			timer.Reset(debounce)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			this.logActivity("Watch error: %s", err)
+
+		case <-timer.C:
+			changed := make([]string, 0, len(pending))
+			for path := range pending {
+				changed = append(changed, path)
+			}
+			sort.Strings(changed)
+			pending = make(map[string]bool)
+
+			this.reindexChanged(ctx, watcher, changed, chunkSize, maxChunks)
+		}
+	}
+}
+
+// The paths WatchPaths was asked to watch. A file is watched through its
+// directory, so events for its siblings have to be filtered out.
+type watchTargets struct {
+	dirs  []string
+	files map[string]bool
+}
+
+func (this *watchTargets) includes(path string) bool {
+	if this.files[path] {
+		return true
+	}
+	for _, dir := range this.dirs {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add watches for a directory and its indexable subdirectories, a path to a
+// single file watches its directory
+func (this *DiskCachedEmbeddingIndex) watchDirectory(watcher *fsnotify.Watcher, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return watcher.Add(filepath.Dir(path))
+	}
+
+	return filepath.WalkDir(path, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if !this.IndexableDirectory(path) {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+// Skip events we don't care about, including writes to our own dotfiles
+func (this *DiskCachedEmbeddingIndex) watchedEvent(event fsnotify.Event) bool {
+	if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) &&
+		!event.Has(fsnotify.Remove) && !event.Has(fsnotify.Rename) {
+		return false
+	}
+
+	name := filepath.Base(event.Name)
+	return name != this.DotfileName && !strings.HasPrefix(name, ".")
+}
+
+func (this *DiskCachedEmbeddingIndex) logActivity(format string, args ...any) {
+	fmt.Fprintf(this.Out, "%s %s\n", time.Now().Format("15:04:05"), fmt.Sprintf(format, args...))
+}
+
+func (this *DiskCachedEmbeddingIndex) reindexChanged(
+	ctx context.Context,
+	watcher *fsnotify.Watcher,
+	changed []string,
+	chunkSize, maxChunks int,
+) {
+	this.logActivity("%d changed: %s", len(changed), strings.Join(changed, ", "))
+
+	for _, path := range changed {
+		if ctx.Err() != nil {
+			return
+		}
+
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			// deleted or renamed away, a rename also creates the new path
+			this.removeDirectory(path)
+			err = this.RemoveFile(path)
+		} else if err == nil && info.IsDir() {
+			if !this.IndexableDirectory(path) {
+				continue
+			}
+			err = this.watchDirectory(watcher, path)
+			if err == nil {
+				err = this.IndexPath(ctx, path, false, chunkSize, maxChunks)
+			}
+		} else if err == nil {
+			// we know the file changed so skip the modification time check,
+			// which only has second granularity
+			err = this.IndexPath(ctx, path, true, chunkSize, maxChunks)
+		}
+
+		if err != nil {
+			this.logActivity("Failed to update %s: %s", path, err)
+		}
+	}
+
+	this.logActivity("Index up to date, %d files indexed", len(this.IndexedFiles()))
+}
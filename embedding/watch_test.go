@@ -0,0 +1,83 @@
+package embedding
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoveFile(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	assert.NoError(t, index.IndexPath(context.Background(), "/a", false, 2, 8))
+
+	assert.NoError(t, index.RemoveFile("/a/one"))
+	assert.NotContains(t, index.IndexedFiles(), "/a/one")
+	assert.Contains(t, index.IndexedFiles(), "/a/two")
+
+	// removing the last file in a directory removes its dotfile
+	assert.NoError(t, index.RemoveFile("/a/b/nine"))
+	exists, err := afero.Exists(fs, "/a/b/.butterfish_index")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestWatchPaths(t *testing.T) {
+	dir := t.TempDir()
+	index, embedder := newTestDiskCachedEmbeddingIndex(afero.NewOsFs())
+	index.Out = io.Discard
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- index.WatchPaths(ctx, []string{dir}, 2, 8, 10*time.Millisecond)
+	}()
+
+	// wait for the watcher to pick up a new file and write the dotfile
+	dotfile := filepath.Join(dir, index.DotfileName)
+	assert.Eventually(t, func() bool {
+		os.WriteFile(filepath.Join(dir, "new.txt"), []byte("hello"), 0644)
+		_, err := os.Stat(dotfile)
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	cancel()
+	assert.NoError(t, <-done)
+	assert.Contains(t, index.IndexedFiles(), filepath.Join(dir, "new.txt"))
+	assert.Greater(t, embedder.Calls, 0)
+}
+
+func TestWatchFile(t *testing.T) {
+	dir := t.TempDir()
+	watched := filepath.Join(dir, "watched.txt")
+	sibling := filepath.Join(dir, "sibling.txt")
+	assert.NoError(t, os.WriteFile(watched, []byte("hello"), 0644))
+	index, _ := newTestDiskCachedEmbeddingIndex(afero.NewOsFs())
+	index.Out = io.Discard
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- index.WatchPaths(ctx, []string{watched}, 2, 8, 10*time.Millisecond)
+	}()
+
+	// the file's directory is watched, but only the file is re-indexed
+	dotfile := filepath.Join(dir, index.DotfileName)
+	assert.Eventually(t, func() bool {
+		os.WriteFile(sibling, []byte("not asked for"), 0644)
+		os.WriteFile(watched, []byte("hello again"), 0644)
+		_, err := os.Stat(dotfile)
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	cancel()
+	assert.NoError(t, <-done)
+	assert.Contains(t, index.IndexedFiles(), watched)
+	assert.NotContains(t, index.IndexedFiles(), sibling)
+}
@@ -5,7 +5,9 @@ const (
 	PromptSummarize            = "summarize"
 	PromptSummarizeFacts       = "summarize_facts"
 	PromptSummarizeListOfFacts = "summarize_list_of_facts"
+	PromptSummarizeMergeFacts  = "summarize_merge_facts"
 	PromptGenerateCommand      = "generate_command"
+	PromptGenerateExplained    = "generate_command_explained"
 	PromptQuestion             = "question"
 	PromptSystemMessage        = "prompt_system_message"
 	ShellAutosuggestCommand    = "shell_autocomplete_command"
@@ -13,6 +15,23 @@ const (
 	ShellAutosuggestPrompt     = "shell_autocomplete_prompt"
 	ShellSystemMessage         = "shell_system_message"
 	GoalModeSystemMessage      = "goal_mode_system_message"
+	ShellAutoDebug             = "shell_auto_debug"
+	PromptExplainCommand       = "explain_command"
+	PromptRerank               = "rerank"
+	PromptCommitMessage        = "commit_message"
+	PromptSummarizeDiff        = "summarize_diff"
+	PromptReviewDiff           = "review_diff"
+	PromptGenerateTests        = "generate_tests"
+	ShellInlineEdit            = "shell_inline_edit"
+	PromptSummarizeDirectory   = "summarize_directory"
+	PromptSummarizeProject     = "summarize_project"
+	PromptWatchAnnotate        = "watch_annotate"
+	PromptTailQuestion         = "tail_question"
+
+	// Prompts named with this prefix are shortcuts in shell mode, e.g.
+	// shortcut_review runs when a prompt starts with "Review:", or "/review"
+	// after the prompt prefix
+	ShortcutPrefix = "shortcut_"
 )
 
 // These are the default prompts used for Butterfish, they will be written
@@ -107,7 +126,76 @@ predicted question:
 		'''
 		We want to do several things:
 		1. Explain to the user why the command probably failed. If unsure, explain that you do not know.
-		2. Edit the command to fix the problem, don't use placeholders. If unsure, explain that you do not know. If sure, then a new line beginning with '>' and then have the updated command. The final line of your response should only have the updated command.`,
+		2. Edit the command to fix the problem, don't use placeholders. If unsure, explain that you do not know. If sure, call the fix_command function with your explanation and the updated command. If you can't call functions, then a new line beginning with '>' and then have the updated command. The final line of your response should only have the updated command.`,
+	},
+
+	// ShellAutoDebug is used in shell mode with --auto-debug when a command
+	// exits with a non-zero status
+	{
+		Name:        ShellAutoDebug,
+		OkToReplace: true,
+		Prompt: `The command "{command}" just failed with exit code {status}. The output from the command is below.
+'''
+{output}
+'''
+In at most 3 short sentences, explain the most likely cause. If there is an obvious fix, put the fixed command on a final line beginning with '>'. Don't repeat the output back.`,
+	},
+
+	// PromptWatchAnnotate is used by butterfish watch when the output of the
+	// watched command looks wrong, the response is printed inline
+	{
+		Name:        PromptWatchAnnotate,
+		OkToReplace: true,
+		Prompt: `The long-running command "{command}" is being watched and {reason}. Its recent output is below.
+'''
+{output}
+'''
+In at most 2 short sentences, say what looks wrong and what to check. If nothing is actually wrong, respond with only OK. Don't repeat the output back.`,
+	},
+
+	// PromptTailQuestion is used by butterfish tail with a question, each time
+	// new lines are summarized
+	{
+		Name:        PromptTailQuestion,
+		OkToReplace: true,
+		Prompt: `These are facts summarized from the log file {path} so far.
+'''
+{facts}
+'''
+These lines were just added to it.
+'''
+{content}
+'''
+The user asked: {question}
+If the new lines answer the question or show what the user asked to be told about, answer in at most 3 short sentences. Otherwise respond with only NOTHING.`,
+	},
+
+	// ShellInlineEdit is used in shell mode to rewrite the command being typed
+	// with an instruction, the response replaces the command as is
+	{
+		Name:        ShellInlineEdit,
+		OkToReplace: true,
+		Prompt: `Rewrite this shell command following the instruction.
+Command: {command}
+Instruction: {instruction}
+System info: {sysinfo}
+Respond with only the rewritten command on a single line, no explanation and no code block.`,
+	},
+
+	// PromptExplainCommand is used by the explain command, the response is
+	// structured output so the format is set by a JSON schema
+	{
+		Name:        PromptExplainCommand,
+		OkToReplace: true,
+		Prompt: `Explain this shell command as a man page would, for a user who wants to understand exactly what it does before running it.
+'''
+{command}
+'''
+It has been split into these pipeline stages, explain each one in order:
+{stages}
+{{if .docs}}Here are extracts from the documentation installed on this machine. Base your explanation of flags on them rather than on memory, since they match the installed versions, and say so if a flag isn't supported by the installed version:
+{docs}
+{{end}}For each stage explain every flag and argument individually. Summarize what the whole command does in one or two sentences. List any warnings, e.g. if the command deletes data, needs elevated privileges, or behaves differently across platforms, otherwise leave warnings empty.`,
 	},
 
 	// PromptSummarize is a prompt for summarizing a command
@@ -146,6 +234,45 @@ Summary:`,
 Description and Important Facts:`,
 	},
 
+	// PromptSummarizeMergeFacts condenses lists of facts from consecutive parts
+	// of a document when there are too many to summarize in one request
+	{
+		Name:        PromptSummarizeMergeFacts,
+		OkToReplace: true,
+		Prompt: `The following are lists of facts from consecutive parts of a document, merge them into a single shorter bullet-point list, dropping repeated and minor facts and keeping the most important first.
+'''
+{content}
+'''
+
+Facts:`,
+	},
+
+	// PromptSummarizeDirectory rolls up the summaries of a directory's files
+	// and subdirectories when summarizing a directory tree
+	{
+		Name:        PromptSummarizeDirectory,
+		OkToReplace: true,
+		Prompt: `The following are summaries of the files and subdirectories in the directory {path}. Write a short description of what the directory contains and what it's for, in at most 5 sentences. Mention the most important files.
+'''
+{content}
+'''
+
+Description:`,
+	},
+
+	// PromptSummarizeProject writes the overview at the top of a directory
+	// tree summary from the summaries of its files and subdirectories
+	{
+		Name:        PromptSummarizeProject,
+		OkToReplace: true,
+		Prompt: `The following are summaries of the files and subdirectories at the top of the project {path}. Write an overview of the whole project: what it does, how it's organized, and its main components, in a paragraph followed by a bulleted list of the directories and what each is for.
+'''
+{content}
+'''
+
+Overview:`,
+	},
+
 	// PromptGenerateCommand is a prompt for generating a command
 	{
 		Name:        PromptGenerateCommand,
@@ -158,14 +285,108 @@ Description and Important Facts:`,
 Shell command:`,
 	},
 
+	// PromptGenerateExplained is used by gencmd --json and --explain, the
+	// response is structured output with the command and a rationale
+	{
+		Name:        PromptGenerateExplained,
+		OkToReplace: true,
+		Prompt: `Write a shell command that accomplishes the following goal, and explain in one short line how it does it.
+'''
+{content}
+'''`,
+	},
+
 	// PromptQuestion is a prompt for answering a question
 	{
 		Name:        PromptQuestion,
 		OkToReplace: true,
-		Prompt: `Answer this question about files stored on disk. Here are some snippets from the file separated by '---'.
+		Prompt: `Answer this question about files stored on disk. Here are some numbered snippets from the files separated by '---', each starts with its number and the file and lines it came from. Cite the snippets you use by number in square brackets, e.g. [1].
 '''
 {snippets}
 '''
 {question}:`,
 	},
+
+	{
+		Name:        PromptRerank,
+		OkToReplace: true,
+		Prompt: `Rate how relevant each numbered snippet is to the search query, from 0 (unrelated) to 10 (directly answers it). Rate every snippet.
+Query: {query}
+
+{snippets}`,
+	},
+
+	// PromptCommitMessage is used by the commit command, {diff} is either the
+	// staged diff or summaries of its chunks if the diff is large
+	{
+		Name:        PromptCommitMessage,
+		OkToReplace: true,
+		Prompt: `Write a git commit message for these changes in the conventional commit style. The first line is a summary of at most 72 characters in the form "type(scope): description", where type is one of feat, fix, docs, style, refactor, perf, test, build, ci, or chore, and the scope is optional. Then a blank line and a body that explains what changed and why, wrapped at 72 characters. Respond with only the commit message.
+'''
+{diff}
+'''`,
+	},
+
+	// PromptSummarizeDiff summarizes a chunk of a diff too large to send whole
+	{
+		Name:        PromptSummarizeDiff,
+		OkToReplace: true,
+		Prompt: `This is part of a git diff. Summarize the changes it makes as a short list, naming the files and what changed in each.
+'''
+{diff}
+'''`,
+	},
+
+	// PromptReviewDiff is used by the review command for each chunk of a diff,
+	// the response is structured output so the format is set by a JSON schema
+	{
+		Name:        PromptReviewDiff,
+		OkToReplace: true,
+		Prompt: `Review this part of a unified diff as an experienced code reviewer. Comment on bugs, security problems, unhandled errors, race conditions, performance problems, and confusing code in the changed lines. Don't comment on style nits or praise the code, and don't comment on code outside the diff. Use severity error for bugs and security problems, warning for likely problems, and info for suggestions. Added and unchanged lines are prefixed with their line number in the new file, use those numbers for the line of each comment. Return no comments if there's nothing worth saying.
+'''
+{diff}
+'''`,
+	},
+
+	// PromptGenerateTests is used by the gentest command, which follows it with
+	// the numbered lines of the test file so the model can use the edit tool
+	{
+		Name:        PromptGenerateTests,
+		OkToReplace: true,
+		Prompt: `Write {language} tests for the source file {path} using {framework}. The tests go in {test_path}, which I'll give you next with line numbers, use the edit tool to write them. If it already has tests, add tests for what isn't covered yet and keep the existing ones. Cover the exported functions and the important edge cases and error paths, but don't test private details that are likely to change. Only use imports and helpers that exist. {notes}
+'''
+{source}
+'''`,
+	},
+
+	// Shortcuts get the text typed after the shortcut as {args}, and the last
+	// shell command and its output as {command} and {output}, which are empty
+	// if the last thing in the history isn't a command
+	{
+		Name:        ShortcutPrefix + "review",
+		OkToReplace: true,
+		Prompt: `Review {{if .command}}the output of "{command}"{{else}}this{{end}} as an experienced engineer. Point out bugs, security problems, and anything confusing, most important first, and skip style nits.{{if .args}} {args}{{end}}
+{{if .output}}'''
+{output}
+'''{{end}}`,
+	},
+
+	{
+		Name:        ShortcutPrefix + "explain",
+		OkToReplace: true,
+		Prompt: `{{if .args}}Explain {args}{{else}}Explain what the last command did and what its output means{{end}}. Keep it short.
+{{if .command}}The last command was "{command}" and its output was:
+'''
+{output}
+'''{{end}}`,
+	},
+
+	{
+		Name:        ShortcutPrefix + "tldr",
+		OkToReplace: true,
+		Prompt: `Summarize {{if .command}}the output of "{command}"{{else}}our conversation so far{{end}} in at most 5 short bullet points{{if .args}}, focusing on {args}{{end}}.
+{{if .output}}'''
+{output}
+'''{{end}}`,
+	},
 }
@@ -8,7 +8,6 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strings"
 
 	yaml "gopkg.in/yaml.v2"
@@ -20,11 +19,68 @@ import (
 // allowing the user to manage their own custom prompts, replacing the
 // defaults.
 
-// Prompt struct with fields Name, Prompt string, OkToReplace bool
+// Prompt struct with fields Name, Prompt string, OkToReplace bool, and
+// optional Variants for specific models
 type Prompt struct {
 	Name        string
 	Prompt      string
 	OkToReplace bool
+	Variants    []PromptVariant `yaml:",omitempty"`
+}
+
+// A version of a prompt used instead of the default for some models, e.g. a
+// terser autosuggest prompt for small local models. Models are names or glob
+// patterns for a model family, like gpt-4o-mini or llama3*.
+type PromptVariant struct {
+	Models []string
+	Prompt string
+}
+
+// Returns the prompt string to use for the given model. An exact model name
+// wins over a pattern, otherwise the first matching variant is used, and
+// the default prompt if none match.
+func (this *Prompt) ForModel(model string) string {
+	if model == "" {
+		return this.Prompt
+	}
+	for _, variant := range this.Variants {
+		for _, pattern := range variant.Models {
+			if pattern == model {
+				return variant.Prompt
+			}
+		}
+	}
+	for _, variant := range this.Variants {
+		for _, pattern := range variant.Models {
+			if matchModel(pattern, model) {
+				return variant.Prompt
+			}
+		}
+	}
+	return this.Prompt
+}
+
+// Match a model name against a glob pattern where * matches anything,
+// including the slashes and colons in names like meta-llama/llama3:8b
+func matchModel(pattern, model string) bool {
+	parts := strings.Split(strings.ToLower(pattern), "*")
+	model = strings.ToLower(model)
+	if len(parts) == 1 {
+		return parts[0] == model
+	}
+	if !strings.HasPrefix(model, parts[0]) {
+		return false
+	}
+	model = model[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		index := strings.Index(model, part)
+		if index == -1 {
+			return false
+		}
+		model = model[index+len(part):]
+	}
+	return strings.HasSuffix(model, last)
 }
 
 // DiskPromptLibrary struct which includes a Path string and a Prompts instance
@@ -45,78 +101,65 @@ func NewPromptLibrary(path string, verbose bool, verboseWriter io.Writer) *DiskP
 	}
 }
 
-// Returns a list of fields to interpolate (strings wrapped in { and })
-func getFields(prompt string) []string {
-	// regex to find all fields in a string
-	regex := regexp.MustCompile(`\{[a-zA-Z0-9_]+\}`)
-	return regex.FindAllString(prompt, -1)
-}
-
 // Fetch a prompt with a given name, interpolating the fields into the prompt string.
 // Throws an error if fields are missing.
 // The argument pattern is first the field name, then the value, for example:
 //
 //	GetPrompt("my_prompt", "name", "John", "age", "30")
 func (this *DiskPromptLibrary) GetPrompt(name string, args ...string) (string, error) {
+	return this.GetPromptForModel(name, "", args...)
+}
 
-	// first find the prompt given the name
-	index := this.ContainsPromptNamed(name)
-	if index == -1 {
-		return "", errors.New("Prompt not found")
+// Like GetPrompt, but uses the prompt's variant for the model if it has one
+func (this *DiskPromptLibrary) GetPromptForModel(name, model string, args ...string) (string, error) {
+	promptString, err := this.GetUninterpolatedPromptForModel(name, model)
+	if err != nil {
+		return "", err
 	}
-	prompt := this.Prompts[index]
 
 	// interpolate the prompt string
-	promptString, err := Interpolate(prompt.Prompt, args...)
-
-	return promptString, err
+	return Interpolate(promptString, args...)
 }
 
 // Fetch a prompt with a given name, interpolating later
 func (this *DiskPromptLibrary) GetUninterpolatedPrompt(name string) (string, error) {
-
-	// first find the prompt given the name
-	index := this.ContainsPromptNamed(name)
-	if index == -1 {
-		return "", errors.New("Prompt not found")
-	}
-	prompt := this.Prompts[index]
-
-	return prompt.Prompt, nil
+	return this.GetUninterpolatedPromptForModel(name, "")
 }
 
-func (this *DiskPromptLibrary) InterpolatePrompt(prompt string, args ...string) (string, error) {
-	return Interpolate(prompt, args...)
+// Fetch a prompt's variant for the model with includes expanded, so it can be
+// interpolated later without the library
+func (this *DiskPromptLibrary) GetUninterpolatedPromptForModel(name, model string) (string, error) {
+	return this.expandIncludes(name, model, 0)
 }
 
-func Interpolate(p string, args ...string) (string, error) {
-	// turn args into a map
-	argMap := make(map[string]string)
-	for i := 0; i < len(args); i += 2 {
-		argMap[args[i]] = args[i+1]
+func (this *DiskPromptLibrary) expandIncludes(name, model string, depth int) (string, error) {
+	if depth > maxIncludeDepth {
+		return "", fmt.Errorf("Prompt includes are nested too deeply at %s, is there a cycle?", name)
 	}
 
-	fields := getFields(p)
-	promptString := p
-
-	// check that the number of fields matches the number of arguments
-	if len(fields)*2 != len(args) {
-		fieldNames := strings.Join(fields, ", ")
-		return "", fmt.Errorf("Incorrect number of fields provided, prompt requires fields (%s)", fieldNames)
+	index := this.ContainsPromptNamed(name)
+	if index == -1 {
+		if depth > 0 {
+			return "", fmt.Errorf("Included prompt %s not found", name)
+		}
+		return "", errors.New("Prompt not found")
 	}
+	promptString := this.Prompts[index].ForModel(model)
 
-	// interpolate fields using the argMap
-	for _, field := range fields {
-		fieldName := field[1 : len(field)-1] // trim { and } from field
-		value, ok := argMap[fieldName]
-		if !ok {
-			fieldNames := strings.Join(fields, ", ")
-			return "", fmt.Errorf("Missing field %s, prompt requires fields (%s)", field, fieldNames)
+	var err error
+	expanded := includeRegex.ReplaceAllStringFunc(promptString, func(include string) string {
+		if err != nil {
+			return ""
 		}
-		promptString = strings.Replace(promptString, field, value, -1)
-	}
+		var included string
+		included, err = this.expandIncludes(includeRegex.FindStringSubmatch(include)[1], model, depth+1)
+		return included
+	})
+	return expanded, err
+}
 
-	return promptString, nil
+func (this *DiskPromptLibrary) InterpolatePrompt(prompt string, args ...string) (string, error) {
+	return Interpolate(prompt, args...)
 }
 
 // Write a yaml file at the path with the contents marshalled from Prompts
@@ -154,13 +197,22 @@ func (this *DiskPromptLibrary) ContainsPromptNamed(name string) int {
 	return -1
 }
 
+// The names of the prompts in the library, in order
+func (this *DiskPromptLibrary) Names() []string {
+	names := []string{}
+	for _, prompt := range this.Prompts {
+		names = append(names, prompt.Name)
+	}
+	return names
+}
+
 // Given an array of Prompt objects, replace prompts in the prompt library based on name, only if OkToReplace is true on the Prompt already in the library
 func (this *DiskPromptLibrary) ReplacePrompts(newPrompts []Prompt) {
 	for _, newPrompt := range newPrompts {
 		index := this.ContainsPromptNamed(newPrompt.Name)
 		if index == -1 {
 			this.Prompts = append(this.Prompts, newPrompt)
-		} else {
+		} else if this.Prompts[index].OkToReplace {
 			this.Prompts[index] = newPrompt
 		}
 	}
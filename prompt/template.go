@@ -0,0 +1,114 @@
+package prompt
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Prompts are interpolated in one of two ways. Simple prompts replace {field}
+// with the matching argument. Prompts containing {{ are rendered as Go
+// text/template templates with the arguments as data, so they can use
+// conditionals like {{if .sysinfo}}...{{end}}, and {field} still works inside
+// them. Missing arguments are an error either way. Extra arguments are
+// allowed so that callers can add variables without breaking prompts that
+// don't use them.
+//
+// Library prompts can also include other prompts with {{include "name"}},
+// includes are expanded when the prompt is fetched from the library.
+
+const maxIncludeDepth = 8
+
+var fieldRegex = regexp.MustCompile(`\{[a-zA-Z0-9_]+\}`)
+
+var includeRegex = regexp.MustCompile(`\{\{-?\s*include\s+"([^"]+)"\s*-?\}\}`)
+
+// Returns a list of fields to interpolate (strings wrapped in { and })
+func getFields(prompt string) []string {
+	return fieldRegex.FindAllString(prompt, -1)
+}
+
+func isTemplate(p string) bool {
+	return strings.Contains(p, "{{")
+}
+
+func Interpolate(p string, args ...string) (string, error) {
+	if len(args)%2 != 0 {
+		return "", fmt.Errorf("Incorrect number of arguments, expected name and value pairs")
+	}
+
+	// turn args into a map
+	argMap := make(map[string]string)
+	for i := 0; i < len(args); i += 2 {
+		argMap[args[i]] = args[i+1]
+	}
+
+	if isTemplate(p) {
+		return interpolateTemplate(p, argMap)
+	}
+
+	fields := getFields(p)
+	promptString := p
+
+	// interpolate fields using the argMap
+	for _, field := range fields {
+		fieldName := field[1 : len(field)-1] // trim { and } from field
+		value, ok := argMap[fieldName]
+		if !ok {
+			fieldNames := strings.Join(fields, ", ")
+			return "", fmt.Errorf("Missing field %s, prompt requires fields (%s)", field, fieldNames)
+		}
+		promptString = strings.Replace(promptString, field, value, -1)
+	}
+
+	return promptString, nil
+}
+
+// Rewrite {field} as {{.field}} so that a template is rendered in one pass,
+// arguments are never themselves parsed as templates or fields
+func fieldsToTemplate(p string) string {
+	var builder strings.Builder
+	last := 0
+	for _, loc := range fieldRegex.FindAllStringIndex(p, -1) {
+		start, end := loc[0], loc[1]
+		// skip the inside of template actions like {{end}}
+		if (start > 0 && p[start-1] == '{') || (end < len(p) && p[end] == '}') {
+			continue
+		}
+		builder.WriteString(p[last:start])
+		builder.WriteString("{{." + p[start+1:end-1] + "}}")
+		last = end
+	}
+	builder.WriteString(p[last:])
+	return builder.String()
+}
+
+func interpolateTemplate(p string, argMap map[string]string) (string, error) {
+	funcs := template.FuncMap{
+		"include": func(name string) (string, error) {
+			return "", fmt.Errorf("Can't include %s, includes only work in prompts from the prompt library", name)
+		},
+	}
+
+	tmpl, err := template.New("prompt").
+		Funcs(funcs).
+		Option("missingkey=error").
+		Parse(fieldsToTemplate(p))
+	if err != nil {
+		return "", fmt.Errorf("Invalid prompt template: %s", err)
+	}
+
+	var builder strings.Builder
+	err = tmpl.Execute(&builder, argMap)
+	if err != nil {
+		var execErr template.ExecError
+		if errors.As(err, &execErr) {
+			err = execErr.Err
+		}
+		return "", fmt.Errorf("Error rendering prompt template: %s", err)
+	}
+
+	return builder.String(), nil
+}
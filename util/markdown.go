@@ -0,0 +1,266 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Markdown styling for StyleCodeblocksWriter outside of code blocks. Like
+// code lines, list items and table rows are written as they stream in and
+// then redrawn once the line is complete: list items are wrapped with the
+// text lined up after the bullet, and a table is redrawn with aligned columns
+// each time a row is added. Headings are styled as soon as the marker is
+// seen.
+
+var ansiEscapePattern = regexp.MustCompile("\x1b\\[[0-9;?]*[A-Za-z]")
+
+// The number of terminal columns text takes, ignoring escape codes
+func visibleWidth(text []byte) int {
+	return utf8.RuneCount(ansiEscapePattern.ReplaceAll(text, nil))
+}
+
+// How many lines up the cursor is from the start of text written from the
+// beginning of a line, when the terminal wraps it
+func wrappedLinesUp(text []byte, terminalWidth int) int {
+	width := visibleWidth(text)
+	if width == 0 {
+		return 0
+	}
+	return (width - 1) / terminalWidth
+}
+
+func isMarkdownMarker(char byte) bool {
+	return char == '#' || char == '-' || char == '*' || char == '+' ||
+		(char >= '0' && char <= '9')
+}
+
+func (this *StyleCodeblocksWriter) headingStyle(level int) string {
+	if this.plain {
+		return ""
+	}
+	if level == 1 {
+		return "\x1b[1;4m"
+	}
+	return "\x1b[1m"
+}
+
+// What looked like the start of a heading or list item wasn't one, so write
+// the held back marker and carry on with a normal line
+func (this *StyleCodeblocksWriter) notMarkdown(w *bytes.Buffer, char byte) {
+	w.Write(this.marker.Bytes())
+	this.marker = nil
+	this.leading = nil
+	this.state = STATE_NORMAL
+	this.writeChar(w, char)
+}
+
+func (this *StyleCodeblocksWriter) StartOfListLine(w *bytes.Buffer) {
+	marker := this.marker.String()
+	if marker == "-" || marker == "*" || marker == "+" {
+		marker = "•"
+	}
+	w.WriteString(marker)
+	w.WriteByte(' ')
+
+	// the marker is added by Write along with the rest of the line
+	this.listLine = new(bytes.Buffer)
+	if this.leading != nil {
+		this.listLine.Write(this.leading.Bytes())
+	}
+	this.listPrefix = this.listLine.Len() + len(marker) + 1
+	this.marker = nil
+	this.leading = nil
+	this.state = STATE_NORMAL
+}
+
+// Redraw a list item that was too long for the terminal with the following
+// lines indented to the text after the marker
+func (this *StyleCodeblocksWriter) EndOfListLine(w io.Writer) {
+	line := this.listLine.Bytes()
+	this.listLine = nil
+	if visibleWidth(line) <= this.terminalWidth {
+		return
+	}
+
+	prefix := line[:this.listPrefix]
+	indentWidth := visibleWidth(prefix)
+	// keep the leading whitespace as is so nested items line up with tabs
+	leading := len(prefix) - len(bytes.TrimLeft(prefix, " \t"))
+	indent := string(prefix[:leading]) + strings.Repeat(" ", indentWidth-leading)
+
+	if linesUp := wrappedLinesUp(line, this.terminalWidth); linesUp > 0 {
+		fmt.Fprintf(w, "\x1b[%dA", linesUp)
+	}
+	w.Write([]byte("\r\x1b[J"))
+	w.Write(prefix)
+
+	column := indentWidth
+	for i, word := range bytes.Split(line[this.listPrefix:], []byte{' '}) {
+		width := visibleWidth(word)
+		if i > 0 {
+			if column+1+width > this.terminalWidth && column > indentWidth {
+				w.Write([]byte("\n" + indent))
+				column = indentWidth
+			} else {
+				w.Write([]byte{' '})
+				column++
+			}
+		}
+		w.Write(word)
+		column += width
+	}
+}
+
+type markdownTable struct {
+	rows [][]string
+	// 'l', 'c', or 'r' for each column, from the row under the header
+	align  []byte
+	header bool
+	// lines the table took when it was last drawn
+	lines int
+}
+
+func splitTableRow(row string) []string {
+	row = strings.TrimSpace(row)
+	row = strings.TrimPrefix(row, "|")
+	row = strings.TrimSuffix(row, "|")
+	cells := strings.Split(row, "|")
+	for i := range cells {
+		cells[i] = strings.TrimSpace(cells[i])
+	}
+	return cells
+}
+
+var tableSeparatorPattern = regexp.MustCompile("^:?-+:?$")
+
+// Parse a |---|:---:| row, nil if the row isn't one
+func tableAlignment(cells []string) []byte {
+	align := make([]byte, len(cells))
+	for i, cell := range cells {
+		if !tableSeparatorPattern.MatchString(cell) {
+			return nil
+		}
+		switch {
+		case strings.HasPrefix(cell, ":") && strings.HasSuffix(cell, ":"):
+			align[i] = 'c'
+		case strings.HasSuffix(cell, ":"):
+			align[i] = 'r'
+		default:
+			align[i] = 'l'
+		}
+	}
+	return align
+}
+
+func (this *StyleCodeblocksWriter) styleTableCell(cell string) string {
+	parts := strings.Split(cell, "`")
+	if len(parts)%2 == 0 {
+		// an unclosed backtick isn't inline code
+		return cell
+	}
+	styled := new(strings.Builder)
+	for i, part := range parts {
+		if i%2 == 1 {
+			styled.WriteString(this.inlineColor + part + this.normalColor)
+		} else {
+			styled.WriteString(part)
+		}
+	}
+	return styled.String()
+}
+
+func tableCellWidth(cell string) int {
+	parts := strings.Split(cell, "`")
+	if len(parts)%2 == 0 {
+		return utf8.RuneCountInString(cell)
+	}
+	return utf8.RuneCountInString(strings.Join(parts, ""))
+}
+
+func (this *StyleCodeblocksWriter) renderTable() []string {
+	table := this.table
+	columns := 0
+	for _, row := range table.rows {
+		columns = max(columns, len(row))
+	}
+	widths := make([]int, columns)
+	for _, row := range table.rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], tableCellWidth(cell))
+		}
+	}
+
+	lines := []string{}
+	for r, row := range table.rows {
+		cells := make([]string, columns)
+		for i := range cells {
+			cell := ""
+			if i < len(row) {
+				cell = row[i]
+			}
+			padding := widths[i] - tableCellWidth(cell)
+			align := byte('l')
+			if i < len(table.align) {
+				align = table.align[i]
+			}
+			left := 0
+			switch align {
+			case 'r':
+				left = padding
+			case 'c':
+				left = padding / 2
+			}
+			cells[i] = strings.Repeat(" ", left) + this.styleTableCell(cell) +
+				strings.Repeat(" ", padding-left)
+		}
+
+		line := strings.TrimRight(strings.Join(cells, " │ "), " ")
+		if r == 0 && table.header {
+			if !this.plain {
+				line = "\x1b[1m" + line + "\x1b[0m" + this.normalColor
+			}
+			lines = append(lines, line)
+			rules := make([]string, columns)
+			for i, width := range widths {
+				rules[i] = strings.Repeat("─", width)
+			}
+			lines = append(lines, strings.Join(rules, "─┼─"))
+		} else {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Add the row that was just written to the table and redraw the whole table
+// in its place
+func (this *StyleCodeblocksWriter) EndOfTableRow(w io.Writer) {
+	if this.table == nil {
+		this.table = &markdownTable{}
+	}
+	table := this.table
+
+	cells := splitTableRow(this.rowBuffer.String())
+	if align := tableAlignment(cells); len(table.rows) == 1 && !table.header && align != nil {
+		table.align = align
+		table.header = true
+	} else {
+		table.rows = append(table.rows, cells)
+	}
+
+	linesUp := table.lines + wrappedLinesUp(this.rowBuffer.Bytes(), this.terminalWidth)
+	if linesUp > 0 {
+		fmt.Fprintf(w, "\x1b[%dA", linesUp)
+	}
+	w.Write([]byte("\r\x1b[J"))
+
+	table.lines = 0
+	for _, line := range this.renderTable() {
+		w.Write([]byte(line + "\n"))
+		table.lines += wrappedLinesUp([]byte(line), this.terminalWidth) + 1
+	}
+}
@@ -0,0 +1,131 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// Butterfish keeps its files in the XDG base directories:
+//   - config (butterfish.env, prompts.yaml, config.yaml, plugins) in
+//     $XDG_CONFIG_HOME/butterfish, by default ~/.config/butterfish
+//   - state (the log file, per-profile usage, the promptedit file) in
+//     $XDG_STATE_HOME/butterfish, by default ~/.local/state/butterfish
+//   - cache in $XDG_CACHE_HOME/butterfish, by default ~/.cache/butterfish
+//
+// Embedding indexes are the exception, .butterfish_index files live in the
+// directories they index unless index_store: central is set in config.yaml,
+// which keeps them in $XDG_STATE_HOME/butterfish/index.
+
+const appDirName = "butterfish"
+
+type Paths struct {
+	ConfigDir string
+	StateDir  string
+	CacheDir  string
+
+	home string
+}
+
+// Resolve an XDG base directory, the spec says relative paths should be
+// ignored so we fall back to the default in that case.
+func xdgDir(envVar, home, fallback string) string {
+	dir := os.Getenv(envVar)
+	if dir == "" || !filepath.IsAbs(dir) {
+		dir = filepath.Join(home, fallback)
+	}
+	return filepath.Join(dir, appDirName)
+}
+
+func GetPaths() (*Paths, error) {
+	home, err := homedir.Dir()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Paths{
+		ConfigDir: xdgDir("XDG_CONFIG_HOME", home, ".config"),
+		StateDir:  xdgDir("XDG_STATE_HOME", home, ".local/state"),
+		CacheDir:  xdgDir("XDG_CACHE_HOME", home, ".cache"),
+		home:      home,
+	}, nil
+}
+
+func (this *Paths) EnvFile() string {
+	return filepath.Join(this.ConfigDir, "butterfish.env")
+}
+
+func (this *Paths) PromptFile() string {
+	return filepath.Join(this.ConfigDir, "prompts.yaml")
+}
+
+func (this *Paths) ConfigFile() string {
+	return filepath.Join(this.ConfigDir, "config.yaml")
+}
+
+func (this *Paths) PluginDir() string {
+	return filepath.Join(this.ConfigDir, "plugins")
+}
+
+func (this *Paths) LogFile() string {
+	return filepath.Join(this.StateDir, "butterfish.log")
+}
+
+func (this *Paths) PromptEditFile() string {
+	return filepath.Join(this.StateDir, "prompt.txt")
+}
+
+func (this *Paths) IndexStoreDir() string {
+	return filepath.Join(this.StateDir, "index")
+}
+
+// Where files used to live, mapped to where they live now
+func (this *Paths) legacyLocations() [][2]string {
+	legacyDir := filepath.Join(this.home, ".config", appDirName)
+
+	return [][2]string{
+		{filepath.Join(legacyDir, "butterfish.env"), this.EnvFile()},
+		{filepath.Join(legacyDir, "prompts.yaml"), this.PromptFile()},
+		{filepath.Join(legacyDir, "config.yaml"), this.ConfigFile()},
+		{filepath.Join(legacyDir, "prompt.txt"), this.PromptEditFile()},
+		{filepath.Join(legacyDir, "profiles"), filepath.Join(this.StateDir, "profiles")},
+	}
+}
+
+// Move files from their pre-XDG locations, we only move a file if it exists
+// in the old location and not in the new one. Returns a description of each
+// file moved.
+func (this *Paths) Migrate() ([]string, error) {
+	moved := []string{}
+
+	for _, location := range this.legacyLocations() {
+		oldPath, newPath := location[0], location[1]
+		if oldPath == newPath {
+			continue
+		}
+
+		_, err := os.Stat(oldPath)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		_, err = os.Stat(newPath)
+		if err == nil {
+			continue
+		}
+
+		err = os.MkdirAll(filepath.Dir(newPath), 0755)
+		if err != nil {
+			return moved, err
+		}
+		err = os.Rename(oldPath, newPath)
+		if err != nil {
+			return moved, fmt.Errorf("Unable to move %s to %s: %s", oldPath, newPath, err)
+		}
+		moved = append(moved, fmt.Sprintf("%s -> %s", oldPath, newPath))
+	}
+
+	return moved, nil
+}
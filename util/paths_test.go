@@ -0,0 +1,63 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathsXDG(t *testing.T) {
+	homedir.DisableCache = true
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("XDG_STATE_HOME", "relative/ignored")
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(home, "cache"))
+
+	paths, err := GetPaths()
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(home, ".config", "butterfish"), paths.ConfigDir)
+	assert.Equal(t, filepath.Join(home, ".local", "state", "butterfish"), paths.StateDir)
+	assert.Equal(t, filepath.Join(home, "cache", "butterfish"), paths.CacheDir)
+}
+
+func TestPathsMigrate(t *testing.T) {
+	homedir.DisableCache = true
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, "xdgconfig"))
+	t.Setenv("XDG_STATE_HOME", "")
+
+	legacyDir := filepath.Join(home, ".config", "butterfish")
+	assert.Nil(t, os.MkdirAll(filepath.Join(legacyDir, "profiles", "work"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(legacyDir, "prompts.yaml"), []byte("old"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(legacyDir, "butterfish.env"), []byte("old"), 0644))
+
+	paths, err := GetPaths()
+	assert.Nil(t, err)
+
+	// a file that already exists in the new location is left alone
+	assert.Nil(t, os.MkdirAll(paths.ConfigDir, 0755))
+	assert.Nil(t, os.WriteFile(paths.EnvFile(), []byte("new"), 0644))
+
+	moved, err := paths.Migrate()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(moved))
+
+	data, err := os.ReadFile(paths.PromptFile())
+	assert.Nil(t, err)
+	assert.Equal(t, "old", string(data))
+	data, err = os.ReadFile(paths.EnvFile())
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(data))
+	_, err = os.Stat(filepath.Join(paths.StateDir, "profiles", "work"))
+	assert.Nil(t, err)
+
+	// running again is a no-op
+	moved, err = paths.Migrate()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(moved))
+}
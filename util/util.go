@@ -15,6 +15,7 @@ import (
 	"unicode"
 
 	"github.com/alecthomas/chroma/quick"
+	"github.com/alecthomas/chroma/styles"
 	"github.com/charmbracelet/lipgloss"
 	"github.com/sashabaranov/go-openai/jsonschema"
 	"github.com/spf13/afero"
@@ -34,6 +35,20 @@ type CompletionRequest struct {
 	Tools         []ToolDefinition
 	Verbose       bool
 	TokenTimeout  time.Duration
+	// Hard timeout for the whole request and how many times to retry rate
+	// limits and server errors, these are set per feature
+	Timeout time.Duration
+	Retries int
+	// If set, ask the model for JSON output matching this JSON schema
+	JSONSchema json.RawMessage
+	// Images sent along with the prompt, for vision models
+	Images []CompletionImage
+}
+
+type CompletionImage struct {
+	// e.g. image/png
+	MimeType string
+	Data     []byte
 }
 
 type FunctionCall struct {
@@ -52,6 +67,71 @@ type CompletionResponse struct {
 	FunctionName       string
 	FunctionParameters string
 	ToolCalls          []*ToolCall
+	// Set when the provider declined to answer, either through a content
+	// filter or an explicit refusal, holds the provider's reason
+	Refusal string
+	// The model that answered when it isn't the requested one, i.e. after
+	// failing over to a fallback, empty otherwise
+	Model string
+	// Set when a streamed answer was cut off, e.g. with Ctrl-C, Completion
+	// holds the part that arrived and the error says why it stopped
+	Interrupted bool
+	// Timing of the request, may be nil
+	Metrics *CompletionMetrics
+}
+
+// Latency and throughput of a single completion request
+type CompletionMetrics struct {
+	// Time from sending the request to the first streamed token, zero for
+	// requests that aren't streamed
+	TimeToFirstToken time.Duration
+	Duration         time.Duration
+	// Streamed chunks, which are about one token each, or the reported
+	// completion tokens for requests that aren't streamed
+	Tokens int
+	// Prompt tokens reported by the API, zero if it didn't report them
+	PromptTokens int
+	// Times the request was retried after a rate limit or server error
+	Retries int
+}
+
+// Generation speed after the first token, so that a slow start doesn't
+// skew it, or over the whole request if it wasn't streamed
+func (this *CompletionMetrics) TokensPerSecond() float64 {
+	generation := this.Duration - this.TimeToFirstToken
+	if generation <= 0 || this.Tokens == 0 {
+		return 0
+	}
+	return float64(this.Tokens) / generation.Seconds()
+}
+
+// Count a streamed token, recording the time to first token
+func (this *CompletionMetrics) CountToken(start time.Time) {
+	if this.Tokens == 0 {
+		this.TimeToFirstToken = time.Since(start)
+	}
+	this.Tokens++
+}
+
+func (this *CompletionMetrics) String() string {
+	str := ""
+	if this.TimeToFirstToken > 0 {
+		str = fmt.Sprintf("first token: %s, ", this.TimeToFirstToken.Round(time.Millisecond))
+	}
+	str += fmt.Sprintf("total: %s, tokens: %d, %.1f tokens/s",
+		this.Duration.Round(time.Millisecond), this.Tokens, this.TokensPerSecond())
+	if this.PromptTokens > 0 {
+		str += fmt.Sprintf(", prompt tokens: %d", this.PromptTokens)
+	}
+	if this.Retries > 0 {
+		str += fmt.Sprintf(", retries: %d", this.Retries)
+	}
+	return str
+}
+
+// Explain a refusal to the user, with what they can do about it
+func (this *CompletionResponse) RefusalMessage() string {
+	return fmt.Sprintf("The model declined to answer: %s\nTry rephrasing your prompt or switching to a different model.", this.Refusal)
 }
 
 type FunctionDefinition struct {
@@ -252,18 +332,46 @@ const (
 	STATE_BLOCK_TWO_TICKS
 	STATE_BLOCK_THREE_TICKS
 	STATE_INLINE
+	STATE_HEADING_MARKS
+	STATE_HEADING
+	STATE_LIST_MARKER
+	STATE_LIST_NUMBER
+	STATE_TABLE_ROW
 )
 
+// A theme that turns off syntax highlighting and other styling of code blocks
+// and markdown, for NO_COLOR
+const NoHighlightTheme = "none"
+
+// Check that a theme is one of the chroma styles, or NoHighlightTheme
+func ValidateTheme(name string) error {
+	if name == "" || name == NoHighlightTheme || styles.Registry[name] != nil {
+		return nil
+	}
+	return fmt.Errorf("Unknown theme %s, expected %s or one of %s",
+		name, NoHighlightTheme, strings.Join(styles.Names(), ", "))
+}
+
 type StyleCodeblocksWriter struct {
 	Writer        io.Writer
 	terminalWidth int
 	normalColor   string
 	inlineColor   string
 	colorScheme   string
+	plain         bool
 	state         int
 	langSuffix    *bytes.Buffer
 	blockBuffer   *bytes.Buffer
 	lock          sync.Mutex
+
+	// markdown outside of code blocks, see markdown.go
+	leading      *bytes.Buffer // whitespace at the start of the current line
+	marker       *bytes.Buffer // a heading or list marker not yet written
+	headingLevel int
+	listLine     *bytes.Buffer // the list item line written so far
+	listPrefix   int           // bytes of listLine before the item text
+	table        *markdownTable
+	rowBuffer    *bytes.Buffer
 }
 
 func NewStyleCodeblocksWriter(
@@ -288,6 +396,7 @@ func NewStyleCodeblocksWriter(
 		inlineColor:   highlightColor,
 		terminalWidth: terminalWidth,
 		colorScheme:   colorScheme,
+		plain:         colorScheme == NoHighlightTheme,
 	}
 }
 
@@ -302,12 +411,18 @@ func (this *StyleCodeblocksWriter) Reset() {
 	this.state = STATE_NEWLINE
 	this.langSuffix = nil
 	this.blockBuffer = nil
+	this.leading = nil
+	this.marker = nil
+	this.listLine = nil
+	this.table = nil
+	this.rowBuffer = nil
 }
 
 // This writer receives bytes in a stream and looks for markdown code
 // blocks (```) and renders them with syntax highlighting.
 // The hard part is the stream splits the input into chunks, so we need
 // to buffer the input in places.
+// Headings, lists, and tables are styled as well, see markdown.go.
 func (this *StyleCodeblocksWriter) Write(p []byte) (n int, err error) {
 	this.lock.Lock()
 	defer this.lock.Unlock()
@@ -315,150 +430,238 @@ func (this *StyleCodeblocksWriter) Write(p []byte) (n int, err error) {
 	toWrite := new(bytes.Buffer)
 
 	for _, char := range p {
+		start := toWrite.Len()
+		this.writeChar(toWrite, char)
+		if this.listLine != nil {
+			this.listLine.Write(toWrite.Bytes()[start:])
+		}
+	}
 
-		switch this.state {
-		case STATE_NORMAL:
-			if char == '\n' {
-				this.state = STATE_NEWLINE
-				toWrite.WriteByte(char)
-			} else if char == '`' {
-				this.state = STATE_INLINE
-				toWrite.Write([]byte(this.inlineColor))
-			} else {
-				toWrite.WriteByte(char)
-			}
+	return this.Writer.Write(toWrite.Bytes())
+}
 
-		case STATE_INLINE:
-			if char == '`' {
-				this.state = STATE_NORMAL
-				toWrite.Write([]byte(this.normalColor))
-			} else {
-				toWrite.WriteByte(char)
+func (this *StyleCodeblocksWriter) writeChar(toWrite *bytes.Buffer, char byte) {
+	switch this.state {
+	case STATE_NORMAL:
+		if char == '\n' {
+			if this.listLine != nil {
+				this.EndOfListLine(toWrite)
 			}
+			this.state = STATE_NEWLINE
+			toWrite.WriteByte(char)
+		} else if char == '`' {
+			this.state = STATE_INLINE
+			toWrite.Write([]byte(this.inlineColor))
+		} else {
+			toWrite.WriteByte(char)
+		}
 
-		case STATE_NEWLINE:
-			if char == '`' {
-				this.state = STATE_ONE_TICK
-			} else if char == '\n' {
-				toWrite.WriteByte(char)
-			} else if char == ' ' || char == '\t' {
-				toWrite.WriteByte(char)
-			} else {
-				this.state = STATE_NORMAL
-				toWrite.WriteByte(char)
-			}
+	case STATE_INLINE:
+		if char == '`' {
+			this.state = STATE_NORMAL
+			toWrite.Write([]byte(this.normalColor))
+		} else {
+			toWrite.WriteByte(char)
+		}
 
-		case STATE_ONE_TICK:
-			if char == '`' {
-				this.state = STATE_TWO_TICKS
-			} else if char == '\n' {
-				this.state = STATE_NEWLINE
-				toWrite.WriteByte('`')
-				toWrite.WriteByte(char)
-			} else {
-				this.state = STATE_INLINE
-				toWrite.Write([]byte(this.inlineColor))
-				toWrite.WriteByte(char)
+	case STATE_NEWLINE:
+		if char != ' ' && char != '\t' {
+			if this.table != nil && char != '|' {
+				this.table = nil
 			}
-
-		case STATE_TWO_TICKS:
-			if char == '`' {
-				this.state++
-			} else if char == '\n' {
-				this.state = STATE_NEWLINE
-				toWrite.WriteByte('`')
-				toWrite.WriteByte('`')
-				toWrite.WriteByte(char)
-			} else {
-				this.state = STATE_NORMAL
-				toWrite.WriteByte('`')
-				toWrite.WriteByte('`')
-				toWrite.WriteByte(char)
+			if !isMarkdownMarker(char) {
+				this.leading = nil
 			}
+		}
 
-		case STATE_THREE_TICKS:
-			if char == '\n' {
-				this.state = STATE_BLOCK_NEWLINE
-				toWrite.WriteByte('\r')
-				this.blockBuffer = new(bytes.Buffer)
-			} else {
-				// append to suffix
-				if this.langSuffix == nil {
-					this.langSuffix = new(bytes.Buffer)
-				}
-				this.langSuffix.WriteByte(char)
+		if char == '`' {
+			this.state = STATE_ONE_TICK
+		} else if char == '\n' {
+			toWrite.WriteByte(char)
+		} else if char == ' ' || char == '\t' {
+			if this.leading == nil {
+				this.leading = new(bytes.Buffer)
 			}
-
-		case STATE_BLOCK:
-			if char == '\n' {
-				this.state = STATE_BLOCK_NEWLINE
-				this.EndOfCodeLine(toWrite)
-				toWrite.WriteByte(char)
-			} else {
-				toWrite.WriteByte(char)
+			this.leading.WriteByte(char)
+			toWrite.WriteByte(char)
+		} else if isMarkdownMarker(char) {
+			this.marker = new(bytes.Buffer)
+			this.marker.WriteByte(char)
+			switch {
+			case char == '#':
+				this.state = STATE_HEADING_MARKS
+			case char >= '0' && char <= '9':
+				this.state = STATE_LIST_NUMBER
+			default:
+				this.state = STATE_LIST_MARKER
 			}
-			this.blockBuffer.WriteByte(char)
+		} else if char == '|' {
+			this.state = STATE_TABLE_ROW
+			this.rowBuffer = new(bytes.Buffer)
+			this.rowBuffer.WriteByte(char)
+			toWrite.WriteByte(char)
+		} else {
+			this.state = STATE_NORMAL
+			toWrite.WriteByte(char)
+		}
 
-		case STATE_BLOCK_NEWLINE:
-			if char == '`' {
-				this.state = STATE_BLOCK_ONE_TICK
-			} else if char == '\n' {
-				this.EndOfCodeLine(toWrite)
-				this.state = STATE_BLOCK_NEWLINE
-				toWrite.WriteByte(char)
-				this.blockBuffer.WriteByte(char)
-			} else if char == ' ' || char == '\t' {
-				toWrite.WriteByte(char)
-				this.blockBuffer.WriteByte(char)
-			} else {
-				this.state = STATE_BLOCK
-				toWrite.WriteByte(char)
-				this.blockBuffer.WriteByte(char)
-			}
+	case STATE_HEADING_MARKS:
+		if char == '#' && this.marker.Len() < 6 {
+			this.marker.WriteByte(char)
+		} else if char == ' ' {
+			this.headingLevel = this.marker.Len()
+			this.marker = nil
+			this.state = STATE_HEADING
+			toWrite.WriteString(this.headingStyle(this.headingLevel))
+		} else {
+			this.notMarkdown(toWrite, char)
+		}
 
-		case STATE_BLOCK_ONE_TICK:
-			if char == '`' {
-				this.state = STATE_BLOCK_TWO_TICKS
-			} else if char == '\n' {
-				this.EndOfCodeLine(toWrite)
-				this.state = STATE_BLOCK_NEWLINE
-				toWrite.WriteByte(char)
-				this.blockBuffer.WriteByte(char)
-			} else {
-				this.state = STATE_BLOCK
-				toWrite.WriteByte(char)
-				this.blockBuffer.WriteByte(char)
+	case STATE_HEADING:
+		if char == '\n' {
+			if !this.plain {
+				toWrite.WriteString("\x1b[0m")
+				toWrite.WriteString(this.normalColor)
 			}
+			this.state = STATE_NEWLINE
+		}
+		toWrite.WriteByte(char)
+
+	case STATE_LIST_NUMBER:
+		if char >= '0' && char <= '9' && this.marker.Len() < 9 {
+			this.marker.WriteByte(char)
+		} else if char == '.' || char == ')' {
+			this.marker.WriteByte(char)
+			this.state = STATE_LIST_MARKER
+		} else {
+			this.notMarkdown(toWrite, char)
+		}
 
-		case STATE_BLOCK_TWO_TICKS:
-			if char == '`' {
-				this.state = STATE_BLOCK_THREE_TICKS
-			} else if char == '\n' {
-				this.EndOfCodeLine(toWrite)
-				this.state = STATE_BLOCK_NEWLINE
-				toWrite.WriteByte(char)
-				this.blockBuffer.WriteByte(char)
-			} else {
-				this.state = STATE_BLOCK
-				toWrite.WriteByte(char)
-				this.blockBuffer.WriteByte(char)
+	case STATE_LIST_MARKER:
+		if char == ' ' && this.marker.Len() > 0 {
+			this.StartOfListLine(toWrite)
+		} else {
+			this.notMarkdown(toWrite, char)
+		}
+
+	case STATE_TABLE_ROW:
+		if char == '\n' {
+			this.EndOfTableRow(toWrite)
+			this.rowBuffer = nil
+			this.state = STATE_NEWLINE
+		} else {
+			this.rowBuffer.WriteByte(char)
+			toWrite.WriteByte(char)
+		}
+
+	case STATE_ONE_TICK:
+		if char == '`' {
+			this.state = STATE_TWO_TICKS
+		} else if char == '\n' {
+			this.state = STATE_NEWLINE
+			toWrite.WriteByte('`')
+			toWrite.WriteByte(char)
+		} else {
+			this.state = STATE_INLINE
+			toWrite.Write([]byte(this.inlineColor))
+			toWrite.WriteByte(char)
+		}
+
+	case STATE_TWO_TICKS:
+		if char == '`' {
+			this.state++
+		} else if char == '\n' {
+			this.state = STATE_NEWLINE
+			toWrite.WriteByte('`')
+			toWrite.WriteByte('`')
+			toWrite.WriteByte(char)
+		} else {
+			this.state = STATE_NORMAL
+			toWrite.WriteByte('`')
+			toWrite.WriteByte('`')
+			toWrite.WriteByte(char)
+		}
+
+	case STATE_THREE_TICKS:
+		if char == '\n' {
+			this.state = STATE_BLOCK_NEWLINE
+			toWrite.WriteByte('\r')
+			this.blockBuffer = new(bytes.Buffer)
+		} else {
+			// append to suffix
+			if this.langSuffix == nil {
+				this.langSuffix = new(bytes.Buffer)
 			}
+			this.langSuffix.WriteByte(char)
+		}
 
-		case STATE_BLOCK_THREE_TICKS:
-			if char == '\n' {
-				if this.langSuffix != nil {
-					this.langSuffix.Reset()
-				}
+	case STATE_BLOCK:
+		if char == '\n' {
+			this.state = STATE_BLOCK_NEWLINE
+			this.EndOfCodeLine(toWrite)
+			toWrite.WriteByte(char)
+		} else {
+			toWrite.WriteByte(char)
+		}
+		this.blockBuffer.WriteByte(char)
+
+	case STATE_BLOCK_NEWLINE:
+		if char == '`' {
+			this.state = STATE_BLOCK_ONE_TICK
+		} else if char == '\n' {
+			this.EndOfCodeLine(toWrite)
+			this.state = STATE_BLOCK_NEWLINE
+			toWrite.WriteByte(char)
+			this.blockBuffer.WriteByte(char)
+		} else if char == ' ' || char == '\t' {
+			toWrite.WriteByte(char)
+			this.blockBuffer.WriteByte(char)
+		} else {
+			this.state = STATE_BLOCK
+			toWrite.WriteByte(char)
+			this.blockBuffer.WriteByte(char)
+		}
 
-				toWrite.Write([]byte(this.normalColor))
+	case STATE_BLOCK_ONE_TICK:
+		if char == '`' {
+			this.state = STATE_BLOCK_TWO_TICKS
+		} else if char == '\n' {
+			this.EndOfCodeLine(toWrite)
+			this.state = STATE_BLOCK_NEWLINE
+			toWrite.WriteByte(char)
+			this.blockBuffer.WriteByte(char)
+		} else {
+			this.state = STATE_BLOCK
+			toWrite.WriteByte(char)
+			this.blockBuffer.WriteByte(char)
+		}
 
-				this.blockBuffer = nil
-				this.state = STATE_NEWLINE
+	case STATE_BLOCK_TWO_TICKS:
+		if char == '`' {
+			this.state = STATE_BLOCK_THREE_TICKS
+		} else if char == '\n' {
+			this.EndOfCodeLine(toWrite)
+			this.state = STATE_BLOCK_NEWLINE
+			toWrite.WriteByte(char)
+			this.blockBuffer.WriteByte(char)
+		} else {
+			this.state = STATE_BLOCK
+			toWrite.WriteByte(char)
+			this.blockBuffer.WriteByte(char)
+		}
+
+	case STATE_BLOCK_THREE_TICKS:
+		if char == '\n' {
+			if this.langSuffix != nil {
+				this.langSuffix.Reset()
 			}
+
+			toWrite.Write([]byte(this.normalColor))
+
+			this.blockBuffer = nil
+			this.state = STATE_NEWLINE
 		}
 	}
-
-	return this.Writer.Write(toWrite.Bytes())
 }
 
 func lastLine(buff *bytes.Buffer, newlines int) []byte {
@@ -477,6 +680,9 @@ func lastLine(buff *bytes.Buffer, newlines int) []byte {
 }
 
 func (this *StyleCodeblocksWriter) EndOfCodeLine(w io.Writer) error {
+	if this.plain {
+		return nil
+	}
 	temp := new(bytes.Buffer)
 	blockBufferString := this.blockBuffer.String()
 
@@ -516,7 +722,7 @@ func (this *StyleCodeblocksWriter) EndOfCodeLine(w io.Writer) error {
 
 func (this *StyleCodeblocksWriter) EndOfCodeBlock(w io.Writer) error {
 	// render block
-	err := quick.Highlight(w, this.blockBuffer.String(), this.langSuffix.String(), "terminal256", "monokai")
+	err := quick.Highlight(w, this.blockBuffer.String(), this.langSuffix.String(), "terminal256", this.colorScheme)
 	if err != nil {
 		log.Printf("error highlighting code block: %s", err)
 	}
@@ -582,9 +788,15 @@ type ReplaceWriter struct {
 	To     string
 }
 
+// Returns len(p) on success rather than the length after replacing, so that
+// e.g. io.MultiWriter doesn't treat it as a short write
 func (this *ReplaceWriter) Write(p []byte) (n int, err error) {
 	s := strings.Replace(string(p), this.From, this.To, -1)
-	return this.Writer.Write([]byte(s))
+	_, err = this.Writer.Write([]byte(s))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
 
 func NewReplaceWriter(writer io.Writer, from string, to string) *ReplaceWriter {
@@ -702,20 +914,24 @@ func NewStyledWriter(writer io.Writer, style lipgloss.Style) *StyledWriter {
 	}
 }
 
-// Open a log file named butterfish.log in a temporary directory
+// Open a log file named butterfish.log in the state directory, usually
+// ~/.local/state/butterfish, falling back to a temporary directory
 func InitLogging(ctx context.Context) string {
-	logDir := "/var/tmp"
-	_, err := os.Stat(logDir)
+	var filename string
+	paths, err := GetPaths()
+	if err == nil {
+		filename = paths.LogFile()
+		err = os.MkdirAll(filepath.Dir(filename), 0755)
+	}
 	if err != nil {
 		// Create a temporary directory to hold the log file
-		logDir, err = os.MkdirTemp("", "butterfish")
+		logDir, err := os.MkdirTemp("", "butterfish")
 		if err != nil {
 			panic(err)
 		}
+		filename = filepath.Join(logDir, "butterfish.log")
 	}
 
-	// Create a log file in the temporary directory
-	filename := filepath.Join(logDir, "butterfish.log")
 	logFile, err := os.OpenFile(filename,
 		os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
 	if err != nil {
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -132,3 +133,80 @@ Foo`
 	// assert buffer equals expected
 	assert.Equal(t, expected, buffer.String())
 }
+
+func TestCompletionMetrics(t *testing.T) {
+	metrics := &CompletionMetrics{}
+	start := time.Now().Add(-100 * time.Millisecond)
+	metrics.CountToken(start)
+	metrics.CountToken(start)
+	assert.Equal(t, 2, metrics.Tokens)
+	assert.GreaterOrEqual(t, metrics.TimeToFirstToken, 100*time.Millisecond)
+
+	metrics = &CompletionMetrics{
+		TimeToFirstToken: 500 * time.Millisecond,
+		Duration:         2500 * time.Millisecond,
+		Tokens:           40,
+	}
+	assert.Equal(t, 20.0, metrics.TokensPerSecond())
+	assert.Equal(t, "first token: 500ms, total: 2.5s, tokens: 40, 20.0 tokens/s", metrics.String())
+
+	metrics.PromptTokens = 300
+	metrics.Retries = 2
+	assert.Equal(t, "first token: 500ms, total: 2.5s, tokens: 40, 20.0 tokens/s, prompt tokens: 300, retries: 2", metrics.String())
+}
+
+func getMarkdownWriter(width int) (*bytes.Buffer, *StyleCodeblocksWriter) {
+	buffer := new(bytes.Buffer)
+	return buffer, NewStyleCodeblocksWriter(buffer, width, "", "", "")
+}
+
+// Writing a byte at a time has to come out the same as writing it all at once
+func assertStreamed(t *testing.T, width int, input, expected string) {
+	buffer, writer := getMarkdownWriter(width)
+	writer.Write([]byte(input))
+	assert.Equal(t, expected, buffer.String())
+
+	buffer, writer = getMarkdownWriter(width)
+	for _, char := range []byte(input) {
+		writer.Write([]byte{char})
+	}
+	assert.Equal(t, expected, buffer.String())
+}
+
+func TestMarkdownHeadings(t *testing.T) {
+	assertStreamed(t, 80,
+		"# Title\n## Section\n#include <stdio.h>\n",
+		"\x1b[1;4mTitle\x1b[0m\n\x1b[1mSection\x1b[0m\n#include <stdio.h>\n")
+}
+
+func TestMarkdownLists(t *testing.T) {
+	assertStreamed(t, 80,
+		"- one\n  * nested\n1. first\n2024 was a year\n---\n**bold**\n",
+		"• one\n  • nested\n1. first\n2024 was a year\n---\n**bold**\n")
+
+	// long items are redrawn with the text lined up after the bullet
+	assertStreamed(t, 20,
+		"  - alpha beta gamma delta\n",
+		"  • alpha beta gamma delta\x1b[1A\r\x1b[J  • alpha beta gamma\n    delta\n")
+}
+
+func TestMarkdownTables(t *testing.T) {
+	assertStreamed(t, 80,
+		"| Name | Size |\n|:---|---:|\n| a | 1 |\n| `bb` | 1000 |\nDone",
+		"| Name | Size |\r\x1b[JName │ Size\n"+
+			"|:---|---:|\x1b[1A\r\x1b[J\x1b[1mName │ Size\x1b[0m\n─────┼─────\n"+
+			"| a | 1 |\x1b[2A\r\x1b[J\x1b[1mName │ Size\x1b[0m\n─────┼─────\na    │    1\n"+
+			"| `bb` | 1000 |\x1b[3A\r\x1b[J\x1b[1mName │ Size\x1b[0m\n─────┼─────\na    │    1\nbb   │ 1000\n"+
+			"Done")
+}
+
+func TestNoHighlightTheme(t *testing.T) {
+	assert.Nil(t, ValidateTheme("dracula"))
+	assert.Nil(t, ValidateTheme(NoHighlightTheme))
+	assert.ErrorContains(t, ValidateTheme("dracul"), "Unknown theme dracul")
+
+	buffer := new(bytes.Buffer)
+	writer := NewStyleCodeblocksWriter(buffer, 80, "", "", NoHighlightTheme)
+	writer.Write([]byte("## Usage\n```go\nfmt.Println(1)\n```\n| a | b |\n|---|---|\n"))
+	assert.Equal(t, "Usage\n\rfmt.Println(1)\n| a | b |\r\x1b[Ja │ b\n|---|---|\x1b[1A\r\x1b[Ja │ b\n──┼──\n", buffer.String())
+}